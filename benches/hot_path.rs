@@ -0,0 +1,36 @@
+use std::error::Error;
+use std::process;
+use tpauth::bench;
+
+// enough samples for the 99th percentile to be told by more than a single one
+const ITERATIONS: usize = 1000;
+
+fn main() -> Result<(), Box<dyn Error>> {
+    bench::setup()?;
+    let token = bench::login()?;
+
+    let reports = vec![
+        bench::measure("signup", ITERATIONS, bench::signup)?,
+        bench::measure("login", ITERATIONS, || bench::login().map(|_| ()))?,
+        bench::measure("validation", ITERATIONS, || bench::validate(&token))?,
+    ];
+
+    let mut failed = false;
+    println!("{:<12} {:>8} {:>12} {:>12} {:>12} {:>12}", "bench", "samples", "median", "budget", "p99", "budget");
+    for report in reports.iter() {
+        let (budget, ok) = match report.check() {
+            Some(check) => check,
+            None => continue,
+        };
+
+        println!("{:<12} {:>8} {:>12?} {:>12?} {:>12?} {:>12?} {}", report.get_name(), report.len(),
+            report.median(), budget.median, report.p99(), budget.p99, if ok {"ok"} else {"OVER BUDGET"});
+        failed |= !ok;
+    }
+
+    if failed {
+        process::exit(1);
+    }
+
+    Ok(())
+}
@@ -1,10 +1,43 @@
+use std::env;
 use std::error::Error;
+use std::path::PathBuf;
+
+// all the protos served by the service, compiled along with their descriptors so they can be served by reflection
+const PROTOS: &[&str] = &[
+    "proto/user.proto",
+    "proto/app.proto",
+    "proto/session.proto",
+    "proto/session_v2.proto",
+    "proto/policy.proto",
+    "proto/invitation.proto",
+    "proto/device.proto",
+    "proto/apikey.proto",
+    "proto/backup.proto",
+    "proto/firewall.proto",
+    "proto/credential.proto",
+    "proto/identity.proto",
+    "proto/recovery.proto",
+    "proto/admin.proto",
+];
+
+// protos of the services the service is a client of only, such as external risk scorers, claims enrichers or
+// authorizers
+const CLIENT_PROTOS: &[&str] = &[
+    "proto/risk.proto",
+    "proto/claims.proto",
+    "proto/authorization.proto",
+];
 
 fn main()->Result<(),Box<dyn Error>>{
     // compiling protos using path on build time
-    tonic_build::compile_protos("proto/user.proto")?;
-    tonic_build::compile_protos("proto/app.proto")?;
-    tonic_build::compile_protos("proto/session.proto")?;
+    let out_dir = PathBuf::from(env::var("OUT_DIR")?);
+    tonic_build::configure()
+        .file_descriptor_set_path(out_dir.join("tpauth_descriptor.bin"))
+        .compile(PROTOS, &["proto"])?;
+
+    tonic_build::configure()
+        .build_server(false)
+        .compile(CLIENT_PROTOS, &["proto"])?;
 
     Ok(())
-}
\ No newline at end of file
+}
@@ -0,0 +1,119 @@
+use std::env;
+use std::error::Error;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+use tonic::transport::Endpoint;
+use tpauth::bench::Report;
+use tpauth::client::Client;
+
+mod proto {
+    tonic::include_proto!("user");
+}
+
+use proto::user_service_client::UserServiceClient;
+use proto::SignupRequest;
+
+const USAGE: &str = "usage: loadtest <url> <signup|login|validation> <email> <pwd> <app> [concurrency] [requests]";
+
+type BoxError = Box<dyn Error + Send + Sync>;
+
+// the requests sent so far by all the workers, so they stop once all of them have been sent
+static SENT: AtomicUsize = AtomicUsize::new(0);
+
+struct Target {
+    url: String,
+    scenario: String,
+    email: String,
+    pwd: String,
+    app: String,
+}
+
+async fn signup(target: &Target, client: &mut UserServiceClient<tonic::transport::Channel>, seq: usize) -> Result<(), BoxError> {
+    let (name, domain) = target.email.split_once('@').ok_or("email must be well formatted")?;
+    let request = SignupRequest {
+        email: format!("{}+{}-{}@{}", name, std::process::id(), seq, domain),
+        pwd: target.pwd.clone(),
+        ..Default::default()
+    };
+
+    client.signup(request).await?;
+    Ok(())
+}
+
+// sends requests of the scenario until all of them have been sent, returning how long each one took
+async fn worker(target: Arc<Target>, requests: usize) -> Result<(Vec<Duration>, usize), BoxError> {
+    let session = Client::new(&target.url).map_err(|err| err.to_string())?;
+    let channel = Endpoint::from_shared(target.url.clone())?.connect_lazy()?;
+    let mut users = UserServiceClient::new(channel);
+
+    // validations are all made by the same token, as a gateway validating the cookie of a busy user would
+    if target.scenario == "validation" {
+        session.login(&target.email, &target.pwd, "", &target.app).await?;
+    }
+
+    let mut samples = Vec::new();
+    let mut failures = 0;
+    loop {
+        let seq = SENT.fetch_add(1, Ordering::SeqCst);
+        if seq >= requests {
+            return Ok((samples, failures));
+        }
+
+        let start = Instant::now();
+        let result = match target.scenario.as_str() {
+            "signup" => signup(&target, &mut users, seq).await,
+            "login" => session.login(&target.email, &target.pwd, "", &target.app).await.map_err(Into::into),
+            _ => match session.token().await {
+                Ok(token) => session.validate(&token).await.map(|_| ()).map_err(Into::into),
+                Err(status) => Err(status.into()),
+            },
+        };
+
+        samples.push(start.elapsed());
+        if let Err(err) = result {
+            eprintln!("request {} has failed: {}", seq, err);
+            failures += 1;
+        }
+    }
+}
+
+#[tokio::main]
+async fn main() -> Result<(), Box<dyn Error>> {
+    let args: Vec<String> = env::args().collect();
+    if args.len() < 6 || !["signup", "login", "validation"].contains(&args[2].as_str()) {
+        return Err(USAGE.into());
+    }
+
+    let concurrency: usize = args.get(6).map(|arg| arg.parse()).transpose()?.unwrap_or(16);
+    let requests: usize = args.get(7).map(|arg| arg.parse()).transpose()?.unwrap_or(10000);
+    let target = Arc::new(Target {
+        url: args[1].clone(),
+        scenario: args[2].clone(),
+        email: args[3].clone(),
+        pwd: args[4].clone(),
+        app: args[5].clone(),
+    });
+
+    let start = Instant::now();
+    let workers: Vec<_> = (0..concurrency)
+        .map(|_| tokio::spawn(worker(target.clone(), requests)))
+        .collect();
+
+    let mut samples = Vec::new();
+    let mut failures = 0;
+    for worker in workers {
+        let (worker_samples, worker_failures) = worker.await?.map_err(|err| err.to_string())?;
+        samples.extend(worker_samples);
+        failures += worker_failures;
+    }
+
+    let elapsed = start.elapsed();
+    let report = Report::new(&target.scenario, samples);
+    println!("{}: {} requests ({} failed) in {:?} by {} workers, {:.0} requests per second",
+        report.get_name(), report.len(), failures, elapsed, concurrency, report.len() as f64 / elapsed.as_secs_f64());
+    println!("median {:?}, p90 {:?}, p99 {:?}, max {:?}",
+        report.median(), report.percentile(90.0), report.p99(), report.percentile(100.0));
+
+    Ok(())
+}
@@ -0,0 +1,4 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Users
+    DROP COLUMN suspended_at,
+    DROP COLUMN admin;
\ No newline at end of file
@@ -0,0 +1,4 @@
+-- Your SQL goes here
+ALTER TABLE Users
+    ADD COLUMN suspended_at TIMESTAMP DEFAULT NULL,
+    ADD COLUMN admin BOOLEAN NOT NULL DEFAULT FALSE;
\ No newline at end of file
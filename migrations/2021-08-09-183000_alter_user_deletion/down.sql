@@ -0,0 +1,3 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Users
+    DROP COLUMN deleted_at;
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- Your SQL goes here
+ALTER TABLE Users
+    ADD COLUMN deleted_at TIMESTAMP DEFAULT NULL;
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Users
+    DROP COLUMN terms_version,
+    DROP COLUMN privacy_version;
+
+DROP TABLE Policies;
\ No newline at end of file
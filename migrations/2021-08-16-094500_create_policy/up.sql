@@ -0,0 +1,16 @@
+-- Your SQL goes here
+CREATE TABLE Policies (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(32) NOT NULL,
+    version INTEGER NOT NULL,
+    url VARCHAR(256) NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    UNIQUE (kind, version),
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
+
+ALTER TABLE Users
+    ADD COLUMN terms_version INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN privacy_version INTEGER NOT NULL DEFAULT 0;
\ No newline at end of file
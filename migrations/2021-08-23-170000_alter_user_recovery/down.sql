@@ -0,0 +1,4 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Users
+    DROP COLUMN recovery_email,
+    DROP COLUMN recovery_until;
\ No newline at end of file
@@ -0,0 +1,4 @@
+-- Your SQL goes here
+ALTER TABLE Users
+    ADD COLUMN recovery_email VARCHAR(64) DEFAULT NULL,
+    ADD COLUMN recovery_until TIMESTAMP DEFAULT NULL;
\ No newline at end of file
@@ -0,0 +1,12 @@
+-- Your SQL goes here
+CREATE TABLE Emails (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    email VARCHAR(64) NOT NULL UNIQUE,
+
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX idx_emails_user_id ON Emails(user_id);
\ No newline at end of file
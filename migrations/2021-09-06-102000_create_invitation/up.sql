@@ -0,0 +1,18 @@
+-- Your SQL goes here
+CREATE TABLE Invitations (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    email VARCHAR(64) NOT NULL,
+    issuer INTEGER NOT NULL,
+    admin BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    FOREIGN KEY (issuer)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
\ No newline at end of file
@@ -0,0 +1,12 @@
+-- Your SQL goes here
+CREATE TABLE Attributes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    value VARCHAR(256) NOT NULL,
+
+    UNIQUE (user_id, name),
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE
+);
\ No newline at end of file
@@ -0,0 +1,18 @@
+-- Your SQL goes here
+CREATE TABLE Devices (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    fingerprint VARCHAR(256) NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    trusted_at TIMESTAMP,
+    last_seen_at TIMESTAMP NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    UNIQUE (user_id, fingerprint),
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
\ No newline at end of file
@@ -0,0 +1,18 @@
+-- Your SQL goes here
+CREATE TABLE Apikeys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    prefix VARCHAR(8) NOT NULL UNIQUE,
+    hash VARCHAR(64) NOT NULL,
+    scopes VARCHAR(256) NOT NULL,
+    last_used_at TIMESTAMP,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
\ No newline at end of file
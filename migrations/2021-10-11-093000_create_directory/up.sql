@@ -0,0 +1,17 @@
+-- Your SQL goes here
+CREATE TABLE Directories (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    app_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    touch_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    UNIQUE (user_id, app_id),
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (app_id)
+        REFERENCES Apps(id)
+        ON DELETE CASCADE
+);
\ No newline at end of file
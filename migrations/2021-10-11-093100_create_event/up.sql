@@ -0,0 +1,12 @@
+-- Your SQL goes here
+CREATE TABLE Events (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    issuer INTEGER NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    reason VARCHAR(256) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    touch_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX events_by_user ON Events (user_id, created_at DESC);
\ No newline at end of file
@@ -0,0 +1,22 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Emails
+    ADD CONSTRAINT emails_email_key UNIQUE (email);
+
+ALTER TABLE Apikeys
+    DROP COLUMN tenant_id;
+
+ALTER TABLE Invitations
+    DROP COLUMN tenant_id;
+
+ALTER TABLE Apps
+    DROP CONSTRAINT apps_tenant_url_key,
+    DROP COLUMN tenant_id,
+    ADD CONSTRAINT apps_url_key UNIQUE (url);
+
+ALTER TABLE Users
+    DROP CONSTRAINT users_tenant_email_key,
+    DROP COLUMN tenant_id,
+    ADD CONSTRAINT users_email_key UNIQUE (email);
+
+DROP TABLE Tenant_settings;
+DROP TABLE Tenants;
@@ -0,0 +1,53 @@
+-- Your SQL goes here
+CREATE TABLE Tenants (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
+
+CREATE TABLE Tenant_settings (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    value VARCHAR(256) NOT NULL,
+
+    UNIQUE (tenant_id, name),
+
+    FOREIGN KEY (tenant_id)
+        REFERENCES Tenants(id)
+        ON DELETE CASCADE
+);
+
+-- all the data existing so far belongs to the default tenant, whose id must be 1
+WITH meta AS (
+    INSERT INTO Metadata (created_at, updated_at)
+    VALUES (NOW(), NOW())
+    RETURNING id
+)
+INSERT INTO Tenants (id, name, meta_id)
+SELECT 1, 'default', id FROM meta;
+
+SELECT setval('tenants_id_seq', 1);
+
+ALTER TABLE Users
+    ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 1 REFERENCES Tenants(id),
+    DROP CONSTRAINT users_email_key,
+    ADD CONSTRAINT users_tenant_email_key UNIQUE (tenant_id, email);
+
+ALTER TABLE Apps
+    ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 1 REFERENCES Tenants(id),
+    DROP CONSTRAINT apps_url_key,
+    ADD CONSTRAINT apps_tenant_url_key UNIQUE (tenant_id, url);
+
+ALTER TABLE Invitations
+    ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 1 REFERENCES Tenants(id);
+
+ALTER TABLE Apikeys
+    ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 1 REFERENCES Tenants(id);
+
+-- aliases are unique per tenant, which is ensured by the service itself
+ALTER TABLE Emails
+    DROP CONSTRAINT emails_email_key;
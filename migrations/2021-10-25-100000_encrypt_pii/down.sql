@@ -0,0 +1,19 @@
+-- This file should undo anything in `up.sql`
+-- values must have been decrypted before, otherwise they do not fit anymore
+ALTER TABLE Invitations
+    ALTER COLUMN email TYPE VARCHAR(64);
+
+ALTER TABLE Attributes
+    ALTER COLUMN value TYPE VARCHAR(256);
+
+DROP INDEX IF EXISTS idx_emails_email_hash;
+
+ALTER TABLE Emails
+    DROP COLUMN email_hash,
+    ALTER COLUMN email TYPE VARCHAR(64);
+
+ALTER TABLE Users
+    DROP CONSTRAINT users_tenant_email_hash_key,
+    DROP COLUMN email_hash,
+    ALTER COLUMN recovery_email TYPE VARCHAR(64),
+    ALTER COLUMN email TYPE VARCHAR(64);
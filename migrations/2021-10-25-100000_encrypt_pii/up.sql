@@ -0,0 +1,19 @@
+-- Your SQL goes here
+-- encrypted values are longer than plain ones, while emails are found by their blind index
+ALTER TABLE Users
+    ALTER COLUMN email TYPE VARCHAR(512),
+    ALTER COLUMN recovery_email TYPE VARCHAR(512),
+    ADD COLUMN email_hash VARCHAR(64) DEFAULT NULL,
+    ADD CONSTRAINT users_tenant_email_hash_key UNIQUE (tenant_id, email_hash);
+
+ALTER TABLE Emails
+    ALTER COLUMN email TYPE VARCHAR(512),
+    ADD COLUMN email_hash VARCHAR(64) DEFAULT NULL;
+
+CREATE INDEX idx_emails_email_hash ON Emails(email_hash);
+
+ALTER TABLE Attributes
+    ALTER COLUMN value TYPE VARCHAR(1024);
+
+ALTER TABLE Invitations
+    ALTER COLUMN email TYPE VARCHAR(512);
@@ -0,0 +1,3 @@
+-- This file should undo anything in `up.sql`
+DROP INDEX events_unpublished;
+ALTER TABLE Events DROP COLUMN published_at;
@@ -0,0 +1,7 @@
+-- Your SQL goes here
+ALTER TABLE Events ADD COLUMN published_at TIMESTAMP DEFAULT NULL;
+
+-- events recorded before the outbox existed are not relayed
+UPDATE Events SET published_at = created_at;
+
+CREATE INDEX events_unpublished ON Events (id) WHERE published_at IS NULL;
@@ -0,0 +1,16 @@
+-- Your SQL goes here
+CREATE TABLE IpRules (
+    id SERIAL PRIMARY KEY,
+    cidr VARCHAR(64) NOT NULL,
+    action VARCHAR(8) NOT NULL,
+    scope VARCHAR(64) NOT NULL DEFAULT '',
+    apikey_id INTEGER,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    FOREIGN KEY (apikey_id)
+        REFERENCES Apikeys(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
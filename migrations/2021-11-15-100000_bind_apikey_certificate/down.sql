@@ -0,0 +1,4 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Apikeys
+    DROP CONSTRAINT apikeys_tenant_certificate_key,
+    DROP COLUMN certificate;
@@ -0,0 +1,5 @@
+-- Your SQL goes here
+-- the identity of the client certificate the key is bound to, so clients presenting it need no api key header
+ALTER TABLE Apikeys
+    ADD COLUMN certificate VARCHAR(256) DEFAULT NULL,
+    ADD CONSTRAINT apikeys_tenant_certificate_key UNIQUE (tenant_id, certificate);
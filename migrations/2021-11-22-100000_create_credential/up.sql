@@ -0,0 +1,16 @@
+-- Your SQL goes here
+CREATE TABLE Credentials (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    public_key VARCHAR(512) NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    UNIQUE (user_id, name),
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
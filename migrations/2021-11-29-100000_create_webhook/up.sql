@@ -0,0 +1,38 @@
+-- Your SQL goes here
+CREATE TABLE Webhooks (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    url VARCHAR(256) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    topics VARCHAR(256) NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    FOREIGN KEY (tenant_id)
+        REFERENCES Tenants(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
+
+CREATE TABLE Deliveries (
+    id SERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL,
+    event_id VARCHAR(32) NOT NULL,
+    topic VARCHAR(32) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response INTEGER NOT NULL DEFAULT 0,
+    error VARCHAR(256) NOT NULL DEFAULT '',
+    next_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    touch_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (webhook_id)
+        REFERENCES Webhooks(id)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX deliveries_by_webhook ON Deliveries (webhook_id, created_at DESC);
+CREATE INDEX deliveries_pending ON Deliveries (next_at) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+-- This file should undo anything in `up.sql`
+DROP TABLE Group_Members;
+DROP TABLE Groups;
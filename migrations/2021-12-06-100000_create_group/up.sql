@@ -0,0 +1,30 @@
+-- Your SQL goes here
+CREATE TABLE Groups (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    UNIQUE (tenant_id, name),
+    FOREIGN KEY (tenant_id)
+        REFERENCES Tenants(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
+
+CREATE TABLE Group_Members (
+    id SERIAL PRIMARY KEY,
+    group_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+
+    UNIQUE (group_id, user_id),
+    FOREIGN KEY (group_id)
+        REFERENCES Groups(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE
+);
@@ -0,0 +1,21 @@
+-- Your SQL goes here
+CREATE TABLE Identities (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    UNIQUE (tenant_id, provider, subject),
+    FOREIGN KEY (tenant_id)
+        REFERENCES Tenants(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
@@ -0,0 +1,8 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Apps
+    DROP COLUMN brand_name,
+    DROP COLUMN logo_url,
+    DROP COLUMN primary_color,
+    DROP COLUMN accent_color,
+    DROP COLUMN support_url,
+    DROP COLUMN support_email;
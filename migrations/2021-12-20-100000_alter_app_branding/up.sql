@@ -0,0 +1,9 @@
+-- Your SQL goes here
+-- how the app presents itself on the hosted pages and the emails sent on its behalf
+ALTER TABLE Apps
+    ADD COLUMN brand_name VARCHAR(64) DEFAULT NULL,
+    ADD COLUMN logo_url VARCHAR(2048) DEFAULT NULL,
+    ADD COLUMN primary_color VARCHAR(7) DEFAULT NULL,
+    ADD COLUMN accent_color VARCHAR(7) DEFAULT NULL,
+    ADD COLUMN support_url VARCHAR(2048) DEFAULT NULL,
+    ADD COLUMN support_email VARCHAR(64) DEFAULT NULL;
@@ -0,0 +1,18 @@
+-- Your SQL goes here
+CREATE TABLE Templates (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    version INTEGER NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    UNIQUE (tenant_id, kind, version),
+    FOREIGN KEY (tenant_id)
+        REFERENCES Tenants(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
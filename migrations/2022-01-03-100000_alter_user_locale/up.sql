@@ -0,0 +1,4 @@
+-- Your SQL goes here
+-- the locale emails are sent in, if not the default one
+ALTER TABLE Users
+    ADD COLUMN locale VARCHAR(16) DEFAULT NULL;
@@ -0,0 +1,4 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Users
+    DROP COLUMN terms_accepted_at,
+    DROP COLUMN privacy_accepted_at;
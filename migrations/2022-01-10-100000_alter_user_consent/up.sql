@@ -0,0 +1,9 @@
+-- Your SQL goes here
+-- when the accepted versions of the policies were accepted, so consents can expire
+ALTER TABLE Users
+    ADD COLUMN terms_accepted_at TIMESTAMP DEFAULT NULL,
+    ADD COLUMN privacy_accepted_at TIMESTAMP DEFAULT NULL;
+
+-- consents given before are taken as given right now
+UPDATE Users SET terms_accepted_at = NOW() WHERE terms_version > 0;
+UPDATE Users SET privacy_accepted_at = NOW() WHERE privacy_version > 0;
@@ -0,0 +1,9 @@
+-- Your SQL goes here
+CREATE TABLE Signing_keys (
+    id SERIAL PRIMARY KEY,
+    secret TEXT NOT NULL,
+    public_key TEXT NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    activates_at TIMESTAMP NOT NULL UNIQUE
+);
@@ -0,0 +1,9 @@
+-- Your SQL goes here
+CREATE TABLE Revocations (
+    id SERIAL PRIMARY KEY,
+    sid VARCHAR(64) NOT NULL,
+    revoked_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX revocations_by_sid ON Revocations (sid);
@@ -0,0 +1,2 @@
+-- This file should undo anything in `up.sql`
+DROP INDEX invitations_by_expiration;
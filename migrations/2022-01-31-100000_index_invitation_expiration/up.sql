@@ -0,0 +1,2 @@
+-- Your SQL goes here
+CREATE INDEX invitations_by_expiration ON Invitations (expires_at);
@@ -0,0 +1,11 @@
+-- This file should undo anything in `up.sql`
+DROP INDEX events_by_created_at;
+DROP INDEX events_by_ip;
+DROP INDEX events_by_app;
+DROP INDEX events_by_kind;
+DROP INDEX events_by_issuer;
+DROP INDEX events_by_user;
+CREATE INDEX events_by_user ON Events (user_id, created_at DESC);
+
+ALTER TABLE Events DROP COLUMN ip;
+ALTER TABLE Events DROP COLUMN app;
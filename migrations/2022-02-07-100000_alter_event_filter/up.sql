@@ -0,0 +1,12 @@
+-- Your SQL goes here
+ALTER TABLE Events ADD COLUMN app VARCHAR(256) NOT NULL DEFAULT '';
+ALTER TABLE Events ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT '';
+
+-- events are paged by id, the latest first, whatever they are filtered by
+DROP INDEX events_by_user;
+CREATE INDEX events_by_user ON Events (user_id, id DESC);
+CREATE INDEX events_by_issuer ON Events (issuer, id DESC);
+CREATE INDEX events_by_kind ON Events (kind, id DESC);
+CREATE INDEX events_by_app ON Events (app, id DESC) WHERE app <> '';
+CREATE INDEX events_by_ip ON Events (ip, id DESC) WHERE ip <> '';
+CREATE INDEX events_by_created_at ON Events (created_at);
@@ -0,0 +1,37 @@
+-- Your SQL goes here
+CREATE TABLE Contacts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    email VARCHAR(512) NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
+
+CREATE INDEX contacts_by_user ON Contacts (user_id);
+
+CREATE TABLE Recoveries (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    quorum INTEGER NOT NULL,
+    approvals VARCHAR(256) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    FOREIGN KEY (user_id)
+        REFERENCES Users(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
+
+-- stale recoveries are looked up by their expiration
+CREATE INDEX recoveries_by_expiration ON Recoveries (expires_at);
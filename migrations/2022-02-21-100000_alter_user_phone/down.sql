@@ -0,0 +1,9 @@
+-- This file should undo anything in `up.sql`
+DROP INDEX IF EXISTS users_tenant_verified_phone_key;
+
+ALTER TABLE Users
+    DROP COLUMN phone,
+    DROP COLUMN phone_hash,
+    DROP COLUMN phone_verified_at,
+    DROP COLUMN phone_code,
+    DROP COLUMN phone_code_until;
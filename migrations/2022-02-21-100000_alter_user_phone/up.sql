@@ -0,0 +1,11 @@
+-- Your SQL goes here
+ALTER TABLE Users
+    ADD COLUMN phone VARCHAR(512) DEFAULT NULL,
+    ADD COLUMN phone_hash VARCHAR(64) DEFAULT NULL,
+    ADD COLUMN phone_verified_at TIMESTAMP DEFAULT NULL,
+    ADD COLUMN phone_code VARCHAR(64) DEFAULT NULL,
+    ADD COLUMN phone_code_until TIMESTAMP DEFAULT NULL;
+
+-- a phone number may be pending verification by many users, but verified by a single one within a tenant
+CREATE UNIQUE INDEX users_tenant_verified_phone_key ON Users (tenant_id, phone_hash)
+    WHERE phone_verified_at IS NOT NULL AND deleted_at IS NULL;
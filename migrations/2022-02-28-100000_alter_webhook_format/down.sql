@@ -0,0 +1,3 @@
+-- This file should undo anything in `up.sql`
+ALTER TABLE Webhooks
+    DROP COLUMN format;
@@ -0,0 +1,4 @@
+-- Your SQL goes here
+-- webhooks registered so far keep being delivered as plain json
+ALTER TABLE Webhooks
+    ADD COLUMN format VARCHAR(8) NOT NULL DEFAULT 'json';
@@ -0,0 +1,6 @@
+-- This file should undo anything in `up.sql`
+DROP INDEX IF EXISTS users_tenant_username_key;
+
+ALTER TABLE Users
+    DROP COLUMN username,
+    DROP COLUMN username_hash;
@@ -0,0 +1,8 @@
+-- Your SQL goes here
+ALTER TABLE Users
+    ADD COLUMN username VARCHAR(512) DEFAULT NULL,
+    ADD COLUMN username_hash VARCHAR(64) DEFAULT NULL;
+
+-- the blind index is taken from the lowercased username, so usernames never collide by their case within a tenant
+CREATE UNIQUE INDEX users_tenant_username_key ON Users (tenant_id, username_hash)
+    WHERE deleted_at IS NULL;
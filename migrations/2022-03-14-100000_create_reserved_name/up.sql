@@ -0,0 +1,16 @@
+-- Your SQL goes here
+CREATE TABLE ReservedNames (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    word VARCHAR(64) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    meta_id INTEGER NOT NULL UNIQUE,
+
+    UNIQUE (tenant_id, word, kind),
+    FOREIGN KEY (tenant_id)
+        REFERENCES Tenants(id)
+        ON DELETE CASCADE,
+
+    FOREIGN KEY (meta_id)
+        REFERENCES Metadata(id)
+);
@@ -0,0 +1,5 @@
+-- This file should undo anything in `up.sql`
+DROP INDEX IF EXISTS users_activation_deadline_idx;
+
+ALTER TABLE Users
+    DROP COLUMN activation_deadline;
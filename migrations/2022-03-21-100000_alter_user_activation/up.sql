@@ -0,0 +1,7 @@
+-- Your SQL goes here
+ALTER TABLE Users
+    ADD COLUMN activation_deadline TIMESTAMP DEFAULT NULL;
+
+-- pending accounts are looked up by their deadline once in a while, so the expired ones get removed
+CREATE INDEX users_activation_deadline_idx ON Users (activation_deadline)
+    WHERE activation_deadline IS NOT NULL;
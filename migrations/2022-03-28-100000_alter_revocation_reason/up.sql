@@ -0,0 +1,3 @@
+-- Your SQL goes here
+ALTER TABLE Revocations
+    ADD COLUMN reason VARCHAR(32) NOT NULL DEFAULT '';
@@ -0,0 +1,287 @@
+#!/usr/bin/python3
+
+# Builds the OpenAPI 3 document of the http/json gateway out of the proto files of the services it transcodes, as
+# listed by the envoy config. Every method is reached by POST /<package>.<service>/<method>, with the json form of its
+# request message as the body, and field names are the ones of the proto files
+
+import json
+import os
+import re
+import sys
+
+PROTO_DIR = "proto"
+ENVOY_CONFIG = os.path.join("envoy", "envoy.yaml")
+TARGET_FILE = sys.argv[1] if len(sys.argv) > 1 else os.path.join("envoy", "openapi.json")
+TITLE = "tpauth"
+VERSION = "0.2.0"
+
+SERVICES_REGEX = re.compile(r"services:\s*\[([^\]]*)\]")
+TOKEN_REGEX = re.compile(r'//[^\n]*|"(?:[^"\\]|\\.)*"|<|>|[A-Za-z_][A-Za-z0-9_.]*|-?\d+|\S')
+
+# how each scalar is mapped into json, as told by the proto3 json mapping
+SCALARS = {
+    "double": {"type": "number", "format": "double"},
+    "float": {"type": "number", "format": "float"},
+    "int32": {"type": "integer", "format": "int32"},
+    "sint32": {"type": "integer", "format": "int32"},
+    "sfixed32": {"type": "integer", "format": "int32"},
+    "uint32": {"type": "integer", "format": "int64", "minimum": 0},
+    "fixed32": {"type": "integer", "format": "int64", "minimum": 0},
+    "int64": {"type": "string", "format": "int64"},
+    "sint64": {"type": "string", "format": "int64"},
+    "sfixed64": {"type": "string", "format": "int64"},
+    "uint64": {"type": "string", "format": "uint64"},
+    "fixed64": {"type": "string", "format": "uint64"},
+    "bool": {"type": "boolean"},
+    "string": {"type": "string"},
+    "bytes": {"type": "string", "format": "byte"},
+}
+
+WELL_KNOWN = {
+    "google.protobuf.Empty": {"type": "object"},
+}
+
+def tokenize(content):
+    """returns the tokens of the given proto file, each one along with the line it belongs to"""
+    tokens = []
+    for number, line in enumerate(content.splitlines()):
+        for token in TOKEN_REGEX.findall(line):
+            tokens.append((token, number))
+    return tokens
+
+def trailing_comment(tokens, index):
+    """returns the comment at the end of the line of the token at the given index, if any"""
+    line = tokens[index][1]
+    while index < len(tokens) and tokens[index][1] == line:
+        if tokens[index][0].startswith("//"):
+            return tokens[index][0][2:].strip()
+        index += 1
+    return ""
+
+class Parser:
+    def __init__(self, tokens):
+        self.tokens = tokens
+        self.index = 0
+        self.package = ""
+        self.messages = {}
+        self.enums = {}
+        self.services = {}
+
+    def peek(self):
+        while self.index < len(self.tokens) and self.tokens[self.index][0].startswith("//"):
+            self.index += 1
+        return self.tokens[self.index][0] if self.index < len(self.tokens) else None
+
+    def next(self):
+        token = self.peek()
+        self.index += 1
+        return token
+
+    def skip_statement(self):
+        while self.next() not in (";", None):
+            pass
+
+    def parse(self):
+        while self.peek() is not None:
+            token = self.next()
+            if token == "package":
+                self.package = self.next()
+                self.skip_statement()
+            elif token == "message":
+                self.parse_message(self.package)
+            elif token == "enum":
+                self.parse_enum(self.package)
+            elif token == "service":
+                self.parse_service()
+            elif token in ("syntax", "import", "option"):
+                self.skip_statement()
+        return self
+
+    def parse_enum(self, scope):
+        name = "{}.{}".format(scope, self.next())
+        self.next() # {
+        values = []
+        while self.peek() != "}":
+            value = self.next()
+            if self.peek() == "=":
+                values.append(value)
+            self.skip_statement()
+        self.next() # }
+        self.enums[name] = values
+
+    def parse_message(self, scope):
+        name = "{}.{}".format(scope, self.next())
+        self.next() # {
+        fields = []
+        while self.peek() != "}":
+            start = self.index
+            token = self.next()
+            if token == "message":
+                self.parse_message(name)
+            elif token == "enum":
+                self.parse_enum(name)
+            elif token in ("option", "reserved"):
+                self.skip_statement()
+            elif token == "oneof":
+                self.next() # name
+                self.next() # {
+                while self.peek() != "}":
+                    fields.append(self.parse_field(self.next(), False, self.index - 1))
+                self.next() # }
+            else:
+                repeated = token == "repeated"
+                if repeated:
+                    token = self.next()
+                fields.append(self.parse_field(token, repeated, start))
+        self.next() # }
+        self.messages[name] = (scope, fields)
+
+    def parse_field(self, kind, repeated, start):
+        key = None
+        if kind == "map":
+            self.next() # <
+            key = self.next()
+            self.next() # ,
+            kind = self.next()
+            self.next() # >
+        name = self.next()
+        description = trailing_comment(self.tokens, start)
+        self.skip_statement()
+        return {"name": name, "kind": kind, "repeated": repeated, "map": key is not None, "description": description}
+
+    def parse_service(self):
+        name = "{}.{}".format(self.package, self.next())
+        self.next() # {
+        methods = []
+        while self.peek() != "}":
+            token = self.next()
+            if token != "rpc":
+                continue
+            method = self.next()
+            self.next() # (
+            request = self.next()
+            self.next() # )
+            self.next() # returns
+            self.next() # (
+            response = self.next()
+            self.next() # )
+            methods.append((method, request, response))
+            if self.next() == "{":
+                while self.next() != "}":
+                    pass
+        self.next() # }
+        self.services[name] = methods
+
+def resolve(kind, scope, known):
+    """returns the full name of the given type, as referenced from the given scope"""
+    if kind in known:
+        return kind
+
+    while True:
+        candidate = "{}.{}".format(scope, kind) if scope else kind
+        if candidate in known:
+            return candidate
+        if not scope:
+            return None
+        scope = scope.rpartition(".")[0]
+
+def get_schema(kind, scope, messages, enums):
+    if kind in SCALARS:
+        return dict(SCALARS[kind])
+    if kind in WELL_KNOWN:
+        return dict(WELL_KNOWN[kind])
+
+    name = resolve(kind, scope, set(messages) | set(enums))
+    if name is None:
+        return {"type": "object"}
+    return {"$ref": "#/components/schemas/{}".format(name)}
+
+def build(parsers, services):
+    messages, enums, all_services = {}, {}, {}
+    for parser in parsers:
+        messages.update(parser.messages)
+        enums.update(parser.enums)
+        all_services.update(parser.services)
+
+    schemas = {}
+    for name, values in enums.items():
+        schemas[name] = {"type": "string", "enum": values}
+
+    for name, (scope, fields) in messages.items():
+        properties = {}
+        for field in fields:
+            schema = get_schema(field["kind"], name, messages, enums)
+            if field["map"]:
+                schema = {"type": "object", "additionalProperties": schema}
+            elif field["repeated"]:
+                schema = {"type": "array", "items": schema}
+            if field["description"]:
+                schema = {"allOf": [schema], "description": field["description"]} if "$ref" in schema else dict(schema, description=field["description"])
+            properties[field["name"]] = schema
+        schemas[name] = {"type": "object", "properties": properties}
+
+    paths = {}
+    for service in services:
+        if service not in all_services:
+            print("Service {} is not declared by any proto file".format(service))
+            continue
+
+        package = service.rpartition(".")[0]
+        for method, request, response in all_services[service]:
+            operation = {
+                "operationId": "{}.{}".format(service, method),
+                "tags": [service],
+                "parameters": [{"$ref": "#/components/parameters/tenant"}],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "content": {"application/json": {"schema": get_schema(response, package, messages, enums)}},
+                    },
+                    "default": {
+                        "description": "The http status matching the grpc one, with the reason in the grpc-message header",
+                    },
+                },
+            }
+
+            if request not in WELL_KNOWN:
+                operation["requestBody"] = {
+                    "required": True,
+                    "content": {"application/json": {"schema": get_schema(request, package, messages, enums)}},
+                }
+
+            paths["/{}/{}".format(service, method)] = {"post": operation}
+
+    return {
+        "openapi": "3.0.3",
+        "info": {"title": TITLE, "version": VERSION},
+        "paths": paths,
+        "components": {
+            "schemas": schemas,
+            "parameters": {
+                "tenant": {"name": "tenant", "in": "header", "required": False, "schema": {"type": "string"}},
+            },
+            "securitySchemes": {
+                "token": {"type": "apiKey", "in": "header", "name": "token"},
+                "cookie": {"type": "apiKey", "in": "cookie", "name": "token"},
+            },
+        },
+        "security": [{}, {"token": []}, {"cookie": []}],
+    }
+
+config = open(ENVOY_CONFIG, "r").read()
+match = SERVICES_REGEX.search(config)
+if match is None:
+    sys.exit("No services are transcoded by {}".format(ENVOY_CONFIG))
+services = [service.strip().strip('"') for service in match.group(1).split(",")]
+
+parsers = []
+for file in sorted(os.listdir(PROTO_DIR)):
+    if file.endswith(".proto"):
+        print("Reading content from {}".format(os.path.join(PROTO_DIR, file)))
+        fo = open(os.path.join(PROTO_DIR, file), "r")
+        parsers.append(Parser(tokenize(fo.read())).parse())
+        fo.close()
+
+target = open(TARGET_FILE, "w")
+json.dump(build(parsers, services), target, indent=2, sort_keys=True)
+target.close()
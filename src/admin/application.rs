@@ -0,0 +1,441 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::constants::{environment, errors, settings};
+use crate::{config, i18n};
+use crate::security;
+use crate::keyring::application::keyring_refresh;
+use crate::signing::application::{signing_enabled, signing_revoke_previous};
+use crate::tenant::application::tenant_find;
+use crate::session::application::{session_revoke, session_count, session_count_by_app};
+use crate::session::domain::{LogoutCause, LogoutReason};
+use crate::{migration, metrics};
+use crate::pagination::Page;
+use crate::app::{
+    application::{app_create, app_remove},
+    get_repository as get_app_repository,
+};
+use crate::apikey::get_repository as get_apikey_repository;
+use crate::quota::{
+    application::quota_usage,
+    domain::Usage,
+};
+use crate::audit::{
+    application::{audit_record, audit_tail, audit_search, audit_verify},
+    domain::{Event, EventKind, Filter},
+};
+use crate::webhook::{
+    application::{webhook_register, webhook_delete, webhook_deliveries, webhook_replay},
+    domain::{Webhook, Delivery, Format},
+};
+use crate::template::{
+    application::{template_set, template_list, template_reset, template_preview},
+    domain::{Template, TemplateKind},
+};
+use crate::import::{
+    application::import_users,
+    domain::{Format, Conflict, ImportReport},
+};
+use crate::user::{
+    application::{get_admin_user, user_suspend_by, user_reinstate_by, user_flag_compromised, user_preregister},
+    get_repository as get_user_repository,
+    domain::User,
+};
+use crate::username::{
+    application::{reserved_add, reserved_delete, reserved_list},
+    domain::{ReservedName, DenyKind},
+};
+use crate::diagnostics::{Report, diagnose};
+use super::domain::{Binding, Role, Stats};
+
+/// Returns the roles granted to the administrator with the given email, as bound by ADMIN_ROLES. If no binding has
+/// been set at all, every administrator of the default tenant is granted for all of them
+fn get_roles(email: &str) -> Result<Vec<Role>, Box<dyn Error>> {
+    let bindings = match config::get(environment::ADMIN_ROLES) {
+        Ok(bindings) => Binding::from_list(&bindings)?,
+        Err(_) => return Ok(Role::all()),
+    };
+
+    Ok(Role::all().into_iter()
+        .filter(|role| bindings.iter().any(|binding| binding.get_email() == email && binding.has_role(*role)))
+        .collect())
+}
+
+/// Operational actions affect the whole service, so only administrators of the default tenant granted for any of the
+/// roles of the action are allowed to perform it. Returns the administrator the provided token belongs to
+fn check_operator(token: &str, allowed: &[Role]) -> Result<User, Box<dyn Error>> {
+    let admin = get_admin_user(token)?;
+    if admin.get_tenant() != settings::DEFAULT_TENANT {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    match get_roles(admin.get_email()) {
+        Ok(roles) if allowed.iter().any(|role| roles.contains(role)) => Ok(admin),
+        Ok(_) => Err(errors::UNAUTHORIZED.into()),
+        Err(err) => {
+            // a misconfigured binding grants nothing
+            error!("admin roles could not be parsed: {}", err);
+            Err(errors::UNAUTHORIZED.into())
+        }
+    }
+}
+
+/// If, and only if, the provided token belongs to a service operator, loads the config file again and applies the new
+/// value of all the reloadable settings, as well as the bundles of the locales, returning the names of the settings
+/// that changed
+pub fn admin_reload(token: &str) -> Result<Vec<String>, Box<dyn Error>> {
+    check_operator(token, &[Role::Service])?;
+    let changed = config::reload()?;
+    info!("config reloaded on demand, {} settings changed", changed.len());
+
+    // the bundles of the locales may have changed with no setting doing so
+    if let Err(err) = i18n::reload() {
+        error!("locales could not be reloaded, the current ones are kept: {}", err);
+    }
+
+    Ok(changed)
+}
+
+/// If, and only if, the provided token belongs to a key administrator, fetches again all the secrets in use, so the
+/// rotated keys get applied right away instead of once cached ones expire. Returns how many of them have been rotated
+pub fn admin_rotate(token: &str) -> Result<usize, Box<dyn Error>> {
+    check_operator(token, &[Role::KeyAdmin])?;
+    let rotated = keyring_refresh()?;
+    info!("secrets refreshed on demand, {} of them rotated", rotated);
+    Ok(rotated)
+}
+
+/// If, and only if, the provided token belongs to a key administrator, drops the signing key before the latest
+/// rotation, so the tokens signed by it are not valid anymore, such as when it has been compromised
+pub fn admin_revoke_key(token: &str) -> Result<(), Box<dyn Error>> {
+    check_operator(token, &[Role::KeyAdmin])?;
+    let revoked = if signing_enabled() {
+        signing_revoke_previous()?
+    } else {
+        security::revoke_previous_jwt_key()?
+    };
+
+    if !revoked {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    warn!("previous signing key revoked on demand");
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to a user administrator, all the sessions of the user with the given
+/// email, in the given tenant, get revoked and the reason recorded into the audit trail
+pub fn admin_revoke(token: &str,
+                    tenant: &str,
+                    email: &str,
+                    reason: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got an operational revocation request for user {} ", email);
+
+    let admin = check_operator(token, &[Role::UserAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    let user = get_user_repository().find_by_email(tenant.get_id(), email)?;
+    session_revoke(user.get_tenant(), user.get_email(), LogoutReason::Admin)?;
+
+    audit_record(user.get_id(), admin.get_id(), EventKind::Revoke, &LogoutReason::Admin.describe(reason));
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to a user administrator, the user with the given email, in the given
+/// tenant, gets suspended, all its sessions revoked and the reason recorded into the audit trail
+pub fn admin_suspend(token: &str,
+                     tenant: &str,
+                     email: &str,
+                     reason: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got an operational suspension request for user {} ", email);
+
+    let admin = check_operator(token, &[Role::UserAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    user_suspend_by(&admin, tenant.get_id(), email, reason)
+}
+
+/// If, and only if, the provided token belongs to a user administrator, the user with the given email, in the given
+/// tenant, is told to be compromised for the given cause: either credential_reuse or, if none, compromise. The user
+/// gets logged out everywhere, as the policy tells for that cause, and required to reset its password
+pub fn admin_flag_compromise(token: &str,
+                             tenant: &str,
+                             email: &str,
+                             cause: &str,
+                             reason: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got an operational compromise request for user {} ", email);
+
+    let cause = match cause {
+        "" => LogoutCause::Compromise,
+        cause => match LogoutCause::from_str(cause) {
+            Some(cause) if cause != LogoutCause::PasswordChange => cause,
+            _ => return Err(errors::PARSE_FAILED.into()),
+        },
+    };
+
+    let admin = check_operator(token, &[Role::UserAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    user_flag_compromised(&admin, tenant.get_id(), email, cause, reason)
+}
+
+/// If, and only if, the provided token belongs to a user administrator, the suspension of the user with the given
+/// email, in the given tenant, is lifted and the reason recorded into the audit trail
+pub fn admin_reinstate(token: &str,
+                       tenant: &str,
+                       email: &str,
+                       reason: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got an operational reinstatement request for user {} ", email);
+
+    let admin = check_operator(token, &[Role::UserAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    user_reinstate_by(&admin, tenant.get_id(), email, reason)
+}
+
+/// If, and only if, the provided token belongs to a user administrator, an account is pre-registered with the given
+/// email, in the given tenant, so the user can activate it within the given timeout, or the default one if zero
+pub fn admin_preregister(token: &str,
+                         tenant: &str,
+                         email: &str,
+                         timeout: u64,
+                         mfa: bool) -> Result<User, Box<dyn Error>> {
+
+    info!("got an operational pre-registration request for user {} ", email);
+
+    let admin = check_operator(token, &[Role::UserAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    let timeout = match timeout {
+        0 => settings::ACTIVATION_TIMEOUT,
+        timeout => timeout,
+    };
+
+    user_preregister(&admin, tenant.get_id(), email, Duration::from_secs(timeout), mfa)
+}
+
+/// If, and only if, the provided token belongs to a service operator, applies all the pending migrations on every
+/// database some repository is provided by
+pub fn admin_migrate(token: &str) -> Result<(), Box<dyn Error>> {
+    info!("got an operational migration request");
+
+    check_operator(token, &[Role::Service])?;
+    migration::migrate_up()
+}
+
+/// If, and only if, the provided token belongs to an auditor, returns up to limit events of the whole audit
+/// trail recorded after the one with the given id, the oldest first, or the latest ones if no id is given
+pub fn admin_events(token: &str, after: &str, limit: u64) -> Result<Vec<Event>, Box<dyn Error>> {
+    check_operator(token, &[Role::Auditor])?;
+    audit_tail(after, limit.min(settings::MAX_PAGE_SIZE))
+}
+
+/// If, and only if, the provided token belongs to an auditor, returns the given page of the events of the whole
+/// audit trail matching the given filter, the newest first, and the token of the next page, if any
+pub fn admin_search_events(token: &str, filter: &Filter, page: &Page) -> Result<(Vec<Event>, String), Box<dyn Error>> {
+    check_operator(token, &[Role::Auditor])?;
+    audit_search(filter, page)
+}
+
+/// If, and only if, the provided token belongs to an auditor, the whole audit trail is chained again and matched with
+/// its checkpoints. Returns how many checkpoints and events have been verified
+pub fn admin_verify_audit(token: &str) -> Result<(usize, usize), Box<dyn Error>> {
+    info!("got an audit trail verification request");
+    check_operator(token, &[Role::Auditor])?;
+    audit_verify(settings::CHECKPOINT_BATCH)
+}
+
+/// If, and only if, the provided token belongs to a client administrator and there is no app with the given url in the
+/// given tenant, a new app with these url and public key gets created, with no signature of the app required
+pub fn admin_create_app(token: &str, tenant: &str, url: &str, pem: &[u8]) -> Result<(), Box<dyn Error>> {
+    info!("got an operational creation request for application {} ", url);
+
+    check_operator(token, &[Role::ClientAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    app_create(tenant.get_id(), url, pem)?;
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to a client administrator, a new webhook of the given tenant gets
+/// registered, subscribed to the given topics and delivered in the given format, json if none. Returns the webhook
+/// along with the secret its deliveries are signed by
+pub fn admin_register_webhook(token: &str,
+                              tenant: &str,
+                              url: &str,
+                              topics: &[String],
+                              format: &str) -> Result<Webhook, Box<dyn Error>> {
+
+    let format = match format {
+        "" => Format::Json,
+        format => Format::from_str(format).ok_or(errors::PARSE_FAILED)?,
+    };
+
+    check_operator(token, &[Role::ClientAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    webhook_register(tenant.get_id(), url, topics, format)
+}
+
+/// If, and only if, the provided token belongs to a client administrator, the webhook with the given id gets removed,
+/// along with its delivery log
+pub fn admin_delete_webhook(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    check_operator(token, &[Role::ClientAdmin])?;
+    webhook_delete(id)
+}
+
+/// If, and only if, the provided token belongs to either a client administrator or an auditor, returns the given page
+/// of the delivery log of the webhook with the given id, from the newest delivery to the oldest one, and the token of
+/// the next page, if any
+pub fn admin_webhook_deliveries(token: &str, id: i32, page: &Page) -> Result<(Vec<Delivery>, String), Box<dyn Error>> {
+    check_operator(token, &[Role::ClientAdmin, Role::Auditor])?;
+    webhook_deliveries(id, page)
+}
+
+/// If, and only if, the provided token belongs to a client administrator, every delivery of the webhook with the given
+/// id created since the given time, of any of the given topics if any, gets scheduled again. Returns how many
+pub fn admin_replay_webhook(token: &str,
+                            id: i32,
+                            since: SystemTime,
+                            topics: &[String]) -> Result<usize, Box<dyn Error>> {
+
+    check_operator(token, &[Role::ClientAdmin])?;
+    webhook_replay(id, since, topics)
+}
+
+/// If, and only if, the provided token belongs to a client administrator, the template of the given notification gets
+/// overridden in the given tenant by a new version made of the given subject and body
+pub fn admin_set_template(token: &str,
+                          tenant: &str,
+                          kind: TemplateKind,
+                          subject: &str,
+                          body: &str) -> Result<Template, Box<dyn Error>> {
+
+    check_operator(token, &[Role::ClientAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    template_set(tenant.get_id(), kind, subject, body)
+}
+
+/// If, and only if, the provided token belongs to either a client administrator or an auditor, returns all the versions
+/// of all the templates overridden in the given tenant
+pub fn admin_list_templates(token: &str, tenant: &str) -> Result<Vec<Template>, Box<dyn Error>> {
+    check_operator(token, &[Role::ClientAdmin, Role::Auditor])?;
+    let tenant = tenant_find(tenant)?;
+    template_list(tenant.get_id())
+}
+
+/// If, and only if, the provided token belongs to a client administrator, the given notification gets sent by its
+/// default template back in the given tenant
+pub fn admin_reset_template(token: &str, tenant: &str, kind: TemplateKind) -> Result<(), Box<dyn Error>> {
+    check_operator(token, &[Role::ClientAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    template_reset(tenant.get_id(), kind)
+}
+
+/// If, and only if, the provided token belongs to either a client administrator or an auditor, returns the subject and
+/// body of the given notification rendered with the given variables, by the given template or, if none, the one in use
+/// by the tenant in the given locale
+pub fn admin_preview_template(token: &str,
+                              tenant: &str,
+                              kind: TemplateKind,
+                              locale: &str,
+                              subject: &str,
+                              body: &str,
+                              values: &[(String, String)]) -> Result<(String, String), Box<dyn Error>> {
+
+    check_operator(token, &[Role::ClientAdmin, Role::Auditor])?;
+    let tenant = tenant_find(tenant)?;
+    template_preview(tenant.get_id(), kind, locale, subject, body, values)
+}
+
+/// If, and only if, the provided token belongs to a client administrator, the given word gets denied to the usernames
+/// of the given tenant, as told by the given kind
+pub fn admin_add_reserved_name(token: &str,
+                               tenant: &str,
+                               word: &str,
+                               kind: DenyKind) -> Result<ReservedName, Box<dyn Error>> {
+
+    check_operator(token, &[Role::ClientAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    reserved_add(tenant.get_id(), word, kind)
+}
+
+/// If, and only if, the provided token belongs to a client administrator, the reserved word with the given id gets
+/// allowed back to the usernames of the given tenant
+pub fn admin_delete_reserved_name(token: &str, tenant: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    check_operator(token, &[Role::ClientAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    reserved_delete(tenant.get_id(), id)
+}
+
+/// If, and only if, the provided token belongs to either a client administrator or an auditor, returns all the words
+/// denied to the usernames of the given tenant
+pub fn admin_list_reserved_names(token: &str, tenant: &str) -> Result<Vec<ReservedName>, Box<dyn Error>> {
+    check_operator(token, &[Role::ClientAdmin, Role::Auditor])?;
+    let tenant = tenant_find(tenant)?;
+    reserved_list(tenant.get_id())
+}
+
+/// If, and only if, the provided token belongs to a user administrator, all the users of the given file, of the given
+/// format, are imported into the given tenant, as told by the conflict policy for these that already exist
+pub fn admin_import(token: &str,
+                    tenant: &str,
+                    format: Format,
+                    data: &str,
+                    conflict: Conflict,
+                    dry_run: bool) -> Result<ImportReport, Box<dyn Error>> {
+
+    check_operator(token, &[Role::UserAdmin])?;
+    import_users(tenant, format, data, conflict, dry_run)
+}
+
+/// If, and only if, the provided token belongs to a client administrator, the app with the given url, in the given
+/// tenant, and all its data gets removed from the system, with no signature of the app required
+pub fn admin_delete_app(token: &str, tenant: &str, url: &str) -> Result<(), Box<dyn Error>> {
+    info!("got an operational deletion request for application {} ", url);
+
+    check_operator(token, &[Role::ClientAdmin])?;
+    let tenant = tenant_find(tenant)?;
+    let app = get_app_repository().find_by_url(tenant.get_id(), url)?;
+    app_remove(&app)
+}
+
+/// If, and only if, the provided token belongs to either a client administrator or an auditor, returns how many tokens
+/// and requests the app with the given url, in the given tenant, has used within the current window, along with its
+/// quotas
+pub fn admin_app_usage(token: &str, tenant: &str, url: &str) -> Result<Vec<Usage>, Box<dyn Error>> {
+    check_operator(token, &[Role::ClientAdmin, Role::Auditor])?;
+    let tenant = tenant_find(tenant)?;
+    let app = get_app_repository().find_by_url(tenant.get_id(), url)?;
+    quota_usage(&app)
+}
+
+/// If, and only if, the provided token belongs to either a service operator or an auditor, returns the active sessions,
+/// in total and by app, and the tokens issued by this instance, by kind and grant
+pub fn admin_stats(token: &str) -> Result<Stats, Box<dyn Error>> {
+    check_operator(token, &[Role::Service, Role::Auditor])?;
+    let mut sessions_by_app: Vec<(i32, usize)> = session_count_by_app()?.into_iter().collect();
+    sessions_by_app.sort();
+
+    Ok(Stats {
+        active_sessions: session_count()?,
+        sessions_by_app: sessions_by_app,
+        tokens_issued: metrics::tokens_issued(),
+    })
+}
+
+/// Returns the findings of all the diagnostics checks, along with the expiration of the credentials the service relies
+/// on, so operators get warned before token issuance starts failing
+pub fn admin_diagnostics(token: &str) -> Result<Report, Box<dyn Error>> {
+    check_operator(token, &[Role::Service, Role::Auditor])?;
+    Ok(diagnose())
+}
+
+/// If, and only if, the provided token belongs to either a key or a client administrator, the api key with the given id
+/// gets removed, no matter who it belongs to
+pub fn admin_revoke_apikey(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got an operational revoke request for api key {} ", id);
+
+    let admin = check_operator(token, &[Role::KeyAdmin, Role::ClientAdmin])?;
+    let key = get_apikey_repository().find(id)?;
+    get_apikey_repository().delete(&key)?;
+
+    audit_record(key.get_user(), admin.get_id(), EventKind::ApiKey, &format!("api key {} revoked", key.get_name()));
+    Ok(())
+}
@@ -0,0 +1,164 @@
+use std::error::Error;
+use crate::constants::errors;
+
+/// All the roles an administrator of the default tenant may be granted, each of them for a group of operational
+/// actions, so operators can be granted the least privileges they require
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Role {
+    UserAdmin,   // revoking sessions, suspending, reinstating, flagging and importing users
+    ClientAdmin, // managing apps, webhooks and notification templates, and revoking api keys
+    KeyAdmin,    // rotating and revoking the signing keys, and revoking api keys
+    Auditor,     // reading the audit trail, the stats, the usage of apps, the deliveries and the templates
+    Service,     // reloading the config and running the migrations
+}
+
+impl Role {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Role::UserAdmin => "user-admin",
+            Role::ClientAdmin => "client-admin",
+            Role::KeyAdmin => "key-admin",
+            Role::Auditor => "auditor",
+            Role::Service => "service",
+        }
+    }
+
+    pub fn from_str(role: &str) -> Option<Self> {
+        match role {
+            "user-admin" => Some(Role::UserAdmin),
+            "client-admin" => Some(Role::ClientAdmin),
+            "key-admin" => Some(Role::KeyAdmin),
+            "auditor" => Some(Role::Auditor),
+            "service" => Some(Role::Service),
+            _ => None,
+        }
+    }
+
+    /// Returns the roles the given name stands for: either a single role, or a bundle of them by the name of any of
+    /// the former coarse roles, so the bindings made by then keep granting the same actions
+    pub fn expand(name: &str) -> Option<Vec<Self>> {
+        match name {
+            "support" => Some(vec![Role::UserAdmin, Role::Auditor]),
+            "clients" => Some(vec![Role::ClientAdmin]),
+            "service" => Some(vec![Role::Service, Role::KeyAdmin]),
+            name => Role::from_str(name).map(|role| vec![role]),
+        }
+    }
+
+    pub fn all() -> Vec<Self> {
+        vec![Role::UserAdmin, Role::ClientAdmin, Role::KeyAdmin, Role::Auditor, Role::Service]
+    }
+}
+
+/// The roles granted to the administrator with the given email
+#[derive(Clone, PartialEq, Debug)]
+pub struct Binding {
+    pub(super) email: String,
+    pub(super) roles: Vec<Role>,
+}
+
+impl Binding {
+    /// Parses a binding formatted as <email>=<role>[+<role>...], such as "alice@example.com=user-admin+auditor"
+    pub fn from_str(binding: &str) -> Result<Self, Box<dyn Error>> {
+        let mut parts = binding.trim().splitn(2, '=');
+        let email = parts.next().unwrap_or_default();
+        let roles = match parts.next() {
+            Some(roles) => roles,
+            None => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        if email.len() == 0 {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        let mut granted = Vec::new();
+        for name in roles.split('+') {
+            for role in Role::expand(name).ok_or(errors::PARSE_FAILED)? {
+                if !granted.contains(&role) {
+                    granted.push(role);
+                }
+            }
+        }
+
+        Ok(Binding {
+            email: email.to_string(),
+            roles: granted,
+        })
+    }
+
+    /// Parses a comma-separated list of bindings
+    pub fn from_list(bindings: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        bindings.split(',')
+            .filter(|binding| binding.trim().len() > 0)
+            .map(Binding::from_str)
+            .collect()
+    }
+
+    pub fn get_email(&self) -> &str {
+        &self.email
+    }
+
+    pub fn has_role(&self, role: Role) -> bool {
+        self.roles.contains(&role)
+    }
+}
+
+/// Figures for capacity planning: the sessions not expired nor closed yet, in total and by the id of the app they have
+/// been granted access to, and the tokens issued by this instance since it started, by kind and grant
+#[derive(Clone, PartialEq, Debug)]
+pub struct Stats {
+    pub active_sessions: usize,
+    pub sessions_by_app: Vec<(i32, usize)>,
+    pub tokens_issued: Vec<(String, String, u64)>,
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{Binding, Role};
+
+    #[test]
+    fn binding_from_str_should_not_fail() {
+        let binding = Binding::from_str("alice@example.com=user-admin+auditor").unwrap();
+        assert_eq!("alice@example.com", binding.email);
+        assert_eq!(vec![Role::UserAdmin, Role::Auditor], binding.roles);
+        assert!(binding.has_role(Role::Auditor));
+        assert!(!binding.has_role(Role::KeyAdmin));
+    }
+
+    #[test]
+    fn binding_from_str_with_former_roles_should_not_fail() {
+        let binding = Binding::from_str("alice@example.com=support+clients+auditor").unwrap();
+        assert_eq!(vec![Role::UserAdmin, Role::Auditor, Role::ClientAdmin], binding.roles);
+
+        let binding = Binding::from_str("bob@example.com=service").unwrap();
+        assert_eq!(vec![Role::Service, Role::KeyAdmin], binding.roles);
+    }
+
+    #[test]
+    fn role_from_str_should_not_fail() {
+        for role in Role::all() {
+            assert_eq!(Some(role), Role::from_str(role.as_str()));
+        }
+
+        assert!(Role::from_str("support").is_none(), "former roles are bundles, not roles");
+    }
+
+    #[test]
+    fn binding_from_str_should_fail() {
+        let wrong = &["alice@example.com", "=support", "alice@example.com=", "alice@example.com=root",
+                      "alice@example.com=support+", "alice@example.com=user_admin"];
+
+        for binding in wrong {
+            assert!(Binding::from_str(binding).is_err(), "{} should not be parsed", binding);
+        }
+    }
+
+    #[test]
+    fn binding_from_list_should_not_fail() {
+        let bindings = Binding::from_list("alice@example.com=support, bob@example.com=key-admin,").unwrap();
+        assert_eq!(2, bindings.len());
+        assert_eq!("bob@example.com", bindings[1].email);
+        assert!(Binding::from_list("").unwrap().is_empty());
+    }
+}
@@ -0,0 +1,892 @@
+use std::time::{Duration, UNIX_EPOCH};
+use tonic::{Request, Response, Status, Streaming};
+use crate::logging;
+use crate::constants::{errors, settings};
+use crate::import::domain::{Format, Conflict};
+use crate::template::domain::{Template, TemplateKind};
+use crate::username::domain::{ReservedName, DenyKind};
+use crate::time::unix_timestamp;
+use crate::firewall::framework::ip_filter;
+use crate::pagination::Page;
+use crate::audit::domain::Event;
+use crate::audit::framework::get_filter as get_audit_filter;
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("admin");
+}
+
+// Proto generated server traits
+use proto::admin_service_server::AdminService;
+pub use proto::admin_service_server::AdminServiceServer;
+
+// Proto message structs
+use proto::{ReloadResponse, RotateResponse, UserRequest, CompromiseRequest, AppRequest, ApiKeyId};
+use proto::{PreRegisterRequest, PreRegistration};
+use proto::{CreateAppRequest, EventsRequest, EventList, Event as ProtoEvent, SearchEventsRequest};
+use proto::{WebhookRequest, Webhook as ProtoWebhook, WebhookId, DeliveriesRequest, DeliveryList, Delivery as ProtoDelivery};
+use proto::{ReplayRequest, ReplaySummary};
+use proto::{ImportChunk, ImportSummary, ImportError};
+use proto::{TemplateRequest, Template as ProtoTemplate, TemplatesRequest, TemplateList, TemplateId};
+use proto::{PreviewRequest, PreviewResponse, Usage as ProtoUsage, UsageList};
+use proto::{ReservedNameRequest, ReservedName as ProtoReservedName, ReservedNamesRequest, ReservedNameList};
+use proto::ReservedNameId;
+use proto::{StatsResponse, AppSessions, TokensIssued, VerifyAuditResponse};
+use proto::{DiagnosticsResponse, Finding as ProtoFinding, Expiration as ProtoExpiration};
+
+fn to_proto(template: &Template) -> ProtoTemplate {
+    ProtoTemplate{
+        kind: template.get_kind().as_str().to_string(),
+        version: template.get_version(),
+        subject: template.get_subject().to_string(),
+        body: template.get_body().to_string(),
+        created_at: unix_timestamp(template.get_created_at()) as u64,
+    }
+}
+
+fn to_proto_reserved_name(name: &ReservedName) -> ProtoReservedName {
+    ProtoReservedName{
+        id: name.get_id(),
+        word: name.get_word().to_string(),
+        kind: name.get_kind().as_str().to_string(),
+        created_at: unix_timestamp(name.get_created_at()) as u64,
+    }
+}
+
+fn to_proto_event(event: &Event) -> ProtoEvent {
+    ProtoEvent{
+        id: event.get_id().to_string(),
+        user: event.get_user(),
+        issuer: event.get_issuer(),
+        kind: event.get_kind().as_str().to_string(),
+        reason: event.get_reason().to_string(),
+        created_at: unix_timestamp(event.get_created_at()) as u64,
+        app: event.get_app().to_string(),
+        ip: event.get_ip().to_string(),
+    }
+}
+
+pub struct AdminServiceImplementation;
+
+#[tonic::async_trait]
+impl AdminService for AdminServiceImplementation {
+    async fn reload_config(&self, request: Request<()>) -> Result<Response<ReloadResponse>, Status> {
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        match super::application::admin_reload(&token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(changed) => Ok(Response::new(ReloadResponse{changed})),
+        }
+    }
+
+    async fn rotate_keys(&self, request: Request<()>) -> Result<Response<RotateResponse>, Status> {
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        match super::application::admin_rotate(&token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(rotated) => Ok(Response::new(RotateResponse{rotated: rotated as i32})),
+        }
+    }
+
+    async fn revoke_previous_key(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        match super::application::admin_revoke_key(&token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(_) => Ok(Response::new(())),
+        }
+    }
+
+    async fn revoke_sessions(&self, request: Request<UserRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_revoke(&token, &msg_ref.tenant, &msg_ref.email, &msg_ref.reason) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn flag_compromise(&self, request: Request<CompromiseRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_flag_compromise(&token,
+                                                        &msg_ref.tenant,
+                                                        &msg_ref.email,
+                                                        &msg_ref.cause,
+                                                        &msg_ref.reason) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn suspend_user(&self, request: Request<UserRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_suspend(&token, &msg_ref.tenant, &msg_ref.email, &msg_ref.reason) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn reinstate_user(&self, request: Request<UserRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_reinstate(&token, &msg_ref.tenant, &msg_ref.email, &msg_ref.reason) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn pre_register_user(&self,
+                               request: Request<PreRegisterRequest>) -> Result<Response<PreRegistration>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_preregister(&token,
+                                                    &msg_ref.tenant,
+                                                    &msg_ref.email,
+                                                    msg_ref.timeout,
+                                                    msg_ref.mfa) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(user) => Ok(Response::new(
+                PreRegistration{
+                    id: user.get_id(),
+                    deadline: user.get_activation_deadline()
+                        .map(|deadline| unix_timestamp(deadline) as u64)
+                        .unwrap_or_default(),
+                }
+            )),
+        }
+    }
+
+    async fn delete_app(&self, request: Request<AppRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_delete_app(&token, &msg_ref.tenant, &msg_ref.url) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn revoke_api_key(&self, request: Request<ApiKeyId>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_revoke_apikey(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn create_app(&self, request: Request<CreateAppRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_create_app(&token, &msg_ref.tenant, &msg_ref.url, &msg_ref.public) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn run_migrations(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        match super::application::admin_migrate(&token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn list_events(&self, request: Request<EventsRequest>) -> Result<Response<EventList>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_events(&token, &msg_ref.after, msg_ref.limit) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(events) => Ok(Response::new(
+                EventList{
+                    events: events.iter().map(to_proto_event).collect(),
+                    next_page_token: "".to_string(),
+                }
+            )),
+        }
+    }
+
+    async fn search_events(&self, request: Request<SearchEventsRequest>) -> Result<Response<EventList>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let page = match Page::new("events", msg_ref.page_size, &msg_ref.page_token) {
+            Err(err) => return Err(Status::invalid_argument(err.to_string())),
+            Ok(page) => page,
+        };
+
+        let mut filter = get_audit_filter(&msg_ref.kinds, msg_ref.since, msg_ref.until)?;
+        filter.user = Some(msg_ref.user).filter(|user| *user != 0);
+        filter.issuer = Some(msg_ref.issuer).filter(|issuer| *issuer != 0);
+        filter.app = Some(msg_ref.app).filter(|app| app.len() > 0);
+        filter.ip = Some(msg_ref.ip).filter(|ip| ip.len() > 0);
+
+        match super::application::admin_search_events(&token, &filter, &page) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((events, next_page_token)) => Ok(Response::new(
+                EventList{
+                    events: events.iter().map(to_proto_event).collect(),
+                    next_page_token: next_page_token,
+                }
+            )),
+        }
+    }
+
+    async fn register_webhook(&self, request: Request<WebhookRequest>) -> Result<Response<ProtoWebhook>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_register_webhook(&token, &msg_ref.tenant, &msg_ref.url, &msg_ref.topics,
+                                                              &msg_ref.format) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(webhook) => Ok(Response::new(
+                ProtoWebhook{
+                    id: webhook.get_id(),
+                    url: webhook.get_url().to_string(),
+                    topics: webhook.get_topics().to_vec(),
+                    secret: webhook.get_secret().to_string(),
+                    format: webhook.get_format().as_str().to_string(),
+                }
+            )),
+        }
+    }
+
+    async fn delete_webhook(&self, request: Request<WebhookId>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_delete_webhook(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn replay_deliveries(&self, request: Request<ReplayRequest>) -> Result<Response<ReplaySummary>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let since = UNIX_EPOCH + Duration::from_secs(msg_ref.since);
+        match super::application::admin_replay_webhook(&token, msg_ref.webhook, since, &msg_ref.topics) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(scheduled) => Ok(Response::new(
+                ReplaySummary{
+                    scheduled: scheduled as u64,
+                }
+            )),
+        }
+    }
+
+    async fn list_deliveries(&self, request: Request<DeliveriesRequest>) -> Result<Response<DeliveryList>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        if msg_ref.page > 0 {
+            // offsets are no longer supported, since pages got skewed by the deliveries made in the meantime
+            return Err(Status::invalid_argument(errors::INVALID_PAGE_TOKEN));
+        }
+
+        let page = match Page::new("deliveries", msg_ref.page_size, &msg_ref.page_token) {
+            Err(err) => return Err(Status::invalid_argument(err.to_string())),
+            Ok(page) => page,
+        };
+
+        match super::application::admin_webhook_deliveries(&token, msg_ref.webhook, &page) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((deliveries, next_page_token)) => Ok(Response::new(
+                DeliveryList{
+                    deliveries: deliveries.iter().map(|delivery| ProtoDelivery{
+                        id: delivery.get_id(),
+                        event: delivery.get_event().to_string(),
+                        topic: delivery.get_topic().to_string(),
+                        status: delivery.get_status().as_str().to_string(),
+                        attempts: delivery.get_attempts(),
+                        response: delivery.get_response(),
+                        error: delivery.get_error().to_string(),
+                        created_at: unix_timestamp(delivery.get_created_at()) as u64,
+                        updated_at: unix_timestamp(delivery.get_touch_at()) as u64,
+                    }).collect(),
+                    next_page_token: next_page_token,
+                }
+            )),
+        }
+    }
+
+    async fn bulk_import_users(&self, request: Request<Streaming<ImportChunk>>) -> Result<Response<ImportSummary>, Status> {
+        // chunks are not dumped, since they carry personal data
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let mut stream = request.into_inner();
+        let first = match stream.message().await? {
+            Some(chunk) => chunk,
+            None => return Err(Status::invalid_argument("no chunk received")),
+        };
+
+        let format = match Format::from_str(&first.format) {
+            Some(format) => format,
+            None => return Err(Status::invalid_argument("wrong format")),
+        };
+
+        let conflict = match first.conflict.as_str() {
+            "" => Conflict::Skip,
+            conflict => match Conflict::from_str(conflict) {
+                Some(conflict) => conflict,
+                None => return Err(Status::invalid_argument("wrong conflict policy")),
+            },
+        };
+
+        let mut data = first.data;
+        while let Some(chunk) = stream.message().await? {
+            if data.len() + chunk.data.len() > settings::IMPORT_MAX_SIZE {
+                return Err(Status::resource_exhausted(errors::IMPORT_TOO_LARGE));
+            }
+
+            data.extend(chunk.data);
+        }
+
+        let data = match String::from_utf8(data) {
+            Err(err) => return Err(Status::invalid_argument(err.to_string())),
+            Ok(data) => data,
+        };
+
+        match super::application::admin_import(&token, &first.tenant, format, &data, conflict, first.dry_run) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(report) => Ok(Response::new(
+                ImportSummary{
+                    imported: report.imported as u64,
+                    updated: report.updated as u64,
+                    skipped: report.skipped as u64,
+                    preserved: report.preserved as u64,
+                    reset: report.reset as u64,
+                    errors: report.errors.into_iter().map(|failure| ImportError{
+                        index: failure.index as u64,
+                        email: failure.email,
+                        error: failure.error,
+                    }).collect(),
+                    dry_run: report.dry_run,
+                }
+            )),
+        }
+    }
+
+    async fn set_template(&self, request: Request<TemplateRequest>) -> Result<Response<ProtoTemplate>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let kind = match TemplateKind::from_str(&msg_ref.kind) {
+            Some(kind) => kind,
+            None => return Err(Status::invalid_argument("wrong template kind")),
+        };
+
+        match super::application::admin_set_template(&token, &msg_ref.tenant, kind, &msg_ref.subject, &msg_ref.body) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(template) => Ok(Response::new(to_proto(&template))),
+        }
+    }
+
+    async fn list_templates(&self, request: Request<TemplatesRequest>) -> Result<Response<TemplateList>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_list_templates(&token, &msg_ref.tenant) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(templates) => Ok(Response::new(
+                TemplateList{
+                    templates: templates.iter().map(to_proto).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn reset_template(&self, request: Request<TemplateId>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let kind = match TemplateKind::from_str(&msg_ref.kind) {
+            Some(kind) => kind,
+            None => return Err(Status::invalid_argument("wrong template kind")),
+        };
+
+        match super::application::admin_reset_template(&token, &msg_ref.tenant, kind) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn preview_template(&self, request: Request<PreviewRequest>) -> Result<Response<PreviewResponse>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let kind = match TemplateKind::from_str(&msg_ref.kind) {
+            Some(kind) => kind,
+            None => return Err(Status::invalid_argument("wrong template kind")),
+        };
+
+        let values: Vec<(String, String)> = msg_ref.variables.into_iter().collect();
+        match super::application::admin_preview_template(&token, &msg_ref.tenant, kind, &msg_ref.locale,
+                                                         &msg_ref.subject, &msg_ref.body, &values) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((subject, body)) => Ok(Response::new(
+                PreviewResponse{
+                    subject: subject,
+                    body: body,
+                }
+            )),
+        }
+    }
+
+    async fn add_reserved_name(&self,
+                               request: Request<ReservedNameRequest>) -> Result<Response<ProtoReservedName>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let kind = match DenyKind::from_str(&msg_ref.kind) {
+            Some(kind) => kind,
+            None => return Err(Status::invalid_argument("wrong reserved name kind")),
+        };
+
+        match super::application::admin_add_reserved_name(&token, &msg_ref.tenant, &msg_ref.word, kind) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(name) => Ok(Response::new(to_proto_reserved_name(&name))),
+        }
+    }
+
+    async fn delete_reserved_name(&self, request: Request<ReservedNameId>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_delete_reserved_name(&token, &msg_ref.tenant, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn list_reserved_names(&self,
+                                 request: Request<ReservedNamesRequest>) -> Result<Response<ReservedNameList>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_list_reserved_names(&token, &msg_ref.tenant) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(names) => Ok(Response::new(
+                ReservedNameList{
+                    names: names.iter().map(to_proto_reserved_name).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn get_app_usage(&self, request: Request<AppRequest>) -> Result<Response<UsageList>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::admin_app_usage(&token, &msg_ref.tenant, &msg_ref.url) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(usage) => Ok(Response::new(
+                UsageList{
+                    usage: usage.iter().map(|usage| ProtoUsage{
+                        metric: usage.get_metric().as_str().to_string(),
+                        used: usage.get_used(),
+                        limit: usage.get_limit().unwrap_or(0),
+                        period: usage.get_period(),
+                    }).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn verify_audit(&self, request: Request<()>) -> Result<Response<VerifyAuditResponse>, Status> {
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        match super::application::admin_verify_audit(&token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((checkpoints, events)) => Ok(Response::new(
+                VerifyAuditResponse{
+                    checkpoints: checkpoints as u64,
+                    events: events as u64,
+                }
+            )),
+        }
+    }
+
+    async fn get_stats(&self, request: Request<()>) -> Result<Response<StatsResponse>, Status> {
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        match super::application::admin_stats(&token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(stats) => Ok(Response::new(
+                StatsResponse{
+                    active_sessions: stats.active_sessions as u64,
+                    sessions_by_app: stats.sessions_by_app.iter().map(|(app, sessions)| AppSessions{
+                        app: *app,
+                        sessions: *sessions as u64,
+                    }).collect(),
+                    tokens_issued: stats.tokens_issued.into_iter().map(|(kind, grant, count)| TokensIssued{
+                        kind: kind,
+                        grant: grant,
+                        count: count,
+                    }).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn get_diagnostics(&self, request: Request<()>) -> Result<Response<DiagnosticsResponse>, Status> {
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        match super::application::admin_diagnostics(&token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(report) => Ok(Response::new(
+                DiagnosticsResponse{
+                    findings: report.findings.iter().map(|finding| ProtoFinding{
+                        check: finding.check.as_str().to_string(),
+                        severity: finding.severity.as_str().to_string(),
+                        subject: finding.subject.clone(),
+                        message: finding.message.clone(),
+                        expires_at: finding.expires_at
+                            .map(|expires_at| unix_timestamp(expires_at) as u64)
+                            .unwrap_or_default(),
+                    }).collect(),
+                    expirations: report.expirations.iter().map(|expiration| ProtoExpiration{
+                        check: expiration.check.as_str().to_string(),
+                        subject: expiration.subject.clone(),
+                        expires_at: unix_timestamp(expiration.expires_at) as u64,
+                    }).collect(),
+                }
+            )),
+        }
+    }
+}
@@ -0,0 +1,3 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
@@ -0,0 +1,154 @@
+use std::error::Error;
+use std::sync::{Arc, RwLock, RwLockReadGuard};
+use crate::spiffe;
+use crate::constants::errors;
+use crate::metadata::domain::Metadata;
+use crate::user::get_repository as get_user_repository;
+use crate::tenant::application::tenant_find;
+use crate::session::{
+    application::decode_token,
+    get_repository as get_sess_repository,
+    domain::Session,
+};
+use crate::audit::{
+    application::audit_record,
+    domain::EventKind,
+};
+use super::{
+    get_repository as get_apikey_repository,
+    domain::ApiKey,
+};
+
+fn get_readable_session(sess_arc: &Arc<RwLock<Session>>) -> Result<RwLockReadGuard<Session>, Box<dyn Error>> {
+    match sess_arc.read() {
+        Ok(sess) => Ok(sess),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
+
+/// If, and only if, the provided token is valid and its session is elevated, a new api key granted for the given
+/// scopes, and optionally bound to the given client certificate identity, is created for the session's owner. Returns
+/// the key as well as its plain value, which cannot be recovered later on
+pub fn apikey_create(token: &str,
+                     name: &str,
+                     scopes: &[String],
+                     certificate: Option<&str>) -> Result<(ApiKey, String), Box<dyn Error>> {
+
+    info!("got a create api key request");
+    if let Some(identity) = certificate.filter(|identity| spiffe::is_spiffe_id(identity)) {
+        // no key may be bound to a workload it could never be authenticated as
+        spiffe::verify(identity)?;
+    }
+
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let (user_id, issuer) = {
+        let sess = get_readable_session(&sess_arc)?;
+        if !sess.is_elevated() {
+            return Err(errors::ELEVATION_REQUIRED.into());
+        }
+
+        (sess.get_user()?.get_id(), sess.get_issuer()?)
+    };
+
+    let user = get_user_repository().find(user_id)?;
+    let meta = Metadata::new();
+    let (mut key, plain) = ApiKey::new(meta, &user, name, scopes, certificate)?;
+    get_apikey_repository().create(&mut key)?;
+
+    audit_record(user_id, issuer, EventKind::ApiKey, &format!("api key {} created", key.get_name()));
+    Ok((key, plain))
+}
+
+/// If, and only if, the provided token is valid, returns all the api keys of the session's owner
+pub fn apikey_list(token: &str) -> Result<Vec<ApiKey>, Box<dyn Error>> {
+    info!("got a list api keys request");
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = get_readable_session(&sess_arc)?.get_user()?.get_id();
+    get_apikey_repository().find_all_by_user(user_id)
+}
+
+/// If, and only if, the provided token is valid and the api key belongs to the session's owner, the key gets removed
+pub fn apikey_revoke(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a revoke api key request");
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let (user_id, issuer) = { // block is required because of lock release
+        let sess = get_readable_session(&sess_arc)?;
+        (sess.get_user()?.get_id(), sess.get_issuer()?)
+    };
+
+    let key = get_apikey_repository().find(id)?;
+    if key.get_user() != user_id {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    get_apikey_repository().delete(&key)?;
+
+    audit_record(user_id, issuer, EventKind::ApiKey, &format!("api key {} revoked", key.get_name()));
+    Ok(())
+}
+
+/// If, and only if, the provided plain api key is valid for the given tenant, granted for the given scope and its owner
+/// is not suspended, returns the key after recording its usage
+pub fn apikey_authenticate(tenant: &str, plain: &str, scope: &str) -> Result<ApiKey, Box<dyn Error>> {
+    let (prefix, secret) = match ApiKey::split(plain) {
+        Some(parts) => parts,
+        None => return Err(errors::PARSE_FAILED.into()),
+    };
+
+    let tenant = tenant_find(tenant)?;
+    let mut key = get_apikey_repository().find_by_prefix(tenant.get_id(), prefix)?;
+    if !key.match_secret(secret) {
+        return Err(errors::NOT_FOUND.into());
+    } else if !key.has_scope(scope) {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    let user = get_user_repository().find(key.get_user())?;
+    if user.is_suspended() {
+        return Err(errors::SUSPENDED.into());
+    }
+
+    key.touch();
+    get_apikey_repository().save(&key)?;
+    Ok(key)
+}
+
+/// Returns the api key the given client certificate identity is bound to for the given tenant, if any, after recording
+/// its usage. If there is one, it must be granted for the given scope and its owner not suspended, as for any other key.
+/// Identities being spiffe ids must be valid ones of a trusted domain, whether they are bound to any key or not
+pub fn apikey_authenticate_certificate(tenant: &str,
+                                       identity: &str,
+                                       scope: &str) -> Result<Option<ApiKey>, Box<dyn Error>> {
+
+    if spiffe::is_spiffe_id(identity) {
+        spiffe::verify(identity)?;
+    }
+
+    let tenant = tenant_find(tenant)?;
+    let mut key = match get_apikey_repository().find_by_certificate(tenant.get_id(), identity) {
+        Ok(key) => key,
+        Err(_) => return Ok(None),
+    };
+
+    if !key.has_scope(scope) {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    let user = get_user_repository().find(key.get_user())?;
+    if user.is_suspended() {
+        return Err(errors::SUSPENDED.into());
+    }
+
+    key.touch();
+    get_apikey_repository().save(&key)?;
+    Ok(Some(key))
+}
\ No newline at end of file
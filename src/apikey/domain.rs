@@ -0,0 +1,252 @@
+use std::error::Error;
+use std::time::SystemTime;
+use crate::regex;
+use crate::security;
+use crate::spiffe::{self, SpiffeId};
+use crate::constants::settings;
+use crate::metadata::domain::Metadata;
+use crate::user::domain::User;
+use crate::time;
+
+pub trait ApiKeyRepository {
+    fn find(&self, id: i32) -> Result<ApiKey, Box<dyn Error>>;
+    fn find_by_prefix(&self, tenant: i32, prefix: &str) -> Result<ApiKey, Box<dyn Error>>;
+    fn find_by_certificate(&self, tenant: i32, identity: &str) -> Result<ApiKey, Box<dyn Error>>;
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<ApiKey>, Box<dyn Error>>;
+    fn create(&self, key: &mut ApiKey) -> Result<(), Box<dyn Error>>;
+    fn save(&self, key: &ApiKey) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, key: &ApiKey) -> Result<(), Box<dyn Error>>;
+}
+
+#[derive(Clone)]
+pub struct ApiKey {
+    pub(super) id: i32,
+    pub(super) user: i32,
+    pub(super) tenant: i32,         // the tenant of its owner
+    pub(super) name: String,
+    pub(super) prefix: String,      // public part of the key, used to find it
+    pub(super) hash: String,        // digest of the secret part of the key
+    pub(super) scopes: Vec<String>, // all these services the key is granted for
+    pub(super) last_used_at: Option<SystemTime>,
+    pub(super) certificate: Option<String>, // identity of the client certificate the key is bound to, if any
+    pub(super) meta: Metadata,
+}
+
+impl ApiKey {
+    /// returns a brand new api key as well as its plain value, which is never stored and so cannot be recovered. If a
+    /// certificate identity is provided, clients presenting that certificate get authenticated as the key with no need
+    /// of its plain value
+    pub fn new(meta: Metadata,
+               user: &User,
+               name: &str,
+               scopes: &[String],
+               certificate: Option<&str>) -> Result<(Self, String), Box<dyn Error>> {
+
+        if scopes.len() == 0 {
+            return Err("at least one scope is required".into());
+        }
+
+        if let Some(identity) = certificate {
+            if identity.len() == 0 || identity.len() > settings::CERTIFICATE_IDENTITY_LEN {
+                return Err("certificate identity must be between 1 and 256 characters long".into());
+            }
+
+            if spiffe::is_spiffe_id(identity) {
+                SpiffeId::parse(identity)?;
+            }
+        }
+
+        for scope in scopes.iter() {
+            regex::match_regex(regex::SCOPE, scope)?;
+        }
+
+        let prefix = security::get_random_string(settings::APIKEY_PREFIX_LEN);
+        let secret = security::get_random_string(settings::APIKEY_LEN);
+        let key = ApiKey {
+            id: 0,
+            user: user.get_id(),
+            tenant: user.get_tenant(),
+            name: name.to_string(),
+            prefix: prefix.clone(),
+            hash: sha256::digest_bytes(secret.as_bytes()),
+            scopes: scopes.to_vec(),
+            last_used_at: None,
+            certificate: certificate.map(|identity| identity.to_string()),
+            meta: meta,
+        };
+
+        Ok((key, format!("{}.{}", prefix, secret)))
+    }
+
+    /// splits the provided plain api key into its prefix and secret parts
+    pub fn split(plain: &str) -> Option<(&str, &str)> {
+        let mut parts = plain.splitn(2, '.');
+        match (parts.next(), parts.next()) {
+            (Some(prefix), Some(secret)) if prefix.len() > 0 && secret.len() > 0 => Some((prefix, secret)),
+            _ => None,
+        }
+    }
+
+    /// sets the current time as the last time the key has been used
+    pub(super) fn touch(&mut self) {
+        self.last_used_at = Some(time::now());
+        self.meta.touch();
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn get_prefix(&self) -> &str {
+        &self.prefix
+    }
+
+    pub fn get_scopes(&self) -> &[String] {
+        &self.scopes
+    }
+
+    pub fn get_last_used_at(&self) -> Option<SystemTime> {
+        self.last_used_at
+    }
+
+    pub fn get_certificate(&self) -> Option<&str> {
+        self.certificate.as_deref()
+    }
+
+    /// if true, the key is granted for the provided scope, else it is not
+    pub fn has_scope(&self, scope: &str) -> bool {
+        self.scopes.iter().any(|granted| granted == scope)
+    }
+
+    // checks the provided secret matches the key's one
+    pub fn match_secret(&self, secret: &str) -> bool {
+        security::constant_time_eq(&sha256::digest_bytes(secret.as_bytes()), &self.hash)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::SystemTime;
+    use crate::metadata::domain::tests::new_metadata;
+    use crate::user::domain::tests::new_user;
+    use crate::constants::settings;
+    use super::ApiKey;
+
+    pub fn new_apikey() -> ApiKey {
+        ApiKey{
+            id: 999,
+            user: 999,
+            tenant: settings::DEFAULT_TENANT,
+            name: "testing".to_string(),
+            prefix: "testing".to_string(),
+            hash: sha256::digest_bytes(b"testing"),
+            scopes: vec!["device".to_string()],
+            last_used_at: None,
+            certificate: None,
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn apikey_new_should_not_fail() {
+        let user = new_user();
+        let scopes = vec!["user".to_string(), "device".to_string()];
+        let (key, plain) = ApiKey::new(new_metadata(), &user, "ci", &scopes, None).unwrap();
+
+        assert_eq!(key.id, 0);
+        assert_eq!(key.user, user.get_id());
+        assert_eq!(key.tenant, user.get_tenant());
+        assert_eq!(key.name, "ci");
+        assert_eq!(key.prefix.len(), settings::APIKEY_PREFIX_LEN);
+        assert_eq!(key.scopes, scopes);
+        assert!(key.last_used_at.is_none());
+        assert!(key.certificate.is_none());
+
+        let (prefix, secret) = ApiKey::split(&plain).unwrap();
+        assert_eq!(prefix, key.prefix);
+        assert_eq!(secret.len(), settings::APIKEY_LEN);
+        assert_ne!(secret, key.hash);
+        assert!(key.match_secret(secret));
+    }
+
+    #[test]
+    fn apikey_new_without_scopes_should_fail() {
+        let user = new_user();
+        assert!(ApiKey::new(new_metadata(), &user, "ci", &[], None).is_err());
+    }
+
+    #[test]
+    fn apikey_new_wrong_scope_should_fail() {
+        let user = new_user();
+        let scopes = vec!["user device".to_string()];
+        assert!(ApiKey::new(new_metadata(), &user, "ci", &scopes, None).is_err());
+    }
+
+    #[test]
+    fn apikey_new_with_certificate_should_not_fail() {
+        let user = new_user();
+        let scopes = vec!["user".to_string()];
+        let identity = "spiffe://testing.com/ns/default/sa/ci";
+        let (key, _) = ApiKey::new(new_metadata(), &user, "ci", &scopes, Some(identity)).unwrap();
+        assert_eq!(Some(identity), key.get_certificate());
+    }
+
+    #[test]
+    fn apikey_new_wrong_certificate_should_fail() {
+        let user = new_user();
+        let scopes = vec!["user".to_string()];
+        assert!(ApiKey::new(new_metadata(), &user, "ci", &scopes, Some("")).is_err());
+
+        let identity = "a".repeat(settings::CERTIFICATE_IDENTITY_LEN + 1);
+        assert!(ApiKey::new(new_metadata(), &user, "ci", &scopes, Some(&identity)).is_err());
+
+        let identity = "spiffe://testing.com/ns/../sa/ci";
+        assert!(ApiKey::new(new_metadata(), &user, "ci", &scopes, Some(identity)).is_err());
+    }
+
+    #[test]
+    fn apikey_split_should_fail() {
+        assert!(ApiKey::split("testing").is_none());
+        assert!(ApiKey::split(".testing").is_none());
+        assert!(ApiKey::split("testing.").is_none());
+    }
+
+    #[test]
+    fn apikey_has_scope_should_not_fail() {
+        let key = new_apikey();
+        assert!(key.has_scope("device"));
+        assert!(!key.has_scope("user"));
+    }
+
+    #[test]
+    fn apikey_match_secret_should_not_fail() {
+        let key = new_apikey();
+        assert!(key.match_secret("testing"));
+        assert!(!key.match_secret("TESTING"));
+    }
+
+    #[test]
+    fn apikey_touch_should_not_fail() {
+        let mut key = new_apikey();
+
+        let before = SystemTime::now();
+        key.touch();
+        let after = SystemTime::now();
+
+        let time = key.last_used_at.unwrap();
+        assert!(time >= before && time <= after);
+    }
+}
\ No newline at end of file
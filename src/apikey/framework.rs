@@ -0,0 +1,401 @@
+use std::error::Error;
+use std::time::SystemTime;
+use tonic::{Request, Response, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::schema::apikeys::dsl::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::apikeys;
+use crate::time::unix_timestamp;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use crate::tls;
+use crate::tenant::framework::get_tenant;
+use super::domain::{ApiKey, ApiKeyRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("apikey");
+}
+
+// Proto generated server traits
+use proto::api_key_service_server::ApiKeyService;
+pub use proto::api_key_service_server::ApiKeyServiceServer;
+
+// Proto message structs
+use proto::{CreateRequest, CreateResponse, ApiKeyRequest, ApiKeyList, ApiKey as ProtoApiKey};
+
+/// Identity of the api key a request has been authenticated with, as stored into the request's extensions
+#[derive(Clone)]
+pub struct ApiKeyIdentity {
+    pub key: i32,
+    pub user: i32,
+    pub tenant: i32,
+}
+
+/// Returns an interceptor authenticating all these requests bearing an "api-key" header against the provided scope.
+/// Requests with no api key but a client certificate bound to one get authenticated as that key instead. Any other
+/// request is let through untouched, so it can still be authenticated by token
+pub fn apikey_interceptor(scope: &'static str) -> impl FnMut(Request<()>) -> Result<Request<()>, Status> + Clone {
+    move |mut request: Request<()>| {
+        let plain = match request.metadata().get("api-key") {
+            None => None,
+            Some(value) => match value.to_str() {
+                Err(err) => return Err(Status::aborted(err.to_string())),
+                Ok(plain) => Some(plain.to_string()),
+            },
+        };
+
+        let result = match plain {
+            Some(plain) => {
+                let tenant = get_tenant(&request)?;
+                super::application::apikey_authenticate(&tenant, &plain, scope).map(Some)
+            },
+            None => match tls::get_peer_identity(&request) {
+                None => return Ok(request),
+                Some(identity) => {
+                    let tenant = get_tenant(&request)?;
+                    super::application::apikey_authenticate_certificate(&tenant, &identity, scope)
+                },
+            },
+        };
+
+        match result {
+            Err(err) => Err(Status::unauthenticated(err.to_string())),
+            Ok(None) => Ok(request),
+            Ok(Some(key)) => {
+                request.extensions_mut().insert(ApiKeyIdentity{
+                    key: key.get_id(),
+                    user: key.get_user(),
+                    tenant: key.get_tenant(),
+                });
+
+                Ok(request)
+            }
+        }
+    }
+}
+
+pub struct ApiKeyServiceImplementation;
+
+#[tonic::async_trait]
+impl ApiKeyService for ApiKeyServiceImplementation {
+    async fn create_api_key(&self, request: Request<CreateRequest>) -> Result<Response<CreateResponse>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let certificate = Some(msg_ref.certificate.as_str()).filter(|identity| identity.len() > 0);
+        match super::application::apikey_create(&token, &msg_ref.name, &msg_ref.scopes, certificate) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((key, plain)) => Ok(Response::new(
+                CreateResponse{
+                    id: key.get_id(),
+                    key: plain,
+                }
+            )),
+        }
+    }
+
+    async fn list_api_keys(&self, request: Request<()>) -> Result<Response<ApiKeyList>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        match super::application::apikey_list(token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(all_keys) => Ok(Response::new(
+                ApiKeyList{
+                    keys: all_keys.iter().map(|key| ProtoApiKey{
+                        id: key.get_id(),
+                        name: key.get_name().to_string(),
+                        prefix: key.get_prefix().to_string(),
+                        scopes: key.get_scopes().to_vec(),
+                        last_used_at: key.get_last_used_at()
+                            .map(|time| unix_timestamp(time) as u64)
+                            .unwrap_or(0),
+                        certificate: key.get_certificate().unwrap_or_default().to_string(),
+                    }).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn revoke_api_key(&self, request: Request<ApiKeyRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::apikey_revoke(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[changeset_options(treat_none_as_null = "true")]
+#[table_name = "apikeys"]
+struct PostgresApiKey {
+    pub id: i32,
+    pub user_id: i32,
+    pub name: String,
+    pub prefix: String,
+    pub hash: String,
+    pub scopes: String,
+    pub last_used_at: Option<SystemTime>,
+    pub meta_id: i32,
+    pub tenant_id: i32,
+    pub certificate: Option<String>,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "apikeys"]
+struct NewPostgresApiKey<'a> {
+    pub user_id: i32,
+    pub name: &'a str,
+    pub prefix: &'a str,
+    pub hash: &'a str,
+    pub scopes: &'a str,
+    pub last_used_at: Option<SystemTime>,
+    pub meta_id: i32,
+    pub tenant_id: i32,
+    pub certificate: Option<&'a str>,
+}
+
+pub struct PostgresApiKeyRepository;
+
+impl PostgresApiKeyRepository {
+    fn create_on_conn(conn: &PgConnection, key: &mut ApiKey) -> Result<(), PgError>  {
+        // in order to create an api key it must exists the metadata for this key
+        PostgresMetadataRepository::create_on_conn(conn, &mut key.meta)?;
+
+        let joined_scopes = key.scopes.join(" ");
+        let new_key = NewPostgresApiKey {
+            user_id: key.user,
+            name: &key.name,
+            prefix: &key.prefix,
+            hash: &key.hash,
+            scopes: &joined_scopes,
+            last_used_at: key.last_used_at,
+            meta_id: key.meta.get_id(),
+            tenant_id: key.tenant,
+            certificate: key.certificate.as_deref(),
+        };
+
+        let result = diesel::insert_into(apikeys::table)
+            .values(&new_key)
+            .get_result::<PostgresApiKey>(conn)?;
+
+        key.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, key: &ApiKey) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            apikeys.filter(id.eq(key.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &key.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresApiKey) -> Result<ApiKey, Box<dyn Error>> {
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(ApiKey{
+            id: result.id,
+            user: result.user_id,
+            tenant: result.tenant_id,
+            name: result.name.clone(),
+            prefix: result.prefix.clone(),
+            hash: result.hash.clone(),
+            scopes: result.scopes.split_whitespace().map(|scope| scope.to_string()).collect(),
+            last_used_at: result.last_used_at,
+            certificate: result.certificate.clone(),
+            meta: meta,
+        })
+    }
+
+    fn build_first(results: &[PostgresApiKey]) -> Result<ApiKey, Box<dyn Error>> {
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresApiKeyRepository::build(&results[0])
+    }
+}
+
+impl ApiKeyRepository for PostgresApiKeyRepository {
+    fn find(&self, target: i32) -> Result<ApiKey, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            apikeys.filter(id.eq(target))
+                   .load::<PostgresApiKey>(&connection)?
+        };
+    
+        PostgresApiKeyRepository::build_first(&results)
+    }
+
+    fn find_by_prefix(&self, target_tenant: i32, target: &str) -> Result<ApiKey, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            apikeys.filter(tenant_id.eq(target_tenant))
+                   .filter(prefix.eq(target))
+                   .load::<PostgresApiKey>(&connection)?
+        };
+    
+        PostgresApiKeyRepository::build_first(&results)
+    }
+
+    fn find_by_certificate(&self, target_tenant: i32, target: &str) -> Result<ApiKey, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            apikeys.filter(tenant_id.eq(target_tenant))
+                   .filter(certificate.eq(target))
+                   .load::<PostgresApiKey>(&connection)?
+        };
+    
+        PostgresApiKeyRepository::build_first(&results)
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<ApiKey>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            apikeys.filter(user_id.eq(target_user))
+                   .order(id.asc())
+                   .load::<PostgresApiKey>(&connection)?
+        };
+
+        let mut all_keys = Vec::new();
+        for result in results.iter() {
+            all_keys.push(PostgresApiKeyRepository::build(result)?);
+        }
+
+        Ok(all_keys)
+    }
+
+    fn create(&self, key: &mut ApiKey) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresApiKeyRepository::create_on_conn(&conn, key))?;
+        Ok(())
+    }
+
+    fn save(&self, key: &ApiKey) -> Result<(), Box<dyn Error>> {
+        let pg_key = PostgresApiKey {
+            id: key.id,
+            user_id: key.user,
+            name: key.name.clone(),
+            prefix: key.prefix.clone(),
+            hash: key.hash.clone(),
+            scopes: key.scopes.join(" "),
+            last_used_at: key.last_used_at,
+            meta_id: key.meta.get_id(),
+            tenant_id: key.tenant,
+            certificate: key.certificate.clone(),
+        };
+        
+        let connection = get_connection().get()?;
+        diesel::update(apikeys)
+            .filter(id.eq(key.id))
+            .set(&pg_key)
+            .execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete(&self, key: &ApiKey) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresApiKeyRepository::delete_on_conn(&conn, key))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryApiKeyRepository {
+    table: memory::Table<ApiKey>,
+}
+
+impl InMemoryApiKeyRepository {
+    pub fn new() -> Self {
+        InMemoryApiKeyRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl ApiKeyRepository for InMemoryApiKeyRepository {
+    fn find(&self, target: i32) -> Result<ApiKey, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_by_prefix(&self, tenant: i32, target: &str) -> Result<ApiKey, Box<dyn Error>>  {
+        self.table.find_first(|key| key.tenant == tenant && key.prefix == target)
+    }
+
+    fn find_by_certificate(&self, tenant: i32, target: &str) -> Result<ApiKey, Box<dyn Error>>  {
+        self.table.find_first(|key| key.tenant == tenant && key.certificate.as_deref() == Some(target))
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<ApiKey>, Box<dyn Error>>  {
+        self.table.find_all(|key| key.user == target_user)
+    }
+
+    fn create(&self, key: &mut ApiKey) -> Result<(), Box<dyn Error>> {
+        // in order to create an api key it must exists the metadata for this key
+        get_meta_repository().create(&mut key.meta)?;
+
+        // a certificate identity may be bound to a single key per tenant only
+        let (target, tenant, bound) = (key.prefix.clone(), key.tenant, key.certificate.clone());
+        self.table.insert(key,
+                          |existing| existing.prefix == target ||
+                                     (bound.is_some() && existing.tenant == tenant && existing.certificate == bound),
+                          |key, new_id| key.id = new_id)
+    }
+
+    fn save(&self, key: &ApiKey) -> Result<(), Box<dyn Error>> {
+        self.table.update(key.id, key)
+    }
+
+    fn delete(&self, key: &ApiKey) -> Result<(), Box<dyn Error>> {
+        self.table.delete(key.id)?;
+        get_meta_repository().delete(&key.meta)
+    }
+}
\ No newline at end of file
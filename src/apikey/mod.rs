@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::ApiKeyRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresApiKeyRepository),
+            Backend::Memory => Box::new(framework::InMemoryApiKeyRepository::new()),
+            backend => storage::unsupported(backend, "api keys"),
+        }
+    }; 
+}   
+
+pub fn get_repository() -> Box<&'static dyn domain::ApiKeyRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
\ No newline at end of file
@@ -3,6 +3,7 @@ use crate::constants::errors;
 use crate::metadata::domain::Metadata;
 use crate::secret::domain::Secret;
 use crate::security;
+use crate::tenant::application::tenant_find;
 use crate::directory::get_repository as get_dir_repository;
 use crate::session::{
     get_repository as get_sess_repository,
@@ -10,12 +11,13 @@ use crate::session::{
 };
 use super::{
     get_repository as get_app_repository,
-    domain::App,
+    domain::{App, Branding},
 };
 
-/// If, and only if, there is no application with the same url, a new app with these url and secret gets created into
-/// the system
-pub fn app_register(url: &str,
+/// If, and only if, there is no application with the same url in the given tenant, a new app with these url and secret
+/// gets created into the system
+pub fn app_register(tenant: &str,
+                    url: &str,
                     pem: &[u8],
                     firm: &[u8]) -> Result<(), Box<dyn Error>> {
 
@@ -29,34 +31,78 @@ pub fn app_register(url: &str,
     // the message signature; otherwise there is no way to ensure the secret is the app's one
     security::verify_ec_signature(pem, firm, &data)?;
     
+    let tenant = tenant_find(tenant)?;
+    app_create(tenant.get_id(), url, pem)?;
+    Ok(())
+}
+
+/// Creates a new app with these url and secret into the given tenant, with no signature of the app required
+pub fn app_create(tenant: i32, url: &str, pem: &[u8]) -> Result<App, Box<dyn Error>> {
     let meta = Metadata::new();
     let secret = Secret::new(pem);
 
-    let mut app = App::new(secret, meta, url)?;
+    let mut app = App::new(secret, meta, tenant, url)?;
     get_app_repository().create(&mut app)?;
-    Ok(())
+    Ok(app)
 }
 
 /// If, and only if, the provided signature matches with the application secret, the app and all its data gets removed
 /// from the system and repositories
-pub fn app_delete(url: &str,
+pub fn app_delete(tenant: &str,
+                  url: &str,
                   firm: &[u8]) -> Result<(), Box<dyn Error>> {
     
     info!("got a deletion request from application {} ", url);
 
-    let app = super::get_repository().find_by_url(url)?;
+    let tenant = tenant_find(tenant)?;
+    let app = super::get_repository().find_by_url(tenant.get_id(), url)?;
     let pem = app.secret.get_data();
     
     let mut data: Vec<&[u8]> = Vec::new();
     data.push(url.as_bytes());
 
     security::verify_ec_signature(pem, firm, &data)?;
+    app_remove(&app)
+}
+
+/// If, and only if, the provided signature matches with the application secret, the app gets the given branding,
+/// replacing the previous one. The signed data is the url of the app followed by every value of the branding, in the
+/// same order as they are requested, so none of them can be changed by anyone else
+pub fn app_set_branding(tenant: &str,
+                        url: &str,
+                        branding: Branding,
+                        firm: &[u8]) -> Result<(), Box<dyn Error>> {
+
+    info!("got a branding request from application {} ", url);
+
+    let tenant = tenant_find(tenant)?;
+    let mut app = get_app_repository().find_by_url(tenant.get_id(), url)?;
+    let values = [branding.get_name(), branding.get_logo_url(), branding.get_primary_color(),
+                  branding.get_accent_color(), branding.get_support_url(), branding.get_support_email()];
+
+    let mut data: Vec<&[u8]> = Vec::new();
+    data.push(url.as_bytes());
+    values.iter().for_each(|value| data.push(value.unwrap_or_default().as_bytes()));
+
+    security::verify_ec_signature(app.secret.get_data(), firm, &data)?;
+    app.set_branding(branding);
+    get_app_repository().save(&app)
+}
+
+/// Returns the branding of the app with the given url in the given tenant, if any
+pub fn app_branding(tenant: i32, url: &str) -> Option<Branding> {
+    get_app_repository().find_by_url(tenant, url)
+        .map(|app| app.get_branding().clone())
+        .ok()
+}
 
-    get_dir_repository().delete_all_by_app(&app)?;
-    get_app_repository().delete(&app)?;
+/// The given app and all its data gets removed from the system and repositories, with no signature required
+pub fn app_remove(app: &App) -> Result<(), Box<dyn Error>> {
+    get_dir_repository().delete_all_by_app(app)?;
+    get_app_repository().delete(app)?;
     
     // delete the app's directory from the current sessions
-    if let Ok(sids_arc) = get_group_by_app().find(&app) {
+    if let Ok(sids_arc) = get_group_by_app().find(app) {
         let sids = match sids_arc.read() {
             Ok(sids) => sids,
             Err(err) => {
@@ -65,7 +111,7 @@ pub fn app_delete(url: &str,
             }
         };
         
-        get_group_by_app().delete(&app)?;
+        get_group_by_app().delete(app)?;
     
         for sid in sids.iter() {
             if let Ok(sess_arc) = get_sess_repository().find(sid) {
@@ -77,7 +123,8 @@ pub fn app_delete(url: &str,
                     }
                 };
     
-                sess.delete_directory(&app);
+                sess.delete_directory(app);
+                get_sess_repository().save(&sess)?;
             }
         }
     }
@@ -92,6 +139,7 @@ mod tests {
     use openssl::pkey::{PKey};
     use openssl::ec::EcKey;
     use openssl::hash::MessageDigest;
+    use crate::constants::settings;
 
     use crate::secret::get_repository as get_secret_repository;
     use crate::metadata::get_repository as get_meta_repository;
@@ -117,9 +165,9 @@ mod tests {
         signer.update(EC_PUBLIC).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_register(URL, EC_PUBLIC, &signature).unwrap();
+        app_register("", URL, EC_PUBLIC, &signature).unwrap();
         
-        let app = get_app_repository().find_by_url(URL).unwrap();
+        let app = get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).unwrap();
         assert_eq!(URL, app.url);
         
         let secret = get_secret_repository().find(app.secret.get_id()).unwrap();
@@ -145,10 +193,10 @@ mod tests {
         signer.update(EC_PUBLIC).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_register(URL, EC_PUBLIC, &signature).unwrap();
-        assert!(app_register(URL, EC_PUBLIC, &signature).is_err());
+        app_register("", URL, EC_PUBLIC, &signature).unwrap();
+        assert!(app_register("", URL, EC_PUBLIC, &signature).is_err());
         
-        let app = get_app_repository().find_by_url(URL).unwrap();
+        let app = get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).unwrap();
         get_app_repository().delete(&app).unwrap();
     }
 
@@ -158,8 +206,8 @@ mod tests {
 
         const URL: &str = "http://app.register.wrong.signature.should.fail";
 
-        assert!(app_register(URL, EC_PUBLIC, "fakesignature".as_bytes()).is_err());
-        assert!(get_app_repository().find_by_url(URL).is_err());
+        assert!(app_register("", URL, EC_PUBLIC, "fakesignature".as_bytes()).is_err());
+        assert!(get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).is_err());
     }
 
     #[test]
@@ -177,14 +225,14 @@ mod tests {
         signer.update(EC_PUBLIC).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_register(URL, EC_PUBLIC, &signature).unwrap();
-        let app = get_app_repository().find_by_url(URL).unwrap();
+        app_register("", URL, EC_PUBLIC, &signature).unwrap();
+        let app = get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).unwrap();
         
         let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
         signer.update(URL.as_bytes()).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_delete(URL, &signature).unwrap();
+        app_delete("", URL, &signature).unwrap();
         assert!(get_app_repository().find(app.id).is_err());
         assert!(get_secret_repository().find(app.secret.get_id()).is_err());
         assert!(get_meta_repository().find(app.meta.get_id()).is_err());
@@ -205,10 +253,10 @@ mod tests {
         signer.update(EC_PUBLIC).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_register(URL, EC_PUBLIC, &signature).unwrap();
-        let app = get_app_repository().find_by_url(URL).unwrap();
+        app_register("", URL, EC_PUBLIC, &signature).unwrap();
+        let app = get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).unwrap();
         
-        assert!(app_delete(URL, "fakesignature".as_bytes()).is_err());
+        assert!(app_delete("", URL, "fakesignature".as_bytes()).is_err());
         assert!(get_app_repository().find(app.id).is_ok());
         assert!(get_secret_repository().find(app.secret.get_id()).is_ok());
         assert!(get_meta_repository().find(app.meta.get_id()).is_ok());
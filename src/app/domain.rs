@@ -1,35 +1,129 @@
 use std::error::Error;
+use http::Uri;
 
 use crate::regex;
+use crate::constants::{errors, settings};
 use crate::secret::domain::Secret;
 use crate::metadata::domain::Metadata;
 
 pub trait AppRepository {
     fn find(&self, id: i32) -> Result<App, Box<dyn Error>>;
-    fn find_by_url(&self, url: &str) -> Result<App, Box<dyn Error>>;
+    fn find_by_url(&self, tenant: i32, url: &str) -> Result<App, Box<dyn Error>>;
     fn create(&self, app: &mut App) -> Result<(), Box<dyn Error>>;
     fn save(&self, app: &App) -> Result<(), Box<dyn Error>>;
     fn delete(&self, app: &App) -> Result<(), Box<dyn Error>>;
 }
 
+/// How an app presents itself to its users on the hosted pages and the emails sent on its behalf. Anything not set
+/// falls back to the defaults of the hosted pages and email templates
+#[derive(Serialize)]
+#[derive(Clone, Default, Debug, PartialEq)]
+pub struct Branding {
+    pub(super) name: Option<String>,
+    pub(super) logo_url: Option<String>,
+    pub(super) primary_color: Option<String>,
+    pub(super) accent_color: Option<String>,
+    pub(super) support_url: Option<String>,
+    pub(super) support_email: Option<String>,
+}
+
+impl Branding {
+    /// Builds a new branding out of the given values, empty ones being taken as unset. Links must be https ones, since
+    /// they get rendered into pages served over https, and colors hexadecimal ones, such as #1a2b3c
+    pub fn new(name: &str,
+               logo_url: &str,
+               primary_color: &str,
+               accent_color: &str,
+               support_url: &str,
+               support_email: &str) -> Result<Self, Box<dyn Error>> {
+
+        let optional = |value: &str| Some(value.trim().to_string()).filter(|value| value.len() > 0);
+        let branding = Branding {
+            name: optional(name),
+            logo_url: optional(logo_url),
+            primary_color: optional(primary_color),
+            accent_color: optional(accent_color),
+            support_url: optional(support_url),
+            support_email: optional(support_email),
+        };
+
+        if branding.name.as_ref().map(|name| name.len() > settings::BRAND_NAME_LEN).unwrap_or(false) {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        for link in [&branding.logo_url, &branding.support_url].iter().filter_map(|link| link.as_deref()) {
+            Branding::check_link(link)?;
+        }
+
+        for color in [&branding.primary_color, &branding.accent_color].iter().filter_map(|color| color.as_deref()) {
+            regex::match_regex(regex::COLOR, color)?;
+        }
+
+        if let Some(email) = &branding.support_email {
+            regex::match_regex(regex::EMAIL, email)?;
+        }
+
+        Ok(branding)
+    }
+
+    fn check_link(link: &str) -> Result<(), Box<dyn Error>> {
+        let uri: Uri = link.parse()?;
+        if link.len() > settings::BRAND_LINK_LEN || uri.scheme_str() != Some("https") || uri.host().is_none() {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(())
+    }
+
+    pub fn get_name(&self) -> Option<&str> {
+        self.name.as_deref()
+    }
+
+    pub fn get_logo_url(&self) -> Option<&str> {
+        self.logo_url.as_deref()
+    }
+
+    pub fn get_primary_color(&self) -> Option<&str> {
+        self.primary_color.as_deref()
+    }
+
+    pub fn get_accent_color(&self) -> Option<&str> {
+        self.accent_color.as_deref()
+    }
+
+    pub fn get_support_url(&self) -> Option<&str> {
+        self.support_url.as_deref()
+    }
+
+    pub fn get_support_email(&self) -> Option<&str> {
+        self.support_email.as_deref()
+    }
+}
+
+#[derive(Clone)]
 pub struct App {
     pub(super) id: i32,
+    pub(super) tenant: i32,
     pub(super) url: String,
     pub(super) secret: Secret,
+    pub(super) branding: Branding,
     pub(super) meta: Metadata,
 }
 
 impl App {
     pub fn new(secret: Secret,
                meta: Metadata,
+               tenant: i32,
                url: &str) -> Result<Self, Box<dyn Error>> {
         
         regex::match_regex(regex::URL, url)?;
 
         let app = App {
             id: 0,
+            tenant: tenant,
             url: url.to_string(),
             secret: secret,
+            branding: Branding::default(),
             meta: meta,
         };
         
@@ -40,23 +134,39 @@ impl App {
         self.id
     }
 
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
     pub fn get_url(&self) -> &str {
         &self.url
     }
+
+    pub fn get_branding(&self) -> &Branding {
+        &self.branding
+    }
+
+    pub fn set_branding(&mut self, branding: Branding) {
+        self.branding = branding;
+        self.meta.touch();
+    }
 }
 
 
 #[cfg(test)]
 pub mod tests {
+    use crate::constants::settings;
     use crate::metadata::domain::tests::new_metadata;
     use crate::secret::domain::tests::new_secret;
-    use super::App;
+    use super::{App, Branding};
 
     pub fn new_app() -> App {
         App{
             id: 999,
+            tenant: settings::DEFAULT_TENANT,
             url: "http://testing.com".to_string(),
             secret: new_secret(),
+            branding: Branding::default(),
             meta: new_metadata(),
         }
     }
@@ -64,8 +174,10 @@ pub mod tests {
     pub fn new_app_custom(id: i32, url: &str) -> App {
         App{
             id: id,
+            tenant: settings::DEFAULT_TENANT,
             url: url.to_string(),
             secret: new_secret(),
+            branding: Branding::default(),
             meta: new_metadata(),
         }
     }
@@ -78,9 +190,11 @@ pub mod tests {
         let meta = new_metadata();
         let app = App::new(secret,
                            meta,
+                           settings::DEFAULT_TENANT,
                            URL).unwrap();
 
         assert_eq!(app.id, 0); 
+        assert_eq!(app.tenant, settings::DEFAULT_TENANT);
         assert_eq!(app.url, URL);
     }
 
@@ -92,8 +206,33 @@ pub mod tests {
         let meta = new_metadata();
         let app = App::new(secret,
                            meta,
+                           settings::DEFAULT_TENANT,
                            URL);
     
         assert!(app.is_err());
     }
+
+    #[test]
+    fn branding_new_should_not_fail() {
+        let branding = Branding::new("Testing", "https://testing.com/static/logo.png", "#1A2b3c", "",
+                                     " https://testing.com/support ", "support@testing.com").unwrap();
+
+        assert_eq!(Some("Testing"), branding.get_name());
+        assert_eq!(Some("https://testing.com/static/logo.png"), branding.get_logo_url());
+        assert_eq!(Some("#1A2b3c"), branding.get_primary_color());
+        assert_eq!(None, branding.get_accent_color());
+        assert_eq!(Some("https://testing.com/support"), branding.get_support_url());
+        assert_eq!(Some("support@testing.com"), branding.get_support_email());
+        assert_eq!(Branding::default(), Branding::new("", "", "", "", "", "").unwrap());
+    }
+
+    #[test]
+    fn branding_new_should_fail() {
+        assert!(Branding::new(&"a".repeat(65), "", "", "", "", "").is_err());
+        assert!(Branding::new("", "http://testing.com/logo.png", "", "", "", "").is_err());
+        assert!(Branding::new("", "javascript:alert(1)", "", "", "", "").is_err());
+        assert!(Branding::new("", "", "red", "", "", "").is_err());
+        assert!(Branding::new("", "", "", "#12345", "", "").is_err());
+        assert!(Branding::new("", "", "", "", "", "not an email").is_err());
+    }
 }
\ No newline at end of file
@@ -3,10 +3,12 @@ use tonic::{Request, Response, Status};
 use diesel::NotFound;
 use diesel::result::Error as PgError;
 
+use crate::logging;
 use crate::diesel::prelude::*;
 use crate::diesel::Connection;
 use crate::schema::apps::dsl::*;
 use crate::postgres::*;
+use crate::memory;
 use crate::schema::apps;
 
 use crate::metadata::{
@@ -18,7 +20,8 @@ use crate::secret::{
     framework::PostgresSecretRepository,
 };
 
-use super::domain::{App, AppRepository};
+use crate::tenant::framework::get_tenant;
+use super::domain::{App, AppRepository, Branding};
 
 // Import the generated rust code into module
 mod proto {
@@ -30,16 +33,19 @@ use proto::app_service_server::AppService;
 pub use proto::app_service_server::AppServiceServer;
 
 // Proto message structs
-use proto::{RegisterRequest, DeleteRequest};
+use proto::{RegisterRequest, DeleteRequest, BrandingRequest};
 
 pub struct AppServiceImplementation;
 
 #[tonic::async_trait]
 impl AppService for AppServiceImplementation {
     async fn register(&self, request: Request<RegisterRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        let tenant = get_tenant(&request)?;
         let msg_ref = request.into_inner();
 
-        match super::application::app_register(&msg_ref.url,
+        match super::application::app_register(&tenant,
+                                               &msg_ref.url,
                                                &msg_ref.public,
                                                &msg_ref.firm) {
 
@@ -49,15 +55,43 @@ impl AppService for AppServiceImplementation {
     }
 
     async fn delete(&self, request: Request<DeleteRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        let tenant = get_tenant(&request)?;
         let msg_ref = request.into_inner();
         
-        match super::application::app_delete(&msg_ref.url,
+        match super::application::app_delete(&tenant,
+                                             &msg_ref.url,
                                              &msg_ref.firm) {
 
             Err(err) => Err(Status::aborted(err.to_string())),
             Ok(()) => Ok(Response::new(())),
         }
     }
+
+    async fn set_branding(&self, request: Request<BrandingRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        let tenant = get_tenant(&request)?;
+        let msg_ref = request.into_inner();
+
+        let branding = match Branding::new(&msg_ref.name,
+                                           &msg_ref.logo_url,
+                                           &msg_ref.primary_color,
+                                           &msg_ref.accent_color,
+                                           &msg_ref.support_url,
+                                           &msg_ref.support_email) {
+            Err(err) => return Err(Status::invalid_argument(err.to_string())),
+            Ok(branding) => branding,
+        };
+
+        match super::application::app_set_branding(&tenant,
+                                                   &msg_ref.url,
+                                                   branding,
+                                                   &msg_ref.firm) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
 }
 
 #[derive(Queryable, Insertable, Associations)]
@@ -70,6 +104,13 @@ struct PostgresApp {
     pub url: String,
     pub secret_id: i32,
     pub meta_id: i32,
+    pub tenant_id: i32,
+    pub brand_name: Option<String>,
+    pub logo_url: Option<String>,
+    pub primary_color: Option<String>,
+    pub accent_color: Option<String>,
+    pub support_url: Option<String>,
+    pub support_email: Option<String>,
 }
 
 #[derive(Insertable)]
@@ -79,6 +120,7 @@ struct NewPostgresApp<'a> {
     pub url: &'a str,
     pub secret_id: i32,
     pub meta_id: i32,
+    pub tenant_id: i32,
 }
 
 pub struct PostgresAppRepository;
@@ -95,6 +137,7 @@ impl PostgresAppRepository {
             url: &app.url,
             secret_id: app.secret.get_id(),
             meta_id: app.meta.get_id(),
+            tenant_id: app.tenant,
         };
 
         let result = diesel::insert_into(apps::table)
@@ -114,6 +157,27 @@ impl PostgresAppRepository {
         PostgresSecretRepository::delete_on_conn(conn, &app.secret)?;
         Ok(())
     }
+
+    fn build(result: &PostgresApp) -> Result<App, Box<dyn Error>> {
+        let secret = get_secret_repository().find(result.secret_id)?;
+        let meta = get_meta_repository().find(result.meta_id)?;
+
+        Ok(App{
+            id: result.id,
+            tenant: result.tenant_id,
+            url: result.url.clone(),
+            secret: secret,
+            branding: Branding {
+                name: result.brand_name.clone(),
+                logo_url: result.logo_url.clone(),
+                primary_color: result.primary_color.clone(),
+                accent_color: result.accent_color.clone(),
+                support_url: result.support_url.clone(),
+                support_email: result.support_email.clone(),
+            },
+            meta: meta,
+        })
+    }
 }
 
 impl AppRepository for PostgresAppRepository {
@@ -128,21 +192,14 @@ impl AppRepository for PostgresAppRepository {
             return Err(Box::new(NotFound));
         }
 
-        let secret = get_secret_repository().find(results[0].secret_id)?;
-        let meta = get_meta_repository().find(results[0].meta_id)?;
-        
-        Ok(App{
-            id: results[0].id,
-            url: results[0].url.clone(),
-            secret: secret,
-            meta: meta,
-        })
+        PostgresAppRepository::build(&results[0])
     }
 
-    fn find_by_url(&self, target: &str) -> Result<App, Box<dyn Error>>  {
+    fn find_by_url(&self, target_tenant: i32, target: &str) -> Result<App, Box<dyn Error>>  {
         let results = { // block is required because of connection release
             let connection = get_connection().get()?;
-            apps.filter(url.eq(target))
+            apps.filter(tenant_id.eq(target_tenant))
+                 .filter(url.eq(target))
                  .load::<PostgresApp>(&connection)?
         };
     
@@ -150,15 +207,7 @@ impl AppRepository for PostgresAppRepository {
             return Err(Box::new(NotFound));
         }
 
-        let secret = get_secret_repository().find(results[0].secret_id)?;
-        let meta = get_meta_repository().find(results[0].meta_id)?;
-        
-        Ok(App{
-            id: results[0].id,
-            url: results[0].url.clone(),
-            secret: secret,
-            meta: meta,
-        })
+        PostgresAppRepository::build(&results[0])
     }
 
     fn create(&self, app: &mut App) -> Result<(), Box<dyn Error>> {
@@ -174,6 +223,13 @@ impl AppRepository for PostgresAppRepository {
             url: app.url.to_string(),
             secret_id: app.secret.get_id(),
             meta_id: app.meta.get_id(),
+            tenant_id: app.tenant,
+            brand_name: app.branding.name.clone(),
+            logo_url: app.branding.logo_url.clone(),
+            primary_color: app.branding.primary_color.clone(),
+            accent_color: app.branding.accent_color.clone(),
+            support_url: app.branding.support_url.clone(),
+            support_email: app.branding.support_email.clone(),
         };
                
         let connection = get_connection().get()?;
@@ -190,4 +246,47 @@ impl AppRepository for PostgresAppRepository {
         conn.transaction::<_, PgError, _>(|| PostgresAppRepository::delete_on_conn(&conn, app))?;
         Ok(())
     }
+}
+
+
+pub struct InMemoryAppRepository {
+    table: memory::Table<App>,
+}
+
+impl InMemoryAppRepository {
+    pub fn new() -> Self {
+        InMemoryAppRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl AppRepository for InMemoryAppRepository {
+    fn find(&self, target: i32) -> Result<App, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_by_url(&self, tenant: i32, target: &str) -> Result<App, Box<dyn Error>>  {
+        self.table.find_first(|app| app.tenant == tenant && app.url == target)
+    }
+
+    fn create(&self, app: &mut App) -> Result<(), Box<dyn Error>> {
+        // in order to create an app it must exists a secret and the metadata for this app
+        get_secret_repository().create(&mut app.secret)?;
+        get_meta_repository().create(&mut app.meta)?;
+
+        let (tenant, target) = (app.tenant, app.url.clone());
+        self.table.insert(app, |existing| existing.tenant == tenant && existing.url == target, |app, new_id| app.id = new_id)
+    }
+
+    fn save(&self, app: &App) -> Result<(), Box<dyn Error>> {
+        get_meta_repository().save(&app.meta)?;
+        self.table.update(app.id, app)
+    }
+
+    fn delete(&self, app: &App) -> Result<(), Box<dyn Error>> {
+        self.table.delete(app.id)?;
+        get_meta_repository().delete(&app.meta)?;
+        get_secret_repository().delete(&app.secret)
+    }
 }
\ No newline at end of file
@@ -2,12 +2,18 @@ pub mod framework;
 pub mod application;
 pub mod domain;
 
+use crate::storage::{self, Backend};
+
 lazy_static! {
-    static ref REPO_PROVIDER: framework::PostgresAppRepository = {
-        framework::PostgresAppRepository
+    static ref REPO_PROVIDER: Box<dyn domain::AppRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresAppRepository),
+            Backend::Memory => Box::new(framework::InMemoryAppRepository::new()),
+            backend => storage::unsupported(backend, "apps"),
+        }
     }; 
 }   
 
 pub fn get_repository() -> Box<&'static dyn domain::AppRepository> {
-    Box::new(&*REPO_PROVIDER)
+    Box::new(&**REPO_PROVIDER)
 }
\ No newline at end of file
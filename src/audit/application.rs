@@ -0,0 +1,203 @@
+use std::error::Error;
+use std::collections::VecDeque;
+use std::time::Duration;
+use crate::webhook::application::webhook_notify;
+use crate::pagination::Page;
+use crate::constants::{errors, settings};
+use crate::{logging, security, time};
+use super::{
+    get_repository as get_audit_repository,
+    get_publisher as get_event_publisher,
+    domain::{Event, EventKind, Filter, CheckpointToken},
+};
+
+// sorts before the id of any event, whatever the backend, be it a serial number or an ulid
+const GENESIS: &str = "0";
+
+/// Records a new event into the audit trail, scheduling its delivery to the webhooks subscribed to it, if any.
+/// Failing to record an event must never block the action it is about, so any error is logged instead of being
+/// returned
+pub fn audit_record(user: i32,
+                    issuer: i32,
+                    kind: EventKind,
+                    reason: &str) {
+
+    audit_record_by_app(user, issuer, kind, reason, "")
+}
+
+/// Records a new event into the audit trail as audit_record does, telling it took place through the app with the
+/// given url, so the trail can be filtered by app. Either way, the event tells the address the request being served
+/// comes from, if any
+pub fn audit_record_by_app(user: i32,
+                           issuer: i32,
+                           kind: EventKind,
+                           reason: &str,
+                           app: &str) {
+
+    let mut event = Event::new(user, issuer, kind, reason);
+    event.app = app.to_string();
+    event.ip = logging::current().and_then(|ctx| ctx.ip).unwrap_or_default();
+    if let Err(err) = get_audit_repository().create(&mut event) {
+        error!("could not record {} event for user {}: {}", kind.as_str(), user, err);
+        return;
+    }
+
+    if let Err(err) = webhook_notify(&event) {
+        error!("could not notify {} event for user {}: {}", kind.as_str(), user, err);
+    }
+}
+
+/// Returns the given page of the given user's audit trail matching the given filter, whatever the user it tells, from
+/// the newest event to the oldest one, and the token of the next page, if any
+pub fn audit_history(user: i32, filter: &Filter, page: &Page) -> Result<(Vec<Event>, String), Box<dyn Error>> {
+    let filter = Filter {
+        user: Some(user),
+        ..filter.clone()
+    };
+
+    audit_search(&filter, page)
+}
+
+/// Returns the given page of the events of the whole audit trail matching the given filter, from the newest event to
+/// the oldest one, and the token of the next page, if any
+pub fn audit_search(filter: &Filter, page: &Page) -> Result<(Vec<Event>, String), Box<dyn Error>> {
+    let mut events = get_audit_repository().find_by_filter(filter, page.get_cursor(), page.get_limit())?;
+    let next = page.next_token(&mut events, |event| event.get_id().to_string());
+    Ok((events, next))
+}
+
+/// Returns up to limit events of the whole audit trail recorded after the one with the given id, the oldest first, or
+/// the latest ones if no id is given, so the trail can be followed as it grows
+pub fn audit_tail(after: &str, limit: u64) -> Result<Vec<Event>, Box<dyn Error>> {
+    get_audit_repository().find_after(after, limit)
+}
+
+/// Publishes up to limit events from the audit trail that have not reached the sinks yet, the oldest first, returning
+/// how many of them have been published. Events are published as a batch, into every sink, and only flagged once all
+/// of them have accepted it, so a failing sink holds the events back instead of losing them. Since events carry their
+/// id, an event that got published but not flagged is relayed again and deduplicated by the consumer
+pub fn audit_relay(limit: u64) -> Result<usize, Box<dyn Error>> {
+    let repo = get_audit_repository();
+    let pending = repo.find_unpublished(limit)?;
+    if pending.len() == 0 {
+        return Ok(0);
+    }
+
+    get_event_publisher().publish_all(&pending)?;
+    for event in pending.iter() {
+        repo.set_published(event)?;
+    }
+
+    Ok(pending.len())
+}
+
+fn tampered(id: &str) -> Box<dyn Error> {
+    format!("{}: {}", errors::TAMPERED, id).into()
+}
+
+/// Returns all the checkpoints of the audit trail, the oldest first
+fn audit_checkpoints(batch: u64) -> Result<Vec<Event>, Box<dyn Error>> {
+    let filter = Filter {
+        kinds: vec![EventKind::Checkpoint],
+        ..Default::default()
+    };
+
+    let mut checkpoints = Vec::new();
+    let mut before = "".to_string();
+    loop {
+        let page = get_audit_repository().find_by_filter(&filter, &before, batch)?;
+        let full = page.len() as u64 == batch;
+        if let Some(oldest) = page.last() {
+            before = oldest.get_id().to_string();
+        }
+
+        checkpoints.extend(page);
+        if !full {
+            break;
+        }
+    }
+
+    checkpoints.reverse();
+    Ok(checkpoints)
+}
+
+/// Chains up to batch events recorded after the last one the latest checkpoint covers, and records a checkpoint of the
+/// chain, signed by the active signing key, as an event of the trail itself, so it gets exported to the sinks as any
+/// other. Only events older than CHECKPOINT_SETTLE are chained, so these other instances are still recording do not get
+/// skipped. Returns how many events have been chained
+pub fn audit_checkpoint(batch: u64) -> Result<usize, Box<dyn Error>> {
+    let filter = Filter {
+        kinds: vec![EventKind::Checkpoint],
+        ..Default::default()
+    };
+
+    let (after, mut count, mut digest) = match get_audit_repository().find_by_filter(&filter, "", 1)?.pop() {
+        Some(latest) => {
+            let claim = security::peek_jwt::<CheckpointToken>(latest.get_reason())?;
+            (claim.sub, claim.count, claim.digest)
+        },
+        None => (GENESIS.to_string(), 0, "".to_string()),
+    };
+
+    let settled = time::now() - Duration::from_secs(settings::CHECKPOINT_SETTLE);
+    let events: Vec<Event> = get_audit_repository().find_after(&after, batch)?
+        .into_iter()
+        .take_while(|event| event.get_created_at() <= settled)
+        .collect();
+
+    let last = match events.last() {
+        Some(last) => last,
+        None => return Ok(0),
+    };
+
+    for event in events.iter() {
+        digest = event.chain(&digest);
+    }
+
+    count += events.len();
+    let token = security::encode_jwt(CheckpointToken::new(last, count, &digest))?;
+    let mut checkpoint = Event::new(0, 0, EventKind::Checkpoint, &token);
+    get_audit_repository().create(&mut checkpoint)?;
+
+    info!("audit trail checkpointed up to event {}, {} events chained", last.get_id(), count);
+    Ok(events.len())
+}
+
+/// Chains the whole audit trail again, from the very first event to the last one the latest checkpoint covers, matching
+/// every checkpoint on the way, as read by batches of the given size. The latest checkpoint must be signed by a key
+/// still in use, and vouches for the chain, and so for every checkpoint, before it. Events changed, removed or
+/// inserted fail with TAMPERED, followed by the id of the last event of the first checkpoint not matching the chain.
+/// Returns how many checkpoints and events have been verified; events after the latest checkpoint are not
+pub fn audit_verify(batch: u64) -> Result<(usize, usize), Box<dyn Error>> {
+    let checkpoints = audit_checkpoints(batch)?;
+    if let Some(latest) = checkpoints.last() {
+        if let Err(err) = security::decode_jwt::<CheckpointToken>(latest.get_reason()) {
+            warn!("latest checkpoint {} of the audit trail is not signed by any key in use: {}", latest.get_id(), err);
+            return Err(tampered(latest.get_id()));
+        }
+    }
+
+    let (mut cursor, mut count, mut digest) = (GENESIS.to_string(), 0, "".to_string());
+    let mut fetched: VecDeque<Event> = VecDeque::new();
+    for checkpoint in checkpoints.iter() {
+        let claim = security::peek_jwt::<CheckpointToken>(checkpoint.get_reason())?;
+        while cursor != claim.sub {
+            if fetched.is_empty() {
+                fetched.extend(get_audit_repository().find_after(&cursor, batch)?);
+            }
+
+            // the trail is over before reaching the last event of the checkpoint, so it has been removed
+            let event = fetched.pop_front().ok_or_else(|| tampered(&claim.sub))?;
+            digest = event.chain(&digest);
+            cursor = event.get_id().to_string();
+            count += 1;
+        }
+
+        if digest != claim.digest || count != claim.count {
+            warn!("checkpoint {} does not match the audit trail", checkpoint.get_id());
+            return Err(tampered(&claim.sub));
+        }
+    }
+
+    Ok((checkpoints.len(), count))
+}
\ No newline at end of file
@@ -0,0 +1,509 @@
+use std::error::Error;
+use std::time::SystemTime;
+use chrono::{DateTime, SecondsFormat, Utc};
+use crate::metadata::domain::InnerMetadata;
+use crate::constants::errors;
+use crate::time::{self, unix_timestamp};
+use crate::security::TokenKind;
+
+// version of the json schema events are exported as, increased on every breaking change
+pub const SCHEMA_VERSION: u32 = 1;
+
+pub trait AuditRepository {
+    // up to limit events of the given user recorded before the one with the given id, the newest first, or the latest
+    // ones if no id
+    fn find_by_user(&self, user_id: i32, before: &str, limit: u64) -> Result<Vec<Event>, Box<dyn Error>>;
+    // up to limit events matching the given filter recorded before the one with the given id, the newest first, or
+    // the latest ones if no id
+    fn find_by_filter(&self, filter: &Filter, before: &str, limit: u64) -> Result<Vec<Event>, Box<dyn Error>>;
+    fn find_unpublished(&self, limit: u64) -> Result<Vec<Event>, Box<dyn Error>>;
+    // up to limit events recorded after the one with the given id, the oldest first, or the latest ones if no id
+    fn find_after(&self, after: &str, limit: u64) -> Result<Vec<Event>, Box<dyn Error>>;
+    fn create(&self, event: &mut Event) -> Result<(), Box<dyn Error>>;
+    fn set_published(&self, event: &Event) -> Result<(), Box<dyn Error>>;
+}
+
+pub trait EventPublisher {
+    fn publish(&self, event: &Event) -> Result<(), Box<dyn Error>>;
+
+    // publishes all the given events in order, stopping on the first failure
+    fn publish_all(&self, events: &[Event]) -> Result<(), Box<dyn Error>> {
+        for event in events {
+            self.publish(event)?;
+        }
+
+        Ok(())
+    }
+}
+
+/// All the destinations the audit trail may be exported to
+#[derive(Clone, PartialEq, Debug)]
+pub enum Sink {
+    Redis(String),  // the stream to add the events into
+    File(String),   // the path of the file to append the events to, one json object per line
+    Syslog(String), // the address of the syslog server, as host:port
+    Kafka(String),  // the url of the topic at a kafka rest proxy
+    RabbitMq(String), // the url of the publish endpoint of an exchange at the rabbitmq management api
+    Http(String),   // the url to post the events to, as a json array
+}
+
+impl Sink {
+    /// Parses a sink formatted as <kind>:<target>, such as "file:/var/log/tpauth/audit.log"
+    pub fn from_str(sink: &str) -> Result<Self, Box<dyn Error>> {
+        let mut parts = sink.trim().splitn(2, ':');
+        let kind = parts.next().unwrap_or_default();
+        let target = match parts.next() {
+            Some(target) if target.len() > 0 => target.to_string(),
+            _ => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        match kind {
+            "redis" => Ok(Sink::Redis(target)),
+            "file" => Ok(Sink::File(target)),
+            "syslog" => Ok(Sink::Syslog(target)),
+            "kafka" => Ok(Sink::Kafka(target)),
+            "rabbitmq" => Ok(Sink::RabbitMq(target)),
+            "http" => Ok(Sink::Http(target)),
+            _ => Err(errors::PARSE_FAILED.into()),
+        }
+    }
+
+    /// Parses a comma-separated list of sinks
+    pub fn from_list(sinks: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        sinks.split(',')
+            .filter(|sink| sink.trim().len() > 0)
+            .map(Sink::from_str)
+            .collect()
+    }
+}
+
+/// All kinds of events the audit trail keeps track of
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum EventKind {
+    Suspend,
+    Reinstate,
+    Delete,
+    Restore,
+    Login,
+    LoginFailed,
+    Logout,
+    MfaChallenge,
+    MfaUpdate,
+    EmailChange,
+    Elevate,
+    Disown,
+    PasswordReset,
+    Impersonate,
+    ApiKey,
+    Threat,
+    Credential,
+    Signup,
+    Revoke,
+    Consent,
+    KeyRotation,
+    GlobalLogout,
+    Recovery,
+    PhoneChange,
+    Checkpoint,
+    Verify,
+    Erase,
+    Activate,
+}
+
+impl EventKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            EventKind::Suspend => "suspend",
+            EventKind::Reinstate => "reinstate",
+            EventKind::Delete => "delete",
+            EventKind::Restore => "restore",
+            EventKind::Login => "login",
+            EventKind::LoginFailed => "login_failed",
+            EventKind::Logout => "logout",
+            EventKind::MfaChallenge => "mfa_challenge",
+            EventKind::MfaUpdate => "mfa_update",
+            EventKind::EmailChange => "email_change",
+            EventKind::Elevate => "elevate",
+            EventKind::Disown => "disown",
+            EventKind::PasswordReset => "password_reset",
+            EventKind::Impersonate => "impersonate",
+            EventKind::ApiKey => "api_key",
+            EventKind::Threat => "threat",
+            EventKind::Credential => "credential",
+            EventKind::Signup => "signup",
+            EventKind::Revoke => "revoke",
+            EventKind::Consent => "consent",
+            EventKind::KeyRotation => "key_rotation",
+            EventKind::GlobalLogout => "global_logout",
+            EventKind::Recovery => "recovery",
+            EventKind::PhoneChange => "phone_change",
+            EventKind::Checkpoint => "checkpoint",
+            EventKind::Verify => "verify",
+            EventKind::Erase => "erase",
+            EventKind::Activate => "activate",
+        }
+    }
+
+    pub fn from_str(kind: &str) -> Option<Self> {
+        match kind {
+            "suspend" => Some(EventKind::Suspend),
+            "reinstate" => Some(EventKind::Reinstate),
+            "delete" => Some(EventKind::Delete),
+            "restore" => Some(EventKind::Restore),
+            "login" => Some(EventKind::Login),
+            "login_failed" => Some(EventKind::LoginFailed),
+            "logout" => Some(EventKind::Logout),
+            "mfa_challenge" => Some(EventKind::MfaChallenge),
+            "mfa_update" => Some(EventKind::MfaUpdate),
+            "email_change" => Some(EventKind::EmailChange),
+            "elevate" => Some(EventKind::Elevate),
+            "disown" => Some(EventKind::Disown),
+            "password_reset" => Some(EventKind::PasswordReset),
+            "impersonate" => Some(EventKind::Impersonate),
+            "api_key" => Some(EventKind::ApiKey),
+            "threat" => Some(EventKind::Threat),
+            "credential" => Some(EventKind::Credential),
+            "signup" => Some(EventKind::Signup),
+            "revoke" => Some(EventKind::Revoke),
+            "consent" => Some(EventKind::Consent),
+            "key_rotation" => Some(EventKind::KeyRotation),
+            "global_logout" => Some(EventKind::GlobalLogout),
+            "recovery" => Some(EventKind::Recovery),
+            "phone_change" => Some(EventKind::PhoneChange),
+            "checkpoint" => Some(EventKind::Checkpoint),
+            "verify" => Some(EventKind::Verify),
+            "erase" => Some(EventKind::Erase),
+            "activate" => Some(EventKind::Activate),
+            _ => None,
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct Event {
+    pub(super) id: String,
+    pub(super) user: i32,     // the user the event is about
+    pub(super) issuer: i32,   // the user who has triggered the event
+    pub(super) kind: EventKind,
+    pub(super) reason: String,
+    pub(super) app: String,     // the url of the app the event took place through, if any
+    pub(super) ip: String,      // the address the request triggering the event came from, if any
+    pub(super) published: bool, // whether the event has been relayed to the message bus
+    pub(super) meta: InnerMetadata,
+}
+
+impl Event {
+    pub fn new(user: i32,
+               issuer: i32,
+               kind: EventKind,
+               reason: &str) -> Self {
+
+        Event {
+            id: "".to_string(), // will be set by the repository controller
+            user: user,
+            issuer: issuer,
+            kind: kind,
+            reason: reason.to_string(),
+            app: "".to_string(),
+            ip: "".to_string(),
+            published: false,
+            meta: InnerMetadata::new(),
+        }
+    }
+
+    pub fn get_id(&self) -> &str {
+        &self.id
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_issuer(&self) -> i32 {
+        self.issuer
+    }
+
+    pub fn get_kind(&self) -> EventKind {
+        self.kind
+    }
+
+    pub fn get_reason(&self) -> &str {
+        &self.reason
+    }
+
+    pub fn get_app(&self) -> &str {
+        &self.app
+    }
+
+    pub fn get_ip(&self) -> &str {
+        &self.ip
+    }
+
+    pub fn get_created_at(&self) -> SystemTime {
+        self.meta.created_at
+    }
+
+    pub fn is_published(&self) -> bool {
+        self.published
+    }
+
+    /// Returns the event as exported to the sinks, following the documented schema
+    pub fn to_json(&self) -> serde_json::Value {
+        let time: DateTime<Utc> = self.meta.created_at.into();
+        serde_json::json!({
+            "version": SCHEMA_VERSION,
+            "id": self.id,
+            "user": self.user,
+            "issuer": self.issuer,
+            "kind": self.kind.as_str(),
+            "reason": self.reason,
+            "created_at": unix_timestamp(self.meta.created_at),
+            "time": time.to_rfc3339_opts(SecondsFormat::Secs, true),
+        })
+    }
+
+    /// Returns the link of the hash chain of the audit trail standing for this event, given the one of the event
+    /// before: the digest of both, so changing, removing or inserting any event breaks every link after it. Times are
+    /// taken by the second, as precise as every backend keeps them
+    pub fn chain(&self, prev: &str) -> String {
+        let fields = serde_json::json!([
+            prev,
+            self.id,
+            self.user,
+            self.issuer,
+            self.kind.as_str(),
+            self.reason,
+            self.app,
+            self.ip,
+            unix_timestamp(self.meta.created_at),
+        ]);
+
+        sha256::digest_bytes(fields.to_string().as_bytes())
+    }
+}
+
+// signed checkpoint of the hash chain of the audit trail, kept as the reason of a checkpoint event
+#[derive(Serialize, Deserialize)]
+pub struct CheckpointToken {
+    pub(super) exp: usize,          // expiration time (as UTC timestamp) - required, checkpoints never expire
+    pub(super) iat: SystemTime,     // issued at: creation time
+    pub(super) iss: String,         // issuer
+    pub(super) sub: String,         // subject: the id of the last event the checkpoint covers
+    pub(super) count: usize,        // how many events the chain covers, from the very first one
+    pub(super) digest: String,      // the link of the chain standing for the last event
+}
+
+impl TokenKind for CheckpointToken {
+    const KIND: &'static str = "checkpoint+jwt";
+}
+
+impl CheckpointToken {
+    pub fn new(last: &Event, count: usize, digest: &str) -> Self {
+        CheckpointToken {
+            exp: usize::MAX,
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: last.id.clone(),
+            count: count,
+            digest: digest.to_string(),
+        }
+    }
+}
+
+/// What the events of an audit query must match: all of the criteria that are set, while an empty list of kinds
+/// matches any kind. The time range includes its start but not its end
+#[derive(Clone, Default, Debug)]
+pub struct Filter {
+    pub user: Option<i32>,
+    pub issuer: Option<i32>,
+    pub kinds: Vec<EventKind>,
+    pub app: Option<String>,
+    pub ip: Option<String>,
+    pub since: Option<SystemTime>,
+    pub until: Option<SystemTime>,
+}
+
+impl Filter {
+    pub fn matches(&self, event: &Event) -> bool {
+        self.user.map(|user| event.user == user).unwrap_or(true) &&
+            self.issuer.map(|issuer| event.issuer == issuer).unwrap_or(true) &&
+            (self.kinds.len() == 0 || self.kinds.contains(&event.kind)) &&
+            self.app.as_ref().map(|app| &event.app == app).unwrap_or(true) &&
+            self.ip.as_ref().map(|ip| &event.ip == ip).unwrap_or(true) &&
+            self.since.map(|since| event.meta.created_at >= since).unwrap_or(true) &&
+            self.until.map(|until| event.meta.created_at < until).unwrap_or(true)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use super::{Event, EventKind, Filter, Sink, CheckpointToken, SCHEMA_VERSION};
+
+    #[test]
+    fn event_new_should_not_fail() {
+        let before = SystemTime::now();
+        let event = Event::new(1, 2, EventKind::Suspend, "testing");
+        let after = SystemTime::now();
+
+        assert_eq!("", event.id);
+        assert_eq!(1, event.user);
+        assert_eq!(2, event.issuer);
+        assert_eq!(EventKind::Suspend, event.kind);
+        assert_eq!("testing", event.reason);
+        assert_eq!("", event.app);
+        assert_eq!("", event.ip);
+        assert!(!event.published);
+        assert!(event.meta.created_at >= before && event.meta.created_at <= after);
+    }
+
+    #[test]
+    fn event_kind_from_str_should_not_fail() {
+        let kinds = &[EventKind::Suspend, EventKind::Reinstate, EventKind::Delete, EventKind::Restore,
+                      EventKind::Login, EventKind::LoginFailed, EventKind::Logout, EventKind::MfaChallenge,
+                      EventKind::MfaUpdate, EventKind::EmailChange, EventKind::Elevate, EventKind::Credential,
+                      EventKind::Signup, EventKind::Revoke, EventKind::Consent,
+                      EventKind::KeyRotation, EventKind::GlobalLogout, EventKind::Recovery,
+                      EventKind::PhoneChange, EventKind::Checkpoint];
+
+        for kind in kinds {
+            assert_eq!(Some(*kind), EventKind::from_str(kind.as_str()));
+        }
+
+        assert_eq!(None, EventKind::from_str("unknown"));
+    }
+
+    #[test]
+    fn event_to_json_should_not_fail() {
+        let mut event = Event::new(1, 2, EventKind::Login, "testing");
+        event.id = "01FMPQ6ZJ5X2Y3ZK9H8T7V6W5Q".to_string();
+
+        let json = event.to_json();
+        assert_eq!(SCHEMA_VERSION as u64, json["version"].as_u64().unwrap());
+        assert_eq!("01FMPQ6ZJ5X2Y3ZK9H8T7V6W5Q", json["id"]);
+        assert_eq!(1, json["user"].as_i64().unwrap());
+        assert_eq!(2, json["issuer"].as_i64().unwrap());
+        assert_eq!("login", json["kind"]);
+        assert_eq!("testing", json["reason"]);
+        assert!(json["created_at"].as_u64().unwrap() > 0);
+        assert!(json["time"].as_str().unwrap().ends_with("Z"));
+    }
+
+    #[test]
+    fn event_to_json_should_match_schema() {
+        let schema: serde_json::Value = serde_json::from_str(include_str!("../../schemas/event.v1.json")).unwrap();
+        assert_eq!(SCHEMA_VERSION as u64, schema["properties"]["version"]["const"].as_u64().unwrap());
+
+        let json = Event::new(1, 2, EventKind::Login, "testing").to_json();
+        let properties = schema["properties"].as_object().unwrap();
+        assert_eq!(properties.len(), json.as_object().unwrap().len());
+        for field in schema["required"].as_array().unwrap() {
+            assert!(!json[field.as_str().unwrap()].is_null(), "{} is missing", field);
+        }
+
+        // every kind the schema tells must be a known one
+        for kind in schema["properties"]["kind"]["enum"].as_array().unwrap() {
+            let kind = EventKind::from_str(kind.as_str().unwrap()).unwrap();
+            assert_eq!(kind, EventKind::from_str(kind.as_str()).unwrap());
+        }
+    }
+
+    #[test]
+    fn event_chain_should_not_fail() {
+        let mut event = Event::new(1, 2, EventKind::Login, "testing");
+        event.id = "1".to_string();
+
+        let link = event.chain("");
+        assert_eq!(64, link.len());
+        assert_eq!(link, event.chain(""));
+        assert_ne!(link, event.chain("previous"));
+
+        let mut tampered = event.clone();
+        tampered.reason = "tampered".to_string();
+        assert_ne!(link, tampered.chain(""));
+
+        tampered = event.clone();
+        tampered.id = "2".to_string();
+        assert_ne!(link, tampered.chain(""));
+    }
+
+    #[test]
+    fn checkpoint_token_new_should_not_fail() {
+        let mut event = Event::new(1, 2, EventKind::Login, "testing");
+        event.id = "1".to_string();
+
+        let before = SystemTime::now();
+        let claim = CheckpointToken::new(&event, 10, "digest");
+        let after = SystemTime::now();
+
+        assert_eq!(usize::MAX, claim.exp);
+        assert!(claim.iat >= before && claim.iat <= after);
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!("1", claim.sub);
+        assert_eq!(10, claim.count);
+        assert_eq!("digest", claim.digest);
+    }
+
+    #[test]
+    fn filter_matches_should_not_fail() {
+        let mut event = Event::new(1, 2, EventKind::Login, "testing");
+        event.app = "http://tpauth.alvidir.com".to_string();
+        event.ip = "10.0.0.1".to_string();
+
+        let filter = Filter {
+            user: Some(1),
+            issuer: Some(2),
+            kinds: vec![EventKind::Login, EventKind::LoginFailed],
+            app: Some("http://tpauth.alvidir.com".to_string()),
+            ip: Some("10.0.0.1".to_string()),
+            since: Some(event.meta.created_at),
+            until: Some(event.meta.created_at + Duration::from_secs(1)),
+        };
+
+        assert!(filter.matches(&event));
+        assert!(Filter::default().matches(&event));
+    }
+
+    #[test]
+    fn filter_matches_should_fail() {
+        let event = Event::new(1, 2, EventKind::Login, "testing");
+        let filters = vec![
+            Filter {user: Some(2), ..Default::default()},
+            Filter {issuer: Some(1), ..Default::default()},
+            Filter {kinds: vec![EventKind::Logout], ..Default::default()},
+            Filter {app: Some("http://tpauth.alvidir.com".to_string()), ..Default::default()},
+            Filter {ip: Some("10.0.0.1".to_string()), ..Default::default()},
+            Filter {since: Some(event.meta.created_at + Duration::from_secs(1)), ..Default::default()},
+            Filter {until: Some(event.meta.created_at), ..Default::default()},
+        ];
+
+        for filter in filters {
+            assert!(!filter.matches(&event), "{:?} should not match", filter);
+        }
+    }
+
+    #[test]
+    fn sink_from_str_should_not_fail() {
+        assert_eq!(Sink::File("/var/log/audit.log".to_string()), Sink::from_str("file:/var/log/audit.log").unwrap());
+        assert_eq!(Sink::Syslog("127.0.0.1:514".to_string()), Sink::from_str("syslog:127.0.0.1:514").unwrap());
+        assert_eq!(Sink::Http("https://siem.example.com/ingest".to_string()),
+                   Sink::from_str("http:https://siem.example.com/ingest").unwrap());
+        assert_eq!(Sink::RabbitMq("http://rabbitmq:15672/api/exchanges/%2F/audit/publish".to_string()),
+                   Sink::from_str("rabbitmq:http://rabbitmq:15672/api/exchanges/%2F/audit/publish").unwrap());
+    }
+
+    #[test]
+    fn sink_from_str_should_fail() {
+        for sink in &["file", "file:", "smtp:admin@example.com", ":/var/log/audit.log"] {
+            assert!(Sink::from_str(sink).is_err(), "{} should not be parsed", sink);
+        }
+    }
+
+    #[test]
+    fn sink_from_list_should_not_fail() {
+        let sinks = Sink::from_list("redis:events, file:/var/log/audit.log,").unwrap();
+        assert_eq!(vec![Sink::Redis("events".to_string()), Sink::File("/var/log/audit.log".to_string())], sinks);
+        assert!(Sink::from_list("").unwrap().is_empty());
+    }
+}
\ No newline at end of file
@@ -0,0 +1,58 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::error::Error;
+use crate::storage::{self, Backend};
+use crate::constants::environment;
+use crate::config;
+use domain::Sink;
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::AuditRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Mongo) {
+            Backend::Mongo => Box::new(framework::MongoAuditRepository),
+            Backend::Postgres => Box::new(framework::PostgresAuditRepository),
+            Backend::Memory => Box::new(framework::InMemoryAuditRepository::new()),
+            backend => storage::unsupported(backend, "audit"),
+        }
+    }; 
+
+    static ref PUBLISHER_PROVIDER: Box<dyn domain::EventPublisher + Sync + Send> = {
+        let sinks = get_sinks().expect("audit sinks must be a list of redis, file, syslog, kafka, rabbitmq or http targets");
+        Box::new(framework::FanOutEventPublisher::new(sinks.into_iter().map(new_publisher).collect()))
+    };
+}   
+
+fn new_publisher(sink: Sink) -> Box<dyn domain::EventPublisher + Sync + Send> {
+    match sink {
+        Sink::Redis(stream) => Box::new(framework::RedisEventPublisher::new(&stream)),
+        Sink::File(path) => Box::new(framework::FileEventPublisher::new(&path)),
+        Sink::Syslog(addr) => Box::new(framework::SyslogEventPublisher::new(&addr).expect("syslog socket must be bound")),
+        Sink::Kafka(url) => Box::new(framework::KafkaEventPublisher::new(&url)),
+        Sink::RabbitMq(url) => Box::new(framework::RabbitMqEventPublisher::new(&url)),
+        Sink::Http(url) => Box::new(framework::HttpEventPublisher::new(&url)),
+    }
+}
+
+/// Returns all the sinks the audit trail is exported to, as set by AUDIT_SINKS, or else the EVENT_STREAM redis
+/// stream, if any
+pub fn get_sinks() -> Result<Vec<Sink>, Box<dyn Error>> {
+    match config::get(environment::AUDIT_SINKS) {
+        Ok(sinks) => Sink::from_list(&sinks),
+        Err(_) => Ok(config::get(environment::EVENT_STREAM).map(|stream| vec![Sink::Redis(stream)]).unwrap_or_default()),
+    }
+}
+
+/// Returns true if, and only if, the audit trail is exported to any sink
+pub fn is_exported() -> bool {
+    get_sinks().map(|sinks| sinks.len() > 0).unwrap_or(false)
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::AuditRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
+
+pub fn get_publisher() -> Box<&'static dyn domain::EventPublisher> {
+    Box::new(&**PUBLISHER_PROVIDER)
+}
\ No newline at end of file
@@ -0,0 +1,72 @@
+use std::error::Error;
+use std::collections::HashMap;
+use serde_json::Value;
+use crate::config;
+use crate::constants::{errors, environment};
+use crate::session::domain::Session;
+use crate::app::domain::App;
+use crate::detection::domain::{Origin, Assessment};
+use crate::audit::{application::audit_record_by_app, domain::EventKind};
+use super::{get_authorizer, domain::{AuthorizationContext, Decision, get_scopes}};
+
+/// Fails unless the authorizer, if any, allows the token being issued for the provided session and app by the given
+/// grant, carrying the given claims. Tokens issued by a login tell the authorizer where it comes from, and how risky it
+/// has been assessed, as well. Whenever the authorizer fails, the token is denied, unless AUTHORIZER_FAIL_OPEN is set
+pub fn authorization_check(sess: &Session,
+                           app: &App,
+                           grant: &str,
+                           claims: &HashMap<String, Value>,
+                           login: Option<(&Origin, &Assessment)>) -> Result<(), Box<dyn Error>> {
+
+    let authorizer = match get_authorizer() {
+        Some(authorizer) => authorizer,
+        None => return Ok(()),
+    };
+
+    let user = sess.get_user().ok();
+    let context = AuthorizationContext {
+        tenant: sess.get_tenant(),
+        user: user.map(|user| user.get_id()),
+        email: user.map(|user| user.get_email().to_string()),
+        app: app.get_id(),
+        app_url: app.get_url().to_string(),
+        grant: grant.to_string(),
+        impersonated: sess.is_impersonated(),
+        scopes: get_scopes(claims),
+        ip: login.map(|(origin, _)| origin.get_ip().to_string()),
+        country: login.and_then(|(origin, _)| origin.get_country()).map(str::to_string),
+        risk_score: login.map(|(_, assessment)| assessment.get_score()),
+        anomalies: login.map(|(_, assessment)| assessment.get_anomalies().iter()
+                .map(|anomaly| anomaly.as_str().to_string())
+                .collect())
+            .unwrap_or_default(),
+    };
+
+    let decision = match authorizer.authorize(&context) {
+        Ok(decision) => decision,
+        Err(err) if fail_open() => {
+            warn!("token for app {} could not be authorized, issued anyway: {}", app.get_id(), err);
+            return Ok(());
+        },
+        Err(err) => {
+            warn!("token for app {} could not be authorized, denied: {}", app.get_id(), err);
+            Decision::deny("authorizer has failed")
+        },
+    };
+
+    if decision.is_allowed() {
+        return Ok(());
+    }
+
+    info!("token for app {} of tenant {} denied by the authorizer: {}", app.get_id(), sess.get_tenant(), decision.get_reason());
+    if let Some(user) = user {
+        let reason = format!("denied by the authorizer: {}", decision.get_reason());
+        audit_record_by_app(user.get_id(), user.get_id(), EventKind::LoginFailed, &reason, app.get_url());
+    }
+
+    Err(errors::ISSUANCE_DENIED.into())
+}
+
+fn fail_open() -> bool {
+    config::get(environment::AUTHORIZER_FAIL_OPEN).map(|value| value == "true").unwrap_or(false)
+}
@@ -0,0 +1,183 @@
+use std::error::Error;
+use std::collections::HashMap;
+use serde_json::Value;
+
+pub trait Authorizer {
+    // decides whether the token described by the given context may be issued
+    fn authorize(&self, context: &AuthorizationContext) -> Result<Decision, Box<dyn Error>>;
+}
+
+/// All the providers tokens may be authorized by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Provider {
+    Http,
+    Opa,
+    Grpc,
+}
+
+impl Provider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Provider::Http => "http",
+            Provider::Opa => "opa",
+            Provider::Grpc => "grpc",
+        }
+    }
+
+    pub fn from_str(provider: &str) -> Option<Self> {
+        match provider {
+            "http" => Some(Provider::Http),
+            "opa" => Some(Provider::Opa),
+            "grpc" => Some(Provider::Grpc),
+            _ => None,
+        }
+    }
+}
+
+/// Everything known about a token by the time it gets authorized, its claims being already enriched
+#[derive(Clone, Debug)]
+pub struct AuthorizationContext {
+    pub(super) tenant: i32,
+    pub(super) user: Option<i32>,       // none if the session is a guest one
+    pub(super) email: Option<String>,   // none if the session is a guest one
+    pub(super) app: i32,
+    pub(super) app_url: String,
+    pub(super) grant: String,           // how the token is being issued, such as password, refresh or guest
+    pub(super) impersonated: bool,
+    pub(super) scopes: Vec<String>,
+    pub(super) ip: Option<String>,      // none unless the token is issued by a login
+    pub(super) country: Option<String>, // none unless the token is issued by a login from a known country
+    pub(super) risk_score: Option<u8>,  // none unless the token is issued by a login
+    pub(super) anomalies: Vec<String>,
+}
+
+impl AuthorizationContext {
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_user(&self) -> Option<i32> {
+        self.user
+    }
+
+    pub fn get_email(&self) -> Option<&str> {
+        self.email.as_deref()
+    }
+
+    pub fn get_app(&self) -> i32 {
+        self.app
+    }
+
+    pub fn get_app_url(&self) -> &str {
+        &self.app_url
+    }
+
+    pub fn get_grant(&self) -> &str {
+        &self.grant
+    }
+
+    pub fn is_guest(&self) -> bool {
+        self.user.is_none()
+    }
+
+    pub fn is_impersonated(&self) -> bool {
+        self.impersonated
+    }
+
+    pub fn get_scopes(&self) -> &[String] {
+        &self.scopes
+    }
+
+    pub fn get_ip(&self) -> Option<&str> {
+        self.ip.as_deref()
+    }
+
+    pub fn get_country(&self) -> Option<&str> {
+        self.country.as_deref()
+    }
+
+    pub fn get_risk_score(&self) -> Option<u8> {
+        self.risk_score
+    }
+
+    pub fn get_anomalies(&self) -> &[String] {
+        &self.anomalies
+    }
+}
+
+/// What an authorizer tells about a token, along with why, if it gets denied
+#[derive(Clone, PartialEq, Debug)]
+pub struct Decision {
+    pub(super) allowed: bool,
+    pub(super) reason: String,
+}
+
+impl Decision {
+    pub fn allow() -> Self {
+        Decision {
+            allowed: true,
+            reason: "".to_string(),
+        }
+    }
+
+    pub fn deny(reason: &str) -> Self {
+        Decision {
+            allowed: false,
+            reason: reason.to_string(),
+        }
+    }
+
+    pub fn is_allowed(&self) -> bool {
+        self.allowed
+    }
+
+    pub fn get_reason(&self) -> &str {
+        &self.reason
+    }
+}
+
+/// Returns the scopes the given claims grant, as told by the space-separated scope claim (RFC 9068), if any
+pub fn get_scopes(claims: &HashMap<String, Value>) -> Vec<String> {
+    match claims.get("scope") {
+        Some(Value::String(scope)) => scope.split_whitespace().map(str::to_string).collect(),
+        _ => Vec::new(),
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::collections::HashMap;
+    use serde_json::json;
+    use super::{Provider, Decision, get_scopes};
+
+    #[test]
+    fn provider_from_str_should_not_fail() {
+        for provider in &[Provider::Http, Provider::Opa, Provider::Grpc] {
+            assert_eq!(Some(*provider), Provider::from_str(provider.as_str()));
+        }
+
+        assert_eq!(None, Provider::from_str("unknown"));
+    }
+
+    #[test]
+    fn decision_should_not_fail() {
+        assert!(Decision::allow().is_allowed());
+
+        let decision = Decision::deny("region not allowed");
+        assert!(!decision.is_allowed());
+        assert_eq!("region not allowed", decision.get_reason());
+    }
+
+    #[test]
+    fn get_scopes_should_not_fail() {
+        let mut claims = HashMap::new();
+        assert!(get_scopes(&claims).is_empty());
+
+        claims.insert("scope".to_string(), json!(" read  write "));
+        assert_eq!(vec!["read".to_string(), "write".to_string()], get_scopes(&claims));
+
+        claims.insert("scope".to_string(), json!(["read", "write"]));
+        assert!(get_scopes(&claims).is_empty());
+    }
+}
@@ -0,0 +1,234 @@
+use std::error::Error;
+use std::sync::Mutex;
+use std::time::Duration;
+use serde::{Serialize, Deserialize};
+use serde_json::Value;
+use tonic::transport::{Channel, Endpoint};
+use tokio::runtime::Handle;
+
+use crate::constants::{settings, errors};
+use super::domain::{Authorizer, AuthorizationContext, Decision};
+
+// Import the generated rust code of the external authorizers into module
+mod proto {
+    tonic::include_proto!("authorization");
+}
+
+use proto::authorizer_client::AuthorizerClient;
+use proto::AuthorizeRequest;
+
+const UNDEFINED_REASON: &str = "undefined decision";
+
+#[derive(Serialize)]
+struct HttpAuthorizeRequest<'a> {
+    tenant: i32,
+    user: Option<i32>,
+    email: Option<&'a str>,
+    app: i32,
+    app_url: &'a str,
+    grant: &'a str,
+    guest: bool,
+    impersonated: bool,
+    scopes: &'a [String],
+    ip: Option<&'a str>,
+    country: Option<&'a str>,
+    risk_score: Option<u8>,
+    anomalies: &'a [String],
+}
+
+impl<'a> HttpAuthorizeRequest<'a> {
+    fn new(context: &'a AuthorizationContext) -> Self {
+        HttpAuthorizeRequest {
+            tenant: context.get_tenant(),
+            user: context.get_user(),
+            email: context.get_email(),
+            app: context.get_app(),
+            app_url: context.get_app_url(),
+            grant: context.get_grant(),
+            guest: context.is_guest(),
+            impersonated: context.is_impersonated(),
+            scopes: context.get_scopes(),
+            ip: context.get_ip(),
+            country: context.get_country(),
+            risk_score: context.get_risk_score(),
+            anomalies: context.get_anomalies(),
+        }
+    }
+}
+
+#[derive(Deserialize, Debug)]
+struct HttpAuthorizeResponse {
+    allow: bool,
+    #[serde(default)]
+    reason: String,
+}
+
+fn new_agent() -> ureq::Agent {
+    ureq::AgentBuilder::new()
+        .timeout(Duration::from_secs(settings::AUTHORIZER_TIMEOUT))
+        .build()
+}
+
+/// Authorizes tokens by posting their context as json to an external service, which responds with the decision
+pub struct HttpAuthorizer {
+    url: String,
+    agent: ureq::Agent,
+}
+
+impl HttpAuthorizer {
+    pub fn new(url: &str) -> Self {
+        HttpAuthorizer {
+            url: url.to_string(),
+            agent: new_agent(),
+        }
+    }
+}
+
+impl Authorizer for HttpAuthorizer {
+    fn authorize(&self, context: &AuthorizationContext) -> Result<Decision, Box<dyn Error>> {
+        let request = HttpAuthorizeRequest::new(context);
+        let response: HttpAuthorizeResponse = self.agent.post(&self.url)
+            .send_json(serde_json::to_value(&request)?)?
+            .into_json()?;
+
+        match response.allow {
+            true => Ok(Decision::allow()),
+            false => Ok(Decision::deny(&response.reason)),
+        }
+    }
+}
+
+/// Returns the decision told by the result of an Open Policy Agent query: either a boolean or an object with the allow
+/// boolean and, optionally, the reason. A result that is missing or of any other shape stands for a denial, since
+/// policies not defined for the input are undefined rather than false
+fn parse_opa_result(result: Option<&Value>) -> Decision {
+    match result {
+        Some(Value::Bool(true)) => Decision::allow(),
+        Some(Value::Object(result)) if result.get("allow") == Some(&Value::Bool(true)) => Decision::allow(),
+        Some(Value::Object(result)) if result.get("allow") == Some(&Value::Bool(false)) => {
+            let reason = result.get("reason").and_then(Value::as_str).unwrap_or_default();
+            Decision::deny(reason)
+        },
+        Some(Value::Bool(false)) => Decision::deny(""),
+        _ => Decision::deny(UNDEFINED_REASON),
+    }
+}
+
+/// Authorizes tokens by querying the decision document of an Open Policy Agent, at the url of its data api (such as
+/// http://opa:8181/v1/data/tpauth/issuance), the context of the token being the input of the query
+pub struct OpaAuthorizer {
+    url: String,
+    agent: ureq::Agent,
+}
+
+impl OpaAuthorizer {
+    pub fn new(url: &str) -> Self {
+        OpaAuthorizer {
+            url: url.to_string(),
+            agent: new_agent(),
+        }
+    }
+}
+
+impl Authorizer for OpaAuthorizer {
+    fn authorize(&self, context: &AuthorizationContext) -> Result<Decision, Box<dyn Error>> {
+        let request = HttpAuthorizeRequest::new(context);
+        let response: Value = self.agent.post(&self.url)
+            .send_json(serde_json::json!({"input": request}))?
+            .into_json()?;
+
+        Ok(parse_opa_result(response.get("result")))
+    }
+}
+
+/// Authorizes tokens by calling the Authorize method of the external authorizer's Authorizer service. The channel is
+/// opened by the first token being issued, since it requires the runtime
+pub struct GrpcAuthorizer {
+    url: String,
+    channel: Mutex<Option<Channel>>,
+}
+
+impl GrpcAuthorizer {
+    pub fn new(url: &str) -> Self {
+        GrpcAuthorizer {
+            url: url.to_string(),
+            channel: Mutex::new(None),
+        }
+    }
+
+    fn get_channel(&self) -> Result<Channel, Box<dyn Error>> {
+        let mut channel = match self.channel.lock() {
+            Ok(channel) => channel,
+            Err(err) => {
+                error!("lock for authorizer channel got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        if let Some(channel) = channel.as_ref() {
+            return Ok(channel.clone());
+        }
+
+        let endpoint = Endpoint::from_shared(self.url.clone())?
+            .timeout(Duration::from_secs(settings::AUTHORIZER_TIMEOUT));
+
+        let lazy = endpoint.connect_lazy()?;
+        *channel = Some(lazy.clone());
+        Ok(lazy)
+    }
+}
+
+impl Authorizer for GrpcAuthorizer {
+    fn authorize(&self, context: &AuthorizationContext) -> Result<Decision, Box<dyn Error>> {
+        let request = AuthorizeRequest {
+            tenant: context.get_tenant(),
+            user: context.get_user().unwrap_or_default(),
+            email: context.get_email().unwrap_or_default().to_string(),
+            app: context.get_app(),
+            app_url: context.get_app_url().to_string(),
+            grant: context.get_grant().to_string(),
+            guest: context.is_guest(),
+            impersonated: context.is_impersonated(),
+            scopes: context.get_scopes().to_vec(),
+            ip: context.get_ip().unwrap_or_default().to_string(),
+            country: context.get_country().unwrap_or_default().to_string(),
+            has_risk_score: context.get_risk_score().is_some(),
+            risk_score: context.get_risk_score().unwrap_or_default() as u32,
+            anomalies: context.get_anomalies().to_vec(),
+        };
+
+        // tokens are issued by synchronous transactions running on the runtime, so the worker thread gets handed over
+        // while waiting for the authorizer
+        let mut client = AuthorizerClient::new(self.get_channel()?);
+        let response = tokio::task::block_in_place(|| Handle::current().block_on(client.authorize(request)))?;
+        let response = response.into_inner();
+        match response.allow {
+            true => Ok(Decision::allow()),
+            false => Ok(Decision::deny(&response.reason)),
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use serde_json::json;
+    use super::super::domain::Decision;
+    use super::{parse_opa_result, UNDEFINED_REASON};
+
+    #[test]
+    fn parse_opa_result_should_not_fail() {
+        assert_eq!(Decision::allow(), parse_opa_result(Some(&json!(true))));
+        assert_eq!(Decision::allow(), parse_opa_result(Some(&json!({"allow": true}))));
+        assert_eq!(Decision::deny(""), parse_opa_result(Some(&json!(false))));
+        assert_eq!(Decision::deny("region not allowed"),
+                   parse_opa_result(Some(&json!({"allow": false, "reason": "region not allowed"}))));
+    }
+
+    #[test]
+    fn parse_opa_result_undefined_should_deny() {
+        assert_eq!(Decision::deny(UNDEFINED_REASON), parse_opa_result(None));
+        assert_eq!(Decision::deny(UNDEFINED_REASON), parse_opa_result(Some(&json!({"reason": "missing allow"}))));
+        assert_eq!(Decision::deny(UNDEFINED_REASON), parse_opa_result(Some(&json!("allow"))));
+    }
+}
@@ -0,0 +1,47 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::sync::{Arc, RwLock};
+use crate::constants::environment;
+use crate::config;
+
+lazy_static! {
+    static ref AUTHORIZER_PROVIDER: RwLock<Option<Arc<dyn domain::Authorizer + Sync + Send>>> = {
+        let authorizer = config::get(environment::AUTHORIZER).ok().map(|provider| {
+            let provider = domain::Provider::from_str(&provider)
+                .expect("authorizer must be one of http, opa or grpc");
+
+            let url = config::get(environment::AUTHORIZER_URL).expect("authorizer url must be set");
+            let authorizer: Arc<dyn domain::Authorizer + Sync + Send> = match provider {
+                domain::Provider::Http => Arc::new(framework::HttpAuthorizer::new(&url)),
+                domain::Provider::Opa => Arc::new(framework::OpaAuthorizer::new(&url)),
+                domain::Provider::Grpc => Arc::new(framework::GrpcAuthorizer::new(&url)),
+            };
+
+            authorizer
+        });
+
+        RwLock::new(authorizer)
+    };
+}
+
+/// Returns the authorizer of the tokens being issued, if any
+pub fn get_authorizer() -> Option<Arc<dyn domain::Authorizer + Sync + Send>> {
+    match AUTHORIZER_PROVIDER.read() {
+        Ok(authorizer) => authorizer.clone(),
+        Err(err) => {
+            error!("read lock for authorizer got poisoned: {}", err);
+            None
+        }
+    }
+}
+
+/// Sets the given authorizer as the one of all the tokens being issued from now on, replacing the configured one if
+/// any
+pub fn set_authorizer(authorizer: Arc<dyn domain::Authorizer + Sync + Send>) {
+    match AUTHORIZER_PROVIDER.write() {
+        Ok(mut current) => *current = Some(authorizer),
+        Err(err) => error!("write lock for authorizer got poisoned: {}", err),
+    }
+}
@@ -0,0 +1,67 @@
+use std::error::Error;
+use crate::constants::{environment, errors, settings};
+use crate::time::unix_timestamp;
+use crate::keyring::application::keyring_get;
+use crate::user::application::get_admin_user;
+use super::{
+    get_repository as get_backup_repository,
+    domain::Archive,
+};
+
+const BACKUP_KEY_LEN: usize = 32;
+
+/// Returns the key archives are sealed with, as set by the environment
+fn get_backup_key() -> Result<Vec<u8>, Box<dyn Error>> {
+    let key_b64 = match keyring_get(environment::BACKUP_SECRET) {
+        Ok(key_b64) => key_b64,
+        Err(_) => return Err("backup secret must be set".into()),
+    };
+
+    let key = base64::decode(key_b64)?;
+    if key.len() != BACKUP_KEY_LEN {
+        return Err(format!("backup secret must be {} bytes long", BACKUP_KEY_LEN).into());
+    }
+
+    Ok(key)
+}
+
+/// Archives hold the data of every tenant, so only administrators of the default one are granted for them
+fn check_backup_admin(token: &str) -> Result<(), Box<dyn Error>> {
+    let admin = get_admin_user(token)?;
+    if admin.get_tenant() != settings::DEFAULT_TENANT {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to an administrator of the default tenant, returns all the auth data
+/// sealed into an encrypted archive
+pub fn backup_export(token: &str) -> Result<Vec<u8>, Box<dyn Error>> {
+    info!("got an export request");
+    check_backup_admin(token)?;
+    backup_dump()
+}
+
+/// If, and only if, the provided token belongs to an administrator of the default tenant, all the auth data gets
+/// replaced by the one in the given archive
+pub fn backup_restore(token: &str, sealed: &[u8]) -> Result<(), Box<dyn Error>> {
+    info!("got a restore request");
+    check_backup_admin(token)?;
+    backup_load(sealed)
+}
+
+/// Returns all the auth data sealed into an encrypted archive, regardless of who is asking for it
+pub fn backup_dump() -> Result<Vec<u8>, Box<dyn Error>> {
+    let archive = get_backup_repository().export()?;
+    archive.seal(&get_backup_key()?)
+}
+
+/// Replaces all the auth data by the one in the given encrypted archive, regardless of who is asking for it
+pub fn backup_load(sealed: &[u8]) -> Result<(), Box<dyn Error>> {
+    let archive = Archive::open(sealed, &get_backup_key()?)?;
+    get_backup_repository().restore(&archive)?;
+
+    info!("archive created at {} has been restored", unix_timestamp(archive.get_created_at()));
+    Ok(())
+}
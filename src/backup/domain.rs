@@ -0,0 +1,165 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration, UNIX_EPOCH};
+use bson::{Bson, Document};
+use crate::security;
+use crate::constants::{errors, settings};
+use crate::time::{self, unix_timestamp};
+
+pub trait BackupRepository {
+    fn export(&self) -> Result<Archive, Box<dyn Error>>;
+    fn restore(&self, archive: &Archive) -> Result<(), Box<dyn Error>>;
+}
+
+/// All the rows of a table, each of them encoded as a json object
+#[derive(Clone, PartialEq, Debug)]
+pub struct Table {
+    pub(super) name: String,
+    pub(super) rows: Vec<String>,
+}
+
+impl Table {
+    pub fn get_name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn get_rows(&self) -> &[String] {
+        &self.rows
+    }
+}
+
+/// A snapshot of all the auth data, sorted in such a way that no table comes before the ones it depends on
+#[derive(Clone, PartialEq, Debug)]
+pub struct Archive {
+    pub(super) version: i32,
+    pub(super) created_at: SystemTime,
+    pub(super) tables: Vec<Table>,
+}
+
+impl Archive {
+    pub fn new() -> Self {
+        Archive {
+            version: settings::BACKUP_VERSION,
+            created_at: time::now(),
+            tables: Vec::new(),
+        }
+    }
+
+    pub fn push(&mut self, name: &str, rows: Vec<String>) {
+        self.tables.push(Table {
+            name: name.to_string(),
+            rows: rows,
+        });
+    }
+
+    pub fn get_created_at(&self) -> SystemTime {
+        self.created_at
+    }
+
+    pub fn get_tables(&self) -> &[Table] {
+        &self.tables
+    }
+
+    /// returns the archive encrypted with the provided key, so it can be kept anywhere without exposing its content
+    pub fn seal(&self, key: &[u8]) -> Result<Vec<u8>, Box<dyn Error>> {
+        let tables: Vec<Bson> = self.tables.iter().map(|table| {
+            let rows: Vec<Bson> = table.rows.iter().map(|row| Bson::String(row.clone())).collect();
+            Bson::Document(doc!{"name": table.name.clone(), "rows": rows})
+        }).collect();
+
+        let document = doc!{
+            "version": self.version,
+            "created_at": unix_timestamp(self.created_at) as i64,
+            "tables": tables,
+        };
+
+        let mut data = Vec::new();
+        document.to_writer(&mut data)?;
+        security::encrypt_aes(key, &data)
+    }
+
+    /// decrypts the provided archive with the given key, failing if the archive has been sealed by another key or
+    /// with another format version
+    pub fn open(sealed: &[u8], key: &[u8]) -> Result<Self, Box<dyn Error>> {
+        let data = security::decrypt_aes(key, sealed)?;
+        let document = Document::from_reader(&mut data.as_slice())?;
+        if document.get_i32("version")? != settings::BACKUP_VERSION {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        let mut archive = Archive {
+            version: settings::BACKUP_VERSION,
+            created_at: UNIX_EPOCH + Duration::from_secs(document.get_i64("created_at")? as u64),
+            tables: Vec::new(),
+        };
+
+        for table in document.get_array("tables")?.iter() {
+            let table = match table.as_document() {
+                Some(table) => table,
+                None => return Err(errors::PARSE_FAILED.into()),
+            };
+
+            let mut rows = Vec::new();
+            for row in table.get_array("rows")?.iter() {
+                match row.as_str() {
+                    Some(row) => rows.push(row.to_string()),
+                    None => return Err(errors::PARSE_FAILED.into()),
+                }
+            }
+
+            archive.push(table.get_str("name")?, rows);
+        }
+
+        Ok(archive)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use crate::constants::settings;
+    use super::Archive;
+
+    const KEY: &[u8] = &[7u8; 32];
+
+    pub fn new_archive() -> Archive {
+        let mut archive = Archive::new();
+        archive.created_at = SystemTime::UNIX_EPOCH + Duration::from_secs(1634550000);
+        archive.push("metadata", vec![r#"{"id":1}"#.to_string(), r#"{"id":2}"#.to_string()]);
+        archive.push("users", vec![r#"{"id":1,"name":"testing"}"#.to_string()]);
+        archive
+    }
+
+    #[test]
+    fn archive_new_should_not_fail() {
+        let archive = Archive::new();
+        assert_eq!(archive.version, settings::BACKUP_VERSION);
+        assert_eq!(archive.tables.len(), 0);
+    }
+
+    #[test]
+    fn archive_seal_should_not_fail() {
+        let archive = new_archive();
+        let sealed = archive.seal(KEY).unwrap();
+        
+        let opened = Archive::open(&sealed, KEY).unwrap();
+        assert_eq!(opened, archive);
+        assert_eq!(opened.get_tables()[0].get_name(), "metadata");
+        assert_eq!(opened.get_tables()[1].get_rows().len(), 1);
+    }
+
+    #[test]
+    fn archive_open_with_wrong_key_should_fail() {
+        let sealed = new_archive().seal(KEY).unwrap();
+        assert!(Archive::open(&sealed, &[8u8; 32]).is_err());
+    }
+
+    #[test]
+    fn archive_open_another_version_should_fail() {
+        let mut archive = new_archive();
+        archive.version = settings::BACKUP_VERSION + 1;
+
+        let sealed = archive.seal(KEY).unwrap();
+        assert!(Archive::open(&sealed, KEY).is_err());
+    }
+}
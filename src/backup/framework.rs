@@ -0,0 +1,164 @@
+use std::error::Error;
+use tonic::{Request, Response, Status};
+use diesel::result::Error as PgError;
+use diesel::sql_types::Text;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::constants::errors;
+
+use crate::firewall::framework::ip_filter;
+use super::domain::{Archive, BackupRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("backup");
+}
+
+// Proto generated server traits
+use proto::backup_service_server::BackupService;
+pub use proto::backup_service_server::BackupServiceServer;
+
+// Proto message structs
+use proto::Archive as ProtoArchive;
+
+pub struct BackupServiceImplementation;
+
+#[tonic::async_trait]
+impl BackupService for BackupServiceImplementation {
+    async fn export(&self, request: Request<()>) -> Result<Response<ProtoArchive>, Status> {
+        ip_filter(&request, "admin")?;
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        match super::application::backup_export(token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(data) => Ok(Response::new(
+                ProtoArchive{
+                    data: data,
+                }
+            )),
+        }
+    }
+
+    async fn restore(&self, request: Request<ProtoArchive>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::backup_restore(&token, &msg_ref.data) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+}
+
+// all the tables holding auth data, sorted in such a way that no table comes before the ones it references
+const TABLES: &[&str] = &[
+    "metadata",
+    "secrets",
+    "tenants",
+    "tenant_settings",
+    "users",
+    "emails",
+    "attributes",
+    "apps",
+    "apikeys",
+    "iprules",
+    "policies",
+    "invitations",
+    "devices",
+    "credentials",
+    "contacts",
+];
+
+#[derive(QueryableByName)]
+struct PostgresRow {
+    #[sql_type = "Text"]
+    pub data: String,
+}
+
+pub struct PostgresBackupRepository;
+
+impl PostgresBackupRepository {
+    fn export_on_conn(conn: &PgConnection) -> Result<Archive, PgError> {
+        let mut archive = Archive::new();
+        for table in TABLES.iter() {
+            let rows = diesel::sql_query(format!("SELECT row_to_json(t)::text AS data FROM {} t ORDER BY t.id", table))
+                .load::<PostgresRow>(conn)?;
+
+            archive.push(table, rows.into_iter().map(|row| row.data).collect());
+        }
+
+        Ok(archive)
+    }
+
+    fn restore_on_conn(conn: &PgConnection, archive: &Archive) -> Result<(), PgError> {
+        // any other table referencing these ones, such as the directories one, gets emptied as well
+        diesel::sql_query(format!("TRUNCATE {} CASCADE", TABLES.join(", ")))
+            .execute(conn)?;
+
+        for table in TABLES.iter() {
+            let rows = match archive.get_tables().iter().find(|candidate| candidate.get_name() == *table) {
+                Some(candidate) => candidate.get_rows(),
+                None => continue,
+            };
+
+            for row in rows.iter() {
+                diesel::sql_query(format!("INSERT INTO {0} SELECT * FROM json_populate_record(NULL::{0}, $1::json)", table))
+                    .bind::<Text, _>(row)
+                    .execute(conn)?;
+            }
+
+            // the sequence must keep going from the greatest restored id
+            diesel::sql_query(format!("SELECT setval(pg_get_serial_sequence('{0}', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM {0}", table))
+                .execute(conn)?;
+        }
+
+        Ok(())
+    }
+}
+
+impl BackupRepository for PostgresBackupRepository {
+    fn export(&self) -> Result<Archive, Box<dyn Error>> {
+        // all tables must be read from the same snapshot, otherwise references could be broken
+        let conn = get_connection().get()?;
+        let archive = conn.build_transaction()
+            .repeatable_read()
+            .read_only()
+            .run::<_, PgError, _>(|| PostgresBackupRepository::export_on_conn(&conn))?;
+
+        Ok(archive)
+    }
+
+    fn restore(&self, archive: &Archive) -> Result<(), Box<dyn Error>> {
+        // table names cannot be bound as parameters, so only the known ones are accepted
+        if archive.get_tables().iter().any(|table| !TABLES.contains(&table.get_name())) {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresBackupRepository::restore_on_conn(&conn, archive))?;
+        Ok(())
+    }
+}
@@ -0,0 +1,18 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::BackupRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresBackupRepository),
+            backend => storage::unsupported(backend, "backups"),
+        }
+    }; 
+}   
+
+pub fn get_repository() -> Box<&'static dyn domain::BackupRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
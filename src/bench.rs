@@ -0,0 +1,176 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::time::{Duration, Instant};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use openssl::ec::{EcGroup, EcKey};
+use openssl::nid::Nid;
+
+use crate::constants::{environment, settings};
+use crate::embed;
+use crate::security;
+use crate::detection::domain::Origin;
+use crate::app::application::app_create;
+use crate::session::application::{session_login, session_introspect};
+use crate::user::application::{user_signup, user_verify};
+use crate::user::{get_repository as get_user_repository, domain::Token};
+
+const APP_URL: &str = "http://bench.tpauth";
+const EMAIL: &str = "bench@tpauth.bench";
+const PASSWORD: &str = "936a185caaa266bb9cbe981e9e05cb78cd732b0b3280eb944412bb6f8f8f07af";
+
+// signups must not collide with any user already created, so every one of them takes the next email
+static SIGNUPS: AtomicUsize = AtomicUsize::new(0);
+
+/// The latency a hot path must keep: both its median and 99th percentile must be within the budget, or else the
+/// benchmark fails
+pub struct Budget {
+    pub name: &'static str,
+    pub median: Duration,
+    pub p99: Duration,
+}
+
+/// The budgets of the authentication hot path, as measured in-process against the in-memory backend, so they tell
+/// the cost of the logic alone, with no storage nor network round trips
+pub const BUDGETS: &[Budget] = &[
+    Budget {name: "signup", median: Duration::from_micros(1000), p99: Duration::from_micros(5000)},
+    Budget {name: "login", median: Duration::from_micros(2000), p99: Duration::from_micros(10000)},
+    Budget {name: "validation", median: Duration::from_micros(100), p99: Duration::from_micros(500)},
+];
+
+/// The latencies measured by a benchmark, sorted from the fastest to the slowest
+pub struct Report {
+    name: String,
+    samples: Vec<Duration>,
+}
+
+impl Report {
+    pub fn new(name: &str, mut samples: Vec<Duration>) -> Self {
+        samples.sort();
+        Report {
+            name: name.to_string(),
+            samples: samples,
+        }
+    }
+
+    pub fn get_name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn len(&self) -> usize {
+        self.samples.len()
+    }
+
+    /// Returns the latency the given percentile of the samples are within, from 0 to 100
+    pub fn percentile(&self, percentile: f64) -> Duration {
+        if self.samples.is_empty() {
+            return Duration::default();
+        }
+
+        let rank = (percentile / 100.0 * self.samples.len() as f64).ceil() as usize;
+        self.samples[rank.max(1).min(self.samples.len()) - 1]
+    }
+
+    pub fn median(&self) -> Duration {
+        self.percentile(50.0)
+    }
+
+    pub fn p99(&self) -> Duration {
+        self.percentile(99.0)
+    }
+
+    /// Returns the budget of the benchmark, if any, and whether the report keeps within it
+    pub fn check(&self) -> Option<(&'static Budget, bool)> {
+        let budget = BUDGETS.iter().find(|budget| budget.name == self.name)?;
+        Some((budget, self.median() <= budget.median && self.p99() <= budget.p99))
+    }
+}
+
+/// Runs the given closure as many times as iterations are given, after a tenth of them as warm up, returning the time
+/// each one took
+pub fn measure<F>(name: &str, iterations: usize, mut f: F) -> Result<Report, Box<dyn Error>>
+where
+    F: FnMut() -> Result<(), Box<dyn Error>>,
+{
+    for _ in 0..iterations / 10 {
+        f()?;
+    }
+
+    let mut samples = Vec::with_capacity(iterations);
+    for _ in 0..iterations {
+        let start = Instant::now();
+        f()?;
+        samples.push(start.elapsed());
+    }
+
+    Ok(Report::new(name, samples))
+}
+
+/// Sets the services up against the in-memory backend, with a key pair generated on the fly and no background jobs,
+/// then registers the app and the verified user the benchmarks log in as
+pub fn setup() -> Result<(), Box<dyn Error>> {
+    let group = EcGroup::from_curve_name(Nid::X9_62_PRIME256V1)?;
+    let key = EcKey::generate(&group)?;
+    let public = base64::encode(key.public_key_to_pem()?);
+    std::env::set_var(environment::JWT_SECRET, base64::encode(key.private_key_to_pem()?));
+    std::env::set_var(environment::JWT_PUBLIC, &public);
+    std::env::set_var(environment::PWD_SUFIX, "bench");
+
+    embed::init(embed::Options::new()
+        .set(environment::STORAGE, "memory")
+        .set(environment::SESSION_STORAGE, "memory")
+        .background_jobs(false))?;
+
+    app_create(settings::DEFAULT_TENANT, APP_URL, public.as_bytes())?;
+    user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default())?;
+    let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL)?;
+    let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+    user_verify(&security::encode_jwt(claim)?)?;
+    Ok(())
+}
+
+/// Signs a brand new user up
+pub fn signup() -> Result<(), Box<dyn Error>> {
+    let email = format!("bench-{}@tpauth.bench", SIGNUPS.fetch_add(1, Ordering::SeqCst));
+    user_signup("", &email, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default())
+}
+
+/// Logs in as the user registered by the setup, returning the token of its session
+pub fn login() -> Result<String, Box<dyn Error>> {
+    session_login("", EMAIL, PASSWORD, "", &[], "", APP_URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default())
+}
+
+/// Validates the given session token, as gateways do on every request
+pub fn validate(token: &str) -> Result<(), Box<dyn Error>> {
+    session_introspect(token, false).map(|_| ())
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::Duration;
+    use super::Report;
+
+    #[test]
+    fn report_percentile_should_not_fail() {
+        let samples = (1..=100).rev().map(Duration::from_millis).collect();
+        let report = Report::new("login", samples);
+
+        assert_eq!(100, report.len());
+        assert_eq!(Duration::from_millis(50), report.median());
+        assert_eq!(Duration::from_millis(99), report.p99());
+        assert_eq!(Duration::from_millis(1), report.percentile(0.0));
+        assert_eq!(Duration::from_millis(100), report.percentile(100.0));
+    }
+
+    #[test]
+    fn report_check_should_not_fail() {
+        let fast = Report::new("validation", vec![Duration::from_micros(10); 100]);
+        assert!(fast.check().unwrap().1);
+
+        let slow = Report::new("validation", vec![Duration::from_secs(1); 100]);
+        assert!(!slow.check().unwrap().1);
+
+        let unknown = Report::new("unknown", vec![Duration::from_secs(1)]);
+        assert!(unknown.check().is_none());
+    }
+}
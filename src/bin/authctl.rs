@@ -0,0 +1,346 @@
+//! Operator cli performing the operational actions of the admin service. It authenticates by the token of its own
+//! administrator session, as given by `AUTHCTL_TOKEN` or the `--token` flag, and reaches the service at `AUTHCTL_URL`
+//! (http://localhost:8000 by default) or the one given by the `--url` flag.
+
+use std::env;
+use std::error::Error;
+use std::fs;
+use std::time::{Duration, UNIX_EPOCH};
+use tonic::Request;
+use tonic::metadata::MetadataValue;
+use tonic::transport::{Channel, Endpoint};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("admin");
+}
+
+use proto::admin_service_client::AdminServiceClient;
+use proto::{UserRequest, AppRequest, ApiKeyId, CreateAppRequest, EventsRequest, SearchEventsRequest, Event, ImportChunk};
+use proto::PreRegisterRequest;
+
+const TOKEN_ENV: &str = "AUTHCTL_TOKEN";
+const URL_ENV: &str = "AUTHCTL_URL";
+const DEFAULT_URL: &str = "http://localhost:8000";
+const TIMEOUT: u64 = 10; // time in seconds
+const TAIL_LIMIT: u64 = 50;
+const TAIL_INTERVAL: u64 = 2; // time in seconds between polls
+const CHUNK_SIZE: usize = 65536; // size in bytes of each piece of an imported file
+
+const USAGE: &str = "usage: authctl [--url <url>] [--token <token>] <command>
+
+commands:
+    create-app <tenant> <url> <public key file>
+    delete-app <tenant> <url>
+    app-usage <tenant> <url>
+    stats
+    diagnostics
+    revoke-apikey <id>
+    revoke-sessions <tenant> <email> <reason>
+    suspend <tenant> <email> <reason>
+    reinstate <tenant> <email> <reason>
+    preregister <tenant> <email> [--timeout <seconds>] [--mfa]
+    import <tenant> <csv|ndjson> <file> [--update] [--dry-run]
+    rotate-keys
+    revoke-previous-key
+    reload
+    migrate
+    tail [--follow]
+    search [--user <id>] [--issuer <id>] [--kind <kind>]... [--app <url>] [--ip <ip>] [--since <timestamp>]
+           [--until <timestamp>]";
+
+struct Options {
+    url: String,
+    token: String,
+    command: Vec<String>,
+}
+
+/// Returns the options given by the command line, falling back to the environment for the unset ones
+fn parse_options(args: &[String]) -> Result<Options, Box<dyn Error>> {
+    let mut url = env::var(URL_ENV).unwrap_or_else(|_| DEFAULT_URL.to_string());
+    let mut token = env::var(TOKEN_ENV).ok();
+    let mut command = Vec::new();
+
+    let mut args = args.iter();
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            "--url" => url = args.next().ok_or(USAGE)?.to_string(),
+            "--token" => token = Some(args.next().ok_or(USAGE)?.to_string()),
+            _ => command.push(arg.to_string()),
+        }
+    }
+
+    match token {
+        Some(token) if token.len() > 0 => Ok(Options{url, token, command}),
+        _ => Err(format!("a token is required, either by {} or the --token flag", TOKEN_ENV).into()),
+    }
+}
+
+/// Returns the request carrying the given message, authenticated by the given token
+fn new_request<T>(message: T, token: &str) -> Result<Request<T>, Box<dyn Error>> {
+    let mut request = Request::new(message);
+    request.metadata_mut().insert("token", MetadataValue::from_str(token)?);
+    Ok(request)
+}
+
+fn user_request(args: &[String]) -> Result<UserRequest, Box<dyn Error>> {
+    match args {
+        [tenant, email, reason] => Ok(UserRequest {
+            tenant: tenant.to_string(),
+            email: email.to_string(),
+            reason: reason.to_string(),
+        }),
+        _ => Err(USAGE.into()),
+    }
+}
+
+/// Returns the pre-registration of the given email into the given tenant, as told by the given flags
+fn preregister_request(tenant: &str, email: &str, flags: &[String]) -> Result<PreRegisterRequest, Box<dyn Error>> {
+    let mut message = PreRegisterRequest {
+        tenant: tenant.to_string(),
+        email: email.to_string(),
+        ..Default::default()
+    };
+
+    let mut flags = flags.iter();
+    while let Some(flag) = flags.next() {
+        match flag.as_str() {
+            "--timeout" => message.timeout = flags.next().ok_or(USAGE)?.parse()?,
+            "--mfa" => message.mfa = true,
+            _ => return Err(USAGE.into()),
+        }
+    }
+
+    Ok(message)
+}
+
+fn print_event(event: &Event) {
+    let created_at = UNIX_EPOCH + Duration::from_secs(event.created_at);
+    let created_at: chrono::DateTime<chrono::Utc> = created_at.into();
+    println!("{}\t{}\t{}\tuser={}\tissuer={}\tapp={}\tip={}\t{}",
+             event.id, created_at.to_rfc3339(), event.kind, event.user, event.issuer, event.app, event.ip,
+             event.reason);
+}
+
+/// Streams the given file to the bulk import of users into the given tenant, then prints its summary
+async fn import(client: &mut AdminServiceClient<Channel>,
+                token: &str,
+                tenant: &str,
+                format: &str,
+                path: &str,
+                flags: &[String]) -> Result<(), Box<dyn Error>> {
+
+    if flags.iter().any(|flag| flag != "--update" && flag != "--dry-run") {
+        return Err(USAGE.into());
+    }
+
+    let dry_run = flags.iter().any(|flag| flag == "--dry-run");
+    let conflict = if flags.iter().any(|flag| flag == "--update") { "update" } else { "skip" };
+
+    // the options are told by the first chunk only
+    let data = fs::read(path)?;
+    let mut chunks: Vec<ImportChunk> = data.chunks(CHUNK_SIZE)
+        .map(|data| ImportChunk{data: data.to_vec(), ..Default::default()})
+        .collect();
+
+    if chunks.is_empty() {
+        chunks.push(ImportChunk::default());
+    }
+
+    chunks[0].tenant = tenant.to_string();
+    chunks[0].format = format.to_string();
+    chunks[0].conflict = conflict.to_string();
+    chunks[0].dry_run = dry_run;
+
+    let request = new_request(tokio_stream::iter(chunks), token)?;
+    let summary = client.bulk_import_users(request).await?.into_inner();
+    for failure in summary.errors.iter() {
+        println!("record {} ({}): {}", failure.index, failure.email, failure.error);
+    }
+
+    println!("{}{} users imported: {} keeping their password, {} required to reset it; {} updated, {} skipped; \
+              {} records failed",
+             if summary.dry_run { "[dry run] " } else { "" },
+             summary.imported, summary.preserved, summary.reset, summary.updated, summary.skipped,
+             summary.errors.len());
+    Ok(())
+}
+
+/// Prints all the events of the audit trail matching the given flags, the newest first, page after page
+async fn search(client: &mut AdminServiceClient<Channel>, token: &str, flags: &[String]) -> Result<(), Box<dyn Error>> {
+    let mut message = SearchEventsRequest::default();
+    let mut flags = flags.iter();
+    while let Some(flag) = flags.next() {
+        let value = flags.next().ok_or(USAGE)?;
+        match flag.as_str() {
+            "--user" => message.user = value.parse()?,
+            "--issuer" => message.issuer = value.parse()?,
+            "--kind" => message.kinds.push(value.to_string()),
+            "--app" => message.app = value.to_string(),
+            "--ip" => message.ip = value.to_string(),
+            "--since" => message.since = value.parse()?,
+            "--until" => message.until = value.parse()?,
+            _ => return Err(USAGE.into()),
+        }
+    }
+
+    loop {
+        let page = client.search_events(new_request(message.clone(), token)?).await?.into_inner();
+        page.events.iter().for_each(print_event);
+        if page.next_page_token.len() == 0 {
+            return Ok(());
+        }
+
+        message.page_token = page.next_page_token;
+    }
+}
+
+/// Prints the latest events of the audit trail and, if follow is set, keeps polling for new ones until interrupted
+async fn tail(client: &mut AdminServiceClient<Channel>, token: &str, follow: bool) -> Result<(), Box<dyn Error>> {
+    let mut after = "".to_string();
+    loop {
+        let message = EventsRequest{after: after.clone(), limit: TAIL_LIMIT};
+        let events = client.list_events(new_request(message, token)?).await?.into_inner().events;
+        events.iter().for_each(print_event);
+        if let Some(last) = events.last() {
+            after = last.id.clone();
+        }
+
+        // a full page means there may be more events already waiting
+        if !follow && (after.len() == 0 || events.len() < TAIL_LIMIT as usize) {
+            return Ok(());
+        } else if events.len() < TAIL_LIMIT as usize {
+            tokio::time::sleep(Duration::from_secs(TAIL_INTERVAL)).await;
+        }
+    }
+}
+
+async fn run(options: Options) -> Result<(), Box<dyn Error>> {
+    let channel = Endpoint::from_shared(options.url.clone())?
+        .connect_timeout(Duration::from_secs(TIMEOUT))
+        .connect()
+        .await?;
+
+    let mut client = AdminServiceClient::new(channel);
+    let token = &options.token;
+    let (command, args) = match options.command.split_first() {
+        Some((command, args)) => (command.as_str(), args),
+        None => return Err(USAGE.into()),
+    };
+
+    match (command, args) {
+        ("create-app", [tenant, url, path]) => {
+            let message = CreateAppRequest {
+                tenant: tenant.to_string(),
+                url: url.to_string(),
+                public: fs::read(path)?,
+            };
+
+            client.create_app(new_request(message, token)?).await?;
+            println!("application {} has been created", url);
+        },
+        ("delete-app", [tenant, url]) => {
+            let message = AppRequest{tenant: tenant.to_string(), url: url.to_string()};
+            client.delete_app(new_request(message, token)?).await?;
+            println!("application {} has been deleted", url);
+        },
+        ("app-usage", [tenant, url]) => {
+            let message = AppRequest{tenant: tenant.to_string(), url: url.to_string()};
+            let response = client.get_app_usage(new_request(message, token)?).await?.into_inner();
+            for usage in response.usage.iter() {
+                let limit = if usage.limit == 0 {"unlimited".to_string()} else {usage.limit.to_string()};
+                println!("{}: {} of {} per {} seconds", usage.metric, usage.used, limit, usage.period);
+            }
+        },
+        ("stats", []) => {
+            let response = client.get_stats(new_request((), token)?).await?.into_inner();
+            println!("active sessions: {}", response.active_sessions);
+            for app in response.sessions_by_app.iter() {
+                println!("app {}: {} sessions", app.app, app.sessions);
+            }
+
+            for tokens in response.tokens_issued.iter() {
+                println!("{} tokens by {}: {}", tokens.kind, tokens.grant, tokens.count);
+            }
+        },
+        ("diagnostics", []) => {
+            let response = client.get_diagnostics(new_request((), token)?).await?.into_inner();
+            if response.findings.is_empty() {
+                println!("no findings");
+            }
+
+            for finding in response.findings.iter() {
+                println!("{} {} {}: {}", finding.severity, finding.check, finding.subject, finding.message);
+            }
+
+            for expiration in response.expirations.iter() {
+                println!("{} {} expires at {}", expiration.check, expiration.subject, expiration.expires_at);
+            }
+        },
+        ("revoke-apikey", [id]) => {
+            let message = ApiKeyId{id: id.parse()?};
+            client.revoke_api_key(new_request(message, token)?).await?;
+            println!("api key {} has been revoked", id);
+        },
+        ("revoke-sessions", args) => {
+            client.revoke_sessions(new_request(user_request(args)?, token)?).await?;
+            println!("sessions have been revoked");
+        },
+        ("suspend", args) => {
+            client.suspend_user(new_request(user_request(args)?, token)?).await?;
+            println!("user has been suspended");
+        },
+        ("reinstate", args) => {
+            client.reinstate_user(new_request(user_request(args)?, token)?).await?;
+            println!("user has been reinstated");
+        },
+        ("preregister", [tenant, email, flags @ ..]) => {
+            let message = preregister_request(tenant, email, flags)?;
+            let response = client.pre_register_user(new_request(message, token)?).await?.into_inner();
+            let deadline = UNIX_EPOCH + Duration::from_secs(response.deadline);
+            let deadline: chrono::DateTime<chrono::Utc> = deadline.into();
+            println!("user {} has been pre-registered, pending until {}", response.id, deadline.to_rfc3339());
+        },
+        ("import", [tenant, format, path, flags @ ..]) => import(&mut client, token, tenant, format, path, flags).await?,
+        ("rotate-keys", []) => {
+            let response = client.rotate_keys(new_request((), token)?).await?.into_inner();
+            println!("{} secrets have been rotated", response.rotated);
+        },
+        ("revoke-previous-key", []) => {
+            client.revoke_previous_key(new_request((), token)?).await?;
+            println!("previous signing key has been revoked");
+        },
+        ("reload", []) => {
+            let response = client.reload_config(new_request((), token)?).await?.into_inner();
+            println!("settings changed: {}", response.changed.join(", "));
+        },
+        ("migrate", []) => {
+            client.run_migrations(new_request((), token)?).await?;
+            println!("migrations have been applied");
+        },
+        ("tail", []) => tail(&mut client, token, false).await?,
+        ("tail", [flag]) if flag == "--follow" || flag == "-f" => tail(&mut client, token, true).await?,
+        ("search", flags) => search(&mut client, token, flags).await?,
+        _ => return Err(USAGE.into()),
+    }
+
+    Ok(())
+}
+
+#[tokio::main]
+async fn main() {
+    let args: Vec<String> = env::args().skip(1).collect();
+    let result = match parse_options(&args) {
+        Ok(options) => run(options).await,
+        Err(err) => Err(err),
+    };
+
+    if let Err(err) = result {
+        match err.downcast_ref::<tonic::Status>() {
+            Some(status) => eprintln!("authctl: {:?}: {}", status.code(), status.message()),
+            None => eprintln!("authctl: {}", err),
+        }
+
+        std::process::exit(1);
+    }
+}
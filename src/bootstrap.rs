@@ -0,0 +1,443 @@
+//! Assembles the middleware every grpc request goes through, so all the listeners, as well as the servers of the hosts
+//! embedding the services, wrap them the same way and in the same order.
+
+use std::any::Any;
+use std::backtrace::Backtrace;
+use std::cell::{Cell, RefCell};
+use std::future::Future;
+use std::panic::{self, AssertUnwindSafe};
+use std::pin::Pin;
+use std::sync::Once;
+use std::task::{Context, Poll};
+use tonic::Status;
+use tonic::body::BoxBody;
+use tonic::metadata::MetadataValue;
+use tower::{Layer, Service};
+
+use crate::{logging, metrics, reporting, ulid};
+use crate::constants::errors;
+use crate::logging::{LoggingLayer, LoggingService};
+use crate::telemetry::{TracingLayer, TracingService};
+use crate::metrics::{MetricsLayer, MetricsService};
+use crate::i18n::{LocaleLayer, LocaleService};
+use crate::status::{ErrorDetailsLayer, ErrorDetailsService};
+use crate::limits::{
+    LoadShedLayer, LoadShedService,
+    MetadataLayer, MetadataService,
+    MessageSizeLayer, MessageSizeService,
+};
+use crate::validation::{ValidationLayer, ValidationService};
+
+const INCIDENT_HEADER: &str = "x-incident-id";
+
+/// Each of the middleware a request may go through before reaching its service
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Middleware {
+    Recovery,     // turns a panic while serving a request into an INTERNAL failure of that request alone
+    Logging,      // tells the id of the request, so everything it goes through logs with it
+    Tracing,
+    Metrics,
+    Locale,       // translates the failures told by all the middleware below
+    ErrorDetails, // tells the fields the validation has found wrong
+    LoadShed,
+    Metadata,
+    MessageSize,
+    Validation,
+}
+
+impl Middleware {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Middleware::Recovery => "recovery",
+            Middleware::Logging => "logging",
+            Middleware::Tracing => "tracing",
+            Middleware::Metrics => "metrics",
+            Middleware::Locale => "locale",
+            Middleware::ErrorDetails => "error_details",
+            Middleware::LoadShed => "load_shed",
+            Middleware::Metadata => "metadata",
+            Middleware::MessageSize => "message_size",
+            Middleware::Validation => "validation",
+        }
+    }
+}
+
+/// The order requests go through the middleware, the outermost first. Requests rejected by any of them have already
+/// been logged, traced and counted, and their failure gets translated and detailed. The guard of each service, which
+/// authenticates the request and applies the firewall and rate limits of its scope, comes last
+pub const ORDER: &[Middleware] = &[
+    Middleware::Recovery,
+    Middleware::Logging,
+    Middleware::Tracing,
+    Middleware::Metrics,
+    Middleware::Locale,
+    Middleware::ErrorDetails,
+    Middleware::LoadShed,
+    Middleware::Metadata,
+    Middleware::MessageSize,
+    Middleware::Validation,
+];
+
+/// The listeners the services are served by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Listener {
+    Public,
+    Admin, // never sheds any load, so the instance can still be operated while overloaded
+}
+
+/// Returns the middleware the requests of the given listener go through, in the order they do
+pub fn middleware(listener: Listener) -> Vec<Middleware> {
+    ORDER.iter()
+        .copied()
+        .filter(|middleware| *middleware != Middleware::LoadShed || listener == Listener::Public)
+        .collect()
+}
+
+/// A layer wrapping the services it is given into all the middleware of its listener, in the order told by ORDER, as
+/// configured by the environment
+#[derive(Clone)]
+pub struct Chain {
+    listener: Listener,
+    load_shed: Option<LoadShedLayer>,
+    metadata: MetadataLayer,
+    message_size: MessageSizeLayer,
+}
+
+impl Chain {
+    pub fn new(listener: Listener) -> Self {
+        let load_shed = match middleware(listener).contains(&Middleware::LoadShed) {
+            true => Some(LoadShedLayer::new()),
+            false => None,
+        };
+
+        Chain {
+            listener: listener,
+            load_shed: load_shed,
+            metadata: MetadataLayer::new(),
+            message_size: MessageSizeLayer::new(),
+        }
+    }
+
+    pub fn get_listener(&self) -> Listener {
+        self.listener
+    }
+
+    /// Returns the middleware the chain wraps its services into, the outermost first
+    pub fn middleware(&self) -> Vec<Middleware> {
+        middleware(self.listener)
+    }
+}
+
+type Checked<S> = MetadataService<MessageSizeService<ValidationService<S>>>;
+
+type Chained<S> = RecoveryService<LoggingService<TracingService<MetricsService<LocaleService<ErrorDetailsService<
+    Toggle<LoadShedService<Checked<S>>, Checked<S>>>>>>>>;
+
+impl<S> Layer<S> for Chain {
+    type Service = Chained<S>;
+
+    // the innermost middleware wraps the service first, so the outermost one is the last to be applied
+    fn layer(&self, inner: S) -> Self::Service {
+        let inner = ValidationLayer.layer(inner);
+        let inner = self.message_size.layer(inner);
+        let inner = self.metadata.layer(inner);
+        let inner = match &self.load_shed {
+            Some(load_shed) => Toggle::On(load_shed.layer(inner)),
+            None => Toggle::Off(inner),
+        };
+
+        let inner = ErrorDetailsLayer.layer(inner);
+        let inner = LocaleLayer.layer(inner);
+        let inner = MetricsLayer.layer(inner);
+        let inner = TracingLayer.layer(inner);
+        let inner = LoggingLayer.layer(inner);
+        RecoveryLayer.layer(inner)
+    }
+}
+
+/// A service going through the middleware it is wrapped into, if on, or else straight to the service itself
+#[derive(Clone)]
+pub enum Toggle<A, B> {
+    On(A),
+    Off(B),
+}
+
+impl<A, B, R> Service<R> for Toggle<A, B>
+where
+    A: Service<R>,
+    A::Future: Send + 'static,
+    B: Service<R, Response = A::Response, Error = A::Error>,
+    B::Future: Send + 'static,
+{
+    type Response = A::Response;
+    type Error = A::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        match self {
+            Toggle::On(service) => service.poll_ready(cx),
+            Toggle::Off(service) => service.poll_ready(cx),
+        }
+    }
+
+    fn call(&mut self, request: R) -> Self::Future {
+        match self {
+            Toggle::On(service) => Box::pin(service.call(request)),
+            Toggle::Off(service) => Box::pin(service.call(request)),
+        }
+    }
+}
+
+/// What a panic told about itself, as captured while unwinding, when the stack it comes from is still known
+#[derive(Clone, Debug)]
+pub struct Panic {
+    pub message: String,           // along with the location it comes from, if known
+    pub backtrace: String,
+    pub request: Option<String>,   // the id of the request being served, if any
+}
+
+impl Panic {
+    // the panic as told by its payload alone, if it could not be captured by the hook
+    fn from_payload(payload: Box<dyn Any + Send>) -> Self {
+        let message = payload.downcast_ref::<&str>().map(|message| message.to_string())
+            .or_else(|| payload.downcast_ref::<String>().cloned())
+            .unwrap_or_else(|| "panic".to_string());
+
+        Panic {
+            message: message,
+            backtrace: "<unknown>".to_string(),
+            request: None,
+        }
+    }
+}
+
+thread_local! {
+    // whether the current thread is running anything being recovered from
+    static RECOVERING: Cell<bool> = Cell::new(false);
+    // the latest panic of the current thread while recovering
+    static CAUGHT: RefCell<Option<Panic>> = RefCell::new(None);
+}
+
+static HOOK: Once = Once::new();
+
+// sets, once, the panic hook capturing the panics to be recovered from, while any other one is left to the former
+// hook, as usual
+fn set_hook() {
+    HOOK.call_once(|| {
+        let former = panic::take_hook();
+        panic::set_hook(Box::new(move |info| {
+            if !RECOVERING.with(|recovering| recovering.get()) {
+                return former(info);
+            }
+
+            let panic = Panic {
+                message: reporting::describe(info),
+                backtrace: Backtrace::force_capture().to_string(),
+                request: logging::current().map(|ctx| ctx.id),
+            };
+
+            CAUGHT.with(|caught| *caught.borrow_mut() = Some(panic));
+        }));
+    });
+}
+
+/// Runs the given closure, returning the panic it ran into, if any, instead of unwinding any further
+pub fn recover<T, F: FnOnce() -> T>(f: F) -> Result<T, Panic> {
+    set_hook();
+    let recovering = RECOVERING.with(|recovering| recovering.replace(true));
+    let result = panic::catch_unwind(AssertUnwindSafe(f));
+    RECOVERING.with(|former| former.set(recovering)); // nested recoveries leave the outer ones still recovering
+
+    result.map_err(|payload| {
+        CAUGHT.with(|caught| caught.borrow_mut().take())
+            .unwrap_or_else(|| Panic::from_payload(payload))
+    })
+}
+
+// a future returning the panic it ran into while being polled, if any, instead of unwinding any further
+struct Recovering<F> {
+    inner: Pin<Box<F>>,
+}
+
+impl<F: Future> Future for Recovering<F> {
+    type Output = Result<F::Output, Panic>;
+
+    fn poll(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Self::Output> {
+        let inner = &mut self.get_mut().inner;
+        match recover(|| inner.as_mut().poll(cx)) {
+            Ok(poll) => poll.map(Ok),
+            Err(panic) => Poll::Ready(Err(panic)),
+        }
+    }
+}
+
+/// Returns the response of a request to the given rpc that panicked while being served: INTERNAL, with no word of the
+/// panic itself, told apart by an incident id of its own, by the x-incident-id metadata, so whoever reports it can be
+/// pointed to the logs and stack trace of the panic
+fn new_incident(rpc: &str, panic: Panic) -> http::Response<BoxBody> {
+    let incident = ulid::generate();
+    metrics::request_panicked(rpc);
+    error!("request {} to {} panicked, incident {}: {}\n{}",
+           panic.request.as_deref().unwrap_or("-"), rpc, incident, panic.message, panic.backtrace);
+
+    let mut status = Status::internal(errors::HAS_FAILED);
+    if let Ok(value) = MetadataValue::from_str(&incident) {
+        status.metadata_mut().insert(INCIDENT_HEADER, value);
+    }
+
+    status.to_http()
+}
+
+/// A layer recovering from any panic while serving the requests of the services it wraps, so it fails that request
+/// alone, with INTERNAL, instead of dropping the whole connection along with every other request in flight on it. Every
+/// panic is logged with its stack trace and an incident id, which is told back to the caller, and counted by
+/// tpauth_panics_total
+#[derive(Clone, Default)]
+pub struct RecoveryLayer;
+
+impl<S> Layer<S> for RecoveryLayer {
+    type Service = RecoveryService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        RecoveryService { inner }
+    }
+}
+
+#[derive(Clone)]
+pub struct RecoveryService<S> {
+    inner: S,
+}
+
+impl<S, B> Service<http::Request<B>> for RecoveryService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<BoxBody>>,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let rpc = request.uri().path().to_string();
+
+        // services may panic while they are being called, and not only while their future is polled
+        let inner = &mut self.inner;
+        let future = match recover(move || inner.call(request)) {
+            Ok(future) => future,
+            Err(panic) => {
+                let response = new_incident(&rpc, panic);
+                return Box::pin(async move { Ok(response) });
+            },
+        };
+
+        let future = Recovering { inner: Box::pin(future) };
+        Box::pin(async move {
+            match future.await {
+                Ok(result) => result,
+                Err(panic) => Ok(new_incident(&rpc, panic)),
+            }
+        })
+    }
+}
+
+#[cfg(test)]
+pub mod tests {
+    use std::convert::Infallible;
+    use hyper::service::service_fn;
+    use tonic::body::BoxBody;
+    use tower::{Layer, Service};
+    use crate::i18n;
+    use crate::constants::errors;
+    use super::{Middleware, Listener, ORDER, Chain, RecoveryLayer, middleware, recover, RECOVERING};
+
+    fn position(chain: &[Middleware], middleware: Middleware) -> usize {
+        chain.iter().position(|candidate| *candidate == middleware).unwrap()
+    }
+
+    #[test]
+    fn middleware_should_not_fail() {
+        let public = middleware(Listener::Public);
+        assert_eq!(ORDER, &public[..]);
+
+        let admin = middleware(Listener::Admin);
+        assert!(!admin.contains(&Middleware::LoadShed), "the admin listener must never shed load");
+        assert_eq!(ORDER.len() - 1, admin.len());
+
+        for chain in &[public, admin] {
+            assert_eq!(Middleware::Recovery, chain[0], "panics must be recovered from wherever they happen");
+            assert_eq!(Some(&Middleware::Validation), chain.last());
+
+            // requests are logged with their id and counted no matter which middleware rejects them
+            for rejecting in &[Middleware::Metadata, Middleware::MessageSize, Middleware::Validation] {
+                assert!(position(chain, Middleware::Logging) < position(chain, *rejecting));
+                assert!(position(chain, Middleware::Metrics) < position(chain, *rejecting));
+                assert!(position(chain, Middleware::Locale) < position(chain, *rejecting));
+            }
+
+            assert!(position(chain, Middleware::Logging) < position(chain, Middleware::Tracing));
+            assert!(position(chain, Middleware::ErrorDetails) < position(chain, Middleware::Validation));
+        }
+    }
+
+    #[test]
+    fn chain_new_should_not_fail() {
+        let chain = Chain::new(Listener::Public);
+        assert_eq!(Listener::Public, chain.get_listener());
+        assert!(chain.load_shed.is_some());
+        assert_eq!(middleware(Listener::Public), chain.middleware());
+
+        let chain = Chain::new(Listener::Admin);
+        assert!(chain.load_shed.is_none());
+    }
+
+    #[test]
+    fn middleware_as_str_should_not_fail() {
+        let mut names: Vec<&str> = ORDER.iter().map(Middleware::as_str).collect();
+        names.sort();
+        names.dedup();
+        assert_eq!(ORDER.len(), names.len(), "every middleware must be told apart by its name");
+    }
+
+    #[test]
+    fn recovery_service_should_not_fail() {
+        let runtime = tokio::runtime::Builder::new_current_thread().enable_all().build().unwrap();
+        runtime.block_on(async {
+            let mut service = RecoveryLayer.layer(service_fn(|request: http::Request<()>| async move {
+                if request.uri().path() == "/panic" {
+                    panic!("testing");
+                }
+
+                Ok::<_, Infallible>(http::Response::new(BoxBody::empty()))
+            }));
+
+            let request = http::Request::builder().uri("/served").body(()).unwrap();
+            let response = service.call(request).await.unwrap();
+            assert!(response.headers().get("grpc-status").is_none());
+
+            let request = http::Request::builder().uri("/panic").body(()).unwrap();
+            let response = service.call(request).await.unwrap();
+            assert_eq!("13", response.headers().get("grpc-status").unwrap()); // INTERNAL
+            let message = response.headers().get("grpc-message").unwrap().to_str().unwrap();
+            assert_eq!(errors::HAS_FAILED, i18n::decode_message(message), "panics must not be told to the caller");
+            assert!(response.headers().get("x-incident-id").is_some());
+        });
+    }
+
+    #[test]
+    fn recover_should_not_fail() {
+        assert_eq!(Ok(7), recover(|| 7).map_err(|panic| panic.message));
+
+        let panic = recover(|| -> i32 { panic!("testing") }).unwrap_err();
+        assert!(panic.message.starts_with("testing at src/bootstrap.rs:"), "{}", panic.message);
+        assert!(panic.backtrace.len() > 0);
+        assert!(!RECOVERING.with(|recovering| recovering.get()));
+
+        let panic = recover(|| recover(|| -> i32 { panic!("inner") }).map(|_| ()).unwrap_err()).unwrap();
+        assert!(panic.message.starts_with("inner"));
+        assert!(!RECOVERING.with(|recovering| recovering.get()));
+    }
+}
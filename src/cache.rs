@@ -0,0 +1,40 @@
+use std::error::Error;
+use r2d2::{Pool, PooledConnection};
+use crate::constants::{environment, settings, errors};
+use crate::config;
+use crate::keyring::application::keyring_get;
+
+type RedisPool = Pool<redis::Client>;
+
+lazy_static! {
+    static ref POOL: RedisPool = {
+        match new_pool() {
+            Ok(pool) => {
+                info!("connection with redis cluster established");
+                pool
+            },
+            Err(err) => {
+                error!("{}", err);
+                panic!("{}", errors::CANNOT_CONNECT);
+            }
+        }
+    };
+}
+
+/// Builds a new pool of connections from the environment: the dsn is required, while the pool size defaults to
+/// settings::REDIS_POOL_SIZE
+fn new_pool() -> Result<RedisPool, Box<dyn Error>> {
+    let redis_dsn = keyring_get(environment::REDIS_DSN).expect("redis dsn must be set");
+    let pool_size = match config::get(environment::REDIS_POOL_SIZE) {
+        Ok(size) => size.parse().expect("redis pool size must be a number"),
+        Err(_) => settings::REDIS_POOL_SIZE,
+    };
+
+    let client = redis::Client::open(redis_dsn)?;
+    let pool = Pool::builder().max_size(pool_size).build(client)?;
+    Ok(pool)
+}
+
+pub fn get_connection() -> Result<PooledConnection<redis::Client>, Box<dyn Error>> {
+    Ok(POOL.get()?)
+}
\ No newline at end of file
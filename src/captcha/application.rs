@@ -0,0 +1,14 @@
+use std::error::Error;
+use crate::constants::errors;
+use super::get_verifier;
+
+/// Fails unless the provided response to the captcha challenge is a valid one, as told by the provider. Providers
+/// being unreachable make the challenge fail as well, so it cannot be skipped by making it time out
+pub fn captcha_verify(response: &str, remote_ip: &str) -> Result<(), Box<dyn Error>> {
+    if let Err(err) = get_verifier().verify(response, remote_ip) {
+        warn!("captcha verification has failed: {}", err);
+        return Err(errors::CAPTCHA_REQUIRED.into());
+    }
+
+    Ok(())
+}
@@ -0,0 +1,59 @@
+use std::error::Error;
+
+pub trait CaptchaVerifier {
+    // fails if the response to the challenge, as solved by the client at remote_ip, is not a valid one
+    fn verify(&self, response: &str, remote_ip: &str) -> Result<(), Box<dyn Error>>;
+}
+
+/// All the captcha providers a challenge may be verified by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Provider {
+    ReCaptcha,
+    HCaptcha,
+    Turnstile,
+}
+
+impl Provider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Provider::ReCaptcha => "recaptcha",
+            Provider::HCaptcha => "hcaptcha",
+            Provider::Turnstile => "turnstile",
+        }
+    }
+
+    pub fn from_str(provider: &str) -> Option<Self> {
+        match provider {
+            "recaptcha" => Some(Provider::ReCaptcha),
+            "hcaptcha" => Some(Provider::HCaptcha),
+            "turnstile" => Some(Provider::Turnstile),
+            _ => None,
+        }
+    }
+
+    /// Returns the endpoint verifying the challenges of the provider. All of them share the same protocol: a form
+    /// with the secret, the response and the remote ip is posted, and a json telling whether it succeeded is returned
+    pub fn get_verify_url(&self) -> &'static str {
+        match self {
+            Provider::ReCaptcha => "https://www.google.com/recaptcha/api/siteverify",
+            Provider::HCaptcha => "https://api.hcaptcha.com/siteverify",
+            Provider::Turnstile => "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::Provider;
+
+    #[test]
+    fn provider_from_str_should_not_fail() {
+        for provider in &[Provider::ReCaptcha, Provider::HCaptcha, Provider::Turnstile] {
+            assert_eq!(Some(*provider), Provider::from_str(provider.as_str()));
+            assert!(provider.get_verify_url().starts_with("https://"));
+        }
+
+        assert_eq!(None, Provider::from_str("unknown"));
+    }
+}
@@ -0,0 +1,73 @@
+use std::error::Error;
+use std::time::Duration;
+use serde::Deserialize;
+
+use crate::constants::{settings, errors, environment};
+use crate::keyring::application::keyring_get;
+use super::domain::{Provider, CaptchaVerifier};
+
+#[derive(Deserialize, Debug)]
+struct SiteVerifyResponse {
+    success: bool,
+    #[serde(default)]
+    score: Option<f64>, // only provided by score-based challenges, such as recaptcha v3
+    #[serde(rename = "error-codes", default)]
+    error_codes: Vec<String>,
+}
+
+/// Verifies the challenges against the provider's own endpoint. The secret is resolved on every verification, so it
+/// can be rotated
+pub struct SiteVerifyCaptcha {
+    provider: Provider,
+    agent: ureq::Agent,
+}
+
+impl SiteVerifyCaptcha {
+    pub fn new(provider: Provider) -> Self {
+        SiteVerifyCaptcha {
+            provider: provider,
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(settings::CAPTCHA_TIMEOUT))
+                .build(),
+        }
+    }
+}
+
+impl CaptchaVerifier for SiteVerifyCaptcha {
+    fn verify(&self, response: &str, remote_ip: &str) -> Result<(), Box<dyn Error>> {
+        if response.len() == 0 {
+            return Err(errors::CAPTCHA_REQUIRED.into());
+        }
+
+        let secret = keyring_get(environment::CAPTCHA_SECRET)?;
+        let mut form = vec![("secret", secret.as_str()), ("response", response)];
+        if remote_ip.len() > 0 {
+            form.push(("remoteip", remote_ip));
+        }
+
+        let result: SiteVerifyResponse = self.agent.post(self.provider.get_verify_url())
+            .send_form(&form)?
+            .into_json()?;
+
+        if !result.success {
+            info!("{} challenge has failed: {:?}", self.provider.as_str(), result.error_codes);
+            return Err(errors::CAPTCHA_REQUIRED.into());
+        }
+
+        if let Some(score) = result.score.filter(|score| *score < settings::CAPTCHA_MIN_SCORE) {
+            info!("{} challenge has been scored {}", self.provider.as_str(), score);
+            return Err(errors::CAPTCHA_REQUIRED.into());
+        }
+
+        Ok(())
+    }
+}
+
+/// Lets all the challenges through, for these deployments with no captcha provider
+pub struct NoCaptcha;
+
+impl CaptchaVerifier for NoCaptcha {
+    fn verify(&self, _: &str, _: &str) -> Result<(), Box<dyn Error>> {
+        Ok(())
+    }
+}
@@ -0,0 +1,26 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::constants::environment;
+use crate::config;
+use crate::keyring::application::keyring_get;
+
+lazy_static! {
+    static ref VERIFIER_PROVIDER: Box<dyn domain::CaptchaVerifier + Sync + Send> = {
+        match config::get(environment::CAPTCHA_PROVIDER) {
+            Err(_) => Box::new(framework::NoCaptcha),
+            Ok(provider) => {
+                let provider = domain::Provider::from_str(&provider)
+                    .expect("captcha provider must be one of recaptcha, hcaptcha or turnstile");
+
+                keyring_get(environment::CAPTCHA_SECRET).expect("captcha secret must be set");
+                Box::new(framework::SiteVerifyCaptcha::new(provider))
+            },
+        }
+    };
+}
+
+pub fn get_verifier() -> Box<&'static dyn domain::CaptchaVerifier> {
+    Box::new(&**VERIFIER_PROVIDER)
+}
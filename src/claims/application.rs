@@ -0,0 +1,32 @@
+use std::collections::HashMap;
+use serde_json::Value;
+use crate::session::domain::Session;
+use crate::app::domain::App;
+use super::{get_enricher, domain::{ClaimsContext, sanitize_claims}};
+
+/// Returns the claims the enricher, if any, adds into the token being issued for the provided session and app. Tokens
+/// are issued no matter the enricher, so whenever it fails they are issued with no additional claims at all
+pub fn claims_enrich(sess: &Session, app: &App) -> HashMap<String, Value> {
+    let enricher = match get_enricher() {
+        Some(enricher) => enricher,
+        None => return HashMap::new(),
+    };
+
+    let user = sess.get_user().ok();
+    let context = ClaimsContext {
+        tenant: sess.get_tenant(),
+        user: user.map(|user| user.get_id()),
+        email: user.map(|user| user.get_email().to_string()),
+        app: app.get_id(),
+        app_url: app.get_url().to_string(),
+        impersonated: sess.is_impersonated(),
+    };
+
+    match enricher.enrich(&context).and_then(sanitize_claims) {
+        Ok(claims) => claims,
+        Err(err) => {
+            warn!("token for app {} could not be enriched, issued with no additional claims: {}", app.get_id(), err);
+            HashMap::new()
+        },
+    }
+}
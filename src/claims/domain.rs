@@ -0,0 +1,124 @@
+use std::error::Error;
+use std::collections::HashMap;
+use serde_json::Value;
+use crate::constants::{settings, errors};
+
+pub trait ClaimsEnricher {
+    // returns the claims to add into the token described by the given context, none of the reserved ones
+    fn enrich(&self, context: &ClaimsContext) -> Result<HashMap<String, Value>, Box<dyn Error>>;
+}
+
+/// Claims set by the service itself, that no enricher may override
+pub const RESERVED_CLAIMS: &[&str] = &["exp", "iat", "nbf", "iss", "sub", "aud", "jti", "app", "guest",
+                                       "impersonator", "tenant"];
+
+/// Everything known about a token by the time it gets issued
+#[derive(Clone, Debug)]
+pub struct ClaimsContext {
+    pub(super) tenant: i32,
+    pub(super) user: Option<i32>,     // none if the session is a guest one
+    pub(super) email: Option<String>, // none if the session is a guest one
+    pub(super) app: i32,
+    pub(super) app_url: String,
+    pub(super) impersonated: bool,
+}
+
+impl ClaimsContext {
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_user(&self) -> Option<i32> {
+        self.user
+    }
+
+    pub fn get_email(&self) -> Option<&str> {
+        self.email.as_deref()
+    }
+
+    pub fn get_app(&self) -> i32 {
+        self.app
+    }
+
+    pub fn get_app_url(&self) -> &str {
+        &self.app_url
+    }
+
+    pub fn is_guest(&self) -> bool {
+        self.user.is_none()
+    }
+
+    pub fn is_impersonated(&self) -> bool {
+        self.impersonated
+    }
+}
+
+/// Parses the claims provided by an enricher as a json object, an empty string standing for none
+pub fn parse_claims(claims: &str) -> Result<HashMap<String, Value>, Box<dyn Error>> {
+    if claims.trim().len() == 0 {
+        return Ok(HashMap::new());
+    }
+
+    match serde_json::from_str(claims)? {
+        Value::Object(claims) => Ok(claims.into_iter().collect()),
+        _ => Err(errors::PARSE_FAILED.into()),
+    }
+}
+
+/// Drops the reserved claims from the given ones, failing if what is left is too large to be carried by a token
+pub fn sanitize_claims(mut claims: HashMap<String, Value>) -> Result<HashMap<String, Value>, Box<dyn Error>> {
+    claims.retain(|name, _| {
+        let reserved = RESERVED_CLAIMS.contains(&name.as_str());
+        if reserved {
+            warn!("reserved claim {} cannot be overridden by the enricher", name);
+        }
+
+        !reserved
+    });
+
+    if serde_json::to_string(&claims)?.len() > settings::MAX_CLAIMS_LEN {
+        return Err(errors::PARSE_FAILED.into());
+    }
+
+    Ok(claims)
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::collections::HashMap;
+    use serde_json::{json, Value};
+    use crate::constants::settings;
+    use super::{parse_claims, sanitize_claims};
+
+    #[test]
+    fn parse_claims_should_not_fail() {
+        let claims = parse_claims(r#"{"plan": "pro", "entitlements": ["export", "share"]}"#).unwrap();
+        assert_eq!(Some(&json!("pro")), claims.get("plan"));
+        assert_eq!(Some(&json!(["export", "share"])), claims.get("entitlements"));
+
+        assert!(parse_claims("").unwrap().is_empty());
+    }
+
+    #[test]
+    fn parse_claims_should_fail() {
+        for wrong in &["[\"pro\"]", "\"pro\"", "{plan: pro}"] {
+            assert!(parse_claims(wrong).is_err(), "{} should not be parsed", wrong);
+        }
+    }
+
+    #[test]
+    fn sanitize_claims_should_not_fail() {
+        let claims = parse_claims(r#"{"plan": "pro", "sub": "other", "tenant": 2}"#).unwrap();
+        let claims = sanitize_claims(claims).unwrap();
+        assert_eq!(1, claims.len());
+        assert!(claims.contains_key("plan"));
+    }
+
+    #[test]
+    fn sanitize_claims_too_large_should_fail() {
+        let mut claims = HashMap::new();
+        claims.insert("plan".to_string(), Value::String("x".repeat(settings::MAX_CLAIMS_LEN)));
+        assert!(sanitize_claims(claims).is_err());
+    }
+}
@@ -0,0 +1,75 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::Duration;
+use serde_json::Value;
+use tonic::transport::{Channel, Endpoint};
+use tokio::runtime::Handle;
+
+use crate::constants::{settings, errors};
+use super::domain::{ClaimsEnricher, ClaimsContext, parse_claims};
+
+// Import the generated rust code of the external enrichers into module
+mod proto {
+    tonic::include_proto!("claims");
+}
+
+use proto::claims_enricher_client::ClaimsEnricherClient;
+use proto::EnrichRequest;
+
+/// Enriches tokens by calling the Enrich method of the external enricher's ClaimsEnricher service. The channel is
+/// opened by the first token being issued, since it requires the runtime
+pub struct GrpcClaimsEnricher {
+    url: String,
+    channel: Mutex<Option<Channel>>,
+}
+
+impl GrpcClaimsEnricher {
+    pub fn new(url: &str) -> Self {
+        GrpcClaimsEnricher {
+            url: url.to_string(),
+            channel: Mutex::new(None),
+        }
+    }
+
+    fn get_channel(&self) -> Result<Channel, Box<dyn Error>> {
+        let mut channel = match self.channel.lock() {
+            Ok(channel) => channel,
+            Err(err) => {
+                error!("lock for claims enricher channel got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        if let Some(channel) = channel.as_ref() {
+            return Ok(channel.clone());
+        }
+
+        let endpoint = Endpoint::from_shared(self.url.clone())?
+            .timeout(Duration::from_secs(settings::CLAIMS_ENRICHER_TIMEOUT));
+
+        let lazy = endpoint.connect_lazy()?;
+        *channel = Some(lazy.clone());
+        Ok(lazy)
+    }
+}
+
+impl ClaimsEnricher for GrpcClaimsEnricher {
+    fn enrich(&self, context: &ClaimsContext) -> Result<HashMap<String, Value>, Box<dyn Error>> {
+        let request = EnrichRequest {
+            tenant: context.get_tenant(),
+            user: context.get_user().unwrap_or_default(),
+            email: context.get_email().unwrap_or_default().to_string(),
+            app: context.get_app(),
+            app_url: context.get_app_url().to_string(),
+            guest: context.is_guest(),
+            impersonated: context.is_impersonated(),
+        };
+
+        // tokens are issued by synchronous transactions running on the runtime, so the worker thread gets handed over
+        // while waiting for the enricher
+        let mut client = ClaimsEnricherClient::new(self.get_channel()?);
+        let response = tokio::task::block_in_place(|| Handle::current().block_on(client.enrich(request)))?;
+        parse_claims(&response.into_inner().claims)
+    }
+}
@@ -0,0 +1,36 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::sync::{Arc, RwLock};
+use crate::constants::environment;
+use crate::config;
+
+lazy_static! {
+    static ref ENRICHER_PROVIDER: RwLock<Option<Arc<dyn domain::ClaimsEnricher + Sync + Send>>> = {
+        let enricher: Option<Arc<dyn domain::ClaimsEnricher + Sync + Send>> = config::get(environment::CLAIMS_ENRICHER_URL)
+            .ok()
+            .map(|url| Arc::new(framework::GrpcClaimsEnricher::new(&url)) as _);
+
+        RwLock::new(enricher)
+    };
+}
+
+/// Returns the enricher of the tokens being issued, if any
+pub fn get_enricher() -> Option<Arc<dyn domain::ClaimsEnricher + Sync + Send>> {
+    match ENRICHER_PROVIDER.read() {
+        Ok(enricher) => enricher.clone(),
+        Err(err) => {
+            error!("read lock for claims enricher got poisoned: {}", err);
+            None
+        }
+    }
+}
+
+/// Sets the given enricher as the one of all the tokens being issued from now on, replacing the configured one if any
+pub fn set_enricher(enricher: Arc<dyn domain::ClaimsEnricher + Sync + Send>) {
+    match ENRICHER_PROVIDER.write() {
+        Ok(mut current) => *current = Some(enricher),
+        Err(err) => error!("write lock for claims enricher got poisoned: {}", err),
+    }
+}
@@ -0,0 +1,587 @@
+use std::env::{self, VarError};
+use std::error::Error;
+use std::fs;
+use std::sync::RwLock;
+use std::time::SystemTime;
+use std::collections::HashMap;
+
+use crate::constants::{environment, errors};
+
+const CONFIG_FLAG: &str = "CONFIG";
+const PRINT_CONFIG_FLAG: &str = "--print-config";
+const REDACTED: &str = "********";
+
+/// The values a setting may have
+#[derive(Clone, Copy, PartialEq, Debug)]
+enum Kind {
+    Text,
+    Number,
+    Flag, // either true or false
+    OneOf(&'static [&'static str]),
+    Secret, // resolved through the keyring, so it can only be set by the environment, and is never printed
+}
+
+const REACTIONS: &[&str] = &["ignore", "notify", "captcha", "mfa", "deny"];
+
+const SETTINGS: &[(&str, Kind)] = &[
+    (environment::SERVICE_IP, Kind::Text),
+    (environment::SERVICE_PORT, Kind::Number),
+    (environment::METRICS_PORT, Kind::Number),
+    (environment::ADMIN_PORT, Kind::Number),
+    (environment::DEBUG_PORT, Kind::Number),
+    (environment::GRAPHQL_PORT, Kind::Number),
+    (environment::SCIM_PORT, Kind::Number),
+    (environment::WEB_PORT, Kind::Number),
+    (environment::WEB_TEMPLATES, Kind::Text),
+    (environment::WEB_TENANT_HOSTS, Kind::Text),
+    (environment::LOCALES, Kind::Text),
+    (environment::DEFAULT_LOCALE, Kind::Text),
+    (environment::ADMIN_ROLES, Kind::Text),
+    (environment::OTLP_ENDPOINT, Kind::Text),
+    (environment::LOG_FORMAT, Kind::OneOf(&["text", "json"])),
+    (environment::LOG_LEVEL, Kind::OneOf(&["off", "error", "warn", "info", "debug", "trace"])),
+    (environment::SENTRY_DSN, Kind::Text),
+    (environment::SHUTDOWN_GRACE, Kind::Number),
+    (environment::POSTGRES_DSN, Kind::Secret),
+    (environment::MONGO_DSN, Kind::Secret),
+    (environment::MONGO_DB, Kind::Text),
+    (environment::MONGO_USERNAME, Kind::Text),
+    (environment::MONGO_PASSWORD, Kind::Secret),
+    (environment::MONGO_POOL_SIZE, Kind::Number),
+    (environment::MONGO_READ_PREFERENCE, Kind::Text),
+    (environment::STORAGE, Kind::OneOf(&["postgres", "mongo", "memory"])),
+    (environment::SESSION_STORAGE, Kind::OneOf(&["memory", "redis"])),
+    (environment::AUTO_MIGRATE, Kind::Flag),
+    (environment::REDIS_DSN, Kind::Secret),
+    (environment::REDIS_POOL_SIZE, Kind::Number),
+    (environment::SMTP_TRANSPORT, Kind::Text),
+    (environment::SMTP_ORIGIN, Kind::Text),
+    (environment::SMTP_USERNAME, Kind::Text),
+    (environment::SMTP_PASSWORD, Kind::Secret),
+    (environment::MAILER_PROVIDER, Kind::OneOf(&["smtp", "ses", "sendgrid", "log"])),
+    (environment::SENDGRID_API_KEY, Kind::Secret),
+    (environment::SMS_PROVIDER, Kind::OneOf(&["twilio", "log"])),
+    (environment::SMS_ORIGIN, Kind::Text),
+    (environment::TWILIO_ACCOUNT_SID, Kind::Text),
+    (environment::TWILIO_AUTH_TOKEN, Kind::Secret),
+    (environment::JWT_PUBLIC, Kind::Secret),
+    (environment::JWT_SECRET, Kind::Secret),
+    (environment::JWT_KEY_SETS, Kind::Text),
+    (environment::JWT_KEY_SET, Kind::Text),
+    (environment::ISSUER_URL, Kind::Text),
+    (environment::KEY_ROTATION_PERIOD, Kind::Number),
+    (environment::KEY_WARMUP, Kind::Number),
+    (environment::KEY_GRACE, Kind::Number),
+    (environment::SIGNING_KEYS_SECRET, Kind::Secret),
+    (environment::TEMPLATES, Kind::Text),
+    (environment::PWD_SUFIX, Kind::Secret),
+    (environment::PWD_SUFIX_PREVIOUS, Kind::Secret),
+    (environment::APP_NAME, Kind::Text),
+    (environment::RETENTION_PERIOD, Kind::Number),
+    (environment::POLICY_ON_LOGIN, Kind::Flag),
+    (environment::TERMS_LIFETIME, Kind::Number),
+    (environment::PRIVACY_LIFETIME, Kind::Number),
+    (environment::SIGNUP_INVITATION, Kind::Flag),
+    (environment::RECOVERY_QUORUM, Kind::Number),
+    (environment::LOGIN_IDENTIFIERS, Kind::Text),
+    (environment::USERNAME_REQUIRED, Kind::Flag),
+    (environment::USERNAME_MIN_LEN, Kind::Number),
+    (environment::USERNAME_MAX_LEN, Kind::Number),
+    (environment::USERNAME_CHARSET, Kind::OneOf(&["alphanumeric", "extended", "unicode"])),
+    (environment::SIGNUP_SCHEMA, Kind::Text),
+    (environment::BACKUP_SECRET, Kind::Secret),
+    (environment::PII_KEYS, Kind::Secret),
+    (environment::PII_INDEX_SECRET, Kind::Secret),
+    (environment::EVENT_STREAM, Kind::Text),
+    (environment::AUDIT_SINKS, Kind::Text),
+    (environment::RATE_LIMITS, Kind::Text),
+    (environment::APP_QUOTAS, Kind::Text),
+    (environment::REMEMBER_INACTIVITY, Kind::Text),
+    (environment::SESSION_PARTITIONING, Kind::OneOf(&["shared", "isolated"])),
+    (environment::VALIDATION_CACHE_TTL, Kind::Number),
+    (environment::HASH_WORKERS, Kind::Number),
+    (environment::HASH_QUEUE, Kind::Number),
+    (environment::LEADER_ELECTION, Kind::OneOf(&["storage", "kubernetes"])),
+    (environment::JOB_SCHEDULES, Kind::Text),
+    (environment::CLEANUP_BATCH, Kind::Number),
+    (environment::CLEANUP_PACE, Kind::Number),
+    (environment::REPLICATION_REGION, Kind::Text),
+    (environment::REPLICATION_PEERS, Kind::Secret),
+    (environment::ACCOUNTS_PER_IP, Kind::Number),
+    (environment::IPS_PER_ACCOUNT, Kind::Number),
+    (environment::DETECTION_WINDOW, Kind::Number),
+    (environment::THROTTLE_TIMEOUT, Kind::Number),
+    (environment::TRAVEL_SPEED, Kind::Number),
+    (environment::RISKY_FAILURES, Kind::Number),
+    (environment::RISK_SCORER, Kind::OneOf(&["heuristic", "http", "grpc"])),
+    (environment::RISK_SCORER_URL, Kind::Text),
+    (environment::CLAIMS_ENRICHER_URL, Kind::Text),
+    (environment::AUTHORIZER, Kind::OneOf(&["http", "opa", "grpc"])),
+    (environment::AUTHORIZER_URL, Kind::Text),
+    (environment::AUTHORIZER_FAIL_OPEN, Kind::Flag),
+    (environment::RISK_MFA_SCORE, Kind::Number),
+    (environment::RISK_DENY_SCORE, Kind::Number),
+    (environment::CAPTCHA_PROVIDER, Kind::OneOf(&["recaptcha", "hcaptcha", "turnstile"])),
+    (environment::CAPTCHA_SECRET, Kind::Secret),
+    (environment::FEATURE_FLAGS, Kind::Text),
+    (environment::FEATURE_FLAGS_PROVIDER, Kind::OneOf(&["config", "http"])),
+    (environment::FEATURE_FLAGS_URL, Kind::Text),
+    (environment::GOOGLE_CLIENT_ID, Kind::Text),
+    (environment::GOOGLE_CLIENT_SECRET, Kind::Secret),
+    (environment::GOOGLE_ISSUER, Kind::Text),
+    (environment::IDENTITY_LINKING, Kind::OneOf(&["email", "password", "explicit"])),
+    (environment::GEOIP_DATABASE, Kind::Text),
+    (environment::NEW_COUNTRY_REACTION, Kind::OneOf(REACTIONS)),
+    (environment::IMPOSSIBLE_TRAVEL_REACTION, Kind::OneOf(REACTIONS)),
+    (environment::SECRETS_PROVIDERS, Kind::Text),
+    (environment::SECRETS_DIR, Kind::Text),
+    (environment::SECRETS_PATH, Kind::Text),
+    (environment::VAULT_ADDR, Kind::Text),
+    (environment::VAULT_TOKEN, Kind::Secret),
+    (environment::VAULT_MOUNT, Kind::Text),
+    (environment::AWS_REGION, Kind::Text),
+    (environment::AWS_ACCESS_KEY_ID, Kind::Secret),
+    (environment::AWS_SECRET_ACCESS_KEY, Kind::Secret),
+    (environment::AWS_SESSION_TOKEN, Kind::Secret),
+    (environment::TLS_CERT, Kind::Text),
+    (environment::TLS_KEY, Kind::Text),
+    (environment::TLS_CLIENT_CA, Kind::Text),
+    (environment::TLS_CLIENT_AUTH, Kind::OneOf(&["required", "optional"])),
+    (environment::SPIFFE_TRUST_DOMAINS, Kind::Text),
+    (environment::COOKIE_DOMAIN, Kind::Text),
+    (environment::COOKIE_PATH, Kind::Text),
+    (environment::COOKIE_SECURE, Kind::Flag),
+    (environment::COOKIE_HTTP_ONLY, Kind::Flag),
+    (environment::COOKIE_SAME_SITE, Kind::OneOf(&["strict", "lax", "none"])),
+    (environment::COOKIE_FORMAT, Kind::OneOf(&["jwt", "opaque"])),
+    (environment::COOKIE_KEYS, Kind::Secret),
+    (environment::COOKIE_ENCRYPT, Kind::Flag),
+    (environment::GLOBAL_LOGOUT_ON, Kind::Text),
+    (environment::GRPC_WEB_ORIGINS, Kind::Text),
+    (environment::GRPC_REFLECTION, Kind::Flag),
+    (environment::GRPC_KEEPALIVE_INTERVAL, Kind::Number),
+    (environment::GRPC_KEEPALIVE_TIMEOUT, Kind::Number),
+    (environment::GRPC_MAX_CONCURRENT_STREAMS, Kind::Number),
+    (environment::GRPC_CONCURRENCY_PER_CONNECTION, Kind::Number),
+    (environment::GRPC_MAX_MESSAGE_SIZE, Kind::Number),
+    (environment::GRPC_MAX_IN_FLIGHT, Kind::Number),
+    (environment::GRPC_NORMAL_SHARE, Kind::Number),
+    (environment::GRPC_LOW_SHARE, Kind::Number),
+    (environment::DIAGNOSTICS_EXPIRY_WARNING, Kind::Number),
+    (environment::DIAGNOSTICS_QUOTA_SHARE, Kind::Number),
+    (environment::DIAGNOSTICS_WINDOW, Kind::Number),
+    (environment::GRPC_MAX_METADATA_SIZE, Kind::Number),
+    (environment::GRPC_MAX_METADATA_ENTRIES, Kind::Number),
+];
+
+// settings that are safe to change with no restart, since they are either read every time they are used or applied by
+// the hooks of these reading them once
+const RELOADABLE: &[&str] = &[
+    environment::LOG_LEVEL,
+    environment::SHUTDOWN_GRACE,
+    environment::ADMIN_ROLES,
+    environment::WEB_TENANT_HOSTS,
+    environment::RATE_LIMITS,
+    environment::APP_QUOTAS,
+    environment::REMEMBER_INACTIVITY,
+    environment::SESSION_PARTITIONING,
+    environment::ACCOUNTS_PER_IP,
+    environment::IPS_PER_ACCOUNT,
+    environment::DETECTION_WINDOW,
+    environment::THROTTLE_TIMEOUT,
+    environment::TRAVEL_SPEED,
+    environment::RISKY_FAILURES,
+    environment::RISK_MFA_SCORE,
+    environment::RISK_DENY_SCORE,
+    environment::POLICY_ON_LOGIN,
+    environment::JWT_KEY_SETS,
+    environment::JWT_KEY_SET,
+    environment::ISSUER_URL,
+    environment::TERMS_LIFETIME,
+    environment::PRIVACY_LIFETIME,
+    environment::SIGNUP_INVITATION,
+    environment::RECOVERY_QUORUM,
+    environment::LOGIN_IDENTIFIERS,
+    environment::USERNAME_REQUIRED,
+    environment::USERNAME_MIN_LEN,
+    environment::USERNAME_MAX_LEN,
+    environment::USERNAME_CHARSET,
+    environment::IDENTITY_LINKING,
+    environment::SPIFFE_TRUST_DOMAINS,
+    environment::NEW_COUNTRY_REACTION,
+    environment::IMPOSSIBLE_TRAVEL_REACTION,
+    environment::FEATURE_FLAGS,
+    environment::LOCALES,
+    environment::DEFAULT_LOCALE,
+    environment::DIAGNOSTICS_EXPIRY_WARNING,
+    environment::DIAGNOSTICS_QUOTA_SHARE,
+    environment::DIAGNOSTICS_WINDOW,
+];
+
+// settings whose name is made of these prefixes followed by the name of something else (e.g. a collection)
+const PREFIXED: &[(&str, Kind)] = &[
+    (environment::MONGO_READ_PREFERENCE, Kind::Text),
+    (environment::JWT_SECRET, Kind::Secret), // the keys of any other key set than the default one
+    (environment::JWT_PUBLIC, Kind::Secret),
+];
+
+/// Where the value of a setting comes from, from the highest precedence to the lowest one
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Source {
+    Flag,
+    Env,
+    File,
+}
+
+impl Source {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Source::Flag => "flag",
+            Source::Env => "env",
+            Source::File => "file",
+        }
+    }
+}
+
+type ChangeHook = Box<dyn Fn() + Sync + Send>;
+
+#[derive(Default)]
+struct Sources {
+    flags: HashMap<String, String>,
+    file: HashMap<String, String>,
+    path: Option<String>,
+    modified: Option<SystemTime>, // last modification of the file, as of the time it got loaded
+}
+
+/// What has been asked for through the command line, besides the settings
+#[derive(Debug)]
+pub struct Args {
+    pub positional: Vec<String>,
+    pub print_config: bool,
+}
+
+lazy_static! {
+    static ref SOURCES: RwLock<Sources> = RwLock::new(Sources::default());
+    static ref HOOKS: RwLock<HashMap<String, Vec<ChangeHook>>> = RwLock::new(HashMap::new());
+}
+
+/// Returns the name of the setting as written in the environment: upper case words split by underscores, no matter
+/// they are written in lower case or split by dashes
+fn normalize(name: &str) -> String {
+    name.trim().to_uppercase().replace('-', "_")
+}
+
+fn get_kind(name: &str) -> Option<Kind> {
+    if let Some((_, kind)) = SETTINGS.iter().find(|(setting, _)| name == *setting) {
+        return Some(*kind);
+    }
+
+    PREFIXED.iter()
+        .find(|(prefix, _)| name.starts_with(&format!("{}_", prefix)))
+        .map(|(_, kind)| *kind)
+}
+
+fn validate(name: &str, value: &str, source: Source) -> Result<(), Box<dyn Error>> {
+    let kind = match get_kind(name) {
+        Some(kind) => kind,
+        // the environment holds many other variables than these of the service
+        None if source == Source::Env => return Ok(()),
+        None => return Err(format!("{} is not a setting", name).into()),
+    };
+
+    let valid = match kind {
+        Kind::Text => true,
+        Kind::Number => value.parse::<f64>().is_ok(),
+        Kind::Flag => value == "true" || value == "false",
+        Kind::OneOf(values) => values.contains(&value),
+        Kind::Secret => source == Source::Env,
+    };
+
+    if !valid {
+        error!("{} from {} is not a valid {:?} setting", name, source.as_str(), kind);
+        return Err(format!("{}: {}", errors::INVALID_CONFIG, name).into());
+    }
+
+    Ok(())
+}
+
+/// Splits the command line into the settings it provides, as --name=value flags, and everything else
+fn parse_flags(args: &[String]) -> Result<(HashMap<String, String>, Args), Box<dyn Error>> {
+    let mut flags = HashMap::new();
+    let mut parsed = Args {
+        positional: Vec::new(),
+        print_config: false,
+    };
+
+    for arg in args {
+        if arg == PRINT_CONFIG_FLAG {
+            parsed.print_config = true;
+        } else if let Some(flag) = arg.strip_prefix("--") {
+            let mut parts = flag.splitn(2, '=');
+            let name = normalize(parts.next().unwrap_or_default());
+            match parts.next() {
+                Some(value) => flags.insert(name, value.to_string()),
+                None => return Err(format!("{} must be set as --{}=<value>", arg, flag).into()),
+            };
+        } else {
+            parsed.positional.push(arg.clone());
+        }
+    }
+
+    Ok((flags, parsed))
+}
+
+/// Returns all the settings in the given yaml document, which must be a mapping of plain values
+fn parse_file(content: &str) -> Result<HashMap<String, String>, Box<dyn Error>> {
+    let document: HashMap<String, serde_yaml::Value> = serde_yaml::from_str(content)?;
+    let mut settings = HashMap::new();
+    for (name, value) in document {
+        let value = match value {
+            serde_yaml::Value::String(value) => value,
+            serde_yaml::Value::Number(value) => value.to_string(),
+            serde_yaml::Value::Bool(value) => value.to_string(),
+            serde_yaml::Value::Null => continue,
+            _ => return Err(format!("{} must be a plain value", name).into()),
+        };
+
+        settings.insert(normalize(&name), value);
+    }
+
+    Ok(settings)
+}
+
+fn get_modified(path: &str) -> Option<SystemTime> {
+    fs::metadata(path).and_then(|metadata| metadata.modified()).ok()
+}
+
+/// Reads and validates all the settings in the file at the given path
+fn load_file(path: &str) -> Result<HashMap<String, String>, Box<dyn Error>> {
+    let content = fs::read_to_string(path)
+        .map_err(|err| format!("config file {} cannot be read: {}", path, err))?;
+
+    let file = parse_file(&content)?;
+    for (name, value) in file.iter() {
+        validate(name, value, Source::File)?;
+    }
+
+    Ok(file)
+}
+
+/// Loads the settings provided by the given command line and by the yaml file at the path set by either the --config
+/// flag or CONFIG_FILE, if any. All of them, as well as these in the environment, must be valid, and no setting may
+/// be unknown, nor any secret set but by the environment
+pub fn init(args: &[String]) -> Result<Args, Box<dyn Error>> {
+    let (mut flags, parsed) = parse_flags(args)?;
+    let path = flags.remove(CONFIG_FLAG).or_else(|| env::var(environment::CONFIG_FILE).ok());
+    let modified = path.as_deref().and_then(get_modified);
+    let file = match &path {
+        Some(path) => load_file(path)?,
+        None => HashMap::new(),
+    };
+
+    for (name, value) in flags.iter() {
+        validate(name, value, Source::Flag)?;
+    }
+
+    for (name, _) in SETTINGS {
+        if let Ok(value) = env::var(name) {
+            validate(name, &value, Source::Env)?;
+        }
+    }
+
+    match SOURCES.write() {
+        Ok(mut sources) => *sources = Sources { flags, file, path, modified },
+        Err(err) => {
+            error!("read-write lock for config sources got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    }
+
+    Ok(parsed)
+}
+
+/// Returns the value of the given setting and where it comes from: its flag, if any, or else its environment variable,
+/// or else the config file
+pub fn resolve(name: &str) -> Option<(String, Source)> {
+    let sources = match SOURCES.read() {
+        Ok(sources) => sources,
+        Err(err) => {
+            error!("read-write lock for config sources got poisoned: {}", err);
+            return env::var(name).ok().map(|value| (value, Source::Env));
+        }
+    };
+
+    if let Some(value) = sources.flags.get(name) {
+        return Some((value.clone(), Source::Flag));
+    }
+
+    if let Ok(value) = env::var(name) {
+        return Some((value, Source::Env));
+    }
+
+    sources.file.get(name).map(|value| (value.clone(), Source::File))
+}
+
+/// Returns the value of the given setting, just like env::var does for environment variables, so the default of the
+/// setting, if any, is up to the caller
+pub fn get(name: &str) -> Result<String, VarError> {
+    resolve(name).map(|(value, _)| value).ok_or(VarError::NotPresent)
+}
+
+/// Registers a hook to be called every time the setting with the given name gets changed by a reload. Hooks must not
+/// register any other hook
+pub fn on_change(name: &str, hook: impl Fn() + Sync + Send + 'static) {
+    match HOOKS.write() {
+        Ok(mut hooks) => hooks.entry(name.to_string()).or_insert_with(Vec::new).push(Box::new(hook)),
+        Err(err) => error!("write lock for config hooks got poisoned: {}", err),
+    }
+}
+
+/// Loads the config file again, if any, and applies the new values of the settings that are safe to change, calling
+/// their hooks. Any other setting keeps its value until restart. Nothing changes unless the whole file is valid.
+/// Returns the names of the settings that have changed
+pub fn reload() -> Result<Vec<String>, Box<dyn Error>> {
+    let path = match SOURCES.read() {
+        Ok(sources) => sources.path.clone(),
+        Err(err) => {
+            error!("read-write lock for config sources got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let path = match path {
+        Some(path) => path,
+        None => return Ok(Vec::new()),
+    };
+
+    let modified = get_modified(&path);
+    let loaded = load_file(&path)?;
+    let before: Vec<Option<(String, Source)>> = RELOADABLE.iter().map(|name| resolve(name)).collect();
+
+    match SOURCES.write() {
+        Ok(mut sources) => {
+            let mut file = sources.file.clone();
+            for (name, value) in loaded.iter().filter(|(name, _)| RELOADABLE.contains(&name.as_str())) {
+                file.insert(name.clone(), value.clone());
+            }
+
+            file.retain(|name, _| !RELOADABLE.contains(&name.as_str()) || loaded.contains_key(name));
+            for (name, value) in loaded.iter().filter(|(name, value)| sources.file.get(*name) != Some(*value)) {
+                if !RELOADABLE.contains(&name.as_str()) {
+                    warn!("{} cannot be changed with no restart, the current value is kept", name);
+                }
+            }
+
+            sources.file = file;
+            sources.modified = modified;
+        },
+
+        Err(err) => {
+            error!("read-write lock for config sources got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    }
+
+    let changed: Vec<String> = RELOADABLE.iter().zip(before.iter())
+        .filter(|(name, before)| resolve(name) != **before)
+        .map(|(name, _)| name.to_string())
+        .collect();
+
+    match HOOKS.read() {
+        Ok(hooks) => changed.iter()
+            .filter_map(|name| hooks.get(name))
+            .for_each(|hooks| hooks.iter().for_each(|hook| hook())),
+        Err(err) => error!("read lock for config hooks got poisoned: {}", err),
+    }
+
+    Ok(changed)
+}
+
+/// Reloads the config file if, and only if, it has been modified since it got loaded. Returns the names of the
+/// settings that have changed
+pub fn refresh() -> Result<Vec<String>, Box<dyn Error>> {
+    let (path, modified) = match SOURCES.read() {
+        Ok(sources) => (sources.path.clone(), sources.modified),
+        Err(err) => {
+            error!("read-write lock for config sources got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    match path {
+        Some(path) if get_modified(&path) != modified => reload(),
+        _ => Ok(Vec::new()),
+    }
+}
+
+/// Returns all the settings, one per line, as well as where they come from, with all the secrets redacted. Settings
+/// with no value are defaulted by the service
+pub fn dump() -> String {
+    SETTINGS.iter()
+        .map(|(name, kind)| match resolve(name) {
+            Some(_) if *kind == Kind::Secret => format!("{}={} ({})", name, REDACTED, Source::Env.as_str()),
+            Some((value, source)) => format!("{}={} ({})", name, value, source.as_str()),
+            None => format!("{}= (default)", name),
+        })
+        .collect::<Vec<String>>()
+        .join("\n")
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{normalize, parse_flags, parse_file, validate, Source};
+
+    #[test]
+    fn normalize_should_not_fail() {
+        assert_eq!("SERVICE_PORT", normalize("service-port"));
+        assert_eq!("SERVICE_PORT", normalize("SERVICE_PORT"));
+    }
+
+    #[test]
+    fn parse_flags_should_not_fail() {
+        let args: Vec<String> = vec!["migrate", "--service-port=8000", "up", "--print-config"]
+            .into_iter().map(|arg| arg.to_string()).collect();
+
+        let (flags, parsed) = parse_flags(&args).unwrap();
+        assert_eq!(Some(&"8000".to_string()), flags.get("SERVICE_PORT"));
+        assert_eq!(vec!["migrate".to_string(), "up".to_string()], parsed.positional);
+        assert!(parsed.print_config);
+    }
+
+    #[test]
+    fn parse_flags_should_fail() {
+        assert!(parse_flags(&["--service-port".to_string()]).is_err());
+    }
+
+    #[test]
+    fn parse_file_should_not_fail() {
+        let settings = parse_file("service_port: 8000\nauto_migrate: false\ncookie_domain: ~\n").unwrap();
+        assert_eq!(Some(&"8000".to_string()), settings.get("SERVICE_PORT"));
+        assert_eq!(Some(&"false".to_string()), settings.get("AUTO_MIGRATE"));
+        assert!(settings.get("COOKIE_DOMAIN").is_none());
+    }
+
+    #[test]
+    fn parse_file_should_fail() {
+        assert!(parse_file("rate_limits:\n  - session.login:ip=5/60\n").is_err());
+    }
+
+    #[test]
+    fn validate_should_not_fail() {
+        assert!(validate("SERVICE_PORT", "8000", Source::File).is_ok());
+        assert!(validate("COOKIE_SAME_SITE", "strict", Source::Flag).is_ok());
+        assert!(validate("MONGO_READ_PREFERENCE_EVENTS", "secondary", Source::File).is_ok());
+        assert!(validate("JWT_SECRET", "secret", Source::Env).is_ok());
+        assert!(validate("HOME", "/root", Source::Env).is_ok());
+    }
+
+    #[test]
+    fn validate_should_fail() {
+        assert!(validate("SERVICE_PORT", "http", Source::File).is_err());
+        assert!(validate("AUTO_MIGRATE", "yes", Source::Flag).is_err());
+        assert!(validate("COOKIE_SAME_SITE", "always", Source::File).is_err());
+        assert!(validate("JWT_SECRET", "secret", Source::File).is_err());
+        assert!(validate("UNKNOWN_SETTING", "value", Source::Flag).is_err());
+    }
+}
@@ -2,29 +2,354 @@ pub mod settings {
     pub const SERVER_IP: &str = "127.0.0.1";
     pub const TOKEN_LEN: usize = 8;
     pub const TOKEN_TIMEOUT: u64 = 86400; // 3600s * 24h
+    pub const TOKEN_ISSUER: &str = "tpauth.alvidir.com";
+    pub const ERROR_DOMAIN: &str = "tpauth.alvidir.com"; // the reasons of failed requests are unique within
+    pub const RETRY_DELAY: u64 = 1; // time in seconds clients are told to wait before retrying a transient failure
+    pub const MAX_FIELD_LEN: usize = 8192; // max bytes of any string field of a request
+    pub const MAX_TEXT_LEN: usize = 65536; // max bytes of the string fields holding free text, such as template bodies
+    pub const KEY_ID_LEN: usize = 16; // hex chars of the key fingerprint telling the key a token is signed by
+    pub const KEY_WARMUP: u64 = 3600; // time in seconds new signing keys are published before signing
+    pub const KEY_GRACE: u64 = 2592000; // 3600s * 24h * 30d, as long as the longest lived tokens
+    pub const KEY_ROTATION_CHECK: u64 = 60; // time in seconds between checks of the signing keys schedule
+    pub const GUEST_TIMEOUT: u64 = 3600; // time in seconds
+    pub const ELEVATION_WINDOW: u64 = 300; // time in seconds
+    pub const REMEMBER_TIMEOUT: u64 = 2592000; // 3600s * 24h * 30d
+    pub const REMEMBERED_TIMEOUT: u64 = 3600; // time in seconds
     pub const LOCK_TIMEOUT: u32 = 30; // time in seconds
     pub const POOL_SIZE: u32 = 1; // by default: single thread
     pub const TOTP_PERIOD: u32 = 30; // time in seconds
+    pub const RETENTION_PERIOD: u64 = 2592000; // 3600s * 24h * 30d
+    pub const PURGE_PERIOD: u64 = 3600; // time in seconds
+    pub const CLEANUP_PERIOD: u64 = 300; // time in seconds between cleanups of the expired sessions and invitations
+    pub const CLEANUP_BATCH: usize = 500; // max sessions, invitations and recoveries removed by each cleanup
+    pub const CLEANUP_PACE: u64 = 100; // time in milliseconds between cleanups while more are pending
+    pub const MAX_PAGE_SIZE: u64 = 100; // max items per page
+    pub const DEFAULT_PAGE_SIZE: u64 = 20; // items per page if no size is requested
+    pub const MAX_BATCH_SIZE: usize = 1000; // max tokens validated per request
+    pub const RECOVERY_PERIOD: u64 = 604800; // 3600s * 24h * 7d
+    pub const INVITATION_LEN: usize = 32;
+    pub const INVITATION_TIMEOUT: u64 = 604800; // 3600s * 24h * 7d
+    pub const DISOWN_TIMEOUT: u64 = 604800; // 3600s * 24h * 7d
+    pub const RESET_TIMEOUT: u64 = 3600; // time in seconds
+    pub const ACTIVATION_TIMEOUT: u64 = 604800; // 3600s * 24h * 7d, if the pre-registration tells none
+    pub const ACTIVATION_MAX_TIMEOUT: u64 = 2592000; // 3600s * 24h * 30d
+    pub const RECOVERY_CODE_LEN: usize = 32;
+    pub const RECOVERY_WINDOW: u64 = 86400; // 3600s * 24h, to gather the approvals of a recovery
+    pub const RECOVERY_QUORUM: usize = 2; // approvals of trusted contacts a recovery requires
+    pub const MAX_TRUSTED_CONTACTS: usize = 5;
+    pub const IMPERSONATION_TIMEOUT: u64 = 1800; // time in seconds
+    pub const APIKEY_PREFIX_LEN: usize = 8;
+    pub const APIKEY_LEN: usize = 32;
+    pub const CHALLENGE_TIMEOUT: u64 = 60; // time in seconds
+    pub const CHALLENGE_NONCE_LEN: usize = 32;
+    pub const COOKIE_NAME: &str = "token";
+    pub const REMEMBER_COOKIE_NAME: &str = "remember";
+    pub const COOKIE_PATH: &str = "/";
+    pub const COOKIE_SAME_SITE: &str = "lax";
+    pub const COOKIE_FORMAT: &str = "jwt";
+    pub const GLOBAL_LOGOUT_ON: &str = "password_change,credential_reuse,compromise";
+    pub const GRPC_WEB_EXPOSED_HEADERS: &[&str] = &["x-request-id"]; // besides grpc-status and grpc-message
+    pub const MONGO_POOL_SIZE: u32 = 10; // max connections per server
+    pub const MONGO_TIMEOUT: u64 = 10; // time in seconds
+    pub const REDIS_POOL_SIZE: u32 = 10; // max connections
+    pub const DEFAULT_TENANT: i32 = 1; // the tenant requests with no tenant belong to
+    pub const DEFAULT_TENANT_NAME: &str = "default";
+    pub const BACKUP_VERSION: i32 = 1; // format of the backup archives
+    pub const RELAY_PERIOD: u64 = 5; // time in seconds
+    pub const RELAY_BATCH: u64 = 100; // max events per relay
+    pub const RELAY_MAX_BACKOFF: u64 = 300; // max time in seconds a failing relay waits before retrying
+    pub const CHECKPOINT_PERIOD: u64 = 3600; // time in seconds
+    pub const CHECKPOINT_BATCH: u64 = 1000; // max events chained per checkpoint
+    pub const CHECKPOINT_SETTLE: u64 = 60; // time in seconds events must be older than to be chained
+    pub const SINK_TIMEOUT: u64 = 10; // time in seconds
+    pub const PUBLISHED_TIMEOUT: u64 = 604800; // 3600s * 24h * 7d
+    pub const WEBHOOK_SECRET_LEN: usize = 32;
+    pub const WEBHOOK_PERIOD: u64 = 5; // time in seconds
+    pub const WEBHOOK_BATCH: u64 = 100; // max deliveries per run
+    pub const WEBHOOK_TIMEOUT: u64 = 10; // time in seconds
+    pub const WEBHOOK_BACKOFF: u64 = 30; // time in seconds before the first retry, doubled on every attempt
+    pub const WEBHOOK_MAX_ATTEMPTS: i32 = 8;
+    pub const WEBHOOK_ERROR_LEN: usize = 256; // max chars of the error kept by the delivery log
+    pub const WEBHOOK_REPLAY_MAX: usize = 10000; // max deliveries replayed at once
+    pub const GROUP_NAME_LEN: usize = 64;
+    pub const PROVISIONED_PASSWORD_LEN: usize = 64;
+    pub const RATE_LIMITS: &str = "session.login:ip=20/60,session.login:user=10/300,user.signup:ip=5/600,recovery.start:user=3/3600,user.set_phone:user=3/600,user.verify_phone:user=5/600,identity.confirm_link:user=5/600";
+    pub const MAX_BUCKETS: usize = 100000; // max rate limit buckets kept in memory
+    pub const USAGE_PERIOD: u64 = 3600; // time in seconds usage with no quota is accounted by
+    pub const MAX_USAGE_COUNTERS: usize = 100000; // max usage counters kept in memory
+    pub const REPLICATION_PERIOD: u64 = 1; // time in seconds between pulls from the peer regions
+    pub const REPLICATION_BATCH: usize = 500; // max changes pulled from each peer region at once
+    pub const REPLICATION_STREAM_LEN: usize = 100000; // approximate max changes kept for the peer regions
+    pub const VALIDATION_CACHE_TTL: u64 = 5; // time in seconds a validated session is taken as valid for
+    pub const VALIDATION_CACHE_SIZE: usize = 10000; // max validated sessions kept in memory
+    pub const HASH_WORKERS: usize = 4; // threads password digests are computed by
+    pub const HASH_QUEUE: usize = 64; // max digests waiting for a worker before failing fast
+    pub const LOCK_TTL: u64 = 10; // time in seconds a lock is held for at most, if not released before
+    pub const LOCK_WAIT: u64 = 2000; // time in milliseconds a lock is waited for before giving up
+    pub const LOCK_RETRY: u64 = 50; // time in milliseconds between attempts to take a lock
+    pub const LOCK_TIMEOUT: u64 = 5; // time in seconds any request to the kubernetes api is waited for
+    pub const LEADER_LEASE: &str = "tpauth-jobs"; // key, or name of the kubernetes lease, the leader is elected by
+    pub const LEADER_TTL: u64 = 15; // time in seconds the leader keeps the leadership for with no renewal
+    pub const LEADER_RENEW: u64 = 5; // time in seconds between renewals of the leadership
+    pub const JOB_JITTER: f64 = 0.1; // max fraction of the wait between runs of a job randomly added to it
+    pub const JOBS_GRACE: u64 = 10; // time in seconds running jobs are waited for on shutdown
+    pub const REVOCATION_REFRESH: u64 = 1; // time in seconds between pulls of the revocations recorded by other instances
+    pub const REVOCATION_REBUILD: u64 = 3600; // time in seconds the revocation filter is rebuilt from scratch after
+    pub const REVOCATION_BATCH: u64 = 1000; // max revocations pulled at once
+    pub const REVOCATION_CAPACITY: usize = 100000; // min revocations the filter is sized for
+    pub const REVOCATION_FP_RATE: f64 = 0.001; // revocation checks going to the store for sessions not revoked
+    pub const MAX_NONCES: usize = 100000; // max nonces kept in memory
+    pub const ACCOUNTS_PER_IP: usize = 20; // distinct accounts failing from the same ip
+    pub const IPS_PER_ACCOUNT: usize = 10; // distinct ips failing on the same account
+    pub const DETECTION_WINDOW: u64 = 3600; // time in seconds
+    pub const THROTTLE_TIMEOUT: u64 = 900; // time in seconds
+    pub const TRAVEL_SPEED: f64 = 1000.0; // km/h, as fast as an airliner
+    pub const RISKY_FAILURES: usize = 3; // distinct failures on the ip or account
+    pub const RISK_MFA_SCORE: u8 = 60; // risk score from which the mfa is required
+    pub const RISK_DENY_SCORE: u8 = 100; // risk score from which the login is denied
+    pub const RISK_SCORER_TIMEOUT: u64 = 5; // time in seconds
+    pub const CLAIMS_ENRICHER_TIMEOUT: u64 = 2; // time in seconds
+    pub const MAX_CLAIMS_LEN: usize = 4096; // max bytes of the claims added by the enricher, as json
+    pub const AUTHORIZER_TIMEOUT: u64 = 2; // time in seconds
+    pub const CAPTCHA_TIMEOUT: u64 = 10; // time in seconds
+    pub const CAPTCHA_MIN_SCORE: f64 = 0.5; // for providers scoring their challenges
+    pub const FEATURE_FLAGS_TIMEOUT: u64 = 5; // time in seconds
+    pub const FEATURE_FLAGS_TTL: u64 = 30; // time in seconds evaluations are cached for
+    pub const MAX_FEATURE_FLAGS: usize = 10000; // max evaluations kept in memory
+    pub const IDENTITY_TIMEOUT: u64 = 10; // time in seconds
+    pub const GOOGLE_ISSUER: &str = "https://accounts.google.com";
+    pub const IDENTITY_LINKING: &str = "email";
+    pub const LINK_TOKEN_TIMEOUT: u64 = 600; // time in seconds
+    pub const FIREWALL_REFRESH: u64 = 30; // time in seconds ip rules are cached for
+    pub const COUNTRY_TIMEOUT: u64 = 7776000; // 3600s * 24h * 90d
+    pub const NEW_COUNTRY_REACTION: &str = "notify";
+    pub const IMPOSSIBLE_TRAVEL_REACTION: &str = "mfa";
+    pub const SECRETS_PROVIDERS: &str = "env";
+    pub const SECRETS_DIR: &str = "/run/secrets";
+    pub const VAULT_MOUNT: &str = "secret";
+    pub const SECRETS_TTL: u64 = 300; // time in seconds secrets are cached for
+    pub const SECRETS_TIMEOUT: u64 = 10; // time in seconds
+    pub const TLS_RELOAD_PERIOD: u64 = 30; // time in seconds
+    pub const TLS_HANDSHAKE_TIMEOUT: u64 = 10; // time in seconds
+    pub const TLS_BACKLOG: usize = 128; // max handshaken connections waiting to be served
+    pub const TLS_CLIENT_AUTH: &str = "required"; // either required or optional
+    pub const CERTIFICATE_IDENTITY_LEN: usize = 256;
+    pub const TRACER_NAME: &str = "tpauth";
+    pub const HEALTH_PERIOD: u64 = 10; // time in seconds between health checks
+    pub const CONFIG_PERIOD: u64 = 30; // time in seconds between checks for changes in the config file
+    pub const SHUTDOWN_GRACE: u64 = 30; // time in seconds in-flight requests are waited for on shutdown
+    pub const REQUEST_ID_MAX_LEN: usize = 64;
+    pub const IP_MAX_LEN: usize = 64; // longer than any ipv6 address, zone included
+    pub const SUBJECT_DIGEST_LEN: usize = 16; // hex digits of the digest logs tell the subject of a request by
+    pub const USER_AGENT_MAX_LEN: usize = 128;
+    pub const REPORT_TIMEOUT: u64 = 5; // time in seconds
+    pub const REPORT_BACKLOG: usize = 100; // max reports waiting to be sent
+    pub const PROFILE_FREQUENCY: i32 = 100; // cpu samples per second
+    pub const PROFILE_SECONDS: u64 = 10;
+    pub const PROFILE_MAX_SECONDS: u64 = 60;
+    pub const LOGIN_OBJECTIVE: f64 = 0.5; // time in seconds a login should take at most
+    pub const SIGNUP_OBJECTIVE: f64 = 1.0; // time in seconds a signup should take at most
+    pub const GRAPHQL_MAX_BODY: usize = 65536; // size in bytes
+    pub const GRAPHQL_MAX_DEPTH: usize = 8;
+    pub const GRAPHQL_MAX_COMPLEXITY: usize = 200;
+    pub const SCIM_MAX_BODY: usize = 1048576; // size in bytes
+    pub const WEB_MAX_BODY: usize = 16384; // size in bytes
+    pub const GRPC_MAX_MESSAGE_SIZE: usize = 4194304; // size in bytes of each message of a request
+    pub const GRPC_MAX_METADATA_SIZE: usize = 16384; // size in bytes of the names and values of all the metadata
+    pub const GRPC_MAX_METADATA_ENTRIES: usize = 64;
+    pub const GRPC_NORMAL_SHARE: usize = 80; // percent of the max in flight requests of normal priority may take
+    pub const GRPC_LOW_SHARE: usize = 50; // percent of the max in flight requests of low priority may take
+    pub const DIAGNOSTICS_EXPIRY_WARNING: u64 = 2592000; // 3600s * 24h * 30d
+    pub const DIAGNOSTICS_EXPIRY_CRITICAL: u64 = 259200; // 3600s * 24h * 3d
+    pub const DIAGNOSTICS_QUOTA_SHARE: u64 = 80; // percent of a quota from which its usage gets reported
+    pub const DIAGNOSTICS_WINDOW: u64 = 3600; // time in seconds limiters are reported for since getting close to capacity
+    pub const MAX_PRESSURE_REPORTS: usize = 1000; // max limiters reported as close to capacity at once
+    pub const MAILER_PROVIDER: &str = "smtp";
+    pub const MAILER_TIMEOUT: u64 = 10; // time in seconds
+    pub const MAILER_RETRIES: usize = 3; // attempts in total
+    pub const MAILER_BACKOFF: u64 = 500; // time in milliseconds before the first retry
+    pub const SMS_PROVIDER: &str = "log";
+    pub const SMS_TIMEOUT: u64 = 10; // time in seconds
+    pub const PHONE_CODE_LEN: usize = 6;
+    pub const PHONE_CODE_TIMEOUT: u64 = 600; // time in seconds
+    pub const LOGIN_IDENTIFIERS: &str = "email";
+    pub const USERNAME_MIN_LEN: usize = 3; // in characters
+    pub const USERNAME_MAX_LEN: usize = 32;
+    pub const USERNAME_CHARSET: &str = "extended";
+    pub const RESERVED_NAME_LEN: usize = 64;
+    pub const BRAND_NAME_LEN: usize = 64;
+    pub const BRAND_LINK_LEN: usize = 2048;
+    pub const TEMPLATE_SUBJECT_LEN: usize = 256;
+    pub const DEFAULT_LOCALE: &str = "en";
+    pub const TEMPLATE_BODY_LEN: usize = 65536; // size in bytes
+    pub const WEB_CSRF_COOKIE_NAME: &str = "csrf";
+    pub const WEB_CSRF_LEN: usize = 32;
+    pub const WEB_STATE_COOKIE_NAME: &str = "state";
+    pub const WEB_STATE_LEN: usize = 512; // max length of the state of the app
+    pub const IMPORT_MAX_SIZE: usize = 33554432; // size in bytes of a whole bulk import
+    pub const CLIENT_TIMEOUT: u64 = 10; // time in seconds
+    pub const CLIENT_RETRIES: usize = 3;
+    pub const CLIENT_BACKOFF: u64 = 100; // time in milliseconds before the first retry
+    pub const CLIENT_REFRESH_MARGIN: u64 = 60; // time in seconds before its expiration a token gets refreshed
+    pub const CLIENT_CACHE_TTL: u64 = 30; // time in seconds an introspected token is taken as valid for
+    pub const CLIENT_CACHE_SIZE: usize = 10000; // max introspected tokens kept in memory
 }
 
 pub mod environment {
+    pub const CONFIG_FILE: &str = "CONFIG_FILE";
+    pub const SERVICE_IP: &str = "SERVICE_IP";
     pub const SERVICE_PORT: &str = "SERVICE_PORT";
+    pub const METRICS_PORT: &str = "METRICS_PORT";
+    pub const ADMIN_PORT: &str = "ADMIN_PORT";
+    pub const DEBUG_PORT: &str = "DEBUG_PORT";
+    pub const GRAPHQL_PORT: &str = "GRAPHQL_PORT";
+    pub const SCIM_PORT: &str = "SCIM_PORT";
+    pub const WEB_PORT: &str = "WEB_PORT";
+    pub const WEB_TEMPLATES: &str = "WEB_TEMPLATES";
+    pub const WEB_TENANT_HOSTS: &str = "WEB_TENANT_HOSTS";
+    pub const LOCALES: &str = "LOCALES";
+    pub const DEFAULT_LOCALE: &str = "DEFAULT_LOCALE";
+    pub const ADMIN_ROLES: &str = "ADMIN_ROLES";
+    pub const OTLP_ENDPOINT: &str = "OTEL_EXPORTER_OTLP_ENDPOINT";
+    pub const LOG_FORMAT: &str = "LOG_FORMAT";
+    pub const LOG_LEVEL: &str = "LOG_LEVEL";
+    pub const SENTRY_DSN: &str = "SENTRY_DSN";
+    pub const SHUTDOWN_GRACE: &str = "SHUTDOWN_GRACE";
     pub const POSTGRES_DSN: &str = "DATABASE_URL";
     pub const MONGO_DSN: &str = "MONGO_DSN";
     pub const MONGO_DB: &str = "MONGO_DB";
+    pub const MONGO_USERNAME: &str = "MONGO_USERNAME";
+    pub const MONGO_PASSWORD: &str = "MONGO_PASSWORD";
+    pub const MONGO_POOL_SIZE: &str = "MONGO_POOL_SIZE";
+    pub const MONGO_READ_PREFERENCE: &str = "MONGO_READ_PREFERENCE";
+    pub const STORAGE: &str = "STORAGE";
+    pub const SESSION_STORAGE: &str = "SESSION_STORAGE";
+    pub const AUTO_MIGRATE: &str = "AUTO_MIGRATE";
+    pub const REDIS_DSN: &str = "REDIS_DSN";
+    pub const REDIS_POOL_SIZE: &str = "REDIS_POOL_SIZE";
     pub const SMTP_TRANSPORT: &str = "SMTP_TRANSPORT";
     pub const SMTP_ORIGIN: &str = "SMTP_ORIGIN";
     pub const SMTP_USERNAME: &str = "SMTP_USERNAME";
     pub const SMTP_PASSWORD: &str = "SMTP_PASSWORD";
+    pub const MAILER_PROVIDER: &str = "MAILER_PROVIDER";
+    pub const SENDGRID_API_KEY: &str = "SENDGRID_API_KEY";
+    pub const SMS_PROVIDER: &str = "SMS_PROVIDER";
+    pub const SMS_ORIGIN: &str = "SMS_ORIGIN";
+    pub const TWILIO_ACCOUNT_SID: &str = "TWILIO_ACCOUNT_SID";
+    pub const TWILIO_AUTH_TOKEN: &str = "TWILIO_AUTH_TOKEN";
+    pub const LOGIN_IDENTIFIERS: &str = "LOGIN_IDENTIFIERS";
+    pub const USERNAME_REQUIRED: &str = "USERNAME_REQUIRED";
+    pub const USERNAME_MIN_LEN: &str = "USERNAME_MIN_LEN";
+    pub const USERNAME_MAX_LEN: &str = "USERNAME_MAX_LEN";
+    pub const USERNAME_CHARSET: &str = "USERNAME_CHARSET";
     pub const JWT_PUBLIC: &str = "JWT_PUBLIC";
     pub const JWT_SECRET: &str = "JWT_SECRET";
+    pub const JWT_KEY_SETS: &str = "JWT_KEY_SETS";
+    pub const JWT_KEY_SET: &str = "JWT_KEY_SET";
+    pub const ISSUER_URL: &str = "ISSUER_URL";
+    pub const KEY_ROTATION_PERIOD: &str = "KEY_ROTATION_PERIOD";
+    pub const KEY_WARMUP: &str = "KEY_WARMUP";
+    pub const KEY_GRACE: &str = "KEY_GRACE";
+    pub const SIGNING_KEYS_SECRET: &str = "SIGNING_KEYS_SECRET";
     pub const TEMPLATES: &str = "TEMPLATES";
     pub const PWD_SUFIX: &str = "PWD_SUFIX";
+    pub const PWD_SUFIX_PREVIOUS: &str = "PWD_SUFIX_PREVIOUS";
     pub const APP_NAME: &str = "APP_NAME";
+    pub const RETENTION_PERIOD: &str = "RETENTION_PERIOD";
+    pub const POLICY_ON_LOGIN: &str = "POLICY_ON_LOGIN";
+    pub const TERMS_LIFETIME: &str = "TERMS_LIFETIME";
+    pub const PRIVACY_LIFETIME: &str = "PRIVACY_LIFETIME";
+    pub const SIGNUP_INVITATION: &str = "SIGNUP_INVITATION";
+    pub const RECOVERY_QUORUM: &str = "RECOVERY_QUORUM";
+    pub const SIGNUP_SCHEMA: &str = "SIGNUP_SCHEMA";
+    pub const BACKUP_SECRET: &str = "BACKUP_SECRET";
+    pub const PII_KEYS: &str = "PII_KEYS";
+    pub const PII_INDEX_SECRET: &str = "PII_INDEX_SECRET";
+    pub const EVENT_STREAM: &str = "EVENT_STREAM";
+    pub const AUDIT_SINKS: &str = "AUDIT_SINKS";
+    pub const RATE_LIMITS: &str = "RATE_LIMITS";
+    pub const APP_QUOTAS: &str = "APP_QUOTAS";
+    pub const REMEMBER_INACTIVITY: &str = "REMEMBER_INACTIVITY";
+    pub const SESSION_PARTITIONING: &str = "SESSION_PARTITIONING";
+    pub const VALIDATION_CACHE_TTL: &str = "VALIDATION_CACHE_TTL";
+    pub const HASH_WORKERS: &str = "HASH_WORKERS";
+    pub const HASH_QUEUE: &str = "HASH_QUEUE";
+    pub const LEADER_ELECTION: &str = "LEADER_ELECTION";
+    pub const JOB_SCHEDULES: &str = "JOB_SCHEDULES";
+    pub const CLEANUP_BATCH: &str = "CLEANUP_BATCH";
+    pub const CLEANUP_PACE: &str = "CLEANUP_PACE";
+    pub const REPLICATION_REGION: &str = "REPLICATION_REGION";
+    pub const REPLICATION_PEERS: &str = "REPLICATION_PEERS";
+    pub const ACCOUNTS_PER_IP: &str = "ACCOUNTS_PER_IP";
+    pub const IPS_PER_ACCOUNT: &str = "IPS_PER_ACCOUNT";
+    pub const DETECTION_WINDOW: &str = "DETECTION_WINDOW";
+    pub const THROTTLE_TIMEOUT: &str = "THROTTLE_TIMEOUT";
+    pub const TRAVEL_SPEED: &str = "TRAVEL_SPEED";
+    pub const RISKY_FAILURES: &str = "RISKY_FAILURES";
+    pub const RISK_SCORER: &str = "RISK_SCORER";
+    pub const RISK_SCORER_URL: &str = "RISK_SCORER_URL";
+    pub const CLAIMS_ENRICHER_URL: &str = "CLAIMS_ENRICHER_URL";
+    pub const AUTHORIZER: &str = "AUTHORIZER";
+    pub const AUTHORIZER_URL: &str = "AUTHORIZER_URL";
+    pub const AUTHORIZER_FAIL_OPEN: &str = "AUTHORIZER_FAIL_OPEN";
+    pub const RISK_MFA_SCORE: &str = "RISK_MFA_SCORE";
+    pub const RISK_DENY_SCORE: &str = "RISK_DENY_SCORE";
+    pub const CAPTCHA_PROVIDER: &str = "CAPTCHA_PROVIDER";
+    pub const CAPTCHA_SECRET: &str = "CAPTCHA_SECRET";
+    pub const FEATURE_FLAGS: &str = "FEATURE_FLAGS";
+    pub const FEATURE_FLAGS_PROVIDER: &str = "FEATURE_FLAGS_PROVIDER";
+    pub const FEATURE_FLAGS_URL: &str = "FEATURE_FLAGS_URL";
+    pub const GOOGLE_CLIENT_ID: &str = "GOOGLE_CLIENT_ID";
+    pub const GOOGLE_CLIENT_SECRET: &str = "GOOGLE_CLIENT_SECRET";
+    pub const GOOGLE_ISSUER: &str = "GOOGLE_ISSUER";
+    pub const IDENTITY_LINKING: &str = "IDENTITY_LINKING";
+    pub const GEOIP_DATABASE: &str = "GEOIP_DATABASE";
+    pub const NEW_COUNTRY_REACTION: &str = "NEW_COUNTRY_REACTION";
+    pub const IMPOSSIBLE_TRAVEL_REACTION: &str = "IMPOSSIBLE_TRAVEL_REACTION";
+    pub const SECRETS_PROVIDERS: &str = "SECRETS_PROVIDERS";
+    pub const SECRETS_DIR: &str = "SECRETS_DIR";
+    pub const SECRETS_PATH: &str = "SECRETS_PATH";
+    pub const VAULT_ADDR: &str = "VAULT_ADDR";
+    pub const VAULT_TOKEN: &str = "VAULT_TOKEN";
+    pub const VAULT_MOUNT: &str = "VAULT_MOUNT";
+    pub const AWS_REGION: &str = "AWS_REGION";
+    pub const AWS_ACCESS_KEY_ID: &str = "AWS_ACCESS_KEY_ID";
+    pub const AWS_SECRET_ACCESS_KEY: &str = "AWS_SECRET_ACCESS_KEY";
+    pub const AWS_SESSION_TOKEN: &str = "AWS_SESSION_TOKEN";
+    pub const TLS_CERT: &str = "TLS_CERT";
+    pub const TLS_KEY: &str = "TLS_KEY";
+    pub const TLS_CLIENT_CA: &str = "TLS_CLIENT_CA";
+    pub const TLS_CLIENT_AUTH: &str = "TLS_CLIENT_AUTH";
+    pub const SPIFFE_TRUST_DOMAINS: &str = "SPIFFE_TRUST_DOMAINS";
+    pub const COOKIE_DOMAIN: &str = "COOKIE_DOMAIN";
+    pub const COOKIE_PATH: &str = "COOKIE_PATH";
+    pub const COOKIE_SECURE: &str = "COOKIE_SECURE";
+    pub const COOKIE_HTTP_ONLY: &str = "COOKIE_HTTP_ONLY";
+    pub const COOKIE_SAME_SITE: &str = "COOKIE_SAME_SITE";
+    pub const COOKIE_FORMAT: &str = "COOKIE_FORMAT";
+    pub const COOKIE_KEYS: &str = "COOKIE_KEYS";
+    pub const COOKIE_ENCRYPT: &str = "COOKIE_ENCRYPT";
+    pub const GLOBAL_LOGOUT_ON: &str = "GLOBAL_LOGOUT_ON";
+    pub const GRPC_WEB_ORIGINS: &str = "GRPC_WEB_ORIGINS";
+    pub const GRPC_REFLECTION: &str = "GRPC_REFLECTION";
+    pub const GRPC_KEEPALIVE_INTERVAL: &str = "GRPC_KEEPALIVE_INTERVAL";
+    pub const GRPC_KEEPALIVE_TIMEOUT: &str = "GRPC_KEEPALIVE_TIMEOUT";
+    pub const GRPC_MAX_CONCURRENT_STREAMS: &str = "GRPC_MAX_CONCURRENT_STREAMS";
+    pub const GRPC_CONCURRENCY_PER_CONNECTION: &str = "GRPC_CONCURRENCY_PER_CONNECTION";
+    pub const GRPC_MAX_MESSAGE_SIZE: &str = "GRPC_MAX_MESSAGE_SIZE";
+    pub const GRPC_MAX_IN_FLIGHT: &str = "GRPC_MAX_IN_FLIGHT";
+    pub const GRPC_NORMAL_SHARE: &str = "GRPC_NORMAL_SHARE";
+    pub const GRPC_LOW_SHARE: &str = "GRPC_LOW_SHARE";
+    pub const DIAGNOSTICS_EXPIRY_WARNING: &str = "DIAGNOSTICS_EXPIRY_WARNING";
+    pub const DIAGNOSTICS_QUOTA_SHARE: &str = "DIAGNOSTICS_QUOTA_SHARE";
+    pub const DIAGNOSTICS_WINDOW: &str = "DIAGNOSTICS_WINDOW";
+    pub const GRPC_MAX_METADATA_SIZE: &str = "GRPC_MAX_METADATA_SIZE";
+    pub const GRPC_MAX_METADATA_ENTRIES: &str = "GRPC_MAX_METADATA_ENTRIES";
 }
 
 pub mod errors {
     pub const CANNOT_CONNECT: &str = "cannot connect";
+    pub const INVALID_CONFIG: &str = "invalid config";
     pub const NOT_FOUND: &str = "not found";
     pub const ALREADY_EXISTS: &str = "already exists";
     pub const POISONED: &str = "poisoned resource";
@@ -32,4 +357,40 @@ pub mod errors {
     pub const UNAUTHORIZED: &str = "unauthorized";
     pub const PARSE_FAILED: &str = "could not parse";
     pub const HAS_FAILED: &str = "action has failed";
+    pub const SUSPENDED: &str = "account suspended";
+    pub const EXPIRED: &str = "session expired";
+    pub const REVOKED: &str = "session revoked";
+    pub const POLICY_REQUIRED: &str = "policy acceptance required";
+    pub const INVITATION_REQUIRED: &str = "valid invitation required";
+    pub const NOT_APPROVED: &str = "recovery not approved yet";
+    pub const WRONG_CODE: &str = "wrong or expired code";
+    pub const GUEST: &str = "not available for guest sessions";
+    pub const ELEVATION_REQUIRED: &str = "session elevation required";
+    pub const RESET_REQUIRED: &str = "password reset required";
+    pub const IMPERSONATED: &str = "not available for impersonated sessions";
+    pub const TOO_MANY_REQUESTS: &str = "too many requests";
+    pub const THROTTLED: &str = "too many failed attempts, try again later";
+    pub const CAPTCHA_REQUIRED: &str = "valid captcha required";
+    pub const IP_NOT_ALLOWED: &str = "address not allowed";
+    pub const LOGIN_DENIED: &str = "login not allowed from this location";
+    pub const REPLAYED: &str = "already used";
+    pub const MFA_REQUIRED: &str = "mfa code required";
+    pub const FEATURE_DISABLED: &str = "not available for this app";
+    pub const ISSUANCE_DENIED: &str = "token issuance denied";
+    pub const INVALID_USERNAME: &str = "username not allowed by the policy";
+    pub const USERNAME_RESERVED: &str = "username not available";
+    pub const NOT_ACTIVATED: &str = "account not activated yet";
+    pub const LOGIN_REQUIRED: &str = "login required";
+    pub const CONSENT_REQUIRED: &str = "consent required";
+    pub const PROFILE_INCOMPLETE: &str = "profile incomplete"; // followed by the missing attributes
+    pub const LINK_REQUIRED: &str = "account linking required"; // followed by the link token, if any
+    pub const BATCH_TOO_LARGE: &str = "too many items in a single request";
+    pub const IMPORT_TOO_LARGE: &str = "import exceeds the max size";
+    pub const COMPRESSION_UNSUPPORTED: &str = "compressed messages are not supported";
+    pub const QUOTA_EXCEEDED: &str = "quota exceeded for this app";
+    pub const OVERLOADED: &str = "server overloaded, try again later";
+    pub const LOCKED: &str = "operation already in progress, try again later";
+    pub const INVALID_PAGE_TOKEN: &str = "invalid page token";
+    pub const TAMPERED: &str = "audit trail tampered"; // followed by the id of the event the chain breaks by
+    pub const INVALID_REQUEST: &str = "invalid request"; // the fields that are wrong go in the details of the status
 }
\ No newline at end of file
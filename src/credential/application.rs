@@ -0,0 +1,121 @@
+use std::error::Error;
+use std::time::Duration;
+use std::sync::{Arc, RwLock, RwLockReadGuard};
+use crate::security;
+use crate::constants::{errors, settings};
+use crate::metadata::domain::Metadata;
+use crate::user::domain::User;
+use crate::tenant::application::tenant_find;
+use crate::nonce::application::nonce_consume;
+use crate::feature::{
+    application::feature_check_by_app_id,
+    domain::Flag,
+};
+use crate::session::{
+    application::decode_token,
+    get_repository as get_sess_repository,
+    domain::Session,
+};
+use crate::audit::{
+    application::audit_record,
+    domain::EventKind,
+};
+use super::{
+    get_repository as get_credential_repository,
+    domain::{Credential, Challenge},
+};
+
+fn get_readable_session(sess_arc: &Arc<RwLock<Session>>) -> Result<RwLockReadGuard<Session>, Box<dyn Error>> {
+    match sess_arc.read() {
+        Ok(sess) => Ok(sess),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
+
+/// If, and only if, the provided token is valid and its session is elevated, the given ec public key is registered as
+/// a credential of the session's owner, which may log in from then on by signing challenges with its private key
+pub fn credential_register(token: &str, name: &str, public_key: &str) -> Result<Credential, Box<dyn Error>> {
+    info!("got a register credential request");
+    let claim = decode_token(token)?;
+    feature_check_by_app_id(Flag::CredentialEnrollment, claim.tenant, claim.app)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let (user, issuer) = { // block is required because of lock release
+        let sess = get_readable_session(&sess_arc)?;
+        if !sess.is_elevated() {
+            return Err(errors::ELEVATION_REQUIRED.into());
+        }
+
+        (sess.get_user()?.clone(), sess.get_issuer()?)
+    };
+
+    let meta = Metadata::new();
+    let mut credential = Credential::new(meta, &user, name, public_key)?;
+    get_credential_repository().create(&mut credential)?;
+
+    audit_record(user.get_id(), issuer, EventKind::Credential, &format!("credential {} registered", credential.get_name()));
+    Ok(credential)
+}
+
+/// If, and only if, the provided token is valid, returns all the credentials of the session's owner
+pub fn credential_list(token: &str) -> Result<Vec<Credential>, Box<dyn Error>> {
+    info!("got a list credentials request");
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = get_readable_session(&sess_arc)?.get_user()?.get_id();
+    get_credential_repository().find_all_by_user(user_id)
+}
+
+/// If, and only if, the provided token is valid and the credential belongs to the session's owner, the credential gets
+/// removed
+pub fn credential_delete(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a delete credential request");
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let (user_id, issuer) = { // block is required because of lock release
+        let sess = get_readable_session(&sess_arc)?;
+        (sess.get_user()?.get_id(), sess.get_issuer()?)
+    };
+
+    let credential = get_credential_repository().find(id)?;
+    if credential.get_user() != user_id {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    get_credential_repository().delete(&credential)?;
+
+    audit_record(user_id, issuer, EventKind::Credential, &format!("credential {} deleted", credential.get_name()));
+    Ok(())
+}
+
+/// Returns a short-lived challenge for logging in the given email of the given tenant. Challenges are issued no matter
+/// the email exists or has any credential, so they cannot be used to tell which accounts there are
+pub fn credential_challenge(tenant: &str, email: &str) -> Result<String, Box<dyn Error>> {
+    info!("got a challenge request for user {} ", email);
+    let tenant = tenant_find(tenant)?;
+    let nonce = security::get_random_string(settings::CHALLENGE_NONCE_LEN);
+    let claim = Challenge::new(tenant.get_id(), email, &nonce, Duration::from_secs(settings::CHALLENGE_TIMEOUT));
+    security::encode_jwt(claim)
+}
+
+/// Checks the provided challenge has been issued for logging in the given email of the user, and that the signature of
+/// it has been made by the private key of any of the user's credentials. Each challenge can be used once only
+pub fn credential_verify(user: &User, email: &str, challenge: &str, signature: &[u8]) -> Result<(), Box<dyn Error>> {
+    let claim = security::decode_jwt::<Challenge>(challenge)?;
+    if claim.tenant != user.get_tenant() || claim.sub != email {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    let all_credentials = get_credential_repository().find_all_by_user(user.get_id())?;
+    if !all_credentials.iter().any(|credential| credential.verify(challenge, signature).is_ok()) {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    // only signed challenges are consumed, so no one else can burn the challenge of the user
+    nonce_consume("challenge", &claim.nonce, claim.exp)
+}
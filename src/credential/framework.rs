@@ -0,0 +1,254 @@
+use std::error::Error;
+use tonic::{Request, Response, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::schema::credentials::dsl::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::credentials;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use super::domain::{Credential, CredentialRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("credential");
+}
+
+// Proto generated server traits
+use proto::credential_service_server::CredentialService;
+pub use proto::credential_service_server::CredentialServiceServer;
+
+// Proto message structs
+use proto::{RegisterRequest, CredentialRequest, CredentialList, Credential as ProtoCredential};
+
+fn to_proto(credential: &Credential) -> ProtoCredential {
+    ProtoCredential{
+        id: credential.get_id(),
+        name: credential.get_name().to_string(),
+        public_key: credential.get_public_key().to_string(),
+    }
+}
+
+pub struct CredentialServiceImplementation;
+
+#[tonic::async_trait]
+impl CredentialService for CredentialServiceImplementation {
+    async fn register_credential(&self, request: Request<RegisterRequest>) -> Result<Response<ProtoCredential>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::credential_register(&token, &msg_ref.name, &msg_ref.public_key) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(credential) => Ok(Response::new(to_proto(&credential))),
+        }
+    }
+
+    async fn list_credentials(&self, request: Request<()>) -> Result<Response<CredentialList>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        match super::application::credential_list(token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(all_credentials) => Ok(Response::new(
+                CredentialList{
+                    credentials: all_credentials.iter().map(to_proto).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn delete_credential(&self, request: Request<CredentialRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::credential_delete(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[table_name = "credentials"]
+struct PostgresCredential {
+    pub id: i32,
+    pub user_id: i32,
+    pub name: String,
+    pub public_key: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "credentials"]
+struct NewPostgresCredential<'a> {
+    pub user_id: i32,
+    pub name: &'a str,
+    pub public_key: &'a str,
+    pub meta_id: i32,
+}
+
+pub struct PostgresCredentialRepository;
+
+impl PostgresCredentialRepository {
+    fn create_on_conn(conn: &PgConnection, credential: &mut Credential) -> Result<(), PgError>  {
+        // in order to create a credential it must exists the metadata for this credential
+        PostgresMetadataRepository::create_on_conn(conn, &mut credential.meta)?;
+
+        let new_credential = NewPostgresCredential {
+            user_id: credential.user,
+            name: &credential.name,
+            public_key: &credential.public_key,
+            meta_id: credential.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(credentials::table)
+            .values(&new_credential)
+            .get_result::<PostgresCredential>(conn)?;
+
+        credential.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, credential: &Credential) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            credentials.filter(id.eq(credential.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &credential.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresCredential) -> Result<Credential, Box<dyn Error>> {
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(Credential{
+            id: result.id,
+            user: result.user_id,
+            name: result.name.clone(),
+            public_key: result.public_key.clone(),
+            meta: meta,
+        })
+    }
+}
+
+impl CredentialRepository for PostgresCredentialRepository {
+    fn find(&self, target: i32) -> Result<Credential, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            credentials.filter(id.eq(target))
+                       .load::<PostgresCredential>(&connection)?
+        };
+    
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresCredentialRepository::build(&results[0])
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Credential>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            credentials.filter(user_id.eq(target_user))
+                       .order(id.asc())
+                       .load::<PostgresCredential>(&connection)?
+        };
+
+        let mut all_credentials = Vec::new();
+        for result in results.iter() {
+            all_credentials.push(PostgresCredentialRepository::build(result)?);
+        }
+
+        Ok(all_credentials)
+    }
+
+    fn create(&self, credential: &mut Credential) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresCredentialRepository::create_on_conn(&conn, credential))?;
+        Ok(())
+    }
+
+    fn delete(&self, credential: &Credential) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresCredentialRepository::delete_on_conn(&conn, credential))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryCredentialRepository {
+    table: memory::Table<Credential>,
+}
+
+impl InMemoryCredentialRepository {
+    pub fn new() -> Self {
+        InMemoryCredentialRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl CredentialRepository for InMemoryCredentialRepository {
+    fn find(&self, target: i32) -> Result<Credential, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Credential>, Box<dyn Error>>  {
+        self.table.find_all(|credential| credential.user == target_user)
+    }
+
+    fn create(&self, credential: &mut Credential) -> Result<(), Box<dyn Error>> {
+        // in order to create a credential it must exists the metadata for this credential
+        get_meta_repository().create(&mut credential.meta)?;
+
+        let (target_user, target) = (credential.user, credential.name.clone());
+        self.table.insert(credential,
+                          |existing| existing.user == target_user && existing.name == target,
+                          |credential, new_id| credential.id = new_id)
+    }
+
+    fn delete(&self, credential: &Credential) -> Result<(), Box<dyn Error>> {
+        self.table.delete(credential.id)?;
+        get_meta_repository().delete(&credential.meta)
+    }
+}
@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::CredentialRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresCredentialRepository),
+            Backend::Memory => Box::new(framework::InMemoryCredentialRepository::new()),
+            backend => storage::unsupported(backend, "credentials"),
+        }
+    }; 
+}   
+
+pub fn get_repository() -> Box<&'static dyn domain::CredentialRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
@@ -0,0 +1,186 @@
+use std::error::Error;
+use std::convert::Infallible;
+use std::fs;
+use std::net::SocketAddr;
+use std::thread;
+use std::time::{Duration, Instant};
+use hyper::{Body, Server, StatusCode};
+use hyper::header::CONTENT_TYPE;
+use hyper::service::{make_service_fn, service_fn};
+use tower::Layer;
+
+use crate::constants::settings;
+use crate::headers::HeadersLayer;
+
+const PROFILE_PATH: &str = "/debug/pprof/profile";
+const VARS_PATH: &str = "/debug/vars";
+const THREADS_PATH: &str = "/debug/threads";
+const PROC_STATUS_FIELDS: &[&str] = &["VmRSS", "VmHWM", "VmSize", "Threads", "voluntary_ctxt_switches",
+                                      "nonvoluntary_ctxt_switches"];
+
+lazy_static! {
+    static ref STARTED_AT: Instant = Instant::now();
+}
+
+/// Returns the value of the given query parameter of the request, if any
+fn get_param(request: &hyper::Request<Body>, name: &str) -> Option<String> {
+    request.uri().query()?
+        .split('&')
+        .filter_map(|param| {
+            let mut parts = param.splitn(2, '=');
+            match (parts.next(), parts.next()) {
+                (Some(key), Some(value)) if key == name => Some(value.to_string()),
+                _ => None,
+            }
+        })
+        .next()
+}
+
+/// Samples the cpu of the whole process for the given time, returning the profile as a flamegraph
+fn profile(seconds: u64) -> Result<Vec<u8>, Box<dyn Error>> {
+    let guard = pprof::ProfilerGuard::new(settings::PROFILE_FREQUENCY)?;
+    thread::sleep(Duration::from_secs(seconds));
+
+    let mut svg = Vec::new();
+    guard.report().build()?.flamegraph(&mut svg)?;
+    Ok(svg)
+}
+
+/// Returns the figures of the process, as told by the kernel, along with the version and uptime of the service
+fn get_vars() -> serde_json::Value {
+    let mut vars = serde_json::json!({
+        "version": env!("CARGO_PKG_VERSION"),
+        "uptime_seconds": STARTED_AT.elapsed().as_secs(),
+    });
+
+    if let Ok(status) = fs::read_to_string("/proc/self/status") {
+        for line in status.lines() {
+            let mut parts = line.splitn(2, ':');
+            if let (Some(key), Some(value)) = (parts.next(), parts.next()) {
+                if PROC_STATUS_FIELDS.contains(&key) {
+                    vars[key] = value.trim().into();
+                }
+            }
+        }
+    }
+
+    if let Ok(fds) = fs::read_dir("/proc/self/fd") {
+        vars["open_fds"] = fds.count().into();
+    }
+
+    vars
+}
+
+/// Returns every thread of the process, one per line, with its id, name and state, as told by the kernel
+fn get_threads() -> Result<String, Box<dyn Error>> {
+    let mut threads = Vec::new();
+    for task in fs::read_dir("/proc/self/task")? {
+        let path = task?.path();
+        let tid = path.file_name().and_then(|tid| tid.to_str()).unwrap_or_default().to_string();
+        let name = fs::read_to_string(path.join("comm")).unwrap_or_default();
+        let stat = fs::read_to_string(path.join("stat")).unwrap_or_default();
+
+        // the state follows the name, which is enclosed by parentheses and may contain spaces itself
+        let state = stat.rfind(')')
+            .and_then(|index| stat[index + 1..].split_whitespace().next())
+            .unwrap_or("?")
+            .to_string();
+
+        threads.push(format!("{} {} {}", tid, state, name.trim()));
+    }
+
+    threads.sort();
+    Ok(threads.join("\n"))
+}
+
+fn new_response(status: StatusCode, body: Body) -> hyper::Response<Body> {
+    let mut response = hyper::Response::new(body);
+    *response.status_mut() = status;
+    response
+}
+
+async fn handle(request: hyper::Request<Body>) -> Result<hyper::Response<Body>, Infallible> {
+    match request.uri().path() {
+        PROFILE_PATH => {
+            let seconds = get_param(&request, "seconds")
+                .and_then(|seconds| seconds.parse().ok())
+                .unwrap_or(settings::PROFILE_SECONDS)
+                .min(settings::PROFILE_MAX_SECONDS);
+
+            info!("profiling cpu for {} seconds", seconds);
+            let result = tokio::task::spawn_blocking(move || profile(seconds).map_err(|err| err.to_string())).await;
+            match result {
+                Ok(Ok(svg)) => {
+                    let mut response = hyper::Response::new(Body::from(svg));
+                    if let Ok(format) = "image/svg+xml".parse() {
+                        response.headers_mut().insert(CONTENT_TYPE, format);
+                    }
+
+                    Ok(response)
+                },
+                Ok(Err(err)) => {
+                    error!("could not profile cpu: {}", err);
+                    Ok(new_response(StatusCode::INTERNAL_SERVER_ERROR, Body::from(err)))
+                },
+                Err(err) => {
+                    error!("could not profile cpu: {}", err);
+                    Ok(new_response(StatusCode::INTERNAL_SERVER_ERROR, Body::empty()))
+                },
+            }
+        },
+
+        VARS_PATH => {
+            let mut response = hyper::Response::new(Body::from(get_vars().to_string()));
+            if let Ok(format) = "application/json".parse() {
+                response.headers_mut().insert(CONTENT_TYPE, format);
+            }
+
+            Ok(response)
+        },
+
+        THREADS_PATH => match get_threads() {
+            Ok(threads) => Ok(hyper::Response::new(Body::from(threads))),
+            Err(err) => {
+                error!("could not list threads: {}", err);
+                Ok(new_response(StatusCode::INTERNAL_SERVER_ERROR, Body::empty()))
+            }
+        },
+
+        _ => Ok(new_response(StatusCode::NOT_FOUND, Body::empty())),
+    }
+}
+
+/// Serves the runtime debug endpoints at the given port of the loopback interface only, so they are never reachable
+/// from outside the host: a cpu profile as a flamegraph at /debug/pprof/profile, the figures of the process at
+/// /debug/vars and all of its threads at /debug/threads
+pub async fn serve(port: u16) -> Result<(), Box<dyn Error + Send + Sync>> {
+    lazy_static::initialize(&STARTED_AT);
+    let addr = SocketAddr::from(([127, 0, 0, 1], port));
+    let make_service = make_service_fn(|_| async {
+        Ok::<_, Infallible>(HeadersLayer::new().layer(service_fn(handle)))
+    });
+
+    Server::try_bind(&addr)?.serve(make_service).await?;
+    Ok(())
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use hyper::{Body, Request};
+    use super::{get_param, get_vars};
+
+    #[test]
+    fn get_param_should_not_fail() {
+        let request = Request::get("/debug/pprof/profile?debug=1&seconds=30").body(Body::empty()).unwrap();
+        assert_eq!(Some("30".to_string()), get_param(&request, "seconds"));
+        assert_eq!(None, get_param(&request, "missing"));
+    }
+
+    #[test]
+    fn get_vars_should_not_fail() {
+        let vars = get_vars();
+        assert_eq!(env!("CARGO_PKG_VERSION"), vars["version"]);
+        assert!(vars["uptime_seconds"].is_u64());
+    }
+}
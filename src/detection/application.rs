@@ -0,0 +1,352 @@
+use std::error::Error;
+use crate::constants::{settings, errors, environment};
+use crate::{smtp, status};
+use crate::user::domain::User;
+use crate::app::domain::Branding;
+use crate::tenant::application::tenant_setting;
+use crate::audit::{
+    application::audit_record,
+    domain::EventKind,
+};
+
+use super::{
+    get_repository as get_signal_repository,
+    get_thresholds,
+    get_scorer,
+    framework::HeuristicScorer,
+    domain::{Origin, Anomaly, Reaction, Assessment, RiskContext, RiskScorer},
+};
+
+fn ip_key(origin: &Origin) -> String {
+    format!("ip:{}", origin.get_ip())
+}
+
+fn account_key(tenant: i32, email: &str) -> String {
+    format!("account:{}", sha256::digest_bytes(format!("{}:{}", tenant, email).as_bytes()))
+}
+
+/// Fails if either the ip the attempt comes from or the account being logged in is being throttled, along with how long
+/// it still is. A failing repository must never block the logins, so any error is logged and the attempt let through
+pub fn detection_check(origin: &Origin, tenant: i32, email: &str) -> Result<(), Box<dyn Error>> {
+    let mut keys = vec![account_key(tenant, email)];
+    if origin.get_ip().len() > 0 {
+        keys.push(ip_key(origin));
+    }
+
+    for key in keys.iter() {
+        match get_signal_repository().blocked_for(key) {
+            Ok(Some(left)) => return Err(status::retry_after(errors::THROTTLED, left)),
+            Ok(None) => {},
+            Err(err) => error!("could not check whether {} is throttled: {}", key, err),
+        }
+    }
+
+    Ok(())
+}
+
+/// Records a failed login attempt on the given account, no matter it exists or not. If too many distinct accounts
+/// fail from the same ip (credential stuffing) the ip gets throttled, while if too many distinct ips fail on the same
+/// account (distributed brute force) the account does. Both cases are alerted about
+pub fn detection_failure(origin: &Origin, tenant: i32, email: &str, user: Option<&User>) {
+    let thresholds = get_thresholds();
+    let repo = get_signal_repository();
+    let account = account_key(tenant, email);
+
+    if origin.get_ip().len() > 0 {
+        let ip = ip_key(origin);
+        match repo.add_distinct(&ip, &account, thresholds.window) {
+            Ok(count) if count > thresholds.accounts_per_ip => {
+                warn!("alert: {} distinct accounts have failed to log in from ip {}, throttling it", count, origin.get_ip());
+                if let Err(err) = repo.block(&ip, thresholds.throttle_timeout) {
+                    error!("could not throttle ip {}: {}", origin.get_ip(), err);
+                }
+            },
+            Ok(_) => {},
+            Err(err) => error!("could not record failed login from ip {}: {}", origin.get_ip(), err),
+        }
+
+        match repo.add_distinct(&account, origin.get_ip(), thresholds.window) {
+            Ok(count) if count > thresholds.ips_per_account => {
+                warn!("alert: {} distinct ips have failed to log into account {}, throttling it", count, account);
+                if let Some(user) = user {
+                    audit_record(user.get_id(), user.get_id(), EventKind::Threat, "too many ips failing to log in");
+                }
+
+                if let Err(err) = repo.block(&account, thresholds.throttle_timeout) {
+                    error!("could not throttle account {}: {}", account, err);
+                }
+            },
+            Ok(_) => {},
+            Err(err) => error!("could not record failed login on account {}: {}", account, err),
+        }
+    }
+}
+
+/// Returns the reaction the given tenant has set for the given setting, or else the default one
+fn get_reaction(tenant: i32, name: &str, default: &str) -> Reaction {
+    let value = tenant_setting(tenant, name).unwrap_or_else(|| default.to_string());
+    match Reaction::from_str(&value) {
+        Some(reaction) => reaction,
+        None => {
+            warn!("{} of tenant {} is not a valid reaction, using {} instead", value, tenant, default);
+            Reaction::from_str(default).unwrap_or(Reaction::Ignore)
+        }
+    }
+}
+
+/// Returns the risk score the given tenant has set for the given setting, or else the default one
+fn get_score(tenant: i32, name: &str, default: u8) -> u8 {
+    match tenant_setting(tenant, name).map(|value| value.parse()) {
+        Some(Ok(score)) => score,
+        Some(Err(_)) => {
+            warn!("{} of tenant {} is not a valid score, using {} instead", name, tenant, default);
+            default
+        },
+        None => default,
+    }
+}
+
+/// Scores the login described by the given context by the scorer, falling back to the heuristic one if it fails, so a
+/// scorer being unreachable does not prevent anyone from logging in
+fn detection_score(context: &RiskContext) -> u8 {
+    match get_scorer().score(context) {
+        Ok(score) => score,
+        Err(err) => {
+            warn!("could not score the login of user {}, scoring it heuristically instead: {}", context.get_user(), err);
+            HeuristicScorer.score(context).unwrap_or_default()
+        }
+    }
+}
+
+/// Assesses the login of the given user, through the given email, despite its credentials being alright. If either
+/// the ip or the account have failed several times recently, a captcha is required. If the login comes from a country
+/// the user has not logged in from recently, or is too far away from the previous one of the user to have travelled in
+/// between (impossible travel), it reacts as set by the tenant's policy, and the anomaly is alerted about. Logins with
+/// no known country or location never show these anomalies. All these signals, along with whether the device the
+/// login comes from, if any, is a trusted one, get scored by the risk scorer, whose score may require the mfa or deny
+/// the login as well, as set by the tenant's policy
+pub fn detection_assess(origin: &Origin, email: &str, user: &User, device_trusted: Option<bool>) -> Assessment {
+    let thresholds = get_thresholds();
+    let repo = get_signal_repository();
+    let mut assessment = Assessment::new();
+    let mut failures = 0;
+    let mut known_countries = 0;
+    let mut travel_speed = None;
+
+    let mut keys = vec![account_key(user.get_tenant(), email)];
+    if origin.get_ip().len() > 0 {
+        keys.push(ip_key(origin));
+    }
+
+    for key in keys.iter() {
+        match repo.count_distinct(key) {
+            Ok(count) => {
+                failures = failures.max(count);
+                if count >= thresholds.risky_failures {
+                    assessment.raise(Reaction::Captcha);
+                }
+            },
+            Err(err) => error!("could not count failed logins on {}: {}", key, err),
+        }
+    }
+
+    if let Some(country) = origin.get_country() {
+        let known = repo.find_countries(user.get_id());
+        known_countries = known.as_ref().map(Vec::len).unwrap_or_default();
+        match known {
+            // the very first country of a user is not a new one, but the one to compare the next ones with
+            Ok(known) if known.len() > 0 && !known.iter().any(|known| known == country) => {
+                warn!("alert: user {} is logging in from {}, a country never seen before", user.get_id(), country);
+                let reaction = get_reaction(user.get_tenant(),
+                                            environment::NEW_COUNTRY_REACTION,
+                                            settings::NEW_COUNTRY_REACTION);
+
+                audit_record(user.get_id(), user.get_id(), EventKind::Threat, Anomaly::NewCountry.as_str());
+                assessment.add_anomaly(Anomaly::NewCountry, reaction);
+            },
+            Ok(_) => {},
+            Err(err) => error!("could not find countries of user {}: {}", user.get_id(), err),
+        }
+    }
+
+    if let Some(location) = origin.get_location() {
+        let previous = repo.find_location(user.get_id());
+        if let Ok(Some(previous)) = &previous {
+            travel_speed = Some(location.speed_from(previous));
+        }
+
+        match previous {
+            Ok(Some(previous)) if location.speed_from(&previous) > thresholds.travel_speed => {
+                warn!("alert: user {} is logging in {:.0} km away from the previous login, at {:.0} km/h",
+                      user.get_id(), location.distance_to(&previous), location.speed_from(&previous));
+
+                let reaction = get_reaction(user.get_tenant(),
+                                            environment::IMPOSSIBLE_TRAVEL_REACTION,
+                                            settings::IMPOSSIBLE_TRAVEL_REACTION);
+
+                audit_record(user.get_id(), user.get_id(), EventKind::Threat, Anomaly::ImpossibleTravel.as_str());
+                assessment.add_anomaly(Anomaly::ImpossibleTravel, reaction);
+            },
+            Ok(_) => {},
+            Err(err) => error!("could not find location of user {}: {}", user.get_id(), err),
+        }
+    }
+
+    let context = RiskContext {
+        tenant: user.get_tenant(),
+        user: user.get_id(),
+        ip: origin.get_ip().to_string(),
+        country: origin.get_country().map(str::to_string),
+        travel_speed: travel_speed,
+        device_trusted: device_trusted,
+        failures: failures,
+        known_countries: known_countries,
+        anomalies: assessment.get_anomalies().to_vec(),
+    };
+
+    let score = detection_score(&context);
+    let mfa_score = get_score(user.get_tenant(), environment::RISK_MFA_SCORE, settings::RISK_MFA_SCORE);
+    let deny_score = get_score(user.get_tenant(), environment::RISK_DENY_SCORE, settings::RISK_DENY_SCORE);
+    let reaction = Reaction::from_score(score, mfa_score, deny_score);
+    if reaction > Reaction::Ignore {
+        warn!("alert: login of user {} has been scored {} out of 100, reacting by {}", user.get_id(), score, reaction.as_str());
+        audit_record(user.get_id(), user.get_id(), EventKind::Threat, &format!("risk score {}", score));
+    }
+
+    assessment.set_score(score, reaction);
+
+    // users are only notified about the anomalies they can tell apart, not about the score alone
+    if assessment.get_reaction() == Reaction::Deny && assessment.get_anomalies().len() > 0 {
+        detection_notify(origin, user, &assessment, None);
+    }
+
+    assessment
+}
+
+/// Notifies the given user about the anomalies of a login from the given origin, on behalf of the app with the given
+/// branding if any. A failing notification must not prevent the user from logging in
+fn detection_notify(origin: &Origin, user: &User, assessment: &Assessment, branding: Option<&Branding>) {
+    let anomalies: Vec<&str> = assessment.get_anomalies().iter().map(|anomaly| anomaly.as_str()).collect();
+    let country = origin.get_country().unwrap_or("an unknown country");
+    let anomalies = anomalies.join(", ");
+    let (tenant, locale) = (user.get_tenant(), user.get_locale());
+    if let Err(err) = smtp::send_new_location_notification(tenant, locale, user.get_email(), country, &anomalies,
+                                                           branding) {
+        warn!("could not notify user {} about a login from {}: {}", user.get_id(), country, err);
+    }
+}
+
+/// Records the location and country of a successful login of the given user, so the next ones can be compared with
+/// them, and notifies the user about its anomalies, if required by the assessment, on behalf of the app with the given
+/// branding if any
+pub fn detection_success(origin: &Origin, user: &User, assessment: &Assessment, branding: Option<&Branding>) {
+    if assessment.must_notify() {
+        detection_notify(origin, user, assessment, branding);
+    }
+
+    if let Some(location) = origin.get_location() {
+        if let Err(err) = get_signal_repository().set_location(user.get_id(), location, settings::REMEMBER_TIMEOUT) {
+            error!("could not record location of user {}: {}", user.get_id(), err);
+        }
+    }
+
+    if let Some(country) = origin.get_country() {
+        if let Err(err) = get_signal_repository().add_country(user.get_id(), country, settings::COUNTRY_TIMEOUT) {
+            error!("could not record country of user {}: {}", user.get_id(), err);
+        }
+    }
+}
+
+#[cfg(test)]
+#[cfg(feature = "integration-tests")]
+mod tests {
+    use crate::status;
+    use crate::constants::{errors, settings};
+    use crate::user::domain::tests::new_user_custom;
+    use super::super::domain::{Origin, Location, Anomaly, Reaction, Assessment};
+    use super::{detection_check, detection_failure, detection_assess, detection_success};
+
+    #[test]
+    fn detection_failure_should_throttle_ip() {
+        let origin = Origin::new("10.0.0.1", None, None);
+        for index in 0..super::get_thresholds().accounts_per_ip + 1 {
+            let email = format!("stuffing_{}@testing.com", index);
+            assert!(detection_check(&origin, settings::DEFAULT_TENANT, &email).is_ok());
+            detection_failure(&origin, settings::DEFAULT_TENANT, &email, None);
+        }
+
+        let err = detection_check(&origin, settings::DEFAULT_TENANT, "another@testing.com").unwrap_err();
+        assert_eq!(errors::THROTTLED, err.to_string());
+        assert!(status::get_retry_after(&*err).is_some(), "throttling must tell how long it lasts");
+        assert!(detection_check(&Origin::new("10.0.0.2", None, None), settings::DEFAULT_TENANT, "another@testing.com").is_ok());
+    }
+
+    #[test]
+    fn detection_failure_should_throttle_account() {
+        const EMAIL: &str = "brute_force@testing.com";
+        for index in 0..super::get_thresholds().ips_per_account + 1 {
+            let origin = Origin::new(&format!("10.0.1.{}", index), None, None);
+            assert!(detection_check(&origin, settings::DEFAULT_TENANT, EMAIL).is_ok());
+            detection_failure(&origin, settings::DEFAULT_TENANT, EMAIL, None);
+        }
+
+        let origin = Origin::new("10.0.2.1", None, None);
+        assert!(detection_check(&origin, settings::DEFAULT_TENANT, EMAIL).is_err());
+        assert!(detection_check(&origin, settings::DEFAULT_TENANT, "another@testing.com").is_ok());
+    }
+
+    #[test]
+    fn detection_assess_should_alert_impossible_travel() {
+        let user = new_user_custom(8888, "impossible_travel@testing.com");
+        let barcelona = Origin::new("10.0.3.1", Some(Location::new(41.3874, 2.1686).unwrap()), None);
+        let new_york = Origin::new("10.0.3.2", Some(Location::new(40.7128, -74.0060).unwrap()), None);
+
+        let assessment = detection_assess(&barcelona, user.get_email(), &user, None);
+        assert_eq!(Reaction::Ignore, assessment.get_reaction());
+        detection_success(&barcelona, &user, &assessment, None);
+
+        assert_eq!(Reaction::Ignore, detection_assess(&barcelona, user.get_email(), &user, None).get_reaction());
+
+        let assessment = detection_assess(&new_york, user.get_email(), &user, None);
+        assert_eq!(Reaction::Mfa, assessment.get_reaction());
+        assert_eq!(&[Anomaly::ImpossibleTravel], assessment.get_anomalies());
+
+        let unknown = Origin::new("10.0.3.3", None, None);
+        assert_eq!(Reaction::Ignore, detection_assess(&unknown, user.get_email(), &user, None).get_reaction());
+    }
+
+    #[test]
+    fn detection_assess_should_alert_new_country() {
+        let user = new_user_custom(8890, "new_country@testing.com");
+        let spain = Origin::new("10.0.6.1", None, Some("ES"));
+        let france = Origin::new("10.0.6.2", None, Some("FR"));
+
+        // the first country is never a new one
+        let assessment = detection_assess(&spain, user.get_email(), &user, None);
+        assert!(assessment.get_anomalies().is_empty());
+        detection_success(&spain, &user, &assessment, None);
+
+        let assessment = detection_assess(&france, user.get_email(), &user, None);
+        assert_eq!(Reaction::Notify, assessment.get_reaction());
+        assert_eq!(&[Anomaly::NewCountry], assessment.get_anomalies());
+        detection_success(&france, &user, &Assessment::new(), None);
+
+        assert!(detection_assess(&france, user.get_email(), &user, None).get_anomalies().is_empty());
+    }
+
+    #[test]
+    fn detection_assess_after_failures() {
+        let user = new_user_custom(8889, "risky@testing.com");
+        let origin = Origin::new("10.0.4.1", None, None);
+        assert_eq!(Reaction::Ignore, detection_assess(&origin, user.get_email(), &user, None).get_reaction());
+
+        for index in 0..super::get_thresholds().risky_failures {
+            let origin = Origin::new(&format!("10.0.5.{}", index), None, None);
+            detection_failure(&origin, user.get_tenant(), user.get_email(), None);
+        }
+
+        let assessment = detection_assess(&origin, user.get_email(), &user, None);
+        assert_eq!(Reaction::Captcha, assessment.get_reaction());
+        assert!(!assessment.must_notify());
+    }
+}
@@ -0,0 +1,401 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::constants::errors;
+use crate::time;
+
+const EARTH_RADIUS: f64 = 6371.0; // in kilometers
+
+pub trait SignalRepository {
+    // adds the member into the set at key, which expires once the window is over since it got created, and returns
+    // how many distinct members the set has
+    fn add_distinct(&self, key: &str, member: &str, window: u64) -> Result<usize, Box<dyn Error>>;
+    fn count_distinct(&self, key: &str) -> Result<usize, Box<dyn Error>>;
+    fn block(&self, key: &str, timeout: u64) -> Result<(), Box<dyn Error>>;
+    // returns how long the key is still blocked for, if it is
+    fn blocked_for(&self, key: &str) -> Result<Option<Duration>, Box<dyn Error>>;
+    fn find_location(&self, user: i32) -> Result<Option<Location>, Box<dyn Error>>;
+    fn set_location(&self, user: i32, location: &Location, timeout: u64) -> Result<(), Box<dyn Error>>;
+    fn find_countries(&self, user: i32) -> Result<Vec<String>, Box<dyn Error>>;
+    // adds the country into these the user has logged in from, all of them being forgotten once the timeout is over
+    // since the last one got added
+    fn add_country(&self, user: i32, country: &str, timeout: u64) -> Result<(), Box<dyn Error>>;
+}
+
+pub trait GeoLocator {
+    // returns the origin of the given address, with as many details as known about it
+    fn locate(&self, ip: &str) -> Result<Origin, Box<dyn Error>>;
+}
+
+pub trait RiskScorer {
+    // scores the risk of the login described by the given context, from 0 (none at all) to 100 (certainly an attack)
+    fn score(&self, context: &RiskContext) -> Result<u8, Box<dyn Error>>;
+}
+
+/// The place a request comes from, as located by the proxy in front of the service
+#[derive(Clone, PartialEq, Debug)]
+pub struct Location {
+    pub(super) latitude: f64,
+    pub(super) longitude: f64,
+    pub(super) seen_at: SystemTime,
+}
+
+impl Location {
+    pub fn new(latitude: f64, longitude: f64) -> Result<Self, Box<dyn Error>> {
+        if !(-90.0..=90.0).contains(&latitude) || !(-180.0..=180.0).contains(&longitude) {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(Location {
+            latitude: latitude,
+            longitude: longitude,
+            seen_at: time::now(),
+        })
+    }
+
+    /// Returns the great-circle distance, in kilometers, to the other location
+    pub fn distance_to(&self, other: &Location) -> f64 {
+        let (lat_a, lat_b) = (self.latitude.to_radians(), other.latitude.to_radians());
+        let delta_lat = lat_b - lat_a;
+        let delta_lon = (other.longitude - self.longitude).to_radians();
+
+        let a = (delta_lat / 2.0).sin().powi(2) + lat_a.cos() * lat_b.cos() * (delta_lon / 2.0).sin().powi(2);
+        2.0 * EARTH_RADIUS * a.sqrt().asin()
+    }
+
+    /// Returns the speed, in kilometers per hour, required to travel from the previous location to this one in time.
+    /// Locations seen at the same time are one minute apart at least, so a proxy placing the same user at two close
+    /// cities does not look like an impossible travel
+    pub fn speed_from(&self, previous: &Location) -> f64 {
+        let elapsed = self.seen_at.duration_since(previous.seen_at).unwrap_or_default().as_secs_f64();
+        self.distance_to(previous) / (elapsed.max(60.0) / 3600.0)
+    }
+}
+
+/// Who a request comes from
+#[derive(Clone, Default, Debug)]
+pub struct Origin {
+    pub(super) ip: String,
+    pub(super) location: Option<Location>,
+    pub(super) country: Option<String>, // as an ISO 3166-1 alpha-2 code
+}
+
+impl Origin {
+    pub fn new(ip: &str, location: Option<Location>, country: Option<&str>) -> Self {
+        Origin {
+            ip: ip.to_string(),
+            location: location,
+            country: country.map(|country| country.to_uppercase()),
+        }
+    }
+
+    pub fn get_ip(&self) -> &str {
+        &self.ip
+    }
+
+    pub fn get_location(&self) -> Option<&Location> {
+        self.location.as_ref()
+    }
+
+    pub fn get_country(&self) -> Option<&str> {
+        self.country.as_deref()
+    }
+}
+
+/// All the anomalies a login may show despite its credentials being alright
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Anomaly {
+    NewCountry,       // the user has never logged in from that country recently
+    ImpossibleTravel, // the user could not have travelled from the previous login in time
+}
+
+impl Anomaly {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Anomaly::NewCountry => "new country",
+            Anomaly::ImpossibleTravel => "impossible travel",
+        }
+    }
+}
+
+/// All the reactions a risky login may trigger, from the mildest to the strictest one
+#[derive(Clone, Copy, PartialEq, PartialOrd, Debug)]
+pub enum Reaction {
+    Ignore,  // the login goes on as usual
+    Notify,  // the user gets notified about the login
+    Captcha, // the user must solve a captcha
+    Mfa,     // the user must provide its totp, even from a trusted device, or else solve a captcha
+    Deny,    // the login is not allowed
+}
+
+impl Reaction {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Reaction::Ignore => "ignore",
+            Reaction::Notify => "notify",
+            Reaction::Captcha => "captcha",
+            Reaction::Mfa => "mfa",
+            Reaction::Deny => "deny",
+        }
+    }
+
+    pub fn from_str(reaction: &str) -> Option<Self> {
+        match reaction {
+            "ignore" => Some(Reaction::Ignore),
+            "notify" => Some(Reaction::Notify),
+            "captcha" => Some(Reaction::Captcha),
+            "mfa" => Some(Reaction::Mfa),
+            "deny" => Some(Reaction::Deny),
+            _ => None,
+        }
+    }
+
+    /// Returns the reaction the given risk score drives, given the scores from which the mfa is required and the login
+    /// denied
+    pub fn from_score(score: u8, mfa_score: u8, deny_score: u8) -> Self {
+        if score >= deny_score {
+            Reaction::Deny
+        } else if score >= mfa_score {
+            Reaction::Mfa
+        } else {
+            Reaction::Ignore
+        }
+    }
+}
+
+/// The outcome of assessing a login: the strictest reaction required by the anomalies it shows, if any, or by its
+/// risk score
+#[derive(Clone, Debug)]
+pub struct Assessment {
+    pub(super) reaction: Reaction,
+    pub(super) anomalies: Vec<Anomaly>,
+    pub(super) score: u8,
+}
+
+impl Assessment {
+    pub fn new() -> Self {
+        Assessment {
+            reaction: Reaction::Ignore,
+            anomalies: Vec::new(),
+            score: 0,
+        }
+    }
+
+    /// Raises the reaction to the given one if it is a stricter one
+    pub fn raise(&mut self, reaction: Reaction) {
+        if reaction > self.reaction {
+            self.reaction = reaction;
+        }
+    }
+
+    pub fn add_anomaly(&mut self, anomaly: Anomaly, reaction: Reaction) {
+        self.anomalies.push(anomaly);
+        self.raise(reaction);
+    }
+
+    pub fn get_reaction(&self) -> Reaction {
+        self.reaction
+    }
+
+    pub fn get_anomalies(&self) -> &[Anomaly] {
+        &self.anomalies
+    }
+
+    /// Sets the risk score of the login, raising the reaction to the one it drives
+    pub fn set_score(&mut self, score: u8, reaction: Reaction) {
+        self.score = score;
+        self.raise(reaction);
+    }
+
+    pub fn get_score(&self) -> u8 {
+        self.score
+    }
+
+    /// Returns true if, and only if, the user must be notified about the login
+    pub fn must_notify(&self) -> bool {
+        self.anomalies.len() > 0 && self.reaction != Reaction::Ignore
+    }
+}
+
+/// The limits beyond which login attempts are considered an attack
+#[derive(Clone, Debug)]
+pub struct Thresholds {
+    pub(super) accounts_per_ip: usize,  // distinct accounts failing from the same ip
+    pub(super) ips_per_account: usize,  // distinct ips failing on the same account
+    pub(super) window: u64,             // time in seconds failures are counted for
+    pub(super) throttle_timeout: u64,   // time in seconds an ip or account is throttled for
+    pub(super) travel_speed: f64,       // km/h beyond which a travel is impossible
+    pub(super) risky_failures: usize,   // distinct failures on the ip or account making a login risky
+}
+
+/// All the providers logins may be scored by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Provider {
+    Heuristic,
+    Http,
+    Grpc,
+}
+
+impl Provider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Provider::Heuristic => "heuristic",
+            Provider::Http => "http",
+            Provider::Grpc => "grpc",
+        }
+    }
+
+    pub fn from_str(provider: &str) -> Option<Self> {
+        match provider {
+            "heuristic" => Some(Provider::Heuristic),
+            "http" => Some(Provider::Http),
+            "grpc" => Some(Provider::Grpc),
+            _ => None,
+        }
+    }
+}
+
+/// Everything known about a login by the time it gets scored, its credentials being alright
+#[derive(Clone, Debug)]
+pub struct RiskContext {
+    pub(super) tenant: i32,
+    pub(super) user: i32,
+    pub(super) ip: String,
+    pub(super) country: Option<String>,
+    pub(super) travel_speed: Option<f64>,   // km/h from the location of the previous login, if both are known
+    pub(super) device_trusted: Option<bool>, // none if the login comes from no device
+    pub(super) failures: usize,             // the most distinct failures recorded on either the ip or the account
+    pub(super) known_countries: usize,      // the countries the user has logged in from recently
+    pub(super) anomalies: Vec<Anomaly>,
+}
+
+impl RiskContext {
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_ip(&self) -> &str {
+        &self.ip
+    }
+
+    pub fn get_country(&self) -> Option<&str> {
+        self.country.as_deref()
+    }
+
+    pub fn get_travel_speed(&self) -> Option<f64> {
+        self.travel_speed
+    }
+
+    pub fn is_device_trusted(&self) -> Option<bool> {
+        self.device_trusted
+    }
+
+    pub fn get_failures(&self) -> usize {
+        self.failures
+    }
+
+    pub fn get_known_countries(&self) -> usize {
+        self.known_countries
+    }
+
+    pub fn get_anomalies(&self) -> &[Anomaly] {
+        &self.anomalies
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::Duration;
+    use super::{Location, Origin, Anomaly, Reaction, Assessment, Provider};
+
+    #[test]
+    fn location_new_should_fail() {
+        assert!(Location::new(90.1, 0.0).is_err());
+        assert!(Location::new(0.0, -180.1).is_err());
+        assert!(Location::new(41.38, 2.17).is_ok());
+    }
+
+    #[test]
+    fn location_distance_should_not_fail() {
+        let barcelona = Location::new(41.3874, 2.1686).unwrap();
+        let new_york = Location::new(40.7128, -74.0060).unwrap();
+
+        let distance = barcelona.distance_to(&new_york);
+        assert!(distance > 6100.0 && distance < 6200.0, "distance is {}", distance);
+        assert_eq!(0.0, barcelona.distance_to(&barcelona));
+    }
+
+    #[test]
+    fn location_speed_should_not_fail() {
+        let barcelona = Location::new(41.3874, 2.1686).unwrap();
+        let mut new_york = Location::new(40.7128, -74.0060).unwrap();
+
+        // an 8 hours flight is alright, while 1 hour is not
+        new_york.seen_at = barcelona.seen_at + Duration::from_secs(8 * 3600);
+        assert!(new_york.speed_from(&barcelona) < 1000.0);
+
+        new_york.seen_at = barcelona.seen_at + Duration::from_secs(3600);
+        assert!(new_york.speed_from(&barcelona) > 1000.0);
+    }
+
+    #[test]
+    fn origin_new_should_not_fail() {
+        let origin = Origin::new("10.0.0.1", None, Some("es"));
+        assert_eq!(Some("ES"), origin.get_country());
+        assert_eq!(None, Origin::new("10.0.0.1", None, None).get_country());
+    }
+
+    #[test]
+    fn assessment_raise_should_not_fail() {
+        let mut assessment = Assessment::new();
+        assert!(!assessment.must_notify());
+
+        assessment.raise(Reaction::Captcha);
+        assert!(!assessment.must_notify());
+
+        // the strictest reaction always wins
+        assessment.add_anomaly(Anomaly::NewCountry, Reaction::Notify);
+        assert_eq!(Reaction::Captcha, assessment.get_reaction());
+        assert!(assessment.must_notify());
+
+        assessment.add_anomaly(Anomaly::ImpossibleTravel, Reaction::Deny);
+        assert_eq!(Reaction::Deny, assessment.get_reaction());
+        assert_eq!(&[Anomaly::NewCountry, Anomaly::ImpossibleTravel], assessment.get_anomalies());
+    }
+
+    #[test]
+    fn assessment_set_score_should_not_fail() {
+        let mut assessment = Assessment::new();
+        assessment.raise(Reaction::Captcha);
+        assessment.set_score(20, Reaction::from_score(20, 60, 100));
+        assert_eq!(20, assessment.get_score());
+        assert_eq!(Reaction::Captcha, assessment.get_reaction());
+
+        assessment.set_score(60, Reaction::from_score(60, 60, 100));
+        assert_eq!(Reaction::Mfa, assessment.get_reaction());
+        assert_eq!(Reaction::Deny, Reaction::from_score(100, 60, 100));
+        assert!(!assessment.must_notify());
+    }
+
+    #[test]
+    fn provider_from_str_should_not_fail() {
+        for provider in &[Provider::Heuristic, Provider::Http, Provider::Grpc] {
+            assert_eq!(Some(*provider), Provider::from_str(provider.as_str()));
+        }
+
+        assert_eq!(None, Provider::from_str("unknown"));
+    }
+
+    #[test]
+    fn reaction_from_str_should_not_fail() {
+        for reaction in &[Reaction::Ignore, Reaction::Notify, Reaction::Captcha, Reaction::Mfa, Reaction::Deny] {
+            assert_eq!(Some(*reaction), Reaction::from_str(reaction.as_str()));
+        }
+
+        assert_eq!(None, Reaction::from_str("block"));
+    }
+}
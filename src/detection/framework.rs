@@ -0,0 +1,530 @@
+use std::error::Error;
+use std::net::IpAddr;
+use std::collections::{HashMap, HashSet};
+use std::sync::{Mutex, RwLock, RwLockWriteGuard};
+use std::time::{SystemTime, Duration, UNIX_EPOCH};
+use tonic::Request;
+use tonic::transport::{Channel, Endpoint};
+use tokio::runtime::Handle;
+use redis::{Commands, Script};
+use maxminddb::{geoip2, MaxMindDBError};
+use serde::{Serialize, Deserialize};
+
+use crate::cache;
+use crate::constants::{settings, errors};
+use crate::ratelimit::framework::get_ip;
+use crate::time;
+use super::get_thresholds;
+use super::domain::{Location, Origin, SignalRepository, GeoLocator, RiskScorer, RiskContext, Anomaly};
+
+// Import the generated rust code of the external scorers into module
+mod proto {
+    tonic::include_proto!("risk");
+}
+
+use proto::risk_scorer_client::RiskScorerClient;
+use proto::ScoreRequest;
+
+const SIGNAL_PREFIX: &str = "signal";
+const BLOCK_PREFIX: &str = "blocked";
+const LOCATION_PREFIX: &str = "location";
+const COUNTRIES_PREFIX: &str = "countries";
+
+// the set only expires once the window since its first member is over, so attempts spread over time still add up
+const ADD_DISTINCT_SCRIPT: &str = r#"
+redis.call('SADD', KEYS[1], ARGV[1])
+if redis.call('TTL', KEYS[1]) < 0 then
+    redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+return redis.call('SCARD', KEYS[1])
+"#;
+
+/// Returns the origin of the request: its ip and, as located by the geoip database, where it comes from. If the proxy
+/// has located the request as well, the location given by the "x-geo-latitude" and "x-geo-longitude" headers, as well
+/// as the country given by the "x-geo-country" one, are taken instead
+pub fn get_origin<T>(request: &Request<T>) -> Origin {
+    let header = |name: &str| -> Option<String> {
+        request.metadata().get(name)
+            .and_then(|value| value.to_str().ok())
+            .map(|value| value.trim().to_string())
+            .filter(|value| value.len() > 0)
+    };
+
+    let ip = get_ip(request).unwrap_or_default();
+    let mut origin = match super::get_locator().locate(&ip) {
+        Ok(origin) => origin,
+        Err(err) => {
+            error!("could not locate ip {}: {}", ip, err);
+            Origin::new(&ip, None, None)
+        }
+    };
+
+    let coordinate = |name: &str| header(name).and_then(|value| value.parse::<f64>().ok());
+    if let (Some(latitude), Some(longitude)) = (coordinate("x-geo-latitude"), coordinate("x-geo-longitude")) {
+        origin.location = Location::new(latitude, longitude).ok();
+    }
+
+    if let Some(country) = header("x-geo-country") {
+        origin.country = Some(country.to_uppercase());
+    }
+
+    origin
+}
+
+/// Locates addresses through a local MaxMind database, such as GeoLite2-City or GeoLite2-Country
+pub struct MaxMindGeoLocator {
+    reader: maxminddb::Reader<Vec<u8>>,
+}
+
+impl MaxMindGeoLocator {
+    pub fn new(path: &str) -> Result<Self, Box<dyn Error>> {
+        Ok(MaxMindGeoLocator {
+            reader: maxminddb::Reader::open_readfile(path)?,
+        })
+    }
+}
+
+impl GeoLocator for MaxMindGeoLocator {
+    fn locate(&self, ip: &str) -> Result<Origin, Box<dyn Error>> {
+        let addr: IpAddr = match ip.parse() {
+            Ok(addr) => addr,
+            Err(_) => return Ok(Origin::new(ip, None, None)),
+        };
+
+        let city: geoip2::City = match self.reader.lookup(addr) {
+            Ok(city) => city,
+            Err(MaxMindDBError::AddressNotFoundError(_)) => return Ok(Origin::new(ip, None, None)),
+            Err(err) => return Err(err.into()),
+        };
+
+        let location = city.location.and_then(|location| match (location.latitude, location.longitude) {
+            (Some(latitude), Some(longitude)) => Location::new(latitude, longitude).ok(),
+            _ => None,
+        });
+
+        let country = city.country.and_then(|country| country.iso_code);
+        Ok(Origin::new(ip, location, country))
+    }
+}
+
+/// Locates no address at all, so requests are only located by the proxy, if ever
+pub struct NoGeoLocator;
+
+impl GeoLocator for NoGeoLocator {
+    fn locate(&self, ip: &str) -> Result<Origin, Box<dyn Error>> {
+        Ok(Origin::new(ip, None, None))
+    }
+}
+
+pub struct InMemorySignalRepository {
+    sets: RwLock<HashMap<String, (HashSet<String>, SystemTime)>>,
+    blocks: RwLock<HashMap<String, SystemTime>>,
+    locations: RwLock<HashMap<i32, Location>>,
+    countries: RwLock<HashMap<i32, HashSet<String>>>,
+}
+
+impl InMemorySignalRepository {
+    pub fn new() -> Self {
+        InMemorySignalRepository {
+            sets: RwLock::new(HashMap::new()),
+            blocks: RwLock::new(HashMap::new()),
+            locations: RwLock::new(HashMap::new()),
+            countries: RwLock::new(HashMap::new()),
+        }
+    }
+
+    fn get_writable<'a, T>(lock: &'a RwLock<T>, name: &str) -> Result<RwLockWriteGuard<'a, T>, Box<dyn Error>> {
+        match lock.write() {
+            Ok(repo) => Ok(repo),
+            Err(err) => {
+                error!("read-write lock for {} from signal's repo got poisoned: {}", name, err);
+                Err(errors::POISONED.into())
+            }
+        }
+    }
+}
+
+impl SignalRepository for InMemorySignalRepository {
+    fn add_distinct(&self, key: &str, member: &str, window: u64) -> Result<usize, Box<dyn Error>> {
+        let mut sets = InMemorySignalRepository::get_writable(&self.sets, "sets")?;
+        let now = time::now();
+        if sets.len() >= settings::MAX_BUCKETS {
+            sets.retain(|_, (_, deadline)| *deadline > now);
+        }
+
+        let (set, deadline) = sets.entry(key.to_string())
+            .or_insert_with(|| (HashSet::new(), now + Duration::from_secs(window)));
+
+        if *deadline <= now {
+            set.clear();
+            *deadline = now + Duration::from_secs(window);
+        }
+
+        set.insert(member.to_string());
+        Ok(set.len())
+    }
+
+    fn count_distinct(&self, key: &str) -> Result<usize, Box<dyn Error>> {
+        let sets = InMemorySignalRepository::get_writable(&self.sets, "sets")?;
+        let now = time::now();
+        Ok(sets.get(key)
+            .filter(|(_, deadline)| *deadline > now)
+            .map(|(set, _)| set.len())
+            .unwrap_or(0))
+    }
+
+    fn block(&self, key: &str, timeout: u64) -> Result<(), Box<dyn Error>> {
+        let mut blocks = InMemorySignalRepository::get_writable(&self.blocks, "blocks")?;
+        let now = time::now();
+        blocks.retain(|_, deadline| *deadline > now);
+        blocks.insert(key.to_string(), now + Duration::from_secs(timeout));
+        Ok(())
+    }
+
+    fn blocked_for(&self, key: &str) -> Result<Option<Duration>, Box<dyn Error>> {
+        let blocks = InMemorySignalRepository::get_writable(&self.blocks, "blocks")?;
+        Ok(blocks.get(key).and_then(|deadline| deadline.duration_since(time::now()).ok()))
+    }
+
+    fn find_location(&self, user: i32) -> Result<Option<Location>, Box<dyn Error>> {
+        let locations = InMemorySignalRepository::get_writable(&self.locations, "locations")?;
+        Ok(locations.get(&user).cloned())
+    }
+
+    fn set_location(&self, user: i32, location: &Location, _: u64) -> Result<(), Box<dyn Error>> {
+        let mut locations = InMemorySignalRepository::get_writable(&self.locations, "locations")?;
+        locations.insert(user, location.clone());
+        Ok(())
+    }
+
+    fn find_countries(&self, user: i32) -> Result<Vec<String>, Box<dyn Error>> {
+        let countries = InMemorySignalRepository::get_writable(&self.countries, "countries")?;
+        Ok(countries.get(&user).map(|known| known.iter().cloned().collect()).unwrap_or_default())
+    }
+
+    fn add_country(&self, user: i32, country: &str, _: u64) -> Result<(), Box<dyn Error>> {
+        let mut countries = InMemorySignalRepository::get_writable(&self.countries, "countries")?;
+        countries.entry(user).or_insert_with(HashSet::new).insert(country.to_string());
+        Ok(())
+    }
+}
+
+pub struct RedisSignalRepository {
+    script: Script,
+}
+
+impl RedisSignalRepository {
+    pub fn new() -> Self {
+        RedisSignalRepository {
+            script: Script::new(ADD_DISTINCT_SCRIPT),
+        }
+    }
+}
+
+impl SignalRepository for RedisSignalRepository {
+    fn add_distinct(&self, key: &str, member: &str, window: u64) -> Result<usize, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let count: usize = self.script
+            .key(format!("{}:{}", SIGNAL_PREFIX, key))
+            .arg(member)
+            .arg(window)
+            .invoke(&mut *conn)?;
+
+        Ok(count)
+    }
+
+    fn count_distinct(&self, key: &str) -> Result<usize, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let count: usize = conn.scard(format!("{}:{}", SIGNAL_PREFIX, key))?;
+        Ok(count)
+    }
+
+    fn block(&self, key: &str, timeout: u64) -> Result<(), Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let _: () = conn.set_ex(format!("{}:{}", BLOCK_PREFIX, key), 1, timeout as usize)?;
+        Ok(())
+    }
+
+    fn blocked_for(&self, key: &str) -> Result<Option<Duration>, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        // negative when there is no such key, blocks always having a timeout
+        let ttl: i64 = conn.pttl(format!("{}:{}", BLOCK_PREFIX, key))?;
+        match ttl {
+            ttl if ttl > 0 => Ok(Some(Duration::from_millis(ttl as u64))),
+            _ => Ok(None),
+        }
+    }
+
+    fn find_location(&self, user: i32) -> Result<Option<Location>, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let raw: Option<String> = conn.get(format!("{}:{}", LOCATION_PREFIX, user))?;
+        let raw = match raw {
+            Some(raw) => raw,
+            None => return Ok(None),
+        };
+
+        let fields: Vec<f64> = raw.split(',').filter_map(|field| field.parse().ok()).collect();
+        if fields.len() != 3 {
+            return Ok(None);
+        }
+
+        Ok(Some(Location {
+            latitude: fields[0],
+            longitude: fields[1],
+            seen_at: UNIX_EPOCH + Duration::from_secs_f64(fields[2]),
+        }))
+    }
+
+    fn set_location(&self, user: i32, location: &Location, timeout: u64) -> Result<(), Box<dyn Error>> {
+        let seen_at = location.seen_at.duration_since(UNIX_EPOCH)?.as_secs_f64();
+        let raw = format!("{},{},{}", location.latitude, location.longitude, seen_at);
+
+        let mut conn = cache::get_connection()?;
+        let _: () = conn.set_ex(format!("{}:{}", LOCATION_PREFIX, user), raw, timeout as usize)?;
+        Ok(())
+    }
+
+    fn find_countries(&self, user: i32) -> Result<Vec<String>, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let countries: Vec<String> = conn.smembers(format!("{}:{}", COUNTRIES_PREFIX, user))?;
+        Ok(countries)
+    }
+
+    fn add_country(&self, user: i32, country: &str, timeout: u64) -> Result<(), Box<dyn Error>> {
+        let key = format!("{}:{}", COUNTRIES_PREFIX, user);
+        let mut conn = cache::get_connection()?;
+        let _: () = redis::pipe().atomic()
+            .sadd(&key, country).ignore()
+            .expire(&key, timeout as usize).ignore()
+            .query(&mut *conn)?;
+
+        Ok(())
+    }
+}
+
+// weights of the signals scored by the heuristic scorer, adding up to the max score
+const FAILURES_WEIGHT: u8 = 20;
+const NEW_COUNTRY_WEIGHT: u8 = 20;
+const IMPOSSIBLE_TRAVEL_WEIGHT: u8 = 40;
+const UNTRUSTED_DEVICE_WEIGHT: u8 = 20;
+
+/// Scores logins by adding up the weights of the signals they show: failing from the same ip or on the same account
+/// as often as making the login a risky one, coming from a new country or from too far away, and coming from a device
+/// that is not a trusted one
+pub struct HeuristicScorer;
+
+impl RiskScorer for HeuristicScorer {
+    fn score(&self, context: &RiskContext) -> Result<u8, Box<dyn Error>> {
+        let mut score = 0;
+        if context.get_failures() >= get_thresholds().risky_failures {
+            score += FAILURES_WEIGHT;
+        }
+
+        for anomaly in context.get_anomalies() {
+            score += match anomaly {
+                Anomaly::NewCountry => NEW_COUNTRY_WEIGHT,
+                Anomaly::ImpossibleTravel => IMPOSSIBLE_TRAVEL_WEIGHT,
+            };
+        }
+
+        if context.is_device_trusted() == Some(false) {
+            score += UNTRUSTED_DEVICE_WEIGHT;
+        }
+
+        Ok(score.min(100))
+    }
+}
+
+#[derive(Serialize)]
+struct HttpScoreRequest<'a> {
+    tenant: i32,
+    user: i32,
+    ip: &'a str,
+    country: Option<&'a str>,
+    travel_speed: Option<f64>,
+    device_trusted: Option<bool>,
+    failures: usize,
+    known_countries: usize,
+    anomalies: Vec<&'a str>,
+}
+
+#[derive(Deserialize, Debug)]
+struct HttpScoreResponse {
+    score: u8,
+}
+
+/// Scores logins by posting their context as json to an external scorer, which responds with the score
+pub struct HttpRiskScorer {
+    url: String,
+    agent: ureq::Agent,
+}
+
+impl HttpRiskScorer {
+    pub fn new(url: &str) -> Self {
+        HttpRiskScorer {
+            url: url.to_string(),
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(settings::RISK_SCORER_TIMEOUT))
+                .build(),
+        }
+    }
+}
+
+impl RiskScorer for HttpRiskScorer {
+    fn score(&self, context: &RiskContext) -> Result<u8, Box<dyn Error>> {
+        let request = HttpScoreRequest {
+            tenant: context.get_tenant(),
+            user: context.get_user(),
+            ip: context.get_ip(),
+            country: context.get_country(),
+            travel_speed: context.get_travel_speed(),
+            device_trusted: context.is_device_trusted(),
+            failures: context.get_failures(),
+            known_countries: context.get_known_countries(),
+            anomalies: context.get_anomalies().iter().map(|anomaly| anomaly.as_str()).collect(),
+        };
+
+        let response: HttpScoreResponse = self.agent.post(&self.url)
+            .send_json(serde_json::to_value(&request)?)?
+            .into_json()?;
+
+        Ok(response.score.min(100))
+    }
+}
+
+/// Scores logins by calling the Score method of the external scorer's RiskScorer service. The channel is opened by
+/// the first login being scored, since it requires the runtime
+pub struct GrpcRiskScorer {
+    url: String,
+    channel: Mutex<Option<Channel>>,
+}
+
+impl GrpcRiskScorer {
+    pub fn new(url: &str) -> Self {
+        GrpcRiskScorer {
+            url: url.to_string(),
+            channel: Mutex::new(None),
+        }
+    }
+
+    fn get_channel(&self) -> Result<Channel, Box<dyn Error>> {
+        let mut channel = match self.channel.lock() {
+            Ok(channel) => channel,
+            Err(err) => {
+                error!("lock for risk scorer channel got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        if let Some(channel) = channel.as_ref() {
+            return Ok(channel.clone());
+        }
+
+        let endpoint = Endpoint::from_shared(self.url.clone())?
+            .timeout(Duration::from_secs(settings::RISK_SCORER_TIMEOUT));
+
+        let lazy = endpoint.connect_lazy()?;
+        *channel = Some(lazy.clone());
+        Ok(lazy)
+    }
+}
+
+impl RiskScorer for GrpcRiskScorer {
+    fn score(&self, context: &RiskContext) -> Result<u8, Box<dyn Error>> {
+        let request = ScoreRequest {
+            tenant: context.get_tenant(),
+            user: context.get_user(),
+            ip: context.get_ip().to_string(),
+            country: context.get_country().unwrap_or_default().to_string(),
+            travel_speed: context.get_travel_speed().unwrap_or_default(),
+            has_device: context.is_device_trusted().is_some(),
+            device_trusted: context.is_device_trusted().unwrap_or_default(),
+            failures: context.get_failures() as u64,
+            known_countries: context.get_known_countries() as u64,
+            anomalies: context.get_anomalies().iter().map(|anomaly| anomaly.as_str().to_string()).collect(),
+        };
+
+        // logins are scored by synchronous transactions running on the runtime, so the worker thread gets handed over
+        // while waiting for the scorer
+        let mut client = RiskScorerClient::new(self.get_channel()?);
+        let response = tokio::task::block_in_place(|| Handle::current().block_on(client.score(request)))?;
+        Ok(response.into_inner().score.min(100) as u8)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::Duration;
+    use super::{InMemorySignalRepository, HeuristicScorer};
+    use super::super::domain::{Location, SignalRepository, RiskScorer, RiskContext, Anomaly};
+
+    #[test]
+    fn in_memory_add_distinct_should_not_fail() {
+        let repo = InMemorySignalRepository::new();
+        assert_eq!(1, repo.add_distinct("ip:127.0.0.1", "a@testing.com", 60).unwrap());
+        assert_eq!(1, repo.add_distinct("ip:127.0.0.1", "a@testing.com", 60).unwrap());
+        assert_eq!(2, repo.add_distinct("ip:127.0.0.1", "b@testing.com", 60).unwrap());
+        assert_eq!(1, repo.add_distinct("ip:127.0.0.2", "a@testing.com", 60).unwrap());
+        assert_eq!(2, repo.count_distinct("ip:127.0.0.1").unwrap());
+        assert_eq!(0, repo.count_distinct("ip:127.0.0.3").unwrap());
+    }
+
+    #[test]
+    fn in_memory_block_should_not_fail() {
+        let repo = InMemorySignalRepository::new();
+        assert!(repo.blocked_for("ip:127.0.0.1").unwrap().is_none());
+        repo.block("ip:127.0.0.1", 60).unwrap();
+
+        let left = repo.blocked_for("ip:127.0.0.1").unwrap().unwrap();
+        assert!(left > Duration::from_secs(59) && left <= Duration::from_secs(60));
+        assert!(repo.blocked_for("ip:127.0.0.2").unwrap().is_none());
+    }
+
+    #[test]
+    fn in_memory_location_should_not_fail() {
+        let repo = InMemorySignalRepository::new();
+        let location = Location::new(41.3874, 2.1686).unwrap();
+        assert_eq!(None, repo.find_location(1).unwrap());
+        repo.set_location(1, &location, 60).unwrap();
+        assert_eq!(Some(location), repo.find_location(1).unwrap());
+    }
+
+    #[test]
+    fn in_memory_countries_should_not_fail() {
+        let repo = InMemorySignalRepository::new();
+        assert!(repo.find_countries(1).unwrap().is_empty());
+        repo.add_country(1, "ES", 60).unwrap();
+        repo.add_country(1, "ES", 60).unwrap();
+        assert_eq!(vec!["ES".to_string()], repo.find_countries(1).unwrap());
+        assert!(repo.find_countries(2).unwrap().is_empty());
+    }
+
+    #[test]
+    fn heuristic_scorer_should_not_fail() {
+        let mut context = RiskContext {
+            tenant: 1,
+            user: 1,
+            ip: "127.0.0.1".to_string(),
+            country: None,
+            travel_speed: None,
+            device_trusted: None,
+            failures: 0,
+            known_countries: 0,
+            anomalies: Vec::new(),
+        };
+
+        assert_eq!(0, HeuristicScorer.score(&context).unwrap());
+
+        context.device_trusted = Some(true);
+        assert_eq!(0, HeuristicScorer.score(&context).unwrap());
+
+        context.device_trusted = Some(false);
+        context.anomalies = vec![Anomaly::ImpossibleTravel];
+        assert_eq!(60, HeuristicScorer.score(&context).unwrap());
+
+        context.failures = super::get_thresholds().risky_failures;
+        context.anomalies.push(Anomaly::NewCountry);
+        assert_eq!(100, HeuristicScorer.score(&context).unwrap());
+    }
+}
@@ -0,0 +1,111 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::error::Error;
+use std::sync::{Arc, RwLock};
+use crate::storage::{self, Backend};
+use crate::constants::{environment, settings};
+use crate::config;
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::SignalRepository + Sync + Send> = {
+        // signals are as volatile as sessions, so they are kept by the same backend
+        match storage::get_session_backend() {
+            Backend::Memory => Box::new(framework::InMemorySignalRepository::new()),
+            Backend::Redis => Box::new(framework::RedisSignalRepository::new()),
+            backend => storage::unsupported(backend, "signals"),
+        }
+    };
+
+    static ref LOCATOR_PROVIDER: Box<dyn domain::GeoLocator + Sync + Send> = {
+        match config::get(environment::GEOIP_DATABASE) {
+            Err(_) => Box::new(framework::NoGeoLocator),
+            Ok(path) => Box::new(framework::MaxMindGeoLocator::new(&path).expect("geoip database must be readable")),
+        }
+    };
+
+    static ref SCORER_PROVIDER: Box<dyn domain::RiskScorer + Sync + Send> = {
+        let provider = config::get(environment::RISK_SCORER)
+            .map(|provider| domain::Provider::from_str(&provider)
+                .expect("risk scorer must be one of heuristic, http or grpc"))
+            .unwrap_or(domain::Provider::Heuristic);
+
+        match provider {
+            domain::Provider::Heuristic => Box::new(framework::HeuristicScorer),
+            domain::Provider::Http => {
+                let url = config::get(environment::RISK_SCORER_URL).expect("risk scorer url must be set");
+                Box::new(framework::HttpRiskScorer::new(&url))
+            },
+            domain::Provider::Grpc => {
+                let url = config::get(environment::RISK_SCORER_URL).expect("risk scorer url must be set");
+                Box::new(framework::GrpcRiskScorer::new(&url))
+            },
+        }
+    };
+
+    static ref THRESHOLDS: RwLock<Arc<domain::Thresholds>> = {
+        let reload = || match load_thresholds() {
+            Ok(thresholds) => match THRESHOLDS.write() {
+                Ok(mut current) => *current = Arc::new(thresholds),
+                Err(err) => error!("write lock for detection thresholds got poisoned: {}", err),
+            },
+            Err(err) => error!("detection thresholds could not be reloaded, the current ones are kept: {}", err),
+        };
+
+        for name in THRESHOLD_SETTINGS {
+            config::on_change(name, reload);
+        }
+
+        RwLock::new(Arc::new(load_thresholds().unwrap_or_else(|err| panic!("{}", err))))
+    };
+}
+
+const THRESHOLD_SETTINGS: &[&str] = &[
+    environment::ACCOUNTS_PER_IP,
+    environment::IPS_PER_ACCOUNT,
+    environment::DETECTION_WINDOW,
+    environment::THROTTLE_TIMEOUT,
+    environment::TRAVEL_SPEED,
+    environment::RISKY_FAILURES,
+];
+
+fn load_thresholds() -> Result<domain::Thresholds, Box<dyn Error>> {
+    fn threshold<T: std::str::FromStr>(name: &str, default: T) -> Result<T, Box<dyn Error>> {
+        match config::get(name) {
+            Ok(value) => value.parse().map_err(|_| format!("{} must be a number", name).into()),
+            Err(_) => Ok(default),
+        }
+    }
+
+    Ok(domain::Thresholds {
+        accounts_per_ip: threshold(environment::ACCOUNTS_PER_IP, settings::ACCOUNTS_PER_IP)?,
+        ips_per_account: threshold(environment::IPS_PER_ACCOUNT, settings::IPS_PER_ACCOUNT)?,
+        window: threshold(environment::DETECTION_WINDOW, settings::DETECTION_WINDOW)?,
+        throttle_timeout: threshold(environment::THROTTLE_TIMEOUT, settings::THROTTLE_TIMEOUT)?,
+        travel_speed: threshold(environment::TRAVEL_SPEED, settings::TRAVEL_SPEED)?,
+        risky_failures: threshold(environment::RISKY_FAILURES, settings::RISKY_FAILURES)?,
+    })
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::SignalRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
+
+pub fn get_locator() -> Box<&'static dyn domain::GeoLocator> {
+    Box::new(&**LOCATOR_PROVIDER)
+}
+
+pub fn get_scorer() -> Box<&'static dyn domain::RiskScorer> {
+    Box::new(&**SCORER_PROVIDER)
+}
+
+pub fn get_thresholds() -> Arc<domain::Thresholds> {
+    match THRESHOLDS.read() {
+        Ok(thresholds) => Arc::clone(&thresholds),
+        Err(err) => {
+            error!("read lock for detection thresholds got poisoned: {}", err);
+            panic!("{}", err);
+        }
+    }
+}
@@ -0,0 +1,200 @@
+use std::error::Error;
+use std::time::{Duration, UNIX_EPOCH};
+use std::sync::{Arc, RwLock, RwLockReadGuard};
+use crate::security;
+use crate::smtp;
+use crate::constants::{errors, settings};
+use crate::pagination::Page;
+use crate::metadata::domain::Metadata;
+use crate::app::domain::Branding;
+use crate::user::{
+    application::user_require_reset,
+    domain::User,
+};
+use crate::session::{
+    application as sess_application,
+    get_repository as get_sess_repository,
+    domain::{Session, LogoutCause, LogoutReason},
+};
+use crate::audit::{
+    application::audit_record,
+    domain::EventKind,
+};
+use super::{
+    get_repository as get_device_repository,
+    domain::{Device, DisownToken},
+};
+
+fn get_readable_session(sess_arc: &Arc<RwLock<Session>>) -> Result<RwLockReadGuard<Session>, Box<dyn Error>> {
+    match sess_arc.read() {
+        Ok(sess) => Ok(sess),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
+
+/// Returns the device of the provided user with the given fingerprint, registering it if it is the first time the
+/// user logs in from it. Returns true as well if, and only if, the device has just been registered, in which case the
+/// user gets notified, on behalf of the app with the given branding if any, unless it is the very first device of the
+/// user
+pub fn device_register(user: &User,
+                       fingerprint: &str,
+                       name: &str,
+                       branding: Option<&Branding>) -> Result<(Device, bool), Box<dyn Error>> {
+
+    if let Ok(mut device) = get_device_repository().find_by_user_and_fingerprint(user.get_id(), fingerprint) {
+        device.touch();
+        get_device_repository().save(&device)?;
+        return Ok((device, false));
+    }
+
+    let known = get_device_repository().find_all_by_user(user.get_id())?.len();
+    let meta = Metadata::new();
+    let mut device = Device::new(meta, user, fingerprint, name)?;
+    get_device_repository().create(&mut device)?;
+
+    if known > 0 {
+        // a failing notification must not prevent the user from logging in
+        if let Err(err) = device_notify(user, &device, branding) {
+            warn!("could not notify user {} about device {}: {}", user.get_id(), device.get_id(), err);
+        }
+    }
+
+    Ok((device, true))
+}
+
+/// Notifies the owner of the provided device about a login from it, including a token to disown the device if the
+/// login was not made by the user
+fn device_notify(user: &User, device: &Device, branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let claim = DisownToken::new(device, Duration::from_secs(settings::DISOWN_TIMEOUT));
+    let token = security::encode_jwt(claim)?;
+    smtp::send_new_device_notification(user.get_tenant(), user.get_locale(), user.get_email(), device.get_name(), &token,
+                                       branding)
+}
+
+/// If, and only if, the provided disown token is valid, the device gets removed and its owner forced to reset its
+/// password and logged out everywhere, as the policy tells for compromises, since its credentials are likely to be
+/// compromised
+pub fn device_disown(token: &str) -> Result<(), Box<dyn Error>> {
+    info!("got a disown device request");
+    let claim = security::decode_jwt::<DisownToken>(token)?;
+
+    let device = get_device_repository().find(claim.device)?;
+    if device.get_user() != claim.sub {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    get_device_repository().delete(&device)?;
+    user_require_reset(claim.sub, Some(LogoutCause::Compromise))?;
+
+    audit_record(claim.sub, claim.sub, EventKind::Disown, &format!("device {} disowned", device.get_name()));
+    Ok(())
+}
+
+/// If, and only if, the provided token is valid, returns all the devices of the session's owner
+pub fn device_list(token: &str) -> Result<Vec<Device>, Box<dyn Error>> {
+    info!("got a list devices request");
+    let claim = sess_application::decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = get_readable_session(&sess_arc)?.get_user()?.get_id();
+    get_device_repository().find_all_by_user(user_id)
+}
+
+// returns the position of the given device in the list of devices, sorted from the most to the least recently seen
+fn device_cursor(device: &Device) -> (u128, i32) {
+    let last_seen = device.get_last_seen_at()
+        .duration_since(UNIX_EPOCH)
+        .map(|elapsed| elapsed.as_nanos())
+        .unwrap_or_default();
+
+    (last_seen, device.get_id())
+}
+
+/// If, and only if, the provided token is valid, returns the given page of the devices of the session's owner, from the
+/// most to the least recently seen, and the token of the next page, if any. Devices seen at the very same time are
+/// sorted by id, so no device is skipped nor repeated across pages
+pub fn device_list_page(token: &str, page: &Page) -> Result<(Vec<Device>, String), Box<dyn Error>> {
+    let cursor = match page.get_cursor() {
+        "" => None,
+        cursor => {
+            let mut parts = cursor.splitn(2, ':');
+            match (parts.next().map(str::parse::<u128>), parts.next().map(str::parse::<i32>)) {
+                (Some(Ok(last_seen)), Some(Ok(id))) => Some((last_seen, id)),
+                _ => return Err(errors::INVALID_PAGE_TOKEN.into()),
+            }
+        },
+    };
+
+    let mut devices: Vec<Device> = device_list(token)?
+        .into_iter()
+        .filter(|device| cursor.map(|cursor| device_cursor(device) < cursor).unwrap_or(true))
+        .take(page.get_limit() as usize)
+        .collect();
+
+    let next = page.next_token(&mut devices, |device| {
+        let (last_seen, id) = device_cursor(device);
+        format!("{}:{}", last_seen, id)
+    });
+
+    Ok((devices, next))
+}
+
+/// Returns the device of the given user with the provided fingerprint, if any
+pub fn device_find(user: &User, fingerprint: &str) -> Result<Device, Box<dyn Error>> {
+    get_device_repository().find_by_user_and_fingerprint(user.get_id(), fingerprint)
+}
+
+/// If, and only if, the provided token is valid, its session is elevated and the device belongs to the session's
+/// owner, the device gets trusted, so no MFA code is required when logging in from it
+pub fn device_trust(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a trust device request");
+    let claim = sess_application::decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = {
+        let sess = get_readable_session(&sess_arc)?;
+        if !sess.is_elevated() {
+            return Err(errors::ELEVATION_REQUIRED.into());
+        }
+
+        sess.get_user()?.get_id()
+    };
+
+    let mut device = get_device_repository().find(id)?;
+    if device.get_user() != user_id {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    device.trust()?;
+    get_device_repository().save(&device)?;
+
+    audit_record(user_id, user_id, EventKind::MfaUpdate, &format!("device {} trusted", device.get_name()));
+    Ok(())
+}
+
+/// If, and only if, the provided token is valid and the device belongs to the session's owner, the device gets removed.
+/// Every session of the user that has been used from that device gets revoked as well, whichever app it is partitioned
+/// to, while the rest of them stay open
+pub fn device_revoke(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a revoke device request");
+    let claim = sess_application::decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let (user_id, tenant, email) = { // block is required because of lock release
+        let sess = get_readable_session(&sess_arc)?;
+        let user = sess.get_user()?;
+        (user.get_id(), user.get_tenant(), user.get_email().to_string())
+    };
+
+    let device = get_device_repository().find(id)?;
+    if device.get_user() != user_id {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    get_device_repository().delete(&device)?;
+    sess_application::session_revoke_by_device(tenant, &email, id, LogoutReason::User)?;
+    Ok(())
+}
\ No newline at end of file
@@ -0,0 +1,207 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::metadata::domain::Metadata;
+use crate::user::domain::User;
+use crate::time::{self, unix_timestamp};
+use crate::security::TokenKind;
+
+pub trait DeviceRepository {
+    fn find(&self, id: i32) -> Result<Device, Box<dyn Error>>;
+    fn find_by_user_and_fingerprint(&self, user_id: i32, fingerprint: &str) -> Result<Device, Box<dyn Error>>;
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<Device>, Box<dyn Error>>;
+    fn create(&self, device: &mut Device) -> Result<(), Box<dyn Error>>;
+    fn save(&self, device: &Device) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, device: &Device) -> Result<(), Box<dyn Error>>;
+}
+
+#[derive(Clone)]
+pub struct Device {
+    pub(super) id: i32,
+    pub(super) user: i32,
+    pub(super) fingerprint: String, // as provided by the client
+    pub(super) name: String,        // friendly name given by the user
+    pub(super) trusted_at: Option<SystemTime>,
+    pub(super) last_seen_at: SystemTime,
+    pub(super) meta: Metadata,
+}
+
+impl Device {
+    pub fn new(meta: Metadata,
+               user: &User,
+               fingerprint: &str,
+               name: &str) -> Result<Self, Box<dyn Error>> {
+
+        if fingerprint.len() == 0 {
+            return Err("fingerprint required".into());
+        }
+
+        let device = Device {
+            id: 0,
+            user: user.get_id(),
+            fingerprint: fingerprint.to_string(),
+            name: name.to_string(),
+            trusted_at: None,
+            last_seen_at: time::now(),
+            meta: meta,
+        };
+
+        Ok(device)
+    }
+
+    /// sets the current time as the last time the device has been seen
+    pub(super) fn touch(&mut self) {
+        self.last_seen_at = time::now();
+        self.meta.touch();
+    }
+
+    /// if the device was not trusted before, sets the current time as its trusting time
+    pub(super) fn trust(&mut self) -> Result<(), Box<dyn Error>> {
+        if self.trusted_at.is_some() {
+            return Err("already trusted".into());
+        }
+
+        self.trusted_at = Some(time::now());
+        self.meta.touch();
+        Ok(())
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn get_last_seen_at(&self) -> SystemTime {
+        self.last_seen_at
+    }
+
+    /// if true, the user does not need to provide the MFA code when logging in from this device, else it does
+    pub fn is_trusted(&self) -> bool {
+        self.trusted_at.is_some()
+    }
+}
+
+
+// token for disowning a device the user did not log in from
+#[derive(Serialize, Deserialize)]
+pub struct DisownToken {
+    pub(super) exp: usize,          // expiration time (as UTC timestamp) - required
+    pub(super) iat: SystemTime,     // issued at: creation time
+    pub(super) iss: String,         // issuer
+    pub(super) sub: i32,            // subject: the user id
+    pub(super) device: i32,         // the device to disown
+}
+
+impl TokenKind for DisownToken {
+    const KIND: &'static str = "disown+jwt";
+}
+
+impl DisownToken {
+    pub fn new(device: &Device, timeout: Duration) -> Self {
+        DisownToken {
+            exp: unix_timestamp(time::now() + timeout),
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: device.user,
+            device: device.id,
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use crate::metadata::domain::tests::new_metadata;
+    use crate::user::domain::tests::new_user;
+    use crate::time::unix_timestamp;
+    use super::{Device, DisownToken};
+
+    pub fn new_device() -> Device {
+        Device{
+            id: 999,
+            user: 999,
+            fingerprint: "testing".to_string(),
+            name: "testing".to_string(),
+            trusted_at: None,
+            last_seen_at: SystemTime::now(),
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn device_new_should_not_fail() {
+        let user = new_user();
+
+        let before = SystemTime::now();
+        let device = Device::new(new_metadata(), &user, "fingerprint", "laptop").unwrap();
+        let after = SystemTime::now();
+
+        assert_eq!(device.id, 0);
+        assert_eq!(device.user, user.get_id());
+        assert_eq!(device.fingerprint, "fingerprint");
+        assert_eq!(device.name, "laptop");
+        assert!(!device.is_trusted());
+        assert!(device.last_seen_at >= before && device.last_seen_at <= after);
+    }
+
+    #[test]
+    fn device_new_without_fingerprint_should_fail() {
+        let user = new_user();
+        assert!(Device::new(new_metadata(), &user, "", "laptop").is_err());
+    }
+
+    #[test]
+    fn device_trust_should_not_fail() {
+        let mut device = new_device();
+
+        let before = SystemTime::now();
+        device.trust().unwrap();
+        let after = SystemTime::now();
+
+        assert!(device.is_trusted());
+        let time = device.trusted_at.unwrap();
+        assert!(time >= before && time <= after);
+    }
+
+    #[test]
+    fn device_trust_should_fail() {
+        let mut device = new_device();
+        device.trust().unwrap();
+        assert!(device.trust().is_err());
+    }
+
+    #[test]
+    fn device_touch_should_not_fail() {
+        let mut device = new_device();
+
+        let before = SystemTime::now();
+        device.touch();
+        let after = SystemTime::now();
+
+        assert!(device.last_seen_at >= before && device.last_seen_at <= after);
+    }
+
+    #[test]
+    fn disown_token_should_not_fail() {
+        let device = new_device();
+        let timeout = Duration::from_secs(60);
+
+        let before = SystemTime::now();
+        let claim = DisownToken::new(&device, timeout);
+        let after = SystemTime::now();
+
+        assert!(claim.iat >= before && claim.iat <= after);
+        assert!(claim.exp >= unix_timestamp(before + timeout));
+        assert!(claim.exp <= unix_timestamp(after + timeout));
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!(device.user, claim.sub);
+        assert_eq!(device.id, claim.device);
+    }
+}
\ No newline at end of file
@@ -0,0 +1,335 @@
+use std::error::Error;
+use std::time::SystemTime;
+use tonic::{Request, Response, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::schema::devices::dsl::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::devices;
+use crate::time::unix_timestamp;
+use crate::pagination::Page;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use super::domain::{Device, DeviceRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("device");
+}
+
+// Proto generated server traits
+use proto::device_service_server::DeviceService;
+pub use proto::device_service_server::DeviceServiceServer;
+
+// Proto message structs
+use proto::{DeviceRequest, ListDevicesRequest, DeviceList, Device as ProtoDevice};
+
+pub struct DeviceServiceImplementation;
+
+#[tonic::async_trait]
+impl DeviceService for DeviceServiceImplementation {
+    async fn list_devices(&self, request: Request<ListDevicesRequest>) -> Result<Response<DeviceList>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        let msg_ref = request.get_ref();
+        let page = match Page::new("devices", msg_ref.page_size, &msg_ref.page_token) {
+            Err(err) => return Err(Status::invalid_argument(err.to_string())),
+            Ok(page) => page,
+        };
+
+        match super::application::device_list_page(token, &page) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((all_devices, next_page_token)) => Ok(Response::new(
+                DeviceList{
+                    devices: all_devices.iter().map(|device| ProtoDevice{
+                        id: device.get_id(),
+                        name: device.get_name().to_string(),
+                        trusted: device.is_trusted(),
+                        last_seen_at: unix_timestamp(device.get_last_seen_at()) as u64,
+                    }).collect(),
+                    next_page_token: next_page_token,
+                }
+            )),
+        }
+    }
+
+    async fn trust_device(&self, request: Request<DeviceRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::device_trust(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn revoke_device(&self, request: Request<DeviceRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::device_revoke(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn disown_device(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        if let Err(err) = super::application::device_disown(token) {
+            return Err(Status::aborted(err.to_string()));
+        }
+
+        Ok(Response::new(()))
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[changeset_options(treat_none_as_null = "true")]
+#[table_name = "devices"]
+struct PostgresDevice {
+    pub id: i32,
+    pub user_id: i32,
+    pub fingerprint: String,
+    pub name: String,
+    pub trusted_at: Option<SystemTime>,
+    pub last_seen_at: SystemTime,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "devices"]
+struct NewPostgresDevice<'a> {
+    pub user_id: i32,
+    pub fingerprint: &'a str,
+    pub name: &'a str,
+    pub trusted_at: Option<SystemTime>,
+    pub last_seen_at: SystemTime,
+    pub meta_id: i32,
+}
+
+pub struct PostgresDeviceRepository;
+
+impl PostgresDeviceRepository {
+    fn create_on_conn(conn: &PgConnection, device: &mut Device) -> Result<(), PgError>  {
+        // in order to create a device it must exists the metadata for this device
+        PostgresMetadataRepository::create_on_conn(conn, &mut device.meta)?;
+
+        let new_device = NewPostgresDevice {
+            user_id: device.user,
+            fingerprint: &device.fingerprint,
+            name: &device.name,
+            trusted_at: device.trusted_at,
+            last_seen_at: device.last_seen_at,
+            meta_id: device.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(devices::table)
+            .values(&new_device)
+            .get_result::<PostgresDevice>(conn)?;
+
+        device.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, device: &Device) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            devices.filter(id.eq(device.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &device.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresDevice) -> Result<Device, Box<dyn Error>> {
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(Device{
+            id: result.id,
+            user: result.user_id,
+            fingerprint: result.fingerprint.clone(),
+            name: result.name.clone(),
+            trusted_at: result.trusted_at,
+            last_seen_at: result.last_seen_at,
+            meta: meta,
+        })
+    }
+
+    fn build_first(results: &[PostgresDevice]) -> Result<Device, Box<dyn Error>> {
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresDeviceRepository::build(&results[0])
+    }
+}
+
+impl DeviceRepository for PostgresDeviceRepository {
+    fn find(&self, target: i32) -> Result<Device, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            devices.filter(id.eq(target))
+                   .load::<PostgresDevice>(&connection)?
+        };
+    
+        PostgresDeviceRepository::build_first(&results)
+    }
+
+    fn find_by_user_and_fingerprint(&self, target_user: i32, target: &str) -> Result<Device, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            devices.filter(user_id.eq(target_user))
+                   .filter(fingerprint.eq(target))
+                   .load::<PostgresDevice>(&connection)?
+        };
+    
+        PostgresDeviceRepository::build_first(&results)
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Device>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            devices.filter(user_id.eq(target_user))
+                   .order((last_seen_at.desc(), id.desc()))
+                   .load::<PostgresDevice>(&connection)?
+        };
+
+        let mut all_devices = Vec::new();
+        for result in results.iter() {
+            all_devices.push(PostgresDeviceRepository::build(result)?);
+        }
+
+        Ok(all_devices)
+    }
+
+    fn create(&self, device: &mut Device) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresDeviceRepository::create_on_conn(&conn, device))?;
+        Ok(())
+    }
+
+    fn save(&self, device: &Device) -> Result<(), Box<dyn Error>> {
+        let pg_device = PostgresDevice {
+            id: device.id,
+            user_id: device.user,
+            fingerprint: device.fingerprint.clone(),
+            name: device.name.clone(),
+            trusted_at: device.trusted_at,
+            last_seen_at: device.last_seen_at,
+            meta_id: device.meta.get_id(),
+        };
+        
+        let connection = get_connection().get()?;
+        diesel::update(devices)
+            .filter(id.eq(device.id))
+            .set(&pg_device)
+            .execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete(&self, device: &Device) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresDeviceRepository::delete_on_conn(&conn, device))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryDeviceRepository {
+    table: memory::Table<Device>,
+}
+
+impl InMemoryDeviceRepository {
+    pub fn new() -> Self {
+        InMemoryDeviceRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl DeviceRepository for InMemoryDeviceRepository {
+    fn find(&self, target: i32) -> Result<Device, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_by_user_and_fingerprint(&self, target_user: i32, target: &str) -> Result<Device, Box<dyn Error>>  {
+        self.table.find_first(|device| device.user == target_user && device.fingerprint == target)
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Device>, Box<dyn Error>>  {
+        let mut all_devices = self.table.find_all(|device| device.user == target_user)?;
+        all_devices.sort_by(|a, b| b.last_seen_at.cmp(&a.last_seen_at).then(b.id.cmp(&a.id)));
+        Ok(all_devices)
+    }
+
+    fn create(&self, device: &mut Device) -> Result<(), Box<dyn Error>> {
+        // in order to create a device it must exists the metadata for this device
+        get_meta_repository().create(&mut device.meta)?;
+
+        let (target_user, target) = (device.user, device.fingerprint.clone());
+        self.table.insert(device,
+                          |existing| existing.user == target_user && existing.fingerprint == target,
+                          |device, new_id| device.id = new_id)
+    }
+
+    fn save(&self, device: &Device) -> Result<(), Box<dyn Error>> {
+        self.table.update(device.id, device)
+    }
+
+    fn delete(&self, device: &Device) -> Result<(), Box<dyn Error>> {
+        self.table.delete(device.id)?;
+        get_meta_repository().delete(&device.meta)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::DeviceRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresDeviceRepository),
+            Backend::Memory => Box::new(framework::InMemoryDeviceRepository::new()),
+            backend => storage::unsupported(backend, "devices"),
+        }
+    }; 
+}   
+
+pub fn get_repository() -> Box<&'static dyn domain::DeviceRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
\ No newline at end of file
@@ -0,0 +1,335 @@
+use std::error::Error;
+use std::fs;
+use std::sync::RwLock;
+use std::collections::HashMap;
+use std::time::{Duration, SystemTime};
+use openssl::asn1::Asn1Time;
+use openssl::x509::X509;
+
+use crate::config;
+use crate::security;
+use crate::signing::application::{signing_enabled, signing_expiry};
+use crate::constants::{environment, settings};
+use crate::time;
+
+lazy_static! {
+    // the latest report of each limiter getting close to its capacity, by check and subject
+    static ref PRESSURE: RwLock<HashMap<(Check, String), (Finding, SystemTime)>> = RwLock::new(HashMap::new());
+}
+
+/// How soon an operator must act on a finding: warnings are about to become a problem, while critical findings are
+/// making token issuance fail, or will do right away
+#[derive(Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Debug)]
+pub enum Severity {
+    Critical,
+    Warning,
+}
+
+impl Severity {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Severity::Critical => "critical",
+            Severity::Warning => "warning",
+        }
+    }
+}
+
+/// All the checks a finding may come from
+#[derive(Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Debug)]
+pub enum Check {
+    Certificate, // the tls certificate served by the service
+    ClientCa,    // the ca client certificates are verified by
+    SigningKey,  // the signing key rotated by the service itself
+    KeySet,      // the keys fetched through the keyring
+    Authorizer,
+    Quota,
+    RateLimit,
+}
+
+impl Check {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Check::Certificate => "certificate",
+            Check::ClientCa => "client_ca",
+            Check::SigningKey => "signing_key",
+            Check::KeySet => "key_set",
+            Check::Authorizer => "authorizer",
+            Check::Quota => "quota",
+            Check::RateLimit => "rate_limit",
+        }
+    }
+}
+
+/// Something operators should know about before token issuance starts failing, along with when it does, if known
+#[derive(Clone, PartialEq, Debug)]
+pub struct Finding {
+    pub check: Check,
+    pub severity: Severity,
+    pub subject: String,
+    pub message: String,
+    pub expires_at: Option<SystemTime>,
+}
+
+impl Finding {
+    pub fn new(check: Check, severity: Severity, subject: &str, message: &str) -> Self {
+        Finding {
+            check: check,
+            severity: severity,
+            subject: subject.to_string(),
+            message: message.to_string(),
+            expires_at: None,
+        }
+    }
+}
+
+/// When a credential the service relies on expires
+#[derive(Clone, PartialEq, Debug)]
+pub struct Expiration {
+    pub check: Check,
+    pub subject: String,
+    pub expires_at: SystemTime,
+}
+
+/// The findings of all the checks, the most severe first, along with the expiration of every credential known
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct Report {
+    pub findings: Vec<Finding>,
+    pub expirations: Vec<Expiration>,
+}
+
+/// Returns the number set by the environment for the given setting, if any, or else the default one
+fn get_setting(name: &str, default: u64) -> u64 {
+    config::get(name).ok()
+        .and_then(|value| value.parse().ok())
+        .unwrap_or(default)
+}
+
+/// Returns the finding, if any, of a credential expiring at the given time: critical once it is about to expire,
+/// and a warning since the given warning window starts
+fn check_expiration(expiration: &Expiration, warning: Duration, now: SystemTime) -> Option<Finding> {
+    let left = expiration.expires_at.duration_since(now).unwrap_or_default();
+    let (severity, message) = if left.as_secs() == 0 {
+        (Severity::Critical, "expired".to_string())
+    } else if left.as_secs() <= settings::DIAGNOSTICS_EXPIRY_CRITICAL {
+        (Severity::Critical, format!("expires in {} hours", left.as_secs() / 3600))
+    } else if left <= warning {
+        (Severity::Warning, format!("expires in {} days", left.as_secs() / 86400))
+    } else {
+        return None;
+    };
+
+    let mut finding = Finding::new(expiration.check, severity, &expiration.subject, &message);
+    finding.expires_at = Some(expiration.expires_at);
+    Some(finding)
+}
+
+/// Returns when the earliest expiring certificate of the pem file at the given path expires
+fn get_certificate_expiry(path: &str) -> Result<SystemTime, Box<dyn Error>> {
+    let epoch = Asn1Time::from_unix(0)?;
+    let mut expires_at = None;
+    for cert in X509::stack_from_pem(&fs::read(path)?)? {
+        let diff = epoch.diff(cert.not_after())?;
+        let secs = diff.days as i64 * 86400 + diff.secs as i64;
+        let cert_expires_at = SystemTime::UNIX_EPOCH + Duration::from_secs(secs.max(0) as u64);
+        expires_at = Some(expires_at.map_or(cert_expires_at, |earliest: SystemTime| earliest.min(cert_expires_at)));
+    }
+
+    expires_at.ok_or_else(|| format!("no certificate found in {}", path).into())
+}
+
+/// Returns the expiration of the tls certificates set by the environment, reporting these that cannot be read
+fn check_certificates(report: &mut Report) {
+    for (check, name) in &[(Check::Certificate, environment::TLS_CERT), (Check::ClientCa, environment::TLS_CLIENT_CA)] {
+        let path = match config::get(name) {
+            Ok(path) => path,
+            Err(_) => continue,
+        };
+
+        match get_certificate_expiry(&path) {
+            Ok(expires_at) => report.expirations.push(Expiration {
+                check: *check,
+                subject: path,
+                expires_at: expires_at,
+            }),
+
+            Err(err) => report.findings.push(Finding::new(*check, Severity::Critical, &path,
+                                                          &format!("cannot be read: {}", err))),
+        }
+    }
+}
+
+/// Reports the signing key rotated by the service itself not being replaced in time, or the keys fetched through the
+/// keyring not being there, since tokens cannot be signed nor verified without them
+fn check_keys(report: &mut Report) {
+    let mut sets: Vec<String> = config::get(environment::JWT_KEY_SETS)
+        .map(|sets| sets.split(',').map(str::trim).filter(|set| !set.is_empty()).map(str::to_string).collect())
+        .unwrap_or_default();
+
+    if signing_enabled() {
+        match signing_expiry() {
+            Ok(Some((expires_at, overdue))) => {
+                let expiration = Expiration {
+                    check: Check::SigningKey,
+                    subject: security::DEFAULT_KEY_SET.to_string(),
+                    expires_at: expires_at,
+                };
+
+                if overdue {
+                    let message = "rotation is overdue: no key has been generated to replace the current one";
+                    let mut finding = Finding::new(Check::SigningKey, Severity::Warning, &expiration.subject, message);
+                    finding.expires_at = Some(expires_at);
+                    report.findings.push(finding);
+                }
+
+                report.expirations.push(expiration);
+            },
+
+            Ok(None) => report.findings.push(Finding::new(Check::SigningKey, Severity::Critical,
+                                                          security::DEFAULT_KEY_SET, "no active signing key")),
+            Err(err) => report.findings.push(Finding::new(Check::SigningKey, Severity::Critical,
+                                                          security::DEFAULT_KEY_SET,
+                                                          &format!("signing keys cannot be read: {}", err))),
+        }
+    } else {
+        sets.insert(0, security::DEFAULT_KEY_SET.to_string());
+    }
+
+    for set in sets.iter() {
+        if let Err(err) = security::check_jwt_key_set(set) {
+            report.findings.push(Finding::new(Check::KeySet, Severity::Critical, set,
+                                              &format!("cannot be loaded: {}", err)));
+        }
+    }
+}
+
+/// Reports tokens being issued unchecked whenever the authorizer fails, if it is told to fail open
+fn check_authorizer(report: &mut Report) {
+    if config::get(environment::AUTHORIZER).is_err() {
+        return;
+    }
+
+    if config::get(environment::AUTHORIZER_FAIL_OPEN).map(|fail_open| fail_open == "true").unwrap_or(false) {
+        report.findings.push(Finding::new(Check::Authorizer, Severity::Warning, environment::AUTHORIZER_FAIL_OPEN,
+                                          "tokens are issued unchecked whenever the authorizer fails"));
+    }
+}
+
+/// Reports the limiters that got close to their capacity within the diagnostics window, dropping older reports
+fn check_pressure(report: &mut Report, now: SystemTime) {
+    let window = Duration::from_secs(get_setting(environment::DIAGNOSTICS_WINDOW, settings::DIAGNOSTICS_WINDOW));
+    match PRESSURE.write() {
+        Ok(mut pressure) => {
+            pressure.retain(|_, (_, reported_at)| *reported_at + window > now);
+            report.findings.extend(pressure.values().map(|(finding, _)| finding.clone()));
+        },
+
+        Err(err) => error!("write lock for diagnostics pressure got poisoned: {}", err),
+    }
+}
+
+/// Returns whether the given usage is close enough to its limit to be reported, as told by DIAGNOSTICS_QUOTA_SHARE
+pub fn is_near_capacity(used: u64, limit: u64) -> bool {
+    let share = get_setting(environment::DIAGNOSTICS_QUOTA_SHARE, settings::DIAGNOSTICS_QUOTA_SHARE);
+    used * 100 >= limit * share.min(100)
+}
+
+/// Records a limiter, such as the quota of an app, getting close to or over its capacity, replacing any former report
+/// for the same subject. Once there are as many subjects as kept at most, new ones get dropped
+pub fn report_pressure(check: Check, severity: Severity, subject: &str, message: &str) {
+    let key = (check, subject.to_string());
+    match PRESSURE.write() {
+        Ok(mut pressure) => {
+            if pressure.len() >= settings::MAX_PRESSURE_REPORTS && !pressure.contains_key(&key) {
+                return;
+            }
+
+            let finding = Finding::new(check, severity, subject, message);
+            pressure.insert(key, (finding, time::now()));
+        },
+
+        Err(err) => error!("write lock for diagnostics pressure got poisoned: {}", err),
+    }
+}
+
+/// Runs all the checks, returning their findings, the most severe first, and the expiration of the credentials known
+pub fn diagnose() -> Report {
+    let now = time::now();
+    let mut report = Report::default();
+    check_certificates(&mut report);
+    check_keys(&mut report);
+    check_authorizer(&mut report);
+    check_pressure(&mut report, now);
+
+    let warning = Duration::from_secs(get_setting(environment::DIAGNOSTICS_EXPIRY_WARNING,
+                                                  settings::DIAGNOSTICS_EXPIRY_WARNING));
+    // signing keys are replaced by the rotation long before they expire, so only an overdue one gets reported
+    let expiring: Vec<Finding> = report.expirations.iter()
+        .filter(|expiration| expiration.check != Check::SigningKey)
+        .filter_map(|expiration| check_expiration(expiration, warning, now))
+        .collect();
+
+    report.findings.extend(expiring);
+    report.findings.sort_by(|a, b| (a.severity, a.check, &a.subject).cmp(&(b.severity, b.check, &b.subject)));
+    report
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use super::{Check, Severity, Expiration, check_expiration, is_near_capacity, report_pressure, diagnose};
+
+    const DAY: u64 = 86400;
+
+    fn new_expiration(expires_at: SystemTime) -> Expiration {
+        Expiration {
+            check: Check::Certificate,
+            subject: "/etc/tls/cert.pem".to_string(),
+            expires_at: expires_at,
+        }
+    }
+
+    #[test]
+    fn check_expiration_should_not_fail() {
+        let now = SystemTime::now();
+        let warning = Duration::from_secs(30 * DAY);
+
+        let expiration = new_expiration(now + Duration::from_secs(60 * DAY));
+        assert!(check_expiration(&expiration, warning, now).is_none());
+
+        let expiration = new_expiration(now + Duration::from_secs(10 * DAY));
+        let finding = check_expiration(&expiration, warning, now).unwrap();
+        assert_eq!(Severity::Warning, finding.severity);
+        assert_eq!(Check::Certificate, finding.check);
+        assert_eq!(Some(expiration.expires_at), finding.expires_at);
+
+        let expiration = new_expiration(now + Duration::from_secs(DAY));
+        assert_eq!(Severity::Critical, check_expiration(&expiration, warning, now).unwrap().severity);
+
+        let expiration = new_expiration(now - Duration::from_secs(DAY));
+        let finding = check_expiration(&expiration, warning, now).unwrap();
+        assert_eq!(Severity::Critical, finding.severity);
+        assert_eq!("expired", finding.message);
+    }
+
+    #[test]
+    fn is_near_capacity_should_not_fail() {
+        assert!(!is_near_capacity(79, 100));
+        assert!(is_near_capacity(80, 100));
+        assert!(is_near_capacity(101, 100));
+    }
+
+    #[test]
+    fn report_pressure_should_not_fail() {
+        report_pressure(Check::Quota, Severity::Warning, "diagnostics.testing.com:sessions", "80 of 100 used");
+        report_pressure(Check::Quota, Severity::Critical, "diagnostics.testing.com:sessions", "101 of 100 used");
+
+        let findings: Vec<_> = diagnose().findings.into_iter()
+            .filter(|finding| finding.subject == "diagnostics.testing.com:sessions")
+            .collect();
+
+        assert_eq!(1, findings.len());
+        assert_eq!(Severity::Critical, findings[0].severity);
+        assert_eq!("101 of 100 used", findings[0].message);
+    }
+}
@@ -8,6 +8,7 @@ use crate::metadata::domain::InnerMetadata;
 pub trait DirectoryRepository {
     fn find(&self, id: &str) -> Result<Directory, Box<dyn Error>>;
     fn find_by_user_and_app(&self, user_id: i32, app_id: i32) -> Result<Directory, Box<dyn Error>>;
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<Directory>, Box<dyn Error>>;
     fn create(&self, secret: &mut Directory) -> Result<(), Box<dyn Error>>;
     fn save(&self, secret: &Directory) -> Result<(), Box<dyn Error>>;
     fn delete(&self, secret: &Directory) -> Result<(), Box<dyn Error>>;
@@ -15,6 +16,7 @@ pub trait DirectoryRepository {
     fn delete_all_by_user(&self, user: &User) -> Result<(), Box<dyn Error>>;
 }
 
+#[derive(Clone)]
 pub struct Directory {
     pub(super) id: String,
     pub(super) user: i32,
@@ -25,15 +27,17 @@ pub struct Directory {
 
 impl Directory {
     pub fn new(sess: &Session,
-               app: &App) -> Self {
+               app: &App) -> Result<Self, Box<dyn Error>> {
 
-        Directory {
+        let dir = Directory {
             id: "".to_string(),
-            user: sess.get_user().get_id(),
+            user: sess.get_user()?.get_id(),
             app: app.get_id(),
             _deadline: sess.get_deadline(),
             meta: InnerMetadata::new(),
-        }
+        };
+
+        Ok(dir)
     }
 
     pub fn get_id(&self) -> &str {
@@ -44,6 +48,19 @@ impl Directory {
         self.app
     }
 
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    /// the time the user first logged into the app, so the app got authorized
+    pub fn get_created_at(&self) -> SystemTime {
+        self.meta.created_at
+    }
+
+    pub fn get_touch_at(&self) -> SystemTime {
+        self.meta.touch_at
+    }
+
     pub fn _set_deadline(&mut self, deadline: SystemTime) {
         self._deadline = deadline;
     }
@@ -73,10 +90,21 @@ pub mod tests {
         let app = new_app();
         let sess = new_session();
 
-        let dir = Directory::new(&sess, &app);
+        let dir = Directory::new(&sess, &app).unwrap();
         
         assert_eq!("", dir.id);
         assert_eq!(dir.app, app.get_id());
-        assert_eq!(dir.user, sess.get_user().get_id());
+        assert_eq!(dir.user, sess.get_user().unwrap().get_id());
+    }
+
+    #[test]
+    fn directory_new_guest_should_fail() {
+        use std::time::Duration;
+        use crate::session::domain::Session;
+        use crate::constants::settings;
+
+        let app = new_app();
+        let sess = Session::new_guest(settings::DEFAULT_TENANT, Duration::from_secs(10));
+        assert!(Directory::new(&sess, &app).is_err());
     }
 }
\ No newline at end of file
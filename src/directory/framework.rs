@@ -1,10 +1,15 @@
 use std::error::Error;
 use std::time::{SystemTime, Duration, UNIX_EPOCH};
 use serde::{Serialize, Deserialize};
-use bson::oid::ObjectId;
 use bson::{Bson, Document};
+use diesel::NotFound;
 
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::directories;
 use crate::mongo;
+use crate::ulid;
 use crate::metadata::domain::InnerMetadata;
 use crate::constants::errors;
 use crate::app::domain::App;
@@ -22,7 +27,7 @@ struct MongoDirectoryMetadata {
 #[derive(Serialize, Deserialize, Debug)]
 struct MongoDirectory {
     #[serde(rename = "_id", skip_serializing_if = "Option::is_none")]
-    pub id: Option<ObjectId>,
+    pub id: Option<Bson>,
     pub user: i32,
     pub app: i32,
     pub meta: MongoDirectoryMetadata,
@@ -34,12 +39,10 @@ impl MongoDirectoryRepository {
     fn build(loaded_dir: Document) -> Result<Directory, Box<dyn Error>> {
         let mongo_dir: MongoDirectory = bson::from_bson(Bson::Document(loaded_dir))?;
         
-        let id: String;
-        if let Some(dir_id) = mongo_dir.id {
-            id = dir_id.to_hex();
-        } else {
-            return Err(errors::NOT_FOUND.into());
-        }
+        let id = match mongo_dir.id.as_ref().and_then(mongo::id_from_bson) {
+            Some(id) => id,
+            None => return Err(errors::NOT_FOUND.into()),
+        };
 
         let dir = Directory {
             id: id,
@@ -63,8 +66,7 @@ impl MongoDirectoryRepository {
 
         let mut id_opt = None;
         if dir.id.len() > 0 {
-            let bson_id = ObjectId::with_string(&dir.id)?;
-            id_opt = Some(bson_id);
+            id_opt = Some(mongo::id_to_bson(&dir.id));
         }
 
         let mongo_dir = MongoDirectory {
@@ -85,8 +87,8 @@ impl MongoDirectoryRepository {
 
 impl DirectoryRepository for MongoDirectoryRepository {
     fn find(&self, target: &str) -> Result<Directory, Box<dyn Error>>  {
-        let loaded_dir_opt = mongo::get_connection(COLLECTION_NAME)
-            .find_one(Some(doc! { "_id":  target }), None)?;
+        let loaded_dir_opt = mongo::get_reading_connection(COLLECTION_NAME)?
+            .find_one(Some(doc! { "_id":  mongo::id_to_bson(target) }), None)?;
 
         if let Some(loaded_dir) = loaded_dir_opt {
             return MongoDirectoryRepository::build(loaded_dir);
@@ -96,7 +98,8 @@ impl DirectoryRepository for MongoDirectoryRepository {
     }
 
     fn find_by_user_and_app(&self, user_id: i32, app_id: i32) -> Result<Directory, Box<dyn Error>> {
-        let loaded_dir_opt = mongo::get_connection(COLLECTION_NAME)
+        // stale reads could end up with a repeated directory, so the primary must be read from
+        let loaded_dir_opt = mongo::get_connection(COLLECTION_NAME)?
             .find_one(Some(doc! { "user":  user_id, "app": app_id }), None)?;
 
         if let Some(loaded_dir) = loaded_dir_opt {
@@ -106,50 +109,255 @@ impl DirectoryRepository for MongoDirectoryRepository {
         Err(errors::NOT_FOUND.into())
     }
 
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<Directory>, Box<dyn Error>> {
+        let cursor = mongo::get_reading_connection(COLLECTION_NAME)?
+            .find(Some(doc!{"user": user_id}), None)?;
+
+        let mut dirs = Vec::new();
+        for loaded_dir in cursor {
+            dirs.push(MongoDirectoryRepository::build(loaded_dir?)?);
+        }
+
+        Ok(dirs)
+    }
+
     fn create(&self, dir: &mut Directory) -> Result<(), Box<dyn Error>> {
-        let document = MongoDirectoryRepository::parse_directory(dir)?;       
-        let result = mongo::get_connection(COLLECTION_NAME)
-            .insert_one(document.to_owned(), None)?;
+        let dir_id = ulid::generate();
+        let mut document = MongoDirectoryRepository::parse_directory(dir)?;
+        document.insert("_id", dir_id.clone());
 
-        let dir_id_opt = result
-            .inserted_id
-            .as_object_id();
+        mongo::get_connection(COLLECTION_NAME)?
+            .insert_one(document, None)?;
 
-        if let Some(dir_id) = dir_id_opt {
-            dir.id = dir_id.to_hex();
-            Ok(())
-        } else {
-            return Err(errors::PARSE_FAILED.into());
-        }
+        dir.id = dir_id;
+        Ok(())
     }
 
     fn save(&self, dir: &Directory) -> Result<(), Box<dyn Error>> {
         let document = MongoDirectoryRepository::parse_directory(dir)?;       
-        mongo::get_connection(COLLECTION_NAME)
-            .update_one(doc!{"_id": dir.get_id()}, document.to_owned(), None)?;
+        mongo::get_connection(COLLECTION_NAME)?
+            .update_one(doc!{"_id": mongo::id_to_bson(dir.get_id())}, document.to_owned(), None)?;
 
         Ok(())
     }
 
     fn delete(&self, dir: &Directory) -> Result<(), Box<dyn Error>> {
-        let bson_id = ObjectId::with_string(&dir.id)?;
-        mongo::get_connection(COLLECTION_NAME)
-            .delete_one(doc!{"_id": bson_id}, None)?;
+        mongo::get_connection(COLLECTION_NAME)?
+            .delete_one(doc!{"_id": mongo::id_to_bson(&dir.id)}, None)?;
 
         Ok(())
     }
 
     fn delete_all_by_app(&self, app: &App) -> Result<(), Box<dyn Error>> {
-        mongo::get_connection(COLLECTION_NAME)
+        mongo::get_connection(COLLECTION_NAME)?
             .delete_one(doc!{"app": app.get_id()}, None)?;
 
         Ok(())
     }
 
     fn delete_all_by_user(&self, user: &User) -> Result<(), Box<dyn Error>> {
-        mongo::get_connection(COLLECTION_NAME)
+        mongo::get_connection(COLLECTION_NAME)?
             .delete_one(doc!{"user": user.get_id()}, None)?;
 
         Ok(())
     }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[table_name = "directories"]
+struct PostgresDirectory {
+    pub id: i32,
+    pub user_id: i32,
+    pub app_id: i32,
+    pub created_at: SystemTime,
+    pub touch_at: SystemTime,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "directories"]
+struct NewPostgresDirectory {
+    pub user_id: i32,
+    pub app_id: i32,
+    pub created_at: SystemTime,
+    pub touch_at: SystemTime,
+}
+
+pub(super) struct PostgresDirectoryRepository;
+
+impl PostgresDirectoryRepository {
+    fn build(result: &PostgresDirectory) -> Directory {
+        Directory {
+            id: result.id.to_string(),
+            user: result.user_id,
+            app: result.app_id,
+            _deadline: SystemTime::UNIX_EPOCH,
+            meta: InnerMetadata {
+                created_at: result.created_at,
+                touch_at: result.touch_at,
+            },
+        }
+    }
+
+    fn build_first(results: &[PostgresDirectory]) -> Result<Directory, Box<dyn Error>> {
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        Ok(PostgresDirectoryRepository::build(&results[0]))
+    }
+}
+
+impl DirectoryRepository for PostgresDirectoryRepository {
+    fn find(&self, target: &str) -> Result<Directory, Box<dyn Error>>  {
+        let target: i32 = target.parse()?;
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            directories::table.filter(directories::id.eq(target))
+                              .load::<PostgresDirectory>(&connection)?
+        };
+
+        PostgresDirectoryRepository::build_first(&results)
+    }
+
+    fn find_by_user_and_app(&self, user_id: i32, app_id: i32) -> Result<Directory, Box<dyn Error>> {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            directories::table.filter(directories::user_id.eq(user_id))
+                              .filter(directories::app_id.eq(app_id))
+                              .load::<PostgresDirectory>(&connection)?
+        };
+
+        PostgresDirectoryRepository::build_first(&results)
+    }
+
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<Directory>, Box<dyn Error>> {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            directories::table.filter(directories::user_id.eq(user_id))
+                              .order(directories::id.asc())
+                              .load::<PostgresDirectory>(&connection)?
+        };
+
+        Ok(results.iter().map(PostgresDirectoryRepository::build).collect())
+    }
+
+    fn create(&self, dir: &mut Directory) -> Result<(), Box<dyn Error>> {
+        let new_dir = NewPostgresDirectory {
+            user_id: dir.user,
+            app_id: dir.app,
+            created_at: dir.meta.created_at,
+            touch_at: dir.meta.touch_at,
+        };
+
+        let result = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            diesel::insert_into(directories::table)
+                .values(&new_dir)
+                .get_result::<PostgresDirectory>(&connection)?
+        };
+
+        dir.id = result.id.to_string();
+        Ok(())
+    }
+
+    fn save(&self, dir: &Directory) -> Result<(), Box<dyn Error>> {
+        let pg_dir = PostgresDirectory {
+            id: dir.id.parse()?,
+            user_id: dir.user,
+            app_id: dir.app,
+            created_at: dir.meta.created_at,
+            touch_at: dir.meta.touch_at,
+        };
+
+        let connection = get_connection().get()?;
+        diesel::update(directories::table)
+            .filter(directories::id.eq(pg_dir.id))
+            .set(&pg_dir)
+            .execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete(&self, dir: &Directory) -> Result<(), Box<dyn Error>> {
+        let target: i32 = dir.id.parse()?;
+        let connection = get_connection().get()?;
+        diesel::delete(
+            directories::table.filter(directories::id.eq(target))
+        ).execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete_all_by_app(&self, app: &App) -> Result<(), Box<dyn Error>> {
+        let connection = get_connection().get()?;
+        diesel::delete(
+            directories::table.filter(directories::app_id.eq(app.get_id()))
+        ).execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete_all_by_user(&self, user: &User) -> Result<(), Box<dyn Error>> {
+        let connection = get_connection().get()?;
+        diesel::delete(
+            directories::table.filter(directories::user_id.eq(user.get_id()))
+        ).execute(&connection)?;
+
+        Ok(())
+    }
+}
+
+pub struct InMemoryDirectoryRepository {
+    table: memory::Table<Directory>,
+}
+
+impl InMemoryDirectoryRepository {
+    pub fn new() -> Self {
+        InMemoryDirectoryRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl DirectoryRepository for InMemoryDirectoryRepository {
+    fn find(&self, target: &str) -> Result<Directory, Box<dyn Error>>  {
+        self.table.find(target.parse()?)
+    }
+
+    fn find_by_user_and_app(&self, user_id: i32, app_id: i32) -> Result<Directory, Box<dyn Error>> {
+        self.table.find_first(|dir| dir.user == user_id && dir.app == app_id)
+    }
+
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<Directory>, Box<dyn Error>> {
+        self.table.find_all(|dir| dir.user == user_id)
+    }
+
+    fn create(&self, dir: &mut Directory) -> Result<(), Box<dyn Error>> {
+        let (user_id, app_id) = (dir.user, dir.app);
+        self.table.insert(dir,
+                          |existing| existing.user == user_id && existing.app == app_id,
+                          |dir, new_id| dir.id = new_id.to_string())
+    }
+
+    fn save(&self, dir: &Directory) -> Result<(), Box<dyn Error>> {
+        self.table.update(dir.id.parse()?, dir)
+    }
+
+    fn delete(&self, dir: &Directory) -> Result<(), Box<dyn Error>> {
+        self.table.delete(dir.id.parse()?)
+    }
+
+    fn delete_all_by_app(&self, app: &App) -> Result<(), Box<dyn Error>> {
+        self.table.delete_all(|dir| dir.app == app.get_id())?;
+        Ok(())
+    }
+
+    fn delete_all_by_user(&self, user: &User) -> Result<(), Box<dyn Error>> {
+        self.table.delete_all(|dir| dir.user == user.get_id())?;
+        Ok(())
+    }
 }
\ No newline at end of file
@@ -2,12 +2,19 @@ pub mod framework;
 pub mod application;
 pub mod domain;
 
+use crate::storage::{self, Backend};
+
 lazy_static! {
-    static ref REPO_PROVIDER: framework::MongoDirectoryRepository = {
-        framework::MongoDirectoryRepository
+    static ref REPO_PROVIDER: Box<dyn domain::DirectoryRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Mongo) {
+            Backend::Mongo => Box::new(framework::MongoDirectoryRepository),
+            Backend::Postgres => Box::new(framework::PostgresDirectoryRepository),
+            Backend::Memory => Box::new(framework::InMemoryDirectoryRepository::new()),
+            backend => storage::unsupported(backend, "directories"),
+        }
     }; 
 }   
 
 pub fn get_repository() -> Box<&'static dyn domain::DirectoryRepository> {
-    Box::new(&*REPO_PROVIDER)
+    Box::new(&**REPO_PROVIDER)
 }
\ No newline at end of file
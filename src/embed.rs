@@ -0,0 +1,238 @@
+use std::error::Error;
+use std::sync::Arc;
+use tonic::{Request, Status};
+use tonic::service::{Interceptor, interceptor::InterceptedService};
+
+use crate::constants::environment;
+use crate::{config, jobs, migration, mongo, postgres};
+use crate::storage::{self, Backend};
+use crate::firewall::framework::ip_filter;
+use crate::ratelimit::framework::rate_limit;
+use crate::apikey::framework::apikey_interceptor;
+use crate::session::framework::cookie_interceptor;
+use crate::claims::{self, domain::ClaimsEnricher};
+use crate::authorization::{self, domain::Authorizer};
+
+use crate::user::framework::{UserServiceServer, UserServiceImplementation};
+use crate::app::framework::{AppServiceServer, AppServiceImplementation};
+use crate::session::framework::{SessionServiceServer, SessionServiceImplementation};
+use crate::session::framework_v2::{
+    SessionServiceServer as SessionServiceServerV2,
+    SessionServiceImplementation as SessionServiceImplementationV2,
+};
+use crate::policy::framework::{PolicyServiceServer, PolicyServiceImplementation};
+use crate::invitation::framework::{InvitationServiceServer, InvitationServiceImplementation};
+use crate::recovery::framework::{RecoveryServiceServer, RecoveryServiceImplementation};
+use crate::device::framework::{DeviceServiceServer, DeviceServiceImplementation};
+use crate::apikey::framework::{ApiKeyServiceServer, ApiKeyServiceImplementation};
+use crate::backup::framework::{BackupServiceServer, BackupServiceImplementation};
+use crate::firewall::framework::{FirewallServiceServer, FirewallServiceImplementation};
+use crate::credential::framework::{CredentialServiceServer, CredentialServiceImplementation};
+use crate::identity::framework::{IdentityServiceServer, IdentityServiceImplementation};
+use crate::admin::framework::{AdminServiceServer, AdminServiceImplementation};
+
+pub use crate::postgres::PgPool;
+
+/// A service guarded by the firewall and the rate limits of its scope
+pub type Guarded<S> = InterceptedService<S, Guard>;
+
+/// Interceptor filtering the requests to a service by their address before limiting their rate, so denied addresses
+/// do not consume the limits of anyone else. Opaque cookies get resolved into the tokens they stand for first
+#[derive(Clone)]
+pub struct Guard {
+    scope: &'static str,
+    apikey: bool,
+}
+
+impl Guard {
+    pub fn new(scope: &'static str) -> Self {
+        Guard {
+            scope: scope,
+            apikey: false,
+        }
+    }
+
+    /// Same as new, but api keys get authenticated first, so requests bearing one get filtered by the rules of the key
+    /// and limited by the key and its owner
+    pub fn with_apikey(scope: &'static str) -> Self {
+        Guard {
+            scope: scope,
+            apikey: true,
+        }
+    }
+}
+
+impl Interceptor for Guard {
+    fn call(&mut self, request: Request<()>) -> Result<Request<()>, Status> {
+        let request = match self.apikey {
+            true => apikey_interceptor(self.scope)(request)?,
+            false => request,
+        };
+
+        let request = cookie_interceptor(request)?;
+        ip_filter(&request, self.scope)?;
+        rate_limit(&request, self.scope, None)?;
+        Ok(request)
+    }
+}
+
+/// How the services get set up when embedded into another binary
+pub struct Options {
+    settings: Vec<(String, String)>,
+    pool: Option<PgPool>,
+    jobs: bool,
+    enricher: Option<Arc<dyn ClaimsEnricher + Sync + Send>>,
+    authorizer: Option<Arc<dyn Authorizer + Sync + Send>>,
+}
+
+impl Options {
+    pub fn new() -> Self {
+        Options {
+            settings: Vec::new(),
+            pool: None,
+            jobs: true,
+            enricher: None,
+            authorizer: None,
+        }
+    }
+
+    /// Sets the given setting, named after its environment variable, with the precedence of a flag. Secrets cannot be
+    /// set this way, but by the environment only
+    pub fn set(mut self, name: &str, value: &str) -> Self {
+        self.settings.push((name.to_string(), value.to_string()));
+        self
+    }
+
+    /// Sets the pool of the host as the one all the postgres repositories get their connections from, so no pool of
+    /// their own is opened, nor POSTGRES_DSN required
+    pub fn postgres_pool(mut self, pool: PgPool) -> Self {
+        self.pool = Some(pool);
+        self
+    }
+
+    /// Whether the background jobs (purging users, relaying events, delivering webhooks, refreshing secrets and
+    /// reloading the config) get spawned by this process, which they are by default. Only one of the processes sharing
+    /// the same storage needs to run them
+    pub fn background_jobs(mut self, enabled: bool) -> Self {
+        self.jobs = enabled;
+        self
+    }
+
+    /// Sets the given enricher as the one adding claims into every token being issued, instead of calling the one at
+    /// CLAIMS_ENRICHER_URL, if any
+    pub fn claims_enricher(mut self, enricher: Arc<dyn ClaimsEnricher + Sync + Send>) -> Self {
+        self.enricher = Some(enricher);
+        self
+    }
+
+    /// Sets the given authorizer as the one deciding whether every token gets issued, instead of the one set by
+    /// AUTHORIZER, if any
+    pub fn authorizer(mut self, authorizer: Arc<dyn Authorizer + Sync + Send>) -> Self {
+        self.authorizer = Some(authorizer);
+        self
+    }
+}
+
+/// All the grpc services, ready to be registered on the server of the host, each of them guarded by the firewall and
+/// rate limits of its scope
+#[derive(Clone, Copy, Default)]
+pub struct Services;
+
+impl Services {
+    pub fn user(&self) -> Guarded<UserServiceServer<UserServiceImplementation>> {
+        UserServiceServer::with_interceptor(UserServiceImplementation, Guard::with_apikey("user"))
+    }
+
+    pub fn app(&self) -> Guarded<AppServiceServer<AppServiceImplementation>> {
+        AppServiceServer::with_interceptor(AppServiceImplementation, Guard::new("app"))
+    }
+
+    pub fn session(&self) -> Guarded<SessionServiceServer<SessionServiceImplementation>> {
+        SessionServiceServer::with_interceptor(SessionServiceImplementation, Guard::new("session"))
+    }
+
+    pub fn session_v2(&self) -> Guarded<SessionServiceServerV2<SessionServiceImplementationV2>> {
+        SessionServiceServerV2::with_interceptor(SessionServiceImplementationV2, Guard::new("session"))
+    }
+
+    pub fn policy(&self) -> Guarded<PolicyServiceServer<PolicyServiceImplementation>> {
+        PolicyServiceServer::with_interceptor(PolicyServiceImplementation, Guard::new("policy"))
+    }
+
+    pub fn invitation(&self) -> Guarded<InvitationServiceServer<InvitationServiceImplementation>> {
+        InvitationServiceServer::with_interceptor(InvitationServiceImplementation, Guard::new("invitation"))
+    }
+
+    pub fn recovery(&self) -> Guarded<RecoveryServiceServer<RecoveryServiceImplementation>> {
+        RecoveryServiceServer::with_interceptor(RecoveryServiceImplementation, Guard::new("recovery"))
+    }
+
+    pub fn device(&self) -> Guarded<DeviceServiceServer<DeviceServiceImplementation>> {
+        DeviceServiceServer::with_interceptor(DeviceServiceImplementation, Guard::new("device"))
+    }
+
+    pub fn apikey(&self) -> Guarded<ApiKeyServiceServer<ApiKeyServiceImplementation>> {
+        ApiKeyServiceServer::with_interceptor(ApiKeyServiceImplementation, Guard::new("apikey"))
+    }
+
+    pub fn backup(&self) -> Guarded<BackupServiceServer<BackupServiceImplementation>> {
+        BackupServiceServer::with_interceptor(BackupServiceImplementation, Guard::new("backup"))
+    }
+
+    pub fn firewall(&self) -> Guarded<FirewallServiceServer<FirewallServiceImplementation>> {
+        FirewallServiceServer::with_interceptor(FirewallServiceImplementation, Guard::new("firewall"))
+    }
+
+    pub fn credential(&self) -> Guarded<CredentialServiceServer<CredentialServiceImplementation>> {
+        CredentialServiceServer::with_interceptor(CredentialServiceImplementation, Guard::new("credential"))
+    }
+
+    pub fn identity(&self) -> Guarded<IdentityServiceServer<IdentityServiceImplementation>> {
+        IdentityServiceServer::with_interceptor(IdentityServiceImplementation, Guard::new("identity"))
+    }
+
+    /// Operational actions should not be reachable by the public listener of the host, so this one is better served
+    /// on a server of its own
+    pub fn admin(&self) -> Guarded<AdminServiceServer<AdminServiceImplementation>> {
+        AdminServiceServer::with_interceptor(AdminServiceImplementation, Guard::new("admin"))
+    }
+}
+
+/// Sets up the services to be embedded into another binary, as the standalone one does on startup but for serving:
+/// the settings get loaded, the storage connected and migrated (unless AUTO_MIGRATE is false) and the background jobs
+/// spawned, if enabled. It must be called once, before any request is served. Logging and tracing are left to the
+/// host
+pub fn init(options: Options) -> Result<Services, Box<dyn Error>> {
+    let flags: Vec<String> = options.settings.iter()
+        .map(|(name, value)| format!("--{}={}", name, value))
+        .collect();
+
+    config::init(&flags)?;
+    if let Some(pool) = options.pool {
+        postgres::share_pool(pool)?;
+    }
+
+    if let Some(enricher) = options.enricher {
+        claims::set_enricher(enricher);
+    }
+
+    if let Some(authorizer) = options.authorizer {
+        authorization::set_authorizer(authorizer);
+    }
+
+    if storage::get_backend(Backend::Mongo) == Backend::Mongo {
+        mongo::connect()?;
+    }
+
+    let auto_migrate = config::get(environment::AUTO_MIGRATE).map(|auto| auto != "false").unwrap_or(true);
+    if auto_migrate {
+        migration::migrate_up()?;
+    }
+
+    migration::verify(auto_migrate)?;
+    if options.jobs {
+        jobs::start_all()?;
+    }
+
+    Ok(Services)
+}
@@ -0,0 +1,38 @@
+use std::error::Error;
+use crate::constants::errors;
+use crate::app::get_repository as get_app_repository;
+use super::{get_provider, domain::Flag};
+
+/// Returns whether the given flow is on for the app with the provided url of the tenant, as told by the provider.
+/// Flows are on unless told otherwise, so flags that cannot be evaluated (e.g. because of a malformed list of rules)
+/// leave them on
+pub fn feature_enabled(flag: Flag, tenant: i32, app: &str) -> bool {
+    match get_provider().evaluate(flag, tenant, app) {
+        Ok(enabled) => enabled.unwrap_or(true),
+        Err(err) => {
+            warn!("feature flag {} could not be evaluated for tenant {}: {}", flag.as_str(), tenant, err);
+            true
+        },
+    }
+}
+
+/// Fails unless the given flow is on for the app with the provided url of the tenant
+pub fn feature_check(flag: Flag, tenant: i32, app: &str) -> Result<(), Box<dyn Error>> {
+    if !feature_enabled(flag, tenant, app) {
+        info!("flow {} is off for app {} of tenant {}", flag.as_str(), app, tenant);
+        return Err(errors::FEATURE_DISABLED.into());
+    }
+
+    Ok(())
+}
+
+/// Same as feature_check, but for the app with the provided id, such as the one a token has been issued for. If there
+/// is no such app, only the rules about all the apps apply
+pub fn feature_check_by_app_id(flag: Flag, tenant: i32, app: i32) -> Result<(), Box<dyn Error>> {
+    let url = match get_app_repository().find(app) {
+        Ok(app) => app.get_url().to_string(),
+        Err(_) => "".to_string(),
+    };
+
+    feature_check(flag, tenant, &url)
+}
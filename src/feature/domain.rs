@@ -0,0 +1,212 @@
+use std::error::Error;
+use crate::constants::errors;
+
+pub trait FlagProvider {
+    // returns whether the flag is on for the app with the given url of the tenant, or none if the provider has no say
+    // on it
+    fn evaluate(&self, flag: Flag, tenant: i32, app: &str) -> Result<Option<bool>, Box<dyn Error>>;
+}
+
+/// All the flows that can be switched on or off. All of them are on unless a provider tells otherwise
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Flag {
+    PasswordLogin,
+    SignatureLogin,
+    ProviderLogin,
+    GuestSession,
+    Impersonation,
+    Signup,
+    TotpEnrollment,
+    CredentialEnrollment,
+}
+
+impl Flag {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Flag::PasswordLogin => "password_login",
+            Flag::SignatureLogin => "signature_login",
+            Flag::ProviderLogin => "provider_login",
+            Flag::GuestSession => "guest_session",
+            Flag::Impersonation => "impersonation",
+            Flag::Signup => "signup",
+            Flag::TotpEnrollment => "totp_enrollment",
+            Flag::CredentialEnrollment => "credential_enrollment",
+        }
+    }
+
+    pub fn from_str(flag: &str) -> Option<Self> {
+        match flag {
+            "password_login" => Some(Flag::PasswordLogin),
+            "signature_login" => Some(Flag::SignatureLogin),
+            "provider_login" => Some(Flag::ProviderLogin),
+            "guest_session" => Some(Flag::GuestSession),
+            "impersonation" => Some(Flag::Impersonation),
+            "signup" => Some(Flag::Signup),
+            "totp_enrollment" => Some(Flag::TotpEnrollment),
+            "credential_enrollment" => Some(Flag::CredentialEnrollment),
+            _ => None,
+        }
+    }
+
+    pub fn all() -> &'static [Flag] {
+        &[Flag::PasswordLogin, Flag::SignatureLogin, Flag::ProviderLogin, Flag::GuestSession, Flag::Impersonation,
+          Flag::Signup, Flag::TotpEnrollment, Flag::CredentialEnrollment]
+    }
+}
+
+/// All the providers flags may be evaluated by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Provider {
+    Config,
+    Http,
+}
+
+impl Provider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Provider::Config => "config",
+            Provider::Http => "http",
+        }
+    }
+
+    pub fn from_str(provider: &str) -> Option<Self> {
+        match provider {
+            "config" => Some(Provider::Config),
+            "http" => Some(Provider::Http),
+            _ => None,
+        }
+    }
+}
+
+/// Switches a flag on or off, either for all the apps or for the one with the given url only
+#[derive(Clone, PartialEq, Debug)]
+pub struct Rule {
+    pub(super) flag: Flag,
+    pub(super) app: Option<String>,
+    pub(super) enabled: bool,
+}
+
+impl Rule {
+    /// Parses a rule formatted as <flag>[@<app>]=<on|off>, such as "signup=off" or
+    /// "password_login@https://app.example.com=off"
+    pub fn from_str(rule: &str) -> Result<Self, Box<dyn Error>> {
+        let (target, value) = match rule.trim().rsplitn(2, '=').collect::<Vec<&str>>()[..] {
+            [value, target] => (target, value),
+            _ => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        let mut parts = target.splitn(2, '@');
+        let flag = match parts.next().and_then(Flag::from_str) {
+            Some(flag) => flag,
+            None => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        let app = parts.next().map(str::to_string);
+        if app.as_ref().filter(|app| app.len() == 0).is_some() {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        let enabled = match value {
+            "on" => true,
+            "off" => false,
+            _ => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        Ok(Rule {
+            flag: flag,
+            app: app,
+            enabled: enabled,
+        })
+    }
+
+    /// Parses a comma-separated list of rules
+    pub fn from_list(rules: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        rules.split(',')
+            .filter(|rule| rule.trim().len() > 0)
+            .map(Rule::from_str)
+            .collect()
+    }
+
+    pub fn get_flag(&self) -> Flag {
+        self.flag
+    }
+
+    pub fn get_app(&self) -> Option<&str> {
+        self.app.as_deref()
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.enabled
+    }
+}
+
+/// Returns whether the given flag is on for the app with the given url, as told by the most specific of the rules
+/// about it: these about the app itself go before these about all the apps, and the latest one wins among rules as
+/// specific as each other. If there is no rule about the flag, none is returned
+pub fn evaluate(rules: &[Rule], flag: Flag, app: &str) -> Option<bool> {
+    let matching: Vec<&Rule> = rules.iter().filter(|rule| rule.flag == flag).collect();
+    matching.iter().rev()
+        .find(|rule| rule.get_app() == Some(app))
+        .or_else(|| matching.iter().rev().find(|rule| rule.app.is_none()))
+        .map(|rule| rule.enabled)
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{Flag, Provider, Rule, evaluate};
+
+    #[test]
+    fn flag_from_str_should_not_fail() {
+        for flag in Flag::all() {
+            assert_eq!(Some(*flag), Flag::from_str(flag.as_str()));
+        }
+
+        assert_eq!(None, Flag::from_str("unknown"));
+        assert_eq!(Some(Provider::Http), Provider::from_str(Provider::Http.as_str()));
+        assert_eq!(None, Provider::from_str("unknown"));
+    }
+
+    #[test]
+    fn rule_from_str_should_not_fail() {
+        let rule = Rule::from_str("signup=off").unwrap();
+        assert_eq!(Flag::Signup, rule.flag);
+        assert_eq!(None, rule.app);
+        assert!(!rule.enabled);
+
+        let rule = Rule::from_str(" password_login@https://app.example.com/?a=b=on").unwrap();
+        assert_eq!(Flag::PasswordLogin, rule.flag);
+        assert_eq!(Some("https://app.example.com/?a=b"), rule.get_app());
+        assert!(rule.enabled);
+    }
+
+    #[test]
+    fn rule_from_str_should_fail() {
+        let wrong = &["signup", "signup=", "signup=yes", "unknown=on", "=on", "signup@=off"];
+        for rule in wrong {
+            assert!(Rule::from_str(rule).is_err(), "{} should not be parsed", rule);
+        }
+    }
+
+    #[test]
+    fn rule_from_list_should_not_fail() {
+        let rules = Rule::from_list("signup=off, guest_session@https://app.example.com=on,").unwrap();
+        assert_eq!(2, rules.len());
+        assert_eq!(Flag::GuestSession, rules[1].flag);
+        assert!(Rule::from_list("").unwrap().is_empty());
+        assert!(Rule::from_list("signup=off,wrong").is_err());
+    }
+
+    #[test]
+    fn evaluate_should_not_fail() {
+        let app = "https://app.example.com";
+        let rules = Rule::from_list("signup=off,password_login@https://app.example.com=off,password_login=on,\
+                                     signup=on,impersonation=on,impersonation@https://other.example.com=off").unwrap();
+
+        assert_eq!(Some(true), evaluate(&rules, Flag::Signup, app));
+        assert_eq!(Some(false), evaluate(&rules, Flag::PasswordLogin, app));
+        assert_eq!(Some(true), evaluate(&rules, Flag::PasswordLogin, "https://other.example.com"));
+        assert_eq!(Some(true), evaluate(&rules, Flag::Impersonation, app));
+        assert_eq!(None, evaluate(&rules, Flag::GuestSession, app));
+    }
+}
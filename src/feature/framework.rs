@@ -0,0 +1,109 @@
+use std::error::Error;
+use std::time::{Duration, Instant};
+use std::sync::RwLock;
+use std::collections::HashMap;
+use serde::{Serialize, Deserialize};
+
+use crate::constants::{settings, environment};
+use crate::tenant::application::tenant_setting;
+use super::domain::{self, Flag, FlagProvider, Rule};
+
+/// Evaluates the flags by the rules listed in the FEATURE_FLAGS setting of the tenant, which overrides the one set by
+/// the environment, if any. The rules are read on every evaluation, so they can be changed with no restart
+pub struct ConfigFlagProvider;
+
+impl FlagProvider for ConfigFlagProvider {
+    fn evaluate(&self, flag: Flag, tenant: i32, app: &str) -> Result<Option<bool>, Box<dyn Error>> {
+        let rules = match tenant_setting(tenant, environment::FEATURE_FLAGS) {
+            Some(rules) => Rule::from_list(&rules)?,
+            None => return Ok(None),
+        };
+
+        Ok(domain::evaluate(&rules, flag, app))
+    }
+}
+
+#[derive(Serialize)]
+struct EvaluationRequest<'a> {
+    flag: &'a str,
+    tenant: i32,
+    app: &'a str,
+}
+
+#[derive(Deserialize, Debug)]
+struct EvaluationResponse {
+    #[serde(default)]
+    enabled: Option<bool>, // missing if the service has no say on the flag
+}
+
+/// Evaluates the flags by posting them, along with the tenant and the app, to an external service. Evaluations are
+/// cached for a while, so not every login waits for the service; if the service fails, the rules of the config apply
+pub struct HttpFlagProvider {
+    url: String,
+    agent: ureq::Agent,
+    cache: RwLock<HashMap<String, (Option<bool>, Instant)>>,
+}
+
+impl HttpFlagProvider {
+    pub fn new(url: &str) -> Self {
+        HttpFlagProvider {
+            url: url.to_string(),
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(settings::FEATURE_FLAGS_TIMEOUT))
+                .build(),
+            cache: RwLock::new(HashMap::new()),
+        }
+    }
+
+    fn fetch(&self, flag: Flag, tenant: i32, app: &str) -> Result<Option<bool>, Box<dyn Error>> {
+        let request = EvaluationRequest {
+            flag: flag.as_str(),
+            tenant: tenant,
+            app: app,
+        };
+
+        let response: EvaluationResponse = self.agent.post(&self.url)
+            .send_json(serde_json::to_value(&request)?)?
+            .into_json()?;
+
+        Ok(response.enabled)
+    }
+}
+
+impl FlagProvider for HttpFlagProvider {
+    fn evaluate(&self, flag: Flag, tenant: i32, app: &str) -> Result<Option<bool>, Box<dyn Error>> {
+        let key = format!("{}:{}:{}", flag.as_str(), tenant, app);
+        let ttl = Duration::from_secs(settings::FEATURE_FLAGS_TTL);
+        match self.cache.read() {
+            Ok(cache) => if let Some((enabled, _)) = cache.get(&key).filter(|(_, at)| at.elapsed() < ttl) {
+                return Ok(*enabled);
+            },
+
+            Err(err) => error!("read lock for feature flags cache got poisoned: {}", err),
+        }
+
+        let enabled = match self.fetch(flag, tenant, app) {
+            Ok(enabled) => enabled,
+            Err(err) => {
+                warn!("feature flag {} could not be evaluated by the service, so the config applies: {}", flag.as_str(), err);
+                return ConfigFlagProvider.evaluate(flag, tenant, app);
+            },
+        };
+
+        match self.cache.write() {
+            Ok(mut cache) => {
+                if cache.len() >= settings::MAX_FEATURE_FLAGS {
+                    cache.retain(|_, (_, at)| at.elapsed() < ttl);
+                }
+
+                if cache.len() < settings::MAX_FEATURE_FLAGS {
+                    cache.insert(key, (enabled, Instant::now()));
+                }
+            },
+
+            Err(err) => error!("write lock for feature flags cache got poisoned: {}", err),
+        }
+
+        Ok(enabled)
+    }
+}
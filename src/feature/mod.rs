@@ -0,0 +1,27 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::constants::environment;
+use crate::config;
+
+lazy_static! {
+    static ref FLAG_PROVIDER: Box<dyn domain::FlagProvider + Sync + Send> = {
+        let provider = config::get(environment::FEATURE_FLAGS_PROVIDER)
+            .map(|provider| domain::Provider::from_str(&provider)
+                .expect("feature flags provider must be one of config or http"))
+            .unwrap_or(domain::Provider::Config);
+
+        match provider {
+            domain::Provider::Config => Box::new(framework::ConfigFlagProvider),
+            domain::Provider::Http => {
+                let url = config::get(environment::FEATURE_FLAGS_URL).expect("feature flags url must be set");
+                Box::new(framework::HttpFlagProvider::new(&url))
+            },
+        }
+    };
+}
+
+pub fn get_provider() -> Box<&'static dyn domain::FlagProvider> {
+    Box::new(&**FLAG_PROVIDER)
+}
@@ -0,0 +1,160 @@
+use std::error::Error;
+use std::net::IpAddr;
+use std::sync::RwLock;
+use std::time::{SystemTime, Duration};
+use crate::constants::{errors, settings};
+use crate::metadata::domain::Metadata;
+use crate::user::application::get_admin_user;
+use crate::apikey::get_repository as get_apikey_repository;
+use crate::time;
+use super::{
+    get_repository as get_rule_repository,
+    domain::{IpRule, Cidr, Action, is_allowed},
+};
+
+lazy_static! {
+    // rules are checked on every single request, so they are kept in memory for a while before loading them again
+    static ref RULES_CACHE: RwLock<Option<(Vec<IpRule>, SystemTime)>> = RwLock::new(None);
+}
+
+/// Rules apply to every tenant, so only administrators of the default one are granted for them
+fn check_firewall_admin(token: &str) -> Result<(), Box<dyn Error>> {
+    let admin = get_admin_user(token)?;
+    if admin.get_tenant() != settings::DEFAULT_TENANT {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    Ok(())
+}
+
+/// Drops the cached rules, so the next check loads them again
+fn invalidate_cache() {
+    match RULES_CACHE.write() {
+        Ok(mut cache) => *cache = None,
+        Err(err) => error!("write lock for ip rules cache got poisoned: {}", err),
+    }
+}
+
+/// Returns all the rules, as cached for no longer than the refresh period
+fn get_cached_rules() -> Result<Vec<IpRule>, Box<dyn Error>> {
+    let refresh = Duration::from_secs(settings::FIREWALL_REFRESH);
+    match RULES_CACHE.read() {
+        Ok(cache) => if let Some((rules, loaded_at)) = &*cache {
+            if loaded_at.elapsed().unwrap_or(refresh) < refresh {
+                return Ok(rules.clone());
+            }
+        },
+        Err(err) => {
+            error!("read lock for ip rules cache got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    }
+
+    let rules = get_rule_repository().find_all()?;
+    match RULES_CACHE.write() {
+        Ok(mut cache) => *cache = Some((rules.clone(), time::now())),
+        Err(err) => error!("write lock for ip rules cache got poisoned: {}", err),
+    }
+
+    Ok(rules)
+}
+
+/// Fails if the rules do not allow the given address to perform requests of the given scope through the given client,
+/// if any. Requests of unknown address are only let through if no rule restricts the scope to some ranges. Since the
+/// whole point of the rules is to keep requests out, they fail closed if they cannot be loaded
+pub fn firewall_check(scope: &str, client: Option<i32>, ip: Option<&str>) -> Result<(), Box<dyn Error>> {
+    let rules = get_cached_rules()?;
+    let applying: Vec<IpRule> = rules.into_iter()
+        .filter(|rule| rule.applies_to(scope, client))
+        .collect();
+
+    if applying.is_empty() {
+        return Ok(());
+    }
+
+    let ip: IpAddr = match ip.and_then(|ip| ip.parse().ok()) {
+        Some(ip) => ip,
+        None => return Err(errors::IP_NOT_ALLOWED.into()),
+    };
+
+    if !is_allowed(&applying, scope, client, &ip) {
+        return Err(errors::IP_NOT_ALLOWED.into());
+    }
+
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to an administrator of the default tenant, a new rule taking the given
+/// action over the range is created for the scope and client, if any
+pub fn firewall_add(token: &str,
+                    cidr: &str,
+                    action: &str,
+                    scope: &str,
+                    client: Option<i32>) -> Result<IpRule, Box<dyn Error>> {
+
+    info!("got an ip rule request to {} {} over scope \"{}\"", action, cidr, scope);
+
+    check_firewall_admin(token)?;
+    let cidr = Cidr::from_str(cidr)?;
+    let action = match Action::from_str(action) {
+        Some(action) => action,
+        None => return Err(errors::PARSE_FAILED.into()),
+    };
+
+    if let Some(client) = client {
+        get_apikey_repository().find(client)?;
+    }
+
+    let meta = Metadata::new();
+    let mut rule = IpRule::new(meta, cidr, action, scope, client);
+    get_rule_repository().create(&mut rule)?;
+    invalidate_cache();
+    Ok(rule)
+}
+
+/// If, and only if, the provided token belongs to an administrator of the default tenant, the rule with the given id
+/// gets deleted
+pub fn firewall_delete(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a deletion request for ip rule {}", id);
+
+    check_firewall_admin(token)?;
+    let rule = get_rule_repository().find(id)?;
+    get_rule_repository().delete(&rule)?;
+    invalidate_cache();
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to an administrator of the default tenant, returns all the rules
+pub fn firewall_list(token: &str) -> Result<Vec<IpRule>, Box<dyn Error>> {
+    check_firewall_admin(token)?;
+    get_rule_repository().find_all()
+}
+
+
+#[cfg(test)]
+#[cfg(feature = "integration-tests")]
+mod tests {
+    use crate::metadata::domain::tests::new_metadata;
+    use super::super::{
+        get_repository as get_rule_repository,
+        domain::{IpRule, Cidr, Action},
+    };
+    use super::{firewall_check, invalidate_cache};
+
+    #[test]
+    fn firewall_check_should_not_fail() {
+        let cidr = Cidr::from_str("10.10.0.0/16").unwrap();
+        let mut rule = IpRule::new(new_metadata(), cidr, Action::Allow, "firewall_testing", None);
+        get_rule_repository().create(&mut rule).unwrap();
+        invalidate_cache();
+
+        assert!(firewall_check("firewall_testing", None, Some("10.10.1.1")).is_ok());
+        assert!(firewall_check("firewall_testing", None, Some("10.11.1.1")).is_err());
+        assert!(firewall_check("firewall_testing", None, None).is_err());
+        assert!(firewall_check("another_scope", None, Some("10.11.1.1")).is_ok());
+
+        get_rule_repository().delete(&rule).unwrap();
+        invalidate_cache();
+        assert!(firewall_check("firewall_testing", None, Some("10.11.1.1")).is_ok());
+    }
+}
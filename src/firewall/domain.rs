@@ -0,0 +1,226 @@
+use std::error::Error;
+use std::net::IpAddr;
+use crate::constants::errors;
+use crate::metadata::domain::Metadata;
+
+pub trait IpRuleRepository {
+    fn find(&self, id: i32) -> Result<IpRule, Box<dyn Error>>;
+    fn find_all(&self) -> Result<Vec<IpRule>, Box<dyn Error>>;
+    fn create(&self, rule: &mut IpRule) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, rule: &IpRule) -> Result<(), Box<dyn Error>>;
+}
+
+/// A range of ip addresses, such as 10.0.0.0/8 or 2001:db8::/32
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub struct Cidr {
+    pub(super) addr: IpAddr,
+    pub(super) prefix: u8,
+}
+
+impl Cidr {
+    /// Parses the given range, where a single address stands for a range of its own
+    pub fn from_str(cidr: &str) -> Result<Self, Box<dyn Error>> {
+        let mut parts = cidr.trim().splitn(2, '/');
+        let addr: IpAddr = parts.next().unwrap_or_default().parse()?;
+        let max_prefix = if addr.is_ipv4() {32} else {128};
+        let prefix = match parts.next() {
+            Some(prefix) => prefix.parse()?,
+            None => max_prefix,
+        };
+
+        if prefix > max_prefix {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(Cidr {
+            addr: addr,
+            prefix: prefix,
+        })
+    }
+
+    /// Returns true if, and only if, the given address belongs to the range. Addresses of another family never do
+    pub fn contains(&self, ip: &IpAddr) -> bool {
+        match (self.addr, ip) {
+            (IpAddr::V4(net), IpAddr::V4(ip)) => {
+                let mask = u32::MAX.checked_shl(32 - self.prefix as u32).unwrap_or(0);
+                u32::from(net) & mask == u32::from(*ip) & mask
+            },
+            (IpAddr::V6(net), IpAddr::V6(ip)) => {
+                let mask = u128::MAX.checked_shl(128 - self.prefix as u32).unwrap_or(0);
+                u128::from(net) & mask == u128::from(*ip) & mask
+            },
+            _ => false,
+        }
+    }
+
+    pub fn to_string(&self) -> String {
+        format!("{}/{}", self.addr, self.prefix)
+    }
+}
+
+/// All the actions a rule may take over the addresses in its range
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Action {
+    Allow,
+    Deny,
+}
+
+impl Action {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Action::Allow => "allow",
+            Action::Deny => "deny",
+        }
+    }
+
+    pub fn from_str(action: &str) -> Option<Self> {
+        match action {
+            "allow" => Some(Action::Allow),
+            "deny" => Some(Action::Deny),
+            _ => None,
+        }
+    }
+}
+
+/// Allows or denies a range of addresses over a scope: all the requests if empty, these of a whole service (e.g.
+/// "user"), or these of the administrative operations if "admin". If a client is set, the rule only applies to the
+/// requests authenticated by that api key
+#[derive(Clone)]
+pub struct IpRule {
+    pub(super) id: i32,
+    pub(super) cidr: Cidr,
+    pub(super) action: Action,
+    pub(super) scope: String,
+    pub(super) client: Option<i32>,
+    pub(super) meta: Metadata,
+}
+
+impl IpRule {
+    pub fn new(meta: Metadata,
+               cidr: Cidr,
+               action: Action,
+               scope: &str,
+               client: Option<i32>) -> Self {
+
+        IpRule {
+            id: 0,
+            cidr: cidr,
+            action: action,
+            scope: scope.to_string(),
+            client: client,
+            meta: meta,
+        }
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_cidr(&self) -> Cidr {
+        self.cidr
+    }
+
+    pub fn get_action(&self) -> Action {
+        self.action
+    }
+
+    pub fn get_scope(&self) -> &str {
+        &self.scope
+    }
+
+    pub fn get_client(&self) -> Option<i32> {
+        self.client
+    }
+
+    /// Returns true if the rule applies to the requests of the given scope authenticated by the given client, if any.
+    /// Global rules apply to every scope
+    pub fn applies_to(&self, scope: &str, client: Option<i32>) -> bool {
+        (self.scope.len() == 0 || self.scope == scope) && (self.client.is_none() || self.client == client)
+    }
+}
+
+/// Returns true if the given address is allowed by the rules to perform requests of the given scope: denied ranges
+/// always win, while if there is any allowed range the address must belong to one of them
+pub fn is_allowed(rules: &[IpRule], scope: &str, client: Option<i32>, ip: &IpAddr) -> bool {
+    let mut restricted = false;
+    let mut allowed = false;
+
+    for rule in rules.iter().filter(|rule| rule.applies_to(scope, client)) {
+        let contained = rule.cidr.contains(ip);
+        match rule.action {
+            Action::Deny if contained => return false,
+            Action::Deny => {},
+            Action::Allow => {
+                restricted = true;
+                allowed = allowed || contained;
+            },
+        }
+    }
+
+    !restricted || allowed
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::net::IpAddr;
+    use crate::metadata::domain::tests::new_metadata;
+    use super::{Cidr, Action, IpRule, is_allowed};
+
+    fn new_rule(cidr: &str, action: Action, scope: &str, client: Option<i32>) -> IpRule {
+        IpRule::new(new_metadata(), Cidr::from_str(cidr).unwrap(), action, scope, client)
+    }
+
+    fn ip(addr: &str) -> IpAddr {
+        addr.parse().unwrap()
+    }
+
+    #[test]
+    fn cidr_from_str_should_not_fail() {
+        assert_eq!("10.0.0.0/8", Cidr::from_str("10.0.0.0/8").unwrap().to_string());
+        assert_eq!("10.1.2.3/32", Cidr::from_str("10.1.2.3").unwrap().to_string());
+        assert_eq!("2001:db8::/32", Cidr::from_str("2001:db8::/32").unwrap().to_string());
+    }
+
+    #[test]
+    fn cidr_from_str_should_fail() {
+        for cidr in &["10.0.0.0/33", "2001:db8::/129", "10.0.0/8", "not_an_ip", "10.0.0.0/eight"] {
+            assert!(Cidr::from_str(cidr).is_err(), "{} should not be parsed", cidr);
+        }
+    }
+
+    #[test]
+    fn cidr_contains_should_not_fail() {
+        let cidr = Cidr::from_str("192.168.1.0/24").unwrap();
+        assert!(cidr.contains(&ip("192.168.1.200")));
+        assert!(!cidr.contains(&ip("192.168.2.1")));
+        assert!(!cidr.contains(&ip("::1")));
+
+        assert!(Cidr::from_str("0.0.0.0/0").unwrap().contains(&ip("8.8.8.8")));
+        assert!(Cidr::from_str("2001:db8::/32").unwrap().contains(&ip("2001:db8:1::1")));
+        assert!(!Cidr::from_str("2001:db8::/32").unwrap().contains(&ip("2001:db9::1")));
+    }
+
+    #[test]
+    fn is_allowed_should_not_fail() {
+        let rules = vec![
+            new_rule("10.0.0.0/8", Action::Allow, "admin", None),
+            new_rule("10.0.0.66", Action::Deny, "", None),
+            new_rule("172.16.0.0/12", Action::Allow, "user", Some(7)),
+        ];
+
+        // admin operations are restricted to the office range
+        assert!(is_allowed(&rules, "admin", None, &ip("10.1.1.1")));
+        assert!(!is_allowed(&rules, "admin", None, &ip("8.8.8.8")));
+
+        // denied addresses are denied everywhere
+        assert!(!is_allowed(&rules, "admin", None, &ip("10.0.0.66")));
+        assert!(!is_allowed(&rules, "session", None, &ip("10.0.0.66")));
+        assert!(is_allowed(&rules, "session", None, &ip("8.8.8.8")));
+
+        // client rules only apply to the requests of that client
+        assert!(is_allowed(&rules, "user", None, &ip("8.8.8.8")));
+        assert!(!is_allowed(&rules, "user", Some(7), &ip("8.8.8.8")));
+        assert!(is_allowed(&rules, "user", Some(7), &ip("172.16.5.5")));
+    }
+}
@@ -0,0 +1,290 @@
+use std::error::Error;
+use tonic::{Request, Response, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::schema::iprules::dsl::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::iprules;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use crate::apikey::framework::ApiKeyIdentity;
+use crate::ratelimit::framework::get_ip;
+use super::domain::{IpRule, Cidr, Action, IpRuleRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("firewall");
+}
+
+// Proto generated server traits
+use proto::firewall_service_server::FirewallService;
+pub use proto::firewall_service_server::FirewallServiceServer;
+
+// Proto message structs
+use proto::{RuleRequest, RuleId, RuleList, Rule as ProtoRule};
+
+/// Returns an interceptor filtering all the requests to the provided service by the address they come from, as
+/// configured by the global rules and these whose scope is the service's name
+pub fn firewall_interceptor(service: &'static str) -> impl FnMut(Request<()>) -> Result<Request<()>, Status> + Clone {
+    move |request: Request<()>| {
+        ip_filter(&request, service)?;
+        Ok(request)
+    }
+}
+
+/// Filters the request by the address it comes from, as configured by the rules of the given scope. Interceptors
+/// cannot tell the method being called, so administrative methods are filtered by calling this function from their own
+/// handler with the "admin" scope
+pub fn ip_filter<T>(request: &Request<T>, scope: &str) -> Result<(), Status> {
+    let client = request.extensions().get::<ApiKeyIdentity>().map(|identity| identity.key);
+    let ip = get_ip(request);
+
+    match super::application::firewall_check(scope, client, ip.as_deref()) {
+        Err(err) => Err(Status::permission_denied(err.to_string())),
+        Ok(_) => Ok(()),
+    }
+}
+
+fn to_proto(rule: &IpRule) -> ProtoRule {
+    ProtoRule {
+        id: rule.get_id(),
+        cidr: rule.get_cidr().to_string(),
+        action: rule.get_action().as_str().to_string(),
+        scope: rule.get_scope().to_string(),
+        client: rule.get_client().unwrap_or(0),
+    }
+}
+
+pub struct FirewallServiceImplementation;
+
+#[tonic::async_trait]
+impl FirewallService for FirewallServiceImplementation {
+    async fn add_rule(&self, request: Request<RuleRequest>) -> Result<Response<ProtoRule>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let client = if msg_ref.client > 0 {Some(msg_ref.client)} else {None};
+        match super::application::firewall_add(&token, &msg_ref.cidr, &msg_ref.action, &msg_ref.scope, client) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(rule) => Ok(Response::new(to_proto(&rule))),
+        }
+    }
+
+    async fn delete_rule(&self, request: Request<RuleId>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::firewall_delete(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn list_rules(&self, request: Request<()>) -> Result<Response<RuleList>, Status> {
+        ip_filter(&request, "admin")?;
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        match super::application::firewall_list(token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(all_rules) => Ok(Response::new(
+                RuleList{
+                    rules: all_rules.iter().map(to_proto).collect(),
+                }
+            )),
+        }
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[changeset_options(treat_none_as_null = "true")]
+#[table_name = "iprules"]
+struct PostgresIpRule {
+    pub id: i32,
+    pub cidr: String,
+    pub action: String,
+    pub scope: String,
+    pub apikey_id: Option<i32>,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "iprules"]
+struct NewPostgresIpRule<'a> {
+    pub cidr: &'a str,
+    pub action: &'a str,
+    pub scope: &'a str,
+    pub apikey_id: Option<i32>,
+    pub meta_id: i32,
+}
+
+pub struct PostgresIpRuleRepository;
+
+impl PostgresIpRuleRepository {
+    fn create_on_conn(conn: &PgConnection, rule: &mut IpRule) -> Result<(), PgError>  {
+        // in order to create an ip rule it must exists the metadata for this rule
+        PostgresMetadataRepository::create_on_conn(conn, &mut rule.meta)?;
+
+        let range = rule.cidr.to_string();
+        let new_rule = NewPostgresIpRule {
+            cidr: &range,
+            action: rule.action.as_str(),
+            scope: &rule.scope,
+            apikey_id: rule.client,
+            meta_id: rule.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(iprules::table)
+            .values(&new_rule)
+            .get_result::<PostgresIpRule>(conn)?;
+
+        rule.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, rule: &IpRule) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            iprules.filter(id.eq(rule.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &rule.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresIpRule) -> Result<IpRule, Box<dyn Error>> {
+        let meta = get_meta_repository().find(result.meta_id)?;
+        let kind = match Action::from_str(&result.action) {
+            Some(kind) => kind,
+            None => return Err(format!("ip rule {} has an unknown action {}", result.id, result.action).into()),
+        };
+
+        Ok(IpRule{
+            id: result.id,
+            cidr: Cidr::from_str(&result.cidr)?,
+            action: kind,
+            scope: result.scope.clone(),
+            client: result.apikey_id,
+            meta: meta,
+        })
+    }
+}
+
+impl IpRuleRepository for PostgresIpRuleRepository {
+    fn find(&self, target: i32) -> Result<IpRule, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            iprules.filter(id.eq(target))
+                   .load::<PostgresIpRule>(&connection)?
+        };
+
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresIpRuleRepository::build(&results[0])
+    }
+
+    fn find_all(&self) -> Result<Vec<IpRule>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            iprules.order(id.asc())
+                   .load::<PostgresIpRule>(&connection)?
+        };
+
+        let mut all_rules = Vec::new();
+        for result in results.iter() {
+            all_rules.push(PostgresIpRuleRepository::build(result)?);
+        }
+
+        Ok(all_rules)
+    }
+
+    fn create(&self, rule: &mut IpRule) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresIpRuleRepository::create_on_conn(&conn, rule))?;
+        Ok(())
+    }
+
+    fn delete(&self, rule: &IpRule) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresIpRuleRepository::delete_on_conn(&conn, rule))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryIpRuleRepository {
+    table: memory::Table<IpRule>,
+}
+
+impl InMemoryIpRuleRepository {
+    pub fn new() -> Self {
+        InMemoryIpRuleRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl IpRuleRepository for InMemoryIpRuleRepository {
+    fn find(&self, target: i32) -> Result<IpRule, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_all(&self) -> Result<Vec<IpRule>, Box<dyn Error>>  {
+        self.table.find_all(|_| true)
+    }
+
+    fn create(&self, rule: &mut IpRule) -> Result<(), Box<dyn Error>> {
+        // in order to create an ip rule it must exists the metadata for this rule
+        get_meta_repository().create(&mut rule.meta)?;
+        self.table.insert(rule, |_| false, |rule, new_id| rule.id = new_id)
+    }
+
+    fn delete(&self, rule: &IpRule) -> Result<(), Box<dyn Error>> {
+        self.table.delete(rule.id)?;
+        get_meta_repository().delete(&rule.meta)
+    }
+}
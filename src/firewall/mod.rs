@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::IpRuleRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresIpRuleRepository),
+            Backend::Memory => Box::new(framework::InMemoryIpRuleRepository::new()),
+            backend => storage::unsupported(backend, "ip rules"),
+        }
+    }; 
+}   
+
+pub fn get_repository() -> Box<&'static dyn domain::IpRuleRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
@@ -0,0 +1,138 @@
+//! Mutation based fuzzing for the parsers of attacker-controlled input, such as tokens, keys and forms. Every target
+//! is given its valid inputs as seeds, and gets fed with random mutations of them, so their edge cases get explored
+//! while the whole run stays deterministic: a failing input is found again by just running the same test.
+//!
+//! Runs are as long as FUZZ_ITERATIONS tells, if set, so the suite keeps fast while longer runs may be started at will
+//! (e.g. FUZZ_ITERATIONS=1000000 cargo test fuzz_). FUZZ_SEED changes the seed of the mutations.
+
+use std::env;
+use std::panic::{self, AssertUnwindSafe};
+use rand::{Rng, SeedableRng};
+use rand::rngs::StdRng;
+
+const FUZZ_ITERATIONS: &str = "FUZZ_ITERATIONS";
+const FUZZ_SEED: &str = "FUZZ_SEED";
+
+const DEFAULT_ITERATIONS: usize = 2000;
+const DEFAULT_SEED: u64 = 0x7a07;
+const MAX_INPUT_LEN: usize = 4096;
+
+// bytes having a meaning for most of the parsers, so mutations get past the very first checks more often
+const INTERESTING: &[u8] = b".=&%+-_/:;,{}[]\"\\\0\n\r ";
+
+/// Feeds the given target with the given seeds and random mutations of them. The target may reject any input, but it
+/// must never panic: if it does, the run fails telling the base64 of the input that made it
+pub fn fuzz<F: Fn(&[u8])>(seeds: &[&[u8]], target: F) {
+    let iterations = env::var(FUZZ_ITERATIONS).ok()
+        .map(|value| value.parse().expect("fuzz iterations must be a number"))
+        .unwrap_or(DEFAULT_ITERATIONS);
+
+    let seed = env::var(FUZZ_SEED).ok()
+        .map(|value| value.parse().expect("fuzz seed must be a number"))
+        .unwrap_or(DEFAULT_SEED);
+
+    let mut rng = StdRng::seed_from_u64(seed);
+    let inputs = seeds.iter().map(|seed| seed.to_vec())
+        .chain((0..iterations).map(|_| mutate(&mut rng, seeds)));
+
+    for input in inputs {
+        if panic::catch_unwind(AssertUnwindSafe(|| target(&input))).is_err() {
+            panic!("fuzz target panicked on input {}", base64::encode(&input));
+        }
+    }
+}
+
+/// Same as fuzz, but for targets taking strings: mutations are turned into strings lossily
+pub fn fuzz_str<F: Fn(&str)>(seeds: &[&str], target: F) {
+    let seeds: Vec<&[u8]> = seeds.iter().map(|seed| seed.as_bytes()).collect();
+    fuzz(&seeds, |input| target(&String::from_utf8_lossy(input)));
+}
+
+/// Returns a random seed having gone through a few random mutations
+fn mutate(rng: &mut StdRng, seeds: &[&[u8]]) -> Vec<u8> {
+    let mut input = match seeds.len() {
+        0 => Vec::new(),
+        len => seeds[rng.gen_range(0..len)].to_vec(),
+    };
+
+    for _ in 0..rng.gen_range(1..=8) {
+        let len = input.len();
+        match rng.gen_range(0..7) {
+            0 if len > 0 => {
+                let index = rng.gen_range(0..len);
+                input[index] ^= 1u8 << rng.gen_range(0..8u32);
+            },
+            1 if len > 0 => {
+                let index = rng.gen_range(0..len);
+                input[index] = rng.gen();
+            },
+            2 => {
+                let index = rng.gen_range(0..=len);
+                input.insert(index, INTERESTING[rng.gen_range(0..INTERESTING.len())]);
+            },
+            3 if len > 0 => {
+                let start = rng.gen_range(0..len);
+                let end = rng.gen_range(start..=len);
+                input = [&input[..start], &input[end..]].concat();
+            },
+            4 if len > 0 => {
+                // repeats a chunk of the input, so lengths and nesting get stressed
+                let start = rng.gen_range(0..len);
+                let end = rng.gen_range(start..=len.min(start + 64));
+                let index = rng.gen_range(0..=len);
+                input = [&input[..index], &input[start..end], &input[index..]].concat();
+            },
+            5 if seeds.len() > 0 => {
+                // splices the tail of another seed, so parts of valid inputs get mixed up
+                let other = seeds[rng.gen_range(0..seeds.len())];
+                let index = rng.gen_range(0..=len);
+                let from = rng.gen_range(0..=other.len());
+                input.truncate(index);
+                input.extend_from_slice(&other[from..]);
+            },
+            _ => input.truncate(rng.gen_range(0..=len)),
+        }
+    }
+
+    input.truncate(MAX_INPUT_LEN);
+    input
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::cell::Cell;
+    use rand::SeedableRng;
+    use rand::rngs::StdRng;
+    use super::{fuzz, mutate, MAX_INPUT_LEN};
+
+    #[test]
+    fn mutate_should_be_deterministic() {
+        let seeds: &[&[u8]] = &[b"hello world", b"key=value"];
+        let mut first = StdRng::seed_from_u64(1);
+        let mut second = StdRng::seed_from_u64(1);
+        for _ in 0..100 {
+            let input = mutate(&mut first, seeds);
+            assert!(input.len() <= MAX_INPUT_LEN);
+            assert_eq!(input, mutate(&mut second, seeds));
+        }
+    }
+
+    #[test]
+    fn fuzz_should_feed_the_seeds() {
+        let seeds: &[&[u8]] = &[b"seed"];
+        let seen = Cell::new(false);
+        fuzz(seeds, |input| if input == b"seed" {
+            seen.set(true);
+        });
+
+        assert!(seen.get());
+    }
+
+    #[test]
+    #[should_panic(expected = "fuzz target panicked")]
+    fn fuzz_should_fail() {
+        let seeds: &[&[u8]] = &[b"seed"];
+        fuzz(seeds, |input| assert!(input.len() == 0));
+    }
+}
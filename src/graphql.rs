@@ -0,0 +1,286 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::net::SocketAddr;
+use async_graphql::{Context, EmptySubscription, InputObject, Object, Schema, SimpleObject};
+use hyper::{Body, Method, Server, StatusCode};
+use hyper::header::{CONTENT_TYPE, COOKIE};
+use hyper::service::{make_service_fn, service_fn};
+use tower::Layer;
+use http::HeaderMap;
+
+use crate::constants::settings;
+use crate::headers::HeadersLayer;
+use crate::time::unix_timestamp;
+use crate::user::domain::User;
+use crate::user::application::{user_info, user_update_profile};
+use crate::session::application::{session_introspect, session_logout, session_resolve_cookie};
+use crate::session::domain::CookieCodec;
+use crate::device::application::device_list;
+use crate::policy::domain::PolicyKind;
+use crate::policy::application::policy_latest;
+
+const GRAPHQL_PATH: &str = "/graphql";
+const TOKEN_HEADER: &str = "token";
+
+type TpauthSchema = Schema<Query, Mutation, EmptySubscription>;
+
+/// The token the request bears, if any, as provided to every resolver
+struct Credential(Option<String>);
+
+fn get_token<'a>(ctx: &Context<'a>) -> async_graphql::Result<&'a str> {
+    match ctx.data::<Credential>()? {
+        Credential(Some(token)) => Ok(token),
+        Credential(None) => Err("token required".into()),
+    }
+}
+
+fn into_result<T>(result: Result<T, Box<dyn Error>>) -> async_graphql::Result<T> {
+    result.map_err(|err| async_graphql::Error::new(err.to_string()))
+}
+
+#[derive(SimpleObject)]
+struct Attribute {
+    name: String,
+    value: String,
+}
+
+#[derive(InputObject)]
+struct AttributeInput {
+    name: String,
+    value: String, // empty to remove the attribute
+}
+
+#[derive(SimpleObject)]
+struct Consent {
+    kind: String,
+    version: i32,  // the version accepted by the user, being 0 if none
+    current: bool, // whether the accepted version is the latest one
+}
+
+#[derive(SimpleObject)]
+struct Device {
+    id: i32,
+    name: String,
+    trusted: bool,
+    last_seen_at: u64,
+}
+
+#[derive(SimpleObject)]
+struct Session {
+    elevated: bool,
+    impersonator: i32, // the administrator acting as the user, being 0 if none
+}
+
+/// The owner of the session the request is authenticated by, along with everything it owns
+struct Profile(User);
+
+#[Object]
+impl Profile {
+    async fn id(&self) -> i32 {
+        self.0.get_id()
+    }
+
+    async fn email(&self) -> &str {
+        self.0.get_email()
+    }
+
+    async fn aliases(&self) -> &[String] {
+        self.0.get_aliases()
+    }
+
+    async fn username(&self) -> Option<&str> {
+        self.0.get_username()
+    }
+
+    async fn verified(&self) -> bool {
+        self.0.is_verified()
+    }
+
+    async fn attributes(&self) -> Vec<Attribute> {
+        let mut attributes: Vec<Attribute> = self.0.get_attributes().iter()
+            .map(|(name, value)| Attribute{name: name.clone(), value: value.clone()})
+            .collect();
+
+        attributes.sort_by(|a, b| a.name.cmp(&b.name));
+        attributes
+    }
+
+    async fn consents(&self) -> Vec<Consent> {
+        [PolicyKind::Terms, PolicyKind::Privacy].iter().map(|kind| {
+            let version = self.0.get_policy_version(*kind);
+            Consent {
+                kind: kind.as_str().to_string(),
+                version: version,
+                current: policy_latest(*kind).map(|latest| latest.get_version() == version).unwrap_or(true),
+            }
+        }).collect()
+    }
+
+    async fn devices(&self, ctx: &Context<'_>) -> async_graphql::Result<Vec<Device>> {
+        let devices = into_result(device_list(get_token(ctx)?))?;
+        Ok(devices.iter().map(|device| Device{
+            id: device.get_id(),
+            name: device.get_name().to_string(),
+            trusted: device.is_trusted(),
+            last_seen_at: unix_timestamp(device.get_last_seen_at()) as u64,
+        }).collect())
+    }
+
+    async fn session(&self, ctx: &Context<'_>) -> async_graphql::Result<Session> {
+        let (_, elevated, impersonator) = into_result(session_introspect(get_token(ctx)?, false))?;
+        Ok(Session{elevated, impersonator})
+    }
+}
+
+struct Query;
+
+#[Object]
+impl Query {
+    async fn me(&self, ctx: &Context<'_>) -> async_graphql::Result<Profile> {
+        let (user, _) = into_result(user_info(get_token(ctx)?))?;
+        Ok(Profile(user))
+    }
+}
+
+struct Mutation;
+
+#[Object]
+impl Mutation {
+    /// closes the session for the app the token has been issued for
+    async fn logout(&self, ctx: &Context<'_>) -> async_graphql::Result<bool> {
+        into_result(session_logout(get_token(ctx)?))?;
+        Ok(true)
+    }
+
+    /// sets the given attributes of the user, keeping the rest of them as they are, as well as its username, if any
+    async fn update_profile(&self,
+                            ctx: &Context<'_>,
+                            attributes: Vec<AttributeInput>,
+                            username: Option<String>) -> async_graphql::Result<Profile> {
+
+        let attributes: HashMap<String, String> = attributes.into_iter()
+            .map(|attribute| (attribute.name, attribute.value))
+            .collect();
+
+        let user = into_result(user_update_profile(get_token(ctx)?, &attributes, username.as_deref()))?;
+        Ok(Profile(user))
+    }
+}
+
+/// Returns the token the request bears in its token header or, if none, in its token cookie
+fn get_request_token(headers: &HeaderMap) -> Option<String> {
+    if let Some(token) = headers.get(TOKEN_HEADER).and_then(|value| value.to_str().ok()) {
+        return Some(token.to_string());
+    }
+
+    headers.get_all(COOKIE).iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|cookies| cookies.split(';'))
+        .filter_map(|cookie| {
+            let mut parts = cookie.trim().splitn(2, '=');
+            match (parts.next(), parts.next()) {
+                (Some(name), Some(value)) if name == settings::COOKIE_NAME && value.len() > 0 => Some(value.to_string()),
+                _ => None,
+            }
+        })
+        .next()
+}
+
+fn new_response(status: StatusCode, body: Body) -> hyper::Response<Body> {
+    let mut response = hyper::Response::new(body);
+    *response.status_mut() = status;
+    response
+}
+
+async fn handle(schema: TpauthSchema, request: hyper::Request<Body>) -> Result<hyper::Response<Body>, Infallible> {
+    if request.uri().path() != GRAPHQL_PATH {
+        return Ok(new_response(StatusCode::NOT_FOUND, Body::empty()));
+    }
+
+    if request.method() != Method::POST {
+        return Ok(new_response(StatusCode::METHOD_NOT_ALLOWED, Body::empty()));
+    }
+
+    // opaque cookies stand for the token every resolver takes, so they get resolved once per request
+    let token = match get_request_token(request.headers()) {
+        Some(token) if CookieCodec::is_opaque(&token) => session_resolve_cookie(&token).ok(),
+        token => token,
+    };
+
+    let body = match hyper::body::to_bytes(request.into_body()).await {
+        Ok(body) if body.len() <= settings::GRAPHQL_MAX_BODY => body,
+        Ok(_) => return Ok(new_response(StatusCode::PAYLOAD_TOO_LARGE, Body::empty())),
+        Err(err) => {
+            warn!("could not read graphql request: {}", err);
+            return Ok(new_response(StatusCode::BAD_REQUEST, Body::empty()));
+        }
+    };
+
+    let query: async_graphql::Request = match serde_json::from_slice(&body) {
+        Ok(query) => query,
+        Err(err) => return Ok(new_response(StatusCode::BAD_REQUEST, Body::from(err.to_string()))),
+    };
+
+    let result = schema.execute(query.data(Credential(token))).await;
+    let body = match serde_json::to_string(&result) {
+        Ok(body) => body,
+        Err(err) => {
+            error!("could not encode graphql response: {}", err);
+            return Ok(new_response(StatusCode::INTERNAL_SERVER_ERROR, Body::empty()));
+        }
+    };
+
+    let mut response = hyper::Response::new(Body::from(body));
+    if let Ok(format) = "application/json".parse() {
+        response.headers_mut().insert(CONTENT_TYPE, format);
+    }
+
+    Ok(response)
+}
+
+/// Serves the account and session queries, and the logout and profile update mutations, as a GraphQL endpoint at the
+/// /graphql path of the given address. Requests are authenticated by the token in their token header or cookie
+pub async fn serve(addr: SocketAddr) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let schema = Schema::build(Query, Mutation, EmptySubscription)
+        .limit_depth(settings::GRAPHQL_MAX_DEPTH)
+        .limit_complexity(settings::GRAPHQL_MAX_COMPLEXITY)
+        .finish();
+
+    let make_service = make_service_fn(move |_| {
+        let schema = schema.clone();
+        async move {
+            let service = service_fn(move |request| handle(schema.clone(), request));
+            Ok::<_, Infallible>(HeadersLayer::new().layer(service))
+        }
+    });
+
+    Server::try_bind(&addr)?.serve(make_service).await?;
+    Ok(())
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use http::HeaderMap;
+    use super::get_request_token;
+
+    #[test]
+    fn get_request_token_should_not_fail() {
+        let mut headers = HeaderMap::new();
+        assert_eq!(None, get_request_token(&headers));
+
+        headers.insert("cookie", "theme=dark; token=abc.def.ghi".parse().unwrap());
+        assert_eq!(Some("abc.def.ghi".to_string()), get_request_token(&headers));
+
+        headers.insert("token", "header.token.value".parse().unwrap());
+        assert_eq!(Some("header.token.value".to_string()), get_request_token(&headers));
+    }
+
+    #[test]
+    fn get_request_token_should_fail() {
+        let mut headers = HeaderMap::new();
+        headers.insert("cookie", "remember=abc.def.ghi; token=".parse().unwrap());
+        assert_eq!(None, get_request_token(&headers));
+    }
+}
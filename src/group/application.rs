@@ -0,0 +1,68 @@
+use std::error::Error;
+use crate::constants::errors;
+use crate::metadata::domain::Metadata;
+use crate::user::get_repository as get_user_repository;
+use super::{
+    get_repository as get_group_repository,
+    domain::Group,
+};
+
+/// Makes sure every member of the given group is a user of its own tenant. Deleted users are kept as members until
+/// they get purged, so they are back in their groups if restored
+fn check_members(group: &Group) -> Result<(), Box<dyn Error>> {
+    for user_id in group.get_members() {
+        let user = get_user_repository().find(*user_id)?;
+        if user.get_tenant() != group.get_tenant() {
+            return Err(errors::NOT_FOUND.into());
+        }
+    }
+
+    Ok(())
+}
+
+/// If, and only if, there is no group with the same name in the given tenant and all the given members are users of
+/// that tenant, a new group with these name and members is created into the tenant
+pub fn group_create(tenant: i32,
+                    name: &str,
+                    members: &[i32]) -> Result<Group, Box<dyn Error>> {
+
+    info!("got a group creation request for group {} ", name);
+
+    let mut group = Group::new(Metadata::new(), tenant, name)?;
+    members.iter().for_each(|user_id| group.add_member(*user_id));
+    check_members(&group)?;
+
+    get_group_repository().create(&mut group)?;
+    Ok(group)
+}
+
+/// Returns the group with the given id if, and only if, it belongs to the given tenant
+pub fn group_find(tenant: i32, id: i32) -> Result<Group, Box<dyn Error>> {
+    let group = get_group_repository().find(id)?;
+    if group.get_tenant() != tenant {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    Ok(group)
+}
+
+/// Returns all the groups of the given tenant
+pub fn group_list(tenant: i32) -> Result<Vec<Group>, Box<dyn Error>> {
+    get_group_repository().find_all_by_tenant(tenant)
+}
+
+/// Saves the given group, once changed, if, and only if, all its members are users of its tenant
+pub fn group_save(group: &Group) -> Result<(), Box<dyn Error>> {
+    info!("got a group update request for group {} ", group.get_id());
+
+    check_members(group)?;
+    get_group_repository().save(group)
+}
+
+/// Removes the group with the given id, if it belongs to the given tenant. Its members are kept
+pub fn group_delete(tenant: i32, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a group deletion request for group {} ", id);
+
+    let group = group_find(tenant, id)?;
+    get_group_repository().delete(&group)
+}
@@ -0,0 +1,127 @@
+use std::error::Error;
+use crate::constants::{errors, settings};
+use crate::metadata::domain::Metadata;
+
+pub trait GroupRepository {
+    fn find(&self, id: i32) -> Result<Group, Box<dyn Error>>;
+    fn find_all_by_tenant(&self, tenant_id: i32) -> Result<Vec<Group>, Box<dyn Error>>;
+    fn create(&self, group: &mut Group) -> Result<(), Box<dyn Error>>;
+    fn save(&self, group: &Group) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, group: &Group) -> Result<(), Box<dyn Error>>;
+}
+
+/// A named set of users of a tenant, as provisioned by its identity provider
+#[derive(Clone)]
+pub struct Group {
+    pub(super) id: i32,
+    pub(super) tenant: i32,
+    pub(super) name: String,
+    pub(super) members: Vec<i32>, // the ids of the users in the group
+    pub(super) meta: Metadata,
+}
+
+impl Group {
+    pub fn new(meta: Metadata,
+               tenant: i32,
+               name: &str) -> Result<Self, Box<dyn Error>> {
+
+        let mut group = Group {
+            id: 0,
+            tenant: tenant,
+            name: "".to_string(),
+            members: Vec::new(),
+            meta: meta,
+        };
+
+        group.rename(name)?;
+        Ok(group)
+    }
+
+    pub fn rename(&mut self, name: &str) -> Result<(), Box<dyn Error>> {
+        let name = name.trim();
+        if name.len() == 0 || name.len() > settings::GROUP_NAME_LEN {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        self.name = name.to_string();
+        Ok(())
+    }
+
+    /// Adds the given user to the group, if not already in it
+    pub fn add_member(&mut self, user_id: i32) {
+        if !self.members.contains(&user_id) {
+            self.members.push(user_id);
+        }
+    }
+
+    pub fn remove_member(&mut self, user_id: i32) {
+        self.members.retain(|member| *member != user_id);
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn get_members(&self) -> &[i32] {
+        &self.members
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use crate::metadata::domain::tests::new_metadata;
+    use crate::constants::settings;
+    use super::Group;
+
+    pub fn new_group() -> Group {
+        Group{
+            id: 999,
+            tenant: 1,
+            name: "engineering".to_string(),
+            members: vec![1, 2],
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn group_new_should_not_fail() {
+        let group = Group::new(new_metadata(), 1, " engineering ").unwrap();
+
+        assert_eq!(0, group.id);
+        assert_eq!(1, group.tenant);
+        assert_eq!("engineering", group.name);
+        assert_eq!(0, group.members.len());
+    }
+
+    #[test]
+    fn group_new_should_fail() {
+        assert!(Group::new(new_metadata(), 1, "").is_err());
+        assert!(Group::new(new_metadata(), 1, "   ").is_err());
+        assert!(Group::new(new_metadata(), 1, &"a".repeat(settings::GROUP_NAME_LEN + 1)).is_err());
+    }
+
+    #[test]
+    fn group_add_member_should_not_duplicate() {
+        let mut group = new_group();
+        group.add_member(2);
+        group.add_member(3);
+        assert_eq!(&[1, 2, 3], group.get_members());
+    }
+
+    #[test]
+    fn group_remove_member_should_not_fail() {
+        let mut group = new_group();
+        group.remove_member(1);
+        group.remove_member(3);
+        assert_eq!(&[2], group.get_members());
+    }
+}
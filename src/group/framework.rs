@@ -0,0 +1,221 @@
+use std::error::Error;
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::{groups, group_members};
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use super::domain::{Group, GroupRepository};
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[table_name = "groups"]
+struct PostgresGroup {
+    pub id: i32,
+    pub tenant_id: i32,
+    pub name: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "groups"]
+struct NewPostgresGroup<'a> {
+    pub tenant_id: i32,
+    pub name: &'a str,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "group_members"]
+struct NewPostgresGroupMember {
+    pub group_id: i32,
+    pub user_id: i32,
+}
+
+pub struct PostgresGroupRepository;
+
+impl PostgresGroupRepository {
+    fn create_on_conn(conn: &PgConnection, group: &mut Group) -> Result<(), PgError>  {
+        // in order to create a group it must exists the metadata for this group
+        PostgresMetadataRepository::create_on_conn(conn, &mut group.meta)?;
+
+        let new_group = NewPostgresGroup {
+            tenant_id: group.tenant,
+            name: &group.name,
+            meta_id: group.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(groups::table)
+            .values(&new_group)
+            .get_result::<PostgresGroup>(conn)?;
+
+        group.id = result.id;
+        PostgresGroupRepository::save_members_on_conn(conn, group)
+    }
+
+    fn save_members_on_conn(conn: &PgConnection, group: &Group) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            group_members::table.filter(group_members::group_id.eq(group.id))
+        ).execute(conn)?;
+
+        let new_members: Vec<NewPostgresGroupMember> = group.members.iter()
+            .map(|user_id| NewPostgresGroupMember {
+                group_id: group.id,
+                user_id: *user_id,
+            })
+            .collect();
+
+        if new_members.len() > 0 {
+            diesel::insert_into(group_members::table)
+                .values(&new_members)
+                .execute(conn)?;
+        }
+
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, group: &Group) -> Result<(), PgError>  {
+        // the members of the group get removed along with it
+        let _result = diesel::delete(
+            groups::table.filter(groups::id.eq(group.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &group.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresGroup) -> Result<Group, Box<dyn Error>> {
+        let members = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            group_members::table.filter(group_members::group_id.eq(result.id))
+                                .order(group_members::id.asc())
+                                .select(group_members::user_id)
+                                .load::<i32>(&connection)?
+        };
+
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(Group{
+            id: result.id,
+            tenant: result.tenant_id,
+            name: result.name.clone(),
+            members: members,
+            meta: meta,
+        })
+    }
+}
+
+impl GroupRepository for PostgresGroupRepository {
+    fn find(&self, target: i32) -> Result<Group, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            groups::table.filter(groups::id.eq(target))
+                         .load::<PostgresGroup>(&connection)?
+        };
+
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresGroupRepository::build(&results[0])
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<Group>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            groups::table.filter(groups::tenant_id.eq(target))
+                         .order(groups::id.asc())
+                         .load::<PostgresGroup>(&connection)?
+        };
+
+        let mut all_groups = Vec::new();
+        for result in results.iter() {
+            all_groups.push(PostgresGroupRepository::build(result)?);
+        }
+
+        Ok(all_groups)
+    }
+
+    fn create(&self, group: &mut Group) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresGroupRepository::create_on_conn(&conn, group))?;
+        Ok(())
+    }
+
+    fn save(&self, group: &Group) -> Result<(), Box<dyn Error>> {
+        let pg_group = PostgresGroup {
+            id: group.id,
+            tenant_id: group.tenant,
+            name: group.name.clone(),
+            meta_id: group.meta.get_id(),
+        };
+
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| {
+            diesel::update(groups::table)
+                .filter(groups::id.eq(group.id))
+                .set(&pg_group)
+                .execute(&conn)?;
+
+            PostgresGroupRepository::save_members_on_conn(&conn, group)
+        })?;
+
+        Ok(())
+    }
+
+    fn delete(&self, group: &Group) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresGroupRepository::delete_on_conn(&conn, group))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryGroupRepository {
+    table: memory::Table<Group>,
+}
+
+impl InMemoryGroupRepository {
+    pub fn new() -> Self {
+        InMemoryGroupRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl GroupRepository for InMemoryGroupRepository {
+    fn find(&self, target: i32) -> Result<Group, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<Group>, Box<dyn Error>>  {
+        self.table.find_all(|group| group.tenant == target)
+    }
+
+    fn create(&self, group: &mut Group) -> Result<(), Box<dyn Error>> {
+        // in order to create a group it must exists the metadata for this group
+        get_meta_repository().create(&mut group.meta)?;
+        let (tenant, name) = (group.tenant, group.name.clone());
+        self.table.insert(group, |other| other.tenant == tenant && other.name == name,
+                          |group, new_id| group.id = new_id)
+    }
+
+    fn save(&self, group: &Group) -> Result<(), Box<dyn Error>> {
+        self.table.update(group.id, group)
+    }
+
+    fn delete(&self, group: &Group) -> Result<(), Box<dyn Error>> {
+        self.table.delete(group.id)?;
+        get_meta_repository().delete(&group.meta)
+    }
+}
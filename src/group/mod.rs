@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::GroupRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresGroupRepository),
+            Backend::Memory => Box::new(framework::InMemoryGroupRepository::new()),
+            backend => storage::unsupported(backend, "groups"),
+        }
+    };
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::GroupRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
@@ -0,0 +1,149 @@
+use std::error::Error;
+use std::sync::{Arc, Mutex};
+use std::sync::mpsc::{self, SyncSender, Receiver, TrySendError};
+use std::thread;
+
+use crate::config;
+use crate::metrics;
+use crate::constants::{environment, errors, settings};
+
+type Job = Box<dyn FnOnce() + Send>;
+
+lazy_static! {
+    static ref POOL: HashingPool = {
+        let workers = match config::get(environment::HASH_WORKERS) {
+            Ok(workers) => workers.parse().expect("hash workers must be a number"),
+            Err(_) => settings::HASH_WORKERS,
+        };
+
+        let queue = match config::get(environment::HASH_QUEUE) {
+            Ok(queue) => queue.parse().expect("hash queue must be a number"),
+            Err(_) => settings::HASH_QUEUE,
+        };
+
+        HashingPool::new(workers, queue)
+    };
+}
+
+/// A fixed set of threads password digests are computed by, so a spike of logins takes no more cpu than these threads
+/// do, leaving the rest for any other request. Digests beyond the workers wait in a bounded queue, and once it is full
+/// any other fails fast instead of piling up
+pub struct HashingPool {
+    sender: SyncSender<Job>,
+}
+
+impl HashingPool {
+    pub fn new(workers: usize, queue: usize) -> Self {
+        let (sender, receiver) = mpsc::sync_channel::<Job>(queue);
+        let receiver = Arc::new(Mutex::new(receiver));
+        for id in 0..workers.max(1) {
+            let receiver = receiver.clone();
+            thread::Builder::new()
+                .name(format!("hashing-{}", id))
+                .spawn(move || HashingPool::work(receiver))
+                .expect("hashing worker must be spawned");
+        }
+
+        HashingPool {
+            sender: sender,
+        }
+    }
+
+    // runs the jobs of the queue, one at a time, until the pool is dropped
+    fn work(receiver: Arc<Mutex<Receiver<Job>>>) {
+        loop {
+            let job = match receiver.lock() {
+                Ok(receiver) => receiver.recv(),
+                Err(err) => {
+                    error!("lock for hashing queue got poisoned: {}", err);
+                    return;
+                }
+            };
+
+            match job {
+                Ok(job) => job(),
+                Err(_) => return,
+            }
+        }
+    }
+
+    /// Runs the given closure by any of the workers, waiting for its result. If the queue is full, it fails right
+    /// away with OVERLOADED
+    pub fn run<T, F>(&self, f: F) -> Result<T, Box<dyn Error>>
+    where
+        T: Send + 'static,
+        F: FnOnce() -> T + Send + 'static,
+    {
+        let (result_sender, result_receiver) = mpsc::channel();
+        let job: Job = Box::new(move || {
+            // the caller may be gone already, so the result has no one to be sent to
+            let _ = result_sender.send(f());
+        });
+
+        match self.sender.try_send(job) {
+            Ok(_) => {},
+            Err(TrySendError::Full(_)) => {
+                metrics::request_shed("hashing");
+                warn!("password hashing queue is full, failing fast");
+                return Err(errors::OVERLOADED.into());
+            },
+            Err(TrySendError::Disconnected(_)) => {
+                error!("password hashing workers are gone");
+                return Err(errors::HAS_FAILED.into());
+            },
+        };
+
+        result_receiver.recv().map_err(|err| {
+            error!("password hashing job got lost: {}", err);
+            errors::HAS_FAILED.into()
+        })
+    }
+}
+
+/// Runs the given closure, which computes some password digest, by the shared hashing pool
+pub fn hashing_run<T, F>(f: F) -> Result<T, Box<dyn Error>>
+where
+    T: Send + 'static,
+    F: FnOnce() -> T + Send + 'static,
+{
+    POOL.run(f)
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::sync::{Arc, Barrier};
+    use std::sync::mpsc;
+    use std::thread;
+    use crate::constants::errors;
+    use super::HashingPool;
+
+    #[test]
+    fn hashing_pool_run_should_not_fail() {
+        let pool = HashingPool::new(2, 4);
+        let results: Vec<usize> = (0..8).map(|i| pool.run(move || i * 2).unwrap()).collect();
+        assert_eq!(vec![0, 2, 4, 6, 8, 10, 12, 14], results);
+    }
+
+    #[test]
+    fn hashing_pool_run_should_fail_fast() {
+        // with no room in the queue at all, jobs are only taken while the worker is idle
+        let pool = Arc::new(HashingPool::new(1, 0));
+        let (started_sender, started) = mpsc::channel();
+        let release = Arc::new(Barrier::new(2));
+        let blocked = {
+            let (pool, release) = (pool.clone(), release.clone());
+            thread::spawn(move || pool.run(move || {
+                started_sender.send(()).unwrap();
+                release.wait();
+            }).map_err(|err| err.to_string()))
+        };
+
+        started.recv().unwrap();
+        let result = pool.run(|| ());
+        assert_eq!(errors::OVERLOADED, result.unwrap_err().to_string());
+
+        release.wait();
+        assert!(blocked.join().unwrap().is_ok());
+    }
+}
@@ -0,0 +1,124 @@
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Arc;
+use std::task::{Context, Poll};
+use http::{HeaderMap, HeaderValue};
+use http::header::{
+    HeaderName, CACHE_CONTROL, CONTENT_SECURITY_POLICY, REFERRER_POLICY, STRICT_TRANSPORT_SECURITY,
+    X_CONTENT_TYPE_OPTIONS, X_FRAME_OPTIONS,
+};
+use tower::{Layer, Service};
+
+const STRICT_TRANSPORT: &str = "max-age=31536000; includeSubDomains";
+const NO_CONTENT_POLICY: &str = "default-src 'none'; frame-ancestors 'none'";
+
+/// A layer setting the security headers of every response served by the services it wraps: no caching, no framing,
+/// no referrer, no content sniffing, transport over https only and, unless told otherwise, no content being loaded
+/// at all. Responses setting any of these headers by themselves keep their own value, so each route may configure
+/// the ones it needs apart from the defaults of its server
+#[derive(Clone)]
+pub struct HeadersLayer {
+    headers: Arc<HeaderMap>,
+}
+
+impl HeadersLayer {
+    pub fn new() -> Self {
+        let mut headers = HeaderMap::new();
+        headers.insert(CACHE_CONTROL, HeaderValue::from_static("no-store"));
+        headers.insert(CONTENT_SECURITY_POLICY, HeaderValue::from_static(NO_CONTENT_POLICY));
+        headers.insert(X_FRAME_OPTIONS, HeaderValue::from_static("DENY"));
+        headers.insert(REFERRER_POLICY, HeaderValue::from_static("no-referrer"));
+        headers.insert(X_CONTENT_TYPE_OPTIONS, HeaderValue::from_static("nosniff"));
+        headers.insert(STRICT_TRANSPORT_SECURITY, HeaderValue::from_static(STRICT_TRANSPORT));
+        HeadersLayer { headers: Arc::new(headers) }
+    }
+
+    /// Returns the layer with the given value as default for the given header, in place of the one it had, if any
+    pub fn with(mut self, name: HeaderName, value: &'static str) -> Self {
+        Arc::make_mut(&mut self.headers).insert(name, HeaderValue::from_static(value));
+        self
+    }
+}
+
+impl<S> Layer<S> for HeadersLayer {
+    type Service = HeadersService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        HeadersService {
+            inner: inner,
+            headers: self.headers.clone(),
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct HeadersService<S> {
+    inner: S,
+    headers: Arc<HeaderMap>,
+}
+
+impl<S, B, R> Service<http::Request<B>> for HeadersService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<R>>,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let headers = self.headers.clone();
+        let future = self.inner.call(request);
+        Box::pin(async move {
+            let mut response = future.await?;
+            for (name, value) in headers.iter() {
+                response.headers_mut().entry(name).or_insert_with(|| value.clone());
+            }
+
+            Ok(response)
+        })
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::convert::Infallible;
+    use http::header::{CACHE_CONTROL, CONTENT_SECURITY_POLICY, STRICT_TRANSPORT_SECURITY, X_CONTENT_TYPE_OPTIONS};
+    use hyper::service::service_fn;
+    use tower::{Layer, Service};
+    use super::HeadersLayer;
+
+    #[test]
+    fn headers_service_should_not_fail() {
+        let runtime = tokio::runtime::Builder::new_current_thread().enable_all().build().unwrap();
+        runtime.block_on(async {
+            let layer = HeadersLayer::new().with(CONTENT_SECURITY_POLICY, "default-src 'self'");
+            let mut service = layer.layer(service_fn(|request: http::Request<()>| async move {
+                let mut response = http::Response::new(());
+                if request.uri().path() == "/cached" {
+                    response.headers_mut().insert(CACHE_CONTROL, "public, max-age=60".parse().unwrap());
+                }
+
+                Ok::<_, Infallible>(response)
+            }));
+
+            let request = http::Request::builder().uri("/served").body(()).unwrap();
+            let response = service.call(request).await.unwrap();
+            assert_eq!("no-store", response.headers()[CACHE_CONTROL]);
+            assert_eq!("nosniff", response.headers()[X_CONTENT_TYPE_OPTIONS]);
+            assert!(response.headers().contains_key(STRICT_TRANSPORT_SECURITY));
+            assert_eq!("default-src 'self'", response.headers()[CONTENT_SECURITY_POLICY]);
+
+            // headers set by the route itself are never overwritten by the defaults
+            let request = http::Request::builder().uri("/cached").body(()).unwrap();
+            let response = service.call(request).await.unwrap();
+            assert_eq!("public, max-age=60", response.headers()[CACHE_CONTROL]);
+            assert_eq!("nosniff", response.headers()[X_CONTENT_TYPE_OPTIONS]);
+        });
+    }
+}
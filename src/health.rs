@@ -0,0 +1,149 @@
+use std::error::Error;
+use std::time::{Duration, SystemTime};
+use std::sync::atomic::{AtomicBool, Ordering};
+use diesel::RunQueryDsl;
+use tonic_health::ServingStatus;
+use tonic_health::server::HealthReporter;
+
+use crate::postgres;
+use crate::mongo;
+use crate::cache;
+use crate::security::{self, TokenKind};
+use crate::time::unix_timestamp;
+use crate::storage::{self, Backend};
+use crate::constants::settings;
+
+pub const LIVENESS: &str = "liveness";
+pub const READINESS: &str = "readiness";
+
+// not ready until all the dependencies have been checked once
+static READY: AtomicBool = AtomicBool::new(false);
+static DRAINING: AtomicBool = AtomicBool::new(false);
+
+#[derive(Serialize, Deserialize)]
+struct Probe {
+    exp: usize,
+}
+
+impl TokenKind for Probe {
+    const KIND: &'static str = "probe+jwt";
+}
+
+/// All the dependencies the service may rely on to serve its requests
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Dependency {
+    Postgres,
+    Mongo,
+    Redis,
+    Keyring, // the secrets required to sign and verify tokens
+}
+
+impl Dependency {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Dependency::Postgres => "postgres",
+            Dependency::Mongo => "mongo",
+            Dependency::Redis => "redis",
+            Dependency::Keyring => "keyring",
+        }
+    }
+}
+
+/// Returns all the dependencies in use, as set by the storage backends of the repositories
+pub fn get_dependencies() -> Vec<Dependency> {
+    let mut dependencies = Vec::new();
+    if storage::get_backend(Backend::Postgres) == Backend::Postgres {
+        dependencies.push(Dependency::Postgres);
+    }
+
+    if storage::get_backend(Backend::Mongo) == Backend::Mongo {
+        dependencies.push(Dependency::Mongo);
+    }
+
+    if storage::get_session_backend() == Backend::Redis {
+        dependencies.push(Dependency::Redis);
+    }
+
+    dependencies.push(Dependency::Keyring);
+    dependencies
+}
+
+/// Fails if the given dependency cannot be reached
+pub fn check(dependency: Dependency) -> Result<(), Box<dyn Error>> {
+    match dependency {
+        Dependency::Postgres => {
+            let conn = postgres::get_connection().get()?;
+            diesel::sql_query("SELECT 1").execute(&conn)?;
+        },
+
+        Dependency::Mongo => mongo::ping()?,
+
+        Dependency::Redis => {
+            let mut conn = cache::get_connection()?;
+            redis::cmd("PING").query::<String>(&mut *conn)?;
+        },
+
+        Dependency::Keyring => {
+            // no token can be issued unless the current keys are able to sign and verify them
+            let exp = unix_timestamp(SystemTime::now() + Duration::from_secs(settings::HEALTH_PERIOD));
+            let token = security::encode_jwt(Probe{exp})?;
+            security::decode_jwt::<Probe>(&token)?;
+        },
+    }
+
+    Ok(())
+}
+
+fn get_status(healthy: bool) -> ServingStatus {
+    if healthy {ServingStatus::Serving} else {ServingStatus::NotServing}
+}
+
+async fn update(reporter: &mut HealthReporter) {
+    let mut all_serving = true;
+    for dependency in get_dependencies() {
+        let healthy = match tokio::task::spawn_blocking(move || check(dependency).map_err(|err| err.to_string())).await {
+            Ok(Ok(_)) => true,
+            Ok(Err(err)) => {
+                warn!("{} is not healthy: {}", dependency.as_str(), err);
+                false
+            },
+            Err(err) => {
+                error!("could not check whether {} is healthy: {}", dependency.as_str(), err);
+                false
+            },
+        };
+
+        all_serving = all_serving && healthy;
+        reporter.set_service_status(dependency.as_str(), get_status(healthy)).await;
+    }
+
+    // the service is alive as long as it keeps checking its dependencies, while it is only ready, as a whole (the
+    // empty name), if all of them are healthy
+    let all_serving = all_serving && !DRAINING.load(Ordering::Relaxed);
+    READY.store(all_serving, Ordering::Relaxed);
+    reporter.set_service_status(LIVENESS, ServingStatus::Serving).await;
+    reporter.set_service_status(READINESS, get_status(all_serving)).await;
+    reporter.set_service_status("", get_status(all_serving)).await;
+}
+
+/// Returns true if, and only if, all the dependencies were healthy the last time they got checked and the service is
+/// not shutting down
+pub fn is_ready() -> bool {
+    READY.load(Ordering::Relaxed) && !DRAINING.load(Ordering::Relaxed)
+}
+
+/// Reports the service as not ready from now on, since it is shutting down
+pub fn set_draining() {
+    DRAINING.store(true, Ordering::Relaxed);
+}
+
+/// Spawns a background task that periodically checks all the dependencies in use, reporting each of them through the
+/// health service by its own name, as well as the liveness and readiness of the service
+pub fn start_health_job(mut reporter: HealthReporter) {
+    tokio::spawn(async move {
+        loop {
+            update(&mut reporter).await;
+            tokio::time::sleep(Duration::from_secs(settings::HEALTH_PERIOD)).await;
+        }
+    });
+}
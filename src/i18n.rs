@@ -0,0 +1,432 @@
+use std::collections::HashMap;
+use std::error::Error;
+use std::fs;
+use std::future::Future;
+use std::path::Path;
+use std::pin::Pin;
+use std::sync::{Arc, RwLock};
+use std::task::{Context, Poll};
+use http::{HeaderMap, HeaderValue};
+use tower::{Layer, Service};
+
+use crate::constants::{environment, settings};
+use crate::config;
+
+const LOCALE_HEADER: &str = "locale";
+const ACCEPT_LANGUAGE_HEADER: &str = "accept-language";
+const CONTENT_LANGUAGE_HEADER: &str = "content-language";
+const GRPC_MESSAGE_HEADER: &str = "grpc-message";
+
+const BUNDLES: &[(&str, &str)] = &[
+    ("en", include_str!("../locales/en.json")),
+    ("es", include_str!("../locales/es.json")),
+];
+
+/// All the messages of a locale: error messages are keyed by themselves, in english, while email subjects are keyed
+/// by the kind of the email, the texts of the pages by their own name and the text messages by their kind
+#[derive(Deserialize, Clone, Default, Debug)]
+struct Bundle {
+    #[serde(default)]
+    errors: HashMap<String, String>,
+    #[serde(default)]
+    emails: HashMap<String, String>,
+    #[serde(default)]
+    pages: HashMap<String, String>,
+    #[serde(default)]
+    sms: HashMap<String, String>,
+}
+
+impl Bundle {
+    /// Sets the messages of the given bundle over these of this one, so only those to be changed need to be provided
+    fn extend(&mut self, other: Bundle) {
+        self.errors.extend(other.errors);
+        self.emails.extend(other.emails);
+        self.pages.extend(other.pages);
+        self.sms.extend(other.sms);
+    }
+}
+
+lazy_static! {
+    static ref LOCALES: RwLock<Arc<HashMap<String, Bundle>>> = {
+        let hook = || if let Err(err) = reload() {
+            error!("locales could not be reloaded, the current ones are kept: {}", err);
+        };
+
+        config::on_change(environment::LOCALES, hook);
+        config::on_change(environment::DEFAULT_LOCALE, hook);
+
+        let bundles = load().expect("locales must be a directory of <locale>.json bundles");
+        RwLock::new(Arc::new(bundles))
+    };
+}
+
+/// Returns the bundled locales along with these of the LOCALES directory, if any, which take precedence
+fn load() -> Result<HashMap<String, Bundle>, Box<dyn Error>> {
+    let mut bundles = HashMap::new();
+    for (locale, bundle) in BUNDLES {
+        bundles.insert(locale.to_string(), serde_json::from_str::<Bundle>(bundle)?);
+    }
+
+    let dir = match config::get(environment::LOCALES) {
+        Ok(dir) => dir,
+        Err(_) => return Ok(bundles),
+    };
+
+    for entry in fs::read_dir(Path::new(&dir))? {
+        let path = entry?.path();
+        let locale = match (path.file_stem().and_then(|stem| stem.to_str()), path.extension()) {
+            (Some(locale), Some(extension)) if extension == "json" => normalize(locale),
+            _ => continue,
+        };
+
+        let locale = match locale {
+            Some(locale) => locale,
+            None => {
+                warn!("file {} is not named after a locale, so it is ignored", path.display());
+                continue;
+            }
+        };
+
+        let bundle: Bundle = serde_json::from_str(&fs::read_to_string(&path)?)?;
+        bundles.entry(locale).or_insert_with(Bundle::default).extend(bundle);
+    }
+
+    Ok(bundles)
+}
+
+/// Loads all the locales again, so the bundles of the LOCALES directory get applied with no restart. Returns how many
+/// locales are supported
+pub fn reload() -> Result<usize, Box<dyn Error>> {
+    let bundles = load()?;
+    let count = bundles.len();
+    match LOCALES.write() {
+        Ok(mut current) => *current = Arc::new(bundles),
+        Err(err) => error!("write lock for locales got poisoned: {}", err),
+    }
+
+    info!("{} locales loaded", count);
+    Ok(count)
+}
+
+fn get_bundles() -> Arc<HashMap<String, Bundle>> {
+    match LOCALES.read() {
+        Ok(bundles) => Arc::clone(&bundles),
+        Err(err) => {
+            error!("read lock for locales got poisoned: {}", err);
+            Arc::new(HashMap::new())
+        }
+    }
+}
+
+/// Returns the given language tag as the locale it stands for, with the language in lowercase and the rest of the tag
+/// in uppercase (e.g. es-ES), if, and only if, it is well formed
+pub fn normalize(tag: &str) -> Option<String> {
+    let mut parts = tag.trim().split(|c| c == '-' || c == '_');
+    let language = parts.next()?;
+    if language.len() < 2 || language.len() > 3 || !language.chars().all(|c| c.is_ascii_alphabetic()) {
+        return None;
+    }
+
+    let mut locale = language.to_ascii_lowercase();
+    for part in parts {
+        if part.len() == 0 || part.len() > 8 || !part.chars().all(|c| c.is_ascii_alphanumeric()) {
+            return None;
+        }
+
+        locale.push('-');
+        locale.push_str(&part.to_ascii_uppercase());
+    }
+
+    Some(locale)
+}
+
+/// Returns the locales of the given accept-language header, from the most preferred to the least one. Wildcards and
+/// malformed tags are ignored
+pub fn parse_accept_language(header: &str) -> Vec<String> {
+    let mut locales: Vec<(String, f32)> = header.split(',')
+        .filter_map(|item| {
+            let mut parts = item.split(';');
+            let locale = normalize(parts.next()?)?;
+            let quality = parts
+                .filter_map(|param| param.trim().strip_prefix("q="))
+                .filter_map(|quality| quality.parse::<f32>().ok())
+                .next()
+                .unwrap_or(1.0);
+
+            Some((locale, quality))
+        })
+        .filter(|(_, quality)| *quality > 0.0)
+        .collect();
+
+    // the sort is stable, so locales of the same quality keep their order
+    locales.sort_by(|(_, a), (_, b)| b.partial_cmp(a).unwrap_or(std::cmp::Ordering::Equal));
+    locales.into_iter().map(|(locale, _)| locale).collect()
+}
+
+/// Returns the locales requested by the given headers, from the most preferred to the least one: the one of the locale
+/// header, if any, followed by these of the accept-language header
+pub fn get_requested(headers: &HeaderMap) -> Vec<String> {
+    let mut locales = Vec::new();
+    if let Some(locale) = headers.get(LOCALE_HEADER).and_then(|value| value.to_str().ok()).and_then(normalize) {
+        locales.push(locale);
+    }
+
+    if let Some(header) = headers.get(ACCEPT_LANGUAGE_HEADER).and_then(|value| value.to_str().ok()) {
+        locales.extend(parse_accept_language(header));
+    }
+
+    locales
+}
+
+/// Returns the locale set as DEFAULT_LOCALE, if any, or english otherwise
+pub fn get_default() -> String {
+    config::get(environment::DEFAULT_LOCALE)
+        .ok()
+        .and_then(|locale| normalize(&locale))
+        .unwrap_or(settings::DEFAULT_LOCALE.to_string())
+}
+
+/// Returns the first supported locale out of the given ones, or the default one if none is. A locale whose region is
+/// not supported falls back to its language alone (e.g. es-MX to es)
+pub fn negotiate<S: AsRef<str>>(candidates: &[S]) -> String {
+    let bundles = get_bundles();
+    for candidate in candidates.iter().filter_map(|candidate| normalize(candidate.as_ref())) {
+        if bundles.contains_key(&candidate) {
+            return candidate;
+        }
+
+        let language = candidate.split('-').next().unwrap_or_default();
+        if bundles.contains_key(language) {
+            return language.to_string();
+        }
+    }
+
+    get_default()
+}
+
+/// Tells whether the given locale is well formed and supported, either by itself or by its language
+pub fn is_supported(locale: &str) -> bool {
+    let locale = match normalize(locale) {
+        Some(locale) => locale,
+        None => return false,
+    };
+
+    let bundles = get_bundles();
+    let language = locale.split('-').next().unwrap_or_default();
+    bundles.contains_key(&locale) || bundles.contains_key(language)
+}
+
+/// Returns the given error message translated to the given locale, or as it is if there is no translation for it
+pub fn translate_error(locale: &str, message: &str) -> String {
+    get_bundles().get(locale)
+        .and_then(|bundle| bundle.errors.get(message))
+        .cloned()
+        .unwrap_or(message.to_string())
+}
+
+/// Returns the template the subject of the given kind of email must be rendered by in the given locale, if any
+pub fn get_email_subject(locale: &str, kind: &str) -> Option<String> {
+    get_bundles().get(locale).and_then(|bundle| bundle.emails.get(kind)).cloned()
+}
+
+/// Returns all the texts of the pages in the given locale, falling back to these of the default locale and english,
+/// in this order, for those with no translation
+pub fn get_pages(locale: &str) -> HashMap<String, String> {
+    let bundles = get_bundles();
+    let mut pages = HashMap::new();
+    for fallback in &[settings::DEFAULT_LOCALE.to_string(), get_default(), locale.to_string()] {
+        if let Some(bundle) = bundles.get(fallback) {
+            pages.extend(bundle.pages.clone());
+        }
+    }
+
+    pages
+}
+
+/// Returns the text of the given kind of text message in the given locale, falling back to the one of its language,
+/// the default locale and english, in this order, if it has no translation
+pub fn get_sms_text(locale: &str, kind: &str) -> Option<String> {
+    let bundles = get_bundles();
+    let language = locale.split('-').next().unwrap_or_default().to_string();
+    [locale.to_string(), language, get_default(), settings::DEFAULT_LOCALE.to_string()].iter()
+        .find_map(|fallback| bundles.get(fallback).and_then(|bundle| bundle.sms.get(kind)).cloned())
+}
+
+/// Decodes the given percent-encoded grpc message
+pub(crate) fn decode_message(message: &str) -> String {
+    let bytes = message.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut index = 0;
+    while index < bytes.len() {
+        let hex = bytes.get(index + 1..index + 3).and_then(|hex| std::str::from_utf8(hex).ok());
+        match (bytes[index], hex.and_then(|hex| u8::from_str_radix(hex, 16).ok())) {
+            (b'%', Some(byte)) => {
+                decoded.push(byte);
+                index += 3;
+            },
+            (byte, _) => {
+                decoded.push(byte);
+                index += 1;
+            },
+        }
+    }
+
+    String::from_utf8_lossy(&decoded).to_string()
+}
+
+/// Percent-encodes the given grpc message, as required for any byte out of the printable ascii range
+fn encode_message(message: &str) -> String {
+    message.bytes()
+        .map(|byte| match byte {
+            b'%' | 0..=0x1f | 0x7f..=0xff => format!("%{:02X}", byte),
+            byte => (byte as char).to_string(),
+        })
+        .collect()
+}
+
+/// A layer translating the message of the failed requests served by the services it wraps to the locale they have
+/// requested, if any is. Requests not asking for any locale get their messages as they are, in english
+#[derive(Clone, Default)]
+pub struct LocaleLayer;
+
+impl<S> Layer<S> for LocaleLayer {
+    type Service = LocaleService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        LocaleService { inner }
+    }
+}
+
+#[derive(Clone)]
+pub struct LocaleService<S> {
+    inner: S,
+}
+
+impl<S, B, R> Service<http::Request<B>> for LocaleService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<R>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let requested = get_requested(request.headers());
+        let future = self.inner.call(request);
+        Box::pin(async move {
+            let mut result = future.await;
+            if requested.len() == 0 {
+                return result;
+            }
+
+            // failed calls tell their message by their headers, as metrics::get_code does with their status code
+            if let Ok(response) = &mut result {
+                let locale = negotiate(&requested);
+                let message = response.headers().get(GRPC_MESSAGE_HEADER)
+                    .and_then(|message| message.to_str().ok())
+                    .map(decode_message);
+
+                if let Some(message) = message {
+                    let translated = encode_message(&translate_error(&locale, &message));
+                    if let Ok(translated) = HeaderValue::from_str(&translated) {
+                        response.headers_mut().insert(GRPC_MESSAGE_HEADER, translated);
+                    }
+                }
+
+                if let Ok(locale) = HeaderValue::from_str(&locale) {
+                    response.headers_mut().insert(CONTENT_LANGUAGE_HEADER, locale);
+                }
+            }
+
+            result
+        })
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use http::HeaderMap;
+    use super::{normalize, parse_accept_language, get_requested, negotiate, translate_error, get_pages,
+                get_sms_text};
+    use super::{decode_message, encode_message};
+
+    #[test]
+    fn normalize_should_not_fail() {
+        assert_eq!(Some("es".to_string()), normalize("ES"));
+        assert_eq!(Some("es-ES".to_string()), normalize("es_es"));
+        assert_eq!(Some("zh-HANT-TW".to_string()), normalize("zh-Hant-TW"));
+    }
+
+    #[test]
+    fn normalize_should_fail() {
+        assert_eq!(None, normalize(""));
+        assert_eq!(None, normalize("*"));
+        assert_eq!(None, normalize("e"));
+        assert_eq!(None, normalize("es-"));
+        assert_eq!(None, normalize("../es"));
+    }
+
+    #[test]
+    fn parse_accept_language_should_not_fail() {
+        let locales = parse_accept_language("fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5, it;q=0");
+        assert_eq!(vec!["fr-CH", "fr", "en", "de"], locales);
+
+        let locales = parse_accept_language("en;q=0.5, es-ES");
+        assert_eq!(vec!["es-ES", "en"], locales);
+    }
+
+    #[test]
+    fn get_requested_should_not_fail() {
+        let mut headers = HeaderMap::new();
+        headers.insert("locale", "es".parse().unwrap());
+        headers.insert("accept-language", "fr;q=0.9, en".parse().unwrap());
+        assert_eq!(vec!["es", "en", "fr"], get_requested(&headers));
+    }
+
+    #[test]
+    fn negotiate_should_not_fail() {
+        assert_eq!("es", negotiate(&["es-MX", "en"]));
+        assert_eq!("en", negotiate(&["fr", "en-GB"]));
+        assert_eq!("en", negotiate::<&str>(&[]));
+    }
+
+    #[test]
+    fn translate_error_should_not_fail() {
+        assert_eq!("no encontrado", translate_error("es", "not found"));
+        assert_eq!("not found", translate_error("en", "not found"));
+        assert_eq!("unknown failure", translate_error("es", "unknown failure"));
+    }
+
+    #[test]
+    fn get_pages_should_fall_back() {
+        let pages = get_pages("es");
+        assert_eq!(Some("Contraseña"), pages.get("password").map(String::as_str));
+
+        let pages = get_pages("fr");
+        assert_eq!(Some("Password"), pages.get("password").map(String::as_str));
+    }
+
+    #[test]
+    fn get_sms_text_should_fall_back() {
+        let text = get_sms_text("es-MX", "phone_code").unwrap();
+        assert!(text.starts_with("{code} es tu código"));
+
+        let text = get_sms_text("fr", "phone_code").unwrap();
+        assert!(text.starts_with("{code} is your verification code"));
+        assert_eq!(None, get_sms_text("en", "unknown"));
+    }
+
+    #[test]
+    fn message_encoding_should_not_fail() {
+        let message = "demasiados intentos fallidos, inténtalo más tarde (100%)";
+        let encoded = encode_message(message);
+        assert!(encoded.is_ascii());
+        assert_eq!(message, decode_message(&encoded));
+    }
+}
@@ -0,0 +1,193 @@
+use std::error::Error;
+use std::time::Duration;
+use std::sync::{Arc, RwLock, RwLockReadGuard};
+use crate::security;
+use crate::constants::{errors, environment, settings};
+use crate::metadata::domain::Metadata;
+use crate::hashing::hashing_run;
+use crate::tenant::application::tenant_setting;
+use crate::user::{
+    get_repository as get_user_repository,
+    domain::User,
+};
+use crate::session::{
+    application::decode_token,
+    get_repository as get_sess_repository,
+    domain::Session,
+};
+use crate::audit::{
+    application::audit_record,
+    domain::EventKind,
+};
+use super::{
+    get_repository as get_identity_repository,
+    get_provider,
+    domain::{Identity, Linking, LinkToken},
+};
+
+fn get_readable_session(sess_arc: &Arc<RwLock<Session>>) -> Result<RwLockReadGuard<Session>, Box<dyn Error>> {
+    match sess_arc.read() {
+        Ok(sess) => Ok(sess),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
+
+/// Returns how the accounts of identity providers get linked to the users of the given tenant with the same email: the
+/// IDENTITY_LINKING of the tenant, if it is a known one, or else the default one
+pub fn identity_linking(tenant: i32) -> Linking {
+    tenant_setting(tenant, environment::IDENTITY_LINKING)
+        .and_then(|linking| Linking::from_str(&linking))
+        .unwrap_or(Linking::Email)
+}
+
+/// Returns the user of the given tenant the account of the given provider, as proven by the given authorization code,
+/// is linked to. An account that has not been linked yet, whose email has been verified by the provider and belongs to
+/// a user of the tenant, gets linked to that user as the linking of the tenant tells: right away, once the password of
+/// the user is confirmed by the link token the login fails with, or never by the login itself
+pub fn identity_authenticate(tenant: i32,
+                             provider: &str,
+                             code: &str,
+                             redirect_uri: &str) -> Result<User, Box<dyn Error>> {
+
+    let provider = get_provider(provider)?;
+    let access_token = provider.authenticate(code, redirect_uri)?;
+    let profile = provider.fetch_profile(&access_token)?;
+
+    if let Ok(identity) = get_identity_repository().find_by_subject(tenant, provider.get_name(), &profile.subject) {
+        return get_user_repository().find(identity.get_user());
+    }
+
+    // an unverified email could have been set by anyone, so it proves nothing about who owns it
+    if !profile.verified {
+        info!("{} account {} has no verified email", provider.get_name(), profile.subject);
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    let user = get_user_repository().find_by_email(tenant, &profile.email)?;
+    match identity_linking(tenant) {
+        Linking::Email => {},
+        Linking::Password => {
+            info!("{} account {} requires the password of user {} to be linked", provider.get_name(), profile.subject,
+                  user.get_id());
+
+            let timeout = Duration::from_secs(settings::LINK_TOKEN_TIMEOUT);
+            let claim = LinkToken::new(&user, provider.get_name(), &profile.subject, timeout);
+            let token = security::encode_jwt(claim)?;
+            return Err(format!("{}: {}", errors::LINK_REQUIRED, token).into());
+        },
+        Linking::Explicit => {
+            info!("{} account {} must be linked by user {} itself", provider.get_name(), profile.subject, user.get_id());
+            return Err(errors::LINK_REQUIRED.into());
+        },
+    }
+
+    let mut identity = Identity::new(Metadata::new(), &user, provider.get_name(), &profile.subject)?;
+    get_identity_repository().create(&mut identity)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::Credential, &format!("{} account linked", provider.get_name()));
+    Ok(user)
+}
+
+/// If, and only if, the provided token is valid, its session is elevated and the given provider supports linking, the
+/// account of the provider proven by the given authorization code gets linked to the session's owner, which may log
+/// in by that account from then on
+pub fn identity_link(token: &str,
+                     provider: &str,
+                     code: &str,
+                     redirect_uri: &str) -> Result<Identity, Box<dyn Error>> {
+
+    info!("got a link identity request for provider {} ", provider);
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let (user, issuer) = { // block is required because of lock release
+        let sess = get_readable_session(&sess_arc)?;
+        if !sess.is_elevated() {
+            return Err(errors::ELEVATION_REQUIRED.into());
+        }
+
+        (sess.get_user()?.clone(), sess.get_issuer()?)
+    };
+
+    let provider = get_provider(provider)?;
+    if !provider.supports_linking() {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    let access_token = provider.authenticate(code, redirect_uri)?;
+    let profile = provider.fetch_profile(&access_token)?;
+
+    let mut identity = Identity::new(Metadata::new(), &user, provider.get_name(), &profile.subject)?;
+    get_identity_repository().create(&mut identity)?;
+
+    audit_record(user.get_id(), issuer, EventKind::Credential, &format!("{} account linked", provider.get_name()));
+    Ok(identity)
+}
+
+/// If, and only if, the provided link token is valid and the given credentials match with the ones of its user, the
+/// account of the token gets linked to the user, which may log in by that account from then on, as long as the account
+/// has not been linked to anyone meanwhile
+pub fn identity_confirm_link(token: &str, pwd: &str, totp: &str) -> Result<Identity, Box<dyn Error>> {
+    info!("got a confirm link request");
+    let claim = security::decode_jwt::<LinkToken>(token)?;
+    let user = get_user_repository().find(claim.sub)?;
+    if user.is_suspended() {
+        return Err(errors::SUSPENDED.into());
+    }
+
+    let (candidate, pwd) = (user.clone(), pwd.to_string());
+    if !hashing_run(move || candidate.match_password(&pwd))? {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    // if, and only if, the user has activated the 2fa
+    if let Some(secret) = user.get_secret() {
+        security::verify_totp(secret.get_data(), totp)?;
+    }
+
+    if get_identity_repository().find_by_subject(user.get_tenant(), &claim.provider, &claim.subject).is_ok() {
+        return Err(errors::ALREADY_EXISTS.into());
+    }
+
+    let mut identity = Identity::new(Metadata::new(), &user, &claim.provider, &claim.subject)?;
+    get_identity_repository().create(&mut identity)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::Credential, &format!("{} account linked", claim.provider));
+    Ok(identity)
+}
+
+/// If, and only if, the provided token is valid, returns all the accounts linked to the session's owner
+pub fn identity_list(token: &str) -> Result<Vec<Identity>, Box<dyn Error>> {
+    info!("got a list identities request");
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = get_readable_session(&sess_arc)?.get_user()?.get_id();
+    get_identity_repository().find_all_by_user(user_id)
+}
+
+/// If, and only if, the provided token is valid and the linked account belongs to the session's owner, the account
+/// gets unlinked, so the user cannot log in by it anymore
+pub fn identity_unlink(token: &str, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got an unlink identity request");
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let (user_id, issuer) = { // block is required because of lock release
+        let sess = get_readable_session(&sess_arc)?;
+        (sess.get_user()?.get_id(), sess.get_issuer()?)
+    };
+
+    let identity = get_identity_repository().find(id)?;
+    if identity.get_user() != user_id {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    get_identity_repository().delete(&identity)?;
+
+    audit_record(user_id, issuer, EventKind::Credential, &format!("{} account unlinked", identity.get_provider()));
+    Ok(())
+}
@@ -0,0 +1,205 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::metadata::domain::Metadata;
+use crate::user::domain::User;
+use crate::time::{self, unix_timestamp};
+use crate::security::TokenKind;
+
+/// A source of identities users may log in by, such as a social or enterprise identity provider speaking oauth2
+pub trait IdentityProvider {
+    // the name the provider is registered and told by, such as "google"
+    fn get_name(&self) -> &str;
+    // exchanges the given authorization code, as granted for the given redirect uri, for an access token
+    fn authenticate(&self, code: &str, redirect_uri: &str) -> Result<String, Box<dyn Error>>;
+    // returns the profile of the account the given access token has been granted by
+    fn fetch_profile(&self, access_token: &str) -> Result<Profile, Box<dyn Error>>;
+    // if true, accounts of the provider may be linked to the user of any session, no matter their email
+    fn supports_linking(&self) -> bool;
+}
+
+pub trait IdentityRepository {
+    fn find(&self, id: i32) -> Result<Identity, Box<dyn Error>>;
+    fn find_by_subject(&self, tenant: i32, provider: &str, subject: &str) -> Result<Identity, Box<dyn Error>>;
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<Identity>, Box<dyn Error>>;
+    fn create(&self, identity: &mut Identity) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, identity: &Identity) -> Result<(), Box<dyn Error>>;
+}
+
+/// An account of an identity provider, as told by the provider itself
+#[derive(Clone, PartialEq, Debug)]
+pub struct Profile {
+    pub subject: String, // the id of the account, which never changes
+    pub email: String,
+    pub verified: bool,  // whether the email has been verified by the provider
+    pub name: String,
+}
+
+/// How an account of an identity provider, not linked to any user yet, gets linked to the user having the same email
+/// when logging in by it
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Linking {
+    Email,    // linked right away, as long as the provider has verified the email
+    Password, // linked once the password of the user has been confirmed, by the token the login fails with
+    Explicit, // never linked by the login, but by the user itself from a session of its own
+}
+
+impl Linking {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Linking::Email => "email",
+            Linking::Password => "password",
+            Linking::Explicit => "explicit",
+        }
+    }
+
+    pub fn from_str(linking: &str) -> Option<Self> {
+        match linking {
+            "email" => Some(Linking::Email),
+            "password" => Some(Linking::Password),
+            "explicit" => Some(Linking::Explicit),
+            _ => None,
+        }
+    }
+}
+
+/// An account of an identity provider linked to a user, which may log in by that account from then on
+#[derive(Clone)]
+pub struct Identity {
+    pub(super) id: i32,
+    pub(super) tenant: i32,
+    pub(super) user: i32,
+    pub(super) provider: String,
+    pub(super) subject: String,
+    pub(super) meta: Metadata,
+}
+
+impl Identity {
+    pub fn new(meta: Metadata,
+               user: &User,
+               provider: &str,
+               subject: &str) -> Result<Self, Box<dyn Error>> {
+
+        if provider.len() == 0 {
+            return Err("provider required".into());
+        }
+
+        if subject.len() == 0 {
+            return Err("subject required".into());
+        }
+
+        let identity = Identity {
+            id: 0,
+            tenant: user.get_tenant(),
+            user: user.get_id(),
+            provider: provider.to_string(),
+            subject: subject.to_string(),
+            meta: meta,
+        };
+
+        Ok(identity)
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_provider(&self) -> &str {
+        &self.provider
+    }
+
+    pub fn get_subject(&self) -> &str {
+        &self.subject
+    }
+}
+
+// token for linking an account of an identity provider to the user with the same email, once its password is confirmed
+#[derive(Serialize, Deserialize)]
+pub struct LinkToken {
+    pub(super) exp: usize,          // expiration time (as UTC timestamp) - required
+    pub(super) iat: SystemTime,     // issued at: creation time
+    pub(super) iss: String,         // issuer
+    pub(super) sub: i32,            // subject: the user id
+    pub(super) provider: String,    // the provider of the account to link
+    pub(super) subject: String,     // the id of the account to link, as told by the provider
+}
+
+impl TokenKind for LinkToken {
+    const KIND: &'static str = "link+jwt";
+}
+
+impl LinkToken {
+    pub fn new(user: &User, provider: &str, subject: &str, timeout: Duration) -> Self {
+        LinkToken {
+            exp: unix_timestamp(time::now() + timeout),
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: user.get_id(),
+            provider: provider.to_string(),
+            subject: subject.to_string(),
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use crate::metadata::domain::tests::new_metadata;
+    use crate::user::domain::tests::new_user;
+    use crate::time::unix_timestamp;
+    use super::{Identity, Linking, LinkToken};
+
+    #[test]
+    fn identity_new_should_not_fail() {
+        let user = new_user();
+        let identity = Identity::new(new_metadata(), &user, "google", "110169484474386276334").unwrap();
+
+        assert_eq!(0, identity.get_id());
+        assert_eq!(user.get_tenant(), identity.get_tenant());
+        assert_eq!(user.get_id(), identity.get_user());
+        assert_eq!("google", identity.get_provider());
+        assert_eq!("110169484474386276334", identity.get_subject());
+    }
+
+    #[test]
+    fn identity_new_should_fail() {
+        let user = new_user();
+        assert!(Identity::new(new_metadata(), &user, "", "110169484474386276334").is_err());
+        assert!(Identity::new(new_metadata(), &user, "google", "").is_err());
+    }
+
+    #[test]
+    fn linking_from_str_should_not_fail() {
+        for linking in &[Linking::Email, Linking::Password, Linking::Explicit] {
+            assert_eq!(Some(*linking), Linking::from_str(linking.as_str()));
+        }
+
+        assert_eq!(None, Linking::from_str("unknown"));
+    }
+
+    #[test]
+    fn link_token_new_should_not_fail() {
+        let user = new_user();
+        let timeout = Duration::from_secs(60);
+
+        let before = SystemTime::now();
+        let claim = LinkToken::new(&user, "google", "110169484474386276334", timeout);
+        let after = SystemTime::now();
+
+        assert!(claim.iat >= before && claim.iat <= after);
+        assert!(claim.exp >= unix_timestamp(before + timeout));
+        assert!(claim.exp <= unix_timestamp(after + timeout));
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!(user.get_id(), claim.sub);
+        assert_eq!("google", claim.provider);
+        assert_eq!("110169484474386276334", claim.subject);
+    }
+}
@@ -0,0 +1,555 @@
+use std::error::Error;
+use std::sync::RwLock;
+use std::time::Duration;
+use tonic::{Request, Response, Status};
+use serde::Deserialize;
+use jsonwebtoken::{DecodingKey, Validation, Algorithm};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::schema::identities::dsl::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::identities;
+use crate::config;
+use crate::constants::{settings, environment, errors};
+use crate::keyring::application::keyring_get;
+use crate::ratelimit::framework::rate_limit;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use super::domain::{Identity, IdentityRepository, IdentityProvider, Profile};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("identity");
+}
+
+// Proto generated server traits
+use proto::identity_service_server::IdentityService;
+pub use proto::identity_service_server::IdentityServiceServer;
+
+// Proto message structs
+use proto::{ProviderList, LinkRequest, ConfirmLinkRequest, IdentityRequest, IdentityList, Identity as ProtoIdentity};
+
+fn to_proto(identity: &Identity) -> ProtoIdentity {
+    ProtoIdentity{
+        id: identity.get_id(),
+        provider: identity.get_provider().to_string(),
+        subject: identity.get_subject().to_string(),
+    }
+}
+
+pub struct IdentityServiceImplementation;
+
+#[tonic::async_trait]
+impl IdentityService for IdentityServiceImplementation {
+    async fn list_providers(&self, _: Request<()>) -> Result<Response<ProviderList>, Status> {
+        match super::get_provider_names() {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(providers) => Ok(Response::new(ProviderList{providers})),
+        }
+    }
+
+    async fn link_identity(&self, request: Request<LinkRequest>) -> Result<Response<ProtoIdentity>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::identity_link(&token, &msg_ref.provider, &msg_ref.code, &msg_ref.redirect_uri) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(identity) => Ok(Response::new(to_proto(&identity))),
+        }
+    }
+
+    async fn confirm_link(&self, request: Request<ConfirmLinkRequest>) -> Result<Response<ProtoIdentity>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "identity.confirm_link", Some(&request.get_ref().token))?;
+        let msg_ref = request.into_inner();
+
+        match super::application::identity_confirm_link(&msg_ref.token, &msg_ref.pwd, &msg_ref.totp) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(identity) => Ok(Response::new(to_proto(&identity))),
+        }
+    }
+
+    async fn list_identities(&self, request: Request<()>) -> Result<Response<IdentityList>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        match super::application::identity_list(token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(all_identities) => Ok(Response::new(
+                IdentityList{
+                    identities: all_identities.iter().map(to_proto).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn unlink_identity(&self, request: Request<IdentityRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::identity_unlink(&token, msg_ref.id) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+}
+
+const DISCOVERY_PATH: &str = "/.well-known/openid-configuration";
+
+#[derive(Deserialize, Debug)]
+struct TokenResponse {
+    access_token: String,
+    #[serde(default)]
+    id_token: String,
+}
+
+// the endpoints of an openid connect provider, as told by its discovery document
+#[derive(Deserialize, Clone, Debug)]
+struct Discovery {
+    issuer: String,
+    token_endpoint: String,
+    userinfo_endpoint: String,
+    jwks_uri: String,
+}
+
+#[derive(Deserialize, Debug)]
+struct Jwk {
+    #[serde(default)]
+    kid: String,
+    kty: String,
+    #[serde(default)]
+    n: String,
+    #[serde(default)]
+    e: String,
+}
+
+#[derive(Deserialize, Debug)]
+struct Jwks {
+    keys: Vec<Jwk>,
+}
+
+#[derive(Deserialize, Debug)]
+struct IdClaims {
+    iss: String,
+}
+
+#[derive(Deserialize, Debug)]
+struct GoogleUserInfo {
+    sub: String,
+    #[serde(default)]
+    email: String,
+    #[serde(default)]
+    email_verified: bool,
+    #[serde(default)]
+    name: String,
+}
+
+/// Authenticates the accounts of google by the openid connect authorization code flow, as the client at
+/// GOOGLE_CLIENT_ID. The endpoints are told by the discovery document of the issuer, and the id token of every exchange,
+/// if any, must have been signed by any of the keys of the issuer for the client. The secret is resolved on every
+/// exchange, so it can be rotated
+pub struct GoogleProvider {
+    agent: ureq::Agent,
+    issuer: String,
+    discovery: RwLock<Option<Discovery>>, // fetched the first time it is required
+}
+
+impl GoogleProvider {
+    /// Returns the provider for the issuer told by GOOGLE_ISSUER, if any, or else google itself
+    pub fn new() -> Self {
+        let issuer = config::get(environment::GOOGLE_ISSUER).unwrap_or(settings::GOOGLE_ISSUER.to_string());
+        GoogleProvider::with_issuer(&issuer)
+    }
+
+    /// Same as new, but for the given issuer, such as any other speaking openid connect on its behalf
+    pub fn with_issuer(issuer: &str) -> Self {
+        GoogleProvider {
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(settings::IDENTITY_TIMEOUT))
+                .build(),
+            issuer: issuer.trim_end_matches('/').to_string(),
+            discovery: RwLock::new(None),
+        }
+    }
+
+    fn get_discovery(&self) -> Result<Discovery, Box<dyn Error>> {
+        match self.discovery.read() {
+            Ok(discovery) => if let Some(discovery) = &*discovery {
+                return Ok(discovery.clone());
+            },
+            Err(err) => {
+                error!("read lock for discovery document got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        let discovery: Discovery = self.agent.get(&format!("{}{}", self.issuer, DISCOVERY_PATH))
+            .call()?
+            .into_json()?;
+
+        // a document telling any other issuer could make tokens of that issuer be taken as these of this one
+        if discovery.issuer.trim_end_matches('/') != self.issuer {
+            warn!("discovery document of {} tells {} as issuer", self.issuer, discovery.issuer);
+            return Err(errors::INVALID_CONFIG.into());
+        }
+
+        match self.discovery.write() {
+            Ok(mut cached) => *cached = Some(discovery.clone()),
+            Err(err) => error!("write lock for discovery document got poisoned: {}", err),
+        };
+
+        Ok(discovery)
+    }
+
+    /// Checks the given id token has been issued by the issuer for the given client, and signed by any of its keys
+    fn verify_id_token(&self, discovery: &Discovery, id_token: &str, client_id: &str) -> Result<(), Box<dyn Error>> {
+        let kid = jsonwebtoken::decode_header(id_token)?.kid;
+        let jwks: Jwks = self.agent.get(&discovery.jwks_uri).call()?.into_json()?;
+        let jwk = jwks.keys.iter()
+            .filter(|jwk| jwk.kty == "RSA")
+            .find(|jwk| kid.as_ref().map(|kid| kid == &jwk.kid).unwrap_or(true))
+            .ok_or(errors::UNAUTHORIZED)?;
+
+        let mut validation = Validation::new(Algorithm::RS256);
+        validation.set_audience(&[client_id]);
+        let key = DecodingKey::from_rsa_components(&jwk.n, &jwk.e);
+        let claims = jsonwebtoken::decode::<IdClaims>(id_token, &key, &validation)?.claims;
+
+        // google tells its issuer with no scheme at times
+        if claims.iss != self.issuer && format!("https://{}", claims.iss) != self.issuer {
+            return Err(errors::UNAUTHORIZED.into());
+        }
+
+        Ok(())
+    }
+}
+
+impl IdentityProvider for GoogleProvider {
+    fn get_name(&self) -> &str {
+        "google"
+    }
+
+    fn authenticate(&self, code: &str, redirect_uri: &str) -> Result<String, Box<dyn Error>> {
+        let client_id = config::get(environment::GOOGLE_CLIENT_ID)?;
+        let client_secret = keyring_get(environment::GOOGLE_CLIENT_SECRET)?;
+        let form = [
+            ("grant_type", "authorization_code"),
+            ("code", code),
+            ("redirect_uri", redirect_uri),
+            ("client_id", &client_id),
+            ("client_secret", &client_secret),
+        ];
+
+        let discovery = self.get_discovery()?;
+        let result: TokenResponse = self.agent.post(&discovery.token_endpoint)
+            .send_form(&form)?
+            .into_json()?;
+
+        if result.id_token.len() > 0 {
+            self.verify_id_token(&discovery, &result.id_token, &client_id)?;
+        }
+
+        Ok(result.access_token)
+    }
+
+    fn fetch_profile(&self, access_token: &str) -> Result<Profile, Box<dyn Error>> {
+        let discovery = self.get_discovery()?;
+        let result: GoogleUserInfo = self.agent.get(&discovery.userinfo_endpoint)
+            .set("Authorization", &format!("Bearer {}", access_token))
+            .call()?
+            .into_json()?;
+
+        Ok(Profile {
+            subject: result.sub,
+            email: result.email.to_lowercase(),
+            verified: result.email_verified,
+            name: result.name,
+        })
+    }
+
+    fn supports_linking(&self) -> bool {
+        true
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[table_name = "identities"]
+struct PostgresIdentity {
+    pub id: i32,
+    pub tenant_id: i32,
+    pub user_id: i32,
+    pub provider: String,
+    pub subject: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "identities"]
+struct NewPostgresIdentity<'a> {
+    pub tenant_id: i32,
+    pub user_id: i32,
+    pub provider: &'a str,
+    pub subject: &'a str,
+    pub meta_id: i32,
+}
+
+pub struct PostgresIdentityRepository;
+
+impl PostgresIdentityRepository {
+    fn create_on_conn(conn: &PgConnection, identity: &mut Identity) -> Result<(), PgError>  {
+        // in order to create an identity it must exists the metadata for this identity
+        PostgresMetadataRepository::create_on_conn(conn, &mut identity.meta)?;
+
+        let new_identity = NewPostgresIdentity {
+            tenant_id: identity.tenant,
+            user_id: identity.user,
+            provider: &identity.provider,
+            subject: &identity.subject,
+            meta_id: identity.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(identities::table)
+            .values(&new_identity)
+            .get_result::<PostgresIdentity>(conn)?;
+
+        identity.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, identity: &Identity) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            identities.filter(id.eq(identity.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &identity.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresIdentity) -> Result<Identity, Box<dyn Error>> {
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(Identity{
+            id: result.id,
+            tenant: result.tenant_id,
+            user: result.user_id,
+            provider: result.provider.clone(),
+            subject: result.subject.clone(),
+            meta: meta,
+        })
+    }
+}
+
+impl IdentityRepository for PostgresIdentityRepository {
+    fn find(&self, target: i32) -> Result<Identity, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            identities.filter(id.eq(target))
+                      .load::<PostgresIdentity>(&connection)?
+        };
+
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresIdentityRepository::build(&results[0])
+    }
+
+    fn find_by_subject(&self, target_tenant: i32, target_provider: &str, target: &str) -> Result<Identity, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            identities.filter(tenant_id.eq(target_tenant))
+                      .filter(provider.eq(target_provider))
+                      .filter(subject.eq(target))
+                      .load::<PostgresIdentity>(&connection)?
+        };
+
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresIdentityRepository::build(&results[0])
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Identity>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            identities.filter(user_id.eq(target_user))
+                      .order(id.asc())
+                      .load::<PostgresIdentity>(&connection)?
+        };
+
+        let mut all_identities = Vec::new();
+        for result in results.iter() {
+            all_identities.push(PostgresIdentityRepository::build(result)?);
+        }
+
+        Ok(all_identities)
+    }
+
+    fn create(&self, identity: &mut Identity) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresIdentityRepository::create_on_conn(&conn, identity))?;
+        Ok(())
+    }
+
+    fn delete(&self, identity: &Identity) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresIdentityRepository::delete_on_conn(&conn, identity))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryIdentityRepository {
+    table: memory::Table<Identity>,
+}
+
+impl InMemoryIdentityRepository {
+    pub fn new() -> Self {
+        InMemoryIdentityRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl IdentityRepository for InMemoryIdentityRepository {
+    fn find(&self, target: i32) -> Result<Identity, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_by_subject(&self, target_tenant: i32, target_provider: &str, target: &str) -> Result<Identity, Box<dyn Error>>  {
+        self.table.find_first(|identity| {
+            identity.tenant == target_tenant && identity.provider == target_provider && identity.subject == target
+        })
+    }
+
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Identity>, Box<dyn Error>>  {
+        self.table.find_all(|identity| identity.user == target_user)
+    }
+
+    fn create(&self, identity: &mut Identity) -> Result<(), Box<dyn Error>> {
+        // in order to create an identity it must exists the metadata for this identity
+        get_meta_repository().create(&mut identity.meta)?;
+
+        let (target_tenant, target_provider) = (identity.tenant, identity.provider.clone());
+        let target = identity.subject.clone();
+        self.table.insert(identity,
+                          |existing| {
+                              existing.tenant == target_tenant &&
+                              existing.provider == target_provider &&
+                              existing.subject == target
+                          },
+                          |identity, new_id| identity.id = new_id)
+    }
+
+    fn delete(&self, identity: &Identity) -> Result<(), Box<dyn Error>> {
+        self.table.delete(identity.id)?;
+        get_meta_repository().delete(&identity.meta)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::env;
+    use crate::constants::environment;
+    use super::super::domain::{IdentityProvider, Profile};
+    use super::super::mock::{MockProvider, Flaw};
+    use super::GoogleProvider;
+
+    const CLIENT_ID: &str = "tpauth-testing";
+    const CLIENT_SECRET: &str = "secret";
+    const REDIRECT_URI: &str = "http://app.example.com/callback";
+
+    fn new_profile() -> Profile {
+        Profile {
+            subject: "1234567890".to_string(),
+            email: "alice@example.com".to_string(),
+            verified: true,
+            name: "Alice".to_string(),
+        }
+    }
+
+    fn start_provider() -> MockProvider {
+        env::set_var(environment::GOOGLE_CLIENT_ID, CLIENT_ID);
+        env::set_var(environment::GOOGLE_CLIENT_SECRET, CLIENT_SECRET);
+        MockProvider::start(CLIENT_ID, CLIENT_SECRET)
+    }
+
+    #[test]
+    fn google_provider_should_not_fail() {
+        let mock = start_provider();
+        let provider = GoogleProvider::with_issuer(mock.get_issuer());
+
+        mock.grant("code", new_profile());
+        let access_token = provider.authenticate("code", REDIRECT_URI).unwrap();
+        assert_eq!(new_profile(), provider.fetch_profile(&access_token).unwrap());
+
+        // providers telling no id token are still taken, by their userinfo
+        mock.grant_with("other", new_profile(), Flaw::NoIdToken);
+        let access_token = provider.authenticate("other", REDIRECT_URI).unwrap();
+        assert_eq!(new_profile(), provider.fetch_profile(&access_token).unwrap());
+    }
+
+    #[test]
+    fn google_provider_should_fail() {
+        let mock = start_provider();
+        let provider = GoogleProvider::with_issuer(mock.get_issuer());
+
+        mock.grant("code", new_profile());
+        provider.authenticate("code", REDIRECT_URI).unwrap();
+        assert!(provider.authenticate("code", REDIRECT_URI).is_err(), "codes must be exchanged once only");
+        assert!(provider.authenticate("unknown", REDIRECT_URI).is_err());
+        assert!(provider.fetch_profile("unknown").is_err());
+
+        for flaw in &[Flaw::UnknownKey, Flaw::Expired, Flaw::WrongAudience, Flaw::WrongIssuer] {
+            mock.grant_with("flawed", new_profile(), *flaw);
+            assert!(provider.authenticate("flawed", REDIRECT_URI).is_err(), "{:?} id token must be rejected", flaw);
+        }
+
+        // an issuer with no discovery document of its own is never trusted
+        let impostor = GoogleProvider::with_issuer(&format!("{}/impostor", mock.get_issuer()));
+        mock.grant("code", new_profile());
+        assert!(impostor.authenticate("code", REDIRECT_URI).is_err());
+    }
+}
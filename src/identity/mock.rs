@@ -0,0 +1,297 @@
+//! An in-process openid connect provider, so the login and linking by identity providers can be tested
+//! deterministically with no real provider. It serves the discovery document, the key set and the token and userinfo
+//! endpoints, and issues tokens for the accounts the test has granted codes to.
+
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::net::TcpListener;
+use std::sync::{Arc, Mutex};
+use std::thread::{self, JoinHandle};
+use std::time::{SystemTime, UNIX_EPOCH};
+use hyper::{Body, Method, Server, StatusCode};
+use hyper::header::{AUTHORIZATION, CONTENT_TYPE};
+use hyper::service::{make_service_fn, service_fn};
+use jsonwebtoken::{EncodingKey, Header, Algorithm};
+use openssl::rsa::Rsa;
+use serde_json::{json, Value};
+use tokio::sync::oneshot;
+
+use crate::security;
+use super::domain::Profile;
+
+const DISCOVERY_PATH: &str = "/.well-known/openid-configuration";
+const JWKS_PATH: &str = "/jwks";
+const TOKEN_PATH: &str = "/token";
+const USERINFO_PATH: &str = "/userinfo";
+
+const KEY_ID: &str = "mock";
+const TOKEN_TIMEOUT: u64 = 3600; // time in seconds
+const ACCESS_TOKEN_LEN: usize = 32;
+
+/// How the id token issued for a code goes wrong, so the verification of every claim can be tested
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Flaw {
+    None,
+    UnknownKey,    // signed by a key the provider does not tell
+    Expired,
+    WrongAudience, // issued for any other client
+    WrongIssuer,
+    NoIdToken,     // the token response has no id token at all
+}
+
+struct Grant {
+    profile: Profile,
+    flaw: Flaw,
+}
+
+struct State {
+    issuer: String,
+    client_id: String,
+    client_secret: String,
+    key: EncodingKey,
+    rogue: EncodingKey, // signs the tokens with Flaw::UnknownKey
+    jwks: Value,
+    grants: HashMap<String, Grant>,   // by authorization code, single use
+    tokens: HashMap<String, Profile>, // by access token
+}
+
+fn now() -> u64 {
+    SystemTime::now().duration_since(UNIX_EPOCH).map(|now| now.as_secs()).unwrap_or_default()
+}
+
+fn json_response(status: StatusCode, body: Value) -> hyper::Response<Body> {
+    hyper::Response::builder()
+        .status(status)
+        .header(CONTENT_TYPE, "application/json")
+        .body(Body::from(body.to_string()))
+        .unwrap_or_default()
+}
+
+// parses a form of url-safe values, as these the provider gets from the service
+fn parse_form(body: &[u8]) -> HashMap<String, String> {
+    String::from_utf8_lossy(body).split('&')
+        .filter_map(|param| {
+            let mut parts = param.splitn(2, '=');
+            Some((parts.next()?.to_string(), parts.next().unwrap_or_default().replace("%3A", ":").replace("%2F", "/")))
+        })
+        .collect()
+}
+
+impl State {
+    fn discovery(&self) -> Value {
+        json!({
+            "issuer": self.issuer,
+            "authorization_endpoint": format!("{}/authorize", self.issuer),
+            "token_endpoint": format!("{}{}", self.issuer, TOKEN_PATH),
+            "userinfo_endpoint": format!("{}{}", self.issuer, USERINFO_PATH),
+            "jwks_uri": format!("{}{}", self.issuer, JWKS_PATH),
+            "response_types_supported": ["code"],
+            "subject_types_supported": ["public"],
+            "id_token_signing_alg_values_supported": ["RS256"],
+        })
+    }
+
+    fn exchange(&mut self, form: &HashMap<String, String>) -> hyper::Response<Body> {
+        let param = |name: &str| form.get(name).map(|value| value.as_str()).unwrap_or_default();
+        if param("grant_type") != "authorization_code" {
+            return json_response(StatusCode::BAD_REQUEST, json!({"error": "unsupported_grant_type"}));
+        }
+
+        if param("client_id") != self.client_id || param("client_secret") != self.client_secret {
+            return json_response(StatusCode::UNAUTHORIZED, json!({"error": "invalid_client"}));
+        }
+
+        let grant = match self.grants.remove(param("code")) {
+            Some(grant) => grant,
+            None => return json_response(StatusCode::BAD_REQUEST, json!({"error": "invalid_grant"})),
+        };
+
+        let issuer = match grant.flaw {
+            Flaw::WrongIssuer => "https://evil.example.com",
+            _ => self.issuer.as_str(),
+        };
+
+        let audience = match grant.flaw {
+            Flaw::WrongAudience => "another-client",
+            _ => self.client_id.as_str(),
+        };
+
+        let expiration = match grant.flaw {
+            Flaw::Expired => now() - TOKEN_TIMEOUT,
+            _ => now() + TOKEN_TIMEOUT,
+        };
+
+        let mut header = Header::new(Algorithm::RS256);
+        header.kid = Some(KEY_ID.to_string());
+        let claims = json!({
+            "iss": issuer,
+            "aud": audience,
+            "sub": grant.profile.subject,
+            "iat": now(),
+            "exp": expiration,
+            "email": grant.profile.email,
+            "email_verified": grant.profile.verified,
+            "name": grant.profile.name,
+        });
+
+        let key = match grant.flaw {
+            Flaw::UnknownKey => &self.rogue,
+            _ => &self.key,
+        };
+
+        let id_token = match jsonwebtoken::encode(&header, &claims, key) {
+            Ok(token) => token,
+            Err(err) => return json_response(StatusCode::INTERNAL_SERVER_ERROR, json!({"error": err.to_string()})),
+        };
+
+        let access_token = security::get_random_string(ACCESS_TOKEN_LEN);
+        self.tokens.insert(access_token.clone(), grant.profile);
+
+        let mut response = json!({
+            "access_token": access_token,
+            "token_type": "Bearer",
+            "expires_in": TOKEN_TIMEOUT,
+        });
+
+        if grant.flaw != Flaw::NoIdToken {
+            response["id_token"] = json!(id_token);
+        }
+
+        json_response(StatusCode::OK, response)
+    }
+
+    fn userinfo(&self, authorization: &str) -> hyper::Response<Body> {
+        let profile = authorization.strip_prefix("Bearer ").and_then(|token| self.tokens.get(token));
+        match profile {
+            Some(profile) => json_response(StatusCode::OK, json!({
+                "sub": profile.subject,
+                "email": profile.email,
+                "email_verified": profile.verified,
+                "name": profile.name,
+            })),
+            None => json_response(StatusCode::UNAUTHORIZED, json!({"error": "invalid_token"})),
+        }
+    }
+}
+
+async fn handle(request: hyper::Request<Body>, state: Arc<Mutex<State>>) -> Result<hyper::Response<Body>, Infallible> {
+    let (parts, body) = request.into_parts();
+    let body = hyper::body::to_bytes(body).await.unwrap_or_default();
+    let mut state = match state.lock() {
+        Ok(state) => state,
+        Err(_) => return Ok(json_response(StatusCode::INTERNAL_SERVER_ERROR, json!({"error": "poisoned"}))),
+    };
+
+    let response = match (&parts.method, parts.uri.path()) {
+        (&Method::GET, DISCOVERY_PATH) => json_response(StatusCode::OK, state.discovery()),
+        (&Method::GET, JWKS_PATH) => json_response(StatusCode::OK, state.jwks.clone()),
+        (&Method::POST, TOKEN_PATH) => state.exchange(&parse_form(&body)),
+        (&Method::GET, USERINFO_PATH) => {
+            let authorization = parts.headers.get(AUTHORIZATION)
+                .and_then(|header| header.to_str().ok())
+                .unwrap_or_default();
+
+            state.userinfo(authorization)
+        },
+        _ => json_response(StatusCode::NOT_FOUND, json!({"error": "not_found"})),
+    };
+
+    Ok(response)
+}
+
+/// An openid connect provider served on a random local port, for as long as it is not dropped
+pub struct MockProvider {
+    issuer: String,
+    state: Arc<Mutex<State>>,
+    shutdown: Option<oneshot::Sender<()>>,
+    server: Option<JoinHandle<()>>,
+}
+
+impl MockProvider {
+    /// Starts a provider for the client with the given credentials, signing its tokens by a brand new key
+    pub fn start(client_id: &str, client_secret: &str) -> Self {
+        let listener = TcpListener::bind("127.0.0.1:0").expect("mock provider must bind a local port");
+        listener.set_nonblocking(true).expect("mock provider listener must be non-blocking");
+        let issuer = format!("http://{}", listener.local_addr().expect("mock provider must have an address"));
+
+        let rsa = Rsa::generate(2048).expect("mock provider key must be generated");
+        let rogue = Rsa::generate(2048).expect("mock provider rogue key must be generated");
+        let state = Arc::new(Mutex::new(State {
+            issuer: issuer.clone(),
+            client_id: client_id.to_string(),
+            client_secret: client_secret.to_string(),
+            key: EncodingKey::from_rsa_pem(&rsa.private_key_to_pem().unwrap()).unwrap(),
+            rogue: EncodingKey::from_rsa_pem(&rogue.private_key_to_pem().unwrap()).unwrap(),
+            jwks: json!({"keys": [{
+                "kty": "RSA",
+                "use": "sig",
+                "alg": "RS256",
+                "kid": KEY_ID,
+                "n": base64::encode_config(rsa.n().to_vec(), base64::URL_SAFE_NO_PAD),
+                "e": base64::encode_config(rsa.e().to_vec(), base64::URL_SAFE_NO_PAD),
+            }]}),
+            grants: HashMap::new(),
+            tokens: HashMap::new(),
+        }));
+
+        let (shutdown, signal) = oneshot::channel::<()>();
+        let shared = state.clone();
+        let server = thread::spawn(move || {
+            let runtime = tokio::runtime::Builder::new_current_thread()
+                .enable_all()
+                .build()
+                .expect("mock provider runtime must be built");
+
+            runtime.block_on(async move {
+                let make_service = make_service_fn(move |_| {
+                    let state = shared.clone();
+                    async move {
+                        Ok::<_, Infallible>(service_fn(move |request| handle(request, state.clone())))
+                    }
+                });
+
+                let server = Server::from_tcp(listener).expect("mock provider must listen").serve(make_service);
+                if let Err(err) = server.with_graceful_shutdown(async { signal.await.ok(); }).await {
+                    error!("mock provider has failed: {}", err);
+                }
+            });
+        });
+
+        MockProvider {
+            issuer: issuer,
+            state: state,
+            shutdown: Some(shutdown),
+            server: Some(server),
+        }
+    }
+
+    /// Returns the issuer the provider is served at, as told by its discovery document
+    pub fn get_issuer(&self) -> &str {
+        &self.issuer
+    }
+
+    /// Grants the given authorization code to the given account, as if its owner had just consented, so exchanging
+    /// it issues the tokens of that account. Codes can be exchanged once only
+    pub fn grant(&self, code: &str, profile: Profile) {
+        self.grant_with(code, profile, Flaw::None)
+    }
+
+    /// Same as grant, but the id token issued for the code goes wrong as told
+    pub fn grant_with(&self, code: &str, profile: Profile, flaw: Flaw) {
+        if let Ok(mut state) = self.state.lock() {
+            state.grants.insert(code.to_string(), Grant {profile: profile, flaw: flaw});
+        }
+    }
+}
+
+impl Drop for MockProvider {
+    fn drop(&mut self) {
+        if let Some(shutdown) = self.shutdown.take() {
+            let _ = shutdown.send(());
+        }
+
+        if let Some(server) = self.server.take() {
+            let _ = server.join();
+        }
+    }
+}
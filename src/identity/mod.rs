@@ -0,0 +1,86 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+#[cfg(test)]
+pub mod mock;
+
+use std::error::Error;
+use std::sync::{Arc, RwLock};
+use std::collections::HashMap;
+use crate::constants::{environment, errors};
+use crate::config;
+use crate::keyring::application::keyring_get;
+use crate::storage::{self, Backend};
+use self::domain::IdentityProvider;
+
+type Provider = Arc<dyn domain::IdentityProvider + Sync + Send>;
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::IdentityRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresIdentityRepository),
+            Backend::Memory => Box::new(framework::InMemoryIdentityRepository::new()),
+            backend => storage::unsupported(backend, "identities"),
+        }
+    };
+
+    // the built-in providers are registered as long as they are configured, while any other may be registered by
+    // the host embedding the service
+    static ref PROVIDERS: RwLock<HashMap<String, Provider>> = {
+        let mut providers: HashMap<String, Provider> = HashMap::new();
+        if config::get(environment::GOOGLE_CLIENT_ID).is_ok() {
+            keyring_get(environment::GOOGLE_CLIENT_SECRET).expect("google client secret must be set");
+            let google = framework::GoogleProvider::new();
+            providers.insert(google.get_name().to_string(), Arc::new(google));
+        }
+
+        RwLock::new(providers)
+    };
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::IdentityRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
+
+/// Registers the given identity provider by its name, replacing any other registered by the same one, so users may
+/// log in and link their accounts of that provider with no further changes
+pub fn register_provider(provider: impl IdentityProvider + Sync + Send + 'static) -> Result<(), Box<dyn Error>> {
+    match PROVIDERS.write() {
+        Ok(mut providers) => {
+            info!("identity provider {} has been registered", provider.get_name());
+            providers.insert(provider.get_name().to_string(), Arc::new(provider));
+            Ok(())
+        },
+        Err(err) => {
+            error!("write lock for identity providers got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
+
+/// Returns the identity provider registered by the given name
+pub fn get_provider(name: &str) -> Result<Provider, Box<dyn Error>> {
+    match PROVIDERS.read() {
+        Ok(providers) => providers.get(name).cloned().ok_or_else(|| errors::NOT_FOUND.into()),
+        Err(err) => {
+            error!("read lock for identity providers got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
+
+/// Returns the names of all the registered identity providers, sorted
+pub fn get_provider_names() -> Result<Vec<String>, Box<dyn Error>> {
+    match PROVIDERS.read() {
+        Ok(providers) => {
+            let mut names: Vec<String> = providers.keys().cloned().collect();
+            names.sort();
+            Ok(names)
+        },
+        Err(err) => {
+            error!("read lock for identity providers got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
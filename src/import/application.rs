@@ -0,0 +1,81 @@
+use std::error::Error;
+use std::collections::HashSet;
+use crate::tenant::application::tenant_find;
+use crate::constants::errors;
+use crate::user::application::{user_import, user_import_update};
+use super::domain::{Format, Conflict, Password, ImportReport, RecordError, parse};
+
+/// What has been done with a record
+enum Outcome {
+    Imported(bool), // whether the password has been kept
+    Updated,
+    Skipped,
+}
+
+/// Imports all the users of the given export, of the given format, into the given tenant. Passwords are kept where
+/// the algorithm they are hashed by is supported, while the rest of the users are required to reset theirs. Records
+/// whose email already exists are either skipped or update the existing user, as told by the conflict policy. Records
+/// that cannot be imported are reported without aborting the import. If dry_run is set, all the records are
+/// validated, but nothing gets imported
+pub fn import_users(tenant: &str,
+                    format: Format,
+                    data: &str,
+                    conflict: Conflict,
+                    dry_run: bool) -> Result<ImportReport, Box<dyn Error>> {
+
+    info!("got an import request of a {} export into tenant {} ", format.as_str(), tenant);
+
+    let tenant = tenant_find(tenant)?;
+    let mut report = ImportReport {
+        dry_run: dry_run,
+        ..Default::default()
+    };
+
+    // records of the same export conflict with each other as well, even if none of them has been created yet
+    let mut seen = HashSet::new();
+    for (index, record) in parse(format, data)?.into_iter().enumerate() {
+        let email = record.as_ref().map(|user| user.email.clone()).unwrap_or_default();
+        let result = record.and_then(|user| {
+            if !seen.insert(user.email.clone()) {
+                return Err(format!("email {} is duplicated", user.email));
+            }
+
+            let digest = match &user.password {
+                Password::Digest(digest) => Some(digest.as_str()),
+                _ => None,
+            };
+
+            match user_import(tenant.get_id(), &user.email, digest, user.verified, user.active, dry_run) {
+                Ok(preserved) => Ok(Outcome::Imported(preserved)),
+                Err(err) if err.to_string() != errors::ALREADY_EXISTS => Err(err.to_string()),
+                Err(_) if conflict == Conflict::Skip => Ok(Outcome::Skipped),
+                Err(_) => user_import_update(tenant.get_id(), &user.email, digest, user.verified, user.active, dry_run)
+                    .map(|_| Outcome::Updated)
+                    .map_err(|err| err.to_string()),
+            }
+        });
+
+        match result {
+            Ok(Outcome::Imported(preserved)) => {
+                report.imported += 1;
+                if preserved {
+                    report.preserved += 1;
+                } else {
+                    report.reset += 1;
+                }
+            },
+            Ok(Outcome::Updated) => report.updated += 1,
+            Ok(Outcome::Skipped) => report.skipped += 1,
+            Err(err) => report.errors.push(RecordError {
+                index: index,
+                email: email,
+                error: err,
+            }),
+        }
+    }
+
+    info!("{} users imported, {} of them keeping their password, {} updated, {} skipped, {} records failed",
+          report.imported, report.preserved, report.updated, report.skipped, report.errors.len());
+
+    Ok(report)
+}
@@ -0,0 +1,406 @@
+use std::error::Error;
+use serde_json::Value;
+use crate::constants::errors;
+
+/// All the export formats users can be imported from
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Format {
+    Auth0,    // a json array or json lines, as the bulk user import of auth0 takes them
+    Firebase, // as exported by `firebase auth:export --format=json`
+    Keycloak, // a realm export, or any of its users files
+    Csv,      // one user per row, with the names of the columns in the first one
+    Ndjson,   // one user per line, as a json object
+}
+
+impl Format {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Format::Auth0 => "auth0",
+            Format::Firebase => "firebase",
+            Format::Keycloak => "keycloak",
+            Format::Csv => "csv",
+            Format::Ndjson => "ndjson",
+        }
+    }
+
+    pub fn from_str(format: &str) -> Option<Self> {
+        match format {
+            "auth0" => Some(Format::Auth0),
+            "firebase" => Some(Format::Firebase),
+            "keycloak" => Some(Format::Keycloak),
+            "csv" => Some(Format::Csv),
+            "ndjson" => Some(Format::Ndjson),
+            _ => None,
+        }
+    }
+}
+
+/// What to do with the records whose email already belongs to a user of the tenant
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Conflict {
+    Skip,   // the user is kept as it is
+    Update, // the user gets the password, verification and status told by the record
+}
+
+impl Conflict {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Conflict::Skip => "skip",
+            Conflict::Update => "update",
+        }
+    }
+
+    pub fn from_str(conflict: &str) -> Option<Self> {
+        match conflict {
+            "skip" => Some(Conflict::Skip),
+            "update" => Some(Conflict::Update),
+            _ => None,
+        }
+    }
+}
+
+/// The password of an imported user, as far as it can be kept
+#[derive(Clone, PartialEq, Debug)]
+pub enum Password {
+    Digest(String),      // the unsalted sha-256 hex digest of the password, being the one clients send
+    Unsupported(String), // hashed by the given algorithm, which cannot be matched by the digest clients send
+    None,
+}
+
+/// A user as told by an export of another identity provider
+#[derive(Clone, PartialEq, Debug)]
+pub struct ImportedUser {
+    pub email: String,
+    pub verified: bool,
+    pub active: bool,
+    pub password: Password,
+}
+
+/// Why a record of an export has not been imported, told by its position (starting at zero) and email, if any
+#[derive(Clone, PartialEq, Debug)]
+pub struct RecordError {
+    pub index: usize,
+    pub email: String,
+    pub error: String,
+}
+
+/// The outcome of an import: how many users have been imported, updated or skipped because they already existed, how
+/// many of the imported ones kept their password and how many are required to reset it, along with every record that
+/// could not be imported
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct ImportReport {
+    pub dry_run: bool,
+    pub imported: usize,
+    pub updated: usize,
+    pub skipped: usize,
+    pub preserved: usize,
+    pub reset: usize,
+    pub errors: Vec<RecordError>,
+}
+
+fn to_hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|byte| format!("{:02x}", byte)).collect()
+}
+
+fn get_bool(record: &Value, name: &str, default: bool) -> bool {
+    match &record[name] {
+        Value::Bool(value) => *value,
+        // csv values are always strings, where an empty one stands for none
+        Value::String(value) => match value.trim().to_lowercase().as_str() {
+            "true" | "1" | "yes" => true,
+            "false" | "0" | "no" => false,
+            _ => default,
+        },
+        _ => default,
+    }
+}
+
+/// Splits the given csv row by its commas, except for the ones in quoted values, where a double quote stands for a
+/// quote. Values spanning several lines are not supported
+fn split_csv_row(row: &str) -> Vec<String> {
+    let mut values = Vec::new();
+    let mut value = String::new();
+    let mut quoted = false;
+    let mut chars = row.trim_end_matches('\r').chars().peekable();
+    while let Some(c) = chars.next() {
+        match (c, quoted) {
+            ('"', true) if chars.peek() == Some(&'"') => {
+                value.push('"');
+                chars.next();
+            },
+            ('"', _) => quoted = !quoted,
+            (',', false) => values.push(std::mem::take(&mut value)),
+            (c, _) => value.push(c),
+        }
+    }
+
+    values.push(value);
+    values
+}
+
+/// Returns every row of the given csv, but the first one, as an object whose keys are the names of the columns
+fn get_csv_records(data: &str) -> Result<Vec<Value>, Box<dyn Error>> {
+    let mut rows = data.lines().filter(|row| row.trim().len() > 0);
+    let columns: Vec<String> = match rows.next() {
+        Some(header) => split_csv_row(header).iter().map(|column| column.trim().to_lowercase()).collect(),
+        None => return Err(errors::PARSE_FAILED.into()),
+    };
+
+    Ok(rows.map(|row| {
+        let record = columns.iter().cloned()
+            .zip(split_csv_row(row).into_iter().map(Value::String))
+            .collect();
+
+        Value::Object(record)
+    }).collect())
+}
+
+fn get_email(record: &Value) -> Result<String, String> {
+    match record["email"].as_str() {
+        Some(email) if email.trim().len() > 0 => Ok(email.trim().to_lowercase()),
+        _ => Err("email is required".to_string()),
+    }
+}
+
+/// Returns all the records of the given document: either the array it is, the one under the given key or, if it is
+/// not a json document at all, one record per line
+fn get_records(data: &str, key: Option<&str>) -> Result<Vec<Value>, Box<dyn Error>> {
+    let document: Value = match serde_json::from_str(data) {
+        Ok(document) => document,
+        Err(_) => return data.lines()
+            .filter(|line| line.trim().len() > 0)
+            .map(|line| serde_json::from_str(line).map_err(|err| err.into()))
+            .collect(),
+    };
+
+    match (document, key) {
+        (Value::Array(records), _) => Ok(records),
+        (Value::Object(mut document), Some(key)) => match document.remove(key) {
+            Some(Value::Array(records)) => Ok(records),
+            _ => Err(errors::PARSE_FAILED.into()),
+        },
+        _ => Err(errors::PARSE_FAILED.into()),
+    }
+}
+
+/// Returns the password of an auth0 record: only sha256 custom hashes with no salt can be kept, while the rest, such as
+/// the bcrypt hashes of auth0 databases, cannot
+fn get_auth0_password(record: &Value) -> Password {
+    let custom = &record["custom_password_hash"];
+    if custom.is_object() {
+        let algorithm = custom["algorithm"].as_str().unwrap_or("unknown");
+        let hash = &custom["hash"];
+        let value = hash["value"].as_str().unwrap_or_default();
+        if algorithm != "sha256" || !hash["salt"].is_null() || value.len() == 0 {
+            return Password::Unsupported(algorithm.to_string());
+        }
+
+        return match hash["encoding"].as_str().unwrap_or("hex") {
+            "hex" => Password::Digest(value.to_lowercase()),
+            "base64" => match base64::decode(value) {
+                Ok(digest) => Password::Digest(to_hex(&digest)),
+                Err(_) => Password::Unsupported(algorithm.to_string()),
+            },
+            _ => Password::Unsupported(algorithm.to_string()),
+        };
+    }
+
+    match record["password_hash"].as_str().or(record["passwordHash"].as_str()) {
+        Some(_) => Password::Unsupported("bcrypt".to_string()),
+        None => Password::None,
+    }
+}
+
+fn parse_auth0(record: &Value) -> Result<ImportedUser, String> {
+    Ok(ImportedUser {
+        email: get_email(record)?,
+        verified: get_bool(record, "email_verified", false),
+        active: !get_bool(record, "blocked", false),
+        password: get_auth0_password(record),
+    })
+}
+
+/// Firebase hashes passwords by its own variant of scrypt, keyed by a secret of the project, so they are never kept
+fn parse_firebase(record: &Value) -> Result<ImportedUser, String> {
+    Ok(ImportedUser {
+        email: get_email(record)?,
+        verified: get_bool(record, "emailVerified", false),
+        active: !get_bool(record, "disabled", false),
+        password: match record["passwordHash"].as_str() {
+            Some(_) => Password::Unsupported("firebase-scrypt".to_string()),
+            None => Password::None,
+        },
+    })
+}
+
+/// Keycloak hashes passwords by salted pbkdf2, so they are never kept
+fn parse_keycloak(record: &Value) -> Result<ImportedUser, String> {
+    let credentials = record["credentials"].as_array().cloned().unwrap_or_default();
+    let password = credentials.iter()
+        .find(|credential| credential["type"] == "password")
+        .map(|credential| {
+            // the credential data is a json document embedded as a string
+            let data: Value = credential["credentialData"].as_str()
+                .and_then(|data| serde_json::from_str(data).ok())
+                .unwrap_or_default();
+
+            let algorithm = data["algorithm"].as_str().unwrap_or("pbkdf2-sha256");
+            Password::Unsupported(algorithm.to_string())
+        })
+        .unwrap_or(Password::None);
+
+    Ok(ImportedUser {
+        email: get_email(record)?,
+        verified: get_bool(record, "emailVerified", false),
+        active: get_bool(record, "enabled", true),
+        password: password,
+    })
+}
+
+/// Parses a record of a csv or ndjson file, whose password, if any, is the digest clients send
+fn parse_native(record: &Value) -> Result<ImportedUser, String> {
+    let password = match record["password"].as_str().map(str::trim) {
+        Some(digest) if digest.len() > 0 => Password::Digest(digest.to_lowercase()),
+        _ => Password::None,
+    };
+
+    Ok(ImportedUser {
+        email: get_email(record)?,
+        verified: get_bool(record, "verified", false),
+        active: get_bool(record, "active", true),
+        password: password,
+    })
+}
+
+/// Parses the given export of the given format, returning each of its records either as the user it tells or as why
+/// it cannot be imported. The whole export fails only if it is not well formatted
+pub fn parse(format: Format, data: &str) -> Result<Vec<Result<ImportedUser, String>>, Box<dyn Error>> {
+    let (records, parse_record): (Vec<Value>, fn(&Value) -> Result<ImportedUser, String>) = match format {
+        Format::Auth0 => (get_records(data, None)?, parse_auth0),
+        Format::Firebase => (get_records(data, Some("users"))?, parse_firebase),
+        Format::Keycloak => (get_records(data, Some("users"))?, parse_keycloak),
+        Format::Csv => (get_csv_records(data)?, parse_native),
+        Format::Ndjson => (get_records(data, None)?, parse_native),
+    };
+
+    Ok(records.iter().map(parse_record).collect())
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{Format, Password, ImportedUser, parse, split_csv_row};
+
+    #[test]
+    fn parse_auth0_should_not_fail() {
+        let data = r#"[
+            {"email": "Alice@example.com", "email_verified": true, "custom_password_hash": {"algorithm": "sha256", "hash": {"value": "A1B2C3D4", "encoding": "hex"}}},
+            {"email": "bob@example.com", "blocked": true, "custom_password_hash": {"algorithm": "sha256", "hash": {"value": "obLD1A==", "encoding": "base64"}}},
+            {"email": "carol@example.com", "custom_password_hash": {"algorithm": "sha256", "hash": {"value": "a1b2", "salt": {"value": "pepper"}}}},
+            {"email": "dave@example.com", "password_hash": "$2b$10$abcdefghijklmnopqrstuv"},
+            {"email_verified": true}
+        ]"#;
+
+        let records = parse(Format::Auth0, data).unwrap();
+        assert_eq!(5, records.len());
+        assert_eq!(&Ok(ImportedUser {
+            email: "alice@example.com".to_string(),
+            verified: true,
+            active: true,
+            password: Password::Digest("a1b2c3d4".to_string()),
+        }), &records[0]);
+
+        let bob = records[1].as_ref().unwrap();
+        assert!(!bob.active);
+        assert_eq!(Password::Digest("a1b2c3d4".to_string()), bob.password);
+        assert_eq!(Password::Unsupported("sha256".to_string()), records[2].as_ref().unwrap().password);
+        assert_eq!(Password::Unsupported("bcrypt".to_string()), records[3].as_ref().unwrap().password);
+        assert!(records[4].is_err());
+    }
+
+    #[test]
+    fn parse_auth0_lines_should_not_fail() {
+        let data = "{\"email\": \"alice@example.com\"}\n\n{\"email\": \"bob@example.com\"}\n";
+        let records = parse(Format::Auth0, data).unwrap();
+        assert_eq!(2, records.len());
+        assert_eq!(Password::None, records[1].as_ref().unwrap().password);
+    }
+
+    #[test]
+    fn parse_firebase_should_not_fail() {
+        let data = r#"{"users": [
+            {"localId": "1", "email": "alice@example.com", "emailVerified": true, "passwordHash": "c2NyeXB0", "salt": "c2FsdA=="},
+            {"localId": "2", "email": "bob@example.com", "disabled": true}
+        ]}"#;
+
+        let records = parse(Format::Firebase, data).unwrap();
+        let alice = records[0].as_ref().unwrap();
+        assert!(alice.verified);
+        assert_eq!(Password::Unsupported("firebase-scrypt".to_string()), alice.password);
+
+        let bob = records[1].as_ref().unwrap();
+        assert!(!bob.active);
+        assert_eq!(Password::None, bob.password);
+    }
+
+    #[test]
+    fn parse_keycloak_should_not_fail() {
+        let data = r#"{"realm": "example", "users": [
+            {"username": "alice", "email": "alice@example.com", "emailVerified": true, "enabled": true, "credentials": [
+                {"type": "password", "secretData": "{\"value\":\"aGFzaA==\",\"salt\":\"c2FsdA==\"}", "credentialData": "{\"hashIterations\":27500,\"algorithm\":\"pbkdf2-sha512\"}"}
+            ]},
+            {"username": "bob", "enabled": false}
+        ]}"#;
+
+        let records = parse(Format::Keycloak, data).unwrap();
+        assert_eq!(Password::Unsupported("pbkdf2-sha512".to_string()), records[0].as_ref().unwrap().password);
+        assert!(records[1].is_err());
+    }
+
+    #[test]
+    fn parse_csv_should_not_fail() {
+        let data = "Email,Password,Verified,Active\r\n\
+                    alice@example.com,A1B2C3D4,true,\r\n\
+                    \"bob@example.com\",,0,false\r\n\
+                    ,,,\r\n";
+
+        let records = parse(Format::Csv, data).unwrap();
+        assert_eq!(3, records.len());
+        assert_eq!(&Ok(ImportedUser {
+            email: "alice@example.com".to_string(),
+            verified: true,
+            active: true,
+            password: Password::Digest("a1b2c3d4".to_string()),
+        }), &records[0]);
+
+        assert_eq!(&Ok(ImportedUser {
+            email: "bob@example.com".to_string(),
+            verified: false,
+            active: false,
+            password: Password::None,
+        }), &records[1]);
+
+        assert!(records[2].is_err());
+    }
+
+    #[test]
+    fn split_csv_row_should_not_fail() {
+        assert_eq!(vec!["a", "b, \"c\"", ""], split_csv_row("a,\"b, \"\"c\"\"\","));
+    }
+
+    #[test]
+    fn parse_ndjson_should_not_fail() {
+        let data = "{\"email\": \"alice@example.com\", \"password\": \"a1b2c3d4\", \"verified\": true}\n";
+        let records = parse(Format::Ndjson, data).unwrap();
+        assert_eq!(Password::Digest("a1b2c3d4".to_string()), records[0].as_ref().unwrap().password);
+        assert!(records[0].as_ref().unwrap().verified);
+    }
+
+    #[test]
+    fn parse_should_fail() {
+        assert!(parse(Format::Auth0, "not json").is_err());
+        assert!(parse(Format::Firebase, r#"{"accounts": []}"#).is_err());
+        assert!(parse(Format::Keycloak, r#"{"users": {}}"#).is_err());
+        assert!(parse(Format::Csv, "").is_err());
+    }
+}
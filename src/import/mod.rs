@@ -0,0 +1,2 @@
+pub mod application;
+pub mod domain;
@@ -0,0 +1,70 @@
+use std::error::Error;
+use std::time::Duration;
+use crate::smtp;
+use crate::constants::{errors, environment, settings};
+use crate::metadata::domain::Metadata;
+use crate::tenant::application::tenant_setting;
+use crate::user::application::get_admin_user;
+use crate::time;
+use super::{
+    get_repository as get_invitation_repository,
+    domain::Invitation,
+};
+
+/// If, and only if, the provided token belongs to an administrator, a new single-use invitation for the given email
+/// is created and sent to it. Returns the code of the invitation
+pub fn invitation_create(token: &str,
+                         email: &str,
+                         admin: bool) -> Result<String, Box<dyn Error>> {
+
+    info!("got an invitation request for user {} ", email);
+
+    let issuer = get_admin_user(token)?;
+    let meta = Metadata::new();
+    let timeout = Duration::from_secs(settings::INVITATION_TIMEOUT);
+    let mut invitation = Invitation::new(meta, &issuer, email, admin, timeout)?;
+    get_invitation_repository().create(&mut invitation)?;
+
+    // the invitee has no locale of its own yet, so the invitation is sent in the one of the issuer
+    smtp::send_invitation_email(issuer.get_tenant(), issuer.get_locale(), email, invitation.get_code(), None)?;
+    Ok(invitation.get_code().to_string())
+}
+
+/// Returns true if, and only if, new users of the given tenant must provide a valid invitation at signup
+pub fn invitation_required_on_signup(tenant: i32) -> bool {
+    match tenant_setting(tenant, environment::SIGNUP_INVITATION) {
+        Some(value) => value == "true",
+        None => false,
+    }
+}
+
+/// Returns the invitation with the provided code if, and only if, it is still valid for the given email and tenant. If
+/// no code is provided, returns None unless invitations are required at signup
+pub fn invitation_find(tenant: i32, code: &str, email: &str) -> Result<Option<Invitation>, Box<dyn Error>> {
+    if code.len() == 0 {
+        if invitation_required_on_signup(tenant) {
+            return Err(errors::INVITATION_REQUIRED.into());
+        }
+
+        return Ok(None);
+    }
+
+    let invitation = get_invitation_repository().find_by_code(tenant, code)?;
+    if !invitation.is_valid_for(email) {
+        return Err(errors::INVITATION_REQUIRED.into());
+    }
+
+    Ok(Some(invitation))
+}
+
+/// Marks the provided invitation as used, so it cannot be used anymore
+pub fn invitation_redeem(invitation: &mut Invitation) -> Result<(), Box<dyn Error>> {
+    invitation.redeem()?;
+    get_invitation_repository().save(invitation)
+}
+
+/// Removes up to batch invitations already used or expired, which are no longer of any use, returning how many of them
+/// have been removed
+pub fn invitation_cleanup(batch: usize) -> Result<usize, Box<dyn Error>> {
+    get_invitation_repository().delete_stale(time::now(), batch)
+}
@@ -0,0 +1,179 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::regex;
+use crate::security;
+use crate::constants::settings;
+use crate::metadata::domain::Metadata;
+use crate::user::domain::User;
+use crate::time;
+
+pub trait InvitationRepository {
+    fn find_by_code(&self, tenant: i32, code: &str) -> Result<Invitation, Box<dyn Error>>;
+    fn create(&self, invitation: &mut Invitation) -> Result<(), Box<dyn Error>>;
+    fn save(&self, invitation: &Invitation) -> Result<(), Box<dyn Error>>;
+    // removes up to limit invitations already used or expired by the given time, returning how many there were
+    fn delete_stale(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>>;
+}
+
+#[derive(Clone)]
+pub struct Invitation {
+    pub(super) id: i32,
+    pub(super) code: String,        // the single-use code the invitee must provide at signup
+    pub(super) email: String,       // the only email the invitation is valid for
+    pub(super) issuer: i32,         // the user who has created the invitation
+    pub(super) admin: bool,         // if true, the invitee signs up as an administrator
+    pub(super) expires_at: SystemTime,
+    pub(super) used_at: Option<SystemTime>,
+    pub(super) meta: Metadata,
+    pub(super) tenant: i32,         // the tenant of the issuer, the only one the invitee can sign up into
+}
+
+impl Invitation {
+    pub fn new(meta: Metadata,
+               issuer: &User,
+               email: &str,
+               admin: bool,
+               timeout: Duration) -> Result<Self, Box<dyn Error>> {
+
+        regex::match_regex(regex::EMAIL, email)?;
+
+        let invitation = Invitation {
+            id: 0,
+            code: security::get_random_string(settings::INVITATION_LEN),
+            email: email.to_string(),
+            issuer: issuer.get_id(),
+            admin: admin,
+            expires_at: time::now() + timeout,
+            used_at: None,
+            meta: meta,
+            tenant: issuer.get_tenant(),
+        };
+
+        Ok(invitation)
+    }
+
+    /// if true, the invitation has not been used nor expired yet and it is for the provided email, else is not
+    pub fn is_valid_for(&self, email: &str) -> bool {
+        self.used_at.is_none() && self.expires_at > time::now() && self.email == email
+    }
+
+    /// if the invitation was not used before, sets the current time as its usage time
+    pub(super) fn redeem(&mut self) -> Result<(), Box<dyn Error>> {
+        if self.used_at.is_some() {
+            return Err("already used".into());
+        }
+
+        self.used_at = Some(time::now());
+        self.meta.touch();
+        Ok(())
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_code(&self) -> &str {
+        &self.code
+    }
+
+    pub fn get_email(&self) -> &str {
+        &self.email
+    }
+
+    pub fn get_issuer(&self) -> i32 {
+        self.issuer
+    }
+
+    pub fn is_admin(&self) -> bool {
+        self.admin
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use crate::constants::settings;
+    use crate::metadata::domain::tests::new_metadata;
+    use crate::user::domain::tests::new_user;
+    use super::Invitation;
+
+    pub fn new_invitation(email: &str) -> Invitation {
+        Invitation{
+            id: 999,
+            code: "testing".to_string(),
+            email: email.to_string(),
+            issuer: 999,
+            admin: false,
+            expires_at: SystemTime::now() + Duration::from_secs(60),
+            used_at: None,
+            meta: new_metadata(),
+            tenant: settings::DEFAULT_TENANT,
+        }
+    }
+
+    #[test]
+    fn invitation_new_should_not_fail() {
+        const EMAIL: &str = "invitee@testing.com";
+
+        let before = SystemTime::now();
+        let issuer = new_user();
+        let invitation = Invitation::new(new_metadata(), &issuer, EMAIL, true, Duration::from_secs(60)).unwrap();
+        let after = SystemTime::now();
+
+        assert_eq!(invitation.id, 0);
+        assert_eq!(invitation.code.len(), settings::INVITATION_LEN);
+        assert_eq!(invitation.email, EMAIL);
+        assert_eq!(invitation.issuer, issuer.get_id());
+        assert_eq!(invitation.tenant, issuer.get_tenant());
+        assert!(invitation.admin);
+        assert!(invitation.used_at.is_none());
+        assert!(invitation.expires_at >= before + Duration::from_secs(60));
+        assert!(invitation.expires_at <= after + Duration::from_secs(60));
+    }
+
+    #[test]
+    fn invitation_new_wrong_email_should_fail() {
+        let issuer = new_user();
+        let invitation = Invitation::new(new_metadata(), &issuer, "not_an_email", false, Duration::from_secs(60));
+        assert!(invitation.is_err());
+    }
+
+    #[test]
+    fn invitation_is_valid_for_should_not_fail() {
+        const EMAIL: &str = "invitee@testing.com";
+
+        let mut invitation = new_invitation(EMAIL);
+        assert!(invitation.is_valid_for(EMAIL));
+        assert!(!invitation.is_valid_for("another@testing.com"));
+
+        invitation.expires_at = SystemTime::now() - Duration::from_secs(1);
+        assert!(!invitation.is_valid_for(EMAIL));
+    }
+
+    #[test]
+    fn invitation_redeem_should_not_fail() {
+        const EMAIL: &str = "invitee@testing.com";
+
+        let mut invitation = new_invitation(EMAIL);
+        let before = SystemTime::now();
+        assert!(invitation.redeem().is_ok());
+        let after = SystemTime::now();
+
+        assert!(invitation.used_at.is_some());
+        let time = invitation.used_at.unwrap();
+        assert!(time >= before && time <= after);
+        assert!(!invitation.is_valid_for(EMAIL));
+    }
+
+    #[test]
+    fn invitation_redeem_twice_should_fail() {
+        let mut invitation = new_invitation("invitee@testing.com");
+        assert!(invitation.redeem().is_ok());
+        assert!(invitation.redeem().is_err());
+    }
+}
\ No newline at end of file
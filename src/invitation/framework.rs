@@ -0,0 +1,240 @@
+use std::error::Error;
+use std::time::SystemTime;
+use tonic::{Request, Response, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::schema::invitations::dsl::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::{invitations, metadata};
+use crate::pii;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use crate::firewall::framework::ip_filter;
+use super::domain::{Invitation, InvitationRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("invitation");
+}
+
+// Proto generated server traits
+use proto::invitation_service_server::InvitationService;
+pub use proto::invitation_service_server::InvitationServiceServer;
+
+// Proto message structs
+use proto::{InviteRequest, InviteResponse};
+
+pub struct InvitationServiceImplementation;
+
+#[tonic::async_trait]
+impl InvitationService for InvitationServiceImplementation {
+    async fn invite(&self, request: Request<InviteRequest>) -> Result<Response<InviteResponse>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::invitation_create(&token,
+                                                    &msg_ref.email,
+                                                    msg_ref.admin) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(invitation_code) => Ok(Response::new(
+                InviteResponse{
+                    code: invitation_code,
+                }
+            )),
+        }
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[changeset_options(treat_none_as_null = "true")]
+#[table_name = "invitations"]
+struct PostgresInvitation {
+    pub id: i32,
+    pub code: String,
+    pub email: String,
+    pub issuer: i32,
+    pub admin: bool,
+    pub expires_at: SystemTime,
+    pub used_at: Option<SystemTime>,
+    pub meta_id: i32,
+    pub tenant_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "invitations"]
+struct NewPostgresInvitation<'a> {
+    pub code: &'a str,
+    pub email: &'a str,
+    pub issuer: i32,
+    pub admin: bool,
+    pub expires_at: SystemTime,
+    pub meta_id: i32,
+    pub tenant_id: i32,
+}
+
+pub struct PostgresInvitationRepository;
+
+impl PostgresInvitationRepository {
+    fn create_on_conn(conn: &PgConnection, invitation: &mut Invitation, sealed_email: &str) -> Result<(), PgError>  {
+        // in order to create an invitation it must exists the metadata for this invitation
+        PostgresMetadataRepository::create_on_conn(conn, &mut invitation.meta)?;
+
+        let new_invitation = NewPostgresInvitation {
+            code: &invitation.code,
+            email: sealed_email,
+            issuer: invitation.issuer,
+            admin: invitation.admin,
+            expires_at: invitation.expires_at,
+            meta_id: invitation.meta.get_id(),
+            tenant_id: invitation.tenant,
+        };
+
+        let result = diesel::insert_into(invitations::table)
+            .values(&new_invitation)
+            .get_result::<PostgresInvitation>(conn)?;
+
+        invitation.id = result.id;
+        Ok(())
+    }
+}
+
+impl InvitationRepository for PostgresInvitationRepository {
+    fn find_by_code(&self, target_tenant: i32, target: &str) -> Result<Invitation, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            invitations.filter(tenant_id.eq(target_tenant))
+                       .filter(code.eq(target))
+                       .load::<PostgresInvitation>(&connection)?
+        };
+    
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        let meta = get_meta_repository().find(results[0].meta_id)?;
+        Ok(Invitation{
+            id: results[0].id,
+            code: results[0].code.clone(),
+            email: pii::decrypt(&results[0].email)?,
+            issuer: results[0].issuer,
+            admin: results[0].admin,
+            expires_at: results[0].expires_at,
+            used_at: results[0].used_at,
+            meta: meta,
+            tenant: results[0].tenant_id,
+        })
+    }
+
+    fn create(&self, invitation: &mut Invitation) -> Result<(), Box<dyn Error>> {
+        let sealed_email = pii::encrypt(&invitation.email)?;
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresInvitationRepository::create_on_conn(&conn, invitation, &sealed_email))?;
+        Ok(())
+    }
+
+    fn save(&self, invitation: &Invitation) -> Result<(), Box<dyn Error>> {
+        let pg_invitation = PostgresInvitation {
+            id: invitation.id,
+            code: invitation.code.clone(),
+            email: pii::encrypt(&invitation.email)?,
+            issuer: invitation.issuer,
+            admin: invitation.admin,
+            expires_at: invitation.expires_at,
+            used_at: invitation.used_at,
+            meta_id: invitation.meta.get_id(),
+            tenant_id: invitation.tenant,
+        };
+        
+        let connection = get_connection().get()?;
+        diesel::update(invitations)
+            .filter(id.eq(invitation.id))
+            .set(&pg_invitation)
+            .execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete_stale(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        let deleted = conn.transaction::<_, PgError, _>(|| {
+            let stale = invitations.filter(used_at.is_not_null().or(expires_at.le(now)))
+                                   .select((id, meta_id))
+                                   .limit(limit as i64)
+                                   .load::<(i32, i32)>(&conn)?;
+
+            let (ids, meta_ids): (Vec<i32>, Vec<i32>) = stale.into_iter().unzip();
+            diesel::delete(invitations.filter(id.eq_any(&ids))).execute(&conn)?;
+            diesel::delete(metadata::table.filter(metadata::id.eq_any(&meta_ids))).execute(&conn)?;
+            Ok(ids.len())
+        })?;
+
+        Ok(deleted)
+    }
+}
+
+
+pub struct InMemoryInvitationRepository {
+    table: memory::Table<Invitation>,
+}
+
+impl InMemoryInvitationRepository {
+    pub fn new() -> Self {
+        InMemoryInvitationRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl InvitationRepository for InMemoryInvitationRepository {
+    fn find_by_code(&self, tenant: i32, target: &str) -> Result<Invitation, Box<dyn Error>>  {
+        self.table.find_first(|invitation| invitation.tenant == tenant && invitation.code == target)
+    }
+
+    fn create(&self, invitation: &mut Invitation) -> Result<(), Box<dyn Error>> {
+        // in order to create an invitation it must exists the metadata for this invitation
+        get_meta_repository().create(&mut invitation.meta)?;
+
+        let target = invitation.code.clone();
+        self.table.insert(invitation,
+                          |existing| existing.code == target,
+                          |invitation, new_id| invitation.id = new_id)
+    }
+
+    fn save(&self, invitation: &Invitation) -> Result<(), Box<dyn Error>> {
+        self.table.update(invitation.id, invitation)
+    }
+
+    fn delete_stale(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>> {
+        let stale = self.table.find_all(|invitation| invitation.used_at.is_some() || invitation.expires_at <= now)?;
+        for invitation in stale.iter().take(limit) {
+            self.table.delete(invitation.id)?;
+            get_meta_repository().delete(&invitation.meta)?;
+        }
+
+        Ok(stale.len().min(limit))
+    }
+}
\ No newline at end of file
@@ -0,0 +1,244 @@
+use std::error::Error;
+use std::sync::{Arc, Mutex, Condvar};
+use std::thread;
+use std::time::{SystemTime, Duration, Instant};
+
+use crate::metrics;
+use crate::constants::errors;
+use crate::lock::application::is_leader;
+use super::domain::Job;
+
+#[derive(Default)]
+struct State {
+    stopping: bool,
+    running: usize, // runs in progress
+}
+
+#[derive(Default)]
+struct Shared {
+    state: Mutex<State>,
+    changed: Condvar,
+}
+
+impl Shared {
+    // waits for the given time, returning false if the scheduler got stopped meanwhile
+    fn sleep(&self, wait: Duration) -> bool {
+        let deadline = Instant::now() + wait;
+        let mut state = match self.state.lock() {
+            Ok(state) => state,
+            Err(err) => {
+                error!("lock for jobs scheduler got poisoned: {}", err);
+                return false;
+            }
+        };
+
+        loop {
+            let now = Instant::now();
+            if state.stopping {
+                return false;
+            } else if now >= deadline {
+                return true;
+            }
+
+            state = match self.changed.wait_timeout(state, deadline - now) {
+                Ok((state, _)) => state,
+                Err(err) => {
+                    error!("lock for jobs scheduler got poisoned: {}", err);
+                    return false;
+                }
+            };
+        }
+    }
+}
+
+// counts a run as in progress, unless the scheduler got stopped
+fn enter(shared: &Arc<Shared>) -> Option<Running> {
+    match shared.state.lock() {
+        Ok(mut state) if !state.stopping => {
+            state.running += 1;
+            Some(Running(shared.clone()))
+        },
+        Ok(_) => None,
+        Err(err) => {
+            error!("lock for jobs scheduler got poisoned: {}", err);
+            None
+        }
+    }
+}
+
+// releases a run once it is over, even if the job panicked
+struct Running(Arc<Shared>);
+
+impl Drop for Running {
+    fn drop(&mut self) {
+        match self.0.state.lock() {
+            Ok(mut state) => state.running -= 1,
+            Err(err) => error!("lock for jobs scheduler got poisoned: {}", err),
+        };
+
+        self.0.changed.notify_all();
+    }
+}
+
+/// Runs each background job by a thread of its own until stopped, recording how long every run takes and how it ends
+#[derive(Default)]
+pub struct Scheduler {
+    shared: Arc<Shared>,
+}
+
+impl Scheduler {
+    pub fn new() -> Self {
+        Default::default()
+    }
+
+    /// Spawns the thread the given job is run by
+    pub fn spawn(&self, job: Job) -> Result<(), Box<dyn Error>> {
+        let shared = self.shared.clone();
+        thread::Builder::new()
+            .name(format!("job-{}", job.get_name()))
+            .spawn(move || Scheduler::run(shared, job))?;
+
+        Ok(())
+    }
+
+    fn run(shared: Arc<Shared>, job: Job) {
+        let mut wait = if job.immediate {
+            Duration::default()
+        } else {
+            job.next_wait(SystemTime::now(), None, 0)
+        };
+
+        let mut failures = 0;
+        while shared.sleep(wait) {
+            if job.leader_only && !is_leader() {
+                metrics::job_skipped(job.name);
+                failures = 0;
+                wait = job.next_wait(SystemTime::now(), None, failures);
+                continue;
+            }
+
+            let running = match enter(&shared) {
+                Some(running) => running,
+                None => return,
+            };
+
+            let start = Instant::now();
+            let result = (job.task)();
+            drop(running);
+
+            metrics::job_finished(job.name, result.is_ok(), start.elapsed());
+            let outcome = match result {
+                Ok(outcome) => {
+                    failures = 0;
+                    Some(outcome)
+                },
+                Err(err) => {
+                    failures += 1;
+                    error!("{} job has failed: {}", job.name, err);
+                    None
+                },
+            };
+
+            wait = job.next_wait(SystemTime::now(), outcome, failures);
+        }
+    }
+
+    /// Stops all the jobs: none of them runs again, while the runs in progress are waited for as long as the given
+    /// grace period. Returns whether all of them were over in time
+    pub fn stop(&self, grace: Duration) -> Result<bool, Box<dyn Error>> {
+        let deadline = Instant::now() + grace;
+        let mut state = match self.shared.state.lock() {
+            Ok(state) => state,
+            Err(err) => {
+                error!("lock for jobs scheduler got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        state.stopping = true;
+        self.shared.changed.notify_all();
+        while state.running > 0 {
+            let now = Instant::now();
+            if now >= deadline {
+                return Ok(false);
+            }
+
+            state = match self.shared.changed.wait_timeout(state, deadline - now) {
+                Ok((state, _)) => state,
+                Err(err) => {
+                    error!("lock for jobs scheduler got poisoned: {}", err);
+                    return Err(errors::POISONED.into());
+                }
+            };
+        }
+
+        Ok(true)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::sync::Arc;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::mpsc;
+    use std::thread;
+    use std::time::Duration;
+    use super::super::domain::{Job, Schedule, Outcome};
+    use super::Scheduler;
+
+    #[test]
+    fn scheduler_spawn_should_not_fail() {
+        let scheduler = Scheduler::new();
+        let runs = Arc::new(AtomicUsize::new(0));
+        let counter = runs.clone();
+        let job = Job::new("test", Schedule::Every(Duration::from_millis(10)), move || {
+            counter.fetch_add(1, Ordering::SeqCst);
+            Ok(Outcome::Done)
+        });
+
+        scheduler.spawn(job).unwrap();
+        thread::sleep(Duration::from_millis(200));
+        assert!(scheduler.stop(Duration::from_secs(1)).unwrap());
+
+        let stopped_at = runs.load(Ordering::SeqCst);
+        assert!(stopped_at > 1);
+
+        thread::sleep(Duration::from_millis(50));
+        assert_eq!(stopped_at, runs.load(Ordering::SeqCst));
+    }
+
+    #[test]
+    fn scheduler_pending_should_not_fail() {
+        // a job with pending work runs again right away, no matter how long its period is
+        let scheduler = Scheduler::new();
+        let (sender, receiver) = mpsc::channel();
+        let job = Job::new("test", Schedule::Every(Duration::from_secs(3600)), move || {
+            let _ = sender.send(());
+            Ok(Outcome::Pending)
+        }).immediate();
+
+        scheduler.spawn(job).unwrap();
+        for _ in 0..3 {
+            receiver.recv_timeout(Duration::from_secs(1)).unwrap();
+        }
+
+        scheduler.stop(Duration::from_secs(1)).unwrap();
+    }
+
+    #[test]
+    fn scheduler_stop_should_wait_for_running_jobs() {
+        let scheduler = Scheduler::new();
+        let (started_sender, started) = mpsc::channel();
+        let job = Job::new("test", Schedule::Every(Duration::from_secs(3600)), move || {
+            started_sender.send(()).unwrap();
+            thread::sleep(Duration::from_millis(300));
+            Ok(Outcome::Done)
+        }).immediate();
+
+        scheduler.spawn(job).unwrap();
+        started.recv_timeout(Duration::from_secs(1)).unwrap();
+        assert!(!scheduler.stop(Duration::from_millis(10)).unwrap());
+        assert!(scheduler.stop(Duration::from_secs(2)).unwrap());
+    }
+}
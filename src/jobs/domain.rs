@@ -0,0 +1,359 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::time::{SystemTime, Duration};
+use chrono::{DateTime, Datelike, Timelike, TimeZone, Utc};
+use crate::constants::errors;
+
+// cron schedules not matching any time within this range, such as the 30th of february, never run at all
+const CRON_HORIZON: i64 = 1461; // time in days, 365d * 4y
+
+/// What the latest run of a job tells about the work left
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Outcome {
+    Done,    // nothing left, so the job waits for its next scheduled run
+    Pending, // a full batch was done, so the job runs again right away, or once its pace is over
+}
+
+pub type Task = Box<dyn Fn() -> Result<Outcome, Box<dyn Error>> + Send>;
+
+/// A cron expression of five fields: minute, hour, day of month, month and day of week, each one being either `*`, a
+/// number, a range such as `1-5` or a comma-separated list of them, optionally followed by a step such as `*/15`.
+/// Times are matched in UTC
+#[derive(Debug, Clone, PartialEq)]
+pub struct Cron {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    weekdays: u64,
+    any_day: bool,
+    any_weekday: bool,
+}
+
+impl Cron {
+    pub fn from_str(expr: &str) -> Result<Self, Box<dyn Error>> {
+        let fields: Vec<&str> = expr.split_whitespace().collect();
+        if fields.len() != 5 {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        // either 0 or 7 stand for sunday
+        let mut weekdays = parse_field(fields[4], 0, 7)?;
+        if weekdays & 1 << 7 != 0 {
+            weekdays = (weekdays | 1) & !(1 << 7);
+        }
+
+        let cron = Cron {
+            minutes: parse_field(fields[0], 0, 59)?,
+            hours: parse_field(fields[1], 0, 23)?,
+            days: parse_field(fields[2], 1, 31)?,
+            months: parse_field(fields[3], 1, 12)?,
+            weekdays: weekdays,
+            any_day: fields[2] == "*",
+            any_weekday: fields[4] == "*",
+        };
+
+        if cron.next_after(SystemTime::now()).is_none() {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(cron)
+    }
+
+    // as cron does, if both the day of month and the day of week are restricted, any of them matching is enough
+    fn matches_day(&self, time: &DateTime<Utc>) -> bool {
+        let day = self.days & 1 << time.day() != 0;
+        let weekday = self.weekdays & 1 << time.weekday().num_days_from_sunday() != 0;
+        match (self.any_day, self.any_weekday) {
+            (true, true) => true,
+            (true, false) => weekday,
+            (false, true) => day,
+            (false, false) => day || weekday,
+        }
+    }
+
+    /// Returns the first time, at the start of a minute, after the given one the expression matches, if any
+    pub fn next_after(&self, after: SystemTime) -> Option<SystemTime> {
+        let after: DateTime<Utc> = after.into();
+        let mut time = after.with_second(0)?.with_nanosecond(0)? + chrono::Duration::minutes(1);
+        let horizon = time + chrono::Duration::days(CRON_HORIZON);
+        while time < horizon {
+            if self.months & 1 << time.month() == 0 {
+                let (year, month) = if time.month() == 12 {(time.year() + 1, 1)} else {(time.year(), time.month() + 1)};
+                time = Utc.ymd(year, month, 1).and_hms(0, 0, 0);
+            } else if !self.matches_day(&time) {
+                time = (time.date() + chrono::Duration::days(1)).and_hms(0, 0, 0);
+            } else if self.hours & 1 << time.hour() == 0 {
+                time = time.with_minute(0)? + chrono::Duration::hours(1);
+            } else if self.minutes & 1 << time.minute() == 0 {
+                time = time + chrono::Duration::minutes(1);
+            } else {
+                return Some(time.into());
+            }
+        }
+
+        None
+    }
+}
+
+// returns the bitset of all the values within min and max the given field of a cron expression matches
+fn parse_field(field: &str, min: u32, max: u32) -> Result<u64, Box<dyn Error>> {
+    let mut values = 0;
+    for item in field.split(',') {
+        let mut parts = item.splitn(2, '/');
+        let range = parts.next().unwrap_or_default();
+        let step: u32 = match parts.next() {
+            Some(step) => step.parse()?,
+            None => 1,
+        };
+
+        let (from, to) = match range {
+            "*" => (min, max),
+            range => match range.find('-') {
+                Some(index) => (range[..index].parse()?, range[index + 1..].parse()?),
+                None if item.contains('/') => (range.parse()?, max),
+                None => (range.parse()?, range.parse()?),
+            },
+        };
+
+        if step == 0 || from < min || to > max || from > to {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        for value in (from..=to).step_by(step as usize) {
+            values |= 1 << value;
+        }
+    }
+
+    Ok(values)
+}
+
+/// When a job runs: either every given period since its latest run, or at the times matched by a cron expression
+#[derive(Debug, Clone, PartialEq)]
+pub enum Schedule {
+    Every(Duration),
+    Cron(Cron),
+}
+
+impl Schedule {
+    /// Parses either a period, formatted as `@every <n><s|m|h|d>` such as "@every 30s", or a cron expression such as
+    /// "0 3 * * *"
+    pub fn from_str(schedule: &str) -> Result<Self, Box<dyn Error>> {
+        let schedule = schedule.trim();
+        if !schedule.starts_with("@every") {
+            return Ok(Schedule::Cron(Cron::from_str(schedule)?));
+        }
+
+        let period = schedule.trim_start_matches("@every").trim();
+        let (amount, unit) = period.split_at(period.find(|c: char| !c.is_ascii_digit()).unwrap_or(period.len()));
+        let amount: u64 = amount.parse()?;
+        let secs = match unit {
+            "" | "s" => amount,
+            "m" => amount * 60,
+            "h" => amount * 3600,
+            "d" => amount * 86400,
+            _ => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        if secs == 0 {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(Schedule::Every(Duration::from_secs(secs)))
+    }
+
+    /// Parses a semicolon-separated list of schedules by job, formatted as <job>=<schedule>, such as
+    /// "purge=0 3 * * *;relay=@every 10s"
+    pub fn from_list(schedules: &str) -> Result<HashMap<String, Self>, Box<dyn Error>> {
+        schedules.split(';')
+            .filter(|schedule| schedule.trim().len() > 0)
+            .map(|schedule| -> Result<(String, Schedule), Box<dyn Error>> {
+                let mut parts = schedule.splitn(2, '=');
+                match (parts.next(), parts.next()) {
+                    (Some(job), Some(schedule)) if job.trim().len() > 0 => {
+                        Ok((job.trim().to_string(), Schedule::from_str(schedule)?))
+                    },
+                    _ => Err(errors::PARSE_FAILED.into()),
+                }
+            })
+            .collect()
+    }
+
+    /// Returns the time of the next run after the given one
+    pub fn next_after(&self, after: SystemTime) -> SystemTime {
+        match self {
+            Schedule::Every(period) => after + *period,
+            // parsed expressions always match some time, yet the horizon may come closer than the next one
+            Schedule::Cron(cron) => cron.next_after(after)
+                .unwrap_or(after + Duration::from_secs(CRON_HORIZON as u64 * 86400)),
+        }
+    }
+}
+
+/// A background job: the task run by its schedule, plus how its runs get spread and retried
+pub struct Job {
+    pub(super) name: &'static str,
+    pub(super) schedule: Schedule,
+    pub(super) task: Task,
+    pub(super) jitter: f64, // max fraction of the wait randomly added to it
+    pub(super) backoff: Option<Duration>, // max wait while failing, doubled on every failure in a row
+    pub(super) pace: Duration, // wait between runs while work is pending
+    pub(super) leader_only: bool, // whether only the leader of the cluster runs it
+    pub(super) immediate: bool, // whether the first run takes place right away, rather than by the schedule
+}
+
+impl Job {
+    pub fn new<F>(name: &'static str, schedule: Schedule, task: F) -> Self
+    where
+        F: Fn() -> Result<Outcome, Box<dyn Error>> + Send + 'static,
+    {
+        Job {
+            name: name,
+            schedule: schedule,
+            task: Box::new(task),
+            jitter: 0.0,
+            backoff: None,
+            pace: Duration::default(),
+            leader_only: false,
+            immediate: false,
+        }
+    }
+
+    pub fn get_name(&self) -> &'static str {
+        self.name
+    }
+
+    /// Adds up to the given fraction of every wait to it, so the instances of the cluster do not run the job all at once
+    pub fn with_jitter(mut self, jitter: f64) -> Self {
+        self.jitter = jitter.max(0.0);
+        self
+    }
+
+    /// Doubles the wait on every failure in a row, up to the given max
+    pub fn with_backoff(mut self, max: Duration) -> Self {
+        self.backoff = Some(max);
+        self
+    }
+
+    /// Waits the given time between runs while work is pending, so a backlog is not drained as fast as possible but at
+    /// a pace the storage can bear
+    pub fn with_pace(mut self, pace: Duration) -> Self {
+        self.pace = pace;
+        self
+    }
+
+    /// Runs the job only while this instance is the leader of the cluster
+    pub fn leader_only(mut self) -> Self {
+        self.leader_only = true;
+        self
+    }
+
+    /// Runs the job right away once started, rather than waiting for its schedule
+    pub fn immediate(mut self) -> Self {
+        self.immediate = true;
+        self
+    }
+
+    /// Returns how long to wait from the given time for the next run, given the outcome of the latest one, if it did
+    /// not fail, and how many have failed in a row
+    pub fn next_wait(&self, now: SystemTime, outcome: Option<Outcome>, failures: u32) -> Duration {
+        if outcome == Some(Outcome::Pending) {
+            return self.pace;
+        }
+
+        let mut wait = self.schedule.next_after(now).duration_since(now).unwrap_or_default();
+        if let Some(max) = self.backoff.filter(|_| failures > 0) {
+            wait = wait.checked_mul(1 << failures.min(16)).unwrap_or(max).min(max);
+        }
+
+        wait + wait.mul_f64(rand::random::<f64>() * self.jitter)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use chrono::{TimeZone, Utc};
+    use super::{Cron, Schedule, Job, Outcome};
+
+    fn at(year: i32, month: u32, day: u32, hour: u32, minute: u32) -> SystemTime {
+        Utc.ymd(year, month, day).and_hms(hour, minute, 0).into()
+    }
+
+    #[test]
+    fn cron_next_after_should_not_fail() {
+        let cron = Cron::from_str("*/15 * * * *").unwrap();
+        assert_eq!(Some(at(2021, 6, 1, 10, 15)), cron.next_after(at(2021, 6, 1, 10, 0)));
+        assert_eq!(Some(at(2021, 6, 1, 11, 0)), cron.next_after(at(2021, 6, 1, 10, 50)));
+
+        let cron = Cron::from_str("0 3 * * *").unwrap();
+        assert_eq!(Some(at(2021, 6, 2, 3, 0)), cron.next_after(at(2021, 6, 1, 3, 0)));
+
+        let cron = Cron::from_str("30 2 1 1,7 *").unwrap();
+        assert_eq!(Some(at(2021, 7, 1, 2, 30)), cron.next_after(at(2021, 6, 1, 0, 0)));
+        assert_eq!(Some(at(2022, 1, 1, 2, 30)), cron.next_after(at(2021, 12, 31, 0, 0)));
+
+        // the 5th of june of 2021 was a saturday
+        let cron = Cron::from_str("0 0 * * 1-5").unwrap();
+        assert_eq!(Some(at(2021, 6, 7, 0, 0)), cron.next_after(at(2021, 6, 5, 0, 0)));
+
+        let cron = Cron::from_str("0 0 * * 7").unwrap();
+        assert_eq!(Some(at(2021, 6, 6, 0, 0)), cron.next_after(at(2021, 6, 5, 0, 0)));
+    }
+
+    #[test]
+    fn cron_from_str_should_fail() {
+        assert!(Cron::from_str("* * * *").is_err());
+        assert!(Cron::from_str("60 * * * *").is_err());
+        assert!(Cron::from_str("* * 0 * *").is_err());
+        assert!(Cron::from_str("*/0 * * * *").is_err());
+        assert!(Cron::from_str("5-1 * * * *").is_err());
+        assert!(Cron::from_str("0 0 30 2 *").is_err());
+    }
+
+    #[test]
+    fn schedule_from_list_should_not_fail() {
+        let schedules = Schedule::from_list("purge=0 3 * * *; relay=@every 10s;webhook=@every 2m").unwrap();
+        assert_eq!(3, schedules.len());
+        assert_eq!(Schedule::Cron(Cron::from_str("0 3 * * *").unwrap()), schedules["purge"]);
+        assert_eq!(Schedule::Every(Duration::from_secs(10)), schedules["relay"]);
+        assert_eq!(Schedule::Every(Duration::from_secs(120)), schedules["webhook"]);
+    }
+
+    #[test]
+    fn schedule_from_list_should_fail() {
+        assert!(Schedule::from_list("purge").is_err());
+        assert!(Schedule::from_list("=@every 10s").is_err());
+        assert!(Schedule::from_list("relay=@every 0s").is_err());
+        assert!(Schedule::from_list("relay=@every 10w").is_err());
+    }
+
+    #[test]
+    fn job_next_wait_should_not_fail() {
+        let now = SystemTime::now();
+        let job = Job::new("test", Schedule::Every(Duration::from_secs(5)), || Ok(Outcome::Done))
+            .with_backoff(Duration::from_secs(60));
+
+        assert_eq!(Duration::from_secs(5), job.next_wait(now, None, 0));
+        assert_eq!(Duration::from_secs(5), job.next_wait(now, Some(Outcome::Done), 0));
+        assert_eq!(Duration::default(), job.next_wait(now, Some(Outcome::Pending), 0));
+        assert_eq!(Duration::from_secs(20), job.next_wait(now, None, 2));
+        assert_eq!(Duration::from_secs(60), job.next_wait(now, None, 10));
+
+        let job = job.with_pace(Duration::from_millis(100));
+        assert_eq!(Duration::from_millis(100), job.next_wait(now, Some(Outcome::Pending), 0));
+    }
+
+    #[test]
+    fn job_next_wait_with_jitter_should_not_fail() {
+        let now = SystemTime::now();
+        let job = Job::new("test", Schedule::Every(Duration::from_secs(10)), || Ok(Outcome::Done))
+            .with_jitter(0.5);
+
+        for _ in 0..100 {
+            let wait = job.next_wait(now, None, 0);
+            assert!(wait >= Duration::from_secs(10) && wait <= Duration::from_secs(15));
+        }
+    }
+}
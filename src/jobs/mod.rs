@@ -0,0 +1,240 @@
+pub mod application;
+pub mod domain;
+
+use std::error::Error;
+use std::collections::HashMap;
+use std::time::Duration;
+use crate::constants::{environment, settings};
+use crate::{config, user, audit, webhook, keyring, session, signing, revocation, invitation, recovery};
+use crate::lock::application::{is_leader, leader_campaign};
+use self::application::Scheduler;
+use self::domain::{Job, Schedule, Outcome};
+
+lazy_static! {
+    static ref SCHEDULER: Scheduler = Scheduler::new();
+    static ref SCHEDULES: HashMap<String, Schedule> = match config::get(environment::JOB_SCHEDULES) {
+        Ok(schedules) => Schedule::from_list(&schedules)
+            .expect("job schedules must be a list of <job>=<cron expression or @every period>"),
+        Err(_) => HashMap::new(),
+    };
+}
+
+// returns a job run every given seconds, unless JOB_SCHEDULES sets any other schedule for it
+fn every<F>(name: &'static str, secs: u64, task: F) -> Job
+where
+    F: Fn() -> Result<Outcome, Box<dyn Error>> + Send + 'static,
+{
+    let schedule = SCHEDULES.get(name).cloned()
+        .unwrap_or(Schedule::Every(Duration::from_secs(secs)));
+
+    Job::new(name, schedule, task).with_jitter(settings::JOB_JITTER)
+}
+
+/// Campaigns for the leadership, so the jobs of the whole cluster, such as purging users or relaying events, are run by
+/// a single instance at a time, and taken over by any other once it is gone
+fn leader_job() -> Job {
+    // renewals must take place before the leadership expires, so they get no jitter
+    every("leader", settings::LEADER_RENEW, || {
+        leader_campaign()?;
+        Ok(Outcome::Done)
+    }).with_jitter(0.0)
+}
+
+/// Purges all these users whose retention period is over, and removes the pre-registered ones whose activation
+/// deadline is over, if leader
+fn purge_job() -> Job {
+    let retention = match config::get(environment::RETENTION_PERIOD) {
+        Ok(secs) => secs.parse().expect("retention period must be a number of seconds"),
+        Err(_) => settings::RETENTION_PERIOD,
+    };
+
+    every("purge", settings::PURGE_PERIOD, move || {
+        let count = user::application::user_purge(Duration::from_secs(retention))?;
+        info!("{} deleted users have been purged", count);
+
+        let count = user::application::user_expire_pending()?;
+        if count > 0 {
+            info!("{} pending users have expired", count);
+        }
+
+        Ok(Outcome::Done)
+    }).leader_only()
+}
+
+/// Removes the expired sessions and remember-me sessions kept by this instance, if any, and, if leader, the used or
+/// expired invitations and recoveries. Each run removes up to CLEANUP_BATCH of each, and while any of them is full the
+/// next one follows once CLEANUP_PACE milliseconds are over, so a backlog causes no spike of load on the storage
+fn cleanup_job() -> Job {
+    let batch = match config::get(environment::CLEANUP_BATCH) {
+        Ok(batch) => batch.parse::<usize>().expect("cleanup batch must be a number").max(1),
+        Err(_) => settings::CLEANUP_BATCH,
+    };
+
+    let pace = match config::get(environment::CLEANUP_PACE) {
+        Ok(millis) => millis.parse().expect("cleanup pace must be a number of milliseconds"),
+        Err(_) => settings::CLEANUP_PACE,
+    };
+
+    every("cleanup", settings::CLEANUP_PERIOD, move || {
+        let sessions = session::application::session_cleanup(batch)?;
+        let (invitations, recoveries) = if is_leader() {
+            (invitation::application::invitation_cleanup(batch)?, recovery::application::recovery_cleanup(batch)?)
+        } else {
+            (0, 0)
+        };
+
+        if sessions + invitations + recoveries > 0 {
+            info!("{} expired sessions, {} stale invitations and {} stale recoveries have been removed",
+                  sessions, invitations, recoveries);
+        }
+
+        if sessions == batch || invitations == batch || recoveries == batch {
+            Ok(Outcome::Pending)
+        } else {
+            Ok(Outcome::Done)
+        }
+    }).with_pace(Duration::from_millis(pace))
+}
+
+/// Relays all the recorded events to the sinks, if leader. While the relay keeps failing it waits twice as long every
+/// time, up to a few minutes, while a full batch is followed by the next one right away, so a backlog gets drained as
+/// fast as the sinks accept it
+fn relay_job() -> Job {
+    every("relay", settings::RELAY_PERIOD, || {
+        match audit::application::audit_relay(settings::RELAY_BATCH)? {
+            count if count as u64 == settings::RELAY_BATCH => {
+                info!("{} events have been published, more are pending", count);
+                Ok(Outcome::Pending)
+            },
+            count => {
+                if count > 0 {
+                    info!("{} events have been published", count);
+                }
+
+                Ok(Outcome::Done)
+            },
+        }
+    }).leader_only().with_backoff(Duration::from_secs(settings::RELAY_MAX_BACKOFF))
+}
+
+/// Chains the events recorded since the latest checkpoint of the audit trail into a new one, if leader. A full batch is
+/// followed by the next one right away, so a backlog gets chained as fast as possible
+fn checkpoint_job() -> Job {
+    every("checkpoint", settings::CHECKPOINT_PERIOD, || {
+        match audit::application::audit_checkpoint(settings::CHECKPOINT_BATCH)? {
+            count if count as u64 == settings::CHECKPOINT_BATCH => Ok(Outcome::Pending),
+            _ => Ok(Outcome::Done),
+        }
+    }).leader_only()
+}
+
+/// Attempts all the webhook deliveries whose time has come, if leader. A full batch is followed by the next one right
+/// away, while failing deliveries are scheduled again by themselves
+fn webhook_job() -> Job {
+    every("webhook", settings::WEBHOOK_PERIOD, || {
+        match webhook::application::webhook_deliver(settings::WEBHOOK_BATCH)? {
+            count if count as u64 == settings::WEBHOOK_BATCH => Ok(Outcome::Pending),
+            _ => Ok(Outcome::Done),
+        }
+    }).leader_only()
+}
+
+/// Fetches again all the secrets in use, so the rotated ones get noticed and their hooks called
+fn rotation_job() -> Job {
+    every("rotation", settings::SECRETS_TTL, || {
+        let count = keyring::application::keyring_refresh()?;
+        if count > 0 {
+            info!("{} secrets have been rotated", count);
+        }
+
+        Ok(Outcome::Done)
+    })
+}
+
+/// Checks whether the config file has changed, so the new value of all the reloadable settings gets applied and their
+/// hooks called. On failure the current settings are kept
+fn config_job() -> Job {
+    every("config", settings::CONFIG_PERIOD, || {
+        let changed = config::refresh()?;
+        if changed.len() > 0 {
+            info!("config reloaded, changed settings: {}", changed.join(", "));
+        }
+
+        Ok(Outcome::Done)
+    })
+}
+
+/// Pulls the changes on sessions made by the peer regions. A full batch is followed by the next one right away
+fn replication_job() -> Job {
+    every("replication", settings::REPLICATION_PERIOD, || {
+        match session::application::session_replicate(settings::REPLICATION_BATCH)? {
+            count if count == settings::REPLICATION_BATCH => Ok(Outcome::Pending),
+            _ => Ok(Outcome::Done),
+        }
+    })
+}
+
+/// Moves the signing keys schedule forward. Only the leader moves it, while any other instance just applies the keys
+/// it has moved
+fn signing_job() -> Job {
+    every("signing", settings::KEY_ROTATION_CHECK, || {
+        if is_leader() {
+            signing::application::signing_rotate()?;
+        } else {
+            signing::application::signing_reload()?;
+        }
+
+        Ok(Outcome::Done)
+    }).immediate()
+}
+
+/// Pulls the sessions revoked by other instances into the revocation filter, rebuilding it from scratch every once in
+/// a while so expired revocations get dropped
+fn revocation_job() -> Job {
+    every("revocation", settings::REVOCATION_REFRESH, || {
+        revocation::application::revocation_refresh()?;
+        Ok(Outcome::Done)
+    }).immediate()
+}
+
+/// Schedules all the background jobs above, once the first campaign for the leadership is over. Jobs with nothing to
+/// do, such as relaying events with no sinks, are not scheduled at all
+pub fn start_all() -> Result<(), Box<dyn Error>> {
+    match leader_campaign() {
+        Ok(true) => info!("this instance is the leader of the background jobs"),
+        Ok(false) => info!("some other instance is the leader of the background jobs"),
+        Err(err) => error!("could not campaign for the leadership of the background jobs: {}", err),
+    };
+
+    SCHEDULER.spawn(leader_job())?;
+    SCHEDULER.spawn(purge_job())?;
+    SCHEDULER.spawn(cleanup_job())?;
+    if audit::get_sinks()?.len() > 0 {
+        SCHEDULER.spawn(relay_job())?;
+    }
+
+    SCHEDULER.spawn(checkpoint_job())?;
+    SCHEDULER.spawn(webhook_job())?;
+    SCHEDULER.spawn(rotation_job())?;
+    SCHEDULER.spawn(config_job())?;
+    if session::application::session_replication_enabled() {
+        SCHEDULER.spawn(replication_job())?;
+    }
+
+    if signing::application::signing_enabled() {
+        SCHEDULER.spawn(signing_job())?;
+    }
+
+    SCHEDULER.spawn(revocation_job())?;
+    Ok(())
+}
+
+/// Stops all the background jobs, waiting for the runs in progress for as long as the given grace period. Once
+/// stopped, they cannot be started again
+pub fn stop_all(grace: Duration) {
+    match SCHEDULER.stop(grace) {
+        Ok(true) => info!("background jobs have been stopped"),
+        Ok(false) => warn!("grace period is over, dropping the background jobs still running"),
+        Err(err) => error!("could not stop the background jobs: {}", err),
+    };
+}
@@ -0,0 +1,157 @@
+use std::error::Error;
+use std::sync::RwLock;
+use std::time::Duration;
+use std::collections::HashMap;
+use crate::constants::{errors, settings};
+use super::{
+    get_sources,
+    domain::CachedSecret,
+};
+
+type RotationHook = Box<dyn Fn(&str) + Sync + Send>;
+
+lazy_static! {
+    static ref CACHE: RwLock<HashMap<String, CachedSecret>> = RwLock::new(HashMap::new());
+    static ref HOOKS: RwLock<HashMap<String, Vec<RotationHook>>> = RwLock::new(HashMap::new());
+}
+
+/// Returns the value of the secret with the given name from the first source having it, as sorted by the providers
+/// list. Failing sources are not skipped, so a secret is never taken from a source it was not meant to come from
+fn fetch(name: &str) -> Result<Option<String>, Box<dyn Error>> {
+    for source in get_sources().iter() {
+        if let Some(value) = source.fetch(name)? {
+            return Ok(Some(value));
+        }
+    }
+
+    Ok(None)
+}
+
+/// Fetches the secret with the given name and caches it. If it differs from the one cached so far, all the hooks
+/// registered for the secret are called with its new value. Returns the value and whether it has been rotated or not
+fn keyring_load(name: &str) -> Result<(String, bool), Box<dyn Error>> {
+    let value = match fetch(name)? {
+        Some(value) => value,
+        None => return Err(format!("secret {} must be set", name).into()),
+    };
+
+    let previous = match CACHE.write() {
+        Ok(mut cache) => cache.insert(name.to_string(), CachedSecret::new(&value)),
+        Err(err) => {
+            error!("write lock for secrets cache got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let rotated = previous.map(|previous| previous.get_value() != value).unwrap_or(false);
+    if rotated {
+        info!("secret {} has been rotated", name);
+        match HOOKS.read() {
+            Ok(hooks) => if let Some(hooks) = hooks.get(name) {
+                hooks.iter().for_each(|hook| hook(&value));
+            },
+
+            Err(err) => error!("read lock for rotation hooks got poisoned: {}", err),
+        }
+    }
+
+    Ok((value, rotated))
+}
+
+/// Returns the value of the secret with the given name, as cached for no longer than the secrets time to live. If the
+/// sources cannot be reached once it has expired, the last known value is returned instead, so an unavailable provider
+/// does not take the service down
+pub fn keyring_get(name: &str) -> Result<String, Box<dyn Error>> {
+    let cached = match CACHE.read() {
+        Ok(cache) => cache.get(name).cloned(),
+        Err(err) => {
+            error!("read lock for secrets cache got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let ttl = Duration::from_secs(settings::SECRETS_TTL);
+    if let Some(cached) = cached.as_ref().filter(|cached| !cached.is_expired(ttl)) {
+        return Ok(cached.get_value().to_string());
+    }
+
+    match keyring_load(name) {
+        Ok((value, _)) => Ok(value),
+        Err(err) => match cached {
+            Some(cached) => {
+                warn!("secret {} could not be refreshed, keeping the last known value: {}", name, err);
+                Ok(cached.get_value().to_string())
+            },
+            None => Err(err),
+        },
+    }
+}
+
+/// Registers a hook to be called with the new value of the secret with the given name every time it gets rotated.
+/// Hooks must not register any other hook
+pub fn keyring_on_rotate(name: &str, hook: impl Fn(&str) + Sync + Send + 'static) {
+    match HOOKS.write() {
+        Ok(mut hooks) => hooks.entry(name.to_string()).or_insert_with(Vec::new).push(Box::new(hook)),
+        Err(err) => error!("write lock for rotation hooks got poisoned: {}", err),
+    }
+}
+
+/// Fetches again all the secrets resolved so far, no matter they have expired or not, so rotated ones get noticed.
+/// Returns how many of them have been rotated
+pub fn keyring_refresh() -> Result<usize, Box<dyn Error>> {
+    let names: Vec<String> = match CACHE.read() {
+        Ok(cache) => cache.keys().cloned().collect(),
+        Err(err) => {
+            error!("read lock for secrets cache got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let mut rotated = 0;
+    for name in names.iter() {
+        match keyring_load(name) {
+            Ok((_, true)) => rotated += 1,
+            Ok(_) => {},
+            Err(err) => warn!("secret {} could not be refreshed: {}", name, err),
+        }
+    }
+
+    Ok(rotated)
+}
+
+
+#[cfg(test)]
+#[cfg(feature = "integration-tests")]
+mod tests {
+    use std::env;
+    use std::sync::Arc;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use super::{keyring_get, keyring_on_rotate, keyring_refresh};
+
+    #[test]
+    fn keyring_refresh_should_call_hooks() {
+        const NAME: &str = "KEYRING_ROTATION_TESTING";
+        env::set_var(NAME, "first");
+        assert_eq!("first", keyring_get(NAME).unwrap());
+
+        let calls = Arc::new(AtomicUsize::new(0));
+        let hook_calls = calls.clone();
+        keyring_on_rotate(NAME, move |value| {
+            assert_eq!("second", value);
+            hook_calls.fetch_add(1, Ordering::SeqCst);
+        });
+
+        // the cached value is kept until refreshed
+        env::set_var(NAME, "second");
+        assert_eq!("first", keyring_get(NAME).unwrap());
+
+        assert!(keyring_refresh().unwrap() >= 1);
+        assert_eq!("second", keyring_get(NAME).unwrap());
+        assert_eq!(1, calls.load(Ordering::SeqCst));
+    }
+
+    #[test]
+    fn keyring_get_should_fail() {
+        assert!(keyring_get("KEYRING_MISSING_TESTING").is_err());
+    }
+}
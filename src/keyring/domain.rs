@@ -0,0 +1,105 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::constants::errors;
+use crate::time;
+
+pub trait SecretSource {
+    // returns the current value of the secret with the given name, if the source has any
+    fn fetch(&self, name: &str) -> Result<Option<String>, Box<dyn Error>>;
+}
+
+/// All the sources a secret may be resolved from
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Provider {
+    Env,   // the environment variable with the same name
+    File,  // the file with the same name, as mounted by docker or kubernetes secrets
+    Vault, // the key with the same name of a HashiCorp Vault kv secret
+    Aws,   // the key with the same name of an AWS Secrets Manager secret
+}
+
+impl Provider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Provider::Env => "env",
+            Provider::File => "file",
+            Provider::Vault => "vault",
+            Provider::Aws => "aws",
+        }
+    }
+
+    pub fn from_str(provider: &str) -> Option<Self> {
+        match provider {
+            "env" => Some(Provider::Env),
+            "file" => Some(Provider::File),
+            "vault" => Some(Provider::Vault),
+            "aws" => Some(Provider::Aws),
+            _ => None,
+        }
+    }
+
+    /// Parses a comma-separated list of providers, in the same order secrets are looked up through them
+    pub fn from_list(providers: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        providers.split(',')
+            .map(|provider| provider.trim())
+            .filter(|provider| provider.len() > 0)
+            .map(|provider| -> Result<Self, Box<dyn Error>> {
+                match Provider::from_str(provider) {
+                    Some(provider) => Ok(provider),
+                    None => Err(errors::PARSE_FAILED.into()),
+                }
+            })
+            .collect()
+    }
+}
+
+/// The value of a secret as it was when fetched
+#[derive(Clone, Debug)]
+pub struct CachedSecret {
+    pub(super) value: String,
+    pub(super) fetched_at: SystemTime,
+}
+
+impl CachedSecret {
+    pub fn new(value: &str) -> Self {
+        CachedSecret {
+            value: value.to_string(),
+            fetched_at: time::now(),
+        }
+    }
+
+    pub fn get_value(&self) -> &str {
+        &self.value
+    }
+
+    /// Returns true if the secret has been cached for longer than the given time to live
+    pub fn is_expired(&self, ttl: Duration) -> bool {
+        self.fetched_at.elapsed().map(|elapsed| elapsed >= ttl).unwrap_or(true)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use super::{Provider, CachedSecret};
+
+    #[test]
+    fn provider_from_list_should_not_fail() {
+        assert_eq!(vec![Provider::Vault, Provider::Env], Provider::from_list("vault, env,").unwrap());
+        assert!(Provider::from_list("").unwrap().is_empty());
+        assert!(Provider::from_list("env,gcp").is_err());
+
+        for provider in &[Provider::Env, Provider::File, Provider::Vault, Provider::Aws] {
+            assert_eq!(Some(*provider), Provider::from_str(provider.as_str()));
+        }
+    }
+
+    #[test]
+    fn cached_secret_is_expired_should_not_fail() {
+        let mut secret = CachedSecret::new("value");
+        assert!(!secret.is_expired(Duration::from_secs(60)));
+
+        secret.fetched_at = SystemTime::now() - Duration::from_secs(61);
+        assert!(secret.is_expired(Duration::from_secs(60)));
+    }
+}
@@ -0,0 +1,258 @@
+use std::error::Error;
+use std::env;
+use std::fs;
+use std::io::ErrorKind;
+use std::path::PathBuf;
+use std::time::Duration;
+use std::collections::HashMap;
+use serde::Deserialize;
+use openssl::sign::Signer;
+use openssl::pkey::PKey;
+use openssl::hash::MessageDigest;
+use chrono::Utc;
+
+use crate::constants::settings;
+use super::domain::SecretSource;
+
+const AWS_ALGORITHM: &str = "AWS4-HMAC-SHA256";
+const AWS_SERVICE: &str = "secretsmanager";
+
+fn new_agent() -> ureq::Agent {
+    ureq::AgentBuilder::new()
+        .timeout(Duration::from_secs(settings::SECRETS_TIMEOUT))
+        .build()
+}
+
+/// Resolves secrets from the environment variables with the same name
+pub struct EnvSource;
+
+impl SecretSource for EnvSource {
+    fn fetch(&self, name: &str) -> Result<Option<String>, Box<dyn Error>> {
+        Ok(env::var(name).ok())
+    }
+}
+
+/// Resolves secrets from the files with the same name in the given directory, such as the ones docker and kubernetes
+/// mount their secrets as. Trailing newlines are not part of the secret
+pub struct FileSource {
+    dir: PathBuf,
+}
+
+impl FileSource {
+    pub fn new(dir: &str) -> Self {
+        FileSource {
+            dir: PathBuf::from(dir),
+        }
+    }
+}
+
+impl SecretSource for FileSource {
+    fn fetch(&self, name: &str) -> Result<Option<String>, Box<dyn Error>> {
+        match fs::read_to_string(self.dir.join(name)) {
+            Ok(value) => Ok(Some(value.trim_end_matches(&['\r', '\n'][..]).to_string())),
+            Err(err) if err.kind() == ErrorKind::NotFound => Ok(None),
+            Err(err) => Err(err.into()),
+        }
+    }
+}
+
+#[derive(Deserialize, Debug)]
+struct VaultData {
+    data: HashMap<String, String>,
+}
+
+#[derive(Deserialize, Debug)]
+struct VaultResponse {
+    data: VaultData,
+}
+
+/// Resolves secrets from the keys of a single secret of HashiCorp Vault's kv (version 2) engine
+pub struct VaultSource {
+    url: String,
+    token: String,
+    agent: ureq::Agent,
+}
+
+impl VaultSource {
+    pub fn new(addr: &str, token: &str, mount: &str, path: &str) -> Self {
+        VaultSource {
+            url: format!("{}/v1/{}/data/{}", addr.trim_end_matches('/'), mount, path),
+            token: token.to_string(),
+            agent: new_agent(),
+        }
+    }
+}
+
+impl SecretSource for VaultSource {
+    fn fetch(&self, name: &str) -> Result<Option<String>, Box<dyn Error>> {
+        let response = match self.agent.get(&self.url).set("X-Vault-Token", &self.token).call() {
+            Ok(response) => response,
+            Err(ureq::Error::Status(404, _)) => return Ok(None),
+            Err(err) => return Err(err.into()),
+        };
+
+        let mut result: VaultResponse = response.into_json()?;
+        Ok(result.data.data.remove(name))
+    }
+}
+
+#[derive(Deserialize, Debug)]
+struct AwsSecretResponse {
+    #[serde(rename = "SecretString", default)]
+    secret_string: Option<String>,
+}
+
+/// Resolves secrets from the keys of a single AWS Secrets Manager secret, whose value is a json object, as stored by
+/// the console for key/value secrets
+pub struct AwsSource {
+    region: String,
+    secret_id: String,
+    access_key: String,
+    secret_key: String,
+    session_token: Option<String>,
+    agent: ureq::Agent,
+}
+
+impl AwsSource {
+    pub fn new(region: &str,
+               secret_id: &str,
+               access_key: &str,
+               secret_key: &str,
+               session_token: Option<&str>) -> Self {
+
+        AwsSource {
+            region: region.to_string(),
+            secret_id: secret_id.to_string(),
+            access_key: access_key.to_string(),
+            secret_key: secret_key.to_string(),
+            session_token: session_token.map(|token| token.to_string()),
+            agent: new_agent(),
+        }
+    }
+
+    pub(crate) fn hmac(key: &[u8], data: &str) -> Result<Vec<u8>, Box<dyn Error>> {
+        let pkey = PKey::hmac(key)?;
+        let mut signer = Signer::new(MessageDigest::sha256(), &pkey)?;
+        signer.update(data.as_bytes())?;
+        Ok(signer.sign_to_vec()?)
+    }
+
+    pub(crate) fn to_hex(data: &[u8]) -> String {
+        data.iter().map(|byte| format!("{:02x}", byte)).collect()
+    }
+
+    /// Derives the key requests of the given date (as YYYYMMDD) get signed with, as told by AWS signature version 4
+    pub(crate) fn signing_key(secret_key: &str,
+                              date: &str,
+                              region: &str,
+                              service: &str) -> Result<Vec<u8>, Box<dyn Error>> {
+
+        let key = AwsSource::hmac(format!("AWS4{}", secret_key).as_bytes(), date)?;
+        let key = AwsSource::hmac(&key, region)?;
+        let key = AwsSource::hmac(&key, service)?;
+        AwsSource::hmac(&key, "aws4_request")
+    }
+}
+
+impl SecretSource for AwsSource {
+    fn fetch(&self, name: &str) -> Result<Option<String>, Box<dyn Error>> {
+        let host = format!("{}.{}.amazonaws.com", AWS_SERVICE, self.region);
+        let target = "secretsmanager.GetSecretValue";
+        let content_type = "application/x-amz-json-1.1";
+        let body = serde_json::json!({"SecretId": self.secret_id}).to_string();
+
+        let now = Utc::now();
+        let amz_date = now.format("%Y%m%dT%H%M%SZ").to_string();
+        let date = now.format("%Y%m%d").to_string();
+
+        // headers must be signed sorted by their name
+        let mut headers = vec![
+            ("content-type", content_type.to_string()),
+            ("host", host.clone()),
+            ("x-amz-date", amz_date.clone()),
+        ];
+
+        if let Some(token) = &self.session_token {
+            headers.push(("x-amz-security-token", token.clone()));
+        }
+
+        headers.push(("x-amz-target", target.to_string()));
+
+        let canonical_headers: String = headers.iter().map(|(name, value)| format!("{}:{}\n", name, value)).collect();
+        let signed_headers = headers.iter().map(|(name, _)| *name).collect::<Vec<&str>>().join(";");
+        let canonical_request = format!("POST\n/\n\n{}\n{}\n{}",
+                                        canonical_headers, signed_headers, sha256::digest_bytes(body.as_bytes()));
+
+        let scope = format!("{}/{}/{}/aws4_request", date, self.region, AWS_SERVICE);
+        let string_to_sign = format!("{}\n{}\n{}\n{}",
+                                     AWS_ALGORITHM, amz_date, scope, sha256::digest_bytes(canonical_request.as_bytes()));
+
+        let key = AwsSource::signing_key(&self.secret_key, &date, &self.region, AWS_SERVICE)?;
+        let signature = AwsSource::to_hex(&AwsSource::hmac(&key, &string_to_sign)?);
+        let authorization = format!("{} Credential={}/{}, SignedHeaders={}, Signature={}",
+                                    AWS_ALGORITHM, self.access_key, scope, signed_headers, signature);
+
+        let mut request = self.agent.post(&format!("https://{}/", host))
+            .set("Authorization", &authorization);
+
+        for (name, value) in headers.iter().filter(|(name, _)| *name != "host") {
+            request = request.set(name, value);
+        }
+
+        let response = match request.send_string(&body) {
+            Ok(response) => response,
+            // any missing secret is told by a 400 response of kind ResourceNotFoundException
+            Err(ureq::Error::Status(400, response)) => {
+                let reason = response.into_string().unwrap_or_default();
+                if reason.contains("ResourceNotFoundException") {
+                    return Ok(None);
+                }
+
+                return Err(format!("aws secrets manager has failed: {}", reason).into());
+            },
+            Err(err) => return Err(err.into()),
+        };
+
+        let result: AwsSecretResponse = response.into_json()?;
+        let values: HashMap<String, String> = match result.secret_string {
+            Some(raw) => serde_json::from_str(&raw)?,
+            None => return Ok(None),
+        };
+
+        Ok(values.get(name).cloned())
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::env;
+    use std::fs;
+    use super::{EnvSource, FileSource, AwsSource};
+    use super::super::domain::SecretSource;
+
+    #[test]
+    fn env_fetch_should_not_fail() {
+        env::set_var("KEYRING_TESTING_SECRET", "value");
+        assert_eq!(Some("value".to_string()), EnvSource.fetch("KEYRING_TESTING_SECRET").unwrap());
+        assert_eq!(None, EnvSource.fetch("KEYRING_TESTING_MISSING").unwrap());
+    }
+
+    #[test]
+    fn file_fetch_should_not_fail() {
+        let dir = env::temp_dir().join("tpauth_keyring_testing");
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("TESTING_SECRET"), "value\n").unwrap();
+
+        let source = FileSource::new(dir.to_str().unwrap());
+        assert_eq!(Some("value".to_string()), source.fetch("TESTING_SECRET").unwrap());
+        assert_eq!(None, source.fetch("TESTING_MISSING").unwrap());
+    }
+
+    #[test]
+    fn aws_signing_key_should_not_fail() {
+        // as given by the examples of the aws documentation on signature version 4
+        let key = AwsSource::signing_key("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam").unwrap();
+        assert_eq!("f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d", AwsSource::to_hex(&key));
+    }
+}
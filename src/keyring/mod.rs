@@ -0,0 +1,48 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::constants::{environment, settings};
+use crate::config;
+use domain::{Provider, SecretSource};
+
+lazy_static! {
+    static ref SOURCES: Vec<Box<dyn SecretSource + Sync + Send>> = {
+        let providers = config::get(environment::SECRETS_PROVIDERS).unwrap_or(settings::SECRETS_PROVIDERS.to_string());
+        Provider::from_list(&providers)
+            .expect("secrets providers must be a list of env, file, vault or aws")
+            .into_iter()
+            .map(new_source)
+            .collect()
+    };
+}
+
+// the settings of each source are always taken from the environment, since they are needed to reach the rest
+fn new_source(provider: Provider) -> Box<dyn SecretSource + Sync + Send> {
+    match provider {
+        Provider::Env => Box::new(framework::EnvSource),
+        Provider::File => {
+            let dir = config::get(environment::SECRETS_DIR).unwrap_or(settings::SECRETS_DIR.to_string());
+            Box::new(framework::FileSource::new(&dir))
+        },
+        Provider::Vault => {
+            let addr = config::get(environment::VAULT_ADDR).expect("vault address must be set");
+            let token = config::get(environment::VAULT_TOKEN).expect("vault token must be set");
+            let mount = config::get(environment::VAULT_MOUNT).unwrap_or(settings::VAULT_MOUNT.to_string());
+            let path = config::get(environment::SECRETS_PATH).expect("secrets path must be set");
+            Box::new(framework::VaultSource::new(&addr, &token, &mount, &path))
+        },
+        Provider::Aws => {
+            let region = config::get(environment::AWS_REGION).expect("aws region must be set");
+            let secret_id = config::get(environment::SECRETS_PATH).expect("secrets path must be set");
+            let access_key = config::get(environment::AWS_ACCESS_KEY_ID).expect("aws access key id must be set");
+            let secret_key = config::get(environment::AWS_SECRET_ACCESS_KEY).expect("aws secret access key must be set");
+            let session_token = config::get(environment::AWS_SESSION_TOKEN).ok();
+            Box::new(framework::AwsSource::new(&region, &secret_id, &access_key, &secret_key, session_token.as_deref()))
+        },
+    }
+}
+
+pub fn get_sources() -> &'static [Box<dyn SecretSource + Sync + Send>] {
+    &SOURCES
+}
@@ -1,6 +1,8 @@
 #[macro_use]
 extern crate diesel;
 #[macro_use]
+extern crate diesel_migrations;
+#[macro_use]
 extern crate lazy_static;
 #[macro_use]
 extern crate serde;
@@ -10,17 +12,85 @@ extern crate bson;
 extern crate log;
 
 pub mod constants;
+pub mod config;
 pub mod user;
 pub mod session;
 pub mod app;
+pub mod policy;
+pub mod invitation;
+pub mod recovery;
+pub mod device;
+pub mod apikey;
+pub mod backup;
+pub mod audit;
+pub mod ratelimit;
+pub mod quota;
+pub mod claims;
+pub mod authorization;
+pub mod detection;
+pub mod firewall;
+pub mod credential;
+pub mod identity;
+pub mod webhook;
+pub mod mailer;
+pub mod sms;
+pub mod group;
+pub mod template;
+pub mod username;
+pub mod feature;
+pub mod import;
+pub mod admin;
+pub mod keyring;
+pub mod signing;
+pub mod revocation;
+pub mod lock;
+pub mod mongo;
+pub mod storage;
+pub mod migration;
+pub mod tls;
+pub mod metrics;
+pub mod telemetry;
+pub mod logging;
+pub mod health;
+pub mod diagnostics;
+pub mod debug;
+pub mod graphql;
+pub mod scim;
+pub mod web;
+pub mod i18n;
+pub mod jobs;
+pub mod embed;
+pub mod client;
+pub mod middleware;
+pub mod limits;
+pub mod status;
+pub mod validation;
+pub mod pagination;
+pub mod bootstrap;
+
+#[cfg(feature = "benchmarks")]
+pub mod bench;
+
+#[cfg(test)]
+mod fuzz;
 
 mod postgres;
-mod mongo;
+mod cache;
 mod smtp;
 mod time;
 mod metadata;
 mod secret;
 mod security;
+mod headers;
+mod hashing;
+mod pii;
+mod ulid;
+mod spiffe;
+mod captcha;
+mod nonce;
 mod directory;
+mod tenant;
 mod schema;
-mod regex;
\ No newline at end of file
+mod regex;
+mod memory;
+mod reporting;
\ No newline at end of file
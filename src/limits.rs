@@ -0,0 +1,541 @@
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::task::{Context, Poll};
+use std::time::Duration;
+use hyper::Body;
+use hyper::body::Bytes;
+use http::HeaderMap;
+use http::header::{CONTENT_LENGTH, CONTENT_ENCODING, CONTENT_TYPE, HeaderValue};
+use tokio_stream::StreamExt;
+use tonic::Status;
+use tonic::body::BoxBody;
+use tonic::transport::Server;
+use tower::{Layer, Service};
+
+use crate::config;
+use crate::metrics;
+use crate::validation::is_unary;
+use crate::constants::{environment, errors, settings};
+
+// probes must reach the health service no matter how loaded the instance is
+const HEALTH_PREFIX: &str = "/grpc.health.v1.Health/";
+const GRPC_ENCODING_HEADER: &str = "grpc-encoding";
+const GRPC_ACCEPT_ENCODING_HEADER: &str = "grpc-accept-encoding";
+const IDENTITY_ENCODING: &str = "identity";
+const GRPC_WEB_TEXT: &str = "application/grpc-web-text";
+const FRAME_PREFIX_LEN: usize = 5; // compressed flag and message length
+
+// keeping the sessions already open alive: validating, refreshing and closing them, and watching the keys they are
+// signed by
+const CRITICAL_METHODS: &[&str] = &[
+    "/session.SessionService/Introspect",
+    "/session.SessionService/ValidateSessions",
+    "/session.SessionService/CheckSession",
+    "/session.SessionService/Refresh",
+    "/session.SessionService/Logout",
+    "/session.SessionService/WatchKeys",
+    "/session.v2.SessionService/Introspect",
+    "/session.v2.SessionService/Refresh",
+    "/session.v2.SessionService/Logout",
+];
+
+// opening new sessions or accounts, which is what a storm of logins or signups, or an attack, is made of
+const LOW_METHODS: &[&str] = &[
+    "/session.SessionService/Login",
+    "/session.SessionService/LoginWithProvider",
+    "/session.SessionService/Challenge",
+    "/session.SessionService/CreateGuestSession",
+    "/session.v2.SessionService/Login",
+    "/user.UserService/Signup",
+    "/user.UserService/UpgradeGuest",
+];
+
+fn get_number<T: std::str::FromStr>(name: &str) -> Option<T> {
+    config::get(name).ok()
+        .map(|value| value.parse().unwrap_or_else(|_| panic!("{} must be a number", name)))
+}
+
+/// Returns a grpc server builder with the connection options set by the environment, if any: the interval of the
+/// keepalive pings sent to idle clients and how long they are waited for before closing the connection, the max
+/// concurrent streams per connection and the max concurrent requests each connection gets served
+pub fn server_builder() -> Server {
+    let mut builder = Server::builder();
+    if let Some(interval) = get_number(environment::GRPC_KEEPALIVE_INTERVAL) {
+        builder = builder.http2_keepalive_interval(Some(Duration::from_secs(interval)));
+    }
+
+    if let Some(timeout) = get_number(environment::GRPC_KEEPALIVE_TIMEOUT) {
+        builder = builder.http2_keepalive_timeout(Some(Duration::from_secs(timeout)));
+    }
+
+    if let Some(streams) = get_number::<u32>(environment::GRPC_MAX_CONCURRENT_STREAMS) {
+        builder = builder.max_concurrent_streams(streams);
+    }
+
+    if let Some(limit) = get_number(environment::GRPC_CONCURRENCY_PER_CONNECTION) {
+        builder = builder.concurrency_limit_per_connection(limit);
+    }
+
+    builder
+}
+
+/// All the priorities requests are admitted by while the instance is loaded
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Priority {
+    Critical, // may take all of the requests in flight
+    Normal,   // may take the share set by GRPC_NORMAL_SHARE
+    Low,      // may take the share set by GRPC_LOW_SHARE
+}
+
+impl Priority {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Priority::Critical => "critical",
+            Priority::Normal => "normal",
+            Priority::Low => "low",
+        }
+    }
+}
+
+/// Returns the priority of a request to the rpc at the given path
+pub fn get_priority(path: &str) -> Priority {
+    if CRITICAL_METHODS.contains(&path) {
+        Priority::Critical
+    } else if LOW_METHODS.contains(&path) {
+        Priority::Low
+    } else {
+        Priority::Normal
+    }
+}
+
+/// Returns how many requests of the given priority may be in flight at once, out of the given max, as told by the
+/// given shares, in percent. Any priority may take a single request at least, so none of them is ever starved for good
+fn get_limit(max: usize, priority: Priority, shares: (usize, usize)) -> usize {
+    let share = match priority {
+        Priority::Critical => 100,
+        Priority::Normal => shares.0,
+        Priority::Low => shares.1,
+    };
+
+    (max * share.min(100) / 100).max(1)
+}
+
+/// A layer failing fast, with RESOURCE_EXHAUSTED, every request beyond the max in flight set by GRPC_MAX_IN_FLIGHT,
+/// so an overloaded instance rejects what it cannot serve in time instead of queueing it, and clients retry on
+/// another one. Admission is weighted by the priority of each request: new logins and signups are shed first, once
+/// they would take more than their share of the requests in flight, and then any other request but these keeping the
+/// open sessions alive, which are only shed once the max is reached. If not set, no request is shed at all
+#[derive(Clone)]
+pub struct LoadShedLayer {
+    in_flight: Arc<AtomicUsize>,
+    max: Option<usize>,
+    shares: (usize, usize),
+}
+
+impl LoadShedLayer {
+    pub fn new() -> Self {
+        LoadShedLayer {
+            in_flight: Arc::new(AtomicUsize::new(0)),
+            max: get_number(environment::GRPC_MAX_IN_FLIGHT),
+            shares: (
+                get_number(environment::GRPC_NORMAL_SHARE).unwrap_or(settings::GRPC_NORMAL_SHARE),
+                get_number(environment::GRPC_LOW_SHARE).unwrap_or(settings::GRPC_LOW_SHARE),
+            ),
+        }
+    }
+}
+
+impl<S> Layer<S> for LoadShedLayer {
+    type Service = LoadShedService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        LoadShedService {
+            inner: inner,
+            in_flight: self.in_flight.clone(),
+            max: self.max,
+            shares: self.shares,
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct LoadShedService<S> {
+    inner: S,
+    in_flight: Arc<AtomicUsize>,
+    max: Option<usize>,
+    shares: (usize, usize),
+}
+
+// releases the slot of a request once it is done, either served or dropped
+struct InFlight(Arc<AtomicUsize>);
+
+impl Drop for InFlight {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+impl<S, B> Service<http::Request<B>> for LoadShedService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    B: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let max = match self.max {
+            Some(max) if !request.uri().path().starts_with(HEALTH_PREFIX) => max,
+            _ => return Box::pin(self.inner.call(request)),
+        };
+
+        // requests are shed by the load they find, so the ones of higher priority still fit once the others do not
+        let limit = get_limit(max, get_priority(request.uri().path()), self.shares);
+        let slot = InFlight(self.in_flight.clone());
+        if self.in_flight.fetch_add(1, Ordering::SeqCst) >= limit {
+            drop(slot);
+            metrics::request_shed(if limit < max {"deprioritized"} else {"overloaded"});
+            let status = Status::resource_exhausted(errors::OVERLOADED);
+            return Box::pin(async move { Ok(status.to_http()) });
+        }
+
+        let future = self.inner.call(request);
+        Box::pin(async move {
+            let result = future.await;
+            drop(slot);
+            result
+        })
+    }
+}
+
+/// A layer rejecting, with UNIMPLEMENTED, every compressed request, and, with RESOURCE_EXHAUSTED, every request whose
+/// metadata is larger than GRPC_MAX_METADATA_SIZE bytes, names and values altogether, or has more entries than
+/// GRPC_MAX_METADATA_ENTRIES. Messages are never decompressed, so no small message can blow up into a huge one
+#[derive(Clone)]
+pub struct MetadataLayer {
+    max_size: usize,
+    max_entries: usize,
+}
+
+impl MetadataLayer {
+    pub fn new() -> Self {
+        MetadataLayer {
+            max_size: get_number(environment::GRPC_MAX_METADATA_SIZE).unwrap_or(settings::GRPC_MAX_METADATA_SIZE),
+            max_entries: get_number(environment::GRPC_MAX_METADATA_ENTRIES)
+                .unwrap_or(settings::GRPC_MAX_METADATA_ENTRIES),
+        }
+    }
+}
+
+impl<S> Layer<S> for MetadataLayer {
+    type Service = MetadataService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        MetadataService {
+            inner: inner,
+            max_size: self.max_size,
+            max_entries: self.max_entries,
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct MetadataService<S> {
+    inner: S,
+    max_size: usize,
+    max_entries: usize,
+}
+
+/// Returns true if, and only if, the given headers tell the body, or the messages it carries, are compressed
+fn is_compressed(headers: &HeaderMap) -> bool {
+    [GRPC_ENCODING_HEADER, CONTENT_ENCODING.as_str()].iter()
+        .filter_map(|name| headers.get(*name))
+        .any(|encoding| encoding.to_str().map(|encoding| encoding.trim() != IDENTITY_ENCODING).unwrap_or(true))
+}
+
+/// Returns the size in bytes of all the given headers, names and values altogether
+fn get_metadata_size(headers: &HeaderMap) -> usize {
+    headers.iter()
+        .map(|(name, value)| name.as_str().len() + value.len())
+        .sum()
+}
+
+impl<S, B> Service<http::Request<B>> for MetadataService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    B: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let headers = request.headers();
+        if headers.len() > self.max_entries {
+            metrics::request_shed("metadata_too_large");
+            let status = Status::resource_exhausted(format!("metadata with more than {} entries", self.max_entries));
+            return Box::pin(async move { Ok(status.to_http()) });
+        }
+
+        if get_metadata_size(headers) > self.max_size {
+            metrics::request_shed("metadata_too_large");
+            let status = Status::resource_exhausted(format!("metadata larger than {} bytes", self.max_size));
+            return Box::pin(async move { Ok(status.to_http()) });
+        }
+
+        if is_compressed(headers) {
+            metrics::request_shed("compressed");
+            let mut response = Status::unimplemented(errors::COMPRESSION_UNSUPPORTED).to_http();
+            response.headers_mut().insert(GRPC_ACCEPT_ENCODING_HEADER, HeaderValue::from_static(IDENTITY_ENCODING));
+            return Box::pin(async move { Ok(response) });
+        }
+
+        Box::pin(self.inner.call(request))
+    }
+}
+
+/// Keeps track of the messages a request body is made of, as its chunks are read, so each message is told apart no
+/// matter how its bytes are split into chunks
+#[derive(Default)]
+struct Framing {
+    prefix: Vec<u8>,  // the bytes read so far of the prefix of the next message
+    remaining: usize, // the bytes of the current message yet to be read
+}
+
+impl Framing {
+    /// Reads the given chunk, failing as soon as the prefix of any message tells it is larger than the given bytes or
+    /// compressed: the message is rejected before any of it is read
+    fn feed(&mut self, chunk: &[u8], max: usize) -> Result<(), String> {
+        let mut chunk = chunk;
+        while chunk.len() > 0 {
+            if self.remaining > 0 {
+                let read = self.remaining.min(chunk.len());
+                self.remaining -= read;
+                chunk = &chunk[read..];
+                continue;
+            }
+
+            let read = (FRAME_PREFIX_LEN - self.prefix.len()).min(chunk.len());
+            self.prefix.extend_from_slice(&chunk[..read]);
+            chunk = &chunk[read..];
+            if self.prefix.len() < FRAME_PREFIX_LEN {
+                continue;
+            }
+
+            if self.prefix[0] != 0 {
+                return Err(errors::COMPRESSION_UNSUPPORTED.to_string());
+            }
+
+            let length = u32::from_be_bytes([self.prefix[1], self.prefix[2], self.prefix[3], self.prefix[4]]) as usize;
+            if length > max {
+                return Err(format!("message larger than {} bytes", max));
+            }
+
+            self.prefix.clear();
+            self.remaining = length;
+        }
+
+        Ok(())
+    }
+}
+
+/// A layer rejecting, with RESOURCE_EXHAUSTED, every request with any message larger than GRPC_MAX_MESSAGE_SIZE bytes
+/// (4 MiB by default, zero for no limit). Unary requests telling their length are rejected before being read at all,
+/// while any other fails as soon as the prefix of a message tells its length, so streams are limited message by
+/// message rather than as a whole. Requests encoded as text, whose messages cannot be told apart as they are read, are
+/// limited as a whole instead
+#[derive(Clone)]
+pub struct MessageSizeLayer {
+    max: Option<usize>,
+}
+
+impl MessageSizeLayer {
+    pub fn new() -> Self {
+        let max = get_number(environment::GRPC_MAX_MESSAGE_SIZE).unwrap_or(settings::GRPC_MAX_MESSAGE_SIZE);
+        MessageSizeLayer {
+            max: Some(max).filter(|max| *max > 0),
+        }
+    }
+}
+
+impl<S> Layer<S> for MessageSizeLayer {
+    type Service = MessageSizeService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        MessageSizeService {
+            inner: inner,
+            max: self.max,
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct MessageSizeService<S> {
+    inner: S,
+    max: Option<usize>,
+}
+
+impl<S> Service<http::Request<Body>> for MessageSizeService<S>
+where
+    S: Service<http::Request<Body>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<Body>) -> Self::Future {
+        let max = match self.max {
+            Some(max) => max,
+            None => return Box::pin(self.inner.call(request)),
+        };
+
+        let text = request.headers().get(CONTENT_TYPE)
+            .and_then(|content_type| content_type.to_str().ok())
+            .map(|content_type| content_type.starts_with(GRPC_WEB_TEXT))
+            .unwrap_or(false);
+
+        // a unary body is made of a single message, while text bodies are base64 encoded, so a third larger
+        let length = request.headers().get(CONTENT_LENGTH)
+            .and_then(|length| length.to_str().ok())
+            .and_then(|length| length.parse::<usize>().ok());
+
+        let max_body = if text {(max + FRAME_PREFIX_LEN) * 4 / 3 + 4} else {max + FRAME_PREFIX_LEN};
+        if length.map(|length| length > max_body).unwrap_or(false) && (text || is_unary(request.uri().path())) {
+            metrics::request_shed("too_large");
+            let status = Status::resource_exhausted(format!("message larger than {} bytes", max));
+            return Box::pin(async move { Ok(status.to_http()) });
+        }
+
+        // bodies are streamed, so their messages are told apart chunk by chunk
+        let (parts, body) = request.into_parts();
+        let mut framing = Framing::default();
+        let mut read = 0;
+        let body = Body::wrap_stream(body.map(move |chunk| -> Result<Bytes, Box<dyn std::error::Error + Send + Sync>> {
+            let chunk = chunk?;
+            let result = if text {
+                read += chunk.len();
+                if read > max_body {Err(format!("message larger than {} bytes", max))} else {Ok(())}
+            } else {
+                framing.feed(&chunk, max)
+            };
+
+            if let Err(err) = result {
+                metrics::request_shed("too_large");
+                return Err(err.into());
+            }
+
+            Ok(chunk)
+        }));
+
+        Box::pin(self.inner.call(http::Request::from_parts(parts, body)))
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use http::HeaderMap;
+    use crate::constants::errors;
+    use super::{Framing, Priority, is_compressed, get_metadata_size, get_priority, get_limit};
+
+    fn frame(compressed: bool, message: &[u8]) -> Vec<u8> {
+        let mut frame = vec![compressed as u8];
+        frame.extend_from_slice(&(message.len() as u32).to_be_bytes());
+        frame.extend_from_slice(message);
+        frame
+    }
+
+    #[test]
+    fn get_priority_should_not_fail() {
+        assert_eq!(Priority::Critical, get_priority("/session.SessionService/Introspect"));
+        assert_eq!(Priority::Critical, get_priority("/session.v2.SessionService/Refresh"));
+        assert_eq!(Priority::Low, get_priority("/session.SessionService/Login"));
+        assert_eq!(Priority::Low, get_priority("/user.UserService/Signup"));
+        assert_eq!(Priority::Normal, get_priority("/user.UserService/GetUserInfo"));
+        assert_eq!(Priority::Normal, get_priority("/unknown"));
+    }
+
+    #[test]
+    fn get_limit_should_not_fail() {
+        assert_eq!(100, get_limit(100, Priority::Critical, (80, 50)));
+        assert_eq!(80, get_limit(100, Priority::Normal, (80, 50)));
+        assert_eq!(50, get_limit(100, Priority::Low, (80, 50)));
+
+        // shares are capped by the max, and no priority gets starved for good
+        assert_eq!(100, get_limit(100, Priority::Normal, (150, 50)));
+        assert_eq!(1, get_limit(100, Priority::Low, (80, 0)));
+        assert_eq!(1, get_limit(1, Priority::Low, (80, 50)));
+    }
+
+    #[test]
+    fn framing_feed_should_not_fail() {
+        let mut body = frame(false, &[1; 10]);
+        body.extend(frame(false, &[2; 8]));
+
+        // messages must be told apart no matter how they are split into chunks
+        for size in 1..body.len() {
+            let mut framing = Framing::default();
+            for chunk in body.chunks(size) {
+                framing.feed(chunk, 10).unwrap();
+            }
+
+            assert_eq!(0, framing.remaining);
+            assert!(framing.prefix.is_empty());
+        }
+    }
+
+    #[test]
+    fn framing_feed_should_fail() {
+        let mut body = frame(false, &[1; 10]);
+        body.extend(frame(false, &[2; 11]));
+
+        let mut framing = Framing::default();
+        let err = body.chunks(3).map(|chunk| framing.feed(chunk, 10)).find(|result| result.is_err()).unwrap();
+        assert_eq!("message larger than 10 bytes", err.unwrap_err());
+
+        let mut framing = Framing::default();
+        assert_eq!(errors::COMPRESSION_UNSUPPORTED, framing.feed(&frame(true, &[1; 4]), 10).unwrap_err());
+    }
+
+    #[test]
+    fn is_compressed_should_not_fail() {
+        let mut headers = HeaderMap::new();
+        assert!(!is_compressed(&headers));
+
+        headers.insert("grpc-encoding", "identity".parse().unwrap());
+        assert!(!is_compressed(&headers));
+
+        headers.insert("content-encoding", "gzip".parse().unwrap());
+        assert!(is_compressed(&headers));
+
+        headers.remove("content-encoding");
+        headers.insert("grpc-encoding", "gzip".parse().unwrap());
+        assert!(is_compressed(&headers));
+    }
+
+    #[test]
+    fn get_metadata_size_should_not_fail() {
+        let mut headers = HeaderMap::new();
+        headers.insert("token", "abcd".parse().unwrap());
+        headers.append("x-forwarded-for", "10.0.0.1".parse().unwrap());
+        assert_eq!(5 + 4 + 15 + 8, get_metadata_size(&headers));
+    }
+}
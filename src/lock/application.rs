@@ -0,0 +1,116 @@
+use std::error::Error;
+use std::thread;
+use std::sync::atomic::Ordering;
+use std::time::{Duration, Instant};
+
+use crate::constants::{errors, settings};
+use super::domain::Lease;
+use super::{get_locker, get_elector, LEADERSHIP, LEADER};
+
+/// Returns the key the operations on the given email of the given tenant are locked by, so signups and email changes
+/// on the same address never race each other, whatever the instance they run on
+pub fn lock_email_key(tenant: i32, email: &str) -> String {
+    format!("email:{}:{}", tenant, email.to_lowercase())
+}
+
+/// Same as lock_email_key, but for the given phone number, already in e.164 format, so no two users of the same tenant
+/// get to verify the same phone meanwhile
+pub fn lock_phone_key(tenant: i32, phone: &str) -> String {
+    format!("phone:{}:{}", tenant, phone)
+}
+
+/// Same as lock_email_key, but for the given username, so no two users of the same tenant get to take it meanwhile
+pub fn lock_username_key(tenant: i32, username: &str) -> String {
+    format!("username:{}:{}", tenant, username.to_lowercase())
+}
+
+/// Runs the given closure holding the lock of the given key, waiting for up to settings::LOCK_WAIT milliseconds for
+/// whoever holds it to be done. If it is still held by then, fails with LOCKED. Unique indexes are still the last
+/// line of defense, while the lock closes the window between checking something is available and taking it
+pub fn lock_run<T, F>(key: &str, f: F) -> Result<T, Box<dyn Error>>
+where
+    F: FnOnce() -> Result<T, Box<dyn Error>>,
+{
+    let lease = Lease::new(key, Duration::from_secs(settings::LOCK_TTL));
+    let deadline = Instant::now() + Duration::from_millis(settings::LOCK_WAIT);
+    while !get_locker().acquire(&lease)? {
+        if Instant::now() >= deadline {
+            warn!("lock {} is still held by some other, giving up", key);
+            return Err(errors::LOCKED.into());
+        }
+
+        thread::sleep(Duration::from_millis(settings::LOCK_RETRY));
+    }
+
+    let result = f();
+    if let Err(err) = get_locker().release(&lease) {
+        // the lease expires by itself anyway
+        warn!("lock {} could not be released: {}", key, err);
+    }
+
+    result
+}
+
+/// Campaigns for the leadership of the background jobs: the leader renews its lease, while any other instance tries
+/// to take it, so it gets taken over as soon as the leader is gone and its lease expires. Returns whether this
+/// instance is the leader. If the elector cannot be reached, the leadership is given up, so no two instances ever
+/// run the jobs at once
+pub fn leader_campaign() -> Result<bool, Box<dyn Error>> {
+    let mut lease = match LEADERSHIP.lock() {
+        Ok(lease) => lease,
+        Err(err) => {
+            error!("lock for leadership got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let was_leader = LEADER.load(Ordering::SeqCst);
+    lease.extend(Duration::from_secs(settings::LEADER_TTL));
+    let result = if was_leader {get_elector().renew(&lease)} else {get_elector().acquire(&lease)};
+
+    let is_leader = *result.as_ref().unwrap_or(&false);
+    LEADER.store(is_leader, Ordering::SeqCst);
+    if is_leader != was_leader {
+        let state = if is_leader {"taken"} else {"lost"};
+        warn!("leadership of the background jobs has been {}", state);
+    }
+
+    result
+}
+
+/// Returns whether this instance is the leader, so it is the one running the background jobs of the whole cluster
+pub fn is_leader() -> bool {
+    LEADER.load(Ordering::SeqCst)
+}
+
+/// Gives the leadership up, if held, so any other instance takes it over right away instead of once the lease expires
+pub fn leader_resign() {
+    if !LEADER.swap(false, Ordering::SeqCst) {
+        return;
+    }
+
+    match LEADERSHIP.lock() {
+        Ok(lease) => if let Err(err) = get_elector().release(&lease) {
+            warn!("leadership could not be released: {}", err);
+        },
+        Err(err) => error!("lock for leadership got poisoned: {}", err),
+    };
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{lock_email_key, lock_phone_key};
+
+    #[test]
+    fn lock_email_key_should_not_fail() {
+        assert_eq!("email:1:dummy@testing.com", lock_email_key(1, "Dummy@Testing.com"));
+        assert_ne!(lock_email_key(1, "dummy@testing.com"), lock_email_key(2, "dummy@testing.com"));
+    }
+
+    #[test]
+    fn lock_phone_key_should_not_fail() {
+        assert_eq!("phone:1:+34600123456", lock_phone_key(1, "+34600123456"));
+        assert_ne!(lock_phone_key(1, "+34600123456"), lock_email_key(1, "+34600123456"));
+    }
+}
@@ -0,0 +1,80 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+
+use crate::ulid;
+
+pub trait Locker {
+    // takes the lock of the key of the given lease if, and only if, no one else holds it, or the lease of whoever did
+    // has expired, returning whether it has been taken
+    fn acquire(&self, lease: &Lease) -> Result<bool, Box<dyn Error>>;
+    // extends the lock of the key of the given lease up to its expiration if, and only if, it is still held by the
+    // lease, returning whether it has been extended
+    fn renew(&self, lease: &Lease) -> Result<bool, Box<dyn Error>>;
+    // releases the lock of the key of the given lease if, and only if, it is still held by the lease
+    fn release(&self, lease: &Lease) -> Result<(), Box<dyn Error>>;
+}
+
+/// The right to run an operation on some key, such as an email, with no other instance running any other on the same
+/// key meanwhile. Leases expire by themselves, so a lock is never held forever by an instance that is gone
+#[derive(Clone)]
+pub struct Lease {
+    pub(super) key: String,
+    pub(super) token: String, // tells apart the holder of the lock, so no one else can release it
+    pub(super) expires_at: SystemTime,
+}
+
+impl Lease {
+    pub fn new(key: &str, ttl: Duration) -> Self {
+        Lease {
+            key: key.to_string(),
+            token: ulid::generate(),
+            expires_at: SystemTime::now() + ttl,
+        }
+    }
+
+    pub fn get_key(&self) -> &str {
+        &self.key
+    }
+
+    pub fn get_token(&self) -> &str {
+        &self.token
+    }
+
+    pub fn is_expired(&self) -> bool {
+        self.expires_at <= SystemTime::now()
+    }
+
+    /// Moves the expiration of the lease to the given time from now on, keeping its token, so it can be renewed
+    pub fn extend(&mut self, ttl: Duration) {
+        self.expires_at = SystemTime::now() + ttl;
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::Duration;
+    use super::Lease;
+
+    #[test]
+    fn lease_new_should_not_fail() {
+        let lease = Lease::new("email:1:dummy@testing.com", Duration::from_secs(10));
+        let other = Lease::new("email:1:dummy@testing.com", Duration::from_secs(10));
+
+        assert_eq!("email:1:dummy@testing.com", lease.get_key());
+        assert_ne!(lease.get_token(), other.get_token());
+        assert!(!lease.is_expired());
+        assert!(Lease::new("email:1:dummy@testing.com", Duration::from_secs(0)).is_expired());
+    }
+
+    #[test]
+    fn lease_extend_should_not_fail() {
+        let mut lease = Lease::new("leader", Duration::from_secs(0));
+        let token = lease.get_token().to_string();
+        assert!(lease.is_expired());
+
+        lease.extend(Duration::from_secs(10));
+        assert!(!lease.is_expired());
+        assert_eq!(token, lease.get_token());
+    }
+}
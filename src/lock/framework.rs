@@ -0,0 +1,408 @@
+use std::error::Error;
+use std::env;
+use std::fs;
+use std::io::BufReader;
+use std::collections::HashMap;
+use std::sync::{Arc, Mutex};
+use std::time::{SystemTime, Duration, UNIX_EPOCH};
+use chrono::{DateTime, Utc};
+use redis::Script;
+use serde_json::{json, Value};
+
+use crate::cache;
+use crate::mongo;
+use crate::constants::{errors, settings};
+use super::domain::{Lease, Locker};
+
+const LOCK_PREFIX: &str = "lock";
+const COLLECTION_NAME: &str = "locks";
+const KUBERNETES_HOST: &str = "KUBERNETES_SERVICE_HOST";
+const KUBERNETES_PORT: &str = "KUBERNETES_SERVICE_PORT";
+const SERVICE_ACCOUNT_DIR: &str = "/var/run/secrets/kubernetes.io/serviceaccount";
+
+// the lock is only released by the lease holding it, even if it expired and got taken by some other meanwhile
+const RELEASE_SCRIPT: &str = r#"
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('DEL', KEYS[1])
+end
+return 0
+"#;
+
+// same as releasing, the lock is only extended by the lease holding it
+const RENEW_SCRIPT: &str = r#"
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+"#;
+
+pub struct InMemoryLocker {
+    leases: Mutex<HashMap<String, Lease>>,
+}
+
+impl InMemoryLocker {
+    pub fn new() -> Self {
+        InMemoryLocker {
+            leases: Mutex::new(HashMap::new()),
+        }
+    }
+}
+
+impl Locker for InMemoryLocker {
+    fn acquire(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let mut leases = match self.leases.lock() {
+            Ok(leases) => leases,
+            Err(err) => {
+                error!("lock for leases from locker got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        if leases.get(&lease.key).map(|current| !current.is_expired()).unwrap_or(false) {
+            return Ok(false);
+        }
+
+        leases.insert(lease.key.clone(), lease.clone());
+        Ok(true)
+    }
+
+    fn renew(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let mut leases = match self.leases.lock() {
+            Ok(leases) => leases,
+            Err(err) => {
+                error!("lock for leases from locker got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        match leases.get_mut(&lease.key) {
+            Some(current) if current.token == lease.token => {
+                current.expires_at = lease.expires_at;
+                Ok(true)
+            },
+            _ => Ok(false),
+        }
+    }
+
+    fn release(&self, lease: &Lease) -> Result<(), Box<dyn Error>> {
+        let mut leases = match self.leases.lock() {
+            Ok(leases) => leases,
+            Err(err) => {
+                error!("lock for leases from locker got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        if leases.get(&lease.key).map(|current| current.token == lease.token).unwrap_or(false) {
+            leases.remove(&lease.key);
+        }
+
+        Ok(())
+    }
+}
+
+pub struct RedisLocker {
+    release_script: Script,
+    renew_script: Script,
+}
+
+impl RedisLocker {
+    pub fn new() -> Self {
+        RedisLocker {
+            release_script: Script::new(RELEASE_SCRIPT),
+            renew_script: Script::new(RENEW_SCRIPT),
+        }
+    }
+}
+
+// the time left until the given lease expires, in milliseconds, as redis expirations are set by
+fn get_ttl_millis(lease: &Lease) -> u64 {
+    lease.expires_at.duration_since(SystemTime::now()).unwrap_or_default().as_millis().max(1) as u64
+}
+
+impl Locker for RedisLocker {
+    fn acquire(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let acquired: Option<String> = redis::cmd("SET")
+            .arg(format!("{}:{}", LOCK_PREFIX, lease.key))
+            .arg(&lease.token)
+            .arg("NX")
+            .arg("PX")
+            .arg(get_ttl_millis(lease))
+            .query(&mut *conn)?;
+
+        Ok(acquired.is_some())
+    }
+
+    fn renew(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let renewed: i32 = self.renew_script
+            .key(format!("{}:{}", LOCK_PREFIX, lease.key))
+            .arg(&lease.token)
+            .arg(get_ttl_millis(lease))
+            .invoke(&mut *conn)?;
+
+        Ok(renewed == 1)
+    }
+
+    fn release(&self, lease: &Lease) -> Result<(), Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let _: i32 = self.release_script
+            .key(format!("{}:{}", LOCK_PREFIX, lease.key))
+            .arg(&lease.token)
+            .invoke(&mut *conn)?;
+
+        Ok(())
+    }
+}
+
+pub struct MongoLocker;
+
+impl Locker for MongoLocker {
+    fn acquire(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let now = SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs_f64();
+        let expires_at = lease.expires_at.duration_since(UNIX_EPOCH)?.as_secs_f64();
+        let collection = mongo::get_connection(COLLECTION_NAME)?;
+
+        // an expired lease is taken over right away
+        let result = collection.update_one(
+            doc! {"_id": lease.key.as_str(), "expires_at": {"$lte": now}},
+            doc! {"$set": {"token": lease.token.as_str(), "expires_at": expires_at}},
+            None)?;
+
+        if result.modified_count > 0 {
+            return Ok(true);
+        }
+
+        let inserted = collection.insert_one(
+            doc! {"_id": lease.key.as_str(), "token": lease.token.as_str(), "expires_at": expires_at},
+            None);
+
+        match inserted {
+            Ok(_) => Ok(true),
+            // the key being held makes the insertion fail as a duplicate, any other reason is a failure indeed
+            Err(err) => match collection.find_one(Some(doc! {"_id": lease.key.as_str()}), None)? {
+                Some(_) => Ok(false),
+                None => Err(err.into()),
+            },
+        }
+    }
+
+    fn renew(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let expires_at = lease.expires_at.duration_since(UNIX_EPOCH)?.as_secs_f64();
+        let result = mongo::get_connection(COLLECTION_NAME)?.update_one(
+            doc! {"_id": lease.key.as_str(), "token": lease.token.as_str()},
+            doc! {"$set": {"expires_at": expires_at}},
+            None)?;
+
+        Ok(result.matched_count > 0)
+    }
+
+    fn release(&self, lease: &Lease) -> Result<(), Box<dyn Error>> {
+        mongo::get_connection(COLLECTION_NAME)?
+            .delete_one(doc! {"_id": lease.key.as_str(), "token": lease.token.as_str()}, None)?;
+
+        Ok(())
+    }
+}
+
+/// Locks keys by the leases of the coordination api of the kubernetes cluster the service runs in, the same way
+/// kubernetes controllers elect their leader. Each key is the name of a lease in the namespace of the pod
+pub struct KubernetesLocker {
+    url: String,
+    token: String,
+    agent: ureq::Agent,
+}
+
+impl KubernetesLocker {
+    pub fn new() -> Result<Self, Box<dyn Error>> {
+        let host = env::var(KUBERNETES_HOST)?;
+        let port = env::var(KUBERNETES_PORT)?;
+        let namespace = fs::read_to_string(format!("{}/namespace", SERVICE_ACCOUNT_DIR))?;
+        let token = fs::read_to_string(format!("{}/token", SERVICE_ACCOUNT_DIR))?;
+
+        // the api server is trusted by the authority of the cluster only
+        let mut tls = rustls::ClientConfig::new();
+        let mut ca = BufReader::new(fs::File::open(format!("{}/ca.crt", SERVICE_ACCOUNT_DIR))?);
+        tls.root_store.add_pem_file(&mut ca).map_err(|_| errors::PARSE_FAILED)?;
+
+        Ok(KubernetesLocker {
+            url: format!("https://{}:{}/apis/coordination.k8s.io/v1/namespaces/{}/leases", host, port, namespace.trim()),
+            token: format!("Bearer {}", token.trim()),
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(settings::LOCK_TIMEOUT))
+                .tls_config(Arc::new(tls))
+                .build(),
+        })
+    }
+
+    fn find(&self, key: &str) -> Result<Option<Value>, Box<dyn Error>> {
+        match self.agent.get(&format!("{}/{}", self.url, key)).set("Authorization", &self.token).call() {
+            Ok(response) => Ok(Some(response.into_json()?)),
+            Err(ureq::Error::Status(404, _)) => Ok(None),
+            Err(err) => Err(err.into()),
+        }
+    }
+
+    // writes the given lease as held by the given one, failing with false if anyone else has written it meanwhile
+    fn hold(&self, key: &str, current: Option<Value>, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let now = format_micro_time(SystemTime::now());
+        let duration = lease.expires_at.duration_since(SystemTime::now()).unwrap_or_default().as_secs().max(1);
+        let result = match current {
+            Some(mut current) => {
+                if current["spec"]["holderIdentity"] != Value::from(lease.token.as_str()) {
+                    current["spec"]["acquireTime"] = Value::from(now.as_str());
+                }
+
+                current["spec"]["holderIdentity"] = Value::from(lease.token.as_str());
+                current["spec"]["leaseDurationSeconds"] = Value::from(duration);
+                current["spec"]["renewTime"] = Value::from(now.as_str());
+
+                // the resource version of the lease is kept, so it is only written if nobody else did meanwhile
+                self.agent.put(&format!("{}/{}", self.url, key))
+                    .set("Authorization", &self.token)
+                    .send_json(current)
+            },
+            None => self.agent.post(&self.url)
+                .set("Authorization", &self.token)
+                .send_json(json!({
+                    "apiVersion": "coordination.k8s.io/v1",
+                    "kind": "Lease",
+                    "metadata": {"name": key},
+                    "spec": {
+                        "holderIdentity": lease.token,
+                        "leaseDurationSeconds": duration,
+                        "acquireTime": now,
+                        "renewTime": now,
+                    },
+                })),
+        };
+
+        match result {
+            Ok(_) => Ok(true),
+            Err(ureq::Error::Status(409, _)) => Ok(false),
+            Err(err) => Err(err.into()),
+        }
+    }
+}
+
+// returns the timestamp kubernetes leases tell their times by, with microseconds
+fn format_micro_time(time: SystemTime) -> String {
+    let time: DateTime<Utc> = time.into();
+    time.format("%Y-%m-%dT%H:%M:%S%.6fZ").to_string()
+}
+
+// returns whether the given kubernetes lease is held by anyone but the given token, its renewal not being older than
+// its duration
+fn is_held_by_other(current: &Value, token: &str) -> bool {
+    let spec = &current["spec"];
+    let holder = spec["holderIdentity"].as_str().unwrap_or_default();
+    if holder.len() == 0 || holder == token {
+        return false;
+    }
+
+    let renewed_at = spec["renewTime"].as_str().and_then(|time| DateTime::parse_from_rfc3339(time).ok());
+    let duration = spec["leaseDurationSeconds"].as_i64().unwrap_or_default();
+    match renewed_at {
+        Some(renewed_at) => renewed_at.with_timezone(&Utc) + chrono::Duration::seconds(duration) > Utc::now(),
+        None => false,
+    }
+}
+
+impl Locker for KubernetesLocker {
+    fn acquire(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        let current = self.find(&lease.key)?;
+        if current.as_ref().map(|current| is_held_by_other(current, &lease.token)).unwrap_or(false) {
+            return Ok(false);
+        }
+
+        self.hold(&lease.key, current, lease)
+    }
+
+    fn renew(&self, lease: &Lease) -> Result<bool, Box<dyn Error>> {
+        match self.find(&lease.key)? {
+            Some(current) if current["spec"]["holderIdentity"] == Value::from(lease.token.as_str()) => {
+                self.hold(&lease.key, Some(current), lease)
+            },
+            _ => Ok(false),
+        }
+    }
+
+    fn release(&self, lease: &Lease) -> Result<(), Box<dyn Error>> {
+        let mut current = match self.find(&lease.key)? {
+            Some(current) if current["spec"]["holderIdentity"] == Value::from(lease.token.as_str()) => current,
+            _ => return Ok(()),
+        };
+
+        // a lease with no holder is free for anyone to take right away
+        current["spec"]["holderIdentity"] = Value::Null;
+        match self.agent.put(&format!("{}/{}", self.url, lease.key)).set("Authorization", &self.token).send_json(current) {
+            Ok(_) | Err(ureq::Error::Status(409, _)) => Ok(()),
+            Err(err) => Err(err.into()),
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use serde_json::json;
+    use super::{InMemoryLocker, format_micro_time, is_held_by_other};
+    use super::super::domain::{Lease, Locker};
+
+    #[test]
+    fn in_memory_acquire_should_not_fail() {
+        let locker = InMemoryLocker::new();
+        let lease = Lease::new("email:1:dummy@testing.com", Duration::from_secs(10));
+        let other = Lease::new("email:1:dummy@testing.com", Duration::from_secs(10));
+
+        assert!(locker.acquire(&lease).unwrap());
+        assert!(!locker.acquire(&other).unwrap());
+
+        // no one but the holder can release the lock
+        locker.release(&other).unwrap();
+        assert!(!locker.acquire(&other).unwrap());
+
+        locker.release(&lease).unwrap();
+        assert!(locker.acquire(&other).unwrap());
+    }
+
+    #[test]
+    fn in_memory_acquire_expired_should_not_fail() {
+        let locker = InMemoryLocker::new();
+        let expired = Lease::new("email:1:dummy@testing.com", Duration::from_secs(0));
+        let other = Lease::new("email:1:dummy@testing.com", Duration::from_secs(10));
+
+        assert!(locker.acquire(&expired).unwrap());
+        assert!(locker.acquire(&other).unwrap());
+    }
+
+    #[test]
+    fn in_memory_renew_should_not_fail() {
+        let locker = InMemoryLocker::new();
+        let mut lease = Lease::new("leader", Duration::from_secs(0));
+        let other = Lease::new("leader", Duration::from_secs(10));
+
+        assert!(locker.acquire(&lease).unwrap());
+        lease.extend(Duration::from_secs(10));
+        assert!(locker.renew(&lease).unwrap());
+        assert!(!locker.acquire(&other).unwrap());
+        assert!(!locker.renew(&other).unwrap());
+    }
+
+    #[test]
+    fn is_held_by_other_should_not_fail() {
+        let renewed_at = format_micro_time(SystemTime::now());
+        let lease = json!({"spec": {"holderIdentity": "other", "leaseDurationSeconds": 15, "renewTime": renewed_at}});
+        assert!(is_held_by_other(&lease, "token"));
+        assert!(!is_held_by_other(&lease, "other"));
+
+        let expired = format_micro_time(SystemTime::now() - Duration::from_secs(60));
+        let lease = json!({"spec": {"holderIdentity": "other", "leaseDurationSeconds": 15, "renewTime": expired}});
+        assert!(!is_held_by_other(&lease, "token"));
+
+        let lease = json!({"spec": {"holderIdentity": null}});
+        assert!(!is_held_by_other(&lease, "token"));
+    }
+}
@@ -0,0 +1,51 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::sync::Mutex;
+use std::sync::atomic::AtomicBool;
+use std::time::Duration;
+use crate::storage::{self, Backend};
+use crate::constants::{environment, settings};
+use crate::config;
+
+lazy_static! {
+    static ref LOCKER_PROVIDER: Box<dyn domain::Locker + Sync + Send> = {
+        // locks are as volatile as sessions, so they are kept by the same backend if shared by all the instances,
+        // or else by the mongodb cluster, which is shared as well
+        match (storage::get_session_backend(), storage::get_backend(Backend::Postgres)) {
+            (Backend::Redis, _) => Box::new(framework::RedisLocker::new()),
+            (Backend::Memory, Backend::Mongo) => Box::new(framework::MongoLocker),
+            (Backend::Memory, _) => Box::new(framework::InMemoryLocker::new()),
+            (backend, _) => storage::unsupported(backend, "locks"),
+        }
+    };
+
+    // the leader is elected by the same locks as any other operation, unless kubernetes leases are told to
+    static ref ELECTOR_PROVIDER: Option<Box<dyn domain::Locker + Sync + Send>> = {
+        match config::get(environment::LEADER_ELECTION).as_deref() {
+            Ok("kubernetes") => Some(Box::new(framework::KubernetesLocker::new()
+                .expect("kubernetes leases require the in-cluster service account"))),
+            _ => None,
+        }
+    };
+
+    // the lease this instance campaigns for the leadership with, the same one all along the process lifetime
+    static ref LEADERSHIP: Mutex<domain::Lease> = {
+        Mutex::new(domain::Lease::new(settings::LEADER_LEASE, Duration::from_secs(settings::LEADER_TTL)))
+    };
+}
+
+// whether this instance holds the leadership, as of its latest campaign
+static LEADER: AtomicBool = AtomicBool::new(false);
+
+pub fn get_locker() -> Box<&'static dyn domain::Locker> {
+    Box::new(&**LOCKER_PROVIDER)
+}
+
+pub fn get_elector() -> Box<&'static dyn domain::Locker> {
+    match &*ELECTOR_PROVIDER {
+        Some(elector) => Box::new(&**elector),
+        None => get_locker(),
+    }
+}
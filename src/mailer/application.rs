@@ -0,0 +1,38 @@
+use std::error::Error;
+use std::thread;
+use std::time::Duration;
+
+use crate::constants::{environment, settings};
+use crate::config;
+use super::get_sender;
+
+/// Sends an html email with the given subject and body to the given address, from the one set by SMTP_ORIGIN, through
+/// the provider set by MAILER_PROVIDER. Deliveries failing because the provider is not available get retried, with an
+/// exponential backoff, while bounced ones are logged as such and not retried, since they would bounce again
+pub fn mailer_send(to: &str, subject: &str, body: &str) -> Result<(), Box<dyn Error>> {
+    let from = config::get(environment::SMTP_ORIGIN)?;
+    let mut backoff = Duration::from_millis(settings::MAILER_BACKOFF);
+    let mut attempt = 1;
+
+    loop {
+        let err = match get_sender().send(&from, to, subject, body) {
+            Ok(()) => return Ok(()),
+            Err(err) => err,
+        };
+
+        if !err.is_retryable() {
+            warn!("email \"{}\" to {} has bounced: {}", subject, to, err);
+            return Err(err.into());
+        }
+
+        if attempt >= settings::MAILER_RETRIES {
+            error!("email \"{}\" to {} could not be delivered after {} attempts: {}", subject, to, attempt, err);
+            return Err(err.into());
+        }
+
+        warn!("email \"{}\" to {} could not be delivered, retrying in {:?}: {}", subject, to, backoff, err);
+        thread::sleep(backoff);
+        backoff *= 2;
+        attempt += 1;
+    }
+}
@@ -0,0 +1,101 @@
+use std::error::Error;
+use std::fmt;
+
+pub trait Sender {
+    // sends an html email with the given subject and body to the given address, on behalf of the given one
+    fn send(&self, from: &str, to: &str, subject: &str, body: &str) -> Result<(), Failure>;
+}
+
+/// All the providers an email may be delivered by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Provider {
+    Smtp,
+    Ses,
+    SendGrid,
+    Log, // no email gets delivered at all, but logged instead: for development only
+}
+
+impl Provider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Provider::Smtp => "smtp",
+            Provider::Ses => "ses",
+            Provider::SendGrid => "sendgrid",
+            Provider::Log => "log",
+        }
+    }
+
+    pub fn from_str(provider: &str) -> Option<Self> {
+        match provider {
+            "smtp" => Some(Provider::Smtp),
+            "ses" => Some(Provider::Ses),
+            "sendgrid" => Some(Provider::SendGrid),
+            "log" => Some(Provider::Log),
+            _ => None,
+        }
+    }
+}
+
+/// Why an email could not be delivered: either the provider has rejected it for good, such as for a non existing
+/// address, and so it bounced, or the provider could not be reached or was not available, in which case delivering
+/// it may succeed if retried
+#[derive(Debug, PartialEq)]
+pub enum Failure {
+    Bounced(String),
+    Unavailable(String),
+}
+
+impl Failure {
+    /// Tells the failure of an http request to a provider by the given status code, with the given reason. Throttled
+    /// requests and server errors are worth retrying, while any other client error will fail again
+    pub fn from_status(status: u16, reason: &str) -> Self {
+        match status {
+            429 | 500..=599 => Failure::Unavailable(format!("{}: {}", status, reason)),
+            _ => Failure::Bounced(format!("{}: {}", status, reason)),
+        }
+    }
+
+    pub fn is_retryable(&self) -> bool {
+        matches!(self, Failure::Unavailable(_))
+    }
+}
+
+impl fmt::Display for Failure {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            Failure::Bounced(reason) => write!(f, "email bounced: {}", reason),
+            Failure::Unavailable(reason) => write!(f, "mailer unavailable: {}", reason),
+        }
+    }
+}
+
+impl Error for Failure {}
+
+impl From<Box<dyn Error>> for Failure {
+    fn from(err: Box<dyn Error>) -> Self {
+        Failure::Unavailable(err.to_string())
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{Provider, Failure};
+
+    #[test]
+    fn provider_from_str_should_not_fail() {
+        for provider in &[Provider::Smtp, Provider::Ses, Provider::SendGrid, Provider::Log] {
+            assert_eq!(Some(*provider), Provider::from_str(provider.as_str()));
+        }
+
+        assert_eq!(None, Provider::from_str("unknown"));
+    }
+
+    #[test]
+    fn failure_from_status_should_not_fail() {
+        assert!(Failure::from_status(429, "throttled").is_retryable());
+        assert!(Failure::from_status(503, "unavailable").is_retryable());
+        assert!(!Failure::from_status(400, "MessageRejected").is_retryable());
+        assert!(!Failure::from_status(403, "forbidden").is_retryable());
+    }
+}
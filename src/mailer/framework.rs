@@ -0,0 +1,191 @@
+use std::env::VarError;
+use std::time::Duration;
+use chrono::Utc;
+use lettre::smtp::authentication::Credentials;
+use lettre::smtp::error::Error as SmtpError;
+use lettre::{SmtpClient, SmtpTransport, Transport};
+use lettre_email::EmailBuilder;
+use serde_json::json;
+
+use crate::constants::{environment, settings};
+use crate::config;
+use crate::keyring::application::keyring_get;
+use crate::keyring::framework::AwsSource;
+use super::domain::{Sender, Failure};
+
+const AWS_ALGORITHM: &str = "AWS4-HMAC-SHA256";
+const SES_SERVICE: &str = "ses";
+const SES_PATH: &str = "/v2/email/outbound-emails";
+const SENDGRID_URL: &str = "https://api.sendgrid.com/v3/mail/send";
+
+fn new_agent() -> ureq::Agent {
+    ureq::AgentBuilder::new()
+        .timeout(Duration::from_secs(settings::MAILER_TIMEOUT))
+        .build()
+}
+
+/// Tells the failure of the given http request to a provider
+fn http_failure(err: ureq::Error) -> Failure {
+    match err {
+        ureq::Error::Status(status, response) => {
+            Failure::from_status(status, &response.into_string().unwrap_or_default())
+        },
+        err => Failure::Unavailable(err.to_string()),
+    }
+}
+
+/// Delivers emails through the SMTP server set by SMTP_TRANSPORT. The transport is built for every email, so a rotated
+/// password gets used by the next one
+pub struct SmtpSender;
+
+impl SmtpSender {
+    fn get_mailer() -> Result<SmtpTransport, Failure> {
+        let unset = |err: VarError| Failure::Unavailable(err.to_string());
+        let smtp_username = config::get(environment::SMTP_USERNAME).map_err(unset)?;
+        let smtp_password = keyring_get(environment::SMTP_PASSWORD)?;
+        let smtp_transport = config::get(environment::SMTP_TRANSPORT).map_err(unset)?;
+
+        let creds = Credentials::new(smtp_username, smtp_password);
+        let mailer = SmtpClient::new_simple(&smtp_transport)
+            .map_err(|err| Failure::Unavailable(err.to_string()))?
+            .timeout(Some(Duration::from_secs(settings::MAILER_TIMEOUT)))
+            .credentials(creds)
+            .transport();
+
+        Ok(mailer)
+    }
+}
+
+impl Sender for SmtpSender {
+    fn send(&self, from: &str, to: &str, subject: &str, body: &str) -> Result<(), Failure> {
+        let email = EmailBuilder::new()
+            .to(to)
+            .from(from)
+            .subject(subject)
+            .html(body)
+            .build()
+            .map_err(|err| Failure::Bounced(err.to_string()))?;
+
+        match SmtpSender::get_mailer()?.send(email.into()) {
+            Ok(_) => Ok(()),
+            // permanent negative replies (5yz) will fail again, whereas any other error is worth retrying
+            Err(SmtpError::Permanent(response)) => Err(Failure::Bounced(format!("{:?}", response))),
+            Err(err) => Err(Failure::Unavailable(err.to_string())),
+        }
+    }
+}
+
+/// Delivers emails through the v2 api of AWS SES, signing its requests with the credentials of the keyring
+pub struct SesSender {
+    region: String,
+    agent: ureq::Agent,
+}
+
+impl SesSender {
+    pub fn new(region: &str) -> Self {
+        SesSender {
+            region: region.to_string(),
+            agent: new_agent(),
+        }
+    }
+}
+
+impl Sender for SesSender {
+    fn send(&self, from: &str, to: &str, subject: &str, body: &str) -> Result<(), Failure> {
+        let access_key = keyring_get(environment::AWS_ACCESS_KEY_ID)?;
+        let secret_key = keyring_get(environment::AWS_SECRET_ACCESS_KEY)?;
+        let session_token = keyring_get(environment::AWS_SESSION_TOKEN).ok();
+
+        let host = format!("email.{}.amazonaws.com", self.region);
+        let content_type = "application/json";
+        let payload = json!({
+            "FromEmailAddress": from,
+            "Destination": {"ToAddresses": [to]},
+            "Content": {"Simple": {
+                "Subject": {"Data": subject, "Charset": "UTF-8"},
+                "Body": {"Html": {"Data": body, "Charset": "UTF-8"}},
+            }},
+        }).to_string();
+
+        let now = Utc::now();
+        let amz_date = now.format("%Y%m%dT%H%M%SZ").to_string();
+        let date = now.format("%Y%m%d").to_string();
+
+        // headers must be signed sorted by their name
+        let mut headers = vec![
+            ("content-type", content_type.to_string()),
+            ("host", host.clone()),
+            ("x-amz-date", amz_date.clone()),
+        ];
+
+        if let Some(token) = session_token {
+            headers.push(("x-amz-security-token", token));
+        }
+
+        let canonical_headers: String = headers.iter().map(|(name, value)| format!("{}:{}\n", name, value)).collect();
+        let signed_headers = headers.iter().map(|(name, _)| *name).collect::<Vec<&str>>().join(";");
+        let canonical_request = format!("POST\n{}\n\n{}\n{}\n{}",
+                                        SES_PATH, canonical_headers, signed_headers,
+                                        sha256::digest_bytes(payload.as_bytes()));
+
+        let scope = format!("{}/{}/{}/aws4_request", date, self.region, SES_SERVICE);
+        let string_to_sign = format!("{}\n{}\n{}\n{}",
+                                     AWS_ALGORITHM, amz_date, scope, sha256::digest_bytes(canonical_request.as_bytes()));
+
+        let key = AwsSource::signing_key(&secret_key, &date, &self.region, SES_SERVICE)?;
+        let signature = AwsSource::to_hex(&AwsSource::hmac(&key, &string_to_sign)?);
+        let authorization = format!("{} Credential={}/{}, SignedHeaders={}, Signature={}",
+                                    AWS_ALGORITHM, access_key, scope, signed_headers, signature);
+
+        let mut request = self.agent.post(&format!("https://{}{}", host, SES_PATH))
+            .set("Authorization", &authorization);
+
+        for (name, value) in headers.iter().filter(|(name, _)| *name != "host") {
+            request = request.set(name, value);
+        }
+
+        request.send_string(&payload).map(|_| ()).map_err(http_failure)
+    }
+}
+
+/// Delivers emails through the v3 api of SendGrid, authenticated by the SENDGRID_API_KEY of the keyring
+pub struct SendGridSender {
+    agent: ureq::Agent,
+}
+
+impl SendGridSender {
+    pub fn new() -> Self {
+        SendGridSender {
+            agent: new_agent(),
+        }
+    }
+}
+
+impl Sender for SendGridSender {
+    fn send(&self, from: &str, to: &str, subject: &str, body: &str) -> Result<(), Failure> {
+        let api_key = keyring_get(environment::SENDGRID_API_KEY)?;
+        let payload = json!({
+            "personalizations": [{"to": [{"email": to}]}],
+            "from": {"email": from},
+            "subject": subject,
+            "content": [{"type": "text/html", "value": body}],
+        });
+
+        self.agent.post(SENDGRID_URL)
+            .set("Authorization", &format!("Bearer {}", api_key))
+            .send_json(payload)
+            .map(|_| ())
+            .map_err(http_failure)
+    }
+}
+
+/// Delivers no email at all, but logs it instead, tokens included, so the flows requiring them can be followed with no
+/// mail server. It must never be used in production
+pub struct LogSender;
+
+impl Sender for LogSender {
+    fn send(&self, from: &str, to: &str, subject: &str, body: &str) -> Result<(), Failure> {
+        info!("email from {} to {} with subject \"{}\":\n{}", from, to, subject, body);
+        Ok(())
+    }
+}
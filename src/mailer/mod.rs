@@ -0,0 +1,26 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::constants::{environment, settings};
+use crate::config;
+
+lazy_static! {
+    static ref SENDER_PROVIDER: Box<dyn domain::Sender + Sync + Send> = {
+        let provider = config::get(environment::MAILER_PROVIDER).unwrap_or(settings::MAILER_PROVIDER.to_string());
+        match domain::Provider::from_str(&provider) {
+            Some(domain::Provider::Smtp) => Box::new(framework::SmtpSender),
+            Some(domain::Provider::Ses) => {
+                let region = config::get(environment::AWS_REGION).expect("aws region must be set");
+                Box::new(framework::SesSender::new(&region))
+            },
+            Some(domain::Provider::SendGrid) => Box::new(framework::SendGridSender::new()),
+            Some(domain::Provider::Log) => Box::new(framework::LogSender),
+            None => panic!("mailer provider must be one of smtp, ses, sendgrid or log"),
+        }
+    };
+}
+
+pub fn get_sender() -> Box<&'static dyn domain::Sender> {
+    Box::new(&**SENDER_PROVIDER)
+}
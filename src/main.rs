@@ -3,8 +3,28 @@ extern crate log;
 
 use tpauth::{
     user,
-    app,
-    session,
+    recovery,
+    backup,
+    audit,
+    import,
+    tls,
+    config,
+    metrics,
+    limits,
+    telemetry,
+    logging,
+    health,
+    debug,
+    graphql,
+    scim,
+    web,
+    jobs,
+    lock,
+    embed,
+    mongo,
+    migration,
+    storage::{self, Backend},
+    bootstrap::{self, Listener},
     constants::{
         environment,
         settings
@@ -13,45 +33,471 @@ use tpauth::{
 
 use dotenv;
 use std::env;
+use std::fs;
+use std::net::SocketAddr;
+use std::time::Duration;
 use std::error::Error;
-use tonic::transport::Server;
+use std::future::Future;
+use tokio::sync::oneshot;
+
+// descriptors of all the protos served, as compiled by the build script
+const FILE_DESCRIPTOR_SET: &[u8] = tonic::include_file_descriptor_set!("tpauth_descriptor");
+
+/// Returns the config of grpc-web: browsers are only allowed to call the services from the origins listed by
+/// GRPC_WEB_ORIGINS, comma-separated, or from any origin if set to `*`. If not set, no browser is allowed at all, while
+/// native grpc clients are served either way
+fn grpc_web_config() -> tonic_web::Config {
+    let config = tonic_web::config().expose_headers(settings::GRPC_WEB_EXPOSED_HEADERS.iter().copied());
+    match config::get(environment::GRPC_WEB_ORIGINS) {
+        Ok(origins) if origins.trim() == "*" => config.allow_all_origins(),
+        Ok(origins) => config.allow_origins(origins.split(',')
+            .map(|origin| origin.trim().to_string())
+            .filter(|origin| origin.len() > 0)
+            .collect::<Vec<String>>()),
+        Err(_) => config.allow_origins(Vec::<String>::new()),
+    }
+}
+
+/// Returns true if, and only if, GRPC_REFLECTION is set to true, so the schema of every service is told to anyone
+/// asking for it, such as grpcurl. It is meant for debugging in staging, so it is disabled by default
+fn is_reflection_enabled() -> bool {
+    config::get(environment::GRPC_REFLECTION).map(|enabled| enabled == "true").unwrap_or(false)
+}
 
 pub async fn start_server(address: String) -> Result<(), Box<dyn Error>> {
-    use user::framework::UserServiceServer;
-    use app::framework::AppServiceServer;
-    use session::framework::SessionServiceServer;
+    // the standalone binary has set everything up by itself, so the services are the same the hosts embed
+    let services = embed::Services;
+
+    // the admin service is only reachable through the public listener unless it is served by a port of its own
+    let admin_public = match config::get(environment::ADMIN_PORT) {
+        Ok(_) => None,
+        Err(_) => Some(services.admin()),
+    };
 
-    let user_server = user::framework::UserServiceImplementation{};
-    let app_server = app::framework::AppServiceImplementation{};
-    let session_server = session::framework::SessionServiceImplementation{};
+    // probes must reach the health service no matter the address they come from or how often they do
+    let (health_reporter, health_server) = tonic_health::server::health_reporter();
+    health::start_health_job(health_reporter);
  
+    // browsers only get to sign up and manage their sessions, the rest of services are meant for backends
+    let grpc_web = grpc_web_config();
+
+    let reflection_server = match is_reflection_enabled() {
+        true => Some(tonic_reflection::server::Builder::configure()
+            .register_encoded_file_descriptor_set(FILE_DESCRIPTOR_SET)
+            .build()?),
+        false => None,
+    };
+
     let addr = address.parse().unwrap();
-    info!("server listening on {}", addr);
- 
-    Server::builder()
-        .add_service(UserServiceServer::new(user_server))
-        .add_service(AppServiceServer::new(app_server))
-        .add_service(SessionServiceServer::new(session_server))
-        .serve(addr)
-        .await?;
- 
+    let router = limits::server_builder()
+        .accept_http1(true) // grpc-web requests may come over http/1.1
+        .layer(bootstrap::Chain::new(Listener::Public))
+        .add_service(grpc_web.enable(services.user()))
+        .add_service(services.app())
+        .add_service(grpc_web.enable(services.session()))
+        .add_service(grpc_web.enable(services.session_v2()))
+        .add_service(services.policy())
+        .add_service(services.invitation())
+        .add_service(services.recovery())
+        .add_service(services.device())
+        .add_service(services.apikey())
+        .add_service(services.backup())
+        .add_service(services.firewall())
+        .add_service(services.credential())
+        .add_service(services.identity())
+        .add_optional_service(admin_public)
+        .add_optional_service(reflection_server)
+        .add_service(health_server);
+
+    let (stop_tx, stop_rx) = oneshot::channel::<()>();
+    let stop = async {
+        stop_rx.await.ok();
+    };
+
+    if tls::is_enabled() {
+        let incoming = tls::incoming(addr).await?;
+        info!("server listening on {} over tls", addr);
+        drain(router.serve_with_incoming_shutdown(incoming, stop), stop_tx).await
+    } else {
+        info!("server listening on {}", addr);
+        drain(router.serve_with_shutdown(addr, stop), stop_tx).await
+    }
+}
+
+/// Waits for either an interrupt or a termination signal
+async fn shutdown_signal() {
+    #[cfg(unix)]
+    let terminate = async {
+        use tokio::signal::unix::{signal, SignalKind};
+        match signal(SignalKind::terminate()) {
+            Ok(mut terminate) => {terminate.recv().await;},
+            Err(err) => {
+                error!("could not listen for termination signal: {}", err);
+                std::future::pending::<()>().await;
+            }
+        }
+    };
+
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    tokio::select! {
+        result = tokio::signal::ctrl_c() => if let Err(err) = result {
+            error!("could not listen for interrupt signal: {}", err);
+            std::future::pending::<()>().await;
+        },
+        _ = terminate => {},
+    }
+}
+
+/// Serves requests until a shutdown signal is received. Then the service is reported as not ready and no new request
+/// is accepted, while the in-flight ones are waited for as long as the grace period set by SHUTDOWN_GRACE
+async fn drain<F>(serving: F, stop: oneshot::Sender<()>) -> Result<(), Box<dyn Error>>
+where F: Future<Output = Result<(), tonic::transport::Error>> {
+    tokio::pin!(serving);
+    tokio::select! {
+        result = &mut serving => return Ok(result?),
+        _ = shutdown_signal() => {},
+    }
+
+    let grace = match config::get(environment::SHUTDOWN_GRACE) {
+        Ok(secs) => secs.parse().expect("shutdown grace must be a number of seconds"),
+        Err(_) => settings::SHUTDOWN_GRACE,
+    };
+
+    info!("shutting down server, waiting up to {} seconds for in-flight requests", grace);
+    health::set_draining();
+    lock::application::leader_resign(); // so another instance takes the jobs over right away
+    if stop.send(()).is_err() {
+        warn!("server has already stopped");
+    }
+
+    match tokio::time::timeout(Duration::from_secs(grace), serving).await {
+        Ok(result) => Ok(result?),
+        Err(_) => {
+            warn!("grace period is over, dropping the in-flight requests");
+            Ok(())
+        }
+    }
+}
+
+/// Spawns a background task serving the admin service alone on the given ip, if any port has been set to serve it by,
+/// so operational actions are not reachable through the public listener. It stops as soon as a shutdown signal is
+/// received, once its in-flight requests are done
+pub fn start_admin_server(ip: &str) -> Result<(), Box<dyn Error>> {
+    let port = match config::get(environment::ADMIN_PORT) {
+        Ok(port) => port,
+        Err(_) => return Ok(()),
+    };
+
+    let addr: SocketAddr = format!("{}:{}", ip, port).parse()?;
+    tokio::spawn(async move {
+        let router = limits::server_builder()
+            .layer(bootstrap::Chain::new(Listener::Admin))
+            .add_service(embed::Services.admin());
+
+        let result = if tls::is_enabled() {
+            let incoming = match tls::incoming(addr).await {
+                Ok(incoming) => incoming,
+                Err(err) => {
+                    error!("admin server could not listen over tls: {}", err);
+                    return;
+                }
+            };
+
+            info!("admin server listening on {} over tls", addr);
+            router.serve_with_incoming_shutdown(incoming, shutdown_signal()).await
+        } else {
+            info!("admin server listening on {}", addr);
+            router.serve_with_shutdown(addr, shutdown_signal()).await
+        };
+
+        if let Err(err) = result {
+            error!("admin server has failed: {}", err);
+        }
+    });
+
+    Ok(())
+}
+
+/// Spawns a background task serving the metrics on the given ip, if any port has been set to serve them by
+pub fn start_metrics_server(ip: &str) {
+    let port = match config::get(environment::METRICS_PORT) {
+        Ok(port) => port,
+        Err(_) => return,
+    };
+
+    let addr = match format!("{}:{}", ip, port).parse() {
+        Ok(addr) => addr,
+        Err(err) => {
+            error!("metrics port must be a number: {}", err);
+            return;
+        }
+    };
+
+    tokio::spawn(async move {
+        info!("metrics served on {}", addr);
+        if let Err(err) = metrics::serve(addr).await {
+            error!("metrics server has failed: {}", err);
+        }
+    });
+}
+
+/// Spawns a background task serving the GraphQL endpoint on the given ip, if any port has been set to serve it by
+pub fn start_graphql_server(ip: &str) {
+    let port = match config::get(environment::GRAPHQL_PORT) {
+        Ok(port) => port,
+        Err(_) => return,
+    };
+
+    let addr = match format!("{}:{}", ip, port).parse() {
+        Ok(addr) => addr,
+        Err(err) => {
+            error!("graphql port must be a number: {}", err);
+            return;
+        }
+    };
+
+    tokio::spawn(async move {
+        info!("graphql served on {}", addr);
+        if let Err(err) = graphql::serve(addr).await {
+            error!("graphql server has failed: {}", err);
+        }
+    });
+}
+
+/// Spawns a background task serving the SCIM endpoint on the given ip, if any port has been set to serve it by
+pub fn start_scim_server(ip: &str) {
+    let port = match config::get(environment::SCIM_PORT) {
+        Ok(port) => port,
+        Err(_) => return,
+    };
+
+    let addr = match format!("{}:{}", ip, port).parse() {
+        Ok(addr) => addr,
+        Err(err) => {
+            error!("scim port must be a number: {}", err);
+            return;
+        }
+    };
+
+    tokio::spawn(async move {
+        info!("scim served on {}", addr);
+        if let Err(err) = scim::serve(addr).await {
+            error!("scim server has failed: {}", err);
+        }
+    });
+}
+
+/// Spawns a background task serving the hosted login pages on the given ip, if any port has been set to serve them by
+pub fn start_web_server(ip: &str) {
+    let port = match config::get(environment::WEB_PORT) {
+        Ok(port) => port,
+        Err(_) => return,
+    };
+
+    let addr = match format!("{}:{}", ip, port).parse() {
+        Ok(addr) => addr,
+        Err(err) => {
+            error!("web port must be a number: {}", err);
+            return;
+        }
+    };
+
+    tokio::spawn(async move {
+        info!("hosted pages served on {}", addr);
+        if let Err(err) = web::serve(addr).await {
+            error!("web server has failed: {}", err);
+        }
+    });
+}
+
+/// Spawns a background task serving the runtime debug endpoints on the loopback interface, if any port has been set to
+/// serve them by
+pub fn start_debug_server() {
+    let port = match config::get(environment::DEBUG_PORT) {
+        Ok(port) => port,
+        Err(_) => return,
+    };
+
+    let port = match port.parse() {
+        Ok(port) => port,
+        Err(err) => {
+            error!("debug port must be a number: {}", err);
+            return;
+        }
+    };
+
+    tokio::spawn(async move {
+        warn!("debug endpoints served on 127.0.0.1:{}", port);
+        if let Err(err) = debug::serve(port).await {
+            error!("debug server has failed: {}", err);
+        }
+    });
+}
+
+/// Runs the migrate command: `migrate up` applies all the pending migrations, while `migrate down <postgres|mongo>`
+/// reverts the latest one of the given backend
+pub fn run_migrate(args: &[String]) -> Result<(), Box<dyn Error>> {
+    match args.get(0).map(|arg| arg.as_str()) {
+        Some("up") => migration::migrate_up(),
+        Some("down") => {
+            let backend = match args.get(1).and_then(|arg| Backend::from_str(arg)) {
+                Some(backend) => backend,
+                None => return Err("usage: migrate down <postgres|mongo>".into()),
+            };
+
+            migration::migrate_down(backend)
+        },
+
+        _ => Err("usage: migrate <up|down>".into()),
+    }
+}
+
+/// Runs the backup command: `backup export <file>` writes all the auth data into the given file as an encrypted
+/// archive, while `backup restore <file>` replaces all the auth data by the one in the given archive
+pub fn run_backup(args: &[String]) -> Result<(), Box<dyn Error>> {
+    match (args.get(0).map(|arg| arg.as_str()), args.get(1)) {
+        (Some("export"), Some(path)) => {
+            let sealed = backup::application::backup_dump()?;
+            fs::write(path, sealed)?;
+            Ok(())
+        },
+
+        (Some("restore"), Some(path)) => {
+            let sealed = fs::read(path)?;
+            backup::application::backup_load(&sealed)
+        },
+
+        _ => Err("usage: backup <export|restore> <file>".into()),
+    }
+}
+
+/// Runs the import command: `import <auth0|firebase|keycloak> <tenant> <file> [--dry-run]` imports all the users of
+/// the given export into the given tenant, printing every record that could not be imported
+pub fn run_import(args: &[String]) -> Result<(), Box<dyn Error>> {
+    let usage = "usage: import <auth0|firebase|keycloak|csv|ndjson> <tenant> <file> [--update] [--dry-run]";
+    let (format, tenant, path, flags) = match args {
+        [format, tenant, path, flags @ ..] => (format, tenant, path, flags),
+        _ => return Err(usage.into()),
+    };
+
+    if flags.iter().any(|flag| flag != "--update" && flag != "--dry-run") {
+        return Err(usage.into());
+    }
+
+    let dry_run = flags.iter().any(|flag| flag == "--dry-run");
+    let conflict = match flags.iter().any(|flag| flag == "--update") {
+        true => import::domain::Conflict::Update,
+        false => import::domain::Conflict::Skip,
+    };
+
+    let format = import::domain::Format::from_str(format).ok_or(usage)?;
+    let data = fs::read_to_string(path)?;
+    let report = import::application::import_users(tenant, format, &data, conflict, dry_run)?;
+    for failure in report.errors.iter() {
+        println!("record {} ({}): {}", failure.index, failure.email, failure.error);
+    }
+
+    println!("{}{} users imported: {} keeping their password, {} required to reset it; {} updated, {} skipped; \
+              {} records failed",
+             if dry_run { "[dry run] " } else { "" },
+             report.imported, report.preserved, report.reset, report.updated, report.skipped, report.errors.len());
     Ok(())
 }
 
 #[tokio::main]
 async fn main() -> Result<(), Box<dyn Error>> {
-    // configuring logs
-    env_logger::init();
+    // seting up environment variables, as well as the rest of settings, before anything reads them
+    let dotenv = dotenv::dotenv();
+    let args: Vec<String> = env::args().skip(1).collect();
+    let parsed = config::init(&args)?;
 
-    // seting up environment variables
-    if let Err(_) = dotenv::dotenv() {
+    // configuring logs
+    logging::init();
+    if let Err(_) = dotenv {
         warn!("no dotenv file has been found");
     }
 
-    let port = env::var(environment::SERVICE_PORT)
+    if parsed.print_config {
+        println!("{}", config::dump());
+        return Ok(());
+    }
+
+    // make sure the mongodb cluster is reachable before serving any request, if any repository is provided by it
+    if storage::get_backend(Backend::Mongo) == Backend::Mongo {
+        mongo::connect()?;
+    }
+
+    let args = parsed.positional;
+    if args.get(0).map(|arg| arg.as_str()) == Some("migrate") {
+        run_migrate(&args[1..])?;
+        mongo::disconnect();
+        return Ok(());
+    }
+
+    if args.get(0).map(|arg| arg.as_str()) == Some("reseal") {
+        let count = user::application::user_reseal()?;
+        info!("personal data of {} users has been encrypted by the current key", count);
+        let count = recovery::application::recovery_reseal()?;
+        info!("emails of {} trusted contacts have been encrypted by the current key", count);
+        mongo::disconnect();
+        return Ok(());
+    }
+
+    if args.get(0).map(|arg| arg.as_str()) == Some("backup") {
+        run_backup(&args[1..])?;
+        mongo::disconnect();
+        return Ok(());
+    }
+
+    if args.get(0).map(|arg| arg.as_str()) == Some("import") {
+        run_import(&args[1..])?;
+        mongo::disconnect();
+        return Ok(());
+    }
+
+    // migrations are applied on startup unless explicitly disabled
+    let auto_migrate = config::get(environment::AUTO_MIGRATE).map(|auto| auto != "false").unwrap_or(true);
+    if auto_migrate {
+        migration::migrate_up()?;
+    }
+
+    if let Err(err) = migration::verify(auto_migrate) {
+        error!("datastore is misconfigured: {}", err);
+        return Err(err);
+    }
+
+    let ip = config::get(environment::SERVICE_IP).unwrap_or(settings::SERVER_IP.to_string());
+    let port = config::get(environment::SERVICE_PORT)
         .expect("service port must be set");
 
-    let addr = format!("{}:{}", settings::SERVER_IP, port);
+    jobs::start_all()?;
+    start_metrics_server(&ip);
+    start_graphql_server(&ip);
+    start_scim_server(&ip);
+    start_web_server(&ip);
+    start_debug_server();
+    start_admin_server(&ip)?;
+
+    if let Err(err) = telemetry::init() {
+        error!("could not set up tracing: {}", err);
+    }
+
+    let addr = format!("{}:{}", ip, port);
     start_server(addr).await?;
+    jobs::stop_all(Duration::from_secs(settings::JOBS_GRACE));
+
+    // events recorded by the latest requests are published right away, rather than waiting for the next relay
+    if audit::is_exported() {
+        match audit::application::audit_relay(settings::RELAY_BATCH) {
+            Ok(count) => info!("{} events have been published before shutting down", count),
+            Err(err) => error!("could not publish events before shutting down: {}", err),
+        }
+    }
+
+    telemetry::shutdown();
+    mongo::disconnect();
+    info!("server has been shut down");
     Ok(())
 }
\ No newline at end of file
@@ -0,0 +1,186 @@
+use std::error::Error;
+use std::collections::BTreeMap;
+use std::sync::{RwLock, RwLockReadGuard, RwLockWriteGuard};
+use crate::constants::errors;
+
+struct Rows<T> {
+    last_id: i32,
+    by_id: BTreeMap<i32, T>,
+}
+
+/// Thread-safe in-memory table whose rows are indexed by an auto-incremental id, used by all these repositories
+/// provided by the memory storage backend
+pub struct Table<T: Clone> {
+    rows: RwLock<Rows<T>>,
+}
+
+impl<T: Clone> Table<T> {
+    pub fn new() -> Self {
+        Table {
+            rows: RwLock::new(Rows {
+                last_id: 0,
+                by_id: BTreeMap::new(),
+            }),
+        }
+    }
+
+    fn get_readable_rows(&self) -> Result<RwLockReadGuard<Rows<T>>, Box<dyn Error>> {
+        match self.rows.read() {
+            Ok(rows) => Ok(rows),
+            Err(err) => {
+                error!("read lock for in-memory table got poisoned: {}", err);
+                Err(errors::POISONED.into())
+            }
+        }
+    }
+
+    fn get_writable_rows(&self) -> Result<RwLockWriteGuard<Rows<T>>, Box<dyn Error>> {
+        match self.rows.write() {
+            Ok(rows) => Ok(rows),
+            Err(err) => {
+                error!("read-write lock for in-memory table got poisoned: {}", err);
+                Err(errors::POISONED.into())
+            }
+        }
+    }
+
+    pub fn find(&self, id: i32) -> Result<T, Box<dyn Error>> {
+        match self.get_readable_rows()?.by_id.get(&id) {
+            Some(row) => Ok(row.clone()),
+            None => Err(errors::NOT_FOUND.into()),
+        }
+    }
+
+    /// returns the row with the lowest id satisfying the provided filter
+    pub fn find_first(&self, filter: impl Fn(&T) -> bool) -> Result<T, Box<dyn Error>> {
+        match self.get_readable_rows()?.by_id.values().find(|row| filter(row)) {
+            Some(row) => Ok(row.clone()),
+            None => Err(errors::NOT_FOUND.into()),
+        }
+    }
+
+    /// returns all the rows satisfying the provided filter, sorted by their id
+    pub fn find_all(&self, filter: impl Fn(&T) -> bool) -> Result<Vec<T>, Box<dyn Error>> {
+        let rows = self.get_readable_rows()?;
+        Ok(rows.by_id.values().filter(|row| filter(row)).cloned().collect())
+    }
+
+    /// stores the provided row under a brand new id, which is set into the row through the given closure. Fails if
+    /// there is any row conflicting with the new one, as told by the provided filter
+    pub fn insert(&self,
+                  row: &mut T,
+                  conflict: impl Fn(&T) -> bool,
+                  set_id: impl FnOnce(&mut T, i32)) -> Result<(), Box<dyn Error>> {
+
+        let mut rows = self.get_writable_rows()?;
+        if rows.by_id.values().any(|existing| conflict(existing)) {
+            return Err(errors::ALREADY_EXISTS.into());
+        }
+
+        rows.last_id += 1;
+        let id = rows.last_id;
+        set_id(row, id);
+        rows.by_id.insert(id, row.clone());
+        Ok(())
+    }
+
+    /// replaces the row with the provided id, failing if there is no such a row
+    pub fn update(&self, id: i32, row: &T) -> Result<(), Box<dyn Error>> {
+        let mut rows = self.get_writable_rows()?;
+        match rows.by_id.get_mut(&id) {
+            Some(existing) => {
+                *existing = row.clone();
+                Ok(())
+            },
+
+            None => Err(errors::NOT_FOUND.into()),
+        }
+    }
+
+    pub fn delete(&self, id: i32) -> Result<(), Box<dyn Error>> {
+        self.get_writable_rows()?.by_id.remove(&id);
+        Ok(())
+    }
+
+    /// removes all the rows satisfying the provided filter, returning how many of them there were
+    pub fn delete_all(&self, filter: impl Fn(&T) -> bool) -> Result<usize, Box<dyn Error>> {
+        let mut rows = self.get_writable_rows()?;
+        let before = rows.by_id.len();
+        rows.by_id.retain(|_, row| !filter(row));
+        Ok(before - rows.by_id.len())
+    }
+}
+
+#[cfg(test)]
+pub mod tests {
+    use super::Table;
+
+    #[derive(Clone, PartialEq, Debug)]
+    struct Row {
+        id: i32,
+        name: String,
+    }
+
+    fn new_row(name: &str) -> Row {
+        Row {
+            id: 0,
+            name: name.to_string(),
+        }
+    }
+
+    #[test]
+    fn table_insert_should_not_fail() {
+        let table = Table::new();
+        let mut first = new_row("first");
+        let mut second = new_row("second");
+
+        table.insert(&mut first, |_| false, |row, id| row.id = id).unwrap();
+        table.insert(&mut second, |_| false, |row, id| row.id = id).unwrap();
+
+        assert_eq!(1, first.id);
+        assert_eq!(2, second.id);
+        assert_eq!(first, table.find(1).unwrap());
+        assert_eq!(second, table.find_first(|row| row.name == "second").unwrap());
+    }
+
+    #[test]
+    fn table_insert_should_fail() {
+        let table = Table::new();
+        let mut first = new_row("first");
+        let mut copy = new_row("first");
+
+        table.insert(&mut first, |_| false, |row, id| row.id = id).unwrap();
+        assert!(table.insert(&mut copy, |row| row.name == "first", |row, id| row.id = id).is_err());
+        assert_eq!(0, copy.id);
+    }
+
+    #[test]
+    fn table_update_should_not_fail() {
+        let table = Table::new();
+        let mut row = new_row("first");
+        table.insert(&mut row, |_| false, |row, id| row.id = id).unwrap();
+
+        row.name = "updated".to_string();
+        table.update(row.id, &row).unwrap();
+        assert_eq!("updated", table.find(row.id).unwrap().name);
+    }
+
+    #[test]
+    fn table_update_should_fail() {
+        let table: Table<Row> = Table::new();
+        assert!(table.update(1, &new_row("first")).is_err());
+    }
+
+    #[test]
+    fn table_delete_all_should_not_fail() {
+        let table = Table::new();
+        for name in ["first", "second", "second"].iter() {
+            let mut row = new_row(name);
+            table.insert(&mut row, |_| false, |row, id| row.id = id).unwrap();
+        }
+
+        assert_eq!(2, table.delete_all(|row| row.name == "second").unwrap());
+        assert_eq!(1, table.find_all(|_| true).unwrap().len());
+        assert!(table.find(2).is_err());
+    }
+}
\ No newline at end of file
@@ -1,5 +1,6 @@
 use std::error::Error;
 use std::time::{SystemTime};
+use crate::time;
 
 pub trait MetadataRepository {
     fn find(&self, id: i32) -> Result<Metadata, Box<dyn Error>>;
@@ -19,8 +20,8 @@ impl Metadata {
     pub fn new() -> Self {
         Metadata {
             id: 0,
-            created_at: SystemTime::now(),
-            updated_at: SystemTime::now(),
+            created_at: time::now(),
+            updated_at: time::now(),
         }
     }
 
@@ -29,10 +30,11 @@ impl Metadata {
     }
 
     pub fn touch(&mut self) {
-        self.updated_at = SystemTime::now();
+        self.updated_at = time::now();
     }
 }
 
+#[derive(Clone)]
 pub struct InnerMetadata {
     pub created_at: SystemTime,
     pub touch_at: SystemTime,
@@ -41,13 +43,13 @@ pub struct InnerMetadata {
 impl InnerMetadata {
     pub fn new() -> Self {
         InnerMetadata {
-            created_at: SystemTime::now(),
-            touch_at: SystemTime::now(),
+            created_at: time::now(),
+            touch_at: time::now(),
         }
     }
 
     pub fn touch(&mut self) {
-        self.touch_at = SystemTime::now();
+        self.touch_at = time::now();
     }
 }
 
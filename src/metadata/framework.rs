@@ -7,6 +7,7 @@ use crate::diesel::prelude::*;
 use crate::schema::metadata::dsl::*;
 use crate::schema::metadata;
 use crate::postgres::*;
+use crate::memory;
 
 use super::domain::{Metadata, MetadataRepository};
 
@@ -102,4 +103,34 @@ impl MetadataRepository for PostgresMetadataRepository {
         Ok(())
     }
 
+}
+
+pub struct InMemoryMetadataRepository {
+    table: memory::Table<Metadata>,
+}
+
+impl InMemoryMetadataRepository {
+    pub fn new() -> Self {
+        InMemoryMetadataRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl MetadataRepository for InMemoryMetadataRepository {
+    fn find(&self, target: i32) -> Result<Metadata, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn create(&self, meta: &mut Metadata) -> Result<(), Box<dyn Error>> {
+        self.table.insert(meta, |_| false, |meta, new_id| meta.id = new_id)
+    }
+
+    fn save(&self, meta: &Metadata) -> Result<(), Box<dyn Error>> {
+        self.table.update(meta.id, meta)
+    }
+
+    fn delete(&self, meta: &Metadata) -> Result<(), Box<dyn Error>> {
+        self.table.delete(meta.id)
+    }
 }
\ No newline at end of file
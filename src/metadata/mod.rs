@@ -2,12 +2,18 @@ pub mod framework;
 pub mod application;
 pub mod domain;
 
+use crate::storage::{self, Backend};
+
 lazy_static! {
-    static ref REPO_PROVIDER: framework::PostgresMetadataRepository = {
-        framework::PostgresMetadataRepository
+    static ref REPO_PROVIDER: Box<dyn domain::MetadataRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresMetadataRepository),
+            Backend::Memory => Box::new(framework::InMemoryMetadataRepository::new()),
+            backend => storage::unsupported(backend, "metadata"),
+        }
     }; 
 }   
 
 pub fn get_repository() -> Box<&'static dyn domain::MetadataRepository> {
-    Box::new(&*REPO_PROVIDER)
+    Box::new(&**REPO_PROVIDER)
 }
\ No newline at end of file
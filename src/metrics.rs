@@ -0,0 +1,386 @@
+use std::error::Error;
+use std::convert::Infallible;
+use std::future::Future;
+use std::net::SocketAddr;
+use std::pin::Pin;
+use std::task::{Context, Poll};
+use std::time::{Duration, SystemTime, UNIX_EPOCH, Instant};
+use hyper::{Body, Server, StatusCode};
+use hyper::header::CONTENT_TYPE;
+use hyper::service::{make_service_fn, service_fn};
+use prometheus::core::Collector;
+use prometheus::{Encoder, TextEncoder, IntCounterVec, HistogramVec, IntGauge, IntGaugeVec};
+use tonic::Code;
+use tower::{Layer, Service};
+
+use crate::health;
+use crate::headers::HeadersLayer;
+use crate::telemetry::in_span;
+use crate::constants::settings;
+
+const METRICS_PATH: &str = "/metrics";
+const LIVENESS_PATH: &str = "/livez";
+const READINESS_PATH: &str = "/readyz";
+const STAGE_BUCKETS: &[f64] = &[0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0];
+const SERVER_ERRORS: &[Code] = &[Code::Internal, Code::Unknown, Code::DataLoss, Code::Unavailable];
+
+lazy_static! {
+    static ref REQUESTS: IntCounterVec = prometheus::register_int_counter_vec!(
+        "tpauth_requests_total",
+        "Requests served, by service, method and status code",
+        &["service", "method", "code"]
+    ).expect("requests counter must be registered");
+
+    static ref LATENCY: HistogramVec = prometheus::register_histogram_vec!(
+        "tpauth_request_duration_seconds",
+        "Time taken to serve the requests, by service and method",
+        &["service", "method"]
+    ).expect("latency histogram must be registered");
+
+    static ref TOKENS: IntCounterVec = prometheus::register_int_counter_vec!(
+        "tpauth_tokens_issued_total",
+        "Tokens issued, by kind and the grant they were issued by (e.g. password, refresh or guest)",
+        &["kind", "grant"]
+    ).expect("tokens counter must be registered");
+
+    static ref STAGES: HistogramVec = prometheus::register_histogram_vec!(
+        "tpauth_stage_duration_seconds",
+        "Time taken by each stage of the login and signup use cases, by use case and stage",
+        &["use_case", "stage"],
+        STAGE_BUCKETS.to_vec()
+    ).expect("stages histogram must be registered");
+
+    static ref OBJECTIVES: IntCounterVec = prometheus::register_int_counter_vec!(
+        "tpauth_slo_requests_total",
+        "Requests of the use cases with a service level objective, by use case and result: good, slow or failed",
+        &["use_case", "result"]
+    ).expect("objectives counter must be registered");
+
+    static ref VERIFICATIONS: IntCounterVec = prometheus::register_int_counter_vec!(
+        "tpauth_tokens_verified_total",
+        "Tokens verified, by the id of the key they were signed by and result: valid or invalid",
+        &["kid", "result"]
+    ).expect("verifications counter must be registered");
+
+    static ref SHED: IntCounterVec = prometheus::register_int_counter_vec!(
+        "tpauth_requests_shed_total",
+        "Requests rejected before being served, by reason: overloaded, deprioritized, too_large or hashing",
+        &["reason"]
+    ).expect("shed counter must be registered");
+
+    static ref PANICS: IntCounterVec = prometheus::register_int_counter_vec!(
+        "tpauth_panics_total",
+        "Requests that panicked while being served, by service and method",
+        &["service", "method"]
+    ).expect("panics counter must be registered");
+
+    static ref JOB_RUNS: IntCounterVec = prometheus::register_int_counter_vec!(
+        "tpauth_job_runs_total",
+        "Runs of the background jobs, by job and result: ok, failed or skipped, if not the leader",
+        &["job", "result"]
+    ).expect("job runs counter must be registered");
+
+    static ref JOB_DURATION: HistogramVec = prometheus::register_histogram_vec!(
+        "tpauth_job_duration_seconds",
+        "Time taken by each run of the background jobs, by job",
+        &["job"]
+    ).expect("job duration histogram must be registered");
+
+    static ref JOB_SUCCESS: IntGaugeVec = prometheus::register_int_gauge_vec!(
+        "tpauth_job_last_success_timestamp_seconds",
+        "Unix time of the latest successful run of the background jobs, by job",
+        &["job"]
+    ).expect("job success gauge must be registered");
+
+    static ref SESSIONS: IntGauge = prometheus::register_int_gauge!(
+        "tpauth_sessions_active",
+        "Sessions not expired nor closed yet"
+    ).expect("sessions gauge must be registered");
+
+    static ref SESSIONS_BY_APP: IntGaugeVec = prometheus::register_int_gauge_vec!(
+        "tpauth_sessions_by_app",
+        "Sessions not expired nor closed yet, by the id of the app they have been granted access to",
+        &["app"]
+    ).expect("sessions by app gauge must be registered");
+
+    static ref FINDINGS: IntGaugeVec = prometheus::register_int_gauge_vec!(
+        "tpauth_diagnostics_findings",
+        "Findings of the diagnostics checks, by check and severity: warning or critical",
+        &["check", "severity"]
+    ).expect("findings gauge must be registered");
+
+    static ref EXPIRATIONS: IntGaugeVec = prometheus::register_int_gauge_vec!(
+        "tpauth_credential_expiry_timestamp_seconds",
+        "Unix time the credentials the service relies on expire at, by check and subject (e.g. the certificate path)",
+        &["check", "subject"]
+    ).expect("expirations gauge must be registered");
+}
+
+/// Counts a token of the given kind (e.g. session or remember) as issued by the given grant (e.g. password)
+pub fn token_issued(kind: &str, grant: &str) {
+    TOKENS.with_label_values(&[kind, grant]).inc();
+}
+
+/// Returns the count of tokens issued by this instance since it started, by kind and grant
+pub fn tokens_issued() -> Vec<(String, String, u64)> {
+    TOKENS.collect().iter()
+        .flat_map(|family| family.get_metric().iter())
+        .map(|metric| {
+            let label = |name: &str| metric.get_label().iter()
+                .find(|pair| pair.get_name() == name)
+                .map(|pair| pair.get_value().to_string())
+                .unwrap_or_default();
+
+            (label("kind"), label("grant"), metric.get_counter().get_value() as u64)
+        })
+        .collect()
+}
+
+/// The key id verifications are counted by when the token tells none, or one not known by the service, so the
+/// cardinality of the counter is bounded by the keys in use
+pub const UNKNOWN_KID: &str = "unknown";
+
+/// Counts a token signed by the key with the given id as verified, either successfully or not
+pub fn token_verified(kid: &str, valid: bool) {
+    let result = if valid {"valid"} else {"invalid"};
+    VERIFICATIONS.with_label_values(&[kid, result]).inc();
+}
+
+/// Counts a request as rejected before being served for the given reason (e.g. overloaded)
+pub fn request_shed(reason: &str) {
+    SHED.with_label_values(&[reason]).inc();
+}
+
+/// Counts a request to the rpc at the given path as panicked while being served
+pub fn request_panicked(path: &str) {
+    let (service, method) = get_rpc(path);
+    PANICS.with_label_values(&[&service, &method]).inc();
+}
+
+/// Counts a run of the given background job as over, either successfully or not, recording the time it took
+pub fn job_finished(job: &str, ok: bool, elapsed: Duration) {
+    let result = if ok {"ok"} else {"failed"};
+    JOB_RUNS.with_label_values(&[job, result]).inc();
+    JOB_DURATION.with_label_values(&[job]).observe(elapsed.as_secs_f64());
+    if ok {
+        let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default();
+        JOB_SUCCESS.with_label_values(&[job]).set(now.as_secs() as i64);
+    }
+}
+
+/// Counts a run of the given background job as skipped, since only the leader runs it
+pub fn job_skipped(job: &str) {
+    JOB_RUNS.with_label_values(&[job, "skipped"]).inc();
+}
+
+/// Runs the given closure as a stage of the given use case (e.g. the password verification of a login), recording the
+/// time it takes and tracing it as a child span of the current one
+pub fn in_stage<T, F: FnOnce() -> T>(use_case: &str, stage: &'static str, f: F) -> T {
+    let start = Instant::now();
+    let result = in_span(stage, f);
+    STAGES.with_label_values(&[use_case, stage]).observe(start.elapsed().as_secs_f64());
+    result
+}
+
+/// Returns the use case and latency objective, in seconds, of the given method, if any
+fn get_objective(service: &str, method: &str) -> Option<(&'static str, f64)> {
+    match (service, method) {
+        ("SessionService", "Login") => Some(("login", settings::LOGIN_OBJECTIVE)),
+        ("UserService", "Signup") => Some(("signup", settings::SIGNUP_OBJECTIVE)),
+        _ => None,
+    }
+}
+
+/// Tells whether a request served with the given code in the given time met the objective. Only server errors count
+/// as failed, since the rest (e.g. a wrong password) are the expected outcome of a bad request
+fn get_result(code: &str, elapsed: f64, objective: f64) -> &'static str {
+    if SERVER_ERRORS.iter().any(|server_error| code == format!("{:?}", server_error)) {
+        "failed"
+    } else if elapsed > objective {
+        "slow"
+    } else {
+        "good"
+    }
+}
+
+/// Splits the path of a grpc request, being /<package>.<Service>/<Method>, into its service and method
+fn get_rpc(path: &str) -> (String, String) {
+    let mut parts = path.trim_start_matches('/').splitn(2, '/');
+    let service = parts.next().unwrap_or_default();
+    let service = service.rsplit('.').next().unwrap_or_default();
+    let method = parts.next().unwrap_or_default();
+    (service.to_string(), method.to_string())
+}
+
+/// Returns the status code of a grpc response: failed calls tell it by their headers, while successful ones tell it
+/// by their trailers, which are not known yet by the time the headers are sent
+pub(crate) fn get_code<T>(response: &http::Response<T>) -> String {
+    let code = response.headers().get("grpc-status")
+        .and_then(|code| code.to_str().ok())
+        .and_then(|code| code.parse().ok())
+        .unwrap_or(0);
+
+    format!("{:?}", Code::from(code))
+}
+
+/// A layer recording the count, status code and latency of all the requests served by the services it wraps
+#[derive(Clone, Default)]
+pub struct MetricsLayer;
+
+impl<S> Layer<S> for MetricsLayer {
+    type Service = MetricsService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        MetricsService { inner }
+    }
+}
+
+#[derive(Clone)]
+pub struct MetricsService<S> {
+    inner: S,
+}
+
+impl<S, B, R> Service<http::Request<B>> for MetricsService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<R>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let (service, method) = get_rpc(request.uri().path());
+        let start = Instant::now();
+        let future = self.inner.call(request);
+
+        Box::pin(async move {
+            let result = future.await;
+            let code = match &result {
+                Ok(response) => get_code(response),
+                Err(_) => format!("{:?}", Code::Unknown),
+            };
+
+            let elapsed = start.elapsed().as_secs_f64();
+            REQUESTS.with_label_values(&[&service, &method, &code]).inc();
+            LATENCY.with_label_values(&[&service, &method]).observe(elapsed);
+            if let Some((use_case, objective)) = get_objective(&service, &method) {
+                OBJECTIVES.with_label_values(&[use_case, get_result(&code, elapsed, objective)]).inc();
+            }
+
+            result
+        })
+    }
+}
+
+fn new_probe_response(ok: bool) -> hyper::Response<Body> {
+    let mut response = hyper::Response::new(Body::from(if ok {"ok"} else {"not ready"}));
+    if !ok {
+        *response.status_mut() = StatusCode::SERVICE_UNAVAILABLE;
+    }
+
+    response
+}
+
+async fn handle(request: hyper::Request<Body>) -> Result<hyper::Response<Body>, Infallible> {
+    match request.uri().path() {
+        METRICS_PATH => {},
+        // the service is alive as long as it is able to respond
+        LIVENESS_PATH => return Ok(new_probe_response(true)),
+        READINESS_PATH => return Ok(new_probe_response(health::is_ready())),
+        _ => {
+            let mut response = hyper::Response::new(Body::empty());
+            *response.status_mut() = StatusCode::NOT_FOUND;
+            return Ok(response);
+        }
+    }
+
+    match crate::session::application::session_count() {
+        Ok(count) => SESSIONS.set(count as i64),
+        Err(err) => error!("could not count active sessions: {}", err),
+    }
+
+    // apps whose sessions are all gone must not keep their latest count
+    match crate::session::application::session_count_by_app() {
+        Ok(counts) => {
+            SESSIONS_BY_APP.reset();
+            counts.iter().for_each(|(app, count)| {
+                SESSIONS_BY_APP.with_label_values(&[&app.to_string()]).set(*count as i64);
+            });
+        },
+        Err(err) => error!("could not count active sessions by app: {}", err),
+    }
+
+    // checks with no findings anymore must not keep their latest count
+    let report = crate::diagnostics::diagnose();
+    FINDINGS.reset();
+    report.findings.iter().for_each(|finding| {
+        FINDINGS.with_label_values(&[finding.check.as_str(), finding.severity.as_str()]).inc();
+    });
+
+    EXPIRATIONS.reset();
+    report.expirations.iter().for_each(|expiration| {
+        let expires_at = expiration.expires_at.duration_since(UNIX_EPOCH).unwrap_or_default();
+        EXPIRATIONS.with_label_values(&[expiration.check.as_str(), expiration.subject.as_str()])
+            .set(expires_at.as_secs() as i64);
+    });
+
+    let encoder = TextEncoder::new();
+    let mut buffer = Vec::new();
+    if let Err(err) = encoder.encode(&prometheus::gather(), &mut buffer) {
+        error!("could not encode metrics: {}", err);
+        let mut response = hyper::Response::new(Body::empty());
+        *response.status_mut() = StatusCode::INTERNAL_SERVER_ERROR;
+        return Ok(response);
+    }
+
+    let mut response = hyper::Response::new(Body::from(buffer));
+    if let Ok(format) = encoder.format_type().parse() {
+        response.headers_mut().insert(CONTENT_TYPE, format);
+    }
+
+    Ok(response)
+}
+
+/// Serves all the metrics, in the prometheus text format, at the /metrics path of the given address, as well as the
+/// liveness and readiness of the service at the /livez and /readyz ones
+pub async fn serve(addr: SocketAddr) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let make_service = make_service_fn(|_| async {
+        Ok::<_, Infallible>(HeadersLayer::new().layer(service_fn(handle)))
+    });
+
+    Server::try_bind(&addr)?.serve(make_service).await?;
+    Ok(())
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{get_rpc, get_objective, get_result};
+
+    #[test]
+    fn get_rpc_should_not_fail() {
+        assert_eq!(("SessionService".to_string(), "Login".to_string()), get_rpc("/session.SessionService/Login"));
+        assert_eq!(("SessionService".to_string(), "".to_string()), get_rpc("/SessionService"));
+    }
+
+    #[test]
+    fn get_objective_should_not_fail() {
+        assert_eq!("login", get_objective("SessionService", "Login").unwrap().0);
+        assert_eq!("signup", get_objective("UserService", "Signup").unwrap().0);
+        assert!(get_objective("SessionService", "Logout").is_none());
+    }
+
+    #[test]
+    fn get_result_should_not_fail() {
+        assert_eq!("good", get_result("Ok", 0.1, 0.5));
+        assert_eq!("good", get_result("Aborted", 0.1, 0.5));
+        assert_eq!("slow", get_result("Ok", 0.6, 0.5));
+        assert_eq!("failed", get_result("Internal", 0.1, 0.5));
+        assert_eq!("failed", get_result("Unavailable", 0.6, 0.5));
+    }
+}
@@ -0,0 +1,395 @@
+use std::error::Error;
+use std::path::Path;
+use std::time::{SystemTime, UNIX_EPOCH};
+use mongodb::{
+    bson::{doc, Document},
+    options::FindOneOptions,
+    sync::Database,
+};
+
+use crate::diesel::prelude::*;
+use crate::postgres;
+use crate::mongo;
+use crate::schema;
+use crate::storage::{self, Backend};
+use crate::constants::errors;
+
+// postgres migrations are these sql files under the migrations directory, so they get embedded into the binary
+embed_migrations!("migrations");
+
+const MIGRATIONS_DIR: &str = "migrations";
+const VERSION_COLLECTION: &str = "schema_version";
+
+// makes sure each of the given tables exists and has all the columns declared by the schema, by selecting them all
+macro_rules! verify_tables {
+    ($conn:expr, $($table:ident),*) => {
+        $(
+            if let Err(err) = schema::$table::table.select(schema::$table::all_columns).limit(0).execute($conn) {
+                return Err(format!("postgres table {} does not match the schema: {}", stringify!($table), err).into());
+            }
+        )*
+    };
+}
+
+/// A versioned change on the mongodb database, such as a new index, a schema validator or a data backfill
+struct MongoMigration {
+    version: i32,
+    name: &'static str,
+    up: fn(&Database) -> Result<(), Box<dyn Error>>,
+    down: fn(&Database) -> Result<(), Box<dyn Error>>,
+    verify: fn(&Database) -> Result<bool, Box<dyn Error>>, // if false, what up does is missing
+}
+
+// all the mongodb migrations, sorted by version
+const MONGO_MIGRATIONS: &[MongoMigration] = &[
+    MongoMigration {
+        version: 1,
+        name: "create_directory_index",
+        up: create_directory_index,
+        down: drop_directory_index,
+        verify: has_directory_index,
+    },
+
+    MongoMigration {
+        version: 2,
+        name: "create_audit_index",
+        up: create_audit_index,
+        down: drop_audit_index,
+        verify: has_audit_index,
+    },
+
+    MongoMigration {
+        version: 3,
+        name: "validate_directory",
+        up: validate_directory,
+        down: unvalidate_directory,
+        verify: has_directory_validator,
+    },
+
+    MongoMigration {
+        version: 4,
+        name: "create_outbox_index",
+        up: create_outbox_index,
+        down: drop_outbox_index,
+        verify: has_outbox_index,
+    },
+
+    MongoMigration {
+        version: 5,
+        name: "create_audit_filter_indexes",
+        up: create_audit_filter_indexes,
+        down: drop_audit_filter_indexes,
+        verify: has_audit_filter_indexes,
+    },
+];
+
+// events are paged by id, the latest first, whatever they are filtered by
+const AUDIT_FILTER_INDEXES: &[(&str, &str)] = &[
+    ("user_id", "user"),
+    ("issuer_id", "issuer"),
+    ("kind_id", "kind"),
+    ("app_id", "app"),
+    ("ip_id", "ip"),
+];
+
+fn create_directory_index(db: &Database) -> Result<(), Box<dyn Error>> {
+    // a user has one directory per app at most
+    create_index(db, "directories", "user_app", doc!{"user": 1, "app": 1}, true)
+}
+
+fn drop_directory_index(db: &Database) -> Result<(), Box<dyn Error>> {
+    drop_index(db, "directories", "user_app")
+}
+
+fn has_directory_index(db: &Database) -> Result<bool, Box<dyn Error>> {
+    has_index(db, "directories", "user_app")
+}
+
+fn create_audit_index(db: &Database) -> Result<(), Box<dyn Error>> {
+    // events are always listed by user, the latest first
+    create_index(db, "audit", "user_created_at", doc!{"user": 1, "meta.created_at": -1}, false)
+}
+
+fn drop_audit_index(db: &Database) -> Result<(), Box<dyn Error>> {
+    drop_index(db, "audit", "user_created_at")
+}
+
+fn has_audit_index(db: &Database) -> Result<bool, Box<dyn Error>> {
+    has_index(db, "audit", "user_created_at")
+}
+
+fn create_outbox_index(db: &Database) -> Result<(), Box<dyn Error>> {
+    // pending events are relayed in the same order they were recorded
+    create_index(db, "audit", "published_created_at", doc!{"published": 1, "meta.created_at": 1}, false)
+}
+
+fn drop_outbox_index(db: &Database) -> Result<(), Box<dyn Error>> {
+    drop_index(db, "audit", "published_created_at")
+}
+
+fn has_outbox_index(db: &Database) -> Result<bool, Box<dyn Error>> {
+    has_index(db, "audit", "published_created_at")
+}
+
+fn create_audit_filter_indexes(db: &Database) -> Result<(), Box<dyn Error>> {
+    for (name, field) in AUDIT_FILTER_INDEXES {
+        let mut keys = Document::new();
+        keys.insert(*field, 1);
+        keys.insert("_id", -1);
+        create_index(db, "audit", name, keys, false)?;
+    }
+
+    create_index(db, "audit", "created_at", doc!{"meta.created_at": 1}, false)
+}
+
+fn drop_audit_filter_indexes(db: &Database) -> Result<(), Box<dyn Error>> {
+    for (name, _) in AUDIT_FILTER_INDEXES {
+        drop_index(db, "audit", name)?;
+    }
+
+    drop_index(db, "audit", "created_at")
+}
+
+fn has_audit_filter_indexes(db: &Database) -> Result<bool, Box<dyn Error>> {
+    for (name, _) in AUDIT_FILTER_INDEXES {
+        if !has_index(db, "audit", name)? {
+            return Ok(false);
+        }
+    }
+
+    has_index(db, "audit", "created_at")
+}
+
+fn validate_directory(db: &Database) -> Result<(), Box<dyn Error>> {
+    set_validator(db, "directories", doc!{
+        "$jsonSchema": {
+            "bsonType": "object",
+            "required": ["user", "app", "meta"],
+            "properties": {
+                "user": {"bsonType": "int"},
+                "app": {"bsonType": "int"}
+            }
+        }
+    })
+}
+
+fn unvalidate_directory(db: &Database) -> Result<(), Box<dyn Error>> {
+    set_validator(db, "directories", doc!{})
+}
+
+fn has_directory_validator(db: &Database) -> Result<bool, Box<dyn Error>> {
+    has_validator(db, "directories")
+}
+
+fn create_index(db: &Database,
+                collection: &str,
+                name: &str,
+                keys: Document,
+                unique: bool) -> Result<(), Box<dyn Error>> {
+
+    db.run_command(doc!{
+        "createIndexes": collection,
+        "indexes": [{"key": keys, "name": name, "unique": unique}]
+    }, None)?;
+
+    Ok(())
+}
+
+fn drop_index(db: &Database, collection: &str, name: &str) -> Result<(), Box<dyn Error>> {
+    db.run_command(doc!{"dropIndexes": collection, "index": name}, None)?;
+    Ok(())
+}
+
+fn set_validator(db: &Database, collection: &str, validator: Document) -> Result<(), Box<dyn Error>> {
+    // validators can only be modified on existing collections
+    if db.list_collection_names(doc!{"name": collection})?.len() == 0 {
+        db.run_command(doc!{"create": collection}, None)?;
+    }
+
+    db.run_command(doc!{"collMod": collection, "validator": validator}, None)?;
+    Ok(())
+}
+
+fn has_collection(db: &Database, collection: &str) -> Result<bool, Box<dyn Error>> {
+    Ok(db.list_collection_names(doc!{"name": collection})?.len() > 0)
+}
+
+fn has_index(db: &Database, collection: &str, name: &str) -> Result<bool, Box<dyn Error>> {
+    // listing the indexes of a missing collection fails instead of returning none
+    if !has_collection(db, collection)? {
+        return Ok(false);
+    }
+
+    let result = db.run_command(doc!{"listIndexes": collection}, None)?;
+    let indexes = result.get_document("cursor")?.get_array("firstBatch")?;
+    Ok(indexes.iter().any(|index| {
+        index.as_document().and_then(|index| index.get_str("name").ok()) == Some(name)
+    }))
+}
+
+fn has_validator(db: &Database, collection: &str) -> Result<bool, Box<dyn Error>> {
+    let spec = match db.list_collections(doc!{"name": collection}, None)?.next() {
+        Some(spec) => spec?,
+        None => return Ok(false),
+    };
+
+    let validator = spec.get_document("options").and_then(|options| options.get_document("validator"));
+    Ok(validator.map(|validator| !validator.is_empty()).unwrap_or(false))
+}
+
+/// Returns the latest version applied on the mongodb database, zero if none
+fn get_mongo_version(db: &Database) -> Result<i32, Box<dyn Error>> {
+    let options = FindOneOptions::builder()
+        .sort(doc!{"_id": -1})
+        .build();
+
+    match db.collection(VERSION_COLLECTION).find_one(None, options)? {
+        Some(latest) => Ok(latest.get_i32("_id")?),
+        None => Ok(0),
+    }
+}
+
+fn mongo_up() -> Result<(), Box<dyn Error>> {
+    let db = mongo::get_database()?;
+    let current = get_mongo_version(&db)?;
+
+    for migration in MONGO_MIGRATIONS.iter().filter(|migration| migration.version > current) {
+        info!("applying mongodb migration {}_{}", migration.version, migration.name);
+        (migration.up)(&db)?;
+
+        let applied_at = SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs_f64();
+        db.collection(VERSION_COLLECTION).insert_one(doc!{
+            "_id": migration.version,
+            "name": migration.name,
+            "applied_at": applied_at
+        }, None)?;
+    }
+
+    Ok(())
+}
+
+fn mongo_down() -> Result<(), Box<dyn Error>> {
+    let db = mongo::get_database()?;
+    let current = get_mongo_version(&db)?;
+
+    let migration = match MONGO_MIGRATIONS.iter().find(|migration| migration.version == current) {
+        Some(migration) => migration,
+        None => return Err(errors::NOT_FOUND.into()),
+    };
+
+    info!("reverting mongodb migration {}_{}", migration.version, migration.name);
+    (migration.down)(&db)?;
+
+    db.collection(VERSION_COLLECTION).delete_one(doc!{"_id": migration.version}, None)?;
+    Ok(())
+}
+
+/// Makes sure every mongodb migration has been applied and what it did is still there, applying it again if repair
+/// is true or failing otherwise
+fn mongo_verify(repair: bool) -> Result<(), Box<dyn Error>> {
+    let db = mongo::get_database()?;
+    let current = get_mongo_version(&db)?;
+
+    for migration in MONGO_MIGRATIONS.iter() {
+        if migration.version > current {
+            return Err(format!("mongodb migration {}_{} is pending", migration.version, migration.name).into());
+        }
+
+        if (migration.verify)(&db)? {
+            continue;
+        }
+
+        if !repair {
+            return Err(format!("mongodb migration {}_{} is applied but missing", migration.version, migration.name).into());
+        }
+
+        warn!("mongodb migration {}_{} is applied but missing, applying it again", migration.version, migration.name);
+        (migration.up)(&db)?;
+    }
+
+    Ok(())
+}
+
+fn postgres_up() -> Result<(), Box<dyn Error>> {
+    // diesel keeps track of the applied versions by its own
+    let conn = postgres::get_connection().get()?;
+    embedded_migrations::run(&conn)?;
+    Ok(())
+}
+
+fn postgres_down() -> Result<(), Box<dyn Error>> {
+    // embedded migrations cannot be reverted, so the down scripts are read from the migrations directory
+    let conn = postgres::get_connection().get()?;
+    let version = diesel_migrations::revert_latest_migration_in_directory(&conn, Path::new(MIGRATIONS_DIR))?;
+    info!("postgres migration {} reverted", version);
+    Ok(())
+}
+
+/// Makes sure every table has all the columns the repositories expect. Postgres migrations cannot be applied partially,
+/// so a mismatch is never repaired
+fn postgres_verify() -> Result<(), Box<dyn Error>> {
+    let conn = postgres::get_connection().get()?;
+    verify_tables!(&conn, apikeys, apps, attributes, contacts, credentials, deliveries, devices, directories, emails,
+                   events, group_members, groups, identities, invitations, iprules, metadata, policies, recoveries,
+                   reserved_names, revocations, secrets, signing_keys, templates, tenant_settings, tenants, users,
+                   webhooks);
+    Ok(())
+}
+
+/// if true, some repository is provided by the given backend, else none is
+fn is_required(backend: Backend) -> bool {
+    match backend {
+        Backend::Postgres => storage::get_backend(Backend::Postgres) == Backend::Postgres,
+        Backend::Mongo => storage::get_backend(Backend::Mongo) == Backend::Mongo,
+        _ => false,
+    }
+}
+
+/// Applies all the pending migrations on every database some repository is provided by
+pub fn migrate_up() -> Result<(), Box<dyn Error>> {
+    if is_required(Backend::Postgres) {
+        postgres_up()?;
+    }
+
+    if is_required(Backend::Mongo) {
+        mongo_up()?;
+    }
+
+    Ok(())
+}
+
+/// Makes sure every database some repository is provided by is in the state the repositories expect, so a misconfigured
+/// datastore is reported on startup instead of failing the first request that hits it. Missing mongodb indexes and
+/// validators are created again if repair is true
+pub fn verify(repair: bool) -> Result<(), Box<dyn Error>> {
+    if is_required(Backend::Postgres) {
+        postgres_verify()?;
+    }
+
+    if is_required(Backend::Mongo) {
+        mongo_verify(repair)?;
+    }
+
+    Ok(())
+}
+
+/// Reverts the latest migration applied on the database of the provided backend
+pub fn migrate_down(backend: Backend) -> Result<(), Box<dyn Error>> {
+    match backend {
+        Backend::Postgres => postgres_down(),
+        Backend::Mongo => mongo_down(),
+        backend => Err(format!("{} storage has no migrations", backend.as_str()).into()),
+    }
+}
+
+#[cfg(test)]
+pub mod tests {
+    use super::MONGO_MIGRATIONS;
+
+    #[test]
+    fn mongo_migrations_should_be_sorted() {
+        for (index, migration) in MONGO_MIGRATIONS.iter().enumerate() {
+            assert_eq!(index as i32 + 1, migration.version);
+        }
+    }
+}
\ No newline at end of file
@@ -1,10 +1,15 @@
 use mongodb::{
-    bson::doc,
-    sync::{Client, Collection},
+    bson::{doc, Bson, oid::ObjectId},
+    options::{ClientOptions, Credential, CollectionOptions, ReadPreference, SelectionCriteria},
+    sync::{Client, Collection, Database},
 };
 
-use std::env;
-use crate::constants::{environment, errors};
+use std::error::Error;
+use std::sync::RwLock;
+use std::time::Duration;
+use crate::constants::{environment, settings, errors};
+use crate::config;
+use crate::keyring::application::keyring_get;
 
 struct Conn {
    client: Client,
@@ -12,11 +17,11 @@ struct Conn {
 }
 
 lazy_static! {
-    static ref CONN: Conn = {
-        Conn {
+    // the connection is kept optional so it can be released on shutdown
+    static ref CONN: RwLock<Option<Conn>> = {
+        let conn = Conn {
             client: {
-                let mongo_dsn = env::var(environment::MONGO_DSN).expect("mongodb dsn must be set");
-                match Client::with_uri_str(&mongo_dsn) {
+                match new_client() {
                     Ok(client) => {
                         info!("connection with mongodb cluster established");
                         client
@@ -28,12 +33,181 @@ lazy_static! {
                 }               
             },
             
-            db_name: env::var(environment::MONGO_DB).expect("mongodb database name must be set"),
+            db_name: config::get(environment::MONGO_DB).expect("mongodb database name must be set"),
+        };
+
+        RwLock::new(Some(conn))
+    };
+}
+
+/// Builds a new client from the environment: the dsn is required, while the credentials, if any, override these
+/// from the dsn and the pool size defaults to settings::MONGO_POOL_SIZE
+fn new_client() -> Result<Client, Box<dyn Error>> {
+    let mongo_dsn = keyring_get(environment::MONGO_DSN).expect("mongodb dsn must be set");
+    let mut options = ClientOptions::parse(&mongo_dsn)?;
+
+    if let Ok(username) = config::get(environment::MONGO_USERNAME) {
+        options.credential = Some(Credential::builder()
+            .username(username)
+            .password(keyring_get(environment::MONGO_PASSWORD).ok())
+            .build());
+    }
+
+    let pool_size = match config::get(environment::MONGO_POOL_SIZE) {
+        Ok(size) => size.parse().expect("mongodb pool size must be a number"),
+        Err(_) => settings::MONGO_POOL_SIZE,
+    };
+
+    let timeout = Duration::from_secs(settings::MONGO_TIMEOUT);
+    options.max_pool_size = Some(pool_size);
+    options.connect_timeout = Some(timeout);
+    options.server_selection_timeout = Some(timeout);
+
+    let client = Client::with_options(options)?;
+    Ok(client)
+}
+
+/// Establishes the connection with the mongodb cluster, if not already, and makes sure it is reachable
+pub fn connect() -> Result<(), Box<dyn Error>> {
+    ping()
+}
+
+/// Checks the mongodb cluster is reachable through the current connection
+pub fn ping() -> Result<(), Box<dyn Error>> {
+    let conn = match CONN.read() {
+        Ok(conn) => conn,
+        Err(err) => {
+            error!("read lock for mongodb connection got poisoned: {}", err);
+            return Err(errors::POISONED.into());
         }
     };
+
+    match &*conn {
+        Some(conn) => {
+            conn.client.database(&conn.db_name).run_command(doc! {"ping": 1}, None)?;
+            Ok(())
+        },
+
+        None => Err(errors::CANNOT_CONNECT.into()),
+    }
 }
 
-pub fn get_connection(name: &str) -> Collection {
-    // Get a handle to a database.
-    CONN.client.clone().database(&CONN.db_name).collection(name)
+/// Releases the connection with the mongodb cluster, so no collection can be gotten from now on. Collections gotten
+/// before keep working until they are dropped
+pub fn disconnect() {
+    match CONN.write() {
+        Ok(mut conn) => {
+            if conn.take().is_some() {
+                info!("connection with mongodb cluster released");
+            }
+        },
+
+        Err(err) => error!("read-write lock for mongodb connection got poisoned: {}", err),
+    }
+}
+
+pub fn get_database() -> Result<Database, Box<dyn Error>> {
+    let conn = match CONN.read() {
+        Ok(conn) => conn,
+        Err(err) => {
+            error!("read lock for mongodb connection got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    match &*conn {
+        Some(conn) => Ok(conn.client.clone().database(&conn.db_name)),
+        None => Err(errors::CANNOT_CONNECT.into()),
+    }
+}
+
+pub fn get_connection(name: &str) -> Result<Collection, Box<dyn Error>> {
+    Ok(get_database()?.collection(name))
+}
+
+/// Returns the value the provided id is kept as by the _id field of its document: documents created before ids were
+/// ulids keep an ObjectId, while any other keeps the id itself
+pub fn id_to_bson(id: &str) -> Bson {
+    match ObjectId::with_string(id) {
+        Ok(object_id) => Bson::ObjectId(object_id),
+        Err(_) => Bson::String(id.to_string()),
+    }
+}
+
+/// Returns the id kept by the provided value of an _id field, if any
+pub fn id_from_bson(id: &Bson) -> Option<String> {
+    match id {
+        Bson::ObjectId(object_id) => Some(object_id.to_hex()),
+        Bson::String(id) => Some(id.clone()),
+        _ => None,
+    }
+}
+
+/// Same as get_connection, but reads through the returned collection are routed as the read preference of the given
+/// collection says. Only these read-heavy operations that can bear stale data should use it
+pub fn get_reading_connection(name: &str) -> Result<Collection, Box<dyn Error>> {
+    let options = CollectionOptions::builder()
+        .selection_criteria(SelectionCriteria::ReadPreference(get_read_preference(name)))
+        .build();
+
+    Ok(get_database()?.collection_with_options(name, options))
+}
+
+/// Returns the read preference of the given collection: the one set by MONGO_READ_PREFERENCE_<COLLECTION>, if any, or
+/// else the one set by MONGO_READ_PREFERENCE for all of them, or else the primary
+fn get_read_preference(name: &str) -> ReadPreference {
+    let specific = format!("{}_{}", environment::MONGO_READ_PREFERENCE, name.to_uppercase());
+    let preference = match config::get(&specific).or(config::get(environment::MONGO_READ_PREFERENCE)) {
+        Ok(preference) => preference,
+        Err(_) => return ReadPreference::Primary,
+    };
+
+    match read_preference_from_str(&preference) {
+        Some(preference) => preference,
+        None => {
+            warn!("unknown read preference {} for collection {}, primary is used instead", preference, name);
+            ReadPreference::Primary
+        }
+    }
+}
+
+fn read_preference_from_str(preference: &str) -> Option<ReadPreference> {
+    match preference {
+        "primary" => Some(ReadPreference::Primary),
+        "primaryPreferred" => Some(ReadPreference::PrimaryPreferred{options: Default::default()}),
+        "secondary" => Some(ReadPreference::Secondary{options: Default::default()}),
+        "secondaryPreferred" => Some(ReadPreference::SecondaryPreferred{options: Default::default()}),
+        "nearest" => Some(ReadPreference::Nearest{options: Default::default()}),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+pub mod tests {
+    use mongodb::bson::Bson;
+    use mongodb::options::ReadPreference;
+    use super::{read_preference_from_str, id_to_bson, id_from_bson};
+
+    #[test]
+    fn read_preference_from_str_should_not_fail() {
+        assert!(matches!(read_preference_from_str("primary"), Some(ReadPreference::Primary)));
+        assert!(matches!(read_preference_from_str("secondaryPreferred"), Some(ReadPreference::SecondaryPreferred{..})));
+        assert!(matches!(read_preference_from_str("nearest"), Some(ReadPreference::Nearest{..})));
+    }
+
+    #[test]
+    fn read_preference_from_str_should_fail() {
+        assert!(read_preference_from_str("secondary_preferred").is_none());
+    }
+
+    #[test]
+    fn id_to_bson_should_not_fail() {
+        const OBJECT_ID: &str = "507f1f77bcf86cd799439011";
+        const ULID: &str = "01ARYZ6S41TSV4RRFFQ69G5FAV";
+
+        assert!(matches!(id_to_bson(OBJECT_ID), Bson::ObjectId(_)));
+        assert_eq!(id_from_bson(&id_to_bson(OBJECT_ID)).unwrap(), OBJECT_ID);
+        assert_eq!(id_to_bson(ULID), Bson::String(ULID.to_string()));
+        assert_eq!(id_from_bson(&id_to_bson(ULID)).unwrap(), ULID);
+    }
 }
\ No newline at end of file
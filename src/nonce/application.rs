@@ -0,0 +1,47 @@
+use std::error::Error;
+use crate::constants::errors;
+use crate::time::{self, unix_timestamp};
+use super::get_repository as get_nonce_repository;
+
+/// Records the given nonce of the given scope (e.g. "challenge") as used until the time it expires at (as UTC
+/// timestamp), failing if it had been used before. Nonces cannot be checked while the repository fails, so they are
+/// rejected rather than risking any replay
+pub fn nonce_consume(scope: &str, nonce: &str, exp: usize) -> Result<(), Box<dyn Error>> {
+    if nonce.len() == 0 {
+        return Err(errors::REPLAYED.into());
+    }
+
+    // a nonce must be kept as long as whatever it belongs to is valid, and no longer
+    let timeout = exp.saturating_sub(unix_timestamp(time::now())).max(1) as u64;
+    let key = format!("{}:{}", scope, nonce);
+    match get_nonce_repository().consume(&key, timeout) {
+        Ok(true) => Ok(()),
+        Ok(false) => {
+            warn!("alert: nonce {} has been replayed", key);
+            Err(errors::REPLAYED.into())
+        },
+        Err(err) => {
+            error!("could not record nonce {}: {}", key, err);
+            Err(errors::REPLAYED.into())
+        },
+    }
+}
+
+#[cfg(test)]
+#[cfg(feature = "integration-tests")]
+mod tests {
+    use std::time::{SystemTime, Duration};
+    use crate::time::unix_timestamp;
+    use super::nonce_consume;
+
+    #[test]
+    fn nonce_consume_should_fail_on_replay() {
+        let exp = unix_timestamp(SystemTime::now() + Duration::from_secs(60));
+        assert!(nonce_consume("testing", "nonce_consume_should_fail_on_replay", exp).is_ok());
+        assert!(nonce_consume("testing", "nonce_consume_should_fail_on_replay", exp).is_err());
+
+        // the same nonce is a different one for another scope
+        assert!(nonce_consume("another", "nonce_consume_should_fail_on_replay", exp).is_ok());
+        assert!(nonce_consume("testing", "", exp).is_err());
+    }
+}
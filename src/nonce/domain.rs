@@ -0,0 +1,6 @@
+use std::error::Error;
+
+pub trait NonceRepository {
+    // records the nonce at key until the timeout is over, returning false if it was already recorded
+    fn consume(&self, key: &str, timeout: u64) -> Result<bool, Box<dyn Error>>;
+}
@@ -0,0 +1,86 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::sync::RwLock;
+use std::time::{SystemTime, Duration};
+
+use crate::cache;
+use crate::constants::{settings, errors};
+use crate::time;
+use super::domain::NonceRepository;
+
+const NONCE_PREFIX: &str = "nonce";
+
+pub struct InMemoryNonceRepository {
+    nonces: RwLock<HashMap<String, SystemTime>>,
+}
+
+impl InMemoryNonceRepository {
+    pub fn new() -> Self {
+        InMemoryNonceRepository {
+            nonces: RwLock::new(HashMap::new()),
+        }
+    }
+}
+
+impl NonceRepository for InMemoryNonceRepository {
+    fn consume(&self, key: &str, timeout: u64) -> Result<bool, Box<dyn Error>> {
+        let mut nonces = match self.nonces.write() {
+            Ok(nonces) => nonces,
+            Err(err) => {
+                error!("read-write lock for nonces got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        let now = time::now();
+        if nonces.len() >= settings::MAX_NONCES {
+            nonces.retain(|_, deadline| *deadline > now);
+        }
+
+        if let Some(deadline) = nonces.get(key) {
+            if *deadline > now {
+                return Ok(false);
+            }
+        }
+
+        nonces.insert(key.to_string(), now + Duration::from_secs(timeout));
+        Ok(true)
+    }
+}
+
+pub struct RedisNonceRepository;
+
+impl NonceRepository for RedisNonceRepository {
+    fn consume(&self, key: &str, timeout: u64) -> Result<bool, Box<dyn Error>> {
+        // setting the key only if it does not exist yet is atomic, so no two instances may consume the same nonce
+        let mut conn = cache::get_connection()?;
+        let result: Option<String> = redis::cmd("SET")
+            .arg(format!("{}:{}", NONCE_PREFIX, key))
+            .arg(1)
+            .arg("NX")
+            .arg("EX")
+            .arg(timeout)
+            .query(&mut *conn)?;
+
+        Ok(result.is_some())
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::InMemoryNonceRepository;
+    use super::super::domain::NonceRepository;
+
+    #[test]
+    fn in_memory_consume_should_not_fail() {
+        let repo = InMemoryNonceRepository::new();
+        assert!(repo.consume("challenge:testing", 60).unwrap());
+        assert!(!repo.consume("challenge:testing", 60).unwrap());
+        assert!(repo.consume("challenge:another", 60).unwrap());
+
+        // expired nonces may be consumed again
+        assert!(repo.consume("challenge:expired", 0).unwrap());
+        assert!(repo.consume("challenge:expired", 60).unwrap());
+    }
+}
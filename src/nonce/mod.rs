@@ -0,0 +1,20 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::NonceRepository + Sync + Send> = {
+        // nonces are as volatile as sessions, so they are kept by the same backend
+        match storage::get_session_backend() {
+            Backend::Memory => Box::new(framework::InMemoryNonceRepository::new()),
+            Backend::Redis => Box::new(framework::RedisNonceRepository),
+            backend => storage::unsupported(backend, "nonces"),
+        }
+    };
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::NonceRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
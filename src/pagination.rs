@@ -0,0 +1,123 @@
+use std::error::Error;
+use crate::constants::{errors, settings};
+
+const TOKEN_SEPARATOR: char = ':';
+
+/// A page of any list, as requested by its page_size and page_token: the max items it may have, bounded by the
+/// server, and the cursor the page goes on from, being the position of the last item of the previous page. Cursors
+/// are specific to each list, so a token issued for a list is not taken by any other
+#[derive(Clone, PartialEq, Debug)]
+pub struct Page {
+    pub(crate) list: &'static str,
+    pub(crate) size: u64,
+    pub(crate) cursor: String,
+}
+
+impl Page {
+    /// Returns the page requested by the given size and token for the list with the given name. A size of zero stands
+    /// for the default one, while sizes larger than the max are capped. An empty token stands for the first page
+    pub fn new(list: &'static str, size: u64, token: &str) -> Result<Self, Box<dyn Error>> {
+        let size = match size {
+            0 => settings::DEFAULT_PAGE_SIZE,
+            size => size.min(settings::MAX_PAGE_SIZE),
+        };
+
+        Ok(Page {
+            list: list,
+            size: size,
+            cursor: decode_token(list, token)?,
+        })
+    }
+
+    pub fn get_size(&self) -> u64 {
+        self.size
+    }
+
+    /// Returns the cursor the page goes on from, empty for the first page
+    pub fn get_cursor(&self) -> &str {
+        &self.cursor
+    }
+
+    /// Returns how many items are to be fetched for the page: one more than its size, so whether there is any next
+    /// page can be told with no other query
+    pub fn get_limit(&self) -> u64 {
+        self.size + 1
+    }
+
+    /// Given the items fetched for the page, up to its limit, drops the one beyond its size, if any, and returns the
+    /// token of the next page: the cursor of the last item kept, as told by the given closure, or empty if there is
+    /// no next page at all
+    pub fn next_token<T, F: Fn(&T) -> String>(&self, items: &mut Vec<T>, cursor: F) -> String {
+        if items.len() as u64 <= self.size {
+            return "".to_string();
+        }
+
+        items.truncate(self.size as usize);
+        items.last()
+            .map(|item| encode_token(self.list, &cursor(item)))
+            .unwrap_or_default()
+    }
+}
+
+/// Returns the opaque token of the page of the given list going on from the given cursor
+pub fn encode_token(list: &str, cursor: &str) -> String {
+    base64::encode_config(format!("{}{}{}", list, TOKEN_SEPARATOR, cursor), base64::URL_SAFE_NO_PAD)
+}
+
+/// Returns the cursor of the given token, as long as it has been issued for the given list
+fn decode_token(list: &str, token: &str) -> Result<String, Box<dyn Error>> {
+    if token.len() == 0 {
+        return Ok("".to_string());
+    }
+
+    let decoded = base64::decode_config(token, base64::URL_SAFE_NO_PAD)
+        .map_err(|_| errors::INVALID_PAGE_TOKEN)?;
+
+    let decoded = String::from_utf8(decoded).map_err(|_| errors::INVALID_PAGE_TOKEN)?;
+    let mut parts = decoded.splitn(2, TOKEN_SEPARATOR);
+    match (parts.next(), parts.next()) {
+        (Some(issuer), Some(cursor)) if issuer == list && cursor.len() > 0 => Ok(cursor.to_string()),
+        _ => Err(errors::INVALID_PAGE_TOKEN.into()),
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use crate::constants::{errors, settings};
+    use super::{Page, encode_token};
+
+    #[test]
+    fn page_new_should_not_fail() {
+        let page = Page::new("devices", 0, "").unwrap();
+        assert_eq!(settings::DEFAULT_PAGE_SIZE, page.get_size());
+        assert_eq!("", page.get_cursor());
+
+        let page = Page::new("devices", settings::MAX_PAGE_SIZE + 1, &encode_token("devices", "10:2")).unwrap();
+        assert_eq!(settings::MAX_PAGE_SIZE, page.get_size());
+        assert_eq!("10:2", page.get_cursor());
+    }
+
+    #[test]
+    fn page_new_should_fail() {
+        for token in &[encode_token("events", "10"), encode_token("devices", ""), "!!".to_string()] {
+            let err = Page::new("devices", 10, token).unwrap_err();
+            assert_eq!(errors::INVALID_PAGE_TOKEN, err.to_string());
+        }
+    }
+
+    #[test]
+    fn page_next_token_should_not_fail() {
+        let page = Page::new("test", 2, "").unwrap();
+        let mut items = vec![1, 2, 3];
+        let token = page.next_token(&mut items, |item| item.to_string());
+        assert_eq!(vec![1, 2], items);
+
+        let next = Page::new("test", 2, &token).unwrap();
+        assert_eq!("2", next.get_cursor());
+
+        let mut items = vec![3];
+        assert_eq!("", next.next_token(&mut items, |item| item.to_string()));
+        assert_eq!(vec![3], items);
+    }
+}
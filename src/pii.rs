@@ -0,0 +1,164 @@
+use std::error::Error;
+use openssl::sign::Signer;
+use openssl::pkey::PKey;
+use openssl::hash::MessageDigest;
+use crate::security;
+use crate::keyring::application::keyring_get;
+use crate::constants::{environment, errors};
+
+// encrypted values are prefixed by it, so any other value is taken as one kept before encryption got enabled
+const SEALED_PREFIX: &str = "pii:1:";
+const KEY_LEN: usize = 32;
+
+lazy_static! {
+    // the first key encrypts all the new values, while the rest are only kept to decrypt the older ones
+    static ref KEYS: Vec<(String, Vec<u8>)> = {
+        match keyring_get(environment::PII_KEYS) {
+            Ok(keys) => parse_keys(&keys).expect("pii keys must be a list of <id>:<base64 key> of 32 bytes"),
+            Err(_) => {
+                warn!("pii keys should be set, personal data is kept unencrypted");
+                Vec::new()
+            }
+        }
+    };
+
+    static ref INDEX_KEY: Option<Vec<u8>> = {
+        match keyring_get(environment::PII_INDEX_SECRET) {
+            Ok(key_b64) => Some(base64::decode(key_b64).expect("pii index secret must be base64 encoded")),
+            Err(_) => {
+                assert!(KEYS.len() == 0, "pii index secret must be set along with the pii keys");
+                None
+            },
+        }
+    };
+}
+
+fn parse_keys(keys: &str) -> Result<Vec<(String, Vec<u8>)>, Box<dyn Error>> {
+    let mut parsed = Vec::new();
+    for entry in keys.split(',') {
+        let mut parts = entry.trim().splitn(2, ':');
+        let (key_id, key_b64) = match (parts.next(), parts.next()) {
+            (Some(key_id), Some(key_b64)) if key_id.len() > 0 => (key_id, key_b64),
+            _ => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        let key = base64::decode(key_b64)?;
+        if key.len() != KEY_LEN {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        parsed.push((key_id.to_string(), key));
+    }
+
+    Ok(parsed)
+}
+
+/// Envelope encryption: the value is encrypted by a brand new data key, which is encrypted by the given master key
+fn seal_with(key_id: &str, master: &[u8], value: &str) -> Result<String, Box<dyn Error>> {
+    let data_key = new_data_key()?;
+    let wrapped = security::encrypt_aes(master, &data_key)?;
+    let ciphertext = security::encrypt_aes(&data_key, value.as_bytes())?;
+
+    Ok(format!("{}{}:{}:{}", SEALED_PREFIX, key_id, base64::encode(wrapped), base64::encode(ciphertext)))
+}
+
+fn open_with(keys: &[(String, Vec<u8>)], value: &str) -> Result<String, Box<dyn Error>> {
+    let sealed = match value.strip_prefix(SEALED_PREFIX) {
+        Some(sealed) => sealed,
+        None => return Ok(value.to_string()),
+    };
+
+    let parts: Vec<&str> = sealed.split(':').collect();
+    if parts.len() != 3 {
+        return Err(errors::PARSE_FAILED.into());
+    }
+
+    let master = match keys.iter().find(|(key_id, _)| key_id == parts[0]) {
+        Some((_, master)) => master,
+        None => return Err(format!("pii key {} is not set", parts[0]).into()),
+    };
+
+    let data_key = security::decrypt_aes(master, &base64::decode(parts[1])?)?;
+    let plain = security::decrypt_aes(&data_key, &base64::decode(parts[2])?)?;
+    Ok(String::from_utf8(plain)?)
+}
+
+fn new_data_key() -> Result<Vec<u8>, Box<dyn Error>> {
+    let mut key = vec![0u8; KEY_LEN];
+    openssl::rand::rand_bytes(&mut key)?;
+    Ok(key)
+}
+
+/// Returns the provided value encrypted by the current key, or the value itself if no key is set
+pub fn encrypt(value: &str) -> Result<String, Box<dyn Error>> {
+    match KEYS.first() {
+        Some((key_id, master)) => seal_with(key_id, master, value),
+        None => Ok(value.to_string()),
+    }
+}
+
+/// Returns the plain value of the provided one, as encrypted by any of the keys set. Values not encrypted at all are
+/// returned as they are
+pub fn decrypt(value: &str) -> Result<String, Box<dyn Error>> {
+    open_with(&KEYS, value)
+}
+
+/// Returns the blind index of the provided value: a keyed digest encrypted values can be found by, since their
+/// ciphertext changes every time they get encrypted
+pub fn blind_index(value: &str) -> Result<String, Box<dyn Error>> {
+    let digest = match &*INDEX_KEY {
+        Some(key) => {
+            let key = PKey::hmac(key)?;
+            let mut signer = Signer::new(MessageDigest::sha256(), &key)?;
+            signer.update(value.as_bytes())?;
+            signer.sign_to_vec()?
+        },
+
+        None => openssl::sha::sha256(value.as_bytes()).to_vec(),
+    };
+
+    Ok(digest.iter().map(|byte| format!("{:02x}", byte)).collect())
+}
+
+#[cfg(test)]
+pub mod tests {
+    use super::{parse_keys, seal_with, open_with, SEALED_PREFIX};
+
+    #[test]
+    fn parse_keys_should_not_fail() {
+        let key_b64 = base64::encode(&[7u8; 32]);
+        let keys = parse_keys(&format!("new:{}, old:{}", key_b64, key_b64)).unwrap();
+        assert_eq!(keys.len(), 2);
+        assert_eq!(keys[0].0, "new");
+        assert_eq!(keys[1].0, "old");
+    }
+
+    #[test]
+    fn parse_keys_should_fail() {
+        assert!(parse_keys("new").is_err());
+        assert!(parse_keys(&format!("new:{}", base64::encode(&[7u8; 16]))).is_err());
+    }
+
+    #[test]
+    fn open_sealed_should_not_fail() {
+        let keys = vec![("new".to_string(), vec![8u8; 32]), ("old".to_string(), vec![7u8; 32])];
+        let sealed = seal_with("old", &keys[1].1, "hello@testing.com").unwrap();
+        
+        assert!(sealed.starts_with(SEALED_PREFIX));
+        assert!(!sealed.contains("hello@testing.com"));
+        assert_ne!(sealed, seal_with("old", &keys[1].1, "hello@testing.com").unwrap());
+        assert_eq!(open_with(&keys, &sealed).unwrap(), "hello@testing.com");
+    }
+
+    #[test]
+    fn open_plain_should_not_fail() {
+        assert_eq!(open_with(&[], "hello@testing.com").unwrap(), "hello@testing.com");
+    }
+
+    #[test]
+    fn open_with_missing_key_should_fail() {
+        let sealed = seal_with("old", &[7u8; 32], "hello@testing.com").unwrap();
+        let keys = vec![("new".to_string(), vec![8u8; 32])];
+        assert!(open_with(&keys, &sealed).is_err());
+    }
+}
@@ -0,0 +1,117 @@
+use std::error::Error;
+use std::time::Duration;
+use crate::constants::{errors, environment};
+use crate::metadata::domain::Metadata;
+use crate::tenant::application::tenant_setting;
+use crate::audit::{
+    application::audit_record,
+    domain::EventKind,
+};
+use crate::user::{
+    application::get_admin_user,
+    domain::User,
+};
+use super::{
+    get_repository as get_policy_repository,
+    domain::{Policy, PolicyKind},
+};
+
+/// If, and only if, the provided token belongs to an administrator and the given version is greater than the latest
+/// published one, a new version of the policy gets published
+pub fn policy_publish(token: &str,
+                      kind: PolicyKind,
+                      version: i32,
+                      url: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got a publication request for version {} of policy {} ", version, kind.as_str());
+
+    get_admin_user(token)?;
+    if let Ok(latest) = get_policy_repository().find_latest(kind) {
+        if latest.get_version() >= version {
+            return Err(errors::ALREADY_EXISTS.into());
+        }
+    }
+
+    let meta = Metadata::new();
+    let mut policy = Policy::new(meta, kind, version, url)?;
+    get_policy_repository().create(&mut policy)?;
+    Ok(())
+}
+
+/// Returns the latest published version of the given kind of policy
+pub fn policy_latest(kind: PolicyKind) -> Result<Policy, Box<dyn Error>> {
+    get_policy_repository().find_latest(kind)
+}
+
+/// Returns for how long the consent users of the given tenant give to the given kind of policy lasts, if it ever
+/// expires
+pub fn policy_lifetime(tenant: i32, kind: PolicyKind) -> Option<Duration> {
+    let setting = match kind {
+        PolicyKind::Terms => environment::TERMS_LIFETIME,
+        PolicyKind::Privacy => environment::PRIVACY_LIFETIME,
+    };
+
+    tenant_setting(tenant, setting)
+        .and_then(|secs| secs.parse::<u64>().ok())
+        .filter(|secs| *secs > 0)
+        .map(Duration::from_secs)
+}
+
+/// Returns true if, and only if, users of the given tenant must accept the latest version of all policies before
+/// logging in. Since expired consents can only be given again on login, that is the case as well if the consent to
+/// any kind of policy expires
+pub fn policy_required_on_login(tenant: i32) -> bool {
+    let required = match tenant_setting(tenant, environment::POLICY_ON_LOGIN) {
+        Some(value) => value == "true",
+        None => false,
+    };
+
+    required || PolicyKind::all().iter().any(|kind| policy_lifetime(tenant, *kind).is_some())
+}
+
+/// Makes sure the provided user has accepted the latest published version of each policy, and that its consent has
+/// not expired. If not, the provided versions are taken as the ones the user is accepting right now, failing if any
+/// of them is not the latest one. Returns true if the user got updated, and so it must be saved
+pub fn policy_enforce(user: &mut User,
+                      terms: i32,
+                      privacy: i32) -> Result<bool, Box<dyn Error>> {
+
+    let mut updated = false;
+    for (kind, accepted) in &[(PolicyKind::Terms, terms), (PolicyKind::Privacy, privacy)] {
+        let latest = match get_policy_repository().find_latest(*kind) {
+            Ok(latest) => latest,
+            Err(_) => continue, // there is no published version for this kind of policy
+        };
+
+        let expired = policy_lifetime(user.get_tenant(), *kind)
+            .map(|lifetime| user.is_policy_expired(*kind, lifetime))
+            .unwrap_or(false);
+
+        if user.get_policy_version(*kind) >= latest.get_version() && !expired {
+            continue;
+        }
+
+        if expired {
+            info!("consent of user {} to the {} policy has expired", user.get_id(), kind.as_str());
+        }
+
+        if *accepted != latest.get_version() {
+            return Err(errors::POLICY_REQUIRED.into());
+        }
+
+        user.accept_policy(&latest);
+        updated = true;
+    }
+
+    Ok(updated)
+}
+
+/// Records into the audit trail the versions of the policies the given user has just accepted, as enforced by
+/// policy_enforce once the user has been saved
+pub fn policy_consent(user: &User) {
+    let reason = format!("terms v{}, privacy v{}",
+                         user.get_policy_version(PolicyKind::Terms),
+                         user.get_policy_version(PolicyKind::Privacy));
+
+    audit_record(user.get_id(), user.get_id(), EventKind::Consent, &reason);
+}
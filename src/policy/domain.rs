@@ -0,0 +1,137 @@
+use std::error::Error;
+use crate::regex;
+use crate::metadata::domain::Metadata;
+
+pub trait PolicyRepository {
+    fn find_latest(&self, kind: PolicyKind) -> Result<Policy, Box<dyn Error>>;
+    fn create(&self, policy: &mut Policy) -> Result<(), Box<dyn Error>>;
+}
+
+/// All kinds of documents a user may be required to accept
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum PolicyKind {
+    Terms,
+    Privacy,
+}
+
+impl PolicyKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            PolicyKind::Terms => "terms",
+            PolicyKind::Privacy => "privacy",
+        }
+    }
+
+    pub fn from_str(kind: &str) -> Option<Self> {
+        match kind {
+            "terms" => Some(PolicyKind::Terms),
+            "privacy" => Some(PolicyKind::Privacy),
+            _ => None,
+        }
+    }
+
+    pub fn all() -> &'static [PolicyKind] {
+        &[PolicyKind::Terms, PolicyKind::Privacy]
+    }
+}
+
+#[derive(Clone)]
+pub struct Policy {
+    pub(super) id: i32,
+    pub(super) kind: PolicyKind,
+    pub(super) version: i32,
+    pub(super) url: String, // where the document can be read
+    pub(super) meta: Metadata,
+}
+
+impl Policy {
+    pub fn new(meta: Metadata,
+               kind: PolicyKind,
+               version: i32,
+               url: &str) -> Result<Self, Box<dyn Error>> {
+
+        regex::match_regex(regex::URL, url)?;
+        if version <= 0 {
+            return Err("version must be greater than zero".into());
+        }
+
+        let policy = Policy {
+            id: 0,
+            kind: kind,
+            version: version,
+            url: url.to_string(),
+            meta: meta,
+        };
+
+        Ok(policy)
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_kind(&self) -> PolicyKind {
+        self.kind
+    }
+
+    pub fn get_version(&self) -> i32 {
+        self.version
+    }
+
+    pub fn get_url(&self) -> &str {
+        &self.url
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use crate::metadata::domain::tests::new_metadata;
+    use super::{Policy, PolicyKind};
+
+    pub fn new_policy(kind: PolicyKind, version: i32) -> Policy {
+        Policy{
+            id: 999,
+            kind: kind,
+            version: version,
+            url: "http://testing.com".to_string(),
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn policy_new_should_not_fail() {
+        const URL: &str = "http://testing.com";
+
+        let meta = new_metadata();
+        let policy = Policy::new(meta, PolicyKind::Terms, 1, URL).unwrap();
+
+        assert_eq!(policy.id, 0);
+        assert_eq!(policy.kind, PolicyKind::Terms);
+        assert_eq!(policy.version, 1);
+        assert_eq!(policy.url, URL);
+    }
+
+    #[test]
+    fn policy_new_with_wrong_version_should_fail() {
+        let meta = new_metadata();
+        let policy = Policy::new(meta, PolicyKind::Privacy, 0, "http://testing.com");
+        assert!(policy.is_err());
+    }
+
+    #[test]
+    fn policy_new_with_wrong_url_should_fail() {
+        let meta = new_metadata();
+        let policy = Policy::new(meta, PolicyKind::Privacy, 1, "not_an_url");
+        assert!(policy.is_err());
+    }
+
+    #[test]
+    fn policy_kind_from_str_should_not_fail() {
+        for kind in &[PolicyKind::Terms, PolicyKind::Privacy] {
+            assert_eq!(Some(*kind), PolicyKind::from_str(kind.as_str()));
+        }
+
+        assert_eq!(None, PolicyKind::from_str("unknown"));
+    }
+}
\ No newline at end of file
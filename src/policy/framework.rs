@@ -0,0 +1,201 @@
+use std::error::Error;
+use tonic::{Request, Response, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::schema::policies::dsl::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::policies;
+
+use crate::constants::errors;
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use crate::firewall::framework::ip_filter;
+use super::domain::{Policy, PolicyKind, PolicyRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("policy");
+}
+
+// Proto generated server traits
+use proto::policy_service_server::PolicyService;
+pub use proto::policy_service_server::PolicyServiceServer;
+
+// Proto message structs
+use proto::{PublishRequest, LatestRequest, PolicyResponse};
+
+pub struct PolicyServiceImplementation;
+
+#[tonic::async_trait]
+impl PolicyService for PolicyServiceImplementation {
+    async fn publish(&self, request: Request<PublishRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let policy_kind = match PolicyKind::from_str(&msg_ref.kind) {
+            Some(policy_kind) => policy_kind,
+            None => return Err(Status::invalid_argument("wrong kind")),
+        };
+
+        match super::application::policy_publish(&token,
+                                                 policy_kind,
+                                                 msg_ref.version,
+                                                 &msg_ref.url) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn get_latest(&self, request: Request<LatestRequest>) -> Result<Response<PolicyResponse>, Status> {
+        logging::dump(request.get_ref());
+        let msg_ref = request.into_inner();
+        let policy_kind = match PolicyKind::from_str(&msg_ref.kind) {
+            Some(policy_kind) => policy_kind,
+            None => return Err(Status::invalid_argument("wrong kind")),
+        };
+
+        match super::application::policy_latest(policy_kind) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(policy) => Ok(Response::new(
+                PolicyResponse{
+                    kind: policy.get_kind().as_str().to_string(),
+                    version: policy.get_version(),
+                    url: policy.get_url().to_string(),
+                }
+            )),
+        }
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(Clone)]
+#[table_name = "policies"]
+struct PostgresPolicy {
+    pub id: i32,
+    pub kind: String,
+    pub version: i32,
+    pub url: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "policies"]
+struct NewPostgresPolicy<'a> {
+    pub kind: &'a str,
+    pub version: i32,
+    pub url: &'a str,
+    pub meta_id: i32,
+}
+
+pub struct PostgresPolicyRepository;
+
+impl PostgresPolicyRepository {
+    fn create_on_conn(conn: &PgConnection, policy: &mut Policy) -> Result<(), PgError>  {
+        // in order to create a policy it must exists the metadata for this policy
+        PostgresMetadataRepository::create_on_conn(conn, &mut policy.meta)?;
+
+        let new_policy = NewPostgresPolicy {
+            kind: policy.kind.as_str(),
+            version: policy.version,
+            url: &policy.url,
+            meta_id: policy.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(policies::table)
+            .values(&new_policy)
+            .get_result::<PostgresPolicy>(conn)?;
+
+        policy.id = result.id;
+        Ok(())
+    }
+}
+
+impl PolicyRepository for PostgresPolicyRepository {
+    fn find_latest(&self, target: PolicyKind) -> Result<Policy, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            policies.filter(kind.eq(target.as_str()))
+                    .order(version.desc())
+                    .limit(1)
+                    .load::<PostgresPolicy>(&connection)?
+        };
+    
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        let policy_kind = match PolicyKind::from_str(&results[0].kind) {
+            Some(policy_kind) => policy_kind,
+            None => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        let meta = get_meta_repository().find(results[0].meta_id)?;
+        Ok(Policy{
+            id: results[0].id,
+            kind: policy_kind,
+            version: results[0].version,
+            url: results[0].url.clone(),
+            meta: meta,
+        })
+    }
+
+    fn create(&self, policy: &mut Policy) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresPolicyRepository::create_on_conn(&conn, policy))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryPolicyRepository {
+    table: memory::Table<Policy>,
+}
+
+impl InMemoryPolicyRepository {
+    pub fn new() -> Self {
+        InMemoryPolicyRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl PolicyRepository for InMemoryPolicyRepository {
+    fn find_latest(&self, target: PolicyKind) -> Result<Policy, Box<dyn Error>>  {
+        let results = self.table.find_all(|policy| policy.kind == target)?;
+        match results.into_iter().max_by_key(|policy| policy.version) {
+            Some(policy) => Ok(policy),
+            None => Err(Box::new(NotFound)),
+        }
+    }
+
+    fn create(&self, policy: &mut Policy) -> Result<(), Box<dyn Error>> {
+        // in order to create a policy it must exists the metadata for this policy
+        get_meta_repository().create(&mut policy.meta)?;
+
+        let (target, target_version) = (policy.kind, policy.version);
+        self.table.insert(policy,
+                          |existing| existing.kind == target && existing.version == target_version,
+                          |policy, new_id| policy.id = new_id)
+    }
+}
\ No newline at end of file
@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::PolicyRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresPolicyRepository),
+            Backend::Memory => Box::new(framework::InMemoryPolicyRepository::new()),
+            backend => storage::unsupported(backend, "policies"),
+        }
+    }; 
+}   
+
+pub fn get_repository() -> Box<&'static dyn domain::PolicyRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
\ No newline at end of file
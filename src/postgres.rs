@@ -1,23 +1,41 @@
-use std::env;
 use lazy_static;
+use std::error::Error;
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicBool, Ordering};
 use diesel::{
     r2d2::{Pool, ConnectionManager},
     pg::PgConnection
 };
 
 use crate::constants::{environment, settings, errors};
+use crate::keyring::application::{keyring_get, keyring_on_rotate};
 
-type PgPool = Pool<ConnectionManager<PgConnection>>;
+pub type PgPool = Pool<ConnectionManager<PgConnection>>;
 
 struct Stream {
    db_connection: PgPool,
 }
 
+static CONNECTED: AtomicBool = AtomicBool::new(false);
+
 lazy_static! {
+    // the pool of the host embedding the service, if any, is used instead of a pool of its own
+    static ref SHARED_POOL: Mutex<Option<PgPool>> = Mutex::new(None);
+
     static ref STREAM: Stream = {
+       CONNECTED.store(true, Ordering::SeqCst);
+       let shared = SHARED_POOL.lock().ok().and_then(|mut shared| shared.take());
        Stream {
-            db_connection: {
-                let postgres_url = env::var(environment::POSTGRES_DSN).expect("postgres url must be set");
+            db_connection: if let Some(pool) = shared {
+                info!("connection with postgres cluster shared by the host");
+                pool
+            } else {
+                let postgres_url = keyring_get(environment::POSTGRES_DSN).expect("postgres url must be set");
+                keyring_on_rotate(environment::POSTGRES_DSN, |_| {
+                    // pooled connections cannot be moved to another dsn, so the current one is kept until restart
+                    warn!("postgres url has been rotated, the service must be restarted to apply it");
+                });
+
                 match PgPool::builder().max_size(settings::POOL_SIZE).build(ConnectionManager::new(&postgres_url)) {
                     Ok(pool) => {
                         info!("connection with postgres cluster established");
@@ -33,6 +51,21 @@ lazy_static! {
     };
 }
 
+/// Sets the given pool as the one all the postgres repositories get their connections from, rather than connecting by
+/// POSTGRES_DSN. It must be set before any connection is requested
+pub fn share_pool(pool: PgPool) -> Result<(), Box<dyn Error>> {
+    if CONNECTED.load(Ordering::SeqCst) {
+        return Err("postgres pool already in use".into());
+    }
+
+    match SHARED_POOL.lock() {
+        Ok(mut shared) => *shared = Some(pool),
+        Err(_) => return Err(errors::POISONED.into()),
+    }
+
+    Ok(())
+}
+
 pub fn get_connection() -> &'static PgPool {
     &STREAM.db_connection
 }
\ No newline at end of file
@@ -0,0 +1,103 @@
+use std::error::Error;
+use std::time::SystemTime;
+use crate::constants::{errors, settings, environment};
+use crate::tenant::application::tenant_setting;
+use crate::time;
+use crate::diagnostics::{self, Check, Severity};
+use crate::app::{
+    get_repository as get_app_repository,
+    domain::App,
+};
+use super::{
+    get_counter,
+    domain::{Metric, Quota, Usage, find_quota, get_window},
+};
+
+/// Returns the quotas of the apps of the given tenant, as set by its APP_QUOTAS setting or else by the environment.
+/// Malformed quotas must never block the service, so if they cannot be parsed there is no quota at all
+fn get_quotas(tenant: i32) -> Vec<Quota> {
+    let quotas = match tenant_setting(tenant, environment::APP_QUOTAS) {
+        Some(quotas) => quotas,
+        None => return Vec::new(),
+    };
+
+    match Quota::from_list(&quotas) {
+        Ok(quotas) => quotas,
+        Err(err) => {
+            error!("app quotas of tenant {} could not be parsed: {}", tenant, err);
+            Vec::new()
+        },
+    }
+}
+
+/// Returns the key of the counter of the given metric of the app for the window of period seconds the given time
+/// falls in
+fn get_key(app: &App, metric: Metric, period: u64, now: SystemTime) -> String {
+    format!("{}:{}:{}:{}", app.get_id(), metric.as_str(), period, get_window(period, now))
+}
+
+/// Accounts one more use of the given metric by the provided app, failing if that exceeds its quota, if any. Metrics
+/// with no quota are accounted by windows of USAGE_PERIOD seconds. A failing counter must never block the service, so
+/// any error is logged and the usage let through
+pub fn quota_consume(app: &App, metric: Metric) -> Result<(), Box<dyn Error>> {
+    let quotas = get_quotas(app.get_tenant());
+    let quota = find_quota(&quotas, metric, app.get_url());
+    let period = quota.map(Quota::get_period).unwrap_or(settings::USAGE_PERIOD);
+
+    let key = get_key(app, metric, period, time::now());
+    let used = match get_counter().increment(&key, period) {
+        Ok(used) => used,
+        Err(err) => {
+            error!("could not account {} of app {}: {}", metric.as_str(), app.get_url(), err);
+            return Ok(());
+        },
+    };
+
+    let quota = match quota {
+        Some(quota) => quota,
+        None => return Ok(()),
+    };
+
+    if diagnostics::is_near_capacity(used, quota.get_limit()) {
+        let severity = if used > quota.get_limit() {Severity::Critical} else {Severity::Warning};
+        diagnostics::report_pressure(Check::Quota, severity, &format!("{}:{}", app.get_url(), metric.as_str()),
+                                     &format!("{} of {} per {} seconds used", used, quota.get_limit(), quota.get_period()));
+    }
+
+    if used > quota.get_limit() {
+        warn!("{} quota of {} per {} seconds exceeded by app {}",
+              metric.as_str(), quota.get_limit(), quota.get_period(), app.get_url());
+        return Err(errors::QUOTA_EXCEEDED.into());
+    }
+
+    Ok(())
+}
+
+/// Same as quota_consume, but for the app with the provided url of the given tenant, such as the one a login is
+/// requested for. If there is no such app there is nothing to account, since the request is about to fail anyway
+pub fn quota_consume_by_url(tenant: i32, url: &str, metric: Metric) -> Result<(), Box<dyn Error>> {
+    match get_app_repository().find_by_url(tenant, url) {
+        Ok(app) => quota_consume(&app, metric),
+        Err(_) => Ok(()),
+    }
+}
+
+/// Returns how much of each metric the provided app has used within the current window, along with its quota, if any
+pub fn quota_usage(app: &App) -> Result<Vec<Usage>, Box<dyn Error>> {
+    let quotas = get_quotas(app.get_tenant());
+    let now = time::now();
+
+    let mut usage = Vec::new();
+    for metric in Metric::all() {
+        let quota = find_quota(&quotas, *metric, app.get_url());
+        let period = quota.map(Quota::get_period).unwrap_or(settings::USAGE_PERIOD);
+        usage.push(Usage {
+            metric: *metric,
+            used: get_counter().get(&get_key(app, *metric, period, now))?,
+            limit: quota.map(Quota::get_limit),
+            period: period,
+        });
+    }
+
+    Ok(usage)
+}
@@ -0,0 +1,212 @@
+use std::error::Error;
+use std::time::{SystemTime, UNIX_EPOCH};
+use crate::constants::errors;
+
+pub trait UsageCounter {
+    // adds one to the counter at key, which is kept for at least ttl seconds, returning its new value
+    fn increment(&self, key: &str, ttl: u64) -> Result<u64, Box<dyn Error>>;
+    // returns the value of the counter at key, being 0 if there is none
+    fn get(&self, key: &str) -> Result<u64, Box<dyn Error>>;
+}
+
+/// All kinds of usage accounted per app
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Metric {
+    Tokens,   // the tokens issued for the app
+    Requests, // the requests made on behalf of the app
+}
+
+impl Metric {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Metric::Tokens => "tokens",
+            Metric::Requests => "requests",
+        }
+    }
+
+    pub fn from_str(metric: &str) -> Option<Self> {
+        match metric {
+            "tokens" => Some(Metric::Tokens),
+            "requests" => Some(Metric::Requests),
+            _ => None,
+        }
+    }
+
+    pub fn all() -> &'static [Metric] {
+        &[Metric::Tokens, Metric::Requests]
+    }
+}
+
+/// Caps the usage of a metric to limit per period, either for all the apps or for the one with the given url only.
+/// Usage is counted by fixed windows of period seconds, starting from zero on each of them
+#[derive(Clone, PartialEq, Debug)]
+pub struct Quota {
+    pub(super) metric: Metric,
+    pub(super) app: Option<String>,
+    pub(super) limit: u64,
+    pub(super) period: u64, // time in seconds
+}
+
+impl Quota {
+    /// Parses a quota formatted as <metric>[@<app>]=<limit>/<period>, such as "tokens=1000/3600" or
+    /// "requests@https://app.example.com=100/60"
+    pub fn from_str(quota: &str) -> Result<Self, Box<dyn Error>> {
+        let (target, value) = match quota.trim().rsplitn(2, '=').collect::<Vec<&str>>()[..] {
+            [value, target] => (target, value),
+            _ => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        let mut parts = target.splitn(2, '@');
+        let metric = match parts.next().and_then(Metric::from_str) {
+            Some(metric) => metric,
+            None => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        let app = parts.next().map(str::to_string);
+        if app.as_ref().filter(|app| app.len() == 0).is_some() {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        let (limit, period) = match value.splitn(2, '/').collect::<Vec<&str>>()[..] {
+            [limit, period] => (limit.parse::<u64>()?, period.parse::<u64>()?),
+            _ => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        if limit == 0 || period == 0 {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(Quota {
+            metric: metric,
+            app: app,
+            limit: limit,
+            period: period,
+        })
+    }
+
+    /// Parses a comma-separated list of quotas
+    pub fn from_list(quotas: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        quotas.split(',')
+            .filter(|quota| quota.trim().len() > 0)
+            .map(Quota::from_str)
+            .collect()
+    }
+
+    pub fn get_metric(&self) -> Metric {
+        self.metric
+    }
+
+    pub fn get_app(&self) -> Option<&str> {
+        self.app.as_deref()
+    }
+
+    pub fn get_limit(&self) -> u64 {
+        self.limit
+    }
+
+    pub fn get_period(&self) -> u64 {
+        self.period
+    }
+}
+
+/// Returns the quota applying to the given metric for the app with the given url, being the most specific of these
+/// about the metric: quotas about the app itself go before these about all the apps, and the latest one wins among
+/// quotas as specific as each other
+pub fn find_quota<'a>(quotas: &'a [Quota], metric: Metric, app: &str) -> Option<&'a Quota> {
+    let matching: Vec<&Quota> = quotas.iter().filter(|quota| quota.metric == metric).collect();
+    matching.iter().rev()
+        .find(|quota| quota.get_app() == Some(app))
+        .or_else(|| matching.iter().rev().find(|quota| quota.app.is_none()))
+        .map(|quota| *quota)
+}
+
+/// Returns the window of period seconds the given time falls in
+pub fn get_window(period: u64, now: SystemTime) -> u64 {
+    now.duration_since(UNIX_EPOCH).unwrap_or_default().as_secs() / period
+}
+
+/// How much of a metric an app has used within the current window
+#[derive(Clone, PartialEq, Debug)]
+pub struct Usage {
+    pub(super) metric: Metric,
+    pub(super) used: u64,
+    pub(super) limit: Option<u64>, // none if there is no quota on the metric
+    pub(super) period: u64, // time in seconds
+}
+
+impl Usage {
+    pub fn get_metric(&self) -> Metric {
+        self.metric
+    }
+
+    pub fn get_used(&self) -> u64 {
+        self.used
+    }
+
+    pub fn get_limit(&self) -> Option<u64> {
+        self.limit
+    }
+
+    pub fn get_period(&self) -> u64 {
+        self.period
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{UNIX_EPOCH, Duration};
+    use super::{Metric, Quota, find_quota, get_window};
+
+    #[test]
+    fn metric_from_str_should_not_fail() {
+        for metric in Metric::all() {
+            assert_eq!(Some(*metric), Metric::from_str(metric.as_str()));
+        }
+
+        assert_eq!(None, Metric::from_str("unknown"));
+    }
+
+    #[test]
+    fn quota_from_str_should_not_fail() {
+        let quota = Quota::from_str("tokens=1000/3600").unwrap();
+        assert_eq!(Metric::Tokens, quota.metric);
+        assert_eq!(None, quota.app);
+        assert_eq!(1000, quota.limit);
+        assert_eq!(3600, quota.period);
+
+        let quota = Quota::from_str(" requests@https://app.example.com/?a=b=100/60").unwrap();
+        assert_eq!(Metric::Requests, quota.metric);
+        assert_eq!(Some("https://app.example.com/?a=b"), quota.get_app());
+        assert_eq!(100, quota.limit);
+    }
+
+    #[test]
+    fn quota_from_str_should_fail() {
+        let wrong = &["tokens", "tokens=", "tokens=10", "tokens=0/60", "tokens=10/0", "unknown=10/60",
+                      "=10/60", "tokens@=10/60", "tokens=ten/60"];
+
+        for quota in wrong {
+            assert!(Quota::from_str(quota).is_err(), "{} should not be parsed", quota);
+        }
+    }
+
+    #[test]
+    fn find_quota_should_not_fail() {
+        let app = "https://app.example.com";
+        let quotas = Quota::from_list("tokens=10/60,requests@https://app.example.com=5/60,requests=20/60,\
+                                       tokens=100/3600").unwrap();
+
+        assert_eq!(100, find_quota(&quotas, Metric::Tokens, app).unwrap().limit);
+        assert_eq!(5, find_quota(&quotas, Metric::Requests, app).unwrap().limit);
+        assert_eq!(20, find_quota(&quotas, Metric::Requests, "https://other.example.com").unwrap().limit);
+        assert!(find_quota(&[], Metric::Tokens, app).is_none());
+    }
+
+    #[test]
+    fn get_window_should_not_fail() {
+        assert_eq!(0, get_window(60, UNIX_EPOCH + Duration::from_secs(59)));
+        assert_eq!(1, get_window(60, UNIX_EPOCH + Duration::from_secs(60)));
+        assert_eq!(2, get_window(3600, UNIX_EPOCH + Duration::from_secs(7500)));
+    }
+}
@@ -0,0 +1,110 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::sync::RwLock;
+use std::time::{SystemTime, Duration};
+use redis::Commands;
+
+use crate::cache;
+use crate::constants::{settings, errors};
+use crate::time;
+use super::domain::UsageCounter;
+
+const USAGE_PREFIX: &str = "usage";
+
+pub struct InMemoryUsageCounter {
+    counters: RwLock<HashMap<String, (u64, SystemTime)>>, // the value of each counter along with its deadline
+}
+
+impl InMemoryUsageCounter {
+    pub fn new() -> Self {
+        InMemoryUsageCounter {
+            counters: RwLock::new(HashMap::new()),
+        }
+    }
+}
+
+impl UsageCounter for InMemoryUsageCounter {
+    fn increment(&self, key: &str, ttl: u64) -> Result<u64, Box<dyn Error>> {
+        let mut counters = match self.counters.write() {
+            Ok(counters) => counters,
+            Err(err) => {
+                error!("read-write lock for usage counters got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        let now = time::now();
+        if counters.len() >= settings::MAX_USAGE_COUNTERS {
+            counters.retain(|_, (_, deadline)| *deadline > now);
+        }
+
+        let (used, deadline) = counters.entry(key.to_string())
+            .or_insert_with(|| (0, now + Duration::from_secs(ttl)));
+
+        if *deadline <= now {
+            *used = 0;
+            *deadline = now + Duration::from_secs(ttl);
+        }
+
+        *used += 1;
+        Ok(*used)
+    }
+
+    fn get(&self, key: &str) -> Result<u64, Box<dyn Error>> {
+        let counters = match self.counters.read() {
+            Ok(counters) => counters,
+            Err(err) => {
+                error!("read lock for usage counters got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        Ok(counters.get(key)
+            .filter(|(_, deadline)| *deadline > time::now())
+            .map(|(used, _)| *used)
+            .unwrap_or(0))
+    }
+}
+
+pub struct RedisUsageCounter;
+
+impl UsageCounter for RedisUsageCounter {
+    fn increment(&self, key: &str, ttl: u64) -> Result<u64, Box<dyn Error>> {
+        let key = format!("{}:{}", USAGE_PREFIX, key);
+        let mut conn = cache::get_connection()?;
+
+        // keys are made of the window they count, so extending their expiration never mixes windows up
+        let (used,): (u64,) = redis::pipe().atomic()
+            .incr(&key, 1)
+            .expire(&key, ttl as usize).ignore()
+            .query(&mut *conn)?;
+
+        Ok(used)
+    }
+
+    fn get(&self, key: &str) -> Result<u64, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let used: Option<u64> = conn.get(format!("{}:{}", USAGE_PREFIX, key))?;
+        Ok(used.unwrap_or(0))
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::InMemoryUsageCounter;
+    use super::super::domain::UsageCounter;
+
+    #[test]
+    fn in_memory_increment_should_not_fail() {
+        let counter = InMemoryUsageCounter::new();
+        assert_eq!(0, counter.get("1:tokens:3600:0").unwrap());
+
+        assert_eq!(1, counter.increment("1:tokens:3600:0", 3600).unwrap());
+        assert_eq!(2, counter.increment("1:tokens:3600:0", 3600).unwrap());
+        assert_eq!(2, counter.get("1:tokens:3600:0").unwrap());
+
+        // each app has its own counter
+        assert_eq!(1, counter.increment("2:tokens:3600:0", 3600).unwrap());
+    }
+}
@@ -0,0 +1,20 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref COUNTER_PROVIDER: Box<dyn domain::UsageCounter + Sync + Send> = {
+        // usage is as volatile as rate limits, so it is kept by the same backend
+        match storage::get_session_backend() {
+            Backend::Memory => Box::new(framework::InMemoryUsageCounter::new()),
+            Backend::Redis => Box::new(framework::RedisUsageCounter),
+            backend => storage::unsupported(backend, "usage counters"),
+        }
+    };
+}
+
+pub fn get_counter() -> Box<&'static dyn domain::UsageCounter> {
+    Box::new(&**COUNTER_PROVIDER)
+}
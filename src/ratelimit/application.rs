@@ -0,0 +1,35 @@
+use std::error::Error;
+use crate::status;
+use crate::constants::errors;
+use crate::diagnostics::{self, Check, Severity};
+use super::{
+    get_limiter,
+    get_rules,
+    domain::SubjectKind,
+};
+
+/// Takes one token from the bucket of each subject for every rule of the given scope, failing if any of them was
+/// empty, along with how long until it has a token again. A failing limiter must never block the service, so any error
+/// is logged and the request let through
+pub fn ratelimit_check(scope: &str, subjects: &[(SubjectKind, String)]) -> Result<(), Box<dyn Error>> {
+    for rule in get_rules().iter().filter(|rule| rule.get_scope() == scope) {
+        for (_, subject) in subjects.iter().filter(|(kind, _)| *kind == rule.get_kind()) {
+            let key = format!("{}:{}:{}", scope, rule.get_kind().as_str(), sha256::digest_bytes(subject.as_bytes()));
+            match get_limiter().take(&key, rule) {
+                Ok(None) => {},
+                Ok(Some(wait)) => {
+                    warn!("{} rate limit exceeded by some {}", scope, rule.get_kind().as_str());
+                    diagnostics::report_pressure(Check::RateLimit, Severity::Warning,
+                                                 &format!("{}:{}", scope, rule.get_kind().as_str()),
+                                                 &format!("capacity of {} per {} seconds exhausted by some {}",
+                                                          rule.get_capacity(), rule.get_period(),
+                                                          rule.get_kind().as_str()));
+                    return Err(status::retry_after(errors::TOO_MANY_REQUESTS, wait));
+                },
+                Err(err) => error!("could not check {} rate limit: {}", scope, err),
+            }
+        }
+    }
+
+    Ok(())
+}
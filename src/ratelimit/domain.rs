@@ -0,0 +1,206 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::constants::errors;
+use crate::time;
+
+pub trait RateLimiter {
+    // takes one token from the bucket at key, returning how long until there is one if there was none left
+    fn take(&self, key: &str, rule: &Rule) -> Result<Option<Duration>, Box<dyn Error>>;
+}
+
+/// All kinds of subjects a rate limit may count the requests of
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum SubjectKind {
+    Ip,     // the address the request comes from
+    User,   // the user the request is on behalf of
+    Client, // the api key the request is authenticated by
+}
+
+impl SubjectKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            SubjectKind::Ip => "ip",
+            SubjectKind::User => "user",
+            SubjectKind::Client => "client",
+        }
+    }
+
+    pub fn from_str(kind: &str) -> Option<Self> {
+        match kind {
+            "ip" => Some(SubjectKind::Ip),
+            "user" => Some(SubjectKind::User),
+            "client" => Some(SubjectKind::Client),
+            _ => None,
+        }
+    }
+}
+
+/// A token bucket of capacity requests, refilled at a rate of capacity tokens per period, that applies to all these
+/// requests of the same subject kind over the given scope: either a whole service (e.g. "session") or one of its
+/// methods (e.g. "session.login")
+#[derive(Clone, PartialEq, Debug)]
+pub struct Rule {
+    pub(super) scope: String,
+    pub(super) kind: SubjectKind,
+    pub(super) capacity: u32,
+    pub(super) period: u64, // time in seconds
+}
+
+impl Rule {
+    /// Parses a rule formatted as <scope>:<kind>=<capacity>/<period>, such as "session.login:ip=10/60"
+    pub fn from_str(rule: &str) -> Result<Self, Box<dyn Error>> {
+        let (target, limit) = split_once(rule.trim(), '=')?;
+        let (scope, kind) = split_once(target, ':')?;
+        let (capacity, period) = split_once(limit, '/')?;
+
+        let kind = match SubjectKind::from_str(kind) {
+            Some(kind) => kind,
+            None => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        let capacity: u32 = capacity.parse()?;
+        let period: u64 = period.parse()?;
+        if scope.len() == 0 || capacity == 0 || period == 0 {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(Rule {
+            scope: scope.to_string(),
+            kind: kind,
+            capacity: capacity,
+            period: period,
+        })
+    }
+
+    /// Parses a comma-separated list of rules
+    pub fn from_list(rules: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        rules.split(',')
+            .filter(|rule| rule.trim().len() > 0)
+            .map(Rule::from_str)
+            .collect()
+    }
+
+    pub fn get_scope(&self) -> &str {
+        &self.scope
+    }
+
+    pub fn get_kind(&self) -> SubjectKind {
+        self.kind
+    }
+
+    pub fn get_capacity(&self) -> u32 {
+        self.capacity
+    }
+
+    pub fn get_period(&self) -> u64 {
+        self.period
+    }
+
+    /// Returns how many tokens are refilled per second
+    pub fn get_rate(&self) -> f64 {
+        self.capacity as f64 / self.period as f64
+    }
+}
+
+fn split_once(value: &str, separator: char) -> Result<(&str, &str), Box<dyn Error>> {
+    let mut parts = value.splitn(2, separator);
+    match (parts.next(), parts.next()) {
+        (Some(head), Some(tail)) => Ok((head, tail)),
+        _ => Err(errors::PARSE_FAILED.into()),
+    }
+}
+
+#[derive(Clone)]
+pub struct Bucket {
+    pub(super) tokens: f64,
+    pub(super) updated_at: SystemTime,
+}
+
+impl Bucket {
+    pub fn new(rule: &Rule) -> Self {
+        Bucket {
+            tokens: rule.capacity as f64,
+            updated_at: time::now(),
+        }
+    }
+
+    /// Refills the bucket for the time elapsed since its last update and then takes one token from it, if any
+    pub fn take(&mut self, rule: &Rule, now: SystemTime) -> bool {
+        let elapsed = now.duration_since(self.updated_at).unwrap_or_default().as_secs_f64();
+        self.tokens = (self.tokens + elapsed * rule.get_rate()).min(rule.capacity as f64);
+        self.updated_at = now;
+
+        if self.tokens < 1.0 {
+            return false;
+        }
+
+        self.tokens -= 1.0;
+        true
+    }
+
+    /// Returns how long it takes, since its last update, for the bucket to be refilled with one token
+    pub fn wait(&self, rule: &Rule) -> Duration {
+        Duration::from_secs_f64((1.0 - self.tokens).max(0.0) / rule.get_rate())
+    }
+
+    /// Returns true if, by the given time, the bucket would be as full as a brand new one
+    pub fn is_full(&self, rule: &Rule, now: SystemTime) -> bool {
+        let elapsed = now.duration_since(self.updated_at).unwrap_or_default().as_secs_f64();
+        self.tokens + elapsed * rule.get_rate() >= rule.capacity as f64
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use super::{Rule, Bucket, SubjectKind};
+
+    #[test]
+    fn rule_from_str_should_not_fail() {
+        let rule = Rule::from_str("session.login:ip=10/60").unwrap();
+        assert_eq!("session.login", rule.scope);
+        assert_eq!(SubjectKind::Ip, rule.kind);
+        assert_eq!(10, rule.capacity);
+        assert_eq!(60, rule.period);
+    }
+
+    #[test]
+    fn rule_from_str_should_fail() {
+        let wrong = &["session.login:ip", "session.login=10/60", ":ip=10/60", "session:host=10/60",
+                      "session:ip=0/60", "session:ip=10/0", "session:ip=ten/60"];
+
+        for rule in wrong {
+            assert!(Rule::from_str(rule).is_err(), "{} should not be parsed", rule);
+        }
+    }
+
+    #[test]
+    fn rule_from_list_should_not_fail() {
+        let rules = Rule::from_list("session.login:ip=10/60, user.signup:ip=5/600,").unwrap();
+        assert_eq!(2, rules.len());
+        assert_eq!("user.signup", rules[1].scope);
+        assert!(Rule::from_list("").unwrap().is_empty());
+    }
+
+    #[test]
+    fn bucket_take_should_not_fail() {
+        let rule = Rule::from_str("session:ip=2/10").unwrap();
+        let now = SystemTime::now();
+        let mut bucket = Bucket::new(&rule);
+        bucket.updated_at = now;
+
+        assert!(bucket.take(&rule, now));
+        assert!(bucket.take(&rule, now));
+        assert!(!bucket.take(&rule, now));
+        assert!(!bucket.is_full(&rule, now));
+        let is_about = |wait: Duration, secs: u64| (wait.as_secs_f64() - secs as f64).abs() < 0.001;
+        assert!(is_about(bucket.wait(&rule), 5));
+
+        // one token gets refilled every 5 seconds
+        assert!(bucket.take(&rule, now + Duration::from_secs(5)));
+        assert!(!bucket.take(&rule, now + Duration::from_secs(6)));
+        assert!(is_about(bucket.wait(&rule), 4));
+        assert!(bucket.is_full(&rule, now + Duration::from_secs(20)));
+    }
+}
@@ -0,0 +1,183 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::sync::RwLock;
+use std::time::{Duration, UNIX_EPOCH};
+use tonic::{Request, Status};
+use redis::Script;
+
+use crate::{cache, status};
+use crate::constants::{settings, errors};
+use crate::apikey::framework::ApiKeyIdentity;
+use crate::time;
+use super::domain::{Rule, Bucket, SubjectKind, RateLimiter};
+
+const BUCKET_PREFIX: &str = "rate_limit";
+
+// refilling and taking from the bucket is done atomically, so several instances of the service share the same limits
+const TAKE_SCRIPT: &str = r#"
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated_at')
+local tokens = tonumber(bucket[1]) or capacity
+local updated_at = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated_at) * rate)
+
+-- how long, in milliseconds, until there is a token to take, if there was none
+local wait = 0
+if tokens >= 1 then
+    tokens = tokens - 1
+else
+    wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated_at', tostring(now))
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return wait
+"#;
+
+/// Returns an interceptor limiting the rate of all the requests to the provided service, as configured by the rules
+/// whose scope is the service's name
+pub fn ratelimit_interceptor(service: &'static str) -> impl FnMut(Request<()>) -> Result<Request<()>, Status> + Clone {
+    move |request: Request<()>| {
+        rate_limit(&request, service, None)?;
+        Ok(request)
+    }
+}
+
+/// Limits the rate of the request as configured by the rules of the given scope. Interceptors cannot tell the method
+/// being called, so methods are limited by calling this function from their own handler, which may also provide the
+/// user the request is about (e.g. the email being logged in) if no token nor api key says so
+pub fn rate_limit<T>(request: &Request<T>, scope: &str, user: Option<&str>) -> Result<(), Status> {
+    let mut subjects = Vec::new();
+    if let Some(ip) = get_ip(request) {
+        subjects.push((SubjectKind::Ip, ip));
+    }
+
+    let identity = request.extensions().get::<ApiKeyIdentity>();
+    if let Some(identity) = identity {
+        subjects.push((SubjectKind::Client, identity.key.to_string()));
+    }
+
+    let token = request.metadata().get("token").and_then(|token| token.to_str().ok());
+    if let Some(identity) = identity {
+        subjects.push((SubjectKind::User, identity.user.to_string()));
+    } else if let Some(token) = token {
+        subjects.push((SubjectKind::User, token.to_string()));
+    } else if let Some(user) = user {
+        subjects.push((SubjectKind::User, user.to_string()));
+    }
+
+    match super::application::ratelimit_check(scope, &subjects) {
+        Err(err) => Err(status::new_exhausted(&*err)),
+        Ok(_) => Ok(()),
+    }
+}
+
+/// Returns the address the request comes from: the first one of its "x-forwarded-for" header if it went through the
+/// proxy, or else the remote address of the connection
+pub fn get_ip<T>(request: &Request<T>) -> Option<String> {
+    let forwarded = request.metadata().get("x-forwarded-for")
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.split(',').next())
+        .map(|ip| ip.trim().to_string())
+        .filter(|ip| ip.len() > 0);
+
+    match forwarded {
+        Some(ip) => Some(ip),
+        None => request.remote_addr().map(|addr| addr.ip().to_string()),
+    }
+}
+
+pub struct InMemoryRateLimiter {
+    buckets: RwLock<HashMap<String, (Bucket, Rule)>>,
+}
+
+impl InMemoryRateLimiter {
+    pub fn new() -> Self {
+        InMemoryRateLimiter {
+            buckets: RwLock::new(HashMap::new()),
+        }
+    }
+}
+
+impl RateLimiter for InMemoryRateLimiter {
+    fn take(&self, key: &str, rule: &Rule) -> Result<Option<Duration>, Box<dyn Error>> {
+        let mut buckets = match self.buckets.write() {
+            Ok(buckets) => buckets,
+            Err(err) => {
+                error!("read-write lock for buckets from rate limiter got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        let now = time::now();
+        if buckets.len() >= settings::MAX_BUCKETS {
+            // full buckets are just like brand new ones, so there is no need to keep them
+            buckets.retain(|_, (bucket, rule)| !bucket.is_full(rule, now));
+        }
+
+        let (bucket, _) = buckets.entry(key.to_string())
+            .or_insert_with(|| (Bucket::new(rule), rule.clone()));
+
+        match bucket.take(rule, now) {
+            true => Ok(None),
+            false => Ok(Some(bucket.wait(rule))),
+        }
+    }
+}
+
+pub struct RedisRateLimiter {
+    script: Script,
+}
+
+impl RedisRateLimiter {
+    pub fn new() -> Self {
+        RedisRateLimiter {
+            script: Script::new(TAKE_SCRIPT),
+        }
+    }
+}
+
+impl RateLimiter for RedisRateLimiter {
+    fn take(&self, key: &str, rule: &Rule) -> Result<Option<Duration>, Box<dyn Error>> {
+        let now = time::now().duration_since(UNIX_EPOCH)?.as_secs_f64();
+        let mut conn = cache::get_connection()?;
+        let wait: u64 = self.script
+            .key(format!("{}:{}", BUCKET_PREFIX, key))
+            .arg(rule.get_capacity())
+            .arg(rule.get_rate())
+            .arg(now)
+            .arg(rule.get_period())
+            .invoke(&mut *conn)?;
+
+        match wait {
+            0 => Ok(None),
+            wait => Ok(Some(Duration::from_millis(wait))),
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::Duration;
+    use super::InMemoryRateLimiter;
+    use super::super::domain::{Rule, RateLimiter};
+
+    #[test]
+    fn in_memory_take_should_not_fail() {
+        let rule = Rule::from_str("session.login:ip=2/3600").unwrap();
+        let limiter = InMemoryRateLimiter::new();
+
+        assert!(limiter.take("session.login:ip:127.0.0.1", &rule).unwrap().is_none());
+        assert!(limiter.take("session.login:ip:127.0.0.1", &rule).unwrap().is_none());
+
+        // one token gets refilled every 30 minutes
+        let wait = limiter.take("session.login:ip:127.0.0.1", &rule).unwrap().unwrap();
+        assert!(wait > Duration::from_secs(1799) && wait <= Duration::from_secs(1800));
+
+        // each subject has its own bucket
+        assert!(limiter.take("session.login:ip:127.0.0.2", &rule).unwrap().is_none());
+    }
+}
@@ -0,0 +1,51 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::sync::{Arc, RwLock};
+use crate::storage::{self, Backend};
+use crate::constants::{environment, settings};
+use crate::config;
+
+lazy_static! {
+    static ref LIMITER_PROVIDER: Box<dyn domain::RateLimiter + Sync + Send> = {
+        // buckets are as volatile as sessions, so they are kept by the same backend
+        match storage::get_session_backend() {
+            Backend::Memory => Box::new(framework::InMemoryRateLimiter::new()),
+            Backend::Redis => Box::new(framework::RedisRateLimiter::new()),
+            backend => storage::unsupported(backend, "rate limits"),
+        }
+    };
+
+    static ref RULES: RwLock<Arc<Vec<domain::Rule>>> = {
+        config::on_change(environment::RATE_LIMITS, || match load_rules() {
+            Ok(rules) => match RULES.write() {
+                Ok(mut current) => *current = Arc::new(rules),
+                Err(err) => error!("write lock for rate limits got poisoned: {}", err),
+            },
+            Err(err) => error!("rate limits could not be reloaded, the current ones are kept: {}", err),
+        });
+
+        let rules = load_rules().expect("rate limits must be a list of <scope>:<kind>=<capacity>/<period>");
+        RwLock::new(Arc::new(rules))
+    };
+}
+
+fn load_rules() -> Result<Vec<domain::Rule>, Box<dyn std::error::Error>> {
+    let rules = config::get(environment::RATE_LIMITS).unwrap_or(settings::RATE_LIMITS.to_string());
+    domain::Rule::from_list(&rules)
+}
+
+pub fn get_limiter() -> Box<&'static dyn domain::RateLimiter> {
+    Box::new(&**LIMITER_PROVIDER)
+}
+
+pub fn get_rules() -> Arc<Vec<domain::Rule>> {
+    match RULES.read() {
+        Ok(rules) => Arc::clone(&rules),
+        Err(err) => {
+            error!("read lock for rate limits got poisoned: {}", err);
+            Arc::new(Vec::new())
+        }
+    }
+}
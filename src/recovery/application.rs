@@ -0,0 +1,224 @@
+use std::error::Error;
+use std::time::Duration;
+use std::sync::{Arc, RwLock, RwLockReadGuard};
+use crate::security;
+use crate::smtp;
+use crate::time;
+use crate::constants::{errors, environment, settings};
+use crate::metadata::domain::Metadata;
+use crate::tenant::application::{tenant_find, tenant_setting};
+use crate::user::{
+    get_repository as get_user_repository,
+    application::user_permit_reset,
+    domain::User,
+};
+use crate::session::{
+    application::decode_token,
+    get_repository as get_sess_repository,
+    domain::Session,
+};
+use crate::audit::{
+    application::audit_record,
+    domain::EventKind,
+};
+use super::{
+    get_repository as get_recovery_repository,
+    get_contact_repository,
+    domain::{Contact, Recovery, ApprovalToken},
+};
+
+fn get_readable_session(sess_arc: &Arc<RwLock<Session>>) -> Result<RwLockReadGuard<Session>, Box<dyn Error>> {
+    match sess_arc.read() {
+        Ok(sess) => Ok(sess),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            Err(errors::POISONED.into())
+        }
+    }
+}
+
+/// Returns the approvals of trusted contacts the recoveries of the given tenant require: the RECOVERY_QUORUM of the
+/// tenant, if it is a positive number, or else the default one
+pub fn recovery_quorum(tenant: i32) -> usize {
+    tenant_setting(tenant, environment::RECOVERY_QUORUM)
+        .and_then(|quorum| quorum.parse::<usize>().ok())
+        .filter(|quorum| *quorum > 0)
+        .unwrap_or(settings::RECOVERY_QUORUM)
+}
+
+/// If, and only if, the provided token is valid, returns all the trusted contacts of the session's owner
+pub fn recovery_list_contacts(token: &str) -> Result<Vec<Contact>, Box<dyn Error>> {
+    info!("got a list trusted contacts request");
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = get_readable_session(&sess_arc)?.get_user()?.get_id();
+    get_contact_repository().find_all_by_user(user_id)
+}
+
+/// If, and only if, the provided token is valid and its session is elevated, the given emails become the trusted
+/// contacts of the session's owner, replacing any former one. No emails at all opts the user out of recovering its
+/// account by trusted contacts
+pub fn recovery_set_contacts(token: &str, emails: &[String]) -> Result<(), Box<dyn Error>> {
+    info!("got a set trusted contacts request");
+    if emails.len() > settings::MAX_TRUSTED_CONTACTS {
+        return Err(errors::BATCH_TOO_LARGE.into());
+    }
+
+    let claim = decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user = { // block is required because of lock release
+        let sess = get_readable_session(&sess_arc)?;
+        if !sess.is_elevated() {
+            return Err(errors::ELEVATION_REQUIRED.into());
+        }
+
+        sess.get_user()?.clone()
+    };
+
+    let mut designated: Vec<&str> = Vec::new();
+    let mut contacts = Vec::new();
+    for email in emails {
+        if designated.contains(&email.as_str()) {
+            continue;
+        }
+
+        let meta = Metadata::new();
+        contacts.push(Contact::new(meta, &user, email)?);
+        designated.push(email);
+    }
+
+    for contact in get_contact_repository().find_all_by_user(user.get_id())? {
+        get_contact_repository().delete(&contact)?;
+    }
+
+    for contact in contacts.iter_mut() {
+        get_contact_repository().create(contact)?;
+    }
+
+    let reason = format!("{} trusted contacts designated", contacts.len());
+    audit_record(user.get_id(), user.get_id(), EventKind::Recovery, &reason);
+    Ok(())
+}
+
+/// Starts the recovery of the user with the given email, in the given tenant: every trusted contact of the user gets
+/// asked to approve it, and the code the recovery gets completed by is returned to the requester. A code is returned as
+/// well if there is no such user, or it has not designated enough contacts, so requesters cannot tell which accounts
+/// exist, but no recovery is started and the code is of no use
+pub fn recovery_start(tenant: &str, email: &str) -> Result<String, Box<dyn Error>> {
+    info!("got a recovery request for user {} ", email);
+
+    let tenant = tenant_find(tenant)?;
+    let decoy = || security::get_random_string(settings::RECOVERY_CODE_LEN);
+    let user = match get_user_repository().find_by_email(tenant.get_id(), email) {
+        Ok(user) if !user.is_suspended() && !user.is_deleted() => user,
+        _ => return Ok(decoy()),
+    };
+
+    let quorum = recovery_quorum(tenant.get_id());
+    let contacts = get_contact_repository().find_all_by_user(user.get_id())?;
+    if contacts.len() < quorum {
+        info!("user {} has {} trusted contacts, while recoveries require {}", user.get_id(), contacts.len(), quorum);
+        return Ok(decoy());
+    }
+
+    let meta = Metadata::new();
+    let window = Duration::from_secs(settings::RECOVERY_WINDOW);
+    let mut recovery = Recovery::new(meta, &user, quorum, window);
+    get_recovery_repository().create(&mut recovery)?;
+
+    for contact in contacts.iter() {
+        // a single contact not being reachable must not prevent the rest from approving the recovery
+        if let Err(err) = recovery_notify(&user, &recovery, contact) {
+            warn!("could not ask contact {} to approve recovery {}: {}", contact.get_id(), recovery.get_id(), err);
+        }
+    }
+
+    let reason = format!("recovery {} started, {} approvals required", recovery.get_id(), quorum);
+    audit_record(user.get_id(), user.get_id(), EventKind::Recovery, &reason);
+    Ok(recovery.get_code().to_string())
+}
+
+/// Asks the given contact to approve the given recovery of the provided user, by a token to approve it with. Contacts
+/// have no locale of their own, so the request is sent in the one of the user
+fn recovery_notify(user: &User, recovery: &Recovery, contact: &Contact) -> Result<(), Box<dyn Error>> {
+    let claim = ApprovalToken::new(recovery, contact);
+    let token = security::encode_jwt(claim)?;
+    smtp::send_recovery_approval_email(user.get_tenant(), user.get_locale(), contact.get_email(), user.get_email(),
+                                       &token, None)
+}
+
+/// If, and only if, the provided approval token is valid and its contact is still trusted by the user, the contact
+/// approves the recovery the token was issued for, as long as it is still pending
+pub fn recovery_approve(token: &str) -> Result<(), Box<dyn Error>> {
+    info!("got a recovery approval request");
+    let claim = security::decode_jwt::<ApprovalToken>(token)?;
+
+    let mut recovery = get_recovery_repository().find(claim.recovery)?;
+    if recovery.get_user() != claim.sub {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    let contact = get_contact_repository().find_all_by_user(claim.sub)?
+        .into_iter()
+        .find(|contact| contact.get_id() == claim.contact)
+        .ok_or(errors::NOT_FOUND)?;
+
+    let approved = recovery.approve(&contact)?;
+    get_recovery_repository().save(&recovery)?;
+
+    let reason = format!("recovery {} approved by contact {}", recovery.get_id(), contact.get_id());
+    audit_record(claim.sub, claim.sub, EventKind::Recovery, &reason);
+    if approved {
+        info!("recovery {} of user {} has reached its quorum", recovery.get_id(), claim.sub);
+    }
+
+    Ok(())
+}
+
+/// If, and only if, the recovery with the provided code, in the given tenant, has been approved by its quorum within
+/// its window, it gets completed and its user required to reset its password. Returns the reset token, since the email
+/// of the user is not assumed to work
+pub fn recovery_complete(tenant: &str, code: &str) -> Result<String, Box<dyn Error>> {
+    info!("got a complete recovery request");
+
+    let tenant = tenant_find(tenant)?;
+    let mut recovery = get_recovery_repository().find_by_code(code)?;
+    let user = get_user_repository().find(recovery.get_user())?;
+    if user.get_tenant() != tenant.get_id() || user.is_deleted() {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    if user.is_suspended() {
+        return Err(errors::SUSPENDED.into());
+    }
+
+    recovery.complete()?;
+    get_recovery_repository().save(&recovery)?;
+
+    let token = user_permit_reset(user.get_id())?;
+    let reason = format!("recovery {} completed", recovery.get_id());
+    audit_record(user.get_id(), user.get_id(), EventKind::Recovery, &reason);
+    Ok(token)
+}
+
+/// The trusted contacts of all the users get saved back, so their emails get encrypted by the current key. Returns how
+/// many contacts there were
+pub fn recovery_reseal() -> Result<usize, Box<dyn Error>> {
+    let mut count = 0;
+    for user in get_user_repository().find_all()? {
+        for contact in get_contact_repository().find_all_by_user(user.get_id())? {
+            get_contact_repository().save(&contact)?;
+            count += 1;
+        }
+    }
+
+    Ok(count)
+}
+
+/// Removes up to batch recoveries already completed or expired, which are no longer of any use, returning how many of
+/// them have been removed
+pub fn recovery_cleanup(batch: usize) -> Result<usize, Box<dyn Error>> {
+    get_recovery_repository().delete_stale(time::now(), batch)
+}
@@ -0,0 +1,318 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use crate::regex;
+use crate::security::{self, TokenKind};
+use crate::constants::{errors, settings};
+use crate::metadata::domain::Metadata;
+use crate::user::domain::User;
+use crate::time::{self, unix_timestamp};
+
+pub trait ContactRepository {
+    fn find_all_by_user(&self, user_id: i32) -> Result<Vec<Contact>, Box<dyn Error>>;
+    fn create(&self, contact: &mut Contact) -> Result<(), Box<dyn Error>>;
+    fn save(&self, contact: &Contact) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, contact: &Contact) -> Result<(), Box<dyn Error>>;
+}
+
+pub trait RecoveryRepository {
+    fn find(&self, id: i32) -> Result<Recovery, Box<dyn Error>>;
+    fn find_by_code(&self, code: &str) -> Result<Recovery, Box<dyn Error>>;
+    fn create(&self, recovery: &mut Recovery) -> Result<(), Box<dyn Error>>;
+    fn save(&self, recovery: &Recovery) -> Result<(), Box<dyn Error>>;
+    // removes up to limit recoveries already completed or expired by the given time, returning how many there were
+    fn delete_stale(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>>;
+}
+
+/// Someone the user trusts to vouch for it whenever it cannot get into its account by itself
+#[derive(Clone)]
+pub struct Contact {
+    pub(super) id: i32,
+    pub(super) user: i32,          // the user who has designated the contact
+    pub(super) email: String,      // where approval requests are sent to
+    pub(super) meta: Metadata,
+}
+
+impl Contact {
+    pub fn new(meta: Metadata, user: &User, email: &str) -> Result<Self, Box<dyn Error>> {
+        regex::match_regex(regex::EMAIL, email)?;
+        if email == user.get_email() {
+            // nobody vouches for itself
+            return Err(errors::INVALID_REQUEST.into());
+        }
+
+        Ok(Contact {
+            id: 0,
+            user: user.get_id(),
+            email: email.to_string(),
+            meta: meta,
+        })
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_email(&self) -> &str {
+        &self.email
+    }
+}
+
+/// A request to recover an account, permitting its password to be reset once a quorum of its trusted contacts has
+/// approved it within the window of the recovery
+#[derive(Clone)]
+pub struct Recovery {
+    pub(super) id: i32,
+    pub(super) user: i32,
+    pub(super) code: String,        // the single-use code the requester completes the recovery by
+    pub(super) quorum: usize,       // approvals required, as told when the recovery was started
+    pub(super) approvals: Vec<i32>, // the contacts having approved the recovery so far
+    pub(super) expires_at: SystemTime,
+    pub(super) completed_at: Option<SystemTime>,
+    pub(super) meta: Metadata,
+}
+
+impl Recovery {
+    pub fn new(meta: Metadata, user: &User, quorum: usize, window: Duration) -> Self {
+        Recovery {
+            id: 0,
+            user: user.get_id(),
+            code: security::get_random_string(settings::RECOVERY_CODE_LEN),
+            quorum: quorum,
+            approvals: Vec::new(),
+            expires_at: time::now() + window,
+            completed_at: None,
+            meta: meta,
+        }
+    }
+
+    /// if true, the recovery has been neither completed nor expired yet, else is over
+    pub fn is_pending(&self) -> bool {
+        self.completed_at.is_none() && self.expires_at > time::now()
+    }
+
+    /// if true, the recovery is still pending and has been approved by as many contacts as its quorum, else is not
+    pub fn is_approved(&self) -> bool {
+        self.is_pending() && self.approvals.len() >= self.quorum
+    }
+
+    /// records the approval of the given contact, as long as it is a contact of the user the recovery is for and the
+    /// recovery is still pending. Approving twice counts once. Returns whether the recovery has got approved
+    pub(super) fn approve(&mut self, contact: &Contact) -> Result<bool, Box<dyn Error>> {
+        if contact.user != self.user {
+            return Err(errors::NOT_FOUND.into());
+        }
+
+        if !self.is_pending() {
+            return Err(errors::HAS_FAILED.into());
+        }
+
+        if !self.approvals.contains(&contact.id) {
+            self.approvals.push(contact.id);
+            self.meta.touch();
+        }
+
+        Ok(self.is_approved())
+    }
+
+    /// if the recovery has been approved, sets the current time as its completion time, so it cannot be used anymore
+    pub(super) fn complete(&mut self) -> Result<(), Box<dyn Error>> {
+        if !self.is_approved() {
+            return Err(errors::NOT_APPROVED.into());
+        }
+
+        self.completed_at = Some(time::now());
+        self.meta.touch();
+        Ok(())
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_code(&self) -> &str {
+        &self.code
+    }
+
+    pub fn get_quorum(&self) -> usize {
+        self.quorum
+    }
+
+    pub fn get_approvals(&self) -> &[i32] {
+        &self.approvals
+    }
+
+    pub fn get_expires_at(&self) -> SystemTime {
+        self.expires_at
+    }
+}
+
+// token for a trusted contact to approve a recovery
+#[derive(Serialize, Deserialize)]
+pub struct ApprovalToken {
+    pub(super) exp: usize,          // expiration time (as UTC timestamp) - required
+    pub(super) iat: SystemTime,     // issued at: creation time
+    pub(super) iss: String,         // issuer
+    pub(super) sub: i32,            // subject: the user id
+    pub(super) recovery: i32,       // the recovery to approve
+    pub(super) contact: i32,        // the contact approving it
+}
+
+impl TokenKind for ApprovalToken {
+    const KIND: &'static str = "approval+jwt";
+}
+
+impl ApprovalToken {
+    pub fn new(recovery: &Recovery, contact: &Contact) -> Self {
+        ApprovalToken {
+            exp: unix_timestamp(recovery.expires_at),
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: recovery.user,
+            recovery: recovery.id,
+            contact: contact.id,
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use crate::constants::settings;
+    use crate::metadata::domain::tests::new_metadata;
+    use crate::user::domain::tests::new_user;
+    use crate::time::unix_timestamp;
+    use super::{Contact, Recovery, ApprovalToken};
+
+    pub fn new_contact(id: i32) -> Contact {
+        Contact{
+            id: id,
+            user: 999,
+            email: format!("contact{}@testing.com", id),
+            meta: new_metadata(),
+        }
+    }
+
+    pub fn new_recovery(quorum: usize) -> Recovery {
+        Recovery{
+            id: 999,
+            user: 999,
+            code: "testing".to_string(),
+            quorum: quorum,
+            approvals: Vec::new(),
+            expires_at: SystemTime::now() + Duration::from_secs(60),
+            completed_at: None,
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn contact_new_should_not_fail() {
+        const EMAIL: &str = "contact@testing.com";
+
+        let user = new_user();
+        let contact = Contact::new(new_metadata(), &user, EMAIL).unwrap();
+        assert_eq!(contact.id, 0);
+        assert_eq!(contact.user, user.get_id());
+        assert_eq!(contact.email, EMAIL);
+    }
+
+    #[test]
+    fn contact_new_should_fail() {
+        let user = new_user();
+        assert!(Contact::new(new_metadata(), &user, "not_an_email").is_err());
+        assert!(Contact::new(new_metadata(), &user, user.get_email()).is_err());
+    }
+
+    #[test]
+    fn recovery_new_should_not_fail() {
+        let user = new_user();
+        let before = SystemTime::now();
+        let recovery = Recovery::new(new_metadata(), &user, 2, Duration::from_secs(60));
+        let after = SystemTime::now();
+
+        assert_eq!(recovery.id, 0);
+        assert_eq!(recovery.user, user.get_id());
+        assert_eq!(recovery.code.len(), settings::RECOVERY_CODE_LEN);
+        assert_eq!(recovery.quorum, 2);
+        assert!(recovery.approvals.is_empty());
+        assert!(recovery.completed_at.is_none());
+        assert!(recovery.expires_at >= before + Duration::from_secs(60));
+        assert!(recovery.expires_at <= after + Duration::from_secs(60));
+        assert!(recovery.is_pending());
+        assert!(!recovery.is_approved());
+    }
+
+    #[test]
+    fn recovery_approve_should_not_fail() {
+        let mut recovery = new_recovery(2);
+        assert!(!recovery.approve(&new_contact(1)).unwrap());
+        assert!(!recovery.approve(&new_contact(1)).unwrap(), "approving twice must count once");
+        assert!(recovery.approve(&new_contact(2)).unwrap());
+        assert_eq!(recovery.approvals, vec![1, 2]);
+        assert!(recovery.is_approved());
+    }
+
+    #[test]
+    fn recovery_approve_should_fail() {
+        let mut recovery = new_recovery(1);
+        let mut stranger = new_contact(1);
+        stranger.user = 1000;
+        assert!(recovery.approve(&stranger).is_err());
+
+        recovery.expires_at = SystemTime::now() - Duration::from_secs(1);
+        assert!(recovery.approve(&new_contact(2)).is_err());
+        assert!(recovery.approvals.is_empty());
+    }
+
+    #[test]
+    fn recovery_complete_should_not_fail() {
+        let mut recovery = new_recovery(1);
+        recovery.approve(&new_contact(1)).unwrap();
+
+        let before = SystemTime::now();
+        assert!(recovery.complete().is_ok());
+        let after = SystemTime::now();
+
+        let time = recovery.completed_at.unwrap();
+        assert!(time >= before && time <= after);
+        assert!(!recovery.is_pending());
+        assert!(recovery.complete().is_err(), "recoveries must be completed once");
+    }
+
+    #[test]
+    fn recovery_complete_should_fail() {
+        let mut recovery = new_recovery(2);
+        recovery.approve(&new_contact(1)).unwrap();
+        assert!(recovery.complete().is_err());
+
+        recovery.approve(&new_contact(2)).unwrap();
+        recovery.expires_at = SystemTime::now() - Duration::from_secs(1);
+        assert!(recovery.complete().is_err(), "expired recoveries must not be completed");
+    }
+
+    #[test]
+    fn approval_token_new_should_not_fail() {
+        let recovery = new_recovery(2);
+        let contact = new_contact(1);
+
+        let before = SystemTime::now();
+        let claim = ApprovalToken::new(&recovery, &contact);
+        let after = SystemTime::now();
+
+        assert_eq!(claim.exp, unix_timestamp(recovery.expires_at));
+        assert!(claim.iat >= before && claim.iat <= after);
+        assert_eq!(claim.iss, "tpauth.alvidir.com");
+        assert_eq!(claim.sub, recovery.user);
+        assert_eq!(claim.recovery, recovery.id);
+        assert_eq!(claim.contact, contact.id);
+    }
+}
@@ -0,0 +1,471 @@
+use std::error::Error;
+use std::time::SystemTime;
+use tonic::{Request, Response, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::logging;
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::{contacts, recoveries, metadata};
+use crate::pii;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use crate::tenant::framework::get_tenant;
+use crate::ratelimit::framework::rate_limit;
+use super::domain::{Contact, ContactRepository, Recovery, RecoveryRepository};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("recovery");
+}
+
+// Proto generated server traits
+use proto::recovery_service_server::RecoveryService;
+pub use proto::recovery_service_server::RecoveryServiceServer;
+
+// Proto message structs
+use proto::{ContactList, RecoveryRequest, RecoveryResponse, CompleteRequest, CompleteResponse};
+
+pub struct RecoveryServiceImplementation;
+
+#[tonic::async_trait]
+impl RecoveryService for RecoveryServiceImplementation {
+    async fn list_contacts(&self, request: Request<()>) -> Result<Response<ContactList>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        match super::application::recovery_list_contacts(token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(all_contacts) => Ok(Response::new(
+                ContactList {
+                    emails: all_contacts.iter().map(|contact| contact.get_email().to_string()).collect(),
+                }
+            )),
+        }
+    }
+
+    async fn set_contacts(&self, request: Request<ContactList>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::recovery_set_contacts(&token, &msg_ref.emails) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn start_recovery(&self, request: Request<RecoveryRequest>) -> Result<Response<RecoveryResponse>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "recovery.start", Some(&request.get_ref().email))?;
+        let tenant = get_tenant(&request)?;
+        let msg_ref = request.into_inner();
+
+        match super::application::recovery_start(&tenant, &msg_ref.email) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(recovery_code) => Ok(Response::new(
+                RecoveryResponse {
+                    code: recovery_code,
+                }
+            )),
+        }
+    }
+
+    async fn approve_recovery(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        if let Err(err) = super::application::recovery_approve(token) {
+            return Err(Status::aborted(err.to_string()));
+        }
+
+        Ok(Response::new(()))
+    }
+
+    async fn complete_recovery(&self, request: Request<CompleteRequest>) -> Result<Response<CompleteResponse>, Status> {
+        rate_limit(&request, "recovery.complete", None)?;
+        let tenant = get_tenant(&request)?;
+        let msg_ref = request.into_inner();
+
+        match super::application::recovery_complete(&tenant, &msg_ref.code) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(reset_token) => Ok(Response::new(
+                CompleteResponse {
+                    token: reset_token,
+                }
+            )),
+        }
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[table_name = "contacts"]
+struct PostgresContact {
+    pub id: i32,
+    pub user_id: i32,
+    pub email: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "contacts"]
+struct NewPostgresContact<'a> {
+    pub user_id: i32,
+    pub email: &'a str,
+    pub meta_id: i32,
+}
+
+pub struct PostgresContactRepository;
+
+impl PostgresContactRepository {
+    fn create_on_conn(conn: &PgConnection, contact: &mut Contact, sealed_email: &str) -> Result<(), PgError>  {
+        // in order to create a contact it must exists the metadata for this contact
+        PostgresMetadataRepository::create_on_conn(conn, &mut contact.meta)?;
+
+        let new_contact = NewPostgresContact {
+            user_id: contact.user,
+            email: sealed_email,
+            meta_id: contact.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(contacts::table)
+            .values(&new_contact)
+            .get_result::<PostgresContact>(conn)?;
+
+        contact.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, contact: &Contact) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            contacts::table.filter(contacts::id.eq(contact.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &contact.meta)?;
+        Ok(())
+    }
+}
+
+impl ContactRepository for PostgresContactRepository {
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Contact>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            contacts::table.filter(contacts::user_id.eq(target_user))
+                           .order(contacts::id.asc())
+                           .load::<PostgresContact>(&connection)?
+        };
+
+        let mut all_contacts = Vec::new();
+        for result in results.iter() {
+            all_contacts.push(Contact{
+                id: result.id,
+                user: result.user_id,
+                email: pii::decrypt(&result.email)?,
+                meta: get_meta_repository().find(result.meta_id)?,
+            });
+        }
+
+        Ok(all_contacts)
+    }
+
+    fn create(&self, contact: &mut Contact) -> Result<(), Box<dyn Error>> {
+        let sealed_email = pii::encrypt(&contact.email)?;
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresContactRepository::create_on_conn(&conn, contact, &sealed_email))?;
+        Ok(())
+    }
+
+    fn save(&self, contact: &Contact) -> Result<(), Box<dyn Error>> {
+        let pg_contact = PostgresContact {
+            id: contact.id,
+            user_id: contact.user,
+            email: pii::encrypt(&contact.email)?,
+            meta_id: contact.meta.get_id(),
+        };
+
+        let connection = get_connection().get()?;
+        diesel::update(contacts::table)
+            .filter(contacts::id.eq(contact.id))
+            .set(&pg_contact)
+            .execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete(&self, contact: &Contact) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresContactRepository::delete_on_conn(&conn, contact))?;
+        Ok(())
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[changeset_options(treat_none_as_null = "true")]
+#[table_name = "recoveries"]
+struct PostgresRecovery {
+    pub id: i32,
+    pub user_id: i32,
+    pub code: String,
+    pub quorum: i32,
+    pub approvals: String,
+    pub expires_at: SystemTime,
+    pub completed_at: Option<SystemTime>,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "recoveries"]
+struct NewPostgresRecovery<'a> {
+    pub user_id: i32,
+    pub code: &'a str,
+    pub quorum: i32,
+    pub approvals: &'a str,
+    pub expires_at: SystemTime,
+    pub meta_id: i32,
+}
+
+// approvals are kept as the ids of the contacts having approved, separated by whitespaces
+fn join_approvals(approvals: &[i32]) -> String {
+    approvals.iter().map(|contact| contact.to_string()).collect::<Vec<String>>().join(" ")
+}
+
+pub struct PostgresRecoveryRepository;
+
+impl PostgresRecoveryRepository {
+    fn create_on_conn(conn: &PgConnection, recovery: &mut Recovery) -> Result<(), PgError>  {
+        // in order to create a recovery it must exists the metadata for this recovery
+        PostgresMetadataRepository::create_on_conn(conn, &mut recovery.meta)?;
+
+        let joined_approvals = join_approvals(&recovery.approvals);
+        let new_recovery = NewPostgresRecovery {
+            user_id: recovery.user,
+            code: &recovery.code,
+            quorum: recovery.quorum as i32,
+            approvals: &joined_approvals,
+            expires_at: recovery.expires_at,
+            meta_id: recovery.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(recoveries::table)
+            .values(&new_recovery)
+            .get_result::<PostgresRecovery>(conn)?;
+
+        recovery.id = result.id;
+        Ok(())
+    }
+
+    fn build_first(results: &[PostgresRecovery]) -> Result<Recovery, Box<dyn Error>> {
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        let meta = get_meta_repository().find(results[0].meta_id)?;
+        Ok(Recovery{
+            id: results[0].id,
+            user: results[0].user_id,
+            code: results[0].code.clone(),
+            quorum: results[0].quorum as usize,
+            approvals: results[0].approvals.split_whitespace()
+                .filter_map(|contact| contact.parse().ok())
+                .collect(),
+            expires_at: results[0].expires_at,
+            completed_at: results[0].completed_at,
+            meta: meta,
+        })
+    }
+}
+
+impl RecoveryRepository for PostgresRecoveryRepository {
+    fn find(&self, target: i32) -> Result<Recovery, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            recoveries::table.filter(recoveries::id.eq(target))
+                             .load::<PostgresRecovery>(&connection)?
+        };
+
+        PostgresRecoveryRepository::build_first(&results)
+    }
+
+    fn find_by_code(&self, target: &str) -> Result<Recovery, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            recoveries::table.filter(recoveries::code.eq(target))
+                             .load::<PostgresRecovery>(&connection)?
+        };
+
+        PostgresRecoveryRepository::build_first(&results)
+    }
+
+    fn create(&self, recovery: &mut Recovery) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresRecoveryRepository::create_on_conn(&conn, recovery))?;
+        Ok(())
+    }
+
+    fn save(&self, recovery: &Recovery) -> Result<(), Box<dyn Error>> {
+        let pg_recovery = PostgresRecovery {
+            id: recovery.id,
+            user_id: recovery.user,
+            code: recovery.code.clone(),
+            quorum: recovery.quorum as i32,
+            approvals: join_approvals(&recovery.approvals),
+            expires_at: recovery.expires_at,
+            completed_at: recovery.completed_at,
+            meta_id: recovery.meta.get_id(),
+        };
+
+        let connection = get_connection().get()?;
+        diesel::update(recoveries::table)
+            .filter(recoveries::id.eq(recovery.id))
+            .set(&pg_recovery)
+            .execute(&connection)?;
+
+        Ok(())
+    }
+
+    fn delete_stale(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        let deleted = conn.transaction::<_, PgError, _>(|| {
+            let stale = recoveries::table.filter(recoveries::completed_at.is_not_null()
+                                                 .or(recoveries::expires_at.le(now)))
+                                         .select((recoveries::id, recoveries::meta_id))
+                                         .limit(limit as i64)
+                                         .load::<(i32, i32)>(&conn)?;
+
+            let (ids, meta_ids): (Vec<i32>, Vec<i32>) = stale.into_iter().unzip();
+            diesel::delete(recoveries::table.filter(recoveries::id.eq_any(&ids))).execute(&conn)?;
+            diesel::delete(metadata::table.filter(metadata::id.eq_any(&meta_ids))).execute(&conn)?;
+            Ok(ids.len())
+        })?;
+
+        Ok(deleted)
+    }
+}
+
+
+pub struct InMemoryContactRepository {
+    table: memory::Table<Contact>,
+}
+
+impl InMemoryContactRepository {
+    pub fn new() -> Self {
+        InMemoryContactRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl ContactRepository for InMemoryContactRepository {
+    fn find_all_by_user(&self, target_user: i32) -> Result<Vec<Contact>, Box<dyn Error>>  {
+        let mut all_contacts = self.table.find_all(|contact| contact.user == target_user)?;
+        all_contacts.sort_by_key(|contact| contact.id);
+        Ok(all_contacts)
+    }
+
+    fn create(&self, contact: &mut Contact) -> Result<(), Box<dyn Error>> {
+        // in order to create a contact it must exists the metadata for this contact
+        get_meta_repository().create(&mut contact.meta)?;
+
+        let (target_user, target) = (contact.user, contact.email.clone());
+        self.table.insert(contact,
+                          |existing| existing.user == target_user && existing.email == target,
+                          |contact, new_id| contact.id = new_id)
+    }
+
+    fn save(&self, contact: &Contact) -> Result<(), Box<dyn Error>> {
+        self.table.update(contact.id, contact)
+    }
+
+    fn delete(&self, contact: &Contact) -> Result<(), Box<dyn Error>> {
+        self.table.delete(contact.id)?;
+        get_meta_repository().delete(&contact.meta)
+    }
+}
+
+
+pub struct InMemoryRecoveryRepository {
+    table: memory::Table<Recovery>,
+}
+
+impl InMemoryRecoveryRepository {
+    pub fn new() -> Self {
+        InMemoryRecoveryRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl RecoveryRepository for InMemoryRecoveryRepository {
+    fn find(&self, target: i32) -> Result<Recovery, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_by_code(&self, target: &str) -> Result<Recovery, Box<dyn Error>>  {
+        self.table.find_first(|recovery| recovery.code == target)
+    }
+
+    fn create(&self, recovery: &mut Recovery) -> Result<(), Box<dyn Error>> {
+        // in order to create a recovery it must exists the metadata for this recovery
+        get_meta_repository().create(&mut recovery.meta)?;
+
+        let target = recovery.code.clone();
+        self.table.insert(recovery,
+                          |existing| existing.code == target,
+                          |recovery, new_id| recovery.id = new_id)
+    }
+
+    fn save(&self, recovery: &Recovery) -> Result<(), Box<dyn Error>> {
+        self.table.update(recovery.id, recovery)
+    }
+
+    fn delete_stale(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>> {
+        let stale = self.table.find_all(|recovery| recovery.completed_at.is_some() || recovery.expires_at <= now)?;
+        for recovery in stale.iter().take(limit) {
+            self.table.delete(recovery.id)?;
+            get_meta_repository().delete(&recovery.meta)?;
+        }
+
+        Ok(stale.len().min(limit))
+    }
+}
@@ -0,0 +1,31 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref CONTACT_REPO_PROVIDER: Box<dyn domain::ContactRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresContactRepository),
+            Backend::Memory => Box::new(framework::InMemoryContactRepository::new()),
+            backend => storage::unsupported(backend, "trusted contacts"),
+        }
+    };
+
+    static ref RECOVERY_REPO_PROVIDER: Box<dyn domain::RecoveryRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresRecoveryRepository),
+            Backend::Memory => Box::new(framework::InMemoryRecoveryRepository::new()),
+            backend => storage::unsupported(backend, "recoveries"),
+        }
+    };
+}
+
+pub fn get_contact_repository() -> Box<&'static dyn domain::ContactRepository> {
+    Box::new(&**CONTACT_REPO_PROVIDER)
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::RecoveryRepository> {
+    Box::new(&**RECOVERY_REPO_PROVIDER)
+}
@@ -4,7 +4,11 @@ use std::error::Error;
 // include '+' into charset before '@' in order to allow sufixed emails
 pub const EMAIL: &str = r"^[a-zA-Z0-9._-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,63}$";
 pub const BASE64: &str = r"\b[A-Fa-f0-9]{8, 64}\b";
+pub const SCOPE: &str = r"^[a-z_]{1,32}$";
+pub const TENANT: &str = r"^[a-z0-9-]{1,64}$";
 pub const URL: &str = r#"https?://(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,32}/?$"#;
+pub const COLOR: &str = r"^#[0-9a-fA-F]{6}$";
+pub const PHONE: &str = r"^\+[1-9][0-9]{6,14}$"; // e.164: up to 15 digits, country code included
 
 const ERR_REGEX_NOT_MATCH: &str = "regex does not match";
 
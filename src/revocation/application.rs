@@ -0,0 +1,152 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+
+use crate::constants::{errors, settings};
+use crate::time;
+use super::domain::{Revocation, BloomFilter, RevocationFilter};
+use super::{get_repository, FILTER};
+
+/// Records the session with the given id as revoked for the given reason until the given deadline, by when all its
+/// tokens have expired
+pub fn revocation_record(sid: &str, expires_at: SystemTime, reason: &str) -> Result<(), Box<dyn Error>> {
+    let mut revocation = Revocation::new(sid, expires_at, reason);
+    get_repository().create(&mut revocation)?;
+
+    // the revocation is known by this instance right away, while the others get to know it by their next refresh
+    match FILTER.write() {
+        Ok(mut filter) => if let Some(filter) = filter.as_mut() {
+            filter.bloom.insert(sid);
+        },
+        Err(err) => {
+            error!("write lock for revocation filter got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    Ok(())
+}
+
+/// Returns whether the session with the given id has been revoked. Sessions the filter tells have certainly not been
+/// revoked, which are almost all of them, are checked with no request to the repository at all
+pub fn revocation_check(sid: &str) -> Result<bool, Box<dyn Error>> {
+    match FILTER.read() {
+        Ok(filter) => if let Some(filter) = filter.as_ref() {
+            if !filter.bloom.might_contain(sid) {
+                return Ok(false);
+            }
+        },
+        Err(err) => {
+            error!("read lock for revocation filter got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    get_repository().exists(sid)
+}
+
+/// Returns why the session with the given id has been revoked, if it has been and its reason is known
+pub fn revocation_reason(sid: &str) -> Result<Option<String>, Box<dyn Error>> {
+    let revocation = match get_repository().find_by_sid(sid) {
+        Ok(revocation) => revocation,
+        Err(err) if err.to_string() == errors::NOT_FOUND => return Ok(None),
+        Err(err) => return Err(err),
+    };
+
+    match revocation.get_reason() {
+        "" => Ok(None),
+        reason => Ok(Some(reason.to_string())),
+    }
+}
+
+/// Pulls all the revocations recorded since the latest refresh into the filter, returning how many there were. Once
+/// the filter is saturated or has not been rebuilt for a while, the expired revocations get purged and the filter
+/// rebuilt from scratch instead, since bloom filters cannot forget any item
+pub fn revocation_refresh() -> Result<usize, Box<dyn Error>> {
+    let rebuild = match FILTER.read() {
+        Ok(filter) => match filter.as_ref() {
+            Some(filter) => filter.bloom.is_saturated() || filter.built_at.elapsed()
+                .map(|elapsed| elapsed >= Duration::from_secs(settings::REVOCATION_REBUILD))
+                .unwrap_or(true),
+            None => true,
+        },
+        Err(err) => {
+            error!("read lock for revocation filter got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    if rebuild {
+        return revocation_rebuild();
+    }
+
+    let cursor = match FILTER.read() {
+        Ok(filter) => filter.as_ref().map(|filter| filter.cursor).unwrap_or_default(),
+        Err(err) => {
+            error!("read lock for revocation filter got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let revocations = pull_after(cursor)?;
+    match FILTER.write() {
+        Ok(mut filter) => if let Some(filter) = filter.as_mut() {
+            for revocation in revocations.iter() {
+                filter.bloom.insert(revocation.get_sid());
+                filter.cursor = filter.cursor.max(revocation.get_id());
+            }
+        },
+        Err(err) => {
+            error!("write lock for revocation filter got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    Ok(revocations.len())
+}
+
+// returns all the revocations recorded after the one with the given id, batch by batch
+fn pull_after(mut cursor: i32) -> Result<Vec<Revocation>, Box<dyn Error>> {
+    let mut all_revocations = Vec::new();
+    loop {
+        let batch = get_repository().find_after(cursor, settings::REVOCATION_BATCH)?;
+        let full = batch.len() as u64 == settings::REVOCATION_BATCH;
+        if let Some(last) = batch.last() {
+            cursor = last.get_id();
+        }
+
+        all_revocations.extend(batch);
+        if !full {
+            return Ok(all_revocations);
+        }
+    }
+}
+
+fn revocation_rebuild() -> Result<usize, Box<dyn Error>> {
+    let purged = get_repository().delete_expired(time::now())?;
+    if purged > 0 {
+        info!("{} expired revocations have been purged", purged);
+    }
+
+    let revocations = pull_after(0)?;
+    let capacity = settings::REVOCATION_CAPACITY.max(revocations.len() * 2);
+    let mut bloom = BloomFilter::new(capacity, settings::REVOCATION_FP_RATE);
+    for revocation in revocations.iter() {
+        bloom.insert(revocation.get_sid());
+    }
+
+    let filter = RevocationFilter {
+        bloom: bloom,
+        cursor: revocations.last().map(Revocation::get_id).unwrap_or_default(),
+        built_at: time::now(),
+    };
+
+    match FILTER.write() {
+        Ok(mut current) => *current = Some(filter),
+        Err(err) => {
+            error!("write lock for revocation filter got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    Ok(revocations.len())
+}
@@ -0,0 +1,160 @@
+use std::error::Error;
+use std::collections::hash_map::DefaultHasher;
+use std::hash::{Hash, Hasher};
+use std::time::SystemTime;
+use crate::time;
+
+pub trait RevocationRepository {
+    // returns up to limit revocations recorded after the one with the given id, the oldest first
+    fn find_after(&self, id: i32, limit: u64) -> Result<Vec<Revocation>, Box<dyn Error>>;
+    // returns whether the session with the given id has been revoked while its tokens have not expired yet
+    fn exists(&self, sid: &str) -> Result<bool, Box<dyn Error>>;
+    // returns the latest revocation of the session with the given id whose tokens have not expired yet
+    fn find_by_sid(&self, sid: &str) -> Result<Revocation, Box<dyn Error>>;
+    fn create(&self, revocation: &mut Revocation) -> Result<(), Box<dyn Error>>;
+    // removes all the revocations whose tokens have expired by the given time, returning how many there were
+    fn delete_expired(&self, now: SystemTime) -> Result<usize, Box<dyn Error>>;
+}
+
+/// A session whose tokens must be rejected until they expire, even if the session is still known somewhere else, such
+/// as by a region the revocation has not been replicated to yet
+#[derive(Clone)]
+pub struct Revocation {
+    pub(super) id: i32,
+    pub(super) sid: String,
+    pub(super) revoked_at: SystemTime,
+    pub(super) expires_at: SystemTime, // by then, all the tokens of the session have expired
+    pub(super) reason: String,         // why the session has been closed, empty if unknown
+}
+
+impl Revocation {
+    pub fn new(sid: &str, expires_at: SystemTime, reason: &str) -> Self {
+        Revocation {
+            id: 0,
+            sid: sid.to_string(),
+            revoked_at: time::now(),
+            expires_at: expires_at,
+            reason: reason.to_string(),
+        }
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_sid(&self) -> &str {
+        &self.sid
+    }
+
+    pub fn get_reason(&self) -> &str {
+        &self.reason
+    }
+
+    pub fn is_expired(&self) -> bool {
+        self.expires_at <= time::now()
+    }
+}
+
+/// A probabilistic set of session ids telling, with no false negatives, whether a session may have been revoked, so
+/// only the sessions it may contain get looked up in the revocation store
+pub struct BloomFilter {
+    bits: Vec<u64>,
+    hashes: u32,
+    capacity: usize,
+    len: usize,
+}
+
+impl BloomFilter {
+    /// Returns an empty filter with room for the given items at the given false positive rate, from 0 to 1
+    pub fn new(capacity: usize, fp_rate: f64) -> Self {
+        let capacity = capacity.max(1);
+        let ln2 = std::f64::consts::LN_2;
+        let bits = (-(capacity as f64) * fp_rate.ln() / (ln2 * ln2)).ceil().max(64.0) as usize;
+        let hashes = ((bits as f64 / capacity as f64) * ln2).round().max(1.0) as u32;
+
+        BloomFilter {
+            bits: vec![0; (bits + 63) / 64],
+            hashes: hashes,
+            capacity: capacity,
+            len: 0,
+        }
+    }
+
+    // the positions of the given item, by double hashing
+    fn positions<'a>(&'a self, item: &str) -> impl Iterator<Item = usize> + 'a {
+        let hash = |seed: u64| {
+            let mut hasher = DefaultHasher::new();
+            seed.hash(&mut hasher);
+            item.hash(&mut hasher);
+            hasher.finish()
+        };
+
+        let (h1, h2) = (hash(0), hash(1) | 1);
+        let size = (self.bits.len() * 64) as u64;
+        (0..self.hashes as u64).map(move |i| (h1.wrapping_add(i.wrapping_mul(h2)) % size) as usize)
+    }
+
+    pub fn insert(&mut self, item: &str) {
+        let positions: Vec<usize> = self.positions(item).collect();
+        for position in positions {
+            self.bits[position / 64] |= 1 << (position % 64);
+        }
+
+        self.len += 1;
+    }
+
+    /// Returns false if the given item has certainly not been inserted, true if it may have been
+    pub fn might_contain(&self, item: &str) -> bool {
+        self.positions(item).all(|position| self.bits[position / 64] & (1 << (position % 64)) != 0)
+    }
+
+    pub fn len(&self) -> usize {
+        self.len
+    }
+
+    /// Returns whether the filter holds more items than it was sized for, so its false positive rate is higher than
+    /// the expected one
+    pub fn is_saturated(&self) -> bool {
+        self.len > self.capacity
+    }
+}
+
+/// All the revocations an instance knows about, up to the one with the latest id, so the next refresh only pulls the
+/// ones recorded after it
+pub struct RevocationFilter {
+    pub(super) bloom: BloomFilter,
+    pub(super) cursor: i32,
+    pub(super) built_at: SystemTime,
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::BloomFilter;
+
+    #[test]
+    fn bloom_filter_should_not_fail() {
+        let mut bloom = BloomFilter::new(1000, 0.001);
+        for i in 0..1000 {
+            bloom.insert(&format!("sid-{}", i));
+        }
+
+        assert_eq!(1000, bloom.len());
+        assert!(!bloom.is_saturated());
+        assert!((0..1000).all(|i| bloom.might_contain(&format!("sid-{}", i))));
+
+        // the false positive rate may differ from the expected one, but never by an order of magnitude
+        let positives = (0..10000).filter(|i| bloom.might_contain(&format!("other-{}", i))).count();
+        assert!(positives < 100, "{} false positives out of 10000", positives);
+
+        bloom.insert("sid-1000");
+        assert!(bloom.is_saturated());
+    }
+
+    #[test]
+    fn bloom_filter_empty_should_not_fail() {
+        let bloom = BloomFilter::new(0, 0.001);
+        assert!(!bloom.might_contain("sid"));
+        assert_eq!(0, bloom.len());
+    }
+}
@@ -0,0 +1,197 @@
+use std::error::Error;
+use std::time::SystemTime;
+
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::constants::errors;
+use crate::schema::revocations;
+use crate::time;
+use super::domain::{Revocation, RevocationRepository};
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(Clone)]
+#[table_name = "revocations"]
+struct PostgresRevocation {
+    pub id: i32,
+    pub sid: String,
+    pub revoked_at: SystemTime,
+    pub expires_at: SystemTime,
+    pub reason: String,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "revocations"]
+struct NewPostgresRevocation<'a> {
+    pub sid: &'a str,
+    pub revoked_at: SystemTime,
+    pub expires_at: SystemTime,
+    pub reason: &'a str,
+}
+
+pub struct PostgresRevocationRepository;
+
+impl PostgresRevocationRepository {
+    fn build(result: &PostgresRevocation) -> Revocation {
+        Revocation {
+            id: result.id,
+            sid: result.sid.clone(),
+            revoked_at: result.revoked_at,
+            expires_at: result.expires_at,
+            reason: result.reason.clone(),
+        }
+    }
+}
+
+impl RevocationRepository for PostgresRevocationRepository {
+    fn find_after(&self, id: i32, limit: u64) -> Result<Vec<Revocation>, Box<dyn Error>> {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            revocations::table.filter(revocations::id.gt(id))
+                              .order(revocations::id.asc())
+                              .limit(limit as i64)
+                              .load::<PostgresRevocation>(&connection)?
+        };
+
+        Ok(results.iter().map(PostgresRevocationRepository::build).collect())
+    }
+
+    fn exists(&self, sid: &str) -> Result<bool, Box<dyn Error>> {
+        let connection = get_connection().get()?;
+        let count = revocations::table.filter(revocations::sid.eq(sid))
+                                      .filter(revocations::expires_at.gt(time::now()))
+                                      .count()
+                                      .get_result::<i64>(&connection)?;
+
+        Ok(count > 0)
+    }
+
+    fn find_by_sid(&self, sid: &str) -> Result<Revocation, Box<dyn Error>> {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            revocations::table.filter(revocations::sid.eq(sid))
+                              .filter(revocations::expires_at.gt(time::now()))
+                              .order(revocations::id.desc())
+                              .limit(1)
+                              .load::<PostgresRevocation>(&connection)?
+        };
+
+        match results.first() {
+            Some(result) => Ok(PostgresRevocationRepository::build(result)),
+            None => Err(errors::NOT_FOUND.into()),
+        }
+    }
+
+    fn create(&self, revocation: &mut Revocation) -> Result<(), Box<dyn Error>> {
+        let new_revocation = NewPostgresRevocation {
+            sid: &revocation.sid,
+            revoked_at: revocation.revoked_at,
+            expires_at: revocation.expires_at,
+            reason: &revocation.reason,
+        };
+
+        let result = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            diesel::insert_into(revocations::table)
+                .values(&new_revocation)
+                .get_result::<PostgresRevocation>(&connection)?
+        };
+
+        revocation.id = result.id;
+        Ok(())
+    }
+
+    fn delete_expired(&self, now: SystemTime) -> Result<usize, Box<dyn Error>> {
+        let connection = get_connection().get()?;
+        let deleted = diesel::delete(revocations::table.filter(revocations::expires_at.le(now)))
+            .execute(&connection)?;
+
+        Ok(deleted)
+    }
+}
+
+pub struct InMemoryRevocationRepository {
+    table: memory::Table<Revocation>,
+}
+
+impl InMemoryRevocationRepository {
+    pub fn new() -> Self {
+        InMemoryRevocationRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl RevocationRepository for InMemoryRevocationRepository {
+    fn find_after(&self, id: i32, limit: u64) -> Result<Vec<Revocation>, Box<dyn Error>> {
+        // rows are sorted by id
+        let after = self.table.find_all(|revocation| revocation.id > id)?;
+        Ok(after.into_iter().take(limit as usize).collect())
+    }
+
+    fn exists(&self, sid: &str) -> Result<bool, Box<dyn Error>> {
+        let found = self.table.find_all(|revocation| revocation.sid == sid && !revocation.is_expired())?;
+        Ok(found.len() > 0)
+    }
+
+    fn find_by_sid(&self, sid: &str) -> Result<Revocation, Box<dyn Error>> {
+        let found = self.table.find_all(|revocation| revocation.sid == sid && !revocation.is_expired())?;
+        found.into_iter().last().ok_or_else(|| errors::NOT_FOUND.into())
+    }
+
+    fn create(&self, revocation: &mut Revocation) -> Result<(), Box<dyn Error>> {
+        self.table.insert(revocation, |_| false, |revocation, new_id| revocation.id = new_id)
+    }
+
+    fn delete_expired(&self, now: SystemTime) -> Result<usize, Box<dyn Error>> {
+        self.table.delete_all(|revocation| revocation.expires_at <= now)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use super::InMemoryRevocationRepository;
+    use super::super::domain::{Revocation, RevocationRepository};
+
+    #[test]
+    fn in_memory_find_after_should_not_fail() {
+        let repo = InMemoryRevocationRepository::new();
+        let deadline = SystemTime::now() + Duration::from_secs(60);
+        for sid in &["sid-1", "sid-2", "sid-3"] {
+            repo.create(&mut Revocation::new(sid, deadline, "user")).unwrap();
+        }
+
+        let after = repo.find_after(1, 10).unwrap();
+        assert_eq!(vec!["sid-2", "sid-3"], after.iter().map(Revocation::get_sid).collect::<Vec<&str>>());
+        assert_eq!(1, repo.find_after(0, 1).unwrap().len());
+        assert!(repo.exists("sid-1").unwrap());
+        assert!(!repo.exists("sid-4").unwrap());
+    }
+
+    #[test]
+    fn in_memory_find_by_sid_should_not_fail() {
+        let repo = InMemoryRevocationRepository::new();
+        let deadline = SystemTime::now() + Duration::from_secs(60);
+        repo.create(&mut Revocation::new("sid-1", deadline, "user")).unwrap();
+        repo.create(&mut Revocation::new("sid-1", deadline, "admin")).unwrap();
+
+        assert_eq!("admin", repo.find_by_sid("sid-1").unwrap().get_reason());
+        assert!(repo.find_by_sid("sid-2").is_err());
+    }
+
+    #[test]
+    fn in_memory_delete_expired_should_not_fail() {
+        let repo = InMemoryRevocationRepository::new();
+        let now = SystemTime::now();
+        repo.create(&mut Revocation::new("expired", now - Duration::from_secs(1), "")).unwrap();
+        repo.create(&mut Revocation::new("alive", now + Duration::from_secs(60), "")).unwrap();
+
+        assert!(!repo.exists("expired").unwrap());
+        assert_eq!(1, repo.delete_expired(now).unwrap());
+        assert!(repo.exists("alive").unwrap());
+    }
+}
@@ -0,0 +1,23 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::sync::RwLock;
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::RevocationRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresRevocationRepository),
+            Backend::Memory => Box::new(framework::InMemoryRevocationRepository::new()),
+            backend => storage::unsupported(backend, "revocations"),
+        }
+    };
+
+    // none until the first refresh, so every check goes to the repository meanwhile
+    static ref FILTER: RwLock<Option<domain::RevocationFilter>> = RwLock::new(None);
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::RevocationRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
@@ -1,9 +1,175 @@
+table! {
+    apikeys (id) {
+        id -> Int4,
+        user_id -> Int4,
+        name -> Varchar,
+        prefix -> Varchar,
+        hash -> Varchar,
+        scopes -> Varchar,
+        last_used_at -> Nullable<Timestamp>,
+        meta_id -> Int4,
+        tenant_id -> Int4,
+        certificate -> Nullable<Varchar>,
+    }
+}
+
 table! {
     apps (id) {
         id -> Int4,
         url -> Varchar,
         secret_id -> Int4,
         meta_id -> Int4,
+        tenant_id -> Int4,
+        brand_name -> Nullable<Varchar>,
+        logo_url -> Nullable<Varchar>,
+        primary_color -> Nullable<Varchar>,
+        accent_color -> Nullable<Varchar>,
+        support_url -> Nullable<Varchar>,
+        support_email -> Nullable<Varchar>,
+    }
+}
+
+table! {
+    attributes (id) {
+        id -> Int4,
+        user_id -> Int4,
+        name -> Varchar,
+        value -> Varchar,
+    }
+}
+
+table! {
+    contacts (id) {
+        id -> Int4,
+        user_id -> Int4,
+        email -> Varchar,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    credentials (id) {
+        id -> Int4,
+        user_id -> Int4,
+        name -> Varchar,
+        public_key -> Varchar,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    deliveries (id) {
+        id -> Int4,
+        webhook_id -> Int4,
+        event_id -> Varchar,
+        topic -> Varchar,
+        payload -> Text,
+        status -> Varchar,
+        attempts -> Int4,
+        response -> Int4,
+        error -> Varchar,
+        next_at -> Timestamp,
+        created_at -> Timestamp,
+        touch_at -> Timestamp,
+    }
+}
+
+table! {
+    devices (id) {
+        id -> Int4,
+        user_id -> Int4,
+        fingerprint -> Varchar,
+        name -> Varchar,
+        trusted_at -> Nullable<Timestamp>,
+        last_seen_at -> Timestamp,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    directories (id) {
+        id -> Int4,
+        user_id -> Int4,
+        app_id -> Int4,
+        created_at -> Timestamp,
+        touch_at -> Timestamp,
+    }
+}
+
+table! {
+    emails (id) {
+        id -> Int4,
+        user_id -> Int4,
+        email -> Varchar,
+        email_hash -> Nullable<Varchar>,
+    }
+}
+
+table! {
+    events (id) {
+        id -> Int4,
+        user_id -> Int4,
+        issuer -> Int4,
+        kind -> Varchar,
+        reason -> Varchar,
+        created_at -> Timestamp,
+        touch_at -> Timestamp,
+        published_at -> Nullable<Timestamp>,
+        app -> Varchar,
+        ip -> Varchar,
+    }
+}
+
+table! {
+    group_members (id) {
+        id -> Int4,
+        group_id -> Int4,
+        user_id -> Int4,
+    }
+}
+
+table! {
+    groups (id) {
+        id -> Int4,
+        tenant_id -> Int4,
+        name -> Varchar,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    identities (id) {
+        id -> Int4,
+        tenant_id -> Int4,
+        user_id -> Int4,
+        provider -> Varchar,
+        subject -> Varchar,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    invitations (id) {
+        id -> Int4,
+        code -> Varchar,
+        email -> Varchar,
+        issuer -> Int4,
+        admin -> Bool,
+        expires_at -> Timestamp,
+        used_at -> Nullable<Timestamp>,
+        meta_id -> Int4,
+        tenant_id -> Int4,
+    }
+}
+
+table! {
+    iprules (id) {
+        id -> Int4,
+        cidr -> Varchar,
+        action -> Varchar,
+        scope -> Varchar,
+        apikey_id -> Nullable<Int4>,
+        meta_id -> Int4,
     }
 }
 
@@ -15,6 +181,49 @@ table! {
     }
 }
 
+table! {
+    policies (id) {
+        id -> Int4,
+        kind -> Varchar,
+        version -> Int4,
+        url -> Varchar,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    recoveries (id) {
+        id -> Int4,
+        user_id -> Int4,
+        code -> Varchar,
+        quorum -> Int4,
+        approvals -> Varchar,
+        expires_at -> Timestamp,
+        completed_at -> Nullable<Timestamp>,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    reserved_names (id) {
+        id -> Int4,
+        tenant_id -> Int4,
+        word -> Varchar,
+        kind -> Varchar,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    revocations (id) {
+        id -> Int4,
+        sid -> Varchar,
+        revoked_at -> Timestamp,
+        expires_at -> Timestamp,
+        reason -> Varchar,
+    }
+}
+
 table! {
     secrets (id) {
         id -> Int4,
@@ -23,6 +232,46 @@ table! {
     }
 }
 
+table! {
+    signing_keys (id) {
+        id -> Int4,
+        secret -> Text,
+        public_key -> Text,
+        state -> Varchar,
+        created_at -> Timestamp,
+        activates_at -> Timestamp,
+    }
+}
+
+table! {
+    templates (id) {
+        id -> Int4,
+        tenant_id -> Int4,
+        kind -> Varchar,
+        version -> Int4,
+        subject -> Text,
+        body -> Text,
+        meta_id -> Int4,
+    }
+}
+
+table! {
+    tenant_settings (id) {
+        id -> Int4,
+        tenant_id -> Int4,
+        name -> Varchar,
+        value -> Varchar,
+    }
+}
+
+table! {
+    tenants (id) {
+        id -> Int4,
+        name -> Varchar,
+        meta_id -> Int4,
+    }
+}
+
 table! {
     users (id) {
         id -> Int4,
@@ -31,18 +280,113 @@ table! {
         verified_at -> Nullable<Timestamp>,
         secret_id -> Nullable<Int4>,
         meta_id -> Int4,
+        suspended_at -> Nullable<Timestamp>,
+        admin -> Bool,
+        deleted_at -> Nullable<Timestamp>,
+        terms_version -> Int4,
+        privacy_version -> Int4,
+        recovery_email -> Nullable<Varchar>,
+        recovery_until -> Nullable<Timestamp>,
+        reset_required_at -> Nullable<Timestamp>,
+        tenant_id -> Int4,
+        email_hash -> Nullable<Varchar>,
+        locale -> Nullable<Varchar>,
+        terms_accepted_at -> Nullable<Timestamp>,
+        privacy_accepted_at -> Nullable<Timestamp>,
+        phone -> Nullable<Varchar>,
+        phone_hash -> Nullable<Varchar>,
+        phone_verified_at -> Nullable<Timestamp>,
+        phone_code -> Nullable<Varchar>,
+        phone_code_until -> Nullable<Timestamp>,
+        username -> Nullable<Varchar>,
+        username_hash -> Nullable<Varchar>,
+        activation_deadline -> Nullable<Timestamp>,
+    }
+}
+
+table! {
+    webhooks (id) {
+        id -> Int4,
+        tenant_id -> Int4,
+        url -> Varchar,
+        secret -> Varchar,
+        topics -> Varchar,
+        meta_id -> Int4,
+        format -> Varchar,
     }
 }
 
+joinable!(apikeys -> metadata (meta_id));
+joinable!(apikeys -> tenants (tenant_id));
+joinable!(apikeys -> users (user_id));
 joinable!(apps -> metadata (meta_id));
 joinable!(apps -> secrets (secret_id));
+joinable!(apps -> tenants (tenant_id));
+joinable!(attributes -> users (user_id));
+joinable!(contacts -> metadata (meta_id));
+joinable!(contacts -> users (user_id));
+joinable!(credentials -> metadata (meta_id));
+joinable!(credentials -> users (user_id));
+joinable!(deliveries -> webhooks (webhook_id));
+joinable!(devices -> metadata (meta_id));
+joinable!(devices -> users (user_id));
+joinable!(directories -> apps (app_id));
+joinable!(directories -> users (user_id));
+joinable!(emails -> users (user_id));
+joinable!(group_members -> groups (group_id));
+joinable!(group_members -> users (user_id));
+joinable!(groups -> metadata (meta_id));
+joinable!(groups -> tenants (tenant_id));
+joinable!(identities -> metadata (meta_id));
+joinable!(identities -> tenants (tenant_id));
+joinable!(identities -> users (user_id));
+joinable!(invitations -> metadata (meta_id));
+joinable!(invitations -> tenants (tenant_id));
+joinable!(invitations -> users (issuer));
+joinable!(iprules -> apikeys (apikey_id));
+joinable!(iprules -> metadata (meta_id));
+joinable!(policies -> metadata (meta_id));
+joinable!(recoveries -> metadata (meta_id));
+joinable!(recoveries -> users (user_id));
+joinable!(reserved_names -> metadata (meta_id));
+joinable!(reserved_names -> tenants (tenant_id));
 joinable!(secrets -> metadata (meta_id));
+joinable!(templates -> metadata (meta_id));
+joinable!(templates -> tenants (tenant_id));
+joinable!(tenant_settings -> tenants (tenant_id));
+joinable!(tenants -> metadata (meta_id));
 joinable!(users -> metadata (meta_id));
 joinable!(users -> secrets (secret_id));
+joinable!(users -> tenants (tenant_id));
+joinable!(webhooks -> metadata (meta_id));
+joinable!(webhooks -> tenants (tenant_id));
 
 allow_tables_to_appear_in_same_query!(
+    apikeys,
     apps,
+    attributes,
+    contacts,
+    credentials,
+    deliveries,
+    devices,
+    directories,
+    emails,
+    events,
+    group_members,
+    groups,
+    identities,
+    invitations,
+    iprules,
     metadata,
+    policies,
+    recoveries,
+    reserved_names,
+    revocations,
     secrets,
+    signing_keys,
+    templates,
+    tenant_settings,
+    tenants,
     users,
+    webhooks,
 );
@@ -0,0 +1,607 @@
+use std::error::Error;
+use std::convert::Infallible;
+use std::net::SocketAddr;
+use hyper::{Body, Method, Server, StatusCode};
+use hyper::header::{AUTHORIZATION, CONTENT_TYPE};
+use hyper::service::{make_service_fn, service_fn};
+use tower::Layer;
+use serde_json::{json, Value};
+
+use crate::constants::{errors, settings};
+use crate::headers::HeadersLayer;
+use crate::user::domain::User;
+use crate::user::application::{
+    user_info_by_id, user_provision, user_find, user_find_by_email, user_list, user_set_active, user_deprovision,
+};
+use crate::group::domain::Group;
+use crate::group::application::{group_create, group_find, group_list, group_save, group_delete};
+use crate::apikey::application::apikey_authenticate;
+
+const SCIM_PATH: &str = "scim";
+const SCIM_VERSION: &str = "v2";
+const SCIM_SCOPE: &str = "scim";
+const SCIM_CONTENT_TYPE: &str = "application/scim+json";
+const BEARER_PREFIX: &str = "Bearer ";
+
+const USER_SCHEMA: &str = "urn:ietf:params:scim:schemas:core:2.0:User";
+const GROUP_SCHEMA: &str = "urn:ietf:params:scim:schemas:core:2.0:Group";
+const CONFIG_SCHEMA: &str = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig";
+const LIST_SCHEMA: &str = "urn:ietf:params:scim:api:messages:2.0:ListResponse";
+const PATCH_SCHEMA: &str = "urn:ietf:params:scim:api:messages:2.0:PatchOp";
+const ERROR_SCHEMA: &str = "urn:ietf:params:scim:api:messages:2.0:Error";
+
+/// An error as told to scim clients: the http status, the scim type of the error, if any, and its detail
+#[derive(Debug, PartialEq)]
+struct ScimError {
+    status: StatusCode,
+    scim_type: Option<&'static str>,
+    detail: String,
+}
+
+impl ScimError {
+    fn new(status: StatusCode, scim_type: Option<&'static str>, detail: &str) -> Self {
+        ScimError {
+            status: status,
+            scim_type: scim_type,
+            detail: detail.to_string(),
+        }
+    }
+
+    fn bad_request(scim_type: &'static str, detail: &str) -> Self {
+        ScimError::new(StatusCode::BAD_REQUEST, Some(scim_type), detail)
+    }
+
+    fn into_response(self) -> hyper::Response<Body> {
+        let mut body = json!({
+            "schemas": [ERROR_SCHEMA],
+            "status": self.status.as_u16().to_string(),
+            "detail": self.detail,
+        });
+
+        if let Some(scim_type) = self.scim_type {
+            body["scimType"] = scim_type.into();
+        }
+
+        new_response(self.status, &body)
+    }
+}
+
+impl From<Box<dyn Error>> for ScimError {
+    fn from(err: Box<dyn Error>) -> Self {
+        let detail = err.to_string();
+        match detail.as_str() {
+            errors::NOT_FOUND | "Record not found" => ScimError::new(StatusCode::NOT_FOUND, None, &detail),
+            errors::ALREADY_EXISTS => ScimError::new(StatusCode::CONFLICT, Some("uniqueness"), &detail),
+            errors::UNAUTHORIZED | errors::SUSPENDED => ScimError::new(StatusCode::FORBIDDEN, None, &detail),
+            errors::PARSE_FAILED => ScimError::bad_request("invalidValue", &detail),
+            _ if detail.starts_with("duplicate key") => {
+                ScimError::new(StatusCode::CONFLICT, Some("uniqueness"), &detail)
+            },
+            _ => {
+                error!("scim request has failed: {}", detail);
+                ScimError::new(StatusCode::INTERNAL_SERVER_ERROR, None, errors::HAS_FAILED)
+            }
+        }
+    }
+}
+
+type ScimResult = Result<hyper::Response<Body>, ScimError>;
+
+/// A filter of the kind `<attribute> eq <value>`, being the only kind scim clients provisioning accounts rely on
+#[derive(Debug, PartialEq)]
+struct Filter {
+    attribute: String,
+    value: String,
+}
+
+/// Parses the given scim filter, returning none if it is not an equality one
+fn parse_filter(filter: &str) -> Option<Filter> {
+    let mut parts = filter.trim().splitn(3, ' ');
+    let (attribute, operator, value) = (parts.next()?, parts.next()?, parts.next()?.trim());
+    if !operator.eq_ignore_ascii_case("eq") || attribute.len() == 0 {
+        return None;
+    }
+
+    let value = match value.strip_prefix('"') {
+        Some(quoted) => quoted.strip_suffix('"')?.replace("\\\"", "\""),
+        None => value.to_string(),
+    };
+
+    Some(Filter {
+        attribute: attribute.to_string(),
+        value: value,
+    })
+}
+
+/// Decodes the given url-encoded query value
+fn decode_param(value: &str) -> String {
+    let bytes = value.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut index = 0;
+    while index < bytes.len() {
+        match bytes[index] {
+            b'+' => decoded.push(b' '),
+            b'%' if index + 2 < bytes.len() => {
+                let hex = std::str::from_utf8(&bytes[index + 1..index + 3]).ok();
+                match hex.and_then(|hex| u8::from_str_radix(hex, 16).ok()) {
+                    Some(byte) => {
+                        decoded.push(byte);
+                        index += 2;
+                    },
+                    None => decoded.push(b'%'),
+                }
+            },
+            byte => decoded.push(byte),
+        }
+
+        index += 1;
+    }
+
+    String::from_utf8_lossy(&decoded).to_string()
+}
+
+/// Returns the decoded value of the given query parameter of the request, if any
+fn get_param(request: &hyper::Request<Body>, name: &str) -> Option<String> {
+    request.uri().query()?
+        .split('&')
+        .filter_map(|param| {
+            let mut parts = param.splitn(2, '=');
+            match (parts.next(), parts.next()) {
+                (Some(key), Some(value)) if key == name => Some(decode_param(value)),
+                _ => None,
+            }
+        })
+        .next()
+}
+
+/// Returns the given value as a boolean, such as true or "True", since some identity providers send them as strings
+fn as_bool(value: &Value) -> Option<bool> {
+    match value {
+        Value::Bool(value) => Some(*value),
+        Value::String(value) if value.eq_ignore_ascii_case("true") => Some(true),
+        Value::String(value) if value.eq_ignore_ascii_case("false") => Some(false),
+        _ => None,
+    }
+}
+
+/// Returns the ids of the users listed as members by the given value, such as [{"value": "1"}, {"value": "2"}]
+fn get_member_ids(value: &Value) -> Result<Vec<i32>, ScimError> {
+    let members = match value {
+        Value::Array(members) => members.iter().collect(),
+        Value::Object(_) => vec![value],
+        _ => return Err(ScimError::bad_request("invalidValue", "members must be a list")),
+    };
+
+    members.iter()
+        .map(|member| member["value"].as_str()
+            .and_then(|id| id.parse().ok())
+            .ok_or(ScimError::bad_request("invalidValue", "members must be referenced by id")))
+        .collect()
+}
+
+fn new_response(status: StatusCode, body: &Value) -> hyper::Response<Body> {
+    let mut response = hyper::Response::new(Body::from(body.to_string()));
+    *response.status_mut() = status;
+    if let Ok(format) = SCIM_CONTENT_TYPE.parse() {
+        response.headers_mut().insert(CONTENT_TYPE, format);
+    }
+
+    response
+}
+
+fn no_content() -> hyper::Response<Body> {
+    let mut response = hyper::Response::new(Body::empty());
+    *response.status_mut() = StatusCode::NO_CONTENT;
+    response
+}
+
+/// Returns the administrator the api key the request bears in its bearer authorization header has been issued for,
+/// if, and only if, it is a valid key of the given tenant granted for the scim scope
+fn authenticate(request: &hyper::Request<Body>, tenant: &str) -> Result<User, ScimError> {
+    let unauthorized = || ScimError::new(StatusCode::UNAUTHORIZED, None, errors::UNAUTHORIZED);
+    let plain = request.headers().get(AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.strip_prefix(BEARER_PREFIX))
+        .ok_or_else(unauthorized)?;
+
+    let key = apikey_authenticate(tenant, plain.trim(), SCIM_SCOPE).map_err(|_| unauthorized())?;
+    let (admin, _) = user_info_by_id(key.get_user())?;
+    if !admin.is_admin() {
+        return Err(ScimError::new(StatusCode::FORBIDDEN, None, errors::UNAUTHORIZED));
+    }
+
+    Ok(admin)
+}
+
+/// The path the resources of a tenant are located at
+fn get_base_path(tenant: &str) -> String {
+    format!("/{}/{}/{}", SCIM_PATH, tenant, SCIM_VERSION)
+}
+
+fn user_to_json(user: &User, base: &str) -> Value {
+    let mut emails = vec![json!({"value": user.get_email(), "primary": true})];
+    emails.extend(user.get_aliases().iter().map(|alias| json!({"value": alias, "primary": false})));
+
+    json!({
+        "schemas": [USER_SCHEMA],
+        "id": user.get_id().to_string(),
+        "userName": user.get_email(),
+        "active": !user.is_suspended(),
+        "emails": emails,
+        "meta": {
+            "resourceType": "User",
+            "location": format!("{}/Users/{}", base, user.get_id()),
+        },
+    })
+}
+
+fn group_to_json(group: &Group, base: &str) -> Value {
+    let members: Vec<Value> = group.get_members().iter()
+        .map(|user_id| json!({
+            "value": user_id.to_string(),
+            "$ref": format!("{}/Users/{}", base, user_id),
+        }))
+        .collect();
+
+    json!({
+        "schemas": [GROUP_SCHEMA],
+        "id": group.get_id().to_string(),
+        "displayName": group.get_name(),
+        "members": members,
+        "meta": {
+            "resourceType": "Group",
+            "location": format!("{}/Groups/{}", base, group.get_id()),
+        },
+    })
+}
+
+/// Returns the page of the given resources the request asks for, as a scim list response
+fn list_response(request: &hyper::Request<Body>, resources: Vec<Value>) -> hyper::Response<Body> {
+    // scim indexes are 1-based
+    let start = get_param(request, "startIndex").and_then(|start| start.parse().ok()).unwrap_or(1_usize).max(1);
+    let count = get_param(request, "count").and_then(|count| count.parse().ok())
+        .unwrap_or(settings::MAX_PAGE_SIZE as usize)
+        .min(settings::MAX_PAGE_SIZE as usize);
+
+    let total = resources.len();
+    let page: Vec<Value> = resources.into_iter().skip(start - 1).take(count).collect();
+    new_response(StatusCode::OK, &json!({
+        "schemas": [LIST_SCHEMA],
+        "totalResults": total,
+        "startIndex": start,
+        "itemsPerPage": page.len(),
+        "Resources": page,
+    }))
+}
+
+fn get_filter(request: &hyper::Request<Body>) -> Result<Option<Filter>, ScimError> {
+    match get_param(request, "filter") {
+        Some(filter) => parse_filter(&filter)
+            .map(Some)
+            .ok_or(ScimError::bad_request("invalidFilter", "only equality filters are supported")),
+        None => Ok(None),
+    }
+}
+
+fn service_provider_config() -> Value {
+    json!({
+        "schemas": [CONFIG_SCHEMA],
+        "patch": {"supported": true},
+        "bulk": {"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+        "filter": {"supported": true, "maxResults": settings::MAX_PAGE_SIZE},
+        "changePassword": {"supported": false},
+        "sort": {"supported": false},
+        "etag": {"supported": false},
+        "authenticationSchemes": [{
+            "type": "oauthbearertoken",
+            "name": "API key",
+            "description": "An api key of a tenant administrator, granted for the scim scope, as bearer token",
+        }],
+    })
+}
+
+fn list_users(request: &hyper::Request<Body>, admin: &User, base: &str) -> ScimResult {
+    let users = match get_filter(request)? {
+        None => user_list(admin.get_tenant())?,
+        Some(filter) if filter.attribute.eq_ignore_ascii_case("userName") => {
+            user_find_by_email(admin.get_tenant(), &filter.value).map(|user| vec![user]).unwrap_or_default()
+        },
+        Some(filter) if filter.attribute == "id" => {
+            filter.value.parse().ok()
+                .and_then(|user_id| user_find(admin.get_tenant(), user_id).ok())
+                .map(|user| vec![user])
+                .unwrap_or_default()
+        },
+        Some(_) => return Err(ScimError::bad_request("invalidFilter", "users are only filtered by userName or id")),
+    };
+
+    Ok(list_response(request, users.iter().map(|user| user_to_json(user, base)).collect()))
+}
+
+fn create_user(admin: &User, base: &str, body: &Value) -> ScimResult {
+    let email = body["userName"].as_str()
+        .ok_or(ScimError::bad_request("invalidValue", "userName is required"))?;
+
+    let active = as_bool(&body["active"]).unwrap_or(true);
+    let user = user_provision(admin, email, active)?;
+    Ok(new_response(StatusCode::CREATED, &user_to_json(&user, base)))
+}
+
+/// Applies the given attributes of a user resource to the user with the given id. The userName is immutable, since
+/// emails get changed by their owners only once confirmed, while the attributes tpauth does not keep are ignored
+fn replace_user(admin: &User, base: &str, user_id: i32, body: &Value) -> ScimResult {
+    let user = user_find(admin.get_tenant(), user_id)?;
+    if let Some(email) = body["userName"].as_str() {
+        if !email.eq_ignore_ascii_case(user.get_email()) {
+            return Err(ScimError::bad_request("mutability", "userName cannot be changed"));
+        }
+    }
+
+    if let Some(active) = as_bool(&body["active"]) {
+        user_set_active(admin, user_id, active, "provisioning")?;
+    }
+
+    let user = user_find(admin.get_tenant(), user_id)?;
+    Ok(new_response(StatusCode::OK, &user_to_json(&user, base)))
+}
+
+fn get_operations(body: &Value) -> Result<&Vec<Value>, ScimError> {
+    let is_patch = body["schemas"].as_array()
+        .map(|schemas| schemas.iter().any(|schema| schema == PATCH_SCHEMA))
+        .unwrap_or(false);
+
+    match body["Operations"].as_array() {
+        Some(operations) if is_patch => Ok(operations),
+        _ => Err(ScimError::bad_request("invalidSyntax", "a patch operation is required")),
+    }
+}
+
+fn patch_user(admin: &User, base: &str, user_id: i32, body: &Value) -> ScimResult {
+    let mut changes = json!({});
+    for operation in get_operations(body)? {
+        let op = operation["op"].as_str().unwrap_or_default().to_lowercase();
+        if op != "add" && op != "replace" {
+            continue; // none of the attributes tpauth keeps can be removed
+        }
+
+        match operation["path"].as_str() {
+            Some(path) => changes[path] = operation["value"].clone(),
+            None => if let Value::Object(values) = &operation["value"] {
+                values.iter().for_each(|(name, value)| changes[name] = value.clone());
+            },
+        }
+    }
+
+    replace_user(admin, base, user_id, &changes)
+}
+
+fn list_groups(request: &hyper::Request<Body>, admin: &User, base: &str) -> ScimResult {
+    let groups = group_list(admin.get_tenant())?;
+    let groups: Vec<&Group> = match get_filter(request)? {
+        None => groups.iter().collect(),
+        Some(filter) if filter.attribute.eq_ignore_ascii_case("displayName") => {
+            groups.iter().filter(|group| group.get_name() == filter.value).collect()
+        },
+        Some(filter) if filter.attribute == "id" => {
+            groups.iter().filter(|group| group.get_id().to_string() == filter.value).collect()
+        },
+        Some(_) => return Err(ScimError::bad_request("invalidFilter", "groups are only filtered by displayName or id")),
+    };
+
+    Ok(list_response(request, groups.iter().map(|group| group_to_json(group, base)).collect()))
+}
+
+fn create_group(admin: &User, base: &str, body: &Value) -> ScimResult {
+    let name = body["displayName"].as_str()
+        .ok_or(ScimError::bad_request("invalidValue", "displayName is required"))?;
+
+    let members = match &body["members"] {
+        Value::Null => Vec::new(),
+        members => get_member_ids(members)?,
+    };
+
+    let group = group_create(admin.get_tenant(), name, &members)?;
+    Ok(new_response(StatusCode::CREATED, &group_to_json(&group, base)))
+}
+
+fn replace_group(admin: &User, base: &str, group_id: i32, body: &Value) -> ScimResult {
+    let mut group = group_find(admin.get_tenant(), group_id)?;
+    if let Some(name) = body["displayName"].as_str() {
+        group.rename(name)?;
+    }
+
+    let members = match &body["members"] {
+        Value::Null => Vec::new(),
+        members => get_member_ids(members)?,
+    };
+
+    group.get_members().to_vec().iter().for_each(|user_id| group.remove_member(*user_id));
+    members.iter().for_each(|user_id| group.add_member(*user_id));
+    group_save(&group)?;
+    Ok(new_response(StatusCode::OK, &group_to_json(&group, base)))
+}
+
+/// Returns the id of the member the given path points to, such as members[value eq "2"], if any
+fn get_member_path(path: &str) -> Option<i32> {
+    let filter = path.strip_prefix("members[")?.strip_suffix(']')?;
+    match parse_filter(filter)? {
+        Filter{attribute, value} if attribute == "value" => value.parse().ok(),
+        _ => None,
+    }
+}
+
+fn patch_group(admin: &User, base: &str, group_id: i32, body: &Value) -> ScimResult {
+    let mut group = group_find(admin.get_tenant(), group_id)?;
+    for operation in get_operations(body)? {
+        let op = operation["op"].as_str().unwrap_or_default().to_lowercase();
+        let value = &operation["value"];
+
+        match (op.as_str(), operation["path"].as_str()) {
+            ("add", Some("members")) => {
+                get_member_ids(value)?.iter().for_each(|user_id| group.add_member(*user_id));
+            },
+            ("remove", Some("members")) if value.is_null() => {
+                group.get_members().to_vec().iter().for_each(|user_id| group.remove_member(*user_id));
+            },
+            ("remove", Some("members")) => {
+                get_member_ids(value)?.iter().for_each(|user_id| group.remove_member(*user_id));
+            },
+            ("remove", Some(path)) => match get_member_path(path) {
+                Some(user_id) => group.remove_member(user_id),
+                None => return Err(ScimError::bad_request("invalidPath", path)),
+            },
+            ("replace", Some("members")) => {
+                let members = get_member_ids(value)?;
+                group.get_members().to_vec().iter().for_each(|user_id| group.remove_member(*user_id));
+                members.iter().for_each(|user_id| group.add_member(*user_id));
+            },
+            ("replace", Some("displayName")) => {
+                let name = value.as_str().ok_or(ScimError::bad_request("invalidValue", "displayName"))?;
+                group.rename(name)?;
+            },
+            ("replace", None) | ("add", None) => {
+                if let Some(name) = value["displayName"].as_str() {
+                    group.rename(name)?;
+                }
+
+                if !value["members"].is_null() {
+                    let members = get_member_ids(&value["members"])?;
+                    if op == "replace" {
+                        group.get_members().to_vec().iter().for_each(|user_id| group.remove_member(*user_id));
+                    }
+
+                    members.iter().for_each(|user_id| group.add_member(*user_id));
+                }
+            },
+            (_, Some(path)) => return Err(ScimError::bad_request("invalidPath", path)),
+            (_, None) => return Err(ScimError::bad_request("invalidSyntax", "unsupported operation")),
+        }
+    }
+
+    group_save(&group)?;
+    Ok(new_response(StatusCode::OK, &group_to_json(&group, base)))
+}
+
+async fn read_body(request: hyper::Request<Body>) -> Result<Value, ScimError> {
+    let body = match hyper::body::to_bytes(request.into_body()).await {
+        Ok(body) if body.len() <= settings::SCIM_MAX_BODY => body,
+        Ok(_) => return Err(ScimError::new(StatusCode::PAYLOAD_TOO_LARGE, None, "request too large")),
+        Err(err) => return Err(ScimError::bad_request("invalidSyntax", &err.to_string())),
+    };
+
+    serde_json::from_slice(&body).map_err(|err| ScimError::bad_request("invalidSyntax", &err.to_string()))
+}
+
+async fn route(request: hyper::Request<Body>) -> ScimResult {
+    let not_found = || ScimError::new(StatusCode::NOT_FOUND, None, errors::NOT_FOUND);
+    let path: Vec<String> = request.uri().path().trim_matches('/').split('/').map(str::to_string).collect();
+    let (tenant, resource, id) = match path.as_slice() {
+        [scim, tenant, version, resource] if scim == SCIM_PATH && version == SCIM_VERSION => (tenant, resource, None),
+        [scim, tenant, version, resource, id] if scim == SCIM_PATH && version == SCIM_VERSION => {
+            (tenant, resource, Some(id.parse::<i32>().map_err(|_| not_found())?))
+        },
+        _ => return Err(not_found()),
+    };
+
+    let admin = authenticate(&request, tenant)?;
+    let base = get_base_path(tenant);
+    let method = request.method().clone();
+
+    match (resource.as_str(), id, method) {
+        ("ServiceProviderConfig", None, Method::GET) => Ok(new_response(StatusCode::OK, &service_provider_config())),
+        ("Users", None, Method::GET) => list_users(&request, &admin, &base),
+        ("Users", None, Method::POST) => create_user(&admin, &base, &read_body(request).await?),
+        ("Users", Some(id), Method::GET) => {
+            let user = user_find(admin.get_tenant(), id)?;
+            Ok(new_response(StatusCode::OK, &user_to_json(&user, &base)))
+        },
+        ("Users", Some(id), Method::PUT) => replace_user(&admin, &base, id, &read_body(request).await?),
+        ("Users", Some(id), Method::PATCH) => patch_user(&admin, &base, id, &read_body(request).await?),
+        ("Users", Some(id), Method::DELETE) => user_deprovision(&admin, id).map(|_| no_content()).map_err(Into::into),
+        ("Groups", None, Method::GET) => list_groups(&request, &admin, &base),
+        ("Groups", None, Method::POST) => create_group(&admin, &base, &read_body(request).await?),
+        ("Groups", Some(id), Method::GET) => {
+            let group = group_find(admin.get_tenant(), id)?;
+            Ok(new_response(StatusCode::OK, &group_to_json(&group, &base)))
+        },
+        ("Groups", Some(id), Method::PUT) => replace_group(&admin, &base, id, &read_body(request).await?),
+        ("Groups", Some(id), Method::PATCH) => patch_group(&admin, &base, id, &read_body(request).await?),
+        ("Groups", Some(id), Method::DELETE) => {
+            group_delete(admin.get_tenant(), id).map(|_| no_content()).map_err(Into::into)
+        },
+        ("ServiceProviderConfig", _, _) | ("Users", _, _) | ("Groups", _, _) => {
+            Err(ScimError::new(StatusCode::METHOD_NOT_ALLOWED, None, "method not allowed"))
+        },
+        _ => Err(not_found()),
+    }
+}
+
+async fn handle(request: hyper::Request<Body>) -> Result<hyper::Response<Body>, Infallible> {
+    match route(request).await {
+        Ok(response) => Ok(response),
+        Err(err) => Ok(err.into_response()),
+    }
+}
+
+/// Serves the Users and Groups resources of every tenant as a SCIM 2.0 endpoint at the /scim/<tenant>/v2 path of the
+/// given address, so identity providers can provision and deprovision accounts. Requests are authenticated by an api
+/// key of an administrator of the tenant, granted for the scim scope, as bearer token
+pub async fn serve(addr: SocketAddr) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let make_service = make_service_fn(|_| async {
+        Ok::<_, Infallible>(HeadersLayer::new().layer(service_fn(handle)))
+    });
+
+    Server::try_bind(&addr)?.serve(make_service).await?;
+    Ok(())
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use serde_json::json;
+    use super::{Filter, parse_filter, decode_param, get_member_ids, get_member_path};
+
+    #[test]
+    fn parse_filter_should_not_fail() {
+        assert_eq!(Some(Filter{attribute: "userName".to_string(), value: "alice@example.com".to_string()}),
+                   parse_filter("userName eq \"alice@example.com\""));
+        assert_eq!(Some(Filter{attribute: "displayName".to_string(), value: "Site \"A\" admins".to_string()}),
+                   parse_filter("displayName EQ \"Site \\\"A\\\" admins\""));
+        assert_eq!(Some(Filter{attribute: "id".to_string(), value: "12".to_string()}),
+                   parse_filter("id eq 12"));
+    }
+
+    #[test]
+    fn parse_filter_should_fail() {
+        assert_eq!(None, parse_filter("userName"));
+        assert_eq!(None, parse_filter("userName sw \"alice\""));
+        assert_eq!(None, parse_filter("userName eq \"alice"));
+    }
+
+    #[test]
+    fn decode_param_should_not_fail() {
+        assert_eq!("userName eq \"alice@example.com\"", decode_param("userName+eq+%22alice%40example.com%22"));
+        assert_eq!("100%", decode_param("100%"));
+        assert_eq!("%zz", decode_param("%zz"));
+    }
+
+    #[test]
+    fn get_member_ids_should_not_fail() {
+        assert_eq!(vec![1, 2], get_member_ids(&json!([{"value": "1"}, {"value": "2"}])).unwrap());
+        assert_eq!(vec![3], get_member_ids(&json!({"value": "3"})).unwrap());
+    }
+
+    #[test]
+    fn get_member_ids_should_fail() {
+        assert!(get_member_ids(&json!("1")).is_err());
+        assert!(get_member_ids(&json!([{"value": "alice"}])).is_err());
+        assert!(get_member_ids(&json!([{"display": "alice"}])).is_err());
+    }
+
+    #[test]
+    fn get_member_path_should_not_fail() {
+        assert_eq!(Some(2), get_member_path("members[value eq \"2\"]"));
+        assert_eq!(None, get_member_path("members[display eq \"alice\"]"));
+        assert_eq!(None, get_member_path("displayName"));
+    }
+}
@@ -4,6 +4,7 @@ use diesel::result::Error as PgError;
 
 use crate::diesel::prelude::*;
 use crate::postgres::*;
+use crate::memory;
 use crate::schema::secrets;
 use crate::schema::secrets::dsl::*;
 use crate::metadata::{
@@ -122,6 +123,39 @@ impl SecretRepository for PostgresSecretRepository {
     }
 }
 
+pub struct InMemorySecretRepository {
+    table: memory::Table<Secret>,
+}
+
+impl InMemorySecretRepository {
+    pub fn new() -> Self {
+        InMemorySecretRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl SecretRepository for InMemorySecretRepository {
+    fn find(&self, target: i32) -> Result<Secret, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn create(&self, secret: &mut Secret) -> Result<(), Box<dyn Error>> {
+        // in order to create a secret it must exists the metadata for this secret
+        get_meta_repository().create(&mut secret.meta)?;
+        self.table.insert(secret, |_| false, |secret, new_id| secret.id = new_id)
+    }
+
+    fn save(&self, secret: &Secret) -> Result<(), Box<dyn Error>> {
+        self.table.update(secret.id, secret)
+    }
+
+    fn delete(&self, secret: &Secret) -> Result<(), Box<dyn Error>> {
+        self.table.delete(secret.id)?;
+        get_meta_repository().delete(&secret.meta)
+    }
+}
+
 #[cfg(test)]
 #[cfg(feature = "integration-tests")]
 pub mod tests {
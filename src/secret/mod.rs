@@ -2,12 +2,18 @@ pub mod framework;
 pub mod application;
 pub mod domain;
 
+use crate::storage::{self, Backend};
+
 lazy_static! {
-    static ref REPO_PROVIDER: framework::PostgresSecretRepository = {
-        framework::PostgresSecretRepository
+    static ref REPO_PROVIDER: Box<dyn domain::SecretRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresSecretRepository),
+            Backend::Memory => Box::new(framework::InMemorySecretRepository::new()),
+            backend => storage::unsupported(backend, "secrets"),
+        }
     }; 
 }   
 
 pub fn get_repository() -> Box<&'static dyn domain::SecretRepository> {
-    Box::new(&*REPO_PROVIDER)
+    Box::new(&**REPO_PROVIDER)
 }
\ No newline at end of file
@@ -1,20 +1,38 @@
 use std::error::Error;
+use std::fmt;
 use std::sync::{Arc, RwLock};
-use std::time::{Duration, SystemTime};
-use std::collections::{HashMap, HashSet};
+use std::time::{Duration, SystemTime, Instant, UNIX_EPOCH};
+use std::collections::{HashMap, HashSet, BTreeMap};
+use openssl::sign::Signer;
+use openssl::pkey::PKey;
+use openssl::hash::MessageDigest;
 
 use crate::metadata::domain::InnerMetadata;
 use crate::user::domain::User;
 use crate::app::domain::App;
 use crate::directory::domain::Directory;
-use crate::constants::errors::ALREADY_EXISTS;
-use crate::time::unix_timestamp;
+use crate::constants::errors::{ALREADY_EXISTS, GUEST, IMPERSONATED, UNAUTHORIZED, PARSE_FAILED, REVOKED};
+use crate::time::{self, unix_timestamp};
+use crate::security::{self, TokenKind};
 
 pub trait SessionRepository {
     fn find(&self, cookie: &str) -> Result<Arc<RwLock<Session>>, Box<dyn Error>>;
-    fn find_by_email(&self, email: &str) -> Result<Arc<RwLock<Session>>, Box<dyn Error>>;
+    fn find_by_email(&self, tenant: i32, email: &str) -> Result<Arc<RwLock<Session>>, Box<dyn Error>>;
+    // returns the session of the user with the given email partitioned to the given app, if any
+    fn find_by_email_and_app(&self, tenant: i32, email: &str, app: i32) -> Result<Arc<RwLock<Session>>, Box<dyn Error>>;
+    // returns all the sessions of the user with the given email: the shared one, if any, and every one partitioned to
+    // any of its apps
+    fn find_all_by_email(&self, tenant: i32, email: &str) -> Result<Vec<Arc<RwLock<Session>>>, Box<dyn Error>>;
     fn insert(&self, session: Session) -> Result<String, Box<dyn Error>>;
+    fn upgrade(&self, cookie: &str, user: User, timeout: Duration) -> Result<Arc<RwLock<Session>>, Box<dyn Error>>;
+    fn save(&self, session: &Session) -> Result<(), Box<dyn Error>>;
     fn delete(&self, session: &Session) -> Result<(), Box<dyn Error>>;
+    // returns how many sessions have not expired nor been closed yet
+    fn count(&self) -> Result<usize, Box<dyn Error>>;
+    // returns how many of these sessions have been issued a token for each app, by the id of the app
+    fn count_by_app(&self) -> Result<HashMap<i32, usize>, Box<dyn Error>>;
+    // removes up to limit sessions whose deadline is over by the given time, returning how many there were
+    fn delete_expired(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>>;
 }
 
 pub trait GroupByAppRepository {
@@ -23,12 +41,52 @@ pub trait GroupByAppRepository {
     fn delete(&self, app: &App) -> Result<(), Box<dyn Error>>;
 }
 
+pub trait RememberRepository {
+    fn find(&self, id: &str) -> Result<Remember, Box<dyn Error>>;
+    fn insert(&self, remember: Remember) -> Result<String, Box<dyn Error>>;
+    // saves the given remember-me session as long as it still exists, so a revoked one is never brought back
+    fn save(&self, remember: &Remember) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, id: &str) -> Result<(), Box<dyn Error>>;
+    fn delete_all_by_email(&self, tenant: i32, email: &str) -> Result<(), Box<dyn Error>>;
+    fn delete_all_by_email_and_app(&self, tenant: i32, email: &str, app: i32) -> Result<(), Box<dyn Error>>;
+    // removes up to limit remember-me sessions whose deadline is over by the given time, returning how many there were
+    fn delete_expired(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>>;
+}
+
+/// All the repositories a session storage backend must provide
+pub trait SessionStorage: Sync + Send {
+    fn sessions(&self) -> &dyn SessionRepository;
+    fn groups(&self) -> &dyn GroupByAppRepository;
+    fn remembers(&self) -> &dyn RememberRepository;
+}
+
+impl<T> SessionStorage for T
+    where T: SessionRepository + GroupByAppRepository + RememberRepository + Sync + Send {
+
+    fn sessions(&self) -> &dyn SessionRepository {
+        self
+    }
+
+    fn groups(&self) -> &dyn GroupByAppRepository {
+        self
+    }
+
+    fn remembers(&self) -> &dyn RememberRepository {
+        self
+    }
+}
+
 pub struct Session {
     pub(super) sid: String,
     pub(super) deadline: SystemTime,
-    pub(super) user: User,
+    pub(super) user: Option<User>, // none for guest sessions
     pub(super) apps: HashMap<i32, Directory>,
     pub(super) meta: InnerMetadata,
+    pub(super) elevated_until: Option<SystemTime>, // end of the window for sensitive actions, if any
+    pub(super) devices: HashSet<i32>, // all these devices the session has been used from
+    pub(super) impersonator: Option<i32>, // the administrator acting as the session's owner, if any
+    pub(super) tenant: i32, // the tenant of the session's owner, or the one a guest session was requested for
+    pub(super) audience: Option<i32>, // the app the session is partitioned to, if any, or else it is shared by all
     // sandbox is used for storing temporal data that must not be persisted nor
     // accessed by any other party than the Session itself
     pub(super) sandbox: HashMap<String, String>,
@@ -40,30 +98,168 @@ impl Session {
 
         Session{
             sid: "".to_string(), // will be set by the repository controller down below
-            deadline: SystemTime::now() + timeout,
-            user: user,
+            deadline: time::now() + timeout,
+            tenant: user.get_tenant(),
+            user: Some(user),
             apps: HashMap::new(),
             meta: InnerMetadata::new(),
+            elevated_until: None,
+            devices: HashSet::new(),
+            impersonator: None,
+            audience: None,
             sandbox: HashMap::new(),
         }
     }
 
+    /// returns a session of the provided user that is partitioned to the given app, so it serves no other app and
+    /// logging out of it keeps the sessions of the user for any other app open
+    pub fn new_partition(user: User,
+                         app: &App,
+                         timeout: Duration) -> Self {
+
+        let mut sess = Session::new(user, timeout);
+        sess.audience = Some(app.get_id());
+        sess
+    }
+
+    /// returns a session that does not belong to any user of the given tenant, so it is limited to these actions
+    /// requiring no account
+    pub fn new_guest(tenant: i32, timeout: Duration) -> Self {
+        Session{
+            sid: "".to_string(), // will be set by the repository controller down below
+            deadline: time::now() + timeout,
+            user: None,
+            apps: HashMap::new(),
+            meta: InnerMetadata::new(),
+            elevated_until: None,
+            devices: HashSet::new(),
+            impersonator: None,
+            tenant: tenant,
+            audience: None,
+            sandbox: HashMap::new(),
+        }
+    }
+
+    /// returns a session owned by the provided user but driven by the given administrator, so every action performed
+    /// through it can be told apart from these performed by the user itself
+    pub fn new_impersonation(user: User,
+                             impersonator: i32,
+                             timeout: Duration) -> Self {
+
+        let mut sess = Session::new(user, timeout);
+        sess.impersonator = Some(impersonator);
+        sess
+    }
+
     pub fn get_id(&self) -> &str {
         &self.sid
     }
 
-    pub fn get_user(&self) -> &User {
-        &self.user
+    /// returns the user owning the session, failing if the session belongs to a guest
+    pub fn get_user(&self) -> Result<&User, Box<dyn Error>> {
+        match &self.user {
+            Some(user) => Ok(user),
+            None => Err(GUEST.into()),
+        }
+    }
+
+    pub fn get_user_mut(&mut self) -> Result<&mut User, Box<dyn Error>> {
+        match &mut self.user {
+            Some(user) => Ok(user),
+            None => Err(GUEST.into()),
+        }
+    }
+
+    /// if true, the session does not belong to any user, else it does
+    pub fn is_guest(&self) -> bool {
+        self.user.is_none()
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_impersonator(&self) -> Option<i32> {
+        self.impersonator
+    }
+
+    pub fn get_audience(&self) -> Option<i32> {
+        self.audience
+    }
+
+    /// if true, the session may serve the provided app, being either shared by all apps or partitioned to that one,
+    /// else it may not
+    pub fn serves(&self, app: &App) -> bool {
+        self.audience.map(|audience| audience == app.get_id()).unwrap_or(true)
+    }
+
+    /// if true, the session is driven by an administrator on behalf of its owner, else it is not
+    pub fn is_impersonated(&self) -> bool {
+        self.impersonator.is_some()
     }
 
-    pub fn get_user_mut(&mut self) -> &mut User {
-        &mut self.user
+    /// returns the id of whoever is actually performing the actions of the session: the impersonator, if any, or else
+    /// the owner of the session
+    pub fn get_issuer(&self) -> Result<i32, Box<dyn Error>> {
+        match self.impersonator {
+            Some(impersonator) => Ok(impersonator),
+            None => Ok(self.get_user()?.get_id()),
+        }
+    }
+
+    /// if, and only if, the session belongs to a guest of the same tenant as the provided user, the user becomes its
+    /// owner while keeping the same session id and sandbox
+    pub(super) fn upgrade(&mut self, user: User, timeout: Duration) -> Result<(), Box<dyn Error>> {
+        if self.user.is_some() {
+            return Err(ALREADY_EXISTS.into());
+        } else if self.tenant != user.get_tenant() {
+            return Err(UNAUTHORIZED.into());
+        }
+
+        self.user = Some(user);
+        self.deadline = time::now() + timeout;
+        self.meta.touch();
+        Ok(())
     }
 
     pub fn get_deadline(&self) -> SystemTime {
         self.deadline
     }
 
+    /// grants the session a higher assurance level for the given window, never beyond the session's deadline
+    pub(super) fn elevate(&mut self, window: Duration) -> Result<(), Box<dyn Error>> {
+        if self.is_guest() {
+            return Err(GUEST.into());
+        } else if self.is_impersonated() {
+            return Err(IMPERSONATED.into());
+        }
+
+        let until = time::now() + window;
+        self.elevated_until = Some(if until < self.deadline {until} else {self.deadline});
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// registers the provided device as one the session has been used from
+    pub(super) fn add_device(&mut self, device: i32) {
+        if self.devices.insert(device) {
+            self.meta.touch();
+        }
+    }
+
+    /// if true, the session has been used from the provided device, else it has not
+    pub fn has_device(&self, device: i32) -> bool {
+        self.devices.contains(&device)
+    }
+
+    /// if true, the session is within its elevation window, else is not
+    pub fn is_elevated(&self) -> bool {
+        match self.elevated_until {
+            Some(until) => until > time::now(),
+            None => false,
+        }
+    }
+
     /// if, and only if, the session does not have any directory for the directory's app then it gets inserted
     /// into the session's directories
     pub fn set_directory(&mut self, dir: Directory) -> Result<(), Box<dyn Error>> {
@@ -107,6 +303,102 @@ impl Session {
     }
 }
 
+/// Represents a long-lived and restricted session whose only purpose is to mint short-lived full sessions for the
+/// app the user logged in with
+#[derive(Clone)]
+pub struct Remember {
+    pub(super) id: String,
+    pub(super) user: i32,
+    pub(super) email: String, // the primary email of the user by the time it logged in
+    pub(super) tenant: i32,
+    pub(super) app: i32,
+    pub(super) deadline: SystemTime,
+    pub(super) used_at: SystemTime, // the last time a session was minted by it, or else its creation time
+}
+
+impl Remember {
+    pub fn new(user: &User,
+               app: &App,
+               timeout: Duration) -> Self {
+
+        Remember {
+            id: "".to_string(), // will be set by the repository controller
+            user: user.get_id(),
+            email: user.get_email().to_string(),
+            tenant: user.get_tenant(),
+            app: app.get_id(),
+            deadline: time::now() + timeout,
+            used_at: time::now(),
+        }
+    }
+
+    pub fn get_id(&self) -> &str {
+        &self.id
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_email(&self) -> &str {
+        &self.email
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_app(&self) -> i32 {
+        self.app
+    }
+
+    pub fn get_deadline(&self) -> SystemTime {
+        self.deadline
+    }
+
+    pub fn get_used_at(&self) -> SystemTime {
+        self.used_at
+    }
+
+    /// if true, the deadline of the remember-me session is not over yet, else it is
+    pub fn is_alive(&self) -> bool {
+        self.deadline > time::now()
+    }
+
+    /// if true, the remember-me session has not been used for as long as the given inactivity window, else it has
+    pub fn is_idle(&self, window: Duration) -> bool {
+        self.used_at + window <= time::now()
+    }
+
+    /// sets the current time as the last time the remember-me session has been used
+    pub(super) fn touch(&mut self) {
+        self.used_at = time::now();
+    }
+}
+
+/// Returns how long the remember-me sessions of the given app may go unused, as told by the given comma-separated list
+/// of inactivity windows formatted as <seconds>[@<app>], either for every app or, if given, for the one with that url,
+/// whose window goes before the one of every app. Returns None if no window applies to the app
+pub fn find_inactivity(windows: &str, app: &str) -> Result<Option<Duration>, Box<dyn Error>> {
+    let mut any = None;
+    for window in windows.split(',').map(str::trim).filter(|window| window.len() > 0) {
+        let mut parts = window.splitn(2, '@');
+        let secs: u64 = parts.next().unwrap_or_default().parse()?;
+        if secs == 0 {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        match parts.next() {
+            Some(url) if url == app => return Ok(Some(Duration::from_secs(secs))),
+            Some(url) if url.len() > 0 => {},
+            Some(_) => return Err(errors::PARSE_FAILED.into()),
+            None => any = any.or(Some(Duration::from_secs(secs))),
+        }
+    }
+
+    Ok(any)
+}
+
 #[derive(Serialize, Deserialize)]
 pub struct Token {
     pub exp: usize,     // expiration time (as UTC timestamp) - required
@@ -114,39 +406,638 @@ pub struct Token {
     pub iss: String,         // issuer
     pub sub: String,         // subject: the user's session
     pub app: i32,            // application id
+    #[serde(default)]
+    pub guest: bool,         // if true, the session does not belong to any user
+    #[serde(default)]
+    pub impersonator: i32,   // the administrator acting as the session's owner, zero if none
+    #[serde(default)]
+    pub tenant: i32,         // the tenant of the session
+    #[serde(flatten)]
+    pub claims: HashMap<String, serde_json::Value>, // the ones added by the claims enricher, if any
+}
+
+// session tokens are told as plain jwts, as verified by the resource servers of the apps
+impl TokenKind for Token {
+    const KIND: &'static str = "JWT";
 }
 
 impl Token {
     pub fn new(sess: &Session, app: &App, deadline: SystemTime) -> Self {
         Token {
             exp: unix_timestamp(deadline),
-            iat: SystemTime::now(),
+            iat: time::now(),
             iss: "tpauth.alvidir.com".to_string(),
             sub: sess.sid.clone(),
             app: app.get_id(),
+            guest: sess.is_guest(),
+            impersonator: sess.impersonator.unwrap_or(0),
+            tenant: sess.tenant,
+            claims: HashMap::new(),
+        }
+    }
+}
+
+// token for remember-me sessions, it cannot be used as a session token
+#[derive(Serialize, Deserialize)]
+pub struct RememberToken {
+    pub exp: usize,          // expiration time (as UTC timestamp) - required
+    pub iat: SystemTime,     // issued at: creation time
+    pub iss: String,         // issuer
+    pub sub: i32,            // subject: the user id
+    pub jti: String,         // the remember-me session id
+}
+
+impl TokenKind for RememberToken {
+    const KIND: &'static str = "remember+jwt";
+}
+
+impl RememberToken {
+    pub fn new(remember: &Remember) -> Self {
+        RememberToken {
+            exp: unix_timestamp(remember.deadline),
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: remember.user,
+            jti: remember.id.clone(),
+        }
+    }
+}
+
+/// All the policies a browser may follow on sending a cookie along with cross-site requests
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum SameSite {
+    Strict, // never sent along with cross-site requests
+    Lax,    // sent along with top-level cross-site navigations only
+    None,   // always sent, which requires the cookie to be a secure one
+}
+
+impl SameSite {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            SameSite::Strict => "strict",
+            SameSite::Lax => "lax",
+            SameSite::None => "none",
+        }
+    }
+
+    pub fn from_str(same_site: &str) -> Option<Self> {
+        match same_site.to_lowercase().as_str() {
+            "strict" => Some(SameSite::Strict),
+            "lax" => Some(SameSite::Lax),
+            "none" => Some(SameSite::None),
+            _ => None,
+        }
+    }
+}
+
+/// The attributes http gateways and sdks must set the cookies holding tokens with, so all of them do it the same way
+#[derive(Clone, Debug)]
+pub struct CookieAttributes {
+    pub(super) domain: Option<String>, // none for host-only cookies
+    pub(super) path: String,
+    pub(super) secure: bool,
+    pub(super) http_only: bool,
+    pub(super) same_site: SameSite,
+}
+
+impl CookieAttributes {
+    pub fn new(domain: Option<&str>,
+               path: &str,
+               secure: bool,
+               http_only: bool,
+               same_site: SameSite) -> Result<Self, Box<dyn Error>> {
+
+        if same_site == SameSite::None && !secure {
+            return Err("cookies with no same site policy must be secure".into());
+        }
+
+        if !path.starts_with('/') {
+            return Err("cookie path must start with a slash".into());
+        }
+
+        Ok(CookieAttributes {
+            domain: domain.filter(|domain| domain.len() > 0).map(|domain| domain.to_string()),
+            path: path.to_string(),
+            secure: secure,
+            http_only: http_only,
+            same_site: same_site,
+        })
+    }
+
+    pub fn get_domain(&self) -> Option<&str> {
+        self.domain.as_deref()
+    }
+
+    pub fn get_path(&self) -> &str {
+        &self.path
+    }
+
+    pub fn is_secure(&self) -> bool {
+        self.secure
+    }
+
+    pub fn is_http_only(&self) -> bool {
+        self.http_only
+    }
+
+    pub fn get_same_site(&self) -> SameSite {
+        self.same_site
+    }
+
+    /// Returns how many seconds a cookie holding a token that expires at the given time (as UTC timestamp) must last
+    pub fn max_age(exp: usize) -> u64 {
+        exp.saturating_sub(unix_timestamp(time::now())) as u64
+    }
+
+    /// Returns the value of the Set-Cookie header for a cookie with the given name, value and max age
+    pub fn to_header(&self, name: &str, value: &str, max_age: u64) -> String {
+        let mut header = format!("{}={}; Path={}; Max-Age={}", name, value, self.path, max_age);
+        if let Some(domain) = &self.domain {
+            header.push_str(&format!("; Domain={}", domain));
+        }
+
+        if self.secure {
+            header.push_str("; Secure");
+        }
+
+        if self.http_only {
+            header.push_str("; HttpOnly");
+        }
+
+        let same_site = match self.same_site {
+            SameSite::Strict => "Strict",
+            SameSite::Lax => "Lax",
+            SameSite::None => "None",
+        };
+
+        header.push_str(&format!("; SameSite={}", same_site));
+        header
+    }
+}
+
+// opaque cookies are prefixed by it, so they can be told apart from tokens, which never start this way
+const OPAQUE_COOKIE_PREFIX: &str = "c1.";
+const COOKIE_KEY_LEN: usize = 32;
+
+/// The session an opaque cookie stands for: its id, the app it has been issued for and when it expires (as UTC
+/// timestamp)
+#[derive(Clone, PartialEq, Debug)]
+pub struct CookieReference {
+    pub sid: String,
+    pub app: i32,
+    pub exp: usize,
+}
+
+/// Seals references to sessions into opaque cookies, for deployments preferring them over tokens, signed by
+/// HMAC-SHA256 and, if told, encrypted by AES-256-GCM. Keys are versioned: the first one seals all the new cookies,
+/// while the rest are only kept to open the older ones, so keys get rotated with no cookie being invalidated
+pub struct CookieCodec {
+    keys: Vec<(String, Vec<u8>, Vec<u8>)>, // by id, along the signing and the encryption keys derived from it
+    encrypt: bool,
+}
+
+impl CookieCodec {
+    /// Returns a codec for the given keys, as a comma-separated list of <id>:<base64 key>, each of them 32 bytes long
+    pub fn new(keys: &str, encrypt: bool) -> Result<Self, Box<dyn Error>> {
+        let mut parsed = Vec::new();
+        for entry in keys.split(',') {
+            let mut parts = entry.trim().splitn(2, ':');
+            let (id, key_b64) = match (parts.next(), parts.next()) {
+                (Some(id), Some(key_b64)) if id.len() > 0 && !id.contains('.') => (id, key_b64),
+                _ => return Err(PARSE_FAILED.into()),
+            };
+
+            let key = base64::decode(key_b64.trim())?;
+            if key.len() != COOKIE_KEY_LEN {
+                return Err(PARSE_FAILED.into());
+            }
+
+            // the same key must never sign and encrypt, so each purpose gets one of its own
+            parsed.push((id.to_string(), CookieCodec::derive(&key, "sign")?, CookieCodec::derive(&key, "encrypt")?));
+        }
+
+        Ok(CookieCodec {
+            keys: parsed,
+            encrypt: encrypt,
+        })
+    }
+
+    /// if true, the given value is an opaque cookie, else it is not (such as any token)
+    pub fn is_opaque(value: &str) -> bool {
+        value.starts_with(OPAQUE_COOKIE_PREFIX)
+    }
+
+    fn derive(key: &[u8], purpose: &str) -> Result<Vec<u8>, Box<dyn Error>> {
+        CookieCodec::mac(key, purpose.as_bytes())
+    }
+
+    fn mac(key: &[u8], data: &[u8]) -> Result<Vec<u8>, Box<dyn Error>> {
+        let key = PKey::hmac(key)?;
+        let mut signer = Signer::new(MessageDigest::sha256(), &key)?;
+        signer.update(data)?;
+        Ok(signer.sign_to_vec()?)
+    }
+
+    /// Returns the opaque cookie standing for the given reference, as <prefix><key id>.<payload>.<signature>, sealed by
+    /// the current key
+    pub fn encode(&self, reference: &CookieReference) -> Result<String, Box<dyn Error>> {
+        let (id, sign_key, encrypt_key) = self.keys.first().ok_or(PARSE_FAILED)?;
+        let plain = format!("{}:{}:{}", reference.sid, reference.app, reference.exp);
+        let payload = match self.encrypt {
+            true => security::encrypt_aes(encrypt_key, plain.as_bytes())?,
+            false => plain.into_bytes(),
+        };
+
+        let signed = format!("{}{}.{}", OPAQUE_COOKIE_PREFIX, id, base64::encode_config(payload, base64::URL_SAFE_NO_PAD));
+        let signature = CookieCodec::mac(sign_key, signed.as_bytes())?;
+        Ok(format!("{}.{}", signed, base64::encode_config(signature, base64::URL_SAFE_NO_PAD)))
+    }
+
+    /// Returns the reference the given opaque cookie stands for, failing if it has been sealed by a key that is not
+    /// set anymore or tampered with. Whether it has expired or not is left to the caller
+    pub fn decode(&self, cookie: &str) -> Result<CookieReference, Box<dyn Error>> {
+        let sealed = cookie.strip_prefix(OPAQUE_COOKIE_PREFIX).ok_or(PARSE_FAILED)?;
+        let parts: Vec<&str> = sealed.split('.').collect();
+        if parts.len() != 3 {
+            return Err(PARSE_FAILED.into());
+        }
+
+        let (sign_key, encrypt_key) = match self.keys.iter().find(|(id, _, _)| id == parts[0]) {
+            Some((_, sign_key, encrypt_key)) => (sign_key, encrypt_key),
+            None => return Err(UNAUTHORIZED.into()),
+        };
+
+        let signed = &cookie[..cookie.len() - parts[2].len() - 1];
+        let signature = base64::encode_config(CookieCodec::mac(sign_key, signed.as_bytes())?, base64::URL_SAFE_NO_PAD);
+        if !security::constant_time_eq(&signature, parts[2]) {
+            return Err(UNAUTHORIZED.into());
+        }
+
+        let payload = base64::decode_config(parts[1], base64::URL_SAFE_NO_PAD)?;
+        let plain = match self.encrypt {
+            true => String::from_utf8(security::decrypt_aes(encrypt_key, &payload)?)?,
+            false => String::from_utf8(payload)?,
+        };
+
+        // session ids may have a colon of their own, while the rest of fields never do
+        let mut fields = plain.rsplitn(3, ':');
+        match (fields.next(), fields.next(), fields.next()) {
+            (Some(exp), Some(app), Some(sid)) if sid.len() > 0 => Ok(CookieReference {
+                sid: sid.to_string(),
+                app: app.parse()?,
+                exp: exp.parse()?,
+            }),
+            _ => Err(PARSE_FAILED.into()),
+        }
+    }
+}
+
+/// Tells which write on a session is the latest one among all regions: the one made the latest, or, if made at the
+/// same time, the one of the region whose name goes last. Versions are formatted so they sort the same way as text
+#[derive(Clone, PartialEq, Eq, PartialOrd, Ord, Debug)]
+pub struct Version {
+    pub(super) at: u128, // time in milliseconds
+    pub(super) region: String,
+}
+
+impl Version {
+    pub fn new(region: &str) -> Self {
+        Version {
+            at: time::now().duration_since(UNIX_EPOCH).unwrap_or_default().as_millis(),
+            region: region.to_string(),
+        }
+    }
+
+    pub fn as_string(&self) -> String {
+        format!("{:020}:{}", self.at, self.region)
+    }
+
+    pub fn from_str(version: &str) -> Option<Self> {
+        let mut parts = version.splitn(2, ':');
+        match (parts.next().and_then(|at| at.parse().ok()), parts.next()) {
+            (Some(at), Some(region)) if region.len() > 0 => Some(Version {
+                at: at,
+                region: region.to_string(),
+            }),
+            _ => None,
+        }
+    }
+
+    pub fn get_region(&self) -> &str {
+        &self.region
+    }
+}
+
+/// The sensitive events a user may get logged out everywhere on, so whoever may have got hold of any of its sessions, or
+/// of its credentials, loses them all at once
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum LogoutCause {
+    PasswordChange,
+    CredentialReuse, // the credentials of the user have been found in use somewhere else, such as by a breach
+    Compromise,      // the account is told to be compromised, such as by an administrator or a disowned device
+}
+
+impl LogoutCause {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            LogoutCause::PasswordChange => "password_change",
+            LogoutCause::CredentialReuse => "credential_reuse",
+            LogoutCause::Compromise => "compromise",
+        }
+    }
+
+    pub fn from_str(cause: &str) -> Option<Self> {
+        match cause.trim() {
+            "password_change" => Some(LogoutCause::PasswordChange),
+            "credential_reuse" => Some(LogoutCause::CredentialReuse),
+            "compromise" => Some(LogoutCause::Compromise),
+            _ => None,
+        }
+    }
+
+    /// Parses a comma-separated list of causes, none of them being an empty list
+    pub fn from_list(causes: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        causes.split(',')
+            .filter(|cause| cause.trim().len() > 0)
+            .map(|cause| LogoutCause::from_str(cause).ok_or_else(|| PARSE_FAILED.into()))
+            .collect()
+    }
+
+    /// Returns the reason the sessions of a user logged out everywhere on this cause end for
+    pub fn get_reason(&self) -> LogoutReason {
+        match self {
+            LogoutCause::PasswordChange => LogoutReason::PasswordChange,
+            LogoutCause::CredentialReuse | LogoutCause::Compromise => LogoutReason::Security,
+        }
+    }
+}
+
+/// Why a session has come to an end, as told by introspection, the audit trail and webhooks, so the apps relying on
+/// the session can tell the user accordingly
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum LogoutReason {
+    User,           // the user logged out, or closed its sessions by changing its account
+    Admin,          // an administrator closed the sessions of the user, such as by suspending or revoking them
+    PasswordChange, // the password of the user has changed
+    Security,       // the account, or any of its devices, is told to be compromised
+}
+
+impl LogoutReason {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            LogoutReason::User => "user",
+            LogoutReason::Admin => "admin",
+            LogoutReason::PasswordChange => "password_change",
+            LogoutReason::Security => "security",
+        }
+    }
+
+    pub fn from_str(reason: &str) -> Option<Self> {
+        match reason.trim() {
+            "user" => Some(LogoutReason::User),
+            "admin" => Some(LogoutReason::Admin),
+            "password_change" => Some(LogoutReason::PasswordChange),
+            "security" => Some(LogoutReason::Security),
+            _ => None,
+        }
+    }
+
+    /// Returns the message apps may show the user whose session has ended for this reason
+    pub fn get_message(&self) -> &'static str {
+        match self {
+            LogoutReason::User => "You have been logged out",
+            LogoutReason::Admin => "Your session has been closed by an administrator",
+            LogoutReason::PasswordChange => "Your password has been changed, please log in again",
+            LogoutReason::Security => "Your session has been closed to keep your account safe, please log in again",
+        }
+    }
+
+    /// Returns the reason of the audit event recording a logout for this reason, formatted as <reason>: <details>,
+    /// or just the reason if no details are given
+    pub fn describe(&self, details: &str) -> String {
+        match details {
+            "" => self.as_str().to_string(),
+            details => format!("{}: {}", self.as_str(), details),
+        }
+    }
+
+    /// Parses the reason of an audit event as described by describe, if any
+    pub fn from_description(description: &str) -> Option<Self> {
+        LogoutReason::from_str(description.splitn(2, ':').next().unwrap_or_default())
+    }
+}
+
+/// The error requests fail with when the session of their token has been closed, telling why, if known. It reads as
+/// errors::REVOKED, so it is told apart just as any other error
+#[derive(Debug)]
+pub struct Revoked {
+    pub reason: Option<LogoutReason>,
+}
+
+impl fmt::Display for Revoked {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", REVOKED)
+    }
+}
+
+impl Error for Revoked {}
+
+/// Returns why the session of the request failing with the given error has been closed, if the error tells so
+pub fn get_logout_reason(err: &(dyn Error + 'static)) -> Option<LogoutReason> {
+    err.downcast_ref::<Revoked>().and_then(|err| err.reason)
+}
+
+/// How the sessions of a user are split among the apps it logs into
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Partitioning {
+    Shared,   // a single session serves every app, so logging into one app logs into all of them
+    Isolated, // every app gets a session of its own, so logging out of one app keeps the rest logged in
+}
+
+impl Partitioning {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Partitioning::Shared => "shared",
+            Partitioning::Isolated => "isolated",
+        }
+    }
+
+    pub fn from_str(partitioning: &str) -> Option<Self> {
+        match partitioning {
+            "shared" => Some(Partitioning::Shared),
+            "isolated" => Some(Partitioning::Isolated),
+            _ => None,
+        }
+    }
+}
+
+/// Another region sessions are replicated from, whose store is reachable at the given dsn
+#[derive(Clone, PartialEq, Debug)]
+pub struct Peer {
+    pub(super) region: String,
+    pub(super) dsn: String,
+}
+
+impl Peer {
+    /// Parses a peer formatted as <region>=<dsn>, such as "eu-west=redis://eu-west.example.com:6379"
+    pub fn from_str(peer: &str) -> Result<Self, Box<dyn Error>> {
+        let mut parts = peer.trim().splitn(2, '=');
+        match (parts.next(), parts.next()) {
+            (Some(region), Some(dsn)) if region.len() > 0 && !region.contains(':') && dsn.len() > 0 => Ok(Peer {
+                region: region.to_string(),
+                dsn: dsn.to_string(),
+            }),
+            _ => Err(PARSE_FAILED.into()),
+        }
+    }
+
+    /// Parses a comma-separated list of peers
+    pub fn from_list(peers: &str) -> Result<Vec<Self>, Box<dyn Error>> {
+        peers.split(',')
+            .filter(|peer| peer.trim().len() > 0)
+            .map(Peer::from_str)
+            .collect()
+    }
+
+    pub fn get_region(&self) -> &str {
+        &self.region
+    }
+
+    pub fn get_dsn(&self) -> &str {
+        &self.dsn
+    }
+}
+
+/// What the validation of a session tells, as remembered by the validation cache
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub struct Validation {
+    pub(super) user: i32, // zero for guest sessions
+    pub(super) elevated_until: Option<SystemTime>,
+    pub(super) impersonator: i32, // zero if none
+}
+
+impl Validation {
+    pub fn new(sess: &Session) -> Self {
+        Validation {
+            user: sess.get_user().map(|user| user.get_id()).unwrap_or(0),
+            elevated_until: sess.elevated_until,
+            impersonator: sess.get_impersonator().unwrap_or(0),
+        }
+    }
+
+    pub fn get_user(&self) -> i32 {
+        self.user
+    }
+
+    pub fn get_impersonator(&self) -> i32 {
+        self.impersonator
+    }
+
+    pub fn is_elevated(&self) -> bool {
+        match self.elevated_until {
+            Some(until) => until > time::now(),
+            None => false,
+        }
+    }
+}
+
+/// The latest validated sessions, by id, up to a given amount: once full, the least recently used one gets evicted,
+/// while entries older than the ttl are taken as missing
+pub struct ValidationCache {
+    entries: HashMap<String, (Validation, Instant, u64)>, // along when it was cached and its latest use
+    recency: BTreeMap<u64, String>, // session ids by their latest use, the least recent first
+    uses: u64,
+    capacity: usize,
+    ttl: Duration,
+}
+
+impl ValidationCache {
+    pub fn new(capacity: usize, ttl: Duration) -> Self {
+        ValidationCache {
+            entries: HashMap::new(),
+            recency: BTreeMap::new(),
+            uses: 0,
+            capacity: capacity,
+            ttl: ttl,
+        }
+    }
+
+    pub fn get(&mut self, sid: &str) -> Option<Validation> {
+        let (validation, cached_at, used) = *self.entries.get(sid)?;
+        if cached_at.elapsed() >= self.ttl {
+            self.remove(sid);
+            return None;
+        }
+
+        self.uses += 1;
+        self.recency.remove(&used);
+        self.recency.insert(self.uses, sid.to_string());
+        self.entries.insert(sid.to_string(), (validation, cached_at, self.uses));
+        Some(validation)
+    }
+
+    pub fn insert(&mut self, sid: &str, validation: Validation) {
+        if self.capacity == 0 {
+            return;
+        }
+
+        self.remove(sid);
+        while self.entries.len() >= self.capacity {
+            let least_recent = match self.recency.keys().next() {
+                Some(used) => *used,
+                None => break,
+            };
+
+            if let Some(evicted) = self.recency.remove(&least_recent) {
+                self.entries.remove(&evicted);
+            }
+        }
+
+        self.uses += 1;
+        self.recency.insert(self.uses, sid.to_string());
+        self.entries.insert(sid.to_string(), (validation, Instant::now(), self.uses));
+    }
+
+    pub fn remove(&mut self, sid: &str) {
+        if let Some((_, _, used)) = self.entries.remove(sid) {
+            self.recency.remove(&used);
         }
     }
+
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
 }
 
 
 #[cfg(test)]
 pub mod tests {
+    use std::error::Error;
     use std::time::{SystemTime, Duration};
-    use std::collections::HashMap;
+    use std::collections::{HashMap, HashSet};
     use crate::user::domain::tests::new_user;
     use crate::metadata::domain::InnerMetadata;
     use crate::directory::domain::tests::new_directory;
-    use crate::app::domain::tests::new_app;
-    use crate::time::unix_timestamp;
-    use super::{Session, Token};
+    use crate::app::domain::tests::{new_app, new_app_custom};
+    use crate::time::{unix_timestamp, Clock};
+    use crate::time::tests::FakeClock;
+    use crate::constants::{errors, settings};
+    use super::{Session, Token, Remember, RememberToken, SameSite, CookieAttributes, CookieCodec, CookieReference,
+                Version, Peer, Validation, LogoutCause, LogoutReason, Revoked, Partitioning,
+                ValidationCache, find_inactivity, get_logout_reason};
 
     pub fn new_session() -> Session {
         Session{
             sid: "testing".to_string(),
             deadline: SystemTime::now(),
-            user: new_user(),
+            user: Some(new_user()),
             apps: HashMap::new(),
             meta: InnerMetadata::new(),
+            elevated_until: None,
+            devices: HashSet::new(),
+            impersonator: None,
+            tenant: settings::DEFAULT_TENANT,
+            audience: None,
             sandbox: HashMap::new(),
         }
     }
@@ -165,11 +1056,178 @@ pub mod tests {
         assert!(sess.deadline < after + TIMEOUT);
         assert!(sess.deadline > before + TIMEOUT);
 
-        assert_eq!(sess.user.get_id(), user_id);
+        assert_eq!(sess.get_user().unwrap().get_id(), user_id);
+        assert_eq!(sess.get_tenant(), settings::DEFAULT_TENANT);
+        assert!(!sess.is_guest());
+        assert!(sess.get_audience().is_none());
         assert_eq!(0, sess.apps.len());
         assert_eq!(0, sess.sandbox.len());
     }
 
+    #[test]
+    fn session_new_partition_should_not_fail() {
+        const TIMEOUT: Duration = Duration::from_secs(10);
+
+        let app = new_app();
+        let sess = Session::new_partition(new_user(), &app, TIMEOUT);
+        assert_eq!(Some(app.get_id()), sess.get_audience());
+        assert!(sess.serves(&app));
+        assert!(!sess.is_guest());
+    }
+
+    #[test]
+    fn session_serves_should_not_fail() {
+        let (app, other) = (new_app_custom(1, "http://serves.should.not.fail.com"), new_app_custom(2, "http://other.com"));
+        let sess = Session::new(new_user(), Duration::from_secs(10));
+        assert!(sess.serves(&app) && sess.serves(&other), "shared sessions must serve every app");
+
+        let sess = Session::new_partition(new_user(), &app, Duration::from_secs(10));
+        assert!(sess.serves(&app));
+        assert!(!sess.serves(&other), "partitioned sessions must serve their app only");
+    }
+
+    #[test]
+    fn session_new_guest_should_not_fail() {
+        const TIMEOUT: Duration = Duration::from_secs(10);
+
+        let before = SystemTime::now();
+        let sess = Session::new_guest(2, TIMEOUT);
+        let after = SystemTime::now();
+
+        assert!(sess.deadline < after + TIMEOUT);
+        assert!(sess.deadline > before + TIMEOUT);
+
+        assert_eq!(2, sess.get_tenant());
+        assert!(sess.is_guest());
+        assert!(sess.get_user().is_err());
+        assert_eq!(0, sess.apps.len());
+    }
+
+    #[test]
+    fn session_new_impersonation_should_not_fail() {
+        const TIMEOUT: Duration = Duration::from_secs(10);
+
+        let user = new_user();
+        let user_id = user.get_id();
+
+        let before = SystemTime::now();
+        let sess = Session::new_impersonation(user, 1, TIMEOUT);
+        let after = SystemTime::now();
+
+        assert!(sess.deadline < after + TIMEOUT);
+        assert!(sess.deadline > before + TIMEOUT);
+
+        assert!(sess.is_impersonated());
+        assert_eq!(Some(1), sess.get_impersonator());
+        assert_eq!(user_id, sess.get_user().unwrap().get_id());
+        assert_eq!(1, sess.get_issuer().unwrap());
+    }
+
+    #[test]
+    fn session_get_issuer_should_not_fail() {
+        let sess = new_session();
+        assert!(!sess.is_impersonated());
+        assert_eq!(sess.get_user().unwrap().get_id(), sess.get_issuer().unwrap());
+    }
+
+    #[test]
+    fn session_upgrade_should_not_fail() {
+        const TIMEOUT: Duration = Duration::from_secs(60);
+
+        let mut sess = Session::new_guest(settings::DEFAULT_TENANT, Duration::from_secs(10));
+        sess.sid = "testing".to_string();
+
+        let user = new_user();
+        let user_id = user.get_id();
+
+        let before = SystemTime::now();
+        sess.upgrade(user, TIMEOUT).unwrap();
+        let after = SystemTime::now();
+
+        assert_eq!("testing", sess.sid);
+        assert!(!sess.is_guest());
+        assert_eq!(sess.get_user().unwrap().get_id(), user_id);
+        assert!(sess.deadline >= before + TIMEOUT && sess.deadline <= after + TIMEOUT);
+    }
+
+    #[test]
+    fn session_upgrade_should_fail() {
+        let mut sess = new_session();
+        assert!(sess.upgrade(new_user(), Duration::from_secs(60)).is_err());
+    }
+
+    #[test]
+    fn session_upgrade_another_tenant_should_fail() {
+        let mut sess = Session::new_guest(2, Duration::from_secs(10));
+        assert!(sess.upgrade(new_user(), Duration::from_secs(60)).is_err());
+        assert!(sess.is_guest());
+    }
+
+    #[test]
+    fn session_add_device_should_not_fail() {
+        let mut sess = new_session();
+        assert!(!sess.has_device(1));
+
+        sess.add_device(1);
+        assert!(sess.has_device(1));
+        assert!(!sess.has_device(2));
+    }
+
+    #[test]
+    fn session_elevate_should_not_fail() {
+        const WINDOW: Duration = Duration::from_secs(10);
+
+        let mut sess = new_session();
+        sess.deadline = SystemTime::now() + Duration::from_secs(60);
+        assert!(!sess.is_elevated());
+
+        let before = SystemTime::now();
+        sess.elevate(WINDOW).unwrap();
+        let after = SystemTime::now();
+
+        assert!(sess.is_elevated());
+        let until = sess.elevated_until.unwrap();
+        assert!(until >= before + WINDOW && until <= after + WINDOW);
+    }
+
+    #[test]
+    fn session_elevate_beyond_deadline_should_not_fail() {
+        let mut sess = new_session();
+        sess.deadline = SystemTime::now() + Duration::from_secs(10);
+        sess.elevate(Duration::from_secs(60)).unwrap();
+        assert_eq!(Some(sess.deadline), sess.elevated_until);
+    }
+
+    #[test]
+    fn session_elevation_expired_should_fail() {
+        let clock = FakeClock::install(SystemTime::now());
+        let mut sess = new_session();
+        sess.deadline = clock.now() + Duration::from_secs(60);
+        sess.elevate(Duration::from_secs(10)).unwrap();
+
+        clock.advance(Duration::from_secs(9));
+        assert!(sess.is_elevated());
+        assert!(Validation::new(&sess).is_elevated());
+
+        clock.advance(Duration::from_secs(1));
+        assert!(!sess.is_elevated());
+        assert!(!Validation::new(&sess).is_elevated());
+    }
+
+    #[test]
+    fn session_elevate_guest_should_fail() {
+        let mut sess = Session::new_guest(settings::DEFAULT_TENANT, Duration::from_secs(60));
+        assert!(sess.elevate(Duration::from_secs(10)).is_err());
+        assert!(!sess.is_elevated());
+    }
+
+    #[test]
+    fn session_elevate_impersonated_should_fail() {
+        let mut sess = Session::new_impersonation(new_user(), 1, Duration::from_secs(60));
+        assert!(sess.elevate(Duration::from_secs(10)).is_err());
+        assert!(!sess.is_elevated());
+    }
+
     #[test]
     fn session_set_directory_should_not_fail() {
         let dir = new_directory();
@@ -211,6 +1269,92 @@ pub mod tests {
         assert_eq!("tpauth.alvidir.com", claim.iss);
         assert_eq!(sess.sid, claim.sub);
         assert_eq!(app.get_id(), claim.app);
+        assert!(!claim.guest);
+        assert_eq!(0, claim.impersonator);
+        assert_eq!(sess.tenant, claim.tenant);
+    }
+
+    #[test]
+    fn remember_new_should_not_fail() {
+        const TIMEOUT: Duration = Duration::from_secs(60);
+
+        let user = new_user();
+        let app = new_app();
+
+        let before = SystemTime::now();
+        let remember = Remember::new(&user, &app, TIMEOUT);
+        let after = SystemTime::now();
+
+        assert_eq!("", remember.id);
+        assert_eq!(user.get_id(), remember.user);
+        assert_eq!(user.get_email(), remember.email);
+        assert_eq!(user.get_tenant(), remember.tenant);
+        assert_eq!(app.get_id(), remember.app);
+        assert!(remember.deadline >= before + TIMEOUT && remember.deadline <= after + TIMEOUT);
+        assert!(remember.used_at >= before && remember.used_at <= after);
+        assert!(remember.is_alive());
+    }
+
+    #[test]
+    fn remember_expired_should_fail() {
+        let remember = Remember::new(&new_user(), &new_app(), Duration::from_secs(0));
+        assert!(!remember.is_alive());
+
+        let clock = FakeClock::install(SystemTime::now());
+        let remember = Remember::new(&new_user(), &new_app(), Duration::from_secs(60));
+        clock.advance(Duration::from_secs(59));
+        assert!(remember.is_alive());
+        clock.advance(Duration::from_secs(1));
+        assert!(!remember.is_alive());
+    }
+
+    #[test]
+    fn remember_idle_should_not_fail() {
+        let clock = FakeClock::install(SystemTime::now());
+        let mut remember = Remember::new(&new_user(), &new_app(), Duration::from_secs(3600));
+        clock.advance(Duration::from_secs(59));
+        assert!(!remember.is_idle(Duration::from_secs(60)));
+        clock.advance(Duration::from_secs(1));
+        assert!(remember.is_idle(Duration::from_secs(60)));
+
+        // using it restarts its inactivity window, while its deadline is kept
+        let deadline = remember.deadline;
+        remember.touch();
+        assert!(!remember.is_idle(Duration::from_secs(60)));
+        assert_eq!(deadline, remember.deadline);
+    }
+
+    #[test]
+    fn find_inactivity_should_not_fail() {
+        const WINDOWS: &str = "2592000, 86400@https://bank.example.com";
+        let window = find_inactivity(WINDOWS, "https://bank.example.com").unwrap();
+        assert_eq!(Some(Duration::from_secs(86400)), window);
+
+        let window = find_inactivity(WINDOWS, "https://app.example.com").unwrap();
+        assert_eq!(Some(Duration::from_secs(2592000)), window);
+
+        let window = find_inactivity("86400@https://bank.example.com", "https://app.example.com").unwrap();
+        assert_eq!(None, window);
+        assert_eq!(None, find_inactivity("", "https://app.example.com").unwrap());
+    }
+
+    #[test]
+    fn find_inactivity_should_fail() {
+        for windows in &["0", "thirty", "86400@", "-1@https://app.example.com"] {
+            assert!(find_inactivity(windows, "https://app.example.com").is_err(), "{} should not be parsed", windows);
+        }
+    }
+
+    #[test]
+    fn remember_token_should_not_fail() {
+        let mut remember = Remember::new(&new_user(), &new_app(), Duration::from_secs(60));
+        remember.id = "testing".to_string();
+
+        let claim = RememberToken::new(&remember);
+        assert_eq!(claim.exp, unix_timestamp(remember.deadline));
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!(remember.user, claim.sub);
+        assert_eq!(remember.id, claim.jti);
     }
 
     #[test]
@@ -238,6 +1382,216 @@ pub mod tests {
         assert_eq!(app.get_id(), claim.app);
     }
 
+    #[test]
+    fn cookie_attributes_new_should_fail() {
+        assert!(CookieAttributes::new(None, "/", false, true, SameSite::None).is_err());
+        assert!(CookieAttributes::new(None, "auth", true, true, SameSite::Lax).is_err());
+        assert!(CookieAttributes::new(None, "/", true, true, SameSite::None).is_ok());
+    }
+
+    #[test]
+    fn cookie_attributes_to_header_should_not_fail() {
+        let attrs = CookieAttributes::new(Some("alvidir.com"), "/", true, true, SameSite::Lax).unwrap();
+        assert_eq!("token=abc; Path=/; Max-Age=60; Domain=alvidir.com; Secure; HttpOnly; SameSite=Lax",
+                   attrs.to_header("token", "abc", 60));
+
+        let attrs = CookieAttributes::new(Some(""), "/auth", false, false, SameSite::Strict).unwrap();
+        assert_eq!(None, attrs.get_domain());
+        assert_eq!("token=abc; Path=/auth; Max-Age=0; SameSite=Strict", attrs.to_header("token", "abc", 0));
+    }
+
+    fn new_cookie_keys(ids: &[(&str, u8)]) -> String {
+        let keys: Vec<String> = ids.iter().map(|(id, byte)| format!("{}:{}", id, base64::encode(&[*byte; 32]))).collect();
+        keys.join(",")
+    }
+
+    #[test]
+    fn cookie_codec_should_not_fail() {
+        let reference = CookieReference {sid: "abc:def".to_string(), app: 7, exp: 1700000000};
+        for encrypt in &[false, true] {
+            let codec = CookieCodec::new(&new_cookie_keys(&[("2", 2)]), *encrypt).unwrap();
+            let cookie = codec.encode(&reference).unwrap();
+            assert!(CookieCodec::is_opaque(&cookie));
+            assert!(cookie.starts_with("c1.2."));
+            assert_eq!(reference, codec.decode(&cookie).unwrap());
+            // whole groups of 3 bytes are encoded the same no matter what follows them
+            assert_eq!(!*encrypt, cookie.contains(&base64::encode_config("abc:de", base64::URL_SAFE_NO_PAD)));
+        }
+
+        assert!(!CookieCodec::is_opaque("eyJhbGciOiJFUzI1NiJ9.e30.c2lnbmF0dXJl"));
+    }
+
+    #[test]
+    fn cookie_codec_rotation_should_not_fail() {
+        let reference = CookieReference {sid: "session".to_string(), app: 1, exp: 1700000000};
+        let old = CookieCodec::new(&new_cookie_keys(&[("1", 1)]), false).unwrap();
+        let cookie = old.encode(&reference).unwrap();
+
+        // the former key keeps opening the cookies it has sealed, while the new one seals the rest
+        let rotated = CookieCodec::new(&new_cookie_keys(&[("2", 2), ("1", 1)]), false).unwrap();
+        assert_eq!(reference, rotated.decode(&cookie).unwrap());
+        assert!(rotated.encode(&reference).unwrap().starts_with("c1.2."));
+
+        let dropped = CookieCodec::new(&new_cookie_keys(&[("2", 2)]), false).unwrap();
+        assert!(dropped.decode(&cookie).is_err());
+    }
+
+    #[test]
+    fn cookie_codec_should_fail() {
+        assert!(CookieCodec::new("1", false).is_err());
+        assert!(CookieCodec::new(&format!("1:{}", base64::encode(&[1u8; 16])), false).is_err());
+        assert!(CookieCodec::new(&new_cookie_keys(&[("a.b", 1)]), false).is_err());
+
+        let reference = CookieReference {sid: "session".to_string(), app: 1, exp: 1700000000};
+        let codec = CookieCodec::new(&new_cookie_keys(&[("1", 1)]), false).unwrap();
+        let cookie = codec.encode(&reference).unwrap();
+        let parts: Vec<&str> = cookie.split('.').collect();
+
+        // the payload of another session, along the signature of the genuine one
+        let forged = base64::encode_config("another:1:1700000000", base64::URL_SAFE_NO_PAD);
+        assert!(codec.decode(&format!("c1.1.{}.{}", forged, parts[3])).is_err());
+        assert!(codec.decode(&format!("c1.2.{}.{}", parts[2], parts[3])).is_err());
+        assert!(codec.decode(&cookie[..cookie.len() - 1]).is_err());
+        assert!(codec.decode("c1.1.payload").is_err());
+        assert!(codec.decode("not a cookie").is_err());
+
+        let other = CookieCodec::new(&new_cookie_keys(&[("1", 2)]), false).unwrap();
+        assert!(other.decode(&cookie).is_err());
+
+        let encrypted = CookieCodec::new(&new_cookie_keys(&[("1", 1)]), true).unwrap();
+        assert!(encrypted.decode(&cookie).is_err());
+    }
+
+    #[test]
+    fn cookie_attributes_max_age_should_not_fail() {
+        let exp = unix_timestamp(SystemTime::now() + Duration::from_secs(60));
+        let max_age = CookieAttributes::max_age(exp);
+        assert!(max_age >= 59 && max_age <= 60);
+        assert_eq!(0, CookieAttributes::max_age(unix_timestamp(SystemTime::now()) - 60));
+    }
+
+    #[test]
+    fn same_site_from_str_should_not_fail() {
+        for same_site in &[SameSite::Strict, SameSite::Lax, SameSite::None] {
+            assert_eq!(Some(*same_site), SameSite::from_str(same_site.as_str()));
+        }
+
+        assert_eq!(Some(SameSite::Lax), SameSite::from_str("Lax"));
+        assert_eq!(None, SameSite::from_str("always"));
+    }
+
+    #[test]
+    fn version_from_str_should_not_fail() {
+        let version = Version::new("eu-west");
+        assert_eq!(Some(version.clone()), Version::from_str(&version.as_string()));
+        assert_eq!("eu-west", version.get_region());
+
+        assert_eq!(None, Version::from_str("eu-west"));
+        assert_eq!(None, Version::from_str("1000:"));
+    }
+
+    #[test]
+    fn version_order_should_not_fail() {
+        let older = Version{at: 999, region: "us-east".to_string()};
+        let newer = Version{at: 1000, region: "eu-west".to_string()};
+        let tied = Version{at: 1000, region: "us-east".to_string()};
+
+        assert!(older < newer && newer < tied);
+        assert!(older.as_string() < newer.as_string() && newer.as_string() < tied.as_string());
+    }
+
+    #[test]
+    fn peer_from_list_should_not_fail() {
+        let peers = Peer::from_list("eu-west=redis://eu.example.com:6379, us-east=redis://:pwd@us.example.com,").unwrap();
+        assert_eq!(2, peers.len());
+        assert_eq!("us-east", peers[1].get_region());
+        assert_eq!("redis://:pwd@us.example.com", peers[1].get_dsn());
+
+        for wrong in &["eu-west", "=redis://eu.example.com", "eu-west=", "eu:west=redis://eu.example.com"] {
+            assert!(Peer::from_str(wrong).is_err(), "{} should not be parsed", wrong);
+        }
+    }
+
+    #[test]
+    fn logout_cause_from_list_should_not_fail() {
+        let causes = LogoutCause::from_list("password_change, compromise,").unwrap();
+        assert_eq!(vec![LogoutCause::PasswordChange, LogoutCause::Compromise], causes);
+        assert!(LogoutCause::from_list("").unwrap().is_empty());
+
+        for cause in &[LogoutCause::PasswordChange, LogoutCause::CredentialReuse, LogoutCause::Compromise] {
+            assert_eq!(Some(*cause), LogoutCause::from_str(cause.as_str()));
+        }
+
+        assert!(LogoutCause::from_list("password_change,breach").is_err());
+    }
+
+    #[test]
+    fn logout_reason_from_description_should_not_fail() {
+        for reason in &[LogoutReason::User, LogoutReason::Admin, LogoutReason::PasswordChange, LogoutReason::Security] {
+            assert_eq!(Some(*reason), LogoutReason::from_str(reason.as_str()));
+            assert_eq!(Some(*reason), LogoutReason::from_description(&reason.describe("")));
+            assert_eq!(Some(*reason), LogoutReason::from_description(&reason.describe("some: details")));
+        }
+
+        assert_eq!("admin: leaving the company", LogoutReason::Admin.describe("leaving the company"));
+        assert_eq!(LogoutReason::Security, LogoutCause::CredentialReuse.get_reason());
+        assert_eq!(None, LogoutReason::from_description("https://app.example.com"));
+    }
+
+    #[test]
+    fn get_logout_reason_should_not_fail() {
+        let err: Box<dyn Error> = Box::new(Revoked{reason: Some(LogoutReason::Admin)});
+        assert_eq!(errors::REVOKED, err.to_string());
+        assert_eq!(Some(LogoutReason::Admin), get_logout_reason(&*err));
+
+        let err: Box<dyn Error> = errors::REVOKED.into();
+        assert_eq!(None, get_logout_reason(&*err));
+    }
+
+    #[test]
+    fn partitioning_from_str_should_not_fail() {
+        for partitioning in &[Partitioning::Shared, Partitioning::Isolated] {
+            assert_eq!(Some(*partitioning), Partitioning::from_str(partitioning.as_str()));
+        }
+
+        assert_eq!(None, Partitioning::from_str("unknown"));
+    }
+
+    #[test]
+    fn validation_cache_should_not_fail() {
+        let mut sess = new_session();
+        sess.elevated_until = Some(SystemTime::now() + Duration::from_secs(60));
+        let validation = Validation::new(&sess);
+        assert!(validation.is_elevated());
+
+        let mut cache = ValidationCache::new(2, Duration::from_secs(60));
+        cache.insert("first", validation);
+        cache.insert("second", validation);
+        assert_eq!(Some(validation), cache.get("first"));
+
+        // the second session is the least recently used one by now
+        cache.insert("third", validation);
+        assert_eq!(2, cache.len());
+        assert!(cache.get("second").is_none());
+        assert!(cache.get("first").is_some());
+
+        cache.remove("first");
+        assert!(cache.get("first").is_none());
+        assert_eq!(1, cache.len());
+    }
+
+    #[test]
+    fn validation_cache_expired_should_fail() {
+        let mut cache = ValidationCache::new(2, Duration::from_secs(0));
+        cache.insert("first", Validation::new(&new_session()));
+        assert!(cache.get("first").is_none());
+        assert_eq!(0, cache.len());
+
+        let mut cache = ValidationCache::new(0, Duration::from_secs(60));
+        cache.insert("first", Validation::new(&new_session()));
+        assert_eq!(0, cache.len());
+    }
+
     #[test]
     #[cfg(feature = "integration-tests")]
     fn session_token_expired_should_fail() {
@@ -1,18 +1,51 @@
 use std::error::Error;
+use std::time::{SystemTime, Duration, UNIX_EPOCH};
 use std::sync::{Arc, RwLock, RwLockWriteGuard, RwLockReadGuard};
 use std::collections::{HashMap, HashSet};
 use tonic::{Request, Response, Status};
+use tonic::metadata::MetadataValue;
+use tokio::sync::{broadcast, mpsc};
+use tokio_stream::wrappers::ReceiverStream;
+use serde::{Serialize, Deserialize, de::DeserializeOwned};
+use bson::{Bson, Document};
+use redis::Commands;
+use crate::{logging, status};
+use crate::cache;
+use crate::ulid;
 use crate::security;
-use crate::constants::{settings, errors};
+use crate::constants::{errors, settings};
 use crate::app::domain::App;
+use crate::user::{
+    get_repository as get_user_repository,
+    domain::User,
+};
+use crate::directory::get_repository as get_dir_repository;
+use crate::metadata::domain::InnerMetadata;
+use crate::tenant::framework::get_tenant;
+use crate::tenant::application::{tenant_find, tenant_key_set};
+use crate::ratelimit::framework::rate_limit;
+use crate::detection::framework::get_origin;
+use crate::firewall::framework::ip_filter;
+use crate::credential::application::credential_challenge;
+use crate::time;
+use super::{get_cookie_attributes, get_cookie_codec};
 use super::domain::{
+    CookieAttributes,
+    CookieCodec,
+    CookieReference,
+    Token,
     Session,
     SessionRepository,
-    GroupByAppRepository
+    GroupByAppRepository,
+    Remember,
+    RememberRepository,
+    Version,
+    Peer,
+    get_logout_reason,
 };
 
 // Import the generated rust code into module
-mod proto {
+pub(super) mod proto {
     tonic::include_proto!("session");
 }
 
@@ -21,29 +54,205 @@ use proto::session_service_server::SessionService;
 pub use proto::session_service_server::SessionServiceServer;
 
 // Proto message structs
-use proto::{LoginRequest, LoginResponse};
+use proto::{LoginRequest, LoginResponse, GuestRequest, ProviderLoginRequest};
+use proto::{ElevateRequest, IntrospectRequest, IntrospectResponse, ImpersonateRequest};
+use proto::{ValidateRequest, ValidateResponse, Validation, KeySet};
+use proto::{ChallengeRequest, ChallengeResponse, Cookie};
+use proto::{CheckSessionRequest, CheckSessionResponse};
+
+const SET_COOKIE_HEADER: &str = "set-cookie";
+const LOGOUT_REASON_HEADER: &str = "logout-reason";
+
+// the only claim all tokens have in common, telling how long the cookies holding them must last
+#[derive(Deserialize)]
+pub(super) struct Expiration {
+    pub(super) exp: usize,
+}
+
+/// Returns the value the cookie of the given name holding the given token must have: the token itself or, if cookies
+/// are told to be opaque, the reference to the session of a session token, along with when it expires
+fn get_cookie_value(name: &str, token: &str) -> Result<(String, usize), Box<dyn Error>> {
+    match get_cookie_codec().filter(|_| name == settings::COOKIE_NAME) {
+        Some(codec) => {
+            let claim = security::decode_jwt::<Token>(token)?;
+            let reference = CookieReference {sid: claim.sub, app: claim.app, exp: claim.exp};
+            Ok((codec.encode(&reference)?, claim.exp))
+        },
+        None => Ok((token.to_string(), security::decode_jwt_of_any_kind::<Expiration>(token)?.exp)),
+    }
+}
+
+/// Returns how the given token must be set as a cookie of the given name, as configured by the environment
+pub(super) fn new_cookie(name: &str, token: &str) -> Option<Cookie> {
+    if token.len() == 0 {
+        return None;
+    }
+
+    let (value, max_age) = match get_cookie_value(name, token) {
+        Ok((value, exp)) => (value, CookieAttributes::max_age(exp)),
+        Err(err) => {
+            warn!("could not tell the value of the cookie {}: {}", name, err);
+            return None;
+        }
+    };
+
+    let attrs = get_cookie_attributes();
+    Some(Cookie{
+        name: name.to_string(),
+        domain: attrs.get_domain().unwrap_or_default().to_string(),
+        path: attrs.get_path().to_string(),
+        secure: attrs.is_secure(),
+        http_only: attrs.is_http_only(),
+        same_site: attrs.get_same_site().as_str().to_string(),
+        max_age: max_age,
+        header: attrs.to_header(name, &value, max_age),
+    })
+}
+
+/// Returns the value of the Set-Cookie header setting the given token as a cookie of the given name, as new_cookie
+/// does, for those serving it over plain http
+pub fn new_cookie_header(name: &str, token: &str) -> Option<String> {
+    new_cookie(name, token).map(|cookie| cookie.header)
+}
+
+/// Returns the response providing the given tokens, which tells how to set them as cookies by its own fields as well
+/// as by set-cookie metadata, so a gateway transcoding it into http sets them as is
+fn new_login_response(token: String, remember: String) -> Response<LoginResponse> {
+    let mut response = Response::new(LoginResponse{
+        cookie: new_cookie(settings::COOKIE_NAME, &token),
+        remember_cookie: new_cookie(settings::REMEMBER_COOKIE_NAME, &remember),
+        token: token,
+        remember: remember,
+    });
+
+    let headers: Vec<String> = [&response.get_ref().cookie, &response.get_ref().remember_cookie].iter()
+        .filter_map(|cookie| cookie.as_ref().map(|cookie| cookie.header.clone()))
+        .collect();
+
+    for header in headers {
+        match MetadataValue::from_str(&header) {
+            Ok(value) => {response.metadata_mut().append(SET_COOKIE_HEADER, value);},
+            Err(err) => warn!("could not set cookie header: {}", err),
+        }
+    }
+
+    response
+}
+
+/// Replaces the opaque cookie a request bears as its token, if any, by a session token standing for it, so services
+/// take it as any other token. Requests bearing a token, or none, are let through as they are
+pub fn cookie_interceptor(mut request: Request<()>) -> Result<Request<()>, Status> {
+    let cookie = match request.metadata().get("token").and_then(|token| token.to_str().ok()) {
+        Some(token) if CookieCodec::is_opaque(token) => token.to_string(),
+        _ => return Ok(request),
+    };
+
+    let token = match super::application::session_resolve_cookie(&cookie) {
+        Ok(token) => token,
+        Err(err) => return Err(Status::unauthenticated(err.to_string())),
+    };
+
+    match MetadataValue::from_str(&token) {
+        Ok(token) => {request.metadata_mut().insert("token", token);},
+        Err(err) => return Err(Status::internal(err.to_string())),
+    }
+
+    Ok(request)
+}
 
 pub struct SessionServiceImplementation;
 
 #[tonic::async_trait]
 impl SessionService for SessionServiceImplementation {
     async fn login(&self, request: Request<LoginRequest>) -> Result<Response<LoginResponse>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "session.login", Some(&request.get_ref().ident))?;
+        let tenant = get_tenant(&request)?;
+        let origin = get_origin(&request);
         let msg_ref = request.into_inner();
 
-        match super::application::session_login(&msg_ref.ident,
+        match super::application::session_login(&tenant,
+                                                &msg_ref.ident,
                                                 &msg_ref.pwd,
+                                                &msg_ref.challenge,
+                                                &msg_ref.signature,
                                                 &msg_ref.totp,
-                                                &msg_ref.app) {
+                                                &msg_ref.app,
+                                                msg_ref.terms,
+                                                msg_ref.privacy,
+                                                &msg_ref.attributes,
+                                                &msg_ref.device,
+                                                &msg_ref.device_name,
+                                                &msg_ref.captcha,
+                                                &origin) {
                                                     
+            // so clients retry later, or on another instance, rather than giving up
+            Err(err) if err.to_string() == errors::OVERLOADED => Err(Status::resource_exhausted(errors::OVERLOADED)),
+            Err(err) if err.to_string() == errors::THROTTLED => Err(status::new_exhausted(&*err)),
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(token) => {
+                let mut remember = "".to_string();
+                if msg_ref.remember_me {
+                    remember = match super::application::session_remember(&token) {
+                        Err(err) => return Err(Status::aborted(err.to_string())),
+                        Ok(remember) => remember,
+                    };
+                }
+
+                Ok(new_login_response(token, remember))
+            }
+        }
+    }
+
+    async fn login_with_provider(&self, request: Request<ProviderLoginRequest>) -> Result<Response<LoginResponse>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "session.login", None)?;
+        let tenant = get_tenant(&request)?;
+        let origin = get_origin(&request);
+        let msg_ref = request.into_inner();
+
+        match super::application::session_login_by_provider(&tenant,
+                                                            &msg_ref.provider,
+                                                            &msg_ref.code,
+                                                            &msg_ref.redirect_uri,
+                                                            &msg_ref.totp,
+                                                            &msg_ref.app,
+                                                            msg_ref.terms,
+                                                            msg_ref.privacy,
+                                                            &msg_ref.attributes,
+                                                            &msg_ref.captcha,
+                                                            &origin) {
+
+            Err(err) if err.to_string() == errors::THROTTLED => Err(status::new_exhausted(&*err)),
             Err(err) => Err(Status::aborted(err.to_string())),
             Ok(token) => {
-                Ok(Response::new(LoginResponse{
-                    token: token,
-                }))
+                let mut remember = "".to_string();
+                if msg_ref.remember_me {
+                    remember = match super::application::session_remember(&token) {
+                        Err(err) => return Err(Status::aborted(err.to_string())),
+                        Ok(remember) => remember,
+                    };
+                }
+
+                Ok(new_login_response(token, remember))
             }
         }
     }
 
+    async fn challenge(&self, request: Request<ChallengeRequest>) -> Result<Response<ChallengeResponse>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "session.challenge", Some(&request.get_ref().ident))?;
+        let tenant = get_tenant(&request)?;
+        let msg_ref = request.into_inner();
+
+        match credential_challenge(&tenant, &msg_ref.ident) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(challenge) => Ok(Response::new(ChallengeResponse{
+                challenge: challenge,
+            })),
+        }
+    }
+
     async fn logout(&self, request: Request<()>) -> Result<Response<()>, Status> {
         let metadata = request.metadata();
         if let None = metadata.get("token") {
@@ -63,13 +272,291 @@ impl SessionService for SessionServiceImplementation {
 
         Ok(Response::new(()))
     }
+
+    async fn create_guest_session(&self, request: Request<GuestRequest>) -> Result<Response<LoginResponse>, Status> {
+        logging::dump(request.get_ref());
+        let tenant = get_tenant(&request)?;
+        let msg_ref = request.into_inner();
+
+        match super::application::session_guest(&tenant, &msg_ref.app) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(token) => {
+                Ok(new_login_response(token, "".to_string()))
+            }
+        }
+    }
+
+    async fn refresh(&self, request: Request<()>) -> Result<Response<LoginResponse>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        match super::application::session_refresh(token) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(new_token) => {
+                Ok(new_login_response(new_token, token.to_string()))
+            }
+        }
+    }
+
+    async fn forget(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        if let Err(err) = super::application::session_forget(token){               
+            return Err(Status::aborted(err.to_string()));
+        }
+
+        Ok(Response::new(()))
+    }
+
+    async fn elevate_session(&self, request: Request<ElevateRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::session_elevate(&token,
+                                                  &msg_ref.pwd,
+                                                  &msg_ref.totp) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn impersonate(&self, request: Request<ImpersonateRequest>) -> Result<Response<LoginResponse>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::session_impersonate(&token,
+                                                      &msg_ref.ident,
+                                                      &msg_ref.app,
+                                                      &msg_ref.reason) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(token) => {
+                Ok(new_login_response(token, "".to_string()))
+            }
+        }
+    }
+
+    async fn check_session(&self, request: Request<CheckSessionRequest>) -> Result<Response<CheckSessionResponse>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "session.check", None)?;
+
+        // single-page apps check their session with no idea of whether there is any, so bearing no token, or a wrong
+        // one, just tells there is not
+        let token = request.metadata().get("token")
+            .and_then(|token| token.to_str().ok())
+            .unwrap_or_default()
+            .to_string();
+
+        let msg_ref = request.into_inner();
+        let (token, deadline) = match super::application::session_check(&token, &msg_ref.app) {
+            Ok(check) => check,
+            Err(err) if err.to_string() == errors::QUOTA_EXCEEDED => {
+                return Err(Status::resource_exhausted(err.to_string()));
+            },
+            // the session is still open, but the app must send the user to the login page to get a token
+            Err(err) if [errors::LOGIN_REQUIRED, errors::CONSENT_REQUIRED].contains(&err.to_string().as_str()) => {
+                return Err(Status::failed_precondition(err.to_string()));
+            },
+            Err(err) => {
+                debug!("session is not active anymore: {}", err);
+                return Ok(Response::new(CheckSessionResponse::default()));
+            }
+        };
+
+        let mut response = Response::new(CheckSessionResponse{
+            active: true,
+            expires_at: time::unix_timestamp(deadline) as u64,
+            cookie: new_cookie(settings::COOKIE_NAME, &token),
+            token: token,
+        });
+
+        let header = response.get_ref().cookie.as_ref().map(|cookie| cookie.header.clone());
+        if let Some(header) = header {
+            match MetadataValue::from_str(&header) {
+                Ok(value) => {response.metadata_mut().append(SET_COOKIE_HEADER, value);},
+                Err(err) => warn!("could not set cookie header: {}", err),
+            }
+        }
+
+        Ok(response)
+    }
+
+    async fn introspect(&self, request: Request<IntrospectRequest>) -> Result<Response<IntrospectResponse>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::session_introspect(&token, msg_ref.elevation) {
+            Err(err) => {
+                // revoked sessions tell why by metadata, so clients can tell the user accordingly
+                let mut status = Status::permission_denied(err.to_string());
+                if let Some(reason) = get_logout_reason(&*err) {
+                    status.metadata_mut().insert(LOGOUT_REASON_HEADER, MetadataValue::from_static(reason.as_str()));
+                }
+
+                Err(status)
+            },
+            Ok((user_id, elevated, impersonator)) => Ok(Response::new(
+                IntrospectResponse{
+                    user: user_id,
+                    elevated: elevated,
+                    impersonator: impersonator,
+                }
+            )),
+        }
+    }
+
+    async fn validate_sessions(&self, request: Request<ValidateRequest>) -> Result<Response<ValidateResponse>, Status> {
+        logging::dump(request.get_ref());
+        let msg_ref = request.into_inner();
+        let results = super::application::session_validate(&msg_ref.tokens, msg_ref.elevation)
+            .map_err(|err| Status::invalid_argument(err.to_string()))?
+            .into_iter()
+            .map(|result| match result {
+                Err(err) => Validation {
+                    error: err.to_string(),
+                    logout_reason: get_logout_reason(&*err)
+                        .map(|reason| reason.as_str().to_string())
+                        .unwrap_or_default(),
+                    ..Default::default()
+                },
+                Ok((user_id, elevated, impersonator)) => Validation {
+                    valid: true,
+                    user: user_id,
+                    elevated: elevated,
+                    impersonator: impersonator,
+                    error: "".to_string(),
+                    logout_reason: "".to_string(),
+                },
+            })
+            .collect();
+
+        Ok(Response::new(ValidateResponse{results}))
+    }
+
+    type WatchKeysStream = ReceiverStream<Result<KeySet, Status>>;
+
+    async fn watch_keys(&self, request: Request<()>) -> Result<Response<Self::WatchKeysStream>, Status> {
+        // keys are these of the tenant named by the request, if any, since each tenant may sign by its own key set
+        let tenant = get_tenant(&request)?;
+        let set = tenant_find(&tenant)
+            .map(|tenant| tenant_key_set(tenant.get_id()))
+            .map_err(|err| Status::aborted(err.to_string()))?;
+
+        // subscribing before sending the current keys, so no change in between gets lost
+        let mut changes = security::watch_jwt_keys();
+        let keys = security::get_jwt_public_keys(&set).map_err(|err| Status::aborted(err.to_string()))?;
+        let (sender, receiver) = mpsc::channel(1);
+
+        tokio::spawn(async move {
+            let mut keys = keys;
+            loop {
+                if let Err(_) = sender.send(Ok(KeySet{keys})).await {
+                    return; // the subscriber has gone
+                }
+
+                // lagging behind only means several changes got merged into the latest keys
+                loop {
+                    match changes.recv().await {
+                        Ok(changed) if changed != set => continue, // a key set of other tenants
+                        Ok(_) | Err(broadcast::error::RecvError::Lagged(_)) => break,
+                        Err(broadcast::error::RecvError::Closed) => return,
+                    }
+                }
+
+                keys = match security::get_jwt_public_keys(&set) {
+                    Ok(keys) => keys,
+                    Err(err) => {
+                        let _ = sender.send(Err(Status::aborted(err.to_string()))).await;
+                        return;
+                    }
+                };
+            }
+        });
+
+        Ok(Response::new(ReceiverStream::new(receiver)))
+    }
+}
+
+
+/// Returns the key sessions of the user with the provided email are indexed by, since emails are only unique within
+/// their tenant
+fn get_email_key(tenant: i32, email: &str) -> String {
+    format!("{}:{}", tenant, email)
+}
+
+// emails have no colons, so the keys of the partitions of a user never collide with the key of any other user
+fn get_partition_key(tenant: i32, email: &str, app: i32) -> String {
+    format!("{}:{}", get_email_key(tenant, email), app)
 }
 
+// returns the key the given session is indexed by: the email of its owner, followed by the app it is partitioned to,
+// if any. Guest sessions are not indexed, since they do not belong to any user; neither are impersonated ones, so they
+// never get mixed up with the sessions of the user itself
+fn get_session_key(sess: &Session) -> Option<String> {
+    match (sess.get_user(), sess.get_audience()) {
+        (Ok(_), _) if sess.is_impersonated() => None,
+        (Ok(user), None) => Some(get_email_key(user.get_tenant(), user.get_email())),
+        (Ok(user), Some(app)) => Some(get_partition_key(user.get_tenant(), user.get_email(), app)),
+        (Err(_), _) => None,
+    }
+}
 
 pub struct InMemorySessionRepository {
     all_instances: RwLock<HashMap<String, Arc<RwLock<Session>>>>,
     sids_by_email: RwLock<HashMap<String, String>>,
     group_by_app: RwLock<HashMap<i32, Arc<RwLock<HashSet<String>>>>>,
+    remembers: RwLock<HashMap<String, Remember>>,
 }
 
 impl InMemorySessionRepository {
@@ -89,6 +576,11 @@ impl InMemorySessionRepository {
                 let repo = HashMap::new();
                 RwLock::new(repo)
             },
+
+            remembers: {
+                let repo = HashMap::new();
+                RwLock::new(repo)
+            },
         }
     }
 
@@ -152,9 +644,29 @@ impl InMemorySessionRepository {
         }
     }
 
-    fn get_sid_by_email(&self, email: &str) -> Result<String, Box<dyn Error>> {
+    fn get_readable_remembers(&self) -> Result<RwLockReadGuard<HashMap<String, Remember>>, Box<dyn Error>>{
+        match self.remembers.read() {
+            Ok(remembers) => Ok(remembers),
+            Err(err) => {
+                error!("read-only lock for remembers from session's repo got poisoned: {}", err);
+                Err(errors::POISONED.into())
+            }
+        }
+    }
+
+    fn get_writable_remembers(&self) -> Result<RwLockWriteGuard<HashMap<String, Remember>>, Box<dyn Error>>{
+        match self.remembers.write() {
+            Ok(remembers) => Ok(remembers),
+            Err(err) => {
+                error!("read-write lock for remembers from session's repo got poisoned: {}", err);
+                Err(errors::POISONED.into())
+            }
+        }
+    }
+
+    fn get_sid_by_email(&self, key: &str) -> Result<String, Box<dyn Error>> {
         let by_email = self.get_readable_emails()?;
-        match by_email.get(email) {
+        match by_email.get(key) {
             Some(sid) => Ok(sid.clone()),
             None => Err(errors::NOT_FOUND.into()),  
         }
@@ -172,7 +684,7 @@ impl InMemorySessionRepository {
         let mut repo = self.get_writable_repo()?;
 
         loop { // make sure the token is unique
-            let sid = security::get_random_string(settings::TOKEN_LEN);
+            let sid = ulid::generate();
             if repo.get(&sid).is_none() {
                 session.sid = sid;
                 break;
@@ -195,15 +707,15 @@ impl InMemorySessionRepository {
         Ok(())
     }
 
-    fn insert_sid_by_email(&self, email: &str, sid: &str) -> Result<(), Box<dyn Error>> {
+    fn insert_sid_by_email(&self, key: &str, sid: &str) -> Result<(), Box<dyn Error>> {
         let mut by_email = self.get_writable_emails()?;
-        by_email.insert(email.to_string(), sid.to_string());
+        by_email.insert(key.to_string(), sid.to_string());
         Ok(())
     }
 
-    fn remove_email(&self, email: &str) -> Result<(), Box<dyn Error>> {
+    fn remove_email(&self, key: &str) -> Result<(), Box<dyn Error>> {
         let mut by_email = self.get_writable_emails()?;
-        by_email.remove(email);
+        by_email.remove(key);
         Ok(())
     }
 }
@@ -218,8 +730,8 @@ impl SessionRepository for InMemorySessionRepository {
         Err(errors::NOT_FOUND.into())
     }
 
-    fn find_by_email(&self, email: &str) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
-        let sid = self.get_sid_by_email(email)?;
+    fn find_by_email(&self, tenant: i32, email: &str) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let sid = self.get_sid_by_email(&get_email_key(tenant, email))?;
         
         let repo = self.get_readable_repo()?;
         if let Some(sess_arc) = repo.get(&sid) {
@@ -229,10 +741,30 @@ impl SessionRepository for InMemorySessionRepository {
         }
     }
 
+    fn find_by_email_and_app(&self, tenant: i32, email: &str, app: i32) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let sid = self.get_sid_by_email(&get_partition_key(tenant, email, app))?;
+        SessionRepository::find(self, &sid)
+    }
+
+    fn find_all_by_email(&self, tenant: i32, email: &str) -> Result<Vec<Arc<RwLock<Session>>>, Box<dyn Error>> {
+        let key = get_email_key(tenant, email);
+        let partitions = format!("{}:", key);
+        let sids: Vec<String> = self.get_readable_emails()?.iter()
+            .filter(|(by, _)| **by == key || by.starts_with(&partitions))
+            .map(|(_, sid)| sid.clone())
+            .collect();
+
+        let repo = self.get_readable_repo()?;
+        Ok(sids.iter().filter_map(|sid| repo.get(sid)).map(Arc::clone).collect())
+    }
+
     fn insert(&self, session: Session) -> Result<String, Box<dyn Error>> {
-        let email = session.get_user().get_email().to_string();
-        if let Ok(_) = self.get_sid_by_email(&email) {
-            return Err(errors::ALREADY_EXISTS.into());
+        let email_opt = get_session_key(&session);
+
+        if let Some(email) = &email_opt {
+            if let Ok(_) = self.get_sid_by_email(email) {
+                return Err(errors::ALREADY_EXISTS.into());
+            }
         }
 
         if let Ok(_) = self.get_session_by_sid(session.get_id()) {
@@ -240,15 +772,106 @@ impl SessionRepository for InMemorySessionRepository {
         }
 
         let token = self.insert_session_into_repo(session)?;
-        self.insert_sid_by_email(&email, &token)?;
+        if let Some(email) = &email_opt {
+            self.insert_sid_by_email(email, &token)?;
+        }
+
         Ok(token)
     }
 
+    fn upgrade(&self, token: &str, user: User, timeout: Duration) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let email = get_email_key(user.get_tenant(), user.get_email());
+        if let Ok(_) = self.get_sid_by_email(&email) {
+            return Err(errors::ALREADY_EXISTS.into());
+        }
+
+        let sess_arc = SessionRepository::find(self, token)?;
+        match sess_arc.write() {
+            Ok(mut sess) => sess.upgrade(user, timeout)?,
+            Err(err) => {
+                error!("read-write lock for session got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        self.insert_sid_by_email(&email, token)?;
+        Ok(sess_arc)
+    }
+
+    fn save(&self, _: &Session) -> Result<(), Box<dyn Error>> {
+        // sessions are shared by reference, so any change on them is already in place
+        Ok(())
+    }
+
     fn delete(&self, session: &Session) -> Result<(), Box<dyn Error>> {
         self.remove_session_by_sid(session.get_id())?;
-        self.remove_email(session.get_user().get_email())?;
+        if let Some(email) = get_session_key(session) {
+            self.remove_email(&email)?;
+        }
+
         Ok(())
     }
+
+    fn count(&self) -> Result<usize, Box<dyn Error>> {
+        // expired sessions are kept until the next cleanup, yet they are no longer active
+        let now = time::now();
+        Ok(self.get_readable_repo()?.values()
+            .filter(|sess| sess.read().map(|sess| sess.deadline > now).unwrap_or(false))
+            .count())
+    }
+
+    fn count_by_app(&self) -> Result<HashMap<i32, usize>, Box<dyn Error>> {
+        let now = time::now();
+        let mut by_app = HashMap::new();
+        for sess in self.get_readable_repo()?.values() {
+            match sess.read() {
+                Ok(sess) if sess.deadline > now => for app in sess.apps.keys() {
+                    *by_app.entry(*app).or_insert(0) += 1;
+                },
+                Ok(_) => {},
+                Err(err) => {
+                    error!("read lock for session got poisoned: {}", err);
+                    return Err(errors::POISONED.into());
+                }
+            };
+        }
+
+        Ok(by_app)
+    }
+
+    fn delete_expired(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>> {
+        // sessions being used right now are locked, so they are left until the next time
+        let expired: Vec<(String, Option<String>)> = self.get_readable_repo()?.iter()
+            .filter_map(|(sid, sess)| sess.try_read().ok().filter(|sess| sess.deadline <= now).map(|sess| {
+                (sid.clone(), get_session_key(&sess))
+            }))
+            .take(limit)
+            .collect();
+
+        for (sid, email) in expired.iter() {
+            self.remove_session_by_sid(sid)?;
+            if let Some(email) = email {
+                let mut by_email = self.get_writable_emails()?;
+                if by_email.get(email) == Some(sid) {
+                    by_email.remove(email);
+                }
+            }
+        }
+
+        for group in self.get_readable_group()?.values() {
+            match group.write() {
+                Ok(mut sids) => for (sid, _) in expired.iter() {
+                    sids.remove(sid);
+                },
+                Err(err) => {
+                    error!("read-write lock for group got poisoned: {}", err);
+                    return Err(errors::POISONED.into());
+                }
+            };
+        }
+
+        Ok(expired.len())
+    }
 }
 
 impl GroupByAppRepository for InMemorySessionRepository {
@@ -282,33 +905,905 @@ impl GroupByAppRepository for InMemorySessionRepository {
     }
 }
 
-#[cfg(test)]
-mod tests {
-    use std::time::Duration;
-    use crate::constants::settings;
-    use crate::user::domain::tests::new_user_custom;
-    use crate::app::domain::tests::new_app_custom;
-    use super::super::{
-        get_repository as get_sess_repository,
-        get_group_by_app,
-        domain::Session,
-    };
+impl RememberRepository for InMemorySessionRepository {
+    fn find(&self, id: &str) -> Result<Remember, Box<dyn Error>> {
+        let remembers = self.get_readable_remembers()?;
+        if let Some(remember) = remembers.get(id) {
+            return Ok(remember.clone());
+        }
 
-    #[test]
-    fn session_insert_should_not_fail() {
-        let user = new_user_custom(999, "session_insert_should_not_fail@testing.com");
-        let timeout = Duration::from_secs(10);
-        let sess = Session::new(user, timeout);
+        Err(errors::NOT_FOUND.into())
+    }
+
+    fn insert(&self, mut remember: Remember) -> Result<String, Box<dyn Error>> {
+        let mut remembers = self.get_writable_remembers()?;
         
-        let token = get_sess_repository().insert(sess).unwrap();
-        let sess_arc = get_sess_repository().find(&token).unwrap();
-        let sess = sess_arc.read().unwrap();
+        // expired remember-me sessions are no longer useful
+        remembers.retain(|_, entry| entry.is_alive());
+
+        loop { // make sure the id is unique
+            let id = ulid::generate();
+            if remembers.get(&id).is_none() {
+                remember.id = id;
+                break;
+            }
 
-        assert_eq!(settings::TOKEN_LEN, sess.get_id().len());
+            warn!("collition: generated remember id already exists");
+        }
+
+        let id = remember.id.clone();
+        remembers.insert(id.clone(), remember);
+        Ok(id)
     }
 
-    #[test]
-    fn session_insert_repeated_should_fail() {
+    fn save(&self, remember: &Remember) -> Result<(), Box<dyn Error>> {
+        let mut remembers = self.get_writable_remembers()?;
+        match remembers.get_mut(&remember.id) {
+            Some(entry) => *entry = remember.clone(),
+            None => return Err(errors::NOT_FOUND.into()),
+        }
+
+        Ok(())
+    }
+
+    fn delete(&self, id: &str) -> Result<(), Box<dyn Error>> {
+        let mut remembers = self.get_writable_remembers()?;
+        remembers.remove(id);
+        Ok(())
+    }
+
+    fn delete_all_by_email(&self, tenant: i32, email: &str) -> Result<(), Box<dyn Error>> {
+        let mut remembers = self.get_writable_remembers()?;
+        remembers.retain(|_, entry| entry.get_tenant() != tenant || entry.get_email() != email);
+        Ok(())
+    }
+
+    fn delete_all_by_email_and_app(&self, tenant: i32, email: &str, app: i32) -> Result<(), Box<dyn Error>> {
+        let mut remembers = self.get_writable_remembers()?;
+        remembers.retain(|_, entry| entry.get_tenant() != tenant || entry.get_email() != email || entry.get_app() != app);
+        Ok(())
+    }
+
+    fn delete_expired(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>> {
+        let mut remembers = self.get_writable_remembers()?;
+        let expired: Vec<String> = remembers.iter()
+            .filter(|(_, entry)| entry.deadline <= now)
+            .map(|(id, _)| id.clone())
+            .take(limit)
+            .collect();
+
+        for id in expired.iter() {
+            remembers.remove(id);
+        }
+
+        Ok(expired.len())
+    }
+}
+
+const SESSION_PREFIX: &str = "session";
+const SESSION_EMAIL_PREFIX: &str = "session:email";
+const REMEMBER_PREFIX: &str = "remember";
+const REMEMBER_EMAIL_PREFIX: &str = "remember:email";
+const REPLICATION_STREAM: &str = "replication:sessions";
+const REPLICATION_VERSION_PREFIX: &str = "replication:version";
+const REPLICATION_EMAIL_VERSION_PREFIX: &str = "replication:version:email";
+const REPLICATION_CURSOR_PREFIX: &str = "replication:cursor";
+const UPSERT_OPERATION: &str = "upsert";
+const DELETE_OPERATION: &str = "delete";
+
+// applies a change on a session as told by the conflict resolution rules: revocations are final, so nothing brings a
+// deleted session back; updates made by other regions are discarded unless they are newer than the latest one applied,
+// while these made by this region always apply; the email index only moves to the newer session, and a deletion
+// only drops it while it points to the deleted session. Changes made by this region are published on its stream.
+//
+// KEYS: session, email index, version of the session, version of the email index, stream of changes
+// ARGV: operation, sid, raw session, email key (empty if none), version, ttl, deadline, publish, max stream length
+const REPLICATION_SCRIPT: &str = r"
+local state = redis.call('GET', KEYS[3])
+if state and string.sub(state, 1, 1) == 'd' then
+    return 0
+end
+
+local local_change = ARGV[8] == '1'
+if ARGV[1] == 'upsert' and not local_change and state and string.sub(state, 2) >= ARGV[5] then
+    return 0
+end
+
+if ARGV[1] == 'delete' then
+    redis.call('DEL', KEYS[1])
+    redis.call('SET', KEYS[3], 'd' .. ARGV[5], 'EX', ARGV[6])
+    if ARGV[4] ~= '' and redis.call('GET', KEYS[2]) == ARGV[2] then
+        redis.call('DEL', KEYS[2], KEYS[4])
+    end
+else
+    redis.call('SET', KEYS[1], ARGV[3], 'EX', ARGV[6])
+    redis.call('SET', KEYS[3], 'u' .. ARGV[5], 'EX', ARGV[6])
+    if ARGV[4] ~= '' then
+        local indexed = redis.call('GET', KEYS[4])
+        if local_change or not indexed or indexed < ARGV[5] then
+            redis.call('SET', KEYS[2], ARGV[2], 'EX', ARGV[6])
+            redis.call('SET', KEYS[4], ARGV[5], 'EX', ARGV[6])
+        end
+    end
+end
+
+if local_change then
+    redis.call('XADD', KEYS[5], 'MAXLEN', '~', ARGV[9], '*',
+               'op', ARGV[1], 'sid', ARGV[2], 'raw', ARGV[3], 'email', ARGV[4],
+               'version', ARGV[5], 'deadline', ARGV[7])
+end
+
+return 1
+";
+
+// a change on a session, as published on the stream of the region it has been made by
+struct SessionChange {
+    operation: String,
+    sid: String,
+    raw: Vec<u8>,
+    email: String, // empty if the session is not indexed by email
+    version: String,
+    deadline: f64,
+}
+
+impl SessionChange {
+    fn from_entry(entry: &HashMap<String, Vec<u8>>) -> Result<Self, Box<dyn Error>> {
+        let field = |name: &str| -> Result<String, Box<dyn Error>> {
+            match entry.get(name) {
+                Some(value) => Ok(String::from_utf8(value.clone())?),
+                None => Err(errors::PARSE_FAILED.into()),
+            }
+        };
+
+        let version = field("version")?;
+        if Version::from_str(&version).is_none() {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(SessionChange {
+            operation: field("op")?,
+            sid: field("sid")?,
+            raw: entry.get("raw").cloned().unwrap_or_default(),
+            email: field("email")?,
+            version: version,
+            deadline: field("deadline")?.parse()?,
+        })
+    }
+
+    /// applies the change into the local store, returning whether it has been applied or discarded
+    fn apply(&self, script: &redis::Script, conn: &mut dyn redis::ConnectionLike, publish: bool) -> Result<bool, Box<dyn Error>> {
+        // once the session is over there is nothing left to apply, tombstones included
+        let ttl = match RedisSessionRepository::get_ttl(RedisSessionRepository::from_secs(self.deadline)) {
+            Some(ttl) => ttl,
+            None => return Ok(false),
+        };
+
+        let applied: i32 = script
+            .key(format!("{}:{}", SESSION_PREFIX, self.sid))
+            .key(format!("{}:{}", SESSION_EMAIL_PREFIX, self.email))
+            .key(format!("{}:{}", REPLICATION_VERSION_PREFIX, self.sid))
+            .key(format!("{}:{}", REPLICATION_EMAIL_VERSION_PREFIX, self.email))
+            .key(REPLICATION_STREAM)
+            .arg(&self.operation)
+            .arg(&self.sid)
+            .arg(&self.raw[..])
+            .arg(&self.email)
+            .arg(&self.version)
+            .arg(ttl)
+            .arg(self.deadline)
+            .arg(if publish {"1"} else {"0"})
+            .arg(settings::REPLICATION_STREAM_LEN)
+            .invoke(conn)?;
+
+        Ok(applied == 1)
+    }
+}
+
+#[derive(Serialize, Deserialize)]
+struct RedisSession {
+    pub user: Option<i32>,
+    pub deadline: f64,
+    pub dirs: Vec<String>, // directories are kept by their own repository
+    #[serde(default)] // sessions written by older versions tell no apps
+    pub apps: Vec<i32>, // the apps of the directories, so sessions can be counted by app with no lookup
+    pub elevated_until: Option<f64>,
+    pub devices: Vec<i32>,
+    pub impersonator: Option<i32>,
+    pub tenant: i32,
+    #[serde(default)] // sessions written by older versions are shared by all apps
+    pub audience: Option<i32>,
+    pub sandbox: HashMap<String, String>,
+    pub created_at: f64,
+    pub touch_at: f64,
+}
+
+#[derive(Serialize, Deserialize)]
+struct RedisRemember {
+    pub user: i32,
+    pub email: String,
+    pub tenant: i32,
+    pub app: i32,
+    pub deadline: f64,
+    #[serde(default)] // remember-me sessions written by older versions tell no usage
+    pub used_at: Option<f64>,
+}
+
+/// Keeps sessions and remember-me sessions in a redis cluster, where they expire by themselves once their deadline is
+/// over, so they can be shared by several instances of the service. Groups by app only track the sessions served by
+/// each instance, so they are kept in memory
+///
+/// If a region is given, every change on a session is versioned and published for the peers of the region to
+/// replicate it, as told by the conflict resolution rules of the replication script
+pub struct RedisSessionRepository {
+    // sessions already built by this instance, as well as the raw value they were built from
+    cache: RwLock<HashMap<String, (Vec<u8>, Arc<RwLock<Session>>)>>,
+    groups: InMemorySessionRepository,
+    region: Option<String>,
+    script: redis::Script,
+}
+
+impl RedisSessionRepository {
+    pub fn new(region: Option<&str>) -> Self {
+        RedisSessionRepository {
+            cache: {
+                let repo = HashMap::new();
+                RwLock::new(repo)
+            },
+
+            groups: InMemorySessionRepository::new(),
+            region: region.map(str::to_string),
+            script: redis::Script::new(REPLICATION_SCRIPT),
+        }
+    }
+
+    fn get_readable_cache(&self) -> Result<RwLockReadGuard<HashMap<String, (Vec<u8>, Arc<RwLock<Session>>)>>, Box<dyn Error>> {
+        match self.cache.read() {
+            Ok(cache) => Ok(cache),
+            Err(err) => {
+                error!("read-only lock for cache from session's repo got poisoned: {}", err);
+                Err(errors::POISONED.into())
+            }
+        }
+    }
+
+    fn get_writable_cache(&self) -> Result<RwLockWriteGuard<HashMap<String, (Vec<u8>, Arc<RwLock<Session>>)>>, Box<dyn Error>> {
+        match self.cache.write() {
+            Ok(cache) => Ok(cache),
+            Err(err) => {
+                error!("read-write lock for cache from session's repo got poisoned: {}", err);
+                Err(errors::POISONED.into())
+            }
+        }
+    }
+
+    fn as_secs(time: SystemTime) -> Result<f64, Box<dyn Error>> {
+        Ok(time.duration_since(UNIX_EPOCH)?.as_secs_f64())
+    }
+
+    fn from_secs(secs: f64) -> SystemTime {
+        UNIX_EPOCH + Duration::from_secs_f64(secs)
+    }
+
+    /// returns how many seconds are left until the provided deadline, if any
+    fn get_ttl(deadline: SystemTime) -> Option<usize> {
+        match deadline.duration_since(time::now()) {
+            Ok(left) if left.as_secs() > 0 => Some(left.as_secs() as usize),
+            _ => None,
+        }
+    }
+
+    fn encode_remember(remember: &Remember) -> Result<Vec<u8>, Box<dyn Error>> {
+        RedisSessionRepository::encode(&RedisRemember {
+            user: remember.user,
+            email: remember.email.clone(),
+            tenant: remember.tenant,
+            app: remember.app,
+            deadline: RedisSessionRepository::as_secs(remember.deadline)?,
+            used_at: Some(RedisSessionRepository::as_secs(remember.used_at)?),
+        })
+    }
+
+    fn encode<T: Serialize>(value: &T) -> Result<Vec<u8>, Box<dyn Error>> {
+        let mut raw = Vec::new();
+        match bson::to_bson(value)? {
+            Bson::Document(doc) => doc.to_writer(&mut raw)?,
+            _ => return Err(errors::PARSE_FAILED.into()),
+        }
+
+        Ok(raw)
+    }
+
+    fn decode<T: DeserializeOwned>(raw: &[u8]) -> Result<T, Box<dyn Error>> {
+        let mut reader = raw;
+        let doc = Document::from_reader(&mut reader)?;
+        Ok(bson::from_bson(Bson::Document(doc))?)
+    }
+
+    fn build(sid: &str, raw: &[u8]) -> Result<Session, Box<dyn Error>> {
+        let redis_sess: RedisSession = RedisSessionRepository::decode(raw)?;
+
+        // the owner is loaded again, so the session is always built from the up to date user
+        let mut user_opt = None;
+        if let Some(user_id) = redis_sess.user {
+            let user = get_user_repository().find(user_id)?;
+            user_opt = Some(user);
+        }
+
+        let mut apps = HashMap::new();
+        for dir_id in redis_sess.dirs.iter() {
+            // the directory may have been removed along with its app
+            match get_dir_repository().find(dir_id) {
+                Ok(dir) => {apps.insert(dir.get_app(), dir);},
+                Err(err) => warn!("directory {} of session {} could not be found: {}", dir_id, sid, err),
+            }
+        }
+
+        Ok(Session{
+            sid: sid.to_string(),
+            deadline: RedisSessionRepository::from_secs(redis_sess.deadline),
+            user: user_opt,
+            apps: apps,
+            meta: InnerMetadata {
+                created_at: RedisSessionRepository::from_secs(redis_sess.created_at),
+                touch_at: RedisSessionRepository::from_secs(redis_sess.touch_at),
+            },
+            elevated_until: redis_sess.elevated_until.map(RedisSessionRepository::from_secs),
+            devices: redis_sess.devices.into_iter().collect(),
+            impersonator: redis_sess.impersonator,
+            tenant: redis_sess.tenant,
+            audience: redis_sess.audience,
+            sandbox: redis_sess.sandbox,
+        })
+    }
+
+    fn parse_session(sess: &Session) -> Result<Vec<u8>, Box<dyn Error>> {
+        let mut elevated_until = None;
+        if let Some(until) = sess.elevated_until {
+            elevated_until = Some(RedisSessionRepository::as_secs(until)?);
+        }
+
+        let redis_sess = RedisSession {
+            user: sess.user.as_ref().map(|user| user.get_id()),
+            deadline: RedisSessionRepository::as_secs(sess.deadline)?,
+            dirs: sess.apps.values().map(|dir| dir.get_id().to_string()).collect(),
+            apps: sess.apps.keys().cloned().collect(),
+            elevated_until: elevated_until,
+            devices: sess.devices.iter().cloned().collect(),
+            impersonator: sess.impersonator,
+            tenant: sess.tenant,
+            audience: sess.audience,
+            sandbox: sess.sandbox.clone(),
+            created_at: RedisSessionRepository::as_secs(sess.meta.created_at)?,
+            touch_at: RedisSessionRepository::as_secs(sess.meta.touch_at)?,
+        };
+
+        RedisSessionRepository::encode(&redis_sess)
+    }
+
+    /// returns the key the provided session is indexed by email, if any. Guest sessions are not indexed by email,
+    /// since they do not belong to any user; neither are impersonated ones, so they never get mixed up with the
+    /// session of the user itself
+    /// applies the given operation on the provided session as a change made by this region
+    fn replicate(&self, region: &str, operation: &str, sess: &Session, raw: Vec<u8>) -> Result<(), Box<dyn Error>> {
+        let change = SessionChange {
+            operation: operation.to_string(),
+            sid: sess.sid.clone(),
+            raw: raw,
+            email: get_session_key(sess).unwrap_or_default(),
+            version: Version::new(region).as_string(),
+            deadline: RedisSessionRepository::as_secs(sess.deadline)?,
+        };
+
+        let mut conn = cache::get_connection()?;
+        if !change.apply(&self.script, &mut *conn, true)? {
+            // the session has been revoked by another region
+            return Err(errors::NOT_FOUND.into());
+        }
+
+        Ok(())
+    }
+
+    /// stores the provided session until its deadline, returning the raw value it has been stored as
+    fn write_session(&self, sess: &Session) -> Result<Vec<u8>, Box<dyn Error>> {
+        let raw = RedisSessionRepository::parse_session(sess)?;
+        if let (Some(region), Some(_)) = (&self.region, RedisSessionRepository::get_ttl(sess.deadline)) {
+            // the session is indexed by email along with the change, so both get replicated at once
+            self.replicate(region, UPSERT_OPERATION, sess, raw.clone())?;
+            return Ok(raw);
+        }
+
+        let key = format!("{}:{}", SESSION_PREFIX, sess.sid);
+        let mut conn = cache::get_connection()?;
+        let _: () = match RedisSessionRepository::get_ttl(sess.deadline) {
+            Some(ttl) => conn.set_ex(key, raw.clone(), ttl)?,
+            None => conn.del(key)?, // the session is already over
+        };
+
+        Ok(raw)
+    }
+
+    fn write_sid_by_email(&self, key: &str, sess: &Session) -> Result<(), Box<dyn Error>> {
+        if self.region.is_some() {
+            return Ok(()); // already indexed when writing the session
+        }
+
+        let key = format!("{}:{}", SESSION_EMAIL_PREFIX, key);
+
+        let mut conn = cache::get_connection()?;
+        let _: () = match RedisSessionRepository::get_ttl(sess.deadline) {
+            Some(ttl) => conn.set_ex(key, sess.get_id(), ttl)?,
+            None => conn.del(key)?,
+        };
+
+        Ok(())
+    }
+
+    fn get_sid_by_email(&self, key: &str) -> Result<String, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let sid: Option<String> = conn.get(format!("{}:{}", SESSION_EMAIL_PREFIX, key))?;
+        match sid {
+            Some(sid) => Ok(sid),
+            None => Err(errors::NOT_FOUND.into()),
+        }
+    }
+
+    fn cache_session(&self, raw: Vec<u8>, sess: Session) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let mut cache = self.get_writable_cache()?;
+
+        // expired sessions are no longer useful; these being used right now are kept until the next time
+        cache.retain(|_, (_, sess_arc)| match sess_arc.try_read() {
+            Ok(sess) => sess.deadline > time::now(),
+            Err(_) => true,
+        });
+
+        let sid = sess.sid.clone();
+        let arc = Arc::new(RwLock::new(sess));
+        cache.insert(sid, (raw, Arc::clone(&arc)));
+        Ok(arc)
+    }
+}
+
+impl SessionRepository for RedisSessionRepository {
+    fn find(&self, token: &str) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let raw: Option<Vec<u8>> = { // block is required because of connection release
+            let mut conn = cache::get_connection()?;
+            conn.get(format!("{}:{}", SESSION_PREFIX, token))?
+        };
+
+        let raw = match raw {
+            Some(raw) => raw,
+            None => {
+                // the session has expired or has been removed by another instance
+                self.get_writable_cache()?.remove(token);
+                return Err(errors::NOT_FOUND.into());
+            }
+        };
+
+        // the cached session is only reused while it has not been changed by any other instance
+        if let Some((cached, sess_arc)) = self.get_readable_cache()?.get(token) {
+            if *cached == raw {
+                return Ok(Arc::clone(sess_arc));
+            }
+        }
+
+        let sess = RedisSessionRepository::build(token, &raw)?;
+        self.cache_session(raw, sess)
+    }
+
+    fn find_by_email(&self, tenant: i32, email: &str) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let sid = self.get_sid_by_email(&get_email_key(tenant, email))?;
+        SessionRepository::find(self, &sid)
+    }
+
+    fn find_by_email_and_app(&self, tenant: i32, email: &str, app: i32) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let sid = self.get_sid_by_email(&get_partition_key(tenant, email, app))?;
+        SessionRepository::find(self, &sid)
+    }
+
+    fn find_all_by_email(&self, tenant: i32, email: &str) -> Result<Vec<Arc<RwLock<Session>>>, Box<dyn Error>> {
+        let key = get_email_key(tenant, email);
+        let mut keys = vec![key.clone()];
+        { // block is required because of connection release
+            let mut conn = cache::get_connection()?;
+            let prefix = format!("{}:", SESSION_EMAIL_PREFIX);
+            let partitions = conn.scan_match::<_, String>(format!("{}{}:*", prefix, key))?
+                .filter_map(|partition| partition.strip_prefix(&prefix).map(str::to_string))
+                .collect::<Vec<String>>();
+
+            keys.extend(partitions);
+        }
+
+        // the session may have expired or been removed since it was scanned
+        Ok(keys.iter()
+            .filter_map(|key| self.get_sid_by_email(key).ok())
+            .filter_map(|sid| SessionRepository::find(self, &sid).ok())
+            .collect())
+    }
+
+    fn insert(&self, mut session: Session) -> Result<String, Box<dyn Error>> {
+        let email_opt = get_session_key(&session);
+
+        if let Some(email) = &email_opt {
+            if let Ok(_) = self.get_sid_by_email(email) {
+                return Err(errors::ALREADY_EXISTS.into());
+            }
+        }
+
+        { // block is required because of connection release
+            let mut conn = cache::get_connection()?;
+            loop { // make sure the token is unique
+                let sid = ulid::generate();
+                let exists: bool = conn.exists(format!("{}:{}", SESSION_PREFIX, sid))?;
+                if !exists {
+                    session.sid = sid;
+                    break;
+                }
+
+                warn!("collition: generated sid already exists");
+            }
+        }
+
+        let raw = self.write_session(&session)?;
+        if let Some(email) = &email_opt {
+            self.write_sid_by_email(email, &session)?;
+        }
+
+        let token = session.sid.clone();
+        self.cache_session(raw, session)?;
+        Ok(token)
+    }
+
+    fn upgrade(&self, token: &str, user: User, timeout: Duration) -> Result<Arc<RwLock<Session>>, Box<dyn Error>> {
+        let email = get_email_key(user.get_tenant(), user.get_email());
+        if let Ok(_) = self.get_sid_by_email(&email) {
+            return Err(errors::ALREADY_EXISTS.into());
+        }
+
+        let sess_arc = SessionRepository::find(self, token)?;
+        match sess_arc.write() {
+            Ok(mut sess) => {
+                sess.upgrade(user, timeout)?;
+                SessionRepository::save(self, &sess)?;
+                self.write_sid_by_email(&email, &sess)?;
+            },
+
+            Err(err) => {
+                error!("read-write lock for session got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        Ok(sess_arc)
+    }
+
+    fn save(&self, session: &Session) -> Result<(), Box<dyn Error>> {
+        let raw = self.write_session(session)?;
+        if let Some((cached, _)) = self.get_writable_cache()?.get_mut(session.get_id()) {
+            *cached = raw;
+        }
+
+        Ok(())
+    }
+
+    fn delete(&self, session: &Session) -> Result<(), Box<dyn Error>> {
+        if let Some(region) = &self.region {
+            // a session revoked by another region in the meanwhile is gone already
+            match self.replicate(region, DELETE_OPERATION, session, Vec::new()) {
+                Err(err) if err.to_string() != errors::NOT_FOUND => return Err(err),
+                _ => {},
+            }
+
+            self.get_writable_cache()?.remove(session.get_id());
+            return Ok(());
+        }
+
+        { // block is required because of connection release
+            let mut conn = cache::get_connection()?;
+            let _: () = conn.del(format!("{}:{}", SESSION_PREFIX, session.get_id()))?;
+
+            if let Some(key) = get_session_key(session) {
+                let _: () = conn.del(format!("{}:{}", SESSION_EMAIL_PREFIX, key))?;
+            }
+        }
+
+        self.get_writable_cache()?.remove(session.get_id());
+        Ok(())
+    }
+
+    fn count(&self) -> Result<usize, Box<dyn Error>> {
+        // sessions are shared by all instances, so all of them count the same ones
+        let mut conn = cache::get_connection()?;
+        let email_prefix = format!("{}:", SESSION_EMAIL_PREFIX);
+        let count = conn.scan_match::<_, String>(format!("{}:*", SESSION_PREFIX))?
+            .filter(|key| !key.starts_with(&email_prefix))
+            .count();
+
+        Ok(count)
+    }
+
+    fn count_by_app(&self) -> Result<HashMap<i32, usize>, Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let email_prefix = format!("{}:", SESSION_EMAIL_PREFIX);
+        let keys: Vec<String> = conn.scan_match::<_, String>(format!("{}:*", SESSION_PREFIX))?
+            .filter(|key| !key.starts_with(&email_prefix))
+            .collect();
+
+        let mut by_app = HashMap::new();
+        for key in keys.iter() {
+            // the session may have expired since it was scanned
+            let raw: Option<Vec<u8>> = conn.get(key)?;
+            if let Some(raw) = raw {
+                let redis_sess: RedisSession = RedisSessionRepository::decode(&raw)?;
+                for app in redis_sess.apps.iter() {
+                    *by_app.entry(*app).or_insert(0) += 1;
+                }
+            }
+        }
+
+        Ok(by_app)
+    }
+
+    fn delete_expired(&self, now: SystemTime, limit: usize) -> Result<usize, Box<dyn Error>> {
+        // sessions expire by themselves in redis, so only the ones cached by this instance are left to drop; these
+        // being used right now are kept until the next time
+        let mut cache = self.get_writable_cache()?;
+        let expired: Vec<String> = cache.iter()
+            .filter(|(_, (_, sess_arc))| sess_arc.try_read().map(|sess| sess.deadline <= now).unwrap_or(false))
+            .map(|(sid, _)| sid.clone())
+            .take(limit)
+            .collect();
+
+        for sid in expired.iter() {
+            cache.remove(sid);
+        }
+
+        Ok(expired.len())
+    }
+}
+
+impl GroupByAppRepository for RedisSessionRepository {
+    fn find(&self, app: &App) -> Result<Arc<RwLock<HashSet<String>>>, Box<dyn Error>> {
+        GroupByAppRepository::find(&self.groups, app)
+    }
+
+    fn insert(&self, app: &App) -> Result<(), Box<dyn Error>> {
+        GroupByAppRepository::insert(&self.groups, app)
+    }
+
+    fn delete(&self, app: &App) -> Result<(), Box<dyn Error>> {
+        GroupByAppRepository::delete(&self.groups, app)
+    }
+}
+
+impl RememberRepository for RedisSessionRepository {
+    fn find(&self, id: &str) -> Result<Remember, Box<dyn Error>> {
+        let raw: Option<Vec<u8>> = { // block is required because of connection release
+            let mut conn = cache::get_connection()?;
+            conn.get(format!("{}:{}", REMEMBER_PREFIX, id))?
+        };
+
+        let redis_remember: RedisRemember = match raw {
+            Some(raw) => RedisSessionRepository::decode(&raw)?,
+            None => return Err(errors::NOT_FOUND.into()),
+        };
+
+        // the ones telling no usage are taken as unused since they were created
+        let deadline = RedisSessionRepository::from_secs(redis_remember.deadline);
+        let used_at = match redis_remember.used_at {
+            Some(used_at) => RedisSessionRepository::from_secs(used_at),
+            None => deadline.checked_sub(Duration::from_secs(settings::REMEMBER_TIMEOUT)).unwrap_or(UNIX_EPOCH),
+        };
+
+        Ok(Remember {
+            id: id.to_string(),
+            user: redis_remember.user,
+            email: redis_remember.email,
+            tenant: redis_remember.tenant,
+            app: redis_remember.app,
+            deadline: deadline,
+            used_at: used_at,
+        })
+    }
+
+    fn insert(&self, mut remember: Remember) -> Result<String, Box<dyn Error>> {
+        let raw = RedisSessionRepository::encode_remember(&remember)?;
+        let ttl = match RedisSessionRepository::get_ttl(remember.deadline) {
+            Some(ttl) => ttl,
+            None => return Err(errors::UNAUTHORIZED.into()), // the remember-me session is already over
+        };
+
+        let mut conn = cache::get_connection()?;
+        loop { // make sure the id is unique
+            let id = ulid::generate();
+            let exists: bool = conn.exists(format!("{}:{}", REMEMBER_PREFIX, id))?;
+            if !exists {
+                remember.id = id;
+                break;
+            }
+
+            warn!("collition: generated remember id already exists");
+        }
+
+        // remember-me sessions are indexed by email as well, so all of them can be revoked at once
+        let by_email = format!("{}:{}", REMEMBER_EMAIL_PREFIX, get_email_key(remember.tenant, &remember.email));
+        let _: () = conn.set_ex(format!("{}:{}", REMEMBER_PREFIX, remember.id), raw, ttl)?;
+        let _: () = conn.sadd(&by_email, &remember.id)?;
+        let _: () = conn.expire(&by_email, ttl)?;
+        Ok(remember.id)
+    }
+
+    fn save(&self, remember: &Remember) -> Result<(), Box<dyn Error>> {
+        let raw = RedisSessionRepository::encode_remember(remember)?;
+        let ttl = match RedisSessionRepository::get_ttl(remember.deadline) {
+            Some(ttl) => ttl,
+            None => return Err(errors::NOT_FOUND.into()), // the remember-me session is already over
+        };
+
+        // the value is only replaced if there is any, so a remember-me session revoked meanwhile stays revoked
+        let mut conn = cache::get_connection()?;
+        let saved: Option<String> = redis::cmd("SET")
+            .arg(format!("{}:{}", REMEMBER_PREFIX, remember.id))
+            .arg(raw)
+            .arg("XX")
+            .arg("EX")
+            .arg(ttl)
+            .query(&mut *conn)?;
+
+        match saved {
+            Some(_) => Ok(()),
+            None => Err(errors::NOT_FOUND.into()),
+        }
+    }
+
+    fn delete(&self, id: &str) -> Result<(), Box<dyn Error>> {
+        let mut conn = cache::get_connection()?;
+        let _: () = conn.del(format!("{}:{}", REMEMBER_PREFIX, id))?;
+        Ok(())
+    }
+
+    fn delete_all_by_email(&self, tenant: i32, email: &str) -> Result<(), Box<dyn Error>> {
+        let by_email = format!("{}:{}", REMEMBER_EMAIL_PREFIX, get_email_key(tenant, email));
+
+        let mut conn = cache::get_connection()?;
+        let ids: Vec<String> = conn.smembers(&by_email)?;
+        for id in ids.iter() {
+            let _: () = conn.del(format!("{}:{}", REMEMBER_PREFIX, id))?;
+        }
+
+        let _: () = conn.del(&by_email)?;
+        Ok(())
+    }
+
+    fn delete_all_by_email_and_app(&self, tenant: i32, email: &str, app: i32) -> Result<(), Box<dyn Error>> {
+        let by_email = format!("{}:{}", REMEMBER_EMAIL_PREFIX, get_email_key(tenant, email));
+
+        let mut conn = cache::get_connection()?;
+        let ids: Vec<String> = conn.smembers(&by_email)?;
+        for id in ids.iter() {
+            let raw: Option<Vec<u8>> = conn.get(format!("{}:{}", REMEMBER_PREFIX, id))?;
+            let redis_remember: RedisRemember = match raw {
+                Some(raw) => RedisSessionRepository::decode(&raw)?,
+                None => { // the remember-me session is already over
+                    let _: () = conn.srem(&by_email, id)?;
+                    continue;
+                },
+            };
+
+            if redis_remember.app == app {
+                let _: () = conn.del(format!("{}:{}", REMEMBER_PREFIX, id))?;
+                let _: () = conn.srem(&by_email, id)?;
+            }
+        }
+
+        Ok(())
+    }
+
+    fn delete_expired(&self, _: SystemTime, _: usize) -> Result<usize, Box<dyn Error>> {
+        // remember-me sessions expire by themselves in redis
+        Ok(0)
+    }
+}
+
+/// Pulls the changes on sessions published by each of the peers, applying them into the local store as told by the
+/// conflict resolution rules. How far each stream has been read is kept in the local store as well
+pub struct RedisSessionReplicator {
+    peers: Vec<(Peer, redis::Client)>,
+    script: redis::Script,
+}
+
+impl RedisSessionReplicator {
+    pub fn new(peers: Vec<Peer>) -> Result<Self, Box<dyn Error>> {
+        let mut clients = Vec::new();
+        for peer in peers.into_iter() {
+            let client = redis::Client::open(peer.get_dsn())?;
+            clients.push((peer, client));
+        }
+
+        Ok(RedisSessionReplicator {
+            peers: clients,
+            script: redis::Script::new(REPLICATION_SCRIPT),
+        })
+    }
+
+    /// applies up to batch changes from each of the peers, returning how many of them have been applied. Peers that
+    /// cannot be reached are skipped until the next time
+    pub fn pull(&self, batch: usize) -> Result<usize, Box<dyn Error>> {
+        let mut applied = 0;
+        for (peer, client) in self.peers.iter() {
+            match self.pull_from(peer, client, batch) {
+                Ok(count) => applied += count,
+                Err(err) => warn!("changes on sessions could not be pulled from region {}: {}", peer.get_region(), err),
+            }
+        }
+
+        Ok(applied)
+    }
+
+    fn pull_from(&self, peer: &Peer, client: &redis::Client, batch: usize) -> Result<usize, Box<dyn Error>> {
+        let cursor_key = format!("{}:{}", REPLICATION_CURSOR_PREFIX, peer.get_region());
+        let mut conn = cache::get_connection()?;
+        let cursor: Option<String> = conn.get(&cursor_key)?;
+        let cursor = cursor.unwrap_or("0".to_string());
+
+        let mut remote = client.get_connection()?;
+        let reply: Option<Vec<(String, Vec<(String, HashMap<String, Vec<u8>>)>)>> = redis::cmd("XREAD")
+            .arg("COUNT").arg(batch)
+            .arg("STREAMS").arg(REPLICATION_STREAM).arg(&cursor)
+            .query(&mut remote)?;
+
+        let entries = match reply.and_then(|streams| streams.into_iter().next()) {
+            Some((_, entries)) => entries,
+            None => return Ok(0), // nothing new
+        };
+
+        let mut applied = 0;
+        for (id, entry) in entries.iter() {
+            // malformed changes are skipped, so they never stop the replication
+            match SessionChange::from_entry(entry) {
+                Ok(change) => if change.apply(&self.script, &mut *conn, false)? {
+                    applied += 1;
+                },
+                Err(err) => warn!("change {} from region {} could not be parsed: {}", id, peer.get_region(), err),
+            }
+
+            let _: () = conn.set(&cursor_key, id)?;
+        }
+
+        Ok(applied)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{SystemTime, Duration};
+    use crate::constants::settings;
+    use crate::ulid::ULID_LEN;
+    use crate::user::domain::tests::new_user_custom;
+    use crate::app::domain::tests::new_app_custom;
+    use super::super::{
+        get_repository as get_sess_repository,
+        get_group_by_app,
+        get_remember_repository,
+        domain::{Session, Remember},
+    };
+    use crate::directory::domain::Directory;
+    use super::{RedisSessionRepository, RedisRemember};
+
+    #[test]
+    fn session_insert_should_not_fail() {
+        let user = new_user_custom(999, "session_insert_should_not_fail@testing.com");
+        let timeout = Duration::from_secs(10);
+        let sess = Session::new(user, timeout);
+        
+        let token = get_sess_repository().insert(sess).unwrap();
+        let sess_arc = get_sess_repository().find(&token).unwrap();
+        let sess = sess_arc.read().unwrap();
+
+        assert_eq!(ULID_LEN, sess.get_id().len());
+    }
+
+    #[test]
+    fn session_insert_repeated_should_fail() {
         let user = new_user_custom(999, "session_insert_repeated_should_fail@testing.com");
         let timeout = Duration::from_secs(10);
         let sess = Session::new(user, timeout);
@@ -328,7 +1823,50 @@ mod tests {
         let sess = Session::new(user, timeout);
         
         get_sess_repository().insert(sess).unwrap();
-        assert!(get_sess_repository().find_by_email("session_find_by_email_should_not_fail@testing.com").is_ok());
+        assert!(get_sess_repository().find_by_email(settings::DEFAULT_TENANT, "session_find_by_email_should_not_fail@testing.com").is_ok());
+    }
+
+    #[test]
+    fn session_find_by_email_and_app_should_not_fail() {
+        const EMAIL: &str = "session_find_by_email_and_app_should_not_fail@testing.com";
+        let app = new_app_custom(333, "http://session.find.by.email.and.app.should.not.fail.com");
+        let timeout = Duration::from_secs(10);
+
+        let shared = get_sess_repository().insert(Session::new(new_user_custom(999, EMAIL), timeout)).unwrap();
+        let sess = Session::new_partition(new_user_custom(999, EMAIL), &app, timeout);
+        let partition = get_sess_repository().insert(sess).unwrap();
+
+        // the partition of an app is indexed apart from the shared session, so both of them coexist
+        let sess_arc = get_sess_repository().find_by_email_and_app(settings::DEFAULT_TENANT, EMAIL, app.get_id()).unwrap();
+        assert_eq!(partition, sess_arc.read().unwrap().get_id());
+        let sess_arc = get_sess_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        assert_eq!(shared, sess_arc.read().unwrap().get_id());
+        assert!(get_sess_repository().find_by_email_and_app(settings::DEFAULT_TENANT, EMAIL, 444).is_err());
+
+        let mut sids: Vec<String> = get_sess_repository().find_all_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap()
+            .iter()
+            .map(|sess_arc| sess_arc.read().unwrap().get_id().to_string())
+            .collect();
+
+        sids.sort();
+        let mut want = vec![shared, partition.clone()];
+        want.sort();
+        assert_eq!(want, sids);
+
+        let sess_arc = get_sess_repository().find(&partition).unwrap();
+        get_sess_repository().delete(&sess_arc.read().unwrap()).unwrap();
+        assert!(get_sess_repository().find_by_email_and_app(settings::DEFAULT_TENANT, EMAIL, app.get_id()).is_err());
+        assert!(get_sess_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).is_ok());
+    }
+
+    #[test]
+    fn session_find_by_email_another_tenant_should_fail() {
+        let user = new_user_custom(999, "session_find_by_email_another_tenant_should_fail@testing.com");
+        let timeout = Duration::from_secs(10);
+        let sess = Session::new(user, timeout);
+        
+        get_sess_repository().insert(sess).unwrap();
+        assert!(get_sess_repository().find_by_email(2, "session_find_by_email_another_tenant_should_fail@testing.com").is_err());
     }
 
     #[test]
@@ -345,6 +1883,70 @@ mod tests {
         assert!(get_sess_repository().find(&token).is_err());
     }
 
+    #[test]
+    fn session_upgrade_should_not_fail() {
+        let timeout = Duration::from_secs(10);
+        let sess = Session::new_guest(settings::DEFAULT_TENANT, timeout);
+        
+        let token = get_sess_repository().insert(sess).unwrap();
+        let user = new_user_custom(999, "session_upgrade_should_not_fail@testing.com");
+        get_sess_repository().upgrade(&token, user, timeout).unwrap();
+
+        let sess_arc = get_sess_repository().find_by_email(settings::DEFAULT_TENANT, "session_upgrade_should_not_fail@testing.com").unwrap();
+        let sess = sess_arc.read().unwrap();
+        assert_eq!(token, sess.get_id());
+        assert!(!sess.is_guest());
+    }
+
+    #[test]
+    fn session_upgrade_registered_should_fail() {
+        let user = new_user_custom(999, "session_upgrade_registered_should_fail@testing.com");
+        let timeout = Duration::from_secs(10);
+        let sess = Session::new(user, timeout);
+        
+        let token = get_sess_repository().insert(sess).unwrap();
+        let user = new_user_custom(999, "session_upgrade_registered_should_fail.other@testing.com");
+        assert!(get_sess_repository().upgrade(&token, user, timeout).is_err());
+    }
+
+    #[test]
+    fn session_delete_expired_should_not_fail() {
+        let user = new_user_custom(999, "session_delete_expired_should_not_fail@testing.com");
+        let expired = Session::new(user, Duration::from_secs(0));
+        let expired = get_sess_repository().insert(expired).unwrap();
+
+        let user = new_user_custom(999, "session_delete_expired_should_not_fail.alive@testing.com");
+        let alive = Session::new(user, Duration::from_secs(60));
+        let alive = get_sess_repository().insert(alive).unwrap();
+
+        let now = SystemTime::now() + Duration::from_secs(1);
+        assert!(get_sess_repository().delete_expired(now, 100).unwrap() >= 1);
+        assert!(get_sess_repository().find(&expired).is_err());
+        assert!(get_sess_repository().find_by_email(settings::DEFAULT_TENANT, "session_delete_expired_should_not_fail@testing.com").is_err());
+        assert!(get_sess_repository().find(&alive).is_ok());
+    }
+
+    #[test]
+    fn session_count_by_app_should_not_fail() {
+        let user = new_user_custom(999, "session_count_by_app_should_not_fail@testing.com");
+        let app = new_app_custom(444, "http://session.count.by.app.should.not.fail.com");
+        let mut sess = Session::new(user, Duration::from_secs(60));
+        let dir = Directory::new(&sess, &app).unwrap();
+        sess.set_directory(dir).unwrap();
+        get_sess_repository().insert(sess).unwrap();
+
+        let user = new_user_custom(999, "session_count_by_app_should_not_fail.expired@testing.com");
+        let mut sess = Session::new(user, Duration::from_secs(0));
+        let dir = Directory::new(&sess, &app).unwrap();
+        sess.set_directory(dir).unwrap();
+        get_sess_repository().insert(sess).unwrap();
+
+        // expired sessions are no longer active, even if not removed yet
+        let by_app = get_sess_repository().count_by_app().unwrap();
+        assert_eq!(Some(&1), by_app.get(&444));
+        assert!(get_sess_repository().count().unwrap() >= 1);
+    }
+
     #[test]
     fn group_by_app_insert_should_not_fail() {
         let app = new_app_custom(111, "http://group.by.app.insert.should.not.fail.com");
@@ -359,4 +1961,102 @@ mod tests {
         assert!(get_group_by_app().delete(&app).is_ok());
         assert!(get_group_by_app().find(&app).is_err());
     }
+
+    #[test]
+    fn remember_insert_should_not_fail() {
+        let user = new_user_custom(999, "remember_insert_should_not_fail@testing.com");
+        let app = new_app_custom(333, "http://remember.insert.should.not.fail.com");
+        let remember = Remember::new(&user, &app, Duration::from_secs(10));
+
+        let id = get_remember_repository().insert(remember).unwrap();
+        let remember = get_remember_repository().find(&id).unwrap();
+        assert_eq!(ULID_LEN, remember.get_id().len());
+
+        assert!(get_remember_repository().delete(&id).is_ok());
+        assert!(get_remember_repository().find(&id).is_err());
+    }
+
+    #[test]
+    fn remember_save_should_not_fail() {
+        let user = new_user_custom(999, "remember_save_should_not_fail@testing.com");
+        let app = new_app_custom(333, "http://remember.save.should.not.fail.com");
+        let id = get_remember_repository().insert(Remember::new(&user, &app, Duration::from_secs(10))).unwrap();
+
+        let mut remember = get_remember_repository().find(&id).unwrap();
+        remember.used_at = SystemTime::now() + Duration::from_secs(5);
+        assert!(get_remember_repository().save(&remember).is_ok());
+
+        let saved = get_remember_repository().find(&id).unwrap();
+        let drift = saved.get_used_at().duration_since(remember.used_at).unwrap_or_else(|err| err.duration());
+        assert!(drift < Duration::from_millis(1));
+
+        // revoked remember-me sessions are never brought back
+        get_remember_repository().delete(&id).unwrap();
+        assert!(get_remember_repository().save(&remember).is_err());
+        assert!(get_remember_repository().find(&id).is_err());
+    }
+
+    #[test]
+    fn remember_delete_all_by_email_should_not_fail() {
+        const EMAIL: &str = "remember_delete_all_by_email_should_not_fail@testing.com";
+
+        let user = new_user_custom(999, EMAIL);
+        let app = new_app_custom(444, "http://remember.delete.all.by.email.should.not.fail.com");
+
+        let first = get_remember_repository().insert(Remember::new(&user, &app, Duration::from_secs(10))).unwrap();
+        let second = get_remember_repository().insert(Remember::new(&user, &app, Duration::from_secs(10))).unwrap();
+
+        assert!(get_remember_repository().delete_all_by_email(settings::DEFAULT_TENANT, EMAIL).is_ok());
+        assert!(get_remember_repository().find(&first).is_err());
+        assert!(get_remember_repository().find(&second).is_err());
+    }
+
+    #[test]
+    fn remember_delete_expired_should_not_fail() {
+        let user = new_user_custom(999, "remember_delete_expired_should_not_fail@testing.com");
+        let app = new_app_custom(555, "http://remember.delete.expired.should.not.fail.com");
+
+        let expired = get_remember_repository().insert(Remember::new(&user, &app, Duration::from_secs(0))).unwrap();
+        let alive = get_remember_repository().insert(Remember::new(&user, &app, Duration::from_secs(60))).unwrap();
+
+        let now = SystemTime::now() + Duration::from_secs(1);
+        assert!(get_remember_repository().delete_expired(now, 100).unwrap() >= 1);
+        assert!(get_remember_repository().find(&expired).is_err());
+        assert!(get_remember_repository().find(&alive).is_ok());
+    }
+
+    #[test]
+    fn redis_get_ttl_should_not_fail() {
+        let deadline = SystemTime::now() + Duration::from_secs(60);
+        let ttl = RedisSessionRepository::get_ttl(deadline).unwrap();
+        assert!(ttl > 0 && ttl <= 60);
+    }
+
+    #[test]
+    fn redis_get_ttl_should_fail() {
+        assert!(RedisSessionRepository::get_ttl(SystemTime::now()).is_none());
+        assert!(RedisSessionRepository::get_ttl(SystemTime::now() - Duration::from_secs(60)).is_none());
+    }
+
+    #[test]
+    fn redis_remember_encode_should_not_fail() {
+        let redis_remember = RedisRemember {
+            user: 999,
+            email: "redis_remember_encode_should_not_fail@testing.com".to_string(),
+            tenant: settings::DEFAULT_TENANT,
+            app: 444,
+            deadline: 60.5,
+            used_at: Some(30.5),
+        };
+
+        let raw = RedisSessionRepository::encode(&redis_remember).unwrap();
+        let decoded: RedisRemember = RedisSessionRepository::decode(&raw).unwrap();
+
+        assert_eq!(decoded.user, redis_remember.user);
+        assert_eq!(decoded.email, redis_remember.email);
+        assert_eq!(decoded.tenant, redis_remember.tenant);
+        assert_eq!(decoded.app, redis_remember.app);
+        assert_eq!(decoded.deadline, redis_remember.deadline);
+        assert_eq!(decoded.used_at, redis_remember.used_at);
+    }
 }
\ No newline at end of file
@@ -0,0 +1,312 @@
+use std::error::Error;
+use prost::Message;
+use tonic::{Code, Request, Response, Status};
+use tonic::metadata::MetadataValue;
+use crate::{logging, status};
+use crate::security;
+use crate::constants::{errors, settings};
+use crate::user::domain::User;
+use crate::user::application::{user_info, user_missing_attributes};
+use crate::device::application::device_find;
+use crate::tenant::framework::get_tenant;
+use crate::ratelimit::framework::rate_limit;
+use crate::detection::framework::get_origin;
+use super::framework::{proto as v1, new_cookie, Expiration};
+use super::domain::{self, get_logout_reason};
+
+// Import the generated rust code into module
+mod proto {
+    tonic::include_proto!("session.v2");
+}
+
+// Proto generated server traits
+use proto::session_service_server::SessionService;
+pub use proto::session_service_server::SessionServiceServer;
+
+// Proto message structs
+use proto::{LoginRequest, LoginResponse, IntrospectRequest, IntrospectResponse};
+use proto::{Tokens, Cookie, UserSummary, DeviceInfo, ErrorDetail, Reason, Hint, Status as SessionStatus, LogoutReason};
+
+const SET_COOKIE_HEADER: &str = "set-cookie";
+const EXPIRED_SIGNATURE: &str = "ExpiredSignature"; // as jsonwebtoken tells an expired token
+
+/// Returns the status code, the reason and the hints telling how to go on, for the given error
+fn get_reason(err: &str) -> (Code, Reason, Vec<Hint>) {
+    match err {
+        errors::NOT_FOUND | errors::UNAUTHORIZED => (Code::Unauthenticated, Reason::InvalidCredentials, vec![]),
+        errors::MFA_REQUIRED => (Code::Unauthenticated, Reason::MfaRequired, vec![Hint::ProvideTotp]),
+        errors::NOT_VERIFIED => (Code::FailedPrecondition, Reason::NotVerified, vec![Hint::VerifyEmail]),
+        errors::SUSPENDED => (Code::PermissionDenied, Reason::Suspended, vec![]),
+        errors::NOT_ACTIVATED => (Code::FailedPrecondition, Reason::NotActivated, vec![Hint::ActivateAccount]),
+        errors::EXPIRED | errors::REVOKED | EXPIRED_SIGNATURE => (Code::Unauthenticated, Reason::InvalidCredentials, vec![]),
+        errors::RESET_REQUIRED => (Code::FailedPrecondition, Reason::ResetRequired, vec![Hint::ResetPassword]),
+        errors::CAPTCHA_REQUIRED => (Code::FailedPrecondition, Reason::CaptchaRequired, vec![Hint::SolveCaptcha]),
+        errors::POLICY_REQUIRED => (Code::FailedPrecondition, Reason::PolicyRequired, vec![Hint::AcceptPolicies]),
+        errors::ELEVATION_REQUIRED => (Code::PermissionDenied, Reason::ElevationRequired, vec![Hint::ElevateSession]),
+        errors::THROTTLED | errors::TOO_MANY_REQUESTS | errors::QUOTA_EXCEEDED => (Code::ResourceExhausted, Reason::RateLimited, vec![Hint::RetryLater]),
+        errors::OVERLOADED => (Code::ResourceExhausted, Reason::Overloaded, vec![Hint::RetryLater]),
+        errors::LOGIN_DENIED | errors::IP_NOT_ALLOWED | errors::ISSUANCE_DENIED => (Code::PermissionDenied, Reason::Denied, vec![]),
+        errors::FEATURE_DISABLED => (Code::PermissionDenied, Reason::FeatureDisabled, vec![]),
+        err if err.starts_with(errors::PROFILE_INCOMPLETE) => {
+            (Code::FailedPrecondition, Reason::ProfileIncomplete, vec![Hint::CompleteProfile])
+        },
+        _ => (Code::Aborted, Reason::Unspecified, vec![]),
+    }
+}
+
+/// Returns where the session stands after a request failing with the given error
+fn get_session_status(err: &str) -> SessionStatus {
+    match err {
+        errors::EXPIRED | EXPIRED_SIGNATURE => SessionStatus::Expired,
+        errors::REVOKED => SessionStatus::Revoked,
+        errors::MFA_REQUIRED => SessionStatus::RequiresMfa,
+        errors::SUSPENDED => SessionStatus::Suspended,
+        errors::THROTTLED => SessionStatus::Locked,
+        err if err.starts_with(errors::PROFILE_INCOMPLETE) => SessionStatus::RequiresProfile,
+        _ => SessionStatus::Unspecified,
+    }
+}
+
+/// Returns the given reason a session has come to an end for as told by the service
+fn into_logout_reason(reason: domain::LogoutReason) -> LogoutReason {
+    match reason {
+        domain::LogoutReason::User => LogoutReason::User,
+        domain::LogoutReason::Admin => LogoutReason::Admin,
+        domain::LogoutReason::PasswordChange => LogoutReason::PasswordChange,
+        domain::LogoutReason::Security => LogoutReason::Security,
+    }
+}
+
+/// Returns the status for the given error, with its details telling why the request failed and how to go on, and why
+/// the session has come to an end, if revoked, as well as how long to wait before retrying, if told, by its retry-after
+/// metadata
+fn new_status(err: Box<dyn Error>) -> Status {
+    let message = err.to_string();
+    let (code, reason, hints) = get_reason(&message);
+    let detail = ErrorDetail {
+        reason: reason as i32,
+        message: message.clone(),
+        hints: hints.into_iter().map(|hint| hint as i32).collect(),
+        missing: user_missing_attributes(&message).unwrap_or_default(),
+        status: get_session_status(&message) as i32,
+        retry_after: status::get_retry_after(&*err).map(status::as_retry_secs).unwrap_or_default(),
+        logout_reason: get_logout_reason(&*err).map(into_logout_reason).unwrap_or(LogoutReason::Unspecified) as i32,
+    };
+
+    status::with_retry_after(Status::with_details(code, message, detail.encode_to_vec().into()), &*err)
+}
+
+/// Returns the token in the metadata of the given request
+fn get_token<T>(request: &Request<T>) -> Result<String, Status> {
+    match request.metadata().get("token") {
+        None => Err(Status::failed_precondition("token required")),
+        Some(token) => match token.to_str() {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(token) => Ok(token.to_string()),
+        },
+    }
+}
+
+fn get_expiration(token: &str) -> u64 {
+    if token.len() == 0 {
+        return 0;
+    }
+
+    security::decode_jwt_of_any_kind::<Expiration>(token).map(|claim| claim.exp as u64).unwrap_or_default()
+}
+
+fn into_cookie(cookie: v1::Cookie) -> Cookie {
+    Cookie {
+        name: cookie.name,
+        domain: cookie.domain,
+        path: cookie.path,
+        secure: cookie.secure,
+        http_only: cookie.http_only,
+        same_site: cookie.same_site,
+        max_age: cookie.max_age,
+        header: cookie.header,
+    }
+}
+
+fn new_user_summary(user: &User) -> UserSummary {
+    UserSummary {
+        id: user.get_id(),
+        email: user.get_email().to_string(),
+        tenant: user.get_tenant(),
+        verified: user.is_verified(),
+        mfa: user.get_secret().is_some(),
+    }
+}
+
+/// Returns the response providing the given tokens, as well as the user owning them and the device, if any, they have
+/// been issued for. As in version 1, the cookies are set by set-cookie metadata as well
+fn new_login_response(access: String, refresh: String, device: &str) -> Result<Response<LoginResponse>, Status> {
+    let (user, _) = user_info(&access).map_err(new_status)?;
+    let device = match device.len() {
+        0 => None,
+        _ => device_find(&user, device).ok().map(|device| DeviceInfo{
+            id: device.get_id(),
+            name: device.get_name().to_string(),
+            trusted: device.is_trusted(),
+        }),
+    };
+
+    let cookies: Vec<Cookie> = [(settings::COOKIE_NAME, &access), (settings::REMEMBER_COOKIE_NAME, &refresh)].iter()
+        .filter_map(|(name, token)| new_cookie(name, token))
+        .map(into_cookie)
+        .collect();
+
+    let headers: Vec<String> = cookies.iter().map(|cookie| cookie.header.clone()).collect();
+    let mut response = Response::new(LoginResponse{
+        tokens: Some(Tokens{
+            access_expires_at: get_expiration(&access),
+            refresh_expires_at: get_expiration(&refresh),
+            access: access,
+            refresh: refresh,
+            cookies: cookies,
+        }),
+        user: Some(new_user_summary(&user)),
+        device: device,
+        status: SessionStatus::Alive as i32,
+    });
+
+    for header in headers {
+        match MetadataValue::from_str(&header) {
+            Ok(value) => {response.metadata_mut().append(SET_COOKIE_HEADER, value);},
+            Err(err) => warn!("could not set cookie header: {}", err),
+        }
+    }
+
+    Ok(response)
+}
+
+pub struct SessionServiceImplementation;
+
+#[tonic::async_trait]
+impl SessionService for SessionServiceImplementation {
+    async fn login(&self, request: Request<LoginRequest>) -> Result<Response<LoginResponse>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "session.login", Some(&request.get_ref().ident))?;
+        let tenant = get_tenant(&request)?;
+        let origin = get_origin(&request);
+        let msg_ref = request.into_inner();
+        let device = msg_ref.device.unwrap_or_default();
+
+        let token = super::application::session_login(&tenant,
+                                                      &msg_ref.ident,
+                                                      &msg_ref.pwd,
+                                                      &msg_ref.challenge,
+                                                      &msg_ref.signature,
+                                                      &msg_ref.totp,
+                                                      &msg_ref.app,
+                                                      msg_ref.terms,
+                                                      msg_ref.privacy,
+                                                      &msg_ref.attributes,
+                                                      &device.fingerprint,
+                                                      &device.name,
+                                                      &msg_ref.captcha,
+                                                      &origin).map_err(new_status)?;
+
+        let mut remember = "".to_string();
+        if msg_ref.remember_me {
+            remember = super::application::session_remember(&token).map_err(new_status)?;
+        }
+
+        new_login_response(token, remember, &device.fingerprint)
+    }
+
+    async fn refresh(&self, request: Request<()>) -> Result<Response<LoginResponse>, Status> {
+        let token = get_token(&request)?;
+        let new_token = super::application::session_refresh(&token).map_err(new_status)?;
+        new_login_response(new_token, token, "")
+    }
+
+    async fn logout(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        let token = get_token(&request)?;
+        super::application::session_logout(&token).map_err(new_status)?;
+        Ok(Response::new(()))
+    }
+
+    async fn introspect(&self, request: Request<IntrospectRequest>) -> Result<Response<IntrospectResponse>, Status> {
+        logging::dump(request.get_ref());
+        let token = get_token(&request)?;
+        let msg_ref = request.into_inner();
+
+        let (user_id, elevated, impersonator) = super::application::session_introspect(&token, msg_ref.elevation)
+            .map_err(new_status)?;
+
+        let user = match user_id {
+            0 => None,
+            _ => Some(new_user_summary(&user_info(&token).map_err(new_status)?.0)),
+        };
+
+        Ok(Response::new(IntrospectResponse{
+            user: user,
+            elevated: elevated,
+            impersonator: impersonator,
+            expires_at: get_expiration(&token),
+            status: SessionStatus::Alive as i32,
+        }))
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::Duration;
+    use prost::Message;
+    use tonic::Code;
+    use crate::status;
+    use crate::constants::errors;
+    use super::super::domain::{self, Revoked};
+    use super::{get_reason, get_session_status, new_status, proto::{Reason, Hint, Status, ErrorDetail, LogoutReason}};
+
+    #[test]
+    fn get_reason_should_not_fail() {
+        assert_eq!((Code::Unauthenticated, Reason::MfaRequired, vec![Hint::ProvideTotp]), get_reason(errors::MFA_REQUIRED));
+        assert_eq!((Code::Unauthenticated, Reason::InvalidCredentials, vec![]), get_reason(errors::NOT_FOUND));
+        assert_eq!((Code::ResourceExhausted, Reason::RateLimited, vec![Hint::RetryLater]), get_reason(errors::THROTTLED));
+        assert_eq!((Code::ResourceExhausted, Reason::Overloaded, vec![Hint::RetryLater]), get_reason(errors::OVERLOADED));
+        assert_eq!((Code::Aborted, Reason::Unspecified, vec![]), get_reason("something else"));
+    }
+
+    #[test]
+    fn get_session_status_should_not_fail() {
+        assert_eq!(Status::Expired, get_session_status(errors::EXPIRED));
+        assert_eq!(Status::Expired, get_session_status("ExpiredSignature"));
+        assert_eq!(Status::Revoked, get_session_status(errors::REVOKED));
+        assert_eq!(Status::RequiresMfa, get_session_status(errors::MFA_REQUIRED));
+        assert_eq!(Status::RequiresProfile, get_session_status(&format!("{}: given_name", errors::PROFILE_INCOMPLETE)));
+        assert_eq!(Status::Suspended, get_session_status(errors::SUSPENDED));
+        assert_eq!(Status::Locked, get_session_status(errors::THROTTLED));
+        assert_eq!(Status::Unspecified, get_session_status(errors::NOT_FOUND));
+    }
+
+    #[test]
+    fn new_status_with_retry_should_not_fail() {
+        let status = new_status(status::retry_after(errors::THROTTLED, Duration::from_secs(540)));
+        assert_eq!(Code::ResourceExhausted, status.code());
+        assert_eq!("540", status.metadata().get("retry-after").unwrap().to_str().unwrap());
+
+        let detail = ErrorDetail::decode(status.details()).unwrap();
+        assert_eq!(Status::Locked as i32, detail.status);
+        assert_eq!(540, detail.retry_after);
+
+        let detail = ErrorDetail::decode(new_status(errors::THROTTLED.into()).details()).unwrap();
+        assert_eq!(0, detail.retry_after);
+    }
+
+    #[test]
+    fn new_status_with_logout_reason_should_not_fail() {
+        let err = Box::new(Revoked{reason: Some(domain::LogoutReason::PasswordChange)});
+        let status = new_status(err);
+        assert_eq!(Code::Unauthenticated, status.code());
+
+        let detail = ErrorDetail::decode(status.details()).unwrap();
+        assert_eq!(Status::Revoked as i32, detail.status);
+        assert_eq!(LogoutReason::PasswordChange as i32, detail.logout_reason);
+
+        let detail = ErrorDetail::decode(new_status(errors::REVOKED.into()).details()).unwrap();
+        assert_eq!(LogoutReason::Unspecified as i32, detail.logout_reason);
+    }
+}
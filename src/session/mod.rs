@@ -1,17 +1,152 @@
 pub mod framework;
+pub mod framework_v2;
 pub mod application;
 pub mod domain;
 
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::Duration;
+use crate::storage::{self, Backend};
+use crate::constants::{environment, settings};
+use crate::config;
+use crate::keyring::application::{keyring_get, keyring_on_rotate};
+
 lazy_static! {
-    static ref REPO_PROVIDER: framework::InMemorySessionRepository = {
-        framework::InMemorySessionRepository::new()
+    static ref REPO_PROVIDER: Box<dyn domain::SessionStorage> = {
+        match storage::get_session_backend() {
+            Backend::Memory => Box::new(framework::InMemorySessionRepository::new()),
+            Backend::Redis => Box::new(framework::RedisSessionRepository::new(REPLICATION_REGION.as_deref())),
+            backend => storage::unsupported(backend, "sessions"),
+        }
     }; 
+
+    static ref REPLICATION_REGION: Option<String> = config::get(environment::REPLICATION_REGION).ok();
+
+    static ref REPLICATOR: Option<framework::RedisSessionReplicator> = {
+        if REPLICATION_REGION.is_none() {
+            return None;
+        }
+
+        if storage::get_session_backend() != Backend::Redis {
+            panic!("session replication requires redis storage for sessions");
+        }
+
+        let peers = keyring_get(environment::REPLICATION_PEERS).unwrap_or_default();
+        let peers = domain::Peer::from_list(&peers).expect("replication peers must be a list of <region>=<dsn>");
+        Some(framework::RedisSessionReplicator::new(peers).expect("replication peers must be valid redis dsn"))
+    };
+
+    // sessions validated the latest, so gateways validating the same cookie over and over do not hit the store every
+    // time; a ttl of zero turns the cache off
+    static ref VALIDATION_CACHE: Mutex<domain::ValidationCache> = {
+        let ttl = match config::get(environment::VALIDATION_CACHE_TTL) {
+            Ok(secs) => secs.parse().expect("validation cache ttl must be a number of seconds"),
+            Err(_) => settings::VALIDATION_CACHE_TTL,
+        };
+
+        let capacity = if ttl > 0 {settings::VALIDATION_CACHE_SIZE} else {0};
+        Mutex::new(domain::ValidationCache::new(capacity, Duration::from_secs(ttl)))
+    };
+
+    static ref COOKIE_ATTRIBUTES: domain::CookieAttributes = {
+        fn flag(name: &str) -> bool {
+            match config::get(name) {
+                Ok(value) => value.parse().unwrap_or_else(|_| panic!("{} must be either true or false", name)),
+                Err(_) => true,
+            }
+        }
+
+        let domain = config::get(environment::COOKIE_DOMAIN).ok();
+        let path = config::get(environment::COOKIE_PATH).unwrap_or(settings::COOKIE_PATH.to_string());
+        let same_site = config::get(environment::COOKIE_SAME_SITE).unwrap_or(settings::COOKIE_SAME_SITE.to_string());
+        let same_site = domain::SameSite::from_str(&same_site).expect("cookie same site must be strict, lax or none");
+
+        domain::CookieAttributes::new(domain.as_deref(),
+                                      &path,
+                                      flag(environment::COOKIE_SECURE),
+                                      flag(environment::COOKIE_HTTP_ONLY),
+                                      same_site).expect("cookie attributes must be valid")
+    };
+
+    // the sensitive events users get logged out everywhere on
+    static ref GLOBAL_LOGOUT_ON: Vec<domain::LogoutCause> = {
+        let causes = config::get(environment::GLOBAL_LOGOUT_ON).unwrap_or(settings::GLOBAL_LOGOUT_ON.to_string());
+        domain::LogoutCause::from_list(&causes)
+            .expect("global logout causes must be a list of password_change, credential_reuse or compromise")
+    };
+
+    // cookies hold tokens unless told otherwise, in which case they hold opaque references to sessions instead
+    static ref COOKIE_CODEC: RwLock<Option<Arc<domain::CookieCodec>>> = {
+        let format = config::get(environment::COOKIE_FORMAT).unwrap_or(settings::COOKIE_FORMAT.to_string());
+        if format != "opaque" {
+            return RwLock::new(None);
+        }
+
+        let keys = keyring_get(environment::COOKIE_KEYS).expect("cookie keys must be set for opaque cookies");
+        keyring_on_rotate(environment::COOKIE_KEYS, reload_cookie_codec);
+        RwLock::new(Some(Arc::new(new_cookie_codec(&keys).expect(COOKIE_KEYS_FORMAT))))
+    };
 }   
 
+const COOKIE_KEYS_FORMAT: &str = "cookie keys must be a list of <id>:<base64 key> of 32 bytes";
+
+fn new_cookie_codec(keys: &str) -> Result<domain::CookieCodec, Box<dyn std::error::Error>> {
+    let encrypt = match config::get(environment::COOKIE_ENCRYPT) {
+        Ok(value) => value.parse().expect("cookie encryption must be either true or false"),
+        Err(_) => false,
+    };
+
+    domain::CookieCodec::new(keys, encrypt)
+}
+
+// rotated keys that cannot be parsed are not applied, so cookies keep being sealed by the current ones
+fn reload_cookie_codec(keys: &str) {
+    let codec = match new_cookie_codec(keys) {
+        Ok(codec) => codec,
+        Err(err) => {
+            error!("rotated cookie keys could not be loaded, keeping the current ones: {}: {}", COOKIE_KEYS_FORMAT, err);
+            return;
+        }
+    };
+
+    match COOKIE_CODEC.write() {
+        Ok(mut current) => *current = Some(Arc::new(codec)),
+        Err(err) => error!("write lock for cookie codec got poisoned: {}", err),
+    }
+}
+
 pub fn get_repository() -> Box<&'static dyn domain::SessionRepository> {
-    Box::new(&*REPO_PROVIDER)
+    Box::new(REPO_PROVIDER.sessions())
 }
 
 pub fn get_group_by_app() -> Box<&'static dyn domain::GroupByAppRepository> {
-    Box::new(&*REPO_PROVIDER)
+    Box::new(REPO_PROVIDER.groups())
+}
+
+pub fn get_remember_repository() -> Box<&'static dyn domain::RememberRepository> {
+    Box::new(REPO_PROVIDER.remembers())
+}
+
+/// Returns the replicator of the sessions of the peer regions, if this instance runs in replicated mode
+pub fn get_replicator() -> Option<&'static framework::RedisSessionReplicator> {
+    REPLICATOR.as_ref()
+}
+
+pub fn get_cookie_attributes() -> &'static domain::CookieAttributes {
+    &COOKIE_ATTRIBUTES
+}
+
+/// Returns true if, and only if, users must get logged out everywhere on the given cause
+pub fn is_global_logout_on(cause: domain::LogoutCause) -> bool {
+    GLOBAL_LOGOUT_ON.contains(&cause)
+}
+
+/// Returns the codec of opaque cookies, if cookies are told to be opaque rather than holding tokens
+pub fn get_cookie_codec() -> Option<Arc<domain::CookieCodec>> {
+    match COOKIE_CODEC.read() {
+        Ok(codec) => codec.clone(),
+        Err(err) => {
+            error!("read lock for cookie codec got poisoned: {}", err);
+            None
+        }
+    }
 }
\ No newline at end of file
@@ -0,0 +1,123 @@
+use std::error::Error;
+use std::time::SystemTime;
+
+use crate::constants::{environment, errors};
+use crate::keyring::application::keyring_get;
+use crate::audit::application::audit_record;
+use crate::audit::domain::EventKind;
+use crate::security;
+use crate::time;
+use super::domain::{SigningKey, KeyState, KeySet, Schedule};
+use super::{get_repository, get_cadence};
+
+/// Returns whether signing keys are rotated by the service itself, instead of through the keyring
+pub fn signing_enabled() -> bool {
+    get_cadence().is_some()
+}
+
+/// Returns all the stored signing keys, storing the first one if there is none yet: the key pair set through the
+/// keyring, if any, so the tokens it has signed are still valid, or else a brand new one
+fn find_or_bootstrap() -> Result<Vec<SigningKey>, Box<dyn Error>> {
+    let repo = get_repository();
+    let keys = repo.find_all()?;
+    if keys.len() > 0 {
+        return Ok(keys);
+    }
+
+    let mut key = match (keyring_get(environment::JWT_SECRET), keyring_get(environment::JWT_PUBLIC)) {
+        (Ok(secret), Ok(public)) => SigningKey::from_pem(base64::decode(secret)?, base64::decode(public)?,
+                                                         SystemTime::UNIX_EPOCH)?,
+        _ => SigningKey::new(time::now())?,
+    };
+
+    match repo.create(&mut key) {
+        Ok(_) => audit_record(0, 0, EventKind::KeyRotation, &format!("signing key {} bootstrapped", key.get_id())),
+        Err(err) if err.to_string() == errors::ALREADY_EXISTS => {}, // bootstrapped by another instance
+        Err(err) => return Err(err),
+    }
+
+    repo.find_all()
+}
+
+/// Returns the keys tokens must be signed and verified by right now
+pub fn signing_keys() -> Result<KeySet, Box<dyn Error>> {
+    let cadence = get_cadence().ok_or(errors::INVALID_CONFIG)?;
+    let keys = find_or_bootstrap()?;
+    let schedule = Schedule::new(&keys, &cadence, time::now());
+    schedule.get_key_set().ok_or_else(|| errors::NOT_FOUND.into())
+}
+
+/// Moves the signing keys schedule forward: the upcoming key gets promoted once its warm-up is over, the replaced keys
+/// get dropped once their grace window is over, and a new key gets generated when the current one is about to have
+/// signed for a whole period. Every step is recorded into the audit trail, and the resulting keys applied right away
+pub fn signing_rotate() -> Result<(), Box<dyn Error>> {
+    let cadence = get_cadence().ok_or(errors::INVALID_CONFIG)?;
+    let repo = get_repository();
+    let keys = find_or_bootstrap()?;
+    let now = time::now();
+
+    let schedule = Schedule::new(&keys, &cadence, now);
+    if let Some(current) = schedule.current.filter(|key| key.get_state() == KeyState::Pending) {
+        let mut promoted = current.clone();
+        promoted.state = KeyState::Active;
+        if repo.update_state(&promoted, KeyState::Pending)? {
+            info!("signing key {} has been promoted", promoted.get_id());
+            audit_record(0, 0, EventKind::KeyRotation, &format!("signing key {} promoted", promoted.get_id()));
+        }
+    }
+
+    for retired in schedule.retired.iter() {
+        if repo.delete(retired)? {
+            info!("signing key {} has been retired", retired.get_id());
+            audit_record(0, 0, EventKind::KeyRotation, &format!("signing key {} retired", retired.get_id()));
+        }
+    }
+
+    if schedule.is_due(&cadence, now) {
+        let mut key = SigningKey::new(schedule.next_activation(&cadence, now))?;
+        match repo.create(&mut key) {
+            Ok(_) => {
+                info!("signing key {} has been generated", key.get_id());
+                audit_record(0, 0, EventKind::KeyRotation, &format!("signing key {} generated", key.get_id()));
+            },
+            Err(err) if err.to_string() == errors::ALREADY_EXISTS => {}, // generated by another instance
+            Err(err) => return Err(err),
+        }
+    }
+
+    security::set_managed_jwt_keys(&signing_keys()?)
+}
+
+/// Returns when the current signing key will have signed for a whole period and whether its replacement is overdue,
+/// with no change on the stored keys. None if no key has activated yet
+pub fn signing_expiry() -> Result<Option<(SystemTime, bool)>, Box<dyn Error>> {
+    let cadence = get_cadence().ok_or(errors::INVALID_CONFIG)?;
+    let keys = get_repository().find_all()?;
+    let now = time::now();
+
+    let schedule = Schedule::new(&keys, &cadence, now);
+    Ok(schedule.expires_at(&cadence).map(|expires_at| (expires_at, schedule.is_overdue(&cadence, now))))
+}
+
+/// Applies the keys tokens must be signed and verified by right now, as moved forward by whichever instance rotates
+/// them, with no change on the schedule
+pub fn signing_reload() -> Result<(), Box<dyn Error>> {
+    security::set_managed_jwt_keys(&signing_keys()?)
+}
+
+/// Drops the key the current one has replaced before its grace window is over, so tokens signed by it are not valid
+/// anymore. Returns whether there was any to drop
+pub fn signing_revoke_previous() -> Result<bool, Box<dyn Error>> {
+    let previous = match signing_keys()?.previous {
+        Some(previous) => previous,
+        None => return Ok(false),
+    };
+
+    if !get_repository().delete(&previous)? {
+        return Ok(false);
+    }
+
+    audit_record(0, 0, EventKind::KeyRotation, &format!("signing key {} revoked", previous.get_id()));
+    security::set_managed_jwt_keys(&signing_keys()?)?;
+    Ok(true)
+}
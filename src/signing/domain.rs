@@ -0,0 +1,326 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use openssl::ec::{EcGroup, EcKey};
+use openssl::nid::Nid;
+use openssl::pkey::PKey;
+use crate::time;
+
+pub trait SigningKeyRepository {
+    // returns all the keys, the one activating the earliest first
+    fn find_all(&self) -> Result<Vec<SigningKey>, Box<dyn Error>>;
+    fn create(&self, key: &mut SigningKey) -> Result<(), Box<dyn Error>>;
+    // sets the state of the key as the provided one, returning false if it was not in the given state anymore
+    fn update_state(&self, key: &SigningKey, from: KeyState) -> Result<bool, Box<dyn Error>>;
+    // returns false if there was no such key anymore
+    fn delete(&self, key: &SigningKey) -> Result<bool, Box<dyn Error>>;
+}
+
+/// All the states a signing key goes through before being retired
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum KeyState {
+    Pending, // published for verification, but not signing yet
+    Active,  // signing, or still verifying within the grace window after its replacement
+}
+
+impl KeyState {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            KeyState::Pending => "pending",
+            KeyState::Active => "active",
+        }
+    }
+
+    pub fn from_str(state: &str) -> Option<Self> {
+        match state {
+            "pending" => Some(KeyState::Pending),
+            "active" => Some(KeyState::Active),
+            _ => None,
+        }
+    }
+}
+
+/// A key pair generated by the service itself to sign tokens by, from the time it activates on
+#[derive(Clone)]
+pub struct SigningKey {
+    pub(super) id: i32,
+    pub(super) secret: Vec<u8>, // ec private key as a pkcs8 pem file
+    pub(super) public: Vec<u8>, // ec public key as a pem file
+    pub(super) state: KeyState,
+    pub(super) created_at: SystemTime,
+    pub(super) activates_at: SystemTime,
+}
+
+impl SigningKey {
+    /// Generates a new P-256 key pair activating at the given time
+    pub fn new(activates_at: SystemTime) -> Result<Self, Box<dyn Error>> {
+        let group = EcGroup::from_curve_name(Nid::X9_62_PRIME256V1)?;
+        let key = EcKey::generate(&group)?;
+        let public = key.public_key_to_pem()?;
+        let secret = PKey::from_ec_key(key)?.private_key_to_pem_pkcs8()?;
+        SigningKey::from_pem(secret, public, activates_at)
+    }
+
+    /// Takes the given key pair, such as the one set through the keyring, as a key activating at the given time
+    pub fn from_pem(secret: Vec<u8>, public: Vec<u8>, activates_at: SystemTime) -> Result<Self, Box<dyn Error>> {
+        let now = time::now();
+        Ok(SigningKey {
+            id: 0,
+            secret: secret,
+            public: public,
+            state: if activates_at > now {KeyState::Pending} else {KeyState::Active},
+            created_at: now,
+            activates_at: activates_at,
+        })
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_secret(&self) -> &[u8] {
+        &self.secret
+    }
+
+    pub fn get_public(&self) -> &[u8] {
+        &self.public
+    }
+
+    pub fn get_state(&self) -> KeyState {
+        self.state
+    }
+
+    pub fn get_activates_at(&self) -> SystemTime {
+        self.activates_at
+    }
+}
+
+/// How often keys get rotated, for how long new keys are published before signing, so verifiers caching the keys get
+/// to know them, and for how long replaced keys keep verifying, so the tokens they signed do not become invalid
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub struct Cadence {
+    pub(super) period: Duration,
+    pub(super) warmup: Duration,
+    pub(super) grace: Duration,
+}
+
+impl Cadence {
+    pub fn new(period: Duration, warmup: Duration, grace: Duration) -> Result<Self, String> {
+        if period.as_secs() == 0 || warmup >= period {
+            return Err("key rotation period must be longer than its warm-up".to_string());
+        }
+
+        Ok(Cadence {
+            period: period,
+            warmup: warmup,
+            grace: grace,
+        })
+    }
+
+    pub fn get_warmup(&self) -> Duration {
+        self.warmup
+    }
+}
+
+/// What each of the keys is for at a given time, as told by their activation times: the current key is the latest one
+/// that has activated, the previous one is the key before it while the grace window since its replacement lasts, and
+/// the upcoming one is the next key to activate, if any. Any other key is retired
+pub struct Schedule<'a> {
+    pub current: Option<&'a SigningKey>,
+    pub previous: Option<&'a SigningKey>,
+    pub upcoming: Option<&'a SigningKey>,
+    pub retired: Vec<&'a SigningKey>,
+}
+
+impl<'a> Schedule<'a> {
+    /// Schedules the given keys, the one activating the earliest first, at the provided time
+    pub fn new(keys: &'a [SigningKey], cadence: &Cadence, now: SystemTime) -> Self {
+        let active: Vec<&SigningKey> = keys.iter().filter(|key| key.activates_at <= now).collect();
+        let current = active.last().copied();
+        let previous = match (current, active.len()) {
+            (Some(current), len) if len >= 2 && current.activates_at + cadence.grace > now => Some(active[len - 2]),
+            _ => None,
+        };
+
+        let kept = active.len() - current.iter().count() - previous.iter().count();
+        Schedule {
+            current: current,
+            previous: previous,
+            upcoming: keys.iter().find(|key| key.activates_at > now),
+            retired: active.into_iter().take(kept).collect(),
+        }
+    }
+
+    /// Returns whether a new key must be generated, so it is done warming up by the time the current one has signed for
+    /// a whole period
+    pub fn is_due(&self, cadence: &Cadence, now: SystemTime) -> bool {
+        if self.upcoming.is_some() {
+            return false;
+        }
+
+        match self.current {
+            Some(current) => current.activates_at + cadence.period <= now + cadence.warmup,
+            None => true,
+        }
+    }
+
+    /// Returns when the next key must activate: once the current one has signed for a whole period, so all instances
+    /// generating it at once agree on the same time, unless that time is already over
+    pub fn next_activation(&self, cadence: &Cadence, now: SystemTime) -> SystemTime {
+        match self.current {
+            Some(current) if current.activates_at + cadence.period > now => current.activates_at + cadence.period,
+            _ => now + cadence.warmup,
+        }
+    }
+
+    /// Returns when the current key will have signed for a whole period, none if no key has activated yet
+    pub fn expires_at(&self, cadence: &Cadence) -> Option<SystemTime> {
+        self.current.map(|current| current.activates_at + cadence.period)
+    }
+
+    /// Returns whether a new key has been due for over half of its warm-up with none generated yet, so the rotation
+    /// looks stuck rather than about to happen
+    pub fn is_overdue(&self, cadence: &Cadence, now: SystemTime) -> bool {
+        self.is_due(cadence, now) && match self.current {
+            Some(current) => current.activates_at + cadence.period <= now + cadence.warmup / 2,
+            None => true,
+        }
+    }
+
+    /// Returns the keys tokens are signed and verified by, none if no key has activated yet
+    pub fn get_key_set(&self) -> Option<KeySet> {
+        Some(KeySet {
+            current: self.current?.clone(),
+            previous: self.previous.cloned(),
+            upcoming: self.upcoming.cloned(),
+        })
+    }
+}
+
+/// The keys tokens are signed by, the current one, and verified by, all of them
+#[derive(Clone)]
+pub struct KeySet {
+    pub current: SigningKey,
+    pub previous: Option<SigningKey>,
+    pub upcoming: Option<SigningKey>,
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use super::{SigningKey, KeyState, Cadence, Schedule};
+
+    const HOUR: u64 = 3600;
+
+    fn new_key(id: i32, activates_at: SystemTime) -> SigningKey {
+        SigningKey {
+            id: id,
+            secret: vec![],
+            public: vec![],
+            state: KeyState::Active,
+            created_at: activates_at,
+            activates_at: activates_at,
+        }
+    }
+
+    #[test]
+    fn signing_key_new_should_not_fail() {
+        let now = SystemTime::now();
+        let key = SigningKey::new(now + Duration::from_secs(HOUR)).unwrap();
+        assert_eq!(KeyState::Pending, key.get_state());
+        assert!(String::from_utf8_lossy(key.get_secret()).contains("BEGIN PRIVATE KEY"));
+        assert!(String::from_utf8_lossy(key.get_public()).contains("BEGIN PUBLIC KEY"));
+
+        let key = SigningKey::new(now).unwrap();
+        assert_eq!(KeyState::Active, key.get_state());
+    }
+
+    #[test]
+    fn cadence_new_should_fail() {
+        let hour = Duration::from_secs(HOUR);
+        assert!(Cadence::new(hour, hour, hour).is_err());
+        assert!(Cadence::new(Duration::from_secs(0), Duration::from_secs(0), hour).is_err());
+        assert!(Cadence::new(hour * 24, hour, hour).is_ok());
+    }
+
+    #[test]
+    fn schedule_new_should_not_fail() {
+        let now = SystemTime::now();
+        let cadence = Cadence::new(Duration::from_secs(24 * HOUR), Duration::from_secs(HOUR),
+                                   Duration::from_secs(2 * HOUR)).unwrap();
+
+        let keys = vec![
+            new_key(1, now - Duration::from_secs(48 * HOUR)),
+            new_key(2, now - Duration::from_secs(24 * HOUR)),
+            new_key(3, now - Duration::from_secs(HOUR)),
+            new_key(4, now + Duration::from_secs(HOUR)),
+        ];
+
+        let schedule = Schedule::new(&keys, &cadence, now);
+        assert_eq!(Some(3), schedule.current.map(SigningKey::get_id));
+        assert_eq!(Some(2), schedule.previous.map(SigningKey::get_id));
+        assert_eq!(Some(4), schedule.upcoming.map(SigningKey::get_id));
+        assert_eq!(vec![1], schedule.retired.iter().map(|key| key.get_id()).collect::<Vec<i32>>());
+        assert!(!schedule.is_due(&cadence, now));
+
+        // once the grace window is over, the previous key gets retired as well
+        let later = now + Duration::from_secs(3 * HOUR / 2);
+        let schedule = Schedule::new(&keys[..3], &cadence, later);
+        assert!(schedule.previous.is_none());
+        assert_eq!(2, schedule.retired.len());
+    }
+
+    #[test]
+    fn schedule_is_due_should_not_fail() {
+        let now = SystemTime::now();
+        let cadence = Cadence::new(Duration::from_secs(24 * HOUR), Duration::from_secs(HOUR),
+                                   Duration::from_secs(2 * HOUR)).unwrap();
+
+        assert!(Schedule::new(&[], &cadence, now).is_due(&cadence, now));
+
+        let keys = vec![new_key(1, now - Duration::from_secs(22 * HOUR))];
+        assert!(!Schedule::new(&keys, &cadence, now).is_due(&cadence, now));
+
+        let keys = vec![new_key(1, now - Duration::from_secs(23 * HOUR))];
+        assert!(Schedule::new(&keys, &cadence, now).is_due(&cadence, now));
+    }
+
+    #[test]
+    fn schedule_next_activation_should_not_fail() {
+        let now = SystemTime::now();
+        let cadence = Cadence::new(Duration::from_secs(24 * HOUR), Duration::from_secs(HOUR),
+                                   Duration::from_secs(2 * HOUR)).unwrap();
+
+        let activates_at = now - Duration::from_secs(23 * HOUR);
+        let keys = vec![new_key(1, activates_at)];
+        let schedule = Schedule::new(&keys, &cadence, now);
+        assert_eq!(activates_at + Duration::from_secs(24 * HOUR), schedule.next_activation(&cadence, now));
+
+        // keys that should have been replaced already get replaced after the warm-up
+        let keys = vec![new_key(1, now - Duration::from_secs(48 * HOUR))];
+        let schedule = Schedule::new(&keys, &cadence, now);
+        assert_eq!(now + Duration::from_secs(HOUR), schedule.next_activation(&cadence, now));
+        assert!(Schedule::new(&[], &cadence, now).get_key_set().is_none());
+    }
+
+    #[test]
+    fn schedule_is_overdue_should_not_fail() {
+        let now = SystemTime::now();
+        let cadence = Cadence::new(Duration::from_secs(24 * HOUR), Duration::from_secs(2 * HOUR),
+                                   Duration::from_secs(2 * HOUR)).unwrap();
+
+        let activates_at = now - Duration::from_secs(22 * HOUR + 1800);
+        let keys = vec![new_key(1, activates_at)];
+        let schedule = Schedule::new(&keys, &cadence, now);
+        assert!(schedule.is_due(&cadence, now));
+        assert!(!schedule.is_overdue(&cadence, now));
+        assert_eq!(Some(activates_at + Duration::from_secs(24 * HOUR)), schedule.expires_at(&cadence));
+
+        let keys = vec![new_key(1, now - Duration::from_secs(23 * HOUR))];
+        assert!(Schedule::new(&keys, &cadence, now).is_overdue(&cadence, now));
+
+        let keys = vec![new_key(1, now - Duration::from_secs(23 * HOUR)), new_key(2, now + Duration::from_secs(HOUR))];
+        assert!(!Schedule::new(&keys, &cadence, now).is_overdue(&cadence, now));
+        assert!(Schedule::new(&[], &cadence, now).is_overdue(&cadence, now));
+    }
+}
@@ -0,0 +1,199 @@
+use std::error::Error;
+use std::time::SystemTime;
+use diesel::NotFound;
+
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::security;
+use crate::schema::signing_keys;
+use crate::constants::{environment, errors};
+use crate::keyring::application::keyring_get;
+use super::domain::{SigningKey, SigningKeyRepository, KeyState};
+
+const SEALING_KEY_LEN: usize = 32;
+
+/// Returns the key private keys are sealed with at rest, as set through the keyring
+fn get_sealing_key() -> Result<Vec<u8>, Box<dyn Error>> {
+    let key_b64 = match keyring_get(environment::SIGNING_KEYS_SECRET) {
+        Ok(key_b64) => key_b64,
+        Err(_) => return Err("signing keys secret must be set".into()),
+    };
+
+    let key = base64::decode(key_b64)?;
+    if key.len() != SEALING_KEY_LEN {
+        return Err(format!("signing keys secret must be {} bytes long", SEALING_KEY_LEN).into());
+    }
+
+    Ok(key)
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(Clone)]
+#[table_name = "signing_keys"]
+struct PostgresSigningKey {
+    pub id: i32,
+    pub secret: String, // sealed, as base64
+    pub public_key: String,
+    pub state: String,
+    pub created_at: SystemTime,
+    pub activates_at: SystemTime,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "signing_keys"]
+struct NewPostgresSigningKey<'a> {
+    pub secret: &'a str,
+    pub public_key: &'a str,
+    pub state: &'a str,
+    pub created_at: SystemTime,
+    pub activates_at: SystemTime,
+}
+
+pub struct PostgresSigningKeyRepository;
+
+impl PostgresSigningKeyRepository {
+    fn build(result: &PostgresSigningKey, sealing_key: &[u8]) -> Result<SigningKey, Box<dyn Error>> {
+        let state = KeyState::from_str(&result.state).ok_or(NotFound)?;
+        let secret = security::decrypt_aes(sealing_key, &base64::decode(&result.secret)?)?;
+        Ok(SigningKey {
+            id: result.id,
+            secret: secret,
+            public: result.public_key.as_bytes().to_vec(),
+            state: state,
+            created_at: result.created_at,
+            activates_at: result.activates_at,
+        })
+    }
+}
+
+impl SigningKeyRepository for PostgresSigningKeyRepository {
+    fn find_all(&self) -> Result<Vec<SigningKey>, Box<dyn Error>> {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            signing_keys::table.order((signing_keys::activates_at.asc(), signing_keys::id.asc()))
+                               .load::<PostgresSigningKey>(&connection)?
+        };
+
+        let sealing_key = get_sealing_key()?;
+        let mut all_keys = Vec::new();
+        for result in results.iter() {
+            all_keys.push(PostgresSigningKeyRepository::build(result, &sealing_key)?);
+        }
+
+        Ok(all_keys)
+    }
+
+    fn create(&self, key: &mut SigningKey) -> Result<(), Box<dyn Error>> {
+        let secret = base64::encode(security::encrypt_aes(&get_sealing_key()?, &key.secret)?);
+        let public = String::from_utf8(key.public.clone())?;
+        let new_key = NewPostgresSigningKey {
+            secret: &secret,
+            public_key: &public,
+            state: key.state.as_str(),
+            created_at: key.created_at,
+            activates_at: key.activates_at,
+        };
+
+        // instances generating the same key at once agree on its activation time, so only the first one gets stored
+        let result = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            diesel::insert_into(signing_keys::table)
+                .values(&new_key)
+                .on_conflict(signing_keys::activates_at)
+                .do_nothing()
+                .get_result::<PostgresSigningKey>(&connection)
+                .optional()?
+        };
+
+        key.id = result.ok_or(errors::ALREADY_EXISTS)?.id;
+        Ok(())
+    }
+
+    fn update_state(&self, key: &SigningKey, from: KeyState) -> Result<bool, Box<dyn Error>> {
+        // the state is only changed by the first instance doing so
+        let connection = get_connection().get()?;
+        let updated = diesel::update(signing_keys::table)
+            .filter(signing_keys::id.eq(key.id))
+            .filter(signing_keys::state.eq(from.as_str()))
+            .set(signing_keys::state.eq(key.state.as_str()))
+            .execute(&connection)?;
+
+        Ok(updated > 0)
+    }
+
+    fn delete(&self, key: &SigningKey) -> Result<bool, Box<dyn Error>> {
+        let connection = get_connection().get()?;
+        let deleted = diesel::delete(signing_keys::table.filter(signing_keys::id.eq(key.id)))
+            .execute(&connection)?;
+
+        Ok(deleted > 0)
+    }
+}
+
+pub struct InMemorySigningKeyRepository {
+    table: memory::Table<SigningKey>,
+}
+
+impl InMemorySigningKeyRepository {
+    pub fn new() -> Self {
+        InMemorySigningKeyRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl SigningKeyRepository for InMemorySigningKeyRepository {
+    fn find_all(&self) -> Result<Vec<SigningKey>, Box<dyn Error>> {
+        let mut all_keys = self.table.find_all(|_| true)?;
+        all_keys.sort_by_key(|key| (key.activates_at, key.id));
+        Ok(all_keys)
+    }
+
+    fn create(&self, key: &mut SigningKey) -> Result<(), Box<dyn Error>> {
+        let activates_at = key.activates_at;
+        self.table.insert(key, |other| other.activates_at == activates_at, |key, new_id| key.id = new_id)
+    }
+
+    fn update_state(&self, key: &SigningKey, from: KeyState) -> Result<bool, Box<dyn Error>> {
+        match self.table.find(key.id) {
+            Ok(current) if current.state == from => {
+                self.table.update(key.id, key)?;
+                Ok(true)
+            },
+            Ok(_) => Ok(false),
+            Err(err) if err.to_string() == errors::NOT_FOUND => Ok(false),
+            Err(err) => Err(err),
+        }
+    }
+
+    fn delete(&self, key: &SigningKey) -> Result<bool, Box<dyn Error>> {
+        let deleted = self.table.delete_all(|other| other.id == key.id)?;
+        Ok(deleted > 0)
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::{SystemTime, Duration};
+    use super::InMemorySigningKeyRepository;
+    use super::super::domain::{SigningKey, SigningKeyRepository, KeyState};
+
+    #[test]
+    fn in_memory_update_state_should_not_fail() {
+        let repo = InMemorySigningKeyRepository::new();
+        let mut key = SigningKey::new(SystemTime::now() + Duration::from_secs(60)).unwrap();
+        repo.create(&mut key).unwrap();
+
+        key.state = KeyState::Active;
+        assert!(repo.update_state(&key, KeyState::Pending).unwrap());
+        assert!(!repo.update_state(&key, KeyState::Pending).unwrap());
+        assert_eq!(KeyState::Active, repo.find_all().unwrap()[0].get_state());
+
+        assert!(repo.delete(&key).unwrap());
+        assert!(!repo.delete(&key).unwrap());
+    }
+}
@@ -0,0 +1,49 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use std::error::Error;
+use std::time::Duration;
+use crate::storage::{self, Backend};
+use crate::constants::{environment, settings};
+use crate::config;
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::SigningKeyRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresSigningKeyRepository),
+            Backend::Memory => Box::new(framework::InMemorySigningKeyRepository::new()),
+            backend => storage::unsupported(backend, "signing keys"),
+        }
+    };
+
+    // none if signing keys are not rotated by the service itself, but through the keyring
+    static ref CADENCE: Option<domain::Cadence> = load_cadence().unwrap_or_else(|err| panic!("{}", err));
+}
+
+fn load_cadence() -> Result<Option<domain::Cadence>, Box<dyn Error>> {
+    fn seconds(name: &str, default: u64) -> Result<Duration, Box<dyn Error>> {
+        match config::get(name) {
+            Ok(value) => value.parse().map(Duration::from_secs).map_err(|_| format!("{} must be a number", name).into()),
+            Err(_) => Ok(Duration::from_secs(default)),
+        }
+    }
+
+    if config::get(environment::KEY_ROTATION_PERIOD).is_err() {
+        return Ok(None);
+    }
+
+    let cadence = domain::Cadence::new(seconds(environment::KEY_ROTATION_PERIOD, 0)?,
+                                       seconds(environment::KEY_WARMUP, settings::KEY_WARMUP)?,
+                                       seconds(environment::KEY_GRACE, settings::KEY_GRACE)?)?;
+
+    Ok(Some(cadence))
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::SigningKeyRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
+
+pub fn get_cadence() -> Option<domain::Cadence> {
+    *CADENCE
+}
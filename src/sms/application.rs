@@ -0,0 +1,18 @@
+use std::error::Error;
+
+use crate::constants::environment;
+use crate::config;
+use super::get_sender;
+
+/// Sends a text message with the given body to the given phone number, from the one set by SMS_ORIGIN, through the
+/// provider set by SMS_PROVIDER. Failed deliveries are not retried: whoever is waiting for the message can just ask
+/// for a new one
+pub fn sms_send(to: &str, body: &str) -> Result<(), Box<dyn Error>> {
+    let from = config::get(environment::SMS_ORIGIN)?;
+    if let Err(err) = get_sender().send(&from, to, body) {
+        warn!("text message to {} could not be delivered: {}", to, err);
+        return Err(err);
+    }
+
+    Ok(())
+}
@@ -0,0 +1,45 @@
+use std::error::Error;
+
+pub trait Sender {
+    // sends a text message with the given body to the given phone number, on behalf of the given one
+    fn send(&self, from: &str, to: &str, body: &str) -> Result<(), Box<dyn Error>>;
+}
+
+/// All the providers a text message may be delivered by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Provider {
+    Twilio,
+    Log, // no message gets delivered at all, but logged instead: for development only
+}
+
+impl Provider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Provider::Twilio => "twilio",
+            Provider::Log => "log",
+        }
+    }
+
+    pub fn from_str(provider: &str) -> Option<Self> {
+        match provider {
+            "twilio" => Some(Provider::Twilio),
+            "log" => Some(Provider::Log),
+            _ => None,
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::Provider;
+
+    #[test]
+    fn provider_from_str_should_not_fail() {
+        for provider in &[Provider::Twilio, Provider::Log] {
+            assert_eq!(Some(*provider), Provider::from_str(provider.as_str()));
+        }
+
+        assert_eq!(None, Provider::from_str("unknown"));
+    }
+}
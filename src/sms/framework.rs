@@ -0,0 +1,56 @@
+use std::error::Error;
+use std::time::Duration;
+
+use crate::constants::{environment, settings};
+use crate::config;
+use crate::keyring::application::keyring_get;
+use super::domain::Sender;
+
+const TWILIO_URL: &str = "https://api.twilio.com/2010-04-01/Accounts";
+
+/// Delivers text messages through the messages api of Twilio, authenticated by the TWILIO_ACCOUNT_SID and the
+/// TWILIO_AUTH_TOKEN of the keyring
+pub struct TwilioSender {
+    agent: ureq::Agent,
+}
+
+impl TwilioSender {
+    pub fn new() -> Self {
+        TwilioSender {
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(settings::SMS_TIMEOUT))
+                .build(),
+        }
+    }
+}
+
+impl Sender for TwilioSender {
+    fn send(&self, from: &str, to: &str, body: &str) -> Result<(), Box<dyn Error>> {
+        let account_sid = config::get(environment::TWILIO_ACCOUNT_SID)?;
+        let auth_token = keyring_get(environment::TWILIO_AUTH_TOKEN)?;
+        let credentials = base64::encode(format!("{}:{}", account_sid, auth_token));
+
+        let url = format!("{}/{}/Messages.json", TWILIO_URL, account_sid);
+        match self.agent.post(&url)
+            .set("Authorization", &format!("Basic {}", credentials))
+            .send_form(&[("From", from), ("To", to), ("Body", body)]) {
+            Ok(_) => Ok(()),
+            Err(ureq::Error::Status(status, response)) => {
+                let reason = response.into_string().unwrap_or_default();
+                Err(format!("twilio has rejected the message with status {}: {}", status, reason).into())
+            },
+            Err(err) => Err(err.into()),
+        }
+    }
+}
+
+/// Delivers no text message at all, but logs it instead, codes included, so the flows requiring them can be followed
+/// with no provider. It must never be used in production
+pub struct LogSender;
+
+impl Sender for LogSender {
+    fn send(&self, from: &str, to: &str, body: &str) -> Result<(), Box<dyn Error>> {
+        info!("text message from {} to {}:\n{}", from, to, body);
+        Ok(())
+    }
+}
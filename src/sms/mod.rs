@@ -0,0 +1,21 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::constants::{environment, settings};
+use crate::config;
+
+lazy_static! {
+    static ref SENDER_PROVIDER: Box<dyn domain::Sender + Sync + Send> = {
+        let provider = config::get(environment::SMS_PROVIDER).unwrap_or(settings::SMS_PROVIDER.to_string());
+        match domain::Provider::from_str(&provider) {
+            Some(domain::Provider::Twilio) => Box::new(framework::TwilioSender::new()),
+            Some(domain::Provider::Log) => Box::new(framework::LogSender),
+            None => panic!("sms provider must be one of twilio or log"),
+        }
+    };
+}
+
+pub fn get_sender() -> Box<&'static dyn domain::Sender> {
+    Box::new(&**SENDER_PROVIDER)
+}
@@ -1,66 +1,194 @@
 #![allow(dead_code, unused_imports, unused_variables)]
 
 use std::error::Error;
-use std::env;
-use lettre::smtp::authentication::Credentials;
-use lettre::{SmtpClient, SmtpTransport, Transport};
-use lettre_email::EmailBuilder;
 use tera::{Tera, Context};
 
 use crate::constants::environment;
+use crate::config;
+use crate::mailer::application::mailer_send;
+use crate::app::domain::Branding;
+use crate::template::domain::TemplateKind;
+use crate::template::application::template_find;
+use crate::i18n;
 
 lazy_static! {
     static ref TERA: Tera = {
-        let templates = env::var(environment::TEMPLATES).unwrap();
+        let templates = config::get(environment::TEMPLATES).unwrap();
         Tera::new(&templates).unwrap()
     };
 }
 
-fn get_mailer() -> Result<SmtpTransport, Box<dyn Error>> {
-    let smtp_username = env::var(environment::SMTP_USERNAME)?;
-    let smtp_password = env::var(environment::SMTP_PASSWORD)?;
-    let smtp_transport = env::var(environment::SMTP_TRANSPORT)?;
+/// Returns the prefix of the subject of the emails sent on behalf of the app with the given branding, if any
+fn get_prefix(branding: Option<&Branding>) -> String {
+    if let Some(name) = branding.and_then(|branding| branding.get_name()) {
+        return name.to_string();
+    }
 
-    let creds = Credentials::new(smtp_username, smtp_password);
-    let mailer = SmtpClient::new_simple(&smtp_transport)?
-        .credentials(creds)
-        .transport();
+    match config::get(environment::APP_NAME) {
+        Ok(app_name) => app_name,
+        Err(_) => "tpauth".to_string(),
+    }
+}
 
-    Ok(mailer)
+/// Returns the name of the file the body of the given notification must be rendered by in the given locale: the one
+/// of TEMPLATES suffixed by the locale (e.g. verification_email.es-ES.html), else by its language, if any, else the
+/// default one
+fn get_localized_file(kind: TemplateKind, locale: &str) -> String {
+    let file = kind.get_file();
+    let (stem, extension) = file.rsplit_once('.').unwrap_or((file, "html"));
+    let language = locale.split('-').next().unwrap_or_default();
+    [locale, language].iter()
+        .map(|locale| format!("{}.{}.{}", stem, locale, extension))
+        .find(|localized| TERA.get_template_names().any(|name| name == localized))
+        .unwrap_or(file.to_string())
 }
 
-pub fn send_verification_email(to: &str, token: &str) -> Result<(), Box<dyn Error>> {
-    let mut context = Context::new();
-    context.insert("token", token);
-    
-    let prefix = match env::var(environment::APP_NAME) {
-        Ok(app_name) => app_name,
-        Err(_) => "tpauth".to_string(),
-    };
+/// Renders the given notification by the template its tenant has overridden it with, if any, else by the default
+/// one in the given locale. A custom template failing to render falls back to the default one, so the notification
+/// still gets sent
+pub fn render_notification(tenant: i32,
+                           kind: TemplateKind,
+                           locale: &str,
+                           context: &Context) -> Result<(String, String), Box<dyn Error>> {
 
-    let subject = format!("[{}] Verification email", prefix);
-    let body = TERA.render("verification_email.html", &context)?;
+    #[cfg(not(test))]
+    if let Ok(template) = template_find(tenant, kind) {
+        match template.render(context) {
+            Ok(rendered) => return Ok(rendered),
+            Err(err) => warn!("could not render version {} of template {} of tenant {}: {}",
+                              template.get_version(), kind.as_str(), tenant, err),
+        }
+    }
+
+    let subject = i18n::get_email_subject(locale, kind.as_str()).unwrap_or(kind.get_subject().to_string());
+    let subject = Tera::one_off(&subject, context, false)?;
+    let body = TERA.render(&get_localized_file(kind, locale), context)?;
+    Ok((subject, body))
+}
+
+/// Sends the given notification to the given address, rendered with the given variables in the given locale, if
+/// supported, and on behalf of the app with the given branding, if any
+fn send_notification(tenant: i32,
+                     locale: Option<&str>,
+                     to: &str,
+                     kind: TemplateKind,
+                     mut context: Context,
+                     branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+
+    context.insert("brand", &branding);
+    context.insert("prefix", &get_prefix(branding));
+    let locale = i18n::negotiate(&locale.into_iter().collect::<Vec<&str>>());
+    let (subject, body) = render_notification(tenant, kind, &locale, &context)?;
 
     if let Err(err) = send_email(to, &subject, &body) {
-        info!("got error {} while sending verification email to {}", err, to);
+        info!("got error {} while sending {} notification to {}", err, kind.as_str(), to);
         return Err(err);
     }
 
     Ok(())
 }
 
+pub fn send_verification_email(tenant: i32,
+                               locale: Option<&str>,
+                               to: &str,
+                               token: &str,
+                               branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("token", token);
+    send_notification(tenant, locale, to, TemplateKind::Verification, context, branding)
+}
+
+pub fn send_email_change_confirmation(tenant: i32,
+                                      locale: Option<&str>,
+                                      to: &str,
+                                      token: &str,
+                                      branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("token", token);
+    send_notification(tenant, locale, to, TemplateKind::EmailChangeConfirmation, context, branding)
+}
 
-pub fn send_email(to: &str, subject: &str, body: &str) -> Result<(), Box<dyn Error>> {
-    let from = env::var(environment::SMTP_ORIGIN)?;
-    let email = EmailBuilder::new()
-        .to(to)
-        .from(from)
-        .subject(subject)
-        .html(body)
-        .build()?;
+pub fn send_email_change_notification(tenant: i32,
+                                      locale: Option<&str>,
+                                      to: &str,
+                                      new_email: &str,
+                                      branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("email", new_email);
+    send_notification(tenant, locale, to, TemplateKind::EmailChangeNotification, context, branding)
+}
 
+pub fn send_invitation_email(tenant: i32,
+                             locale: Option<&str>,
+                             to: &str,
+                             code: &str,
+                             branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("code", code);
+    send_notification(tenant, locale, to, TemplateKind::Invitation, context, branding)
+}
+
+pub fn send_new_device_notification(tenant: i32,
+                                    locale: Option<&str>,
+                                    to: &str,
+                                    device: &str,
+                                    token: &str,
+                                    branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("device", device);
+    context.insert("token", token);
+    send_notification(tenant, locale, to, TemplateKind::NewDevice, context, branding)
+}
+
+pub fn send_new_location_notification(tenant: i32,
+                                      locale: Option<&str>,
+                                      to: &str,
+                                      country: &str,
+                                      anomalies: &str,
+                                      branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("country", country);
+    context.insert("anomalies", anomalies);
+    send_notification(tenant, locale, to, TemplateKind::NewLocation, context, branding)
+}
+
+pub fn send_recovery_approval_email(tenant: i32,
+                                    locale: Option<&str>,
+                                    to: &str,
+                                    email: &str,
+                                    token: &str,
+                                    branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("email", email);
+    context.insert("token", token);
+    send_notification(tenant, locale, to, TemplateKind::RecoveryApproval, context, branding)
+}
+
+pub fn send_password_reset_email(tenant: i32,
+                                 locale: Option<&str>,
+                                 to: &str,
+                                 token: &str,
+                                 branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("token", token);
+    send_notification(tenant, locale, to, TemplateKind::PasswordReset, context, branding)
+}
+
+pub fn send_activation_email(tenant: i32,
+                             locale: Option<&str>,
+                             to: &str,
+                             token: &str,
+                             deadline: &str,
+                             branding: Option<&Branding>) -> Result<(), Box<dyn Error>> {
+    let mut context = Context::new();
+    context.insert("token", token);
+    context.insert("deadline", deadline);
+    send_notification(tenant, locale, to, TemplateKind::Activation, context, branding)
+}
+
+pub fn send_email(to: &str, subject: &str, body: &str) -> Result<(), Box<dyn Error>> {
     #[cfg(not(test))]
-    get_mailer()?.send(email.into())?;
+    mailer_send(to, subject, body)?;
     
     Ok(())
 }
@@ -71,7 +199,7 @@ pub fn send_email(to: &str, subject: &str, body: &str) -> Result<(), Box<dyn Err
 #[cfg(feature = "integration-tests")]
 mod tests {
     use std::env;
-    use crate::constants::environment;
+    use crate::constants::{environment, settings};
     use super::send_verification_email;
 
     #[test]
@@ -79,7 +207,7 @@ mod tests {
         dotenv::dotenv().unwrap();
 
         const TOKEN: &str = "dummytoken";
-        let mailto = env::var(environment::SMTP_USERNAME).unwrap();
-        send_verification_email(&mailto, TOKEN).unwrap();
+        let mailto = config::get(environment::SMTP_USERNAME).unwrap();
+        send_verification_email(settings::DEFAULT_TENANT, None, &mailto, TOKEN, None).unwrap();
     }
 }
\ No newline at end of file
@@ -0,0 +1,137 @@
+use std::error::Error;
+use crate::constants::{environment, errors};
+use crate::config;
+
+const SCHEME: &str = "spiffe://";
+const MAX_ID_LEN: usize = 2048;
+
+/// The identity of a workload, as told by the uri subject alternative name of its x509 svid: the trust domain it
+/// belongs to, followed by the path naming the workload within that domain (e.g. spiffe://mesh.local/ns/default/sa/ci)
+#[derive(Clone, PartialEq, Debug)]
+pub struct SpiffeId {
+    trust_domain: String,
+    path: String,
+}
+
+impl SpiffeId {
+    /// Parses the given spiffe id. The trust domain is made of lowercase letters, digits, dots, dashes and underscores,
+    /// with no port nor user info, while the path, if any, is made of non-empty segments of letters, digits, dots,
+    /// dashes and underscores, other than the relative ones, with no trailing slash, query nor fragment
+    pub fn parse(id: &str) -> Result<Self, Box<dyn Error>> {
+        if id.len() > MAX_ID_LEN {
+            return Err(format!("spiffe id must be up to {} characters long", MAX_ID_LEN).into());
+        }
+
+        let rest = match id.strip_prefix(SCHEME) {
+            Some(rest) => rest,
+            None => return Err(format!("spiffe id must start with {}", SCHEME).into()),
+        };
+
+        let (trust_domain, path) = match rest.find('/') {
+            Some(index) => rest.split_at(index),
+            None => (rest, ""),
+        };
+
+        let is_domain_char = |c: char| c.is_ascii_lowercase() || c.is_ascii_digit() || ".-_".contains(c);
+        if trust_domain.is_empty() || !trust_domain.chars().all(is_domain_char) {
+            return Err(format!("spiffe id {} has no valid trust domain", id).into());
+        }
+
+        let is_path_char = |c: char| c.is_ascii_alphanumeric() || ".-_".contains(c);
+        let has_valid_path = path.is_empty() || path[1..].split('/').all(|segment| {
+            !segment.is_empty() && segment != "." && segment != ".." && segment.chars().all(is_path_char)
+        });
+
+        if !has_valid_path {
+            return Err(format!("spiffe id {} has no valid path", id).into());
+        }
+
+        Ok(SpiffeId {
+            trust_domain: trust_domain.to_string(),
+            path: path.to_string(),
+        })
+    }
+
+    pub fn get_trust_domain(&self) -> &str {
+        &self.trust_domain
+    }
+
+    pub fn get_path(&self) -> &str {
+        &self.path
+    }
+}
+
+/// Returns true if, and only if, the given certificate identity is meant to be a spiffe id, whether it is a valid one
+/// or not
+pub fn is_spiffe_id(identity: &str) -> bool {
+    identity.starts_with(SCHEME)
+}
+
+/// Returns whether the given trust domain is any of the listed by SPIFFE_TRUST_DOMAINS. If none is listed, any trust
+/// domain is trusted, as long as its svids have been issued by the client certificate authority
+pub fn is_trusted_domain(trust_domain: &str) -> bool {
+    match config::get(environment::SPIFFE_TRUST_DOMAINS) {
+        Err(_) => true,
+        Ok(domains) => domains.split(',').any(|domain| domain.trim() == trust_domain),
+    }
+}
+
+/// Returns the spiffe id the given certificate identity stands for, as long as it is a valid one and belongs to a
+/// trusted domain
+pub fn verify(identity: &str) -> Result<SpiffeId, Box<dyn Error>> {
+    let id = SpiffeId::parse(identity)?;
+    if !is_trusted_domain(id.get_trust_domain()) {
+        warn!("spiffe id {} belongs to an untrusted domain", identity);
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    Ok(id)
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use super::{SpiffeId, is_spiffe_id};
+
+    #[test]
+    fn spiffe_id_parse_should_not_fail() {
+        let id = SpiffeId::parse("spiffe://mesh.local/ns/default/sa/ci").unwrap();
+        assert_eq!(id.get_trust_domain(), "mesh.local");
+        assert_eq!(id.get_path(), "/ns/default/sa/ci");
+
+        let id = SpiffeId::parse("spiffe://mesh_01-a.local").unwrap();
+        assert_eq!(id.get_trust_domain(), "mesh_01-a.local");
+        assert_eq!(id.get_path(), "");
+    }
+
+    #[test]
+    fn spiffe_id_parse_should_fail() {
+        const IDS: &[&str] = &[
+            "https://mesh.local/ns/default",
+            "spiffe://",
+            "spiffe:///ns/default",
+            "spiffe://Mesh.local/ns/default",
+            "spiffe://mesh.local:8443/ns/default",
+            "spiffe://user@mesh.local/ns/default",
+            "spiffe://mesh.local/",
+            "spiffe://mesh.local/ns//default",
+            "spiffe://mesh.local/ns/../default",
+            "spiffe://mesh.local/ns/./default",
+            "spiffe://mesh.local/ns/default?query",
+            "spiffe://mesh.local/ns/default#fragment",
+        ];
+
+        for id in IDS {
+            assert!(SpiffeId::parse(id).is_err(), "{} must not be a valid spiffe id", id);
+        }
+
+        let long = format!("spiffe://mesh.local/{}", "a".repeat(2048));
+        assert!(SpiffeId::parse(&long).is_err());
+    }
+
+    #[test]
+    fn is_spiffe_id_should_not_fail() {
+        assert!(is_spiffe_id("spiffe://mesh.local/ns/default"));
+        assert!(!is_spiffe_id("ci.mesh.local"));
+    }
+}
@@ -0,0 +1,529 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::fmt;
+use std::future::Future;
+use std::pin::Pin;
+use std::task::{Context, Poll};
+use std::time::Duration;
+use http::{HeaderMap, HeaderValue};
+use prost::Message;
+use tonic::Status;
+use tonic::metadata::MetadataValue;
+use tower::{Layer, Service};
+
+use crate::{config, i18n};
+use crate::constants::{environment, errors, settings};
+use crate::user::application::user_missing_attributes;
+
+const GRPC_STATUS_HEADER: &str = "grpc-status";
+const GRPC_MESSAGE_HEADER: &str = "grpc-message";
+const GRPC_DETAILS_HEADER: &str = "grpc-status-details-bin";
+const RETRY_AFTER_HEADER: &str = "retry-after";
+const TYPE_URL_PREFIX: &str = "type.googleapis.com/google.rpc.";
+const TOKEN_REQUIRED: &str = "token required";
+const WRONG_PREFIX: &str = "wrong ";
+
+// the arguments telling, by their message, which one of them is wrong
+const ARGUMENTS: &[(&str, &str)] = &[
+    ("wrong template kind", "kind"),
+    ("wrong kind", "kind"),
+    ("wrong event kind", "kinds"),
+    ("wrong format", "format"),
+    ("wrong conflict policy", "conflict"),
+    ("wrong action", "action"),
+    ("invalid page token", "page_token"),
+];
+
+/// The google.rpc.Status message, as defined by google/rpc/status.proto, so clients decode the details of a failed
+/// request by the googleapis protos they already have
+#[derive(Clone, PartialEq, Message)]
+pub struct RpcStatus {
+    #[prost(int32, tag = "1")]
+    pub code: i32,
+    #[prost(string, tag = "2")]
+    pub message: String,
+    #[prost(message, repeated, tag = "3")]
+    pub details: Vec<Any>,
+}
+
+/// The google.protobuf.Any message each detail of a status is packed into
+#[derive(Clone, PartialEq, Message)]
+pub struct Any {
+    #[prost(string, tag = "1")]
+    pub type_url: String,
+    #[prost(bytes, tag = "2")]
+    pub value: Vec<u8>,
+}
+
+/// The google.rpc.ErrorInfo message: the machine-readable reason of the error, unique within its domain
+#[derive(Clone, PartialEq, Message)]
+pub struct ErrorInfo {
+    #[prost(string, tag = "1")]
+    pub reason: String,
+    #[prost(string, tag = "2")]
+    pub domain: String,
+    #[prost(map = "string, string", tag = "3")]
+    pub metadata: HashMap<String, String>,
+}
+
+/// The google.protobuf.Duration message
+#[derive(Clone, PartialEq, Message)]
+pub struct ProtoDuration {
+    #[prost(int64, tag = "1")]
+    pub seconds: i64,
+    #[prost(int32, tag = "2")]
+    pub nanos: i32,
+}
+
+/// The google.rpc.RetryInfo message: how long clients should wait before retrying the same request
+#[derive(Clone, PartialEq, Message)]
+pub struct RetryInfo {
+    #[prost(message, optional, tag = "1")]
+    pub retry_delay: Option<ProtoDuration>,
+}
+
+/// The google.rpc.BadRequest.FieldViolation message
+#[derive(Clone, PartialEq, Message)]
+pub struct FieldViolation {
+    #[prost(string, tag = "1")]
+    pub field: String,
+    #[prost(string, tag = "2")]
+    pub description: String,
+}
+
+/// The google.rpc.BadRequest message: the fields of the request that are wrong or missing
+#[derive(Clone, PartialEq, Message)]
+pub struct BadRequest {
+    #[prost(message, repeated, tag = "1")]
+    pub field_violations: Vec<FieldViolation>,
+}
+
+/// The google.rpc.LocalizedMessage message: the message of the error, translated to the locale of the request
+#[derive(Clone, PartialEq, Message)]
+pub struct LocalizedMessage {
+    #[prost(string, tag = "1")]
+    pub locale: String,
+    #[prost(string, tag = "2")]
+    pub message: String,
+}
+
+/// The fields of a request found wrong before it was served, as told by the ValidationLayer to this one through the
+/// extensions of the response
+#[derive(Clone, Debug)]
+pub struct Violations(pub Vec<FieldViolation>);
+
+/// An error worth retrying once the given delay is over, such as a rate limit being exceeded or the login of an account
+/// being throttled. Its message is the one of the error it stands for, so it is matched on as any other
+#[derive(Debug)]
+pub struct RetryAfter {
+    message: &'static str,
+    delay: Duration,
+}
+
+impl fmt::Display for RetryAfter {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.message)
+    }
+}
+
+impl Error for RetryAfter {}
+
+/// Returns the error with the given message, telling to retry once the given delay is over
+pub fn retry_after(message: &'static str, delay: Duration) -> Box<dyn Error> {
+    Box::new(RetryAfter {
+        message: message,
+        delay: delay,
+    })
+}
+
+/// Returns how long the given error tells to wait before retrying, if it does
+pub fn get_retry_after(err: &(dyn Error + 'static)) -> Option<Duration> {
+    err.downcast_ref::<RetryAfter>().map(|err| err.delay)
+}
+
+/// Returns the given delay in whole seconds, rounded up so clients never retry too early, as the retry-after header of
+/// http tells it
+pub fn as_retry_secs(delay: Duration) -> u64 {
+    let secs = delay.as_secs() + if delay.subsec_nanos() > 0 { 1 } else { 0 };
+    secs.max(1)
+}
+
+/// Tells, by the retry-after metadata of the given status, how long the error it stands for tells to wait before
+/// retrying, if it does. Gateways translating the call into http tell it by the Retry-After header, while the
+/// ErrorDetailsLayer tells it by the RetryInfo of the details
+pub fn with_retry_after(mut status: Status, err: &(dyn Error + 'static)) -> Status {
+    let value = get_retry_after(err)
+        .and_then(|delay| MetadataValue::from_str(&as_retry_secs(delay).to_string()).ok());
+
+    if let Some(value) = value {
+        status.metadata_mut().insert(RETRY_AFTER_HEADER, value);
+    }
+
+    status
+}
+
+/// Returns the RESOURCE_EXHAUSTED status for the given error, telling how long to wait before retrying, if known
+pub fn new_exhausted(err: &(dyn Error + 'static)) -> Status {
+    with_retry_after(Status::resource_exhausted(err.to_string()), err)
+}
+
+fn pack<M: Message>(name: &str, detail: &M) -> Any {
+    Any {
+        type_url: format!("{}{}", TYPE_URL_PREFIX, name),
+        value: detail.encode_to_vec(),
+    }
+}
+
+/// Returns the reason of the given error, in upper snake case, along with how long to wait before retrying the
+/// request, if it is worth retrying at all. Errors not known by the service have an UNSPECIFIED reason
+pub fn get_reason(message: &str) -> (&'static str, Option<Duration>) {
+    match message {
+        errors::NOT_FOUND => ("NOT_FOUND", None),
+        errors::ALREADY_EXISTS => ("ALREADY_EXISTS", None),
+        errors::UNAUTHORIZED => ("UNAUTHORIZED", None),
+        errors::PARSE_FAILED => ("PARSE_FAILED", None),
+        errors::NOT_VERIFIED => ("NOT_VERIFIED", None),
+        errors::SUSPENDED => ("SUSPENDED", None),
+        errors::EXPIRED => ("EXPIRED", None),
+        errors::REVOKED => ("REVOKED", None),
+        errors::POLICY_REQUIRED => ("POLICY_REQUIRED", None),
+        errors::INVITATION_REQUIRED => ("INVITATION_REQUIRED", None),
+        errors::NOT_APPROVED => ("NOT_APPROVED", None),
+        errors::WRONG_CODE => ("WRONG_CODE", None),
+        errors::GUEST => ("GUEST_SESSION", None),
+        errors::ELEVATION_REQUIRED => ("ELEVATION_REQUIRED", None),
+        errors::RESET_REQUIRED => ("RESET_REQUIRED", None),
+        errors::IMPERSONATED => ("IMPERSONATED_SESSION", None),
+        errors::CAPTCHA_REQUIRED => ("CAPTCHA_REQUIRED", None),
+        errors::IP_NOT_ALLOWED => ("IP_NOT_ALLOWED", None),
+        errors::LOGIN_DENIED => ("LOGIN_DENIED", None),
+        errors::REPLAYED => ("REPLAYED", None),
+        errors::MFA_REQUIRED => ("MFA_REQUIRED", None),
+        errors::FEATURE_DISABLED => ("FEATURE_DISABLED", None),
+        errors::ISSUANCE_DENIED => ("ISSUANCE_DENIED", None),
+        errors::INVALID_USERNAME => ("INVALID_USERNAME", None),
+        errors::USERNAME_RESERVED => ("USERNAME_RESERVED", None),
+        errors::NOT_ACTIVATED => ("NOT_ACTIVATED", None),
+        errors::LOGIN_REQUIRED => ("LOGIN_REQUIRED", None),
+        errors::CONSENT_REQUIRED => ("CONSENT_REQUIRED", None),
+        errors::BATCH_TOO_LARGE => ("BATCH_TOO_LARGE", None),
+        errors::IMPORT_TOO_LARGE => ("IMPORT_TOO_LARGE", None),
+        errors::COMPRESSION_UNSUPPORTED => ("COMPRESSION_UNSUPPORTED", None),
+        errors::INVALID_REQUEST => ("INVALID_ARGUMENT", None),
+        errors::INVALID_PAGE_TOKEN => ("INVALID_ARGUMENT", None),
+        // quotas are accounted by windows of their own, so there is no telling when the next one starts
+        errors::QUOTA_EXCEEDED => ("QUOTA_EXCEEDED", None),
+        errors::TOO_MANY_REQUESTS => ("TOO_MANY_REQUESTS", Some(Duration::from_secs(settings::RETRY_DELAY))),
+        errors::OVERLOADED => ("OVERLOADED", Some(Duration::from_secs(settings::RETRY_DELAY))),
+        errors::LOCKED => ("LOCKED", Some(Duration::from_millis(settings::LOCK_WAIT))),
+        errors::THROTTLED => {
+            let timeout = config::get(environment::THROTTLE_TIMEOUT).ok()
+                .and_then(|timeout| timeout.parse().ok())
+                .unwrap_or(settings::THROTTLE_TIMEOUT);
+
+            ("THROTTLED", Some(Duration::from_secs(timeout)))
+        },
+        TOKEN_REQUIRED => ("TOKEN_REQUIRED", None),
+        message if message.starts_with(errors::PROFILE_INCOMPLETE) => ("PROFILE_INCOMPLETE", None),
+        message if message.starts_with(errors::LINK_REQUIRED) => ("LINK_REQUIRED", None),
+        message if message.starts_with(errors::TAMPERED) => ("TAMPERED", None),
+        message if message.starts_with(WRONG_PREFIX) => ("INVALID_ARGUMENT", None),
+        _ => ("UNSPECIFIED", None),
+    }
+}
+
+/// Returns the fields of the request the given error is about: the token if missing, the attributes a profile is
+/// missing, or the argument a message tells as wrong
+fn get_violations(message: &str) -> Vec<FieldViolation> {
+    if message == TOKEN_REQUIRED {
+        return vec![FieldViolation {
+            field: "token".to_string(),
+            description: message.to_string(),
+        }];
+    }
+
+    if let Some(missing) = user_missing_attributes(message) {
+        return missing.into_iter()
+            .map(|attribute| FieldViolation {
+                field: attribute,
+                description: "required".to_string(),
+            })
+            .collect();
+    }
+
+    ARGUMENTS.iter()
+        .filter(|(wrong, _)| *wrong == message)
+        .map(|(_, field)| FieldViolation {
+            field: field.to_string(),
+            description: message.to_string(),
+        })
+        .collect()
+}
+
+/// Returns the google.rpc.Status for the given code and error message, with the reason of the error, the fields it
+/// is about, besides the given ones, and how long to wait before retrying, if any, as well as the message translated
+/// to the given locale. The given delay, as told by the service, prevails over the one the reason tells
+pub fn new_details(code: i32, message: &str, violations: &[FieldViolation], retry: Option<Duration>,
+                   locale: Option<&str>) -> RpcStatus {
+    let (reason, default) = get_reason(message);
+    let retry = retry.or(default);
+    let mut details = vec![pack("ErrorInfo", &ErrorInfo {
+        reason: reason.to_string(),
+        domain: settings::ERROR_DOMAIN.to_string(),
+        metadata: HashMap::new(),
+    })];
+
+    let mut violations = violations.to_vec();
+    violations.extend(get_violations(message));
+    if violations.len() > 0 {
+        details.push(pack("BadRequest", &BadRequest {
+            field_violations: violations,
+        }));
+    }
+
+    if let Some(retry) = retry {
+        details.push(pack("RetryInfo", &RetryInfo {
+            retry_delay: Some(ProtoDuration {
+                seconds: retry.as_secs() as i64,
+                nanos: retry.subsec_nanos() as i32,
+            }),
+        }));
+    }
+
+    if let Some(locale) = locale {
+        details.push(pack("LocalizedMessage", &LocalizedMessage {
+            locale: locale.to_string(),
+            message: i18n::translate_error(locale, message),
+        }));
+    }
+
+    RpcStatus {
+        code: code,
+        message: message.to_string(),
+        details: details,
+    }
+}
+
+/// Returns the details of the failed response with the given headers, unless it succeeded or already has some
+fn get_details(headers: &HeaderMap, violations: Option<&Violations>, locale: Option<&str>) -> Option<String> {
+    if headers.contains_key(GRPC_DETAILS_HEADER) {
+        return None;
+    }
+
+    let code = headers.get(GRPC_STATUS_HEADER)
+        .and_then(|code| code.to_str().ok())
+        .and_then(|code| code.parse::<i32>().ok())
+        .filter(|code| *code != 0)?;
+
+    let message = headers.get(GRPC_MESSAGE_HEADER)
+        .and_then(|message| message.to_str().ok())
+        .map(i18n::decode_message)
+        .unwrap_or_default();
+
+    let retry = headers.get(RETRY_AFTER_HEADER)
+        .and_then(|retry| retry.to_str().ok())
+        .and_then(|retry| retry.parse().ok())
+        .map(Duration::from_secs);
+
+    let violations = violations.map(|violations| violations.0.as_slice()).unwrap_or_default();
+    let details = new_details(code, &message, violations, retry, locale).encode_to_vec();
+    Some(base64::encode_config(details, base64::STANDARD_NO_PAD))
+}
+
+/// A layer providing, along with every failed request served by the services it wraps, a google.rpc.Status as the
+/// details of its status, so clients can tell why it failed by its reason instead of parsing its message. Requests
+/// whose status already has details of its own, such as the ones of version 2 of the SessionService, are left as
+/// they are. It must be added after the LocaleLayer, so the message it reads is still the one in english, and before
+/// the ValidationLayer, so it tells the fields the latter has found wrong
+#[derive(Clone, Default)]
+pub struct ErrorDetailsLayer;
+
+impl<S> Layer<S> for ErrorDetailsLayer {
+    type Service = ErrorDetailsService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        ErrorDetailsService { inner }
+    }
+}
+
+#[derive(Clone)]
+pub struct ErrorDetailsService<S> {
+    inner: S,
+}
+
+impl<S, B, R> Service<http::Request<B>> for ErrorDetailsService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<R>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let requested = i18n::get_requested(request.headers());
+        let future = self.inner.call(request);
+        Box::pin(async move {
+            let mut result = future.await;
+
+            // failed calls tell their status by their headers, as metrics::get_code does with their status code
+            if let Ok(response) = &mut result {
+                let locale = match requested.len() {
+                    0 => None,
+                    _ => Some(i18n::negotiate(&requested)),
+                };
+
+                let violations = response.extensions().get::<Violations>();
+                let details = get_details(response.headers(), violations, locale.as_deref())
+                    .and_then(|details| HeaderValue::from_str(&details).ok());
+
+                if let Some(details) = details {
+                    response.headers_mut().insert(GRPC_DETAILS_HEADER, details);
+                }
+            }
+
+            result
+        })
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::error::Error;
+    use std::time::Duration;
+    use prost::Message;
+    use http::{HeaderMap, HeaderValue};
+    use tonic::Code;
+    use crate::constants::{errors, settings};
+    use super::{get_reason, get_details, new_details, RpcStatus, ErrorInfo, BadRequest, RetryInfo};
+    use super::{retry_after, get_retry_after, new_exhausted, as_retry_secs};
+    use super::{FieldViolation, Violations};
+
+    #[test]
+    fn get_reason_should_not_fail() {
+        assert_eq!(("NOT_FOUND", None), get_reason(errors::NOT_FOUND));
+        assert_eq!(("QUOTA_EXCEEDED", None), get_reason(errors::QUOTA_EXCEEDED));
+        assert_eq!(("REVOKED", None), get_reason(errors::REVOKED));
+        assert_eq!(("OVERLOADED", Some(Duration::from_secs(settings::RETRY_DELAY))), get_reason(errors::OVERLOADED));
+        assert_eq!("PROFILE_INCOMPLETE", get_reason(&format!("{}: given_name", errors::PROFILE_INCOMPLETE)).0);
+        assert_eq!("LINK_REQUIRED", get_reason(&format!("{}: token", errors::LINK_REQUIRED)).0);
+        assert_eq!("INVALID_ARGUMENT", get_reason("wrong template kind").0);
+        assert_eq!("UNSPECIFIED", get_reason("something else").0);
+    }
+
+    #[test]
+    fn new_details_should_not_fail() {
+        let message = format!("{}: given_name,family_name", errors::PROFILE_INCOMPLETE);
+        let status = new_details(9, &message, &[], None, None);
+        assert_eq!(9, status.code);
+        assert_eq!(message, status.message);
+        assert_eq!(2, status.details.len());
+
+        let info = ErrorInfo::decode(status.details[0].value.as_slice()).unwrap();
+        assert_eq!("type.googleapis.com/google.rpc.ErrorInfo", status.details[0].type_url);
+        assert_eq!("PROFILE_INCOMPLETE", info.reason);
+        assert_eq!(settings::ERROR_DOMAIN, info.domain);
+
+        let bad_request = BadRequest::decode(status.details[1].value.as_slice()).unwrap();
+        let fields: Vec<&str> = bad_request.field_violations.iter().map(|violation| violation.field.as_str()).collect();
+        assert_eq!(vec!["given_name", "family_name"], fields);
+    }
+
+    #[test]
+    fn new_details_with_retry_should_not_fail() {
+        let status = new_details(8, errors::TOO_MANY_REQUESTS, &[], None, Some("es"));
+        assert_eq!(3, status.details.len());
+        assert_eq!("type.googleapis.com/google.rpc.RetryInfo", status.details[1].type_url);
+        assert_eq!("type.googleapis.com/google.rpc.LocalizedMessage", status.details[2].type_url);
+
+        let retry = RetryInfo::decode(status.details[1].value.as_slice()).unwrap();
+        assert_eq!(settings::RETRY_DELAY as i64, retry.retry_delay.unwrap().seconds);
+
+        let status = new_details(8, errors::THROTTLED, &[], Some(Duration::from_secs(42)), None);
+        let retry = RetryInfo::decode(status.details[1].value.as_slice()).unwrap();
+        assert_eq!(42, retry.retry_delay.unwrap().seconds);
+    }
+
+    #[test]
+    fn retry_after_should_not_fail() {
+        let err = retry_after(errors::TOO_MANY_REQUESTS, Duration::from_millis(1500));
+        assert_eq!(errors::TOO_MANY_REQUESTS, err.to_string());
+        assert_eq!(Some(Duration::from_millis(1500)), get_retry_after(&*err));
+
+        let status = new_exhausted(&*err);
+        assert_eq!(Code::ResourceExhausted, status.code());
+        assert_eq!(errors::TOO_MANY_REQUESTS, status.message());
+        assert_eq!("2", status.metadata().get("retry-after").unwrap().to_str().unwrap());
+
+        let err: Box<dyn Error> = errors::TOO_MANY_REQUESTS.into();
+        assert_eq!(None, get_retry_after(&*err));
+        assert!(new_exhausted(&*err).metadata().get("retry-after").is_none());
+    }
+
+    #[test]
+    fn as_retry_secs_should_not_fail() {
+        assert_eq!(1, as_retry_secs(Duration::from_millis(0)));
+        assert_eq!(1, as_retry_secs(Duration::from_millis(200)));
+        assert_eq!(60, as_retry_secs(Duration::from_secs(60)));
+        assert_eq!(61, as_retry_secs(Duration::from_millis(60001)));
+    }
+
+    #[test]
+    fn get_details_should_not_fail() {
+        let mut headers = HeaderMap::new();
+        headers.insert("grpc-status", HeaderValue::from_static("10"));
+        headers.insert("grpc-message", HeaderValue::from_static("not%20found"));
+
+        let details = get_details(&headers, None, None).unwrap();
+        let details = base64::decode_config(details, base64::STANDARD_NO_PAD).unwrap();
+        let status = RpcStatus::decode(details.as_slice()).unwrap();
+        assert_eq!(10, status.code);
+        assert_eq!(errors::NOT_FOUND, status.message);
+
+        headers.insert("grpc-status", HeaderValue::from_static("8"));
+        headers.insert("grpc-message", HeaderValue::from_static("too%20many%20requests"));
+        headers.insert("retry-after", HeaderValue::from_static("30"));
+        let details = get_details(&headers, None, None).unwrap();
+        let details = base64::decode_config(details, base64::STANDARD_NO_PAD).unwrap();
+        let status = RpcStatus::decode(details.as_slice()).unwrap();
+        let retry = RetryInfo::decode(status.details[1].value.as_slice()).unwrap();
+        assert_eq!(30, retry.retry_delay.unwrap().seconds);
+    }
+
+    #[test]
+    fn get_details_should_fail() {
+        // successful responses have no details, while these having some already keep their own
+        let mut headers = HeaderMap::new();
+        headers.insert("grpc-status", HeaderValue::from_static("0"));
+        assert!(get_details(&headers, None, None).is_none());
+
+        headers.insert("grpc-status", HeaderValue::from_static("10"));
+        headers.insert("grpc-status-details-bin", HeaderValue::from_static("AAAA"));
+        assert!(get_details(&headers, None, None).is_none());
+    }
+
+    #[test]
+    fn get_details_with_violations_should_not_fail() {
+        let mut headers = HeaderMap::new();
+        headers.insert("grpc-status", HeaderValue::from_static("3"));
+        headers.insert("grpc-message", HeaderValue::from_static("invalid%20request"));
+
+        let violations = Violations(vec![FieldViolation {
+            field: "email".to_string(),
+            description: "must be a valid email".to_string(),
+        }]);
+
+        let details = get_details(&headers, Some(&violations), None).unwrap();
+        let details = base64::decode_config(details, base64::STANDARD_NO_PAD).unwrap();
+        let status = RpcStatus::decode(details.as_slice()).unwrap();
+        assert_eq!("INVALID_ARGUMENT", ErrorInfo::decode(status.details[0].value.as_slice()).unwrap().reason);
+
+        let bad_request = BadRequest::decode(status.details[1].value.as_slice()).unwrap();
+        assert_eq!("email", bad_request.field_violations[0].field);
+    }
+}
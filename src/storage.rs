@@ -0,0 +1,86 @@
+use crate::constants::environment;
+use crate::config;
+
+/// All the storage backends a repository may be provided by
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Backend {
+    Postgres,
+    Mongo,
+    Memory,
+    Redis,
+}
+
+impl Backend {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Backend::Postgres => "postgres",
+            Backend::Mongo => "mongo",
+            Backend::Memory => "memory",
+            Backend::Redis => "redis",
+        }
+    }
+
+    pub fn from_str(backend: &str) -> Option<Self> {
+        match backend {
+            "postgres" => Some(Backend::Postgres),
+            "mongo" => Some(Backend::Mongo),
+            "memory" => Some(Backend::Memory),
+            "redis" => Some(Backend::Redis),
+            _ => None,
+        }
+    }
+}
+
+lazy_static! {
+    // if set, all the repositories are provided by the same backend
+    static ref BACKEND: Option<Backend> = {
+        config::get(environment::STORAGE).ok().map(|backend| {
+            Backend::from_str(&backend).expect("storage must be one of postgres, mongo or memory")
+        })
+    };
+
+    // sessions are volatile, so they have their own backend regardless of the one of all the other repositories
+    static ref SESSION_BACKEND: Backend = {
+        match config::get(environment::SESSION_STORAGE) {
+            Ok(backend) => Backend::from_str(&backend).expect("session storage must be one of memory or redis"),
+            Err(_) => Backend::Memory,
+        }
+    };
+}
+
+/// Returns the backend a repository must be provided by: the one set by the environment, if any, or else the
+/// provided default backend of the repository
+pub fn get_backend(default: Backend) -> Backend {
+    match *BACKEND {
+        Some(backend) => backend,
+        None => default,
+    }
+}
+
+/// Returns the backend the session repositories must be provided by: the one set by the environment, if any, or else
+/// the memory one
+pub fn get_session_backend() -> Backend {
+    *SESSION_BACKEND
+}
+
+/// Aborts the startup since the provided backend cannot provide the given repository
+pub fn unsupported(backend: Backend, repository: &str) -> ! {
+    panic!("{} storage does not support {} repository", backend.as_str(), repository)
+}
+
+#[cfg(test)]
+pub mod tests {
+    use super::Backend;
+
+    #[test]
+    fn backend_from_str_should_not_fail() {
+        for backend in [Backend::Postgres, Backend::Mongo, Backend::Memory, Backend::Redis].iter() {
+            assert_eq!(Some(*backend), Backend::from_str(backend.as_str()));
+        }
+    }
+
+    #[test]
+    fn backend_from_str_should_fail() {
+        assert_eq!(None, Backend::from_str("cassandra"));
+    }
+}
\ No newline at end of file
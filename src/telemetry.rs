@@ -0,0 +1,118 @@
+use std::error::Error;
+use std::future::Future;
+use std::pin::Pin;
+use std::task::{Context as TaskContext, Poll};
+use opentelemetry::{global, KeyValue};
+use opentelemetry::propagation::Extractor;
+use opentelemetry::sdk::propagation::TraceContextPropagator;
+use opentelemetry::trace::{FutureExt, Span, StatusCode, TraceContextExt, Tracer};
+use opentelemetry_otlp::WithExportConfig;
+use tower::{Layer, Service};
+
+use crate::constants::{environment, settings};
+use crate::config;
+use crate::metrics::get_code;
+
+struct HeaderExtractor<'a>(&'a http::HeaderMap);
+
+impl<'a> Extractor for HeaderExtractor<'a> {
+    fn get(&self, key: &str) -> Option<&str> {
+        self.0.get(key).and_then(|value| value.to_str().ok())
+    }
+
+    fn keys(&self) -> Vec<&str> {
+        self.0.keys().map(|key| key.as_str()).collect()
+    }
+}
+
+/// Installs the exporter sending all the spans to the OTLP collector at OTEL_EXPORTER_OTLP_ENDPOINT, if set. Otherwise
+/// spans are neither recorded nor exported, while the incoming trace context is still propagated
+pub fn init() -> Result<(), Box<dyn Error>> {
+    global::set_text_map_propagator(TraceContextPropagator::new());
+
+    let endpoint = match config::get(environment::OTLP_ENDPOINT) {
+        Ok(endpoint) => endpoint,
+        Err(_) => return Ok(()),
+    };
+
+    opentelemetry_otlp::new_pipeline()
+        .tracing()
+        .with_exporter(opentelemetry_otlp::new_exporter().tonic().with_endpoint(&endpoint))
+        .install_batch(opentelemetry::runtime::Tokio)?;
+
+    info!("spans exported to {}", endpoint);
+    Ok(())
+}
+
+/// Exports all the spans not exported yet
+pub fn shutdown() {
+    global::shutdown_tracer_provider();
+}
+
+/// Runs the given closure within a child span of the current one, so the steps of a use case (e.g. repository calls)
+/// show up within the request they are part of
+pub fn in_span<T, F: FnOnce() -> T>(name: &'static str, f: F) -> T {
+    global::tracer(settings::TRACER_NAME).in_span(name, |_| f())
+}
+
+/// A layer tracing all the requests served by the services it wraps, each of them as a child span of the trace context
+/// the request comes with, if any
+#[derive(Clone, Default)]
+pub struct TracingLayer;
+
+impl<S> Layer<S> for TracingLayer {
+    type Service = TracingService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        TracingService { inner }
+    }
+}
+
+#[derive(Clone)]
+pub struct TracingService<S> {
+    inner: S,
+}
+
+impl<S, B, R> Service<http::Request<B>> for TracingService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<R>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut TaskContext<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<B>) -> Self::Future {
+        let parent = global::get_text_map_propagator(|propagator| {
+            propagator.extract(&HeaderExtractor(request.headers()))
+        });
+
+        let name = request.uri().path().trim_start_matches('/').to_string();
+        let mut span = global::tracer(settings::TRACER_NAME).start_with_context(name, &parent);
+        span.set_attribute(KeyValue::new("rpc.system", "grpc"));
+
+        let cx = parent.with_span(span);
+        let future = self.inner.call(request).with_context(cx.clone());
+
+        Box::pin(async move {
+            let result = future.await;
+            let code = match &result {
+                Ok(response) => get_code(response),
+                Err(_) => format!("{:?}", tonic::Code::Unknown),
+            };
+
+            let span = cx.span();
+            span.set_attribute(KeyValue::new("rpc.grpc.status_code", code.clone()));
+            if code != format!("{:?}", tonic::Code::Ok) {
+                span.set_status(StatusCode::Error, code);
+            }
+
+            span.end();
+            result
+        })
+    }
+}
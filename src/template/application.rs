@@ -0,0 +1,68 @@
+use std::error::Error;
+use crate::constants::errors;
+use crate::metadata::domain::Metadata;
+use crate::{i18n, smtp};
+use super::{
+    get_repository as get_template_repository,
+    domain::{Template, TemplateKind},
+};
+
+/// Overrides the template of the given notification in the given tenant by a new version made of the given subject
+/// and body, if, and only if, both are valid templates of that notification. Former versions are kept
+pub fn template_set(tenant: i32,
+                    kind: TemplateKind,
+                    subject: &str,
+                    body: &str) -> Result<Template, Box<dyn Error>> {
+
+    info!("got a template update request for template {} ", kind.as_str());
+
+    let version = match get_template_repository().find_latest(tenant, kind) {
+        Ok(latest) => latest.get_version() + 1,
+        Err(_) => 1,
+    };
+
+    let mut template = Template::new(Metadata::new(), tenant, kind, version, subject, body)?;
+    get_template_repository().create(&mut template)?;
+    Ok(template)
+}
+
+/// Returns the latest version of the template of the given notification in the given tenant, if overridden
+pub fn template_find(tenant: i32, kind: TemplateKind) -> Result<Template, Box<dyn Error>> {
+    get_template_repository().find_latest(tenant, kind)
+}
+
+/// Returns all the versions of all the templates overridden in the given tenant
+pub fn template_list(tenant: i32) -> Result<Vec<Template>, Box<dyn Error>> {
+    get_template_repository().find_all_by_tenant(tenant)
+}
+
+/// Removes all the versions of the template of the given notification in the given tenant, so the default one gets
+/// used back
+pub fn template_reset(tenant: i32, kind: TemplateKind) -> Result<(), Box<dyn Error>> {
+    info!("got a template reset request for template {} ", kind.as_str());
+    get_template_repository().delete_all_by_kind(tenant, kind)
+}
+
+/// Renders the given notification with the given variables, made up for those not given, and returns its subject and
+/// body. Unless any subject and body are given, and then validated as a new version would be, the template used is
+/// the one the notification would be sent with by the given tenant in the given locale
+pub fn template_preview(tenant: i32,
+                        kind: TemplateKind,
+                        locale: &str,
+                        subject: &str,
+                        body: &str,
+                        values: &[(String, String)]) -> Result<(String, String), Box<dyn Error>> {
+
+    if values.iter().any(|(name, _)| !kind.get_variables().contains(&name.as_str())) {
+        return Err(errors::PARSE_FAILED.into());
+    }
+
+    let context = kind.sample_context(values);
+    if subject.is_empty() && body.is_empty() {
+        let locale = i18n::negotiate(&[locale]);
+        return smtp::render_notification(tenant, kind, &locale, &context);
+    }
+
+    let template = Template::new(Metadata::new(), tenant, kind, 0, subject, body)?;
+    template.render(&context)
+}
@@ -0,0 +1,289 @@
+use std::error::Error;
+use std::time::SystemTime;
+use tera::{Tera, Context};
+
+use crate::constants::{errors, settings};
+use crate::metadata::domain::Metadata;
+
+pub trait TemplateRepository {
+    fn find_latest(&self, tenant: i32, kind: TemplateKind) -> Result<Template, Box<dyn Error>>;
+    fn find_all_by_tenant(&self, tenant: i32) -> Result<Vec<Template>, Box<dyn Error>>;
+    fn create(&self, template: &mut Template) -> Result<(), Box<dyn Error>>;
+    fn delete_all_by_kind(&self, tenant: i32, kind: TemplateKind) -> Result<(), Box<dyn Error>>;
+}
+
+/// All the notifications whose template may be overridden by a tenant
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum TemplateKind {
+    Verification,
+    PasswordReset,
+    EmailChangeConfirmation,
+    EmailChangeNotification,
+    Invitation,
+    NewDevice,
+    NewLocation,
+    RecoveryApproval,
+    Activation,
+}
+
+impl TemplateKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            TemplateKind::Verification => "verification",
+            TemplateKind::PasswordReset => "password_reset",
+            TemplateKind::EmailChangeConfirmation => "email_change_confirmation",
+            TemplateKind::EmailChangeNotification => "email_change_notification",
+            TemplateKind::Invitation => "invitation",
+            TemplateKind::NewDevice => "new_device",
+            TemplateKind::NewLocation => "new_location",
+            TemplateKind::RecoveryApproval => "recovery_approval",
+            TemplateKind::Activation => "activation",
+        }
+    }
+
+    pub fn from_str(kind: &str) -> Option<Self> {
+        match kind {
+            "verification" => Some(TemplateKind::Verification),
+            "password_reset" => Some(TemplateKind::PasswordReset),
+            "email_change_confirmation" => Some(TemplateKind::EmailChangeConfirmation),
+            "email_change_notification" => Some(TemplateKind::EmailChangeNotification),
+            "invitation" => Some(TemplateKind::Invitation),
+            "new_device" => Some(TemplateKind::NewDevice),
+            "new_location" => Some(TemplateKind::NewLocation),
+            "recovery_approval" => Some(TemplateKind::RecoveryApproval),
+            "activation" => Some(TemplateKind::Activation),
+            _ => None,
+        }
+    }
+
+    pub fn all() -> Vec<Self> {
+        vec![TemplateKind::Verification, TemplateKind::PasswordReset, TemplateKind::EmailChangeConfirmation,
+             TemplateKind::EmailChangeNotification, TemplateKind::Invitation, TemplateKind::NewDevice,
+             TemplateKind::NewLocation, TemplateKind::RecoveryApproval, TemplateKind::Activation]
+    }
+
+    /// Returns the name of the file, among the ones matching TEMPLATES, the body of the notification is rendered by
+    /// unless its tenant has overridden it
+    pub fn get_file(&self) -> &'static str {
+        match self {
+            TemplateKind::Verification => "verification_email.html",
+            TemplateKind::PasswordReset => "password_reset_email.html",
+            TemplateKind::EmailChangeConfirmation => "email_change_confirmation.html",
+            TemplateKind::EmailChangeNotification => "email_change_notification.html",
+            TemplateKind::Invitation => "invitation_email.html",
+            TemplateKind::NewDevice => "new_device_notification.html",
+            TemplateKind::NewLocation => "new_location_notification.html",
+            TemplateKind::RecoveryApproval => "recovery_approval_email.html",
+            TemplateKind::Activation => "activation_email.html",
+        }
+    }
+
+    /// Returns the template the subject of the notification is rendered by unless its tenant has overridden it
+    pub fn get_subject(&self) -> &'static str {
+        match self {
+            TemplateKind::Verification => "[{{ prefix }}] Verification email",
+            TemplateKind::PasswordReset => "[{{ prefix }}] Reset your password",
+            TemplateKind::EmailChangeConfirmation => "[{{ prefix }}] Confirm your new email",
+            TemplateKind::EmailChangeNotification => "[{{ prefix }}] Your email is being changed",
+            TemplateKind::Invitation => "[{{ prefix }}] You have been invited",
+            TemplateKind::NewDevice => "[{{ prefix }}] New login to your account",
+            TemplateKind::NewLocation => "[{{ prefix }}] Unusual login to your account",
+            TemplateKind::RecoveryApproval => "[{{ prefix }}] {{ email }} asks for your help to recover their account",
+            TemplateKind::Activation => "[{{ prefix }}] Activate your account",
+        }
+    }
+
+    /// Returns the variables the notification is rendered with, besides the prefix of its subject and the branding of
+    /// the app it is sent on behalf of, if any, as brand. The first one, if any, is required: the notification is of
+    /// no use without it
+    pub fn get_variables(&self) -> &'static [&'static str] {
+        match self {
+            TemplateKind::Verification => &["token"],
+            TemplateKind::PasswordReset => &["token"],
+            TemplateKind::EmailChangeConfirmation => &["token"],
+            TemplateKind::EmailChangeNotification => &["email"],
+            TemplateKind::Invitation => &["code"],
+            TemplateKind::NewDevice => &["token", "device"],
+            TemplateKind::NewLocation => &["country", "anomalies"],
+            TemplateKind::RecoveryApproval => &["token", "email"],
+            TemplateKind::Activation => &["token", "deadline"],
+        }
+    }
+
+    /// Tells whether the notification is of no use unless its first variable gets rendered into its body
+    pub fn is_first_required(&self) -> bool {
+        !matches!(self, TemplateKind::EmailChangeNotification | TemplateKind::NewLocation)
+    }
+
+    /// Returns a context holding a sample value, as given or made up, for every variable of the notification. The
+    /// branding is left unset, as it is for notifications sent with no app involved
+    pub fn sample_context(&self, values: &[(String, String)]) -> Context {
+        let mut context = Context::new();
+        context.insert("prefix", "tpauth");
+        context.insert("brand", &None::<()>);
+        for name in self.get_variables() {
+            let value = values.iter()
+                .find(|(key, _)| key == name)
+                .map(|(_, value)| value.clone())
+                .unwrap_or(format!("sample-{}", name));
+
+            context.insert(*name, &value);
+        }
+
+        context
+    }
+}
+
+/// A version of the template a tenant has overridden a notification by. Versions are never changed: a new one is
+/// created instead, and the latest one is used
+#[derive(Clone)]
+pub struct Template {
+    pub(super) id: i32,
+    pub(super) tenant: i32,
+    pub(super) kind: TemplateKind,
+    pub(super) version: i32,
+    pub(super) subject: String,
+    pub(super) body: String,
+    pub(super) meta: Metadata,
+}
+
+impl Template {
+    /// Builds a new version of the template of the given notification if, and only if, both the subject and body are
+    /// valid templates, rendering with no other variables than the ones of the notification and, if required, the
+    /// first of them into the body
+    pub fn new(meta: Metadata,
+               tenant: i32,
+               kind: TemplateKind,
+               version: i32,
+               subject: &str,
+               body: &str) -> Result<Self, Box<dyn Error>> {
+
+        if subject.len() > settings::TEMPLATE_SUBJECT_LEN || body.len() > settings::TEMPLATE_BODY_LEN {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        let template = Template {
+            id: 0,
+            tenant: tenant,
+            kind: kind,
+            version: version,
+            subject: subject.to_string(),
+            body: body.to_string(),
+            meta: meta,
+        };
+
+        let first = kind.get_variables().first().filter(|_| kind.is_first_required());
+        let marker = first.map(|name| (name.to_string(), format!("__{}__", name)));
+        let context = kind.sample_context(&marker.iter().cloned().collect::<Vec<_>>());
+        let (_, body) = template.render(&context)?;
+        if let Some((_, value)) = marker {
+            if !body.contains(&value) {
+                return Err(errors::PARSE_FAILED.into());
+            }
+        }
+
+        Ok(template)
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_kind(&self) -> TemplateKind {
+        self.kind
+    }
+
+    pub fn get_version(&self) -> i32 {
+        self.version
+    }
+
+    pub fn get_subject(&self) -> &str {
+        &self.subject
+    }
+
+    pub fn get_body(&self) -> &str {
+        &self.body
+    }
+
+    pub fn get_created_at(&self) -> SystemTime {
+        self.meta.created_at
+    }
+
+    /// Renders the subject and body of the template with the given variables. Any variable not in the context makes
+    /// the render fail, and the body gets html escaped
+    pub fn render(&self, context: &Context) -> Result<(String, String), Box<dyn Error>> {
+        let subject = Tera::one_off(&self.subject, context, false)?;
+        let body = Tera::one_off(&self.body, context, true)?;
+        Ok((subject.trim().to_string(), body))
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use crate::constants::settings;
+    use crate::metadata::domain::tests::new_metadata;
+    use super::{Template, TemplateKind};
+
+    pub fn new_template() -> Template {
+        Template {
+            id: 999,
+            tenant: settings::DEFAULT_TENANT,
+            kind: TemplateKind::Verification,
+            version: 1,
+            subject: "[{{ prefix }}] Welcome".to_string(),
+            body: "<a href=\"https://example.com/verify?token={{ token }}\">Verify</a>".to_string(),
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn template_kind_from_str_should_not_fail() {
+        for kind in TemplateKind::all() {
+            assert_eq!(Some(kind), TemplateKind::from_str(kind.as_str()));
+        }
+
+        assert_eq!(None, TemplateKind::from_str("unknown"));
+    }
+
+    #[test]
+    fn template_new_should_not_fail() {
+        let template = Template::new(new_metadata(), settings::DEFAULT_TENANT, TemplateKind::NewDevice, 2,
+                                     "New login from {{ device }}",
+                                     "{% if brand %}{{ brand.name }}{% endif %}Not you? {{ token }}").unwrap();
+
+        assert_eq!(0, template.get_id());
+        assert_eq!(2, template.get_version());
+        assert_eq!(TemplateKind::NewDevice, template.get_kind());
+    }
+
+    #[test]
+    fn template_new_should_fail() {
+        // unknown variables
+        assert!(Template::new(new_metadata(), settings::DEFAULT_TENANT, TemplateKind::Verification, 1,
+                              "Hi {{ name }}", "{{ token }}").is_err());
+        // the required variable is missing
+        assert!(Template::new(new_metadata(), settings::DEFAULT_TENANT, TemplateKind::Verification, 1,
+                              "Welcome", "Welcome aboard").is_err());
+        // not a template at all
+        assert!(Template::new(new_metadata(), settings::DEFAULT_TENANT, TemplateKind::Verification, 1,
+                              "Welcome", "{% if token %}").is_err());
+        // the branding may be unset
+        assert!(Template::new(new_metadata(), settings::DEFAULT_TENANT, TemplateKind::Verification, 1,
+                              "Welcome", "{{ brand.name }} {{ token }}").is_err());
+    }
+
+    #[test]
+    fn template_render_should_not_fail() {
+        let template = new_template();
+        let values = vec![("token".to_string(), "<abc>".to_string())];
+        let (subject, body) = template.render(&TemplateKind::Verification.sample_context(&values)).unwrap();
+
+        assert_eq!("[tpauth] Welcome", subject);
+        assert_eq!("<a href=\"https://example.com/verify?token=&lt;abc&gt;\">Verify</a>", body);
+    }
+}
@@ -0,0 +1,198 @@
+use std::error::Error;
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::constants::errors;
+use crate::schema::templates;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use super::domain::{Template, TemplateKind, TemplateRepository};
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(Clone)]
+#[table_name = "templates"]
+struct PostgresTemplate {
+    pub id: i32,
+    pub tenant_id: i32,
+    pub kind: String,
+    pub version: i32,
+    pub subject: String,
+    pub body: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "templates"]
+struct NewPostgresTemplate<'a> {
+    pub tenant_id: i32,
+    pub kind: &'a str,
+    pub version: i32,
+    pub subject: &'a str,
+    pub body: &'a str,
+    pub meta_id: i32,
+}
+
+pub struct PostgresTemplateRepository;
+
+impl PostgresTemplateRepository {
+    fn create_on_conn(conn: &PgConnection, template: &mut Template) -> Result<(), PgError>  {
+        // in order to create a template it must exists the metadata for this template
+        PostgresMetadataRepository::create_on_conn(conn, &mut template.meta)?;
+
+        let new_template = NewPostgresTemplate {
+            tenant_id: template.tenant,
+            kind: template.kind.as_str(),
+            version: template.version,
+            subject: &template.subject,
+            body: &template.body,
+            meta_id: template.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(templates::table)
+            .values(&new_template)
+            .get_result::<PostgresTemplate>(conn)?;
+
+        template.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, template: &Template) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            templates::table.filter(templates::id.eq(template.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &template.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresTemplate) -> Result<Template, Box<dyn Error>> {
+        let kind = TemplateKind::from_str(&result.kind)
+            .ok_or(NotFound)?;
+
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(Template{
+            id: result.id,
+            tenant: result.tenant_id,
+            kind: kind,
+            version: result.version,
+            subject: result.subject.clone(),
+            body: result.body.clone(),
+            meta: meta,
+        })
+    }
+}
+
+impl TemplateRepository for PostgresTemplateRepository {
+    fn find_latest(&self, tenant: i32, kind: TemplateKind) -> Result<Template, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            templates::table.filter(templates::tenant_id.eq(tenant))
+                            .filter(templates::kind.eq(kind.as_str()))
+                            .order(templates::version.desc())
+                            .limit(1)
+                            .load::<PostgresTemplate>(&connection)?
+        };
+
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresTemplateRepository::build(&results[0])
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<Template>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            templates::table.filter(templates::tenant_id.eq(target))
+                            .order((templates::kind.asc(), templates::version.asc()))
+                            .load::<PostgresTemplate>(&connection)?
+        };
+
+        let mut all_templates = Vec::new();
+        for result in results.iter() {
+            all_templates.push(PostgresTemplateRepository::build(result)?);
+        }
+
+        Ok(all_templates)
+    }
+
+    fn create(&self, template: &mut Template) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresTemplateRepository::create_on_conn(&conn, template))?;
+        Ok(())
+    }
+
+    fn delete_all_by_kind(&self, tenant: i32, kind: TemplateKind) -> Result<(), Box<dyn Error>> {
+        // all the versions of the template get removed at once
+        let all_templates: Vec<Template> = self.find_all_by_tenant(tenant)?
+            .into_iter()
+            .filter(|template| template.kind == kind)
+            .collect();
+
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| {
+            for template in all_templates.iter() {
+                PostgresTemplateRepository::delete_on_conn(&conn, template)?;
+            }
+
+            Ok(())
+        })?;
+
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryTemplateRepository {
+    table: memory::Table<Template>,
+}
+
+impl InMemoryTemplateRepository {
+    pub fn new() -> Self {
+        InMemoryTemplateRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl TemplateRepository for InMemoryTemplateRepository {
+    fn find_latest(&self, tenant: i32, kind: TemplateKind) -> Result<Template, Box<dyn Error>>  {
+        self.table.find_all(|template| template.tenant == tenant && template.kind == kind)?
+            .into_iter()
+            .max_by_key(|template| template.version)
+            .ok_or_else(|| errors::NOT_FOUND.into())
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<Template>, Box<dyn Error>>  {
+        let mut all_templates = self.table.find_all(|template| template.tenant == target)?;
+        all_templates.sort_by(|a, b| (a.kind.as_str(), a.version).cmp(&(b.kind.as_str(), b.version)));
+        Ok(all_templates)
+    }
+
+    fn create(&self, template: &mut Template) -> Result<(), Box<dyn Error>> {
+        // in order to create a template it must exists the metadata for this template
+        get_meta_repository().create(&mut template.meta)?;
+        let (tenant, kind, version) = (template.tenant, template.kind, template.version);
+        self.table.insert(template, |other| other.tenant == tenant && other.kind == kind && other.version == version,
+                          |template, new_id| template.id = new_id)
+    }
+
+    fn delete_all_by_kind(&self, tenant: i32, kind: TemplateKind) -> Result<(), Box<dyn Error>> {
+        let all_templates = self.table.find_all(|template| template.tenant == tenant && template.kind == kind)?;
+        for template in all_templates {
+            self.table.delete(template.id)?;
+            get_meta_repository().delete(&template.meta)?;
+        }
+
+        Ok(())
+    }
+}
@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::TemplateRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresTemplateRepository),
+            Backend::Memory => Box::new(framework::InMemoryTemplateRepository::new()),
+            backend => storage::unsupported(backend, "templates"),
+        }
+    };
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::TemplateRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
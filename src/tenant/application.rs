@@ -0,0 +1,48 @@
+use std::error::Error;
+use crate::constants::{environment, settings};
+use crate::{config, security};
+use super::{
+    get_repository as get_tenant_repository,
+    domain::Tenant,
+};
+
+/// Returns the tenant with the provided name, or the default one if no name is provided
+pub fn tenant_find(name: &str) -> Result<Tenant, Box<dyn Error>> {
+    if name.len() == 0 {
+        return get_tenant_repository().find(settings::DEFAULT_TENANT);
+    }
+
+    get_tenant_repository().find_by_name(name)
+}
+
+/// Returns the value of the given setting for the tenant with the provided id: the one the tenant overrides it with,
+/// if any, or else the one set by the environment
+pub fn tenant_setting(tenant: i32, name: &str) -> Option<String> {
+    match get_tenant_repository().find(tenant) {
+        Ok(tenant) => if let Some(value) = tenant.get_setting(name) {
+            return Some(value.to_string());
+        },
+
+        Err(err) => warn!("settings of tenant {} could not be loaded: {}", tenant, err),
+    }
+
+    config::get(name).ok()
+}
+
+/// Returns the key set the tokens of the tenant with the provided id are signed by: the one named by its JWT_KEY_SET
+/// setting, as long as it is any of the listed by JWT_KEY_SETS, or else the default one
+pub fn tenant_key_set(tenant: i32) -> String {
+    match tenant_setting(tenant, environment::JWT_KEY_SET) {
+        Some(set) if security::is_jwt_key_set(&set) => set,
+        Some(set) => {
+            warn!("key set {} of tenant {} is not listed, signing by the default one", set, tenant);
+            security::DEFAULT_KEY_SET.to_string()
+        },
+        None => security::DEFAULT_KEY_SET.to_string(),
+    }
+}
+
+/// Returns the issuer of the tokens of the tenant with the provided id, as told by its ISSUER_URL setting
+pub fn tenant_issuer(tenant: i32) -> String {
+    tenant_setting(tenant, environment::ISSUER_URL).unwrap_or(settings::TOKEN_ISSUER.to_string())
+}
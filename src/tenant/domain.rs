@@ -0,0 +1,98 @@
+use std::error::Error;
+use std::collections::HashMap;
+use crate::regex;
+use crate::metadata::domain::Metadata;
+
+pub trait TenantRepository {
+    fn find(&self, id: i32) -> Result<Tenant, Box<dyn Error>>;
+    fn find_by_name(&self, name: &str) -> Result<Tenant, Box<dyn Error>>;
+    fn create(&self, tenant: &mut Tenant) -> Result<(), Box<dyn Error>>;
+    fn save(&self, tenant: &Tenant) -> Result<(), Box<dyn Error>>;
+}
+
+#[derive(Clone)]
+pub struct Tenant {
+    pub(super) id: i32,
+    pub(super) name: String,
+    pub(super) settings: HashMap<String, String>, // overrides of the service's environment for this tenant
+    pub(super) meta: Metadata,
+}
+
+impl Tenant {
+    pub fn new(meta: Metadata, name: &str) -> Result<Self, Box<dyn Error>> {
+        regex::match_regex(regex::TENANT, name)?;
+
+        let tenant = Tenant {
+            id: 0,
+            name: name.to_string(),
+            settings: HashMap::new(),
+            meta: meta,
+        };
+
+        Ok(tenant)
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_name(&self) -> &str {
+        &self.name
+    }
+
+    /// returns the value the tenant overrides the given setting with, if any
+    pub fn get_setting(&self, name: &str) -> Option<&str> {
+        self.settings.get(name).map(|value| value.as_str())
+    }
+
+    /// overrides the given setting for this tenant, returning the previous value, if any
+    pub fn set_setting(&mut self, name: &str, value: &str) -> Option<String> {
+        self.meta.touch();
+        self.settings.insert(name.to_string(), value.to_string())
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::collections::HashMap;
+    use crate::metadata::domain::tests::new_metadata;
+    use super::Tenant;
+
+    pub fn new_tenant() -> Tenant {
+        Tenant{
+            id: 999,
+            name: "testing".to_string(),
+            settings: HashMap::new(),
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn tenant_new_should_not_fail() {
+        const NAME: &str = "acme-corp";
+
+        let meta = new_metadata();
+        let tenant = Tenant::new(meta, NAME).unwrap();
+
+        assert_eq!(tenant.id, 0);
+        assert_eq!(tenant.name, NAME);
+        assert_eq!(tenant.settings.len(), 0);
+    }
+
+    #[test]
+    fn tenant_new_with_wrong_name_should_fail() {
+        let meta = new_metadata();
+        let tenant = Tenant::new(meta, "Not A Tenant");
+        assert!(tenant.is_err());
+    }
+
+    #[test]
+    fn tenant_set_setting_should_not_fail() {
+        let mut tenant = new_tenant();
+        assert_eq!(tenant.get_setting("SIGNUP_INVITATION"), None);
+        assert_eq!(tenant.set_setting("SIGNUP_INVITATION", "true"), None);
+        assert_eq!(tenant.get_setting("SIGNUP_INVITATION"), Some("true"));
+        assert_eq!(tenant.set_setting("SIGNUP_INVITATION", "false"), Some("true".to_string()));
+    }
+}
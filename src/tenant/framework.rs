@@ -0,0 +1,206 @@
+use std::error::Error;
+use tonic::{Request, Status};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::tenants;
+use crate::schema::tenant_settings;
+use crate::constants::settings;
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+    domain::Metadata,
+};
+
+use super::domain::{Tenant, TenantRepository};
+
+/// Returns the name of the tenant the request is addressed to, as set by its "tenant" header, or an empty string if
+/// none, standing for the default tenant
+pub fn get_tenant<T>(request: &Request<T>) -> Result<String, Status> {
+    match request.metadata().get("tenant") {
+        None => Ok("".to_string()),
+        Some(value) => match value.to_str() {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(tenant) => Ok(tenant.to_string()),
+        },
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(Clone)]
+#[table_name = "tenants"]
+struct PostgresTenant {
+    pub id: i32,
+    pub name: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "tenants"]
+struct NewPostgresTenant<'a> {
+    pub name: &'a str,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "tenant_settings"]
+struct NewPostgresTenantSetting<'a> {
+    pub tenant_id: i32,
+    pub name: &'a str,
+    pub value: &'a str,
+}
+
+pub struct PostgresTenantRepository;
+
+impl PostgresTenantRepository {
+    fn create_on_conn(conn: &PgConnection, tenant: &mut Tenant) -> Result<(), PgError>  {
+        // in order to create a tenant it must exists the metadata for this tenant
+        PostgresMetadataRepository::create_on_conn(conn, &mut tenant.meta)?;
+
+        let new_tenant = NewPostgresTenant {
+            name: &tenant.name,
+            meta_id: tenant.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(tenants::table)
+            .values(&new_tenant)
+            .get_result::<PostgresTenant>(conn)?;
+
+        tenant.id = result.id;
+        PostgresTenantRepository::save_settings_on_conn(conn, tenant)
+    }
+
+    fn save_settings_on_conn(conn: &PgConnection, tenant: &Tenant) -> Result<(), PgError>  {
+        diesel::delete(
+            tenant_settings::table.filter(tenant_settings::tenant_id.eq(tenant.id))
+        ).execute(conn)?;
+
+        let new_settings: Vec<NewPostgresTenantSetting> = tenant.settings.iter()
+            .map(|(setting_name, setting_value)| NewPostgresTenantSetting {
+                tenant_id: tenant.id,
+                name: setting_name,
+                value: setting_value,
+            })
+            .collect();
+
+        if new_settings.len() > 0 {
+            diesel::insert_into(tenant_settings::table)
+                .values(&new_settings)
+                .execute(conn)?;
+        }
+
+        Ok(())
+    }
+
+    fn build_first(results: &[PostgresTenant]) -> Result<Tenant, Box<dyn Error>> {
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        let meta = get_meta_repository().find(results[0].meta_id)?;
+        let settings = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            tenant_settings::table.filter(tenant_settings::tenant_id.eq(results[0].id))
+                                  .select((tenant_settings::name, tenant_settings::value))
+                                  .load::<(String, String)>(&connection)?
+        };
+
+        Ok(Tenant{
+            id: results[0].id,
+            name: results[0].name.clone(),
+            settings: settings.into_iter().collect(),
+            meta: meta,
+        })
+    }
+}
+
+impl TenantRepository for PostgresTenantRepository {
+    fn find(&self, target: i32) -> Result<Tenant, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            tenants::table.filter(tenants::id.eq(target))
+                          .load::<PostgresTenant>(&connection)?
+        };
+
+        PostgresTenantRepository::build_first(&results)
+    }
+
+    fn find_by_name(&self, target: &str) -> Result<Tenant, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            tenants::table.filter(tenants::name.eq(target))
+                          .load::<PostgresTenant>(&connection)?
+        };
+
+        PostgresTenantRepository::build_first(&results)
+    }
+
+    fn create(&self, tenant: &mut Tenant) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresTenantRepository::create_on_conn(&conn, tenant))?;
+        Ok(())
+    }
+
+    fn save(&self, tenant: &Tenant) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| {
+            diesel::update(tenants::table)
+                .filter(tenants::id.eq(tenant.id))
+                .set(tenants::name.eq(&tenant.name))
+                .execute(&conn)?;
+
+            PostgresTenantRepository::save_settings_on_conn(&conn, tenant)
+        })?;
+
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryTenantRepository {
+    table: memory::Table<Tenant>,
+}
+
+impl InMemoryTenantRepository {
+    pub fn new() -> Self {
+        let repo = InMemoryTenantRepository {
+            table: memory::Table::new(),
+        };
+
+        // same as the postgres migration does, the default tenant is the very first one
+        let mut default = Tenant::new(Metadata::new(), settings::DEFAULT_TENANT_NAME)
+            .expect("default tenant name must be well formatted");
+        repo.table.insert(&mut default, |_| false, |tenant, new_id| tenant.id = new_id)
+            .expect("default tenant must be created");
+
+        repo
+    }
+}
+
+impl TenantRepository for InMemoryTenantRepository {
+    fn find(&self, target: i32) -> Result<Tenant, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_by_name(&self, target: &str) -> Result<Tenant, Box<dyn Error>>  {
+        self.table.find_first(|tenant| tenant.name == target)
+    }
+
+    fn create(&self, tenant: &mut Tenant) -> Result<(), Box<dyn Error>> {
+        // in order to create a tenant it must exists the metadata for this tenant
+        get_meta_repository().create(&mut tenant.meta)?;
+
+        let target = tenant.name.clone();
+        self.table.insert(tenant, |existing| existing.name == target, |tenant, new_id| tenant.id = new_id)
+    }
+
+    fn save(&self, tenant: &Tenant) -> Result<(), Box<dyn Error>> {
+        self.table.update(tenant.id, tenant)
+    }
+}
@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::TenantRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresTenantRepository),
+            Backend::Memory => Box::new(framework::InMemoryTenantRepository::new()),
+            backend => storage::unsupported(backend, "tenants"),
+        }
+    }; 
+}   
+
+pub fn get_repository() -> Box<&'static dyn domain::TenantRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
@@ -2,6 +2,37 @@ use std::error::Error;
 use std::time::{SystemTime, UNIX_EPOCH};
 use chrono::prelude::{DateTime, Utc};
 
+/// A source of the current time, so every deadline, expiration and rotation is told by the same one, and tests may
+/// move it at will
+pub trait Clock {
+    fn now(&self) -> SystemTime;
+}
+
+/// The clock of the system, the default one
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    fn now(&self) -> SystemTime {
+        SystemTime::now()
+    }
+}
+
+#[cfg(test)]
+thread_local! {
+    // tests run side by side, so each of them gets its own clock, if any
+    static FAKE_CLOCK: std::cell::RefCell<Option<std::sync::Arc<tests::FakeClock>>> = std::cell::RefCell::new(None);
+}
+
+/// Returns the current time, as told by the clock in use: the system one, unless a test has installed any other
+pub fn now() -> SystemTime {
+    #[cfg(test)]
+    if let Some(fake) = FAKE_CLOCK.with(|fake| fake.borrow().clone()) {
+        return fake.now();
+    }
+
+    SystemClock.now()
+}
+
 pub fn _unix_seconds(current: SystemTime) -> Result<u64, Box<dyn Error>> {
 	match current.duration_since(UNIX_EPOCH) {
 		Err(err) => {
@@ -24,4 +55,81 @@ pub fn _iso8601(current: SystemTime) -> String {
     let utc: DateTime<Utc> = current.into();
     format!("{}", utc.format("%+"))
     // formats like "2001-07-08T00:34:60.026490+09:30"
-}
\ No newline at end of file
+}
+
+#[cfg(test)]
+pub mod tests {
+    use std::sync::{Arc, Mutex};
+    use std::time::{Duration, SystemTime};
+    use super::{Clock, FAKE_CLOCK, now};
+
+    /// A clock that only moves when told, so TTLs, rotations and deadlines can be tested deterministically. Once
+    /// installed, the current time of the installing thread is told by it until the returned guard gets dropped;
+    /// any other thread, such as these hashing passwords, keeps telling the system time
+    pub struct FakeClock {
+        now: Mutex<SystemTime>,
+    }
+
+    impl FakeClock {
+        pub fn install(start: SystemTime) -> FakeClockGuard {
+            let clock = Arc::new(FakeClock {now: Mutex::new(start)});
+            FAKE_CLOCK.with(|fake| *fake.borrow_mut() = Some(clock.clone()));
+            FakeClockGuard {clock: clock}
+        }
+
+        /// Moves the clock forward by the given duration
+        pub fn advance(&self, by: Duration) {
+            if let Ok(mut now) = self.now.lock() {
+                *now += by;
+            }
+        }
+
+        pub fn set(&self, to: SystemTime) {
+            if let Ok(mut now) = self.now.lock() {
+                *now = to;
+            }
+        }
+    }
+
+    impl Clock for FakeClock {
+        fn now(&self) -> SystemTime {
+            self.now.lock().map(|now| *now).unwrap_or_else(|_| SystemTime::now())
+        }
+    }
+
+    pub struct FakeClockGuard {
+        clock: Arc<FakeClock>,
+    }
+
+    impl std::ops::Deref for FakeClockGuard {
+        type Target = FakeClock;
+
+        fn deref(&self) -> &FakeClock {
+            &self.clock
+        }
+    }
+
+    impl Drop for FakeClockGuard {
+        fn drop(&mut self) {
+            FAKE_CLOCK.with(|fake| *fake.borrow_mut() = None);
+        }
+    }
+
+    #[test]
+    fn fake_clock_should_not_fail() {
+        let start = SystemTime::UNIX_EPOCH + Duration::from_secs(1000);
+        {
+            let clock = FakeClock::install(start);
+            assert_eq!(start, now());
+
+            clock.advance(Duration::from_secs(60));
+            assert_eq!(start + Duration::from_secs(60), now());
+
+            clock.set(start);
+            assert_eq!(start, now());
+        }
+
+        // once the guard is dropped the system time is told again
+        assert!(now() > start + Duration::from_secs(60));
+    }
+}
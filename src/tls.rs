@@ -0,0 +1,223 @@
+use std::fs;
+use std::io;
+use std::error::Error;
+use std::net::SocketAddr;
+use std::sync::{Arc, RwLock};
+use std::thread;
+use std::time::{Duration, SystemTime};
+use tokio::net::{TcpListener, TcpStream};
+use tokio::sync::mpsc;
+use tokio_rustls::{TlsAcceptor, server::TlsStream};
+use tokio_stream::wrappers::ReceiverStream;
+use tonic::Request;
+use openssl::x509::X509;
+use openssl::nid::Nid;
+use rustls::{ServerConfig, NoClientAuth, ResolvesServerCert, ClientHello, RootCertStore, ClientCertVerifier};
+use rustls::{AllowAnyAuthenticatedClient, AllowAnyAnonymousOrAuthenticatedClient};
+use rustls::sign::{self, CertifiedKey};
+use rustls::internal::pemfile;
+
+use crate::constants::{environment, settings, errors};
+use crate::config;
+
+pub type Incoming = ReceiverStream<Result<TlsStream<TcpStream>, io::Error>>;
+
+/// Serves the certificate and key loaded from their files, replacing them as soon as any of the files changes, so
+/// renewed certificates (e.g. by an ACME client such as certbot or cert-manager) apply with no restart
+struct ReloadingResolver {
+    cert_path: String,
+    key_path: String,
+    current: RwLock<(CertifiedKey, Option<SystemTime>)>,
+}
+
+impl ReloadingResolver {
+    fn new(cert_path: &str, key_path: &str) -> Result<Self, Box<dyn Error>> {
+        let modified = last_modified(cert_path, key_path);
+        let certified = load_certified_key(cert_path, key_path)?;
+        Ok(ReloadingResolver {
+            cert_path: cert_path.to_string(),
+            key_path: key_path.to_string(),
+            current: RwLock::new((certified, modified)),
+        })
+    }
+
+    /// Loads the certificate and key again if any of their files has changed since the last time. Returns true if
+    /// they got replaced. If the new ones cannot be loaded, the current ones are kept
+    fn reload(&self) -> Result<bool, Box<dyn Error>> {
+        let modified = last_modified(&self.cert_path, &self.key_path);
+        let loaded = match self.current.read() {
+            Ok(current) => current.1,
+            Err(err) => {
+                error!("read lock for tls certificate got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        };
+
+        if modified == loaded {
+            return Ok(false);
+        }
+
+        let certified = load_certified_key(&self.cert_path, &self.key_path)?;
+        match self.current.write() {
+            Ok(mut current) => *current = (certified, modified),
+            Err(err) => {
+                error!("write lock for tls certificate got poisoned: {}", err);
+                return Err(errors::POISONED.into());
+            }
+        }
+
+        Ok(true)
+    }
+}
+
+impl ResolvesServerCert for ReloadingResolver {
+    fn resolve(&self, _: ClientHello) -> Option<CertifiedKey> {
+        match self.current.read() {
+            Ok(current) => Some(current.0.clone()),
+            Err(err) => {
+                error!("read lock for tls certificate got poisoned: {}", err);
+                None
+            }
+        }
+    }
+}
+
+/// Returns the latest modification time of both files, if known
+fn last_modified(cert_path: &str, key_path: &str) -> Option<SystemTime> {
+    let modified = |path: &str| fs::metadata(path).and_then(|meta| meta.modified()).ok();
+    modified(cert_path).max(modified(key_path))
+}
+
+/// Loads the certificate chain and the private key, either pkcs8 or rsa, from their pem files
+fn load_certified_key(cert_path: &str, key_path: &str) -> Result<CertifiedKey, Box<dyn Error>> {
+    let cert_pem = fs::read(cert_path)?;
+    let chain = match pemfile::certs(&mut cert_pem.as_slice()) {
+        Ok(chain) if chain.len() > 0 => chain,
+        _ => return Err(format!("no certificate found in {}", cert_path).into()),
+    };
+
+    let key_pem = fs::read(key_path)?;
+    let mut keys = pemfile::pkcs8_private_keys(&mut key_pem.as_slice()).unwrap_or_default();
+    if keys.is_empty() {
+        keys = pemfile::rsa_private_keys(&mut key_pem.as_slice()).unwrap_or_default();
+    }
+
+    let key = match keys.first().map(sign::any_supported_type) {
+        Some(Ok(key)) => key,
+        _ => return Err(format!("no supported private key found in {}", key_path).into()),
+    };
+
+    Ok(CertifiedKey::new(chain, Arc::new(key)))
+}
+
+/// Returns true if, and only if, the service must serve tls by itself, as told by the environment
+pub fn is_enabled() -> bool {
+    config::get(environment::TLS_CERT).is_ok()
+}
+
+/// Spawns a background thread that periodically checks whether the certificate files have changed, reloading them
+fn start_reload_job(resolver: Arc<ReloadingResolver>) {
+    thread::spawn(move || loop {
+        thread::sleep(Duration::from_secs(settings::TLS_RELOAD_PERIOD));
+        match resolver.reload() {
+            Ok(true) => info!("tls certificate has been reloaded"),
+            Ok(false) => {},
+            Err(err) => error!("tls certificate could not be reloaded, keeping the current one: {}", err),
+        }
+    });
+}
+
+/// Returns the verifier of client certificates: none if no client ca is set by the environment, or else one accepting
+/// only these certificates issued by it, either requiring them or letting anonymous clients through as well
+fn new_client_verifier() -> Result<Arc<dyn ClientCertVerifier>, Box<dyn Error>> {
+    let ca_path = match config::get(environment::TLS_CLIENT_CA) {
+        Ok(ca_path) => ca_path,
+        Err(_) => return Ok(NoClientAuth::new()),
+    };
+
+    let ca_pem = fs::read(&ca_path)?;
+    let mut roots = RootCertStore::empty();
+    match roots.add_pem_file(&mut ca_pem.as_slice()) {
+        Ok((valid, _)) if valid > 0 => {},
+        _ => return Err(format!("no certificate authority found in {}", ca_path).into()),
+    }
+
+    let mode = config::get(environment::TLS_CLIENT_AUTH).unwrap_or(settings::TLS_CLIENT_AUTH.to_string());
+    match mode.as_str() {
+        "required" => Ok(AllowAnyAuthenticatedClient::new(roots)),
+        "optional" => Ok(AllowAnyAnonymousOrAuthenticatedClient::new(roots)),
+        _ => Err(format!("client authentication must be either required or optional, got {}", mode).into()),
+    }
+}
+
+/// Returns the identity of the client certificate the request has been sent with, if any: its first uri subject
+/// alternative name (e.g. a spiffe id), or else its first dns one, or else its subject common name
+pub fn get_peer_identity<T>(request: &Request<T>) -> Option<String> {
+    let certs = request.peer_certs()?;
+    let cert = X509::from_der(certs.first()?.get_ref()).ok()?;
+
+    if let Some(names) = cert.subject_alt_names() {
+        let uri = names.iter().find_map(|name| name.uri().map(|uri| uri.to_string()));
+        if let Some(identity) = uri.or_else(|| names.iter().find_map(|name| name.dnsname().map(|dns| dns.to_string()))) {
+            return Some(identity);
+        }
+    }
+
+    cert.subject_name()
+        .entries_by_nid(Nid::COMMONNAME)
+        .next()
+        .and_then(|entry| entry.data().as_utf8().ok())
+        .map(|common_name| common_name.to_string())
+}
+
+/// Builds the tls configuration from the certificate and key at the paths set by the environment
+fn new_config() -> Result<ServerConfig, Box<dyn Error>> {
+    let cert_path = config::get(environment::TLS_CERT)?;
+    let key_path = match config::get(environment::TLS_KEY) {
+        Ok(key_path) => key_path,
+        Err(_) => return Err("tls key must be set along with the tls certificate".into()),
+    };
+
+    let resolver = Arc::new(ReloadingResolver::new(&cert_path, &key_path)?);
+    start_reload_job(resolver.clone());
+
+    let mut config = ServerConfig::new(new_client_verifier()?);
+    config.cert_resolver = resolver;
+    config.set_protocols(&[b"h2".to_vec()]); // grpc requires http2
+    Ok(config)
+}
+
+/// Listens on the given address and returns the stream of all these connections that have completed the tls
+/// handshake. Handshakes are performed apart from accepting, so slow clients do not hold the rest
+pub async fn incoming(addr: SocketAddr) -> Result<Incoming, Box<dyn Error>> {
+    let acceptor = TlsAcceptor::from(Arc::new(new_config()?));
+    let listener = TcpListener::bind(addr).await?;
+    let (sender, receiver) = mpsc::channel(settings::TLS_BACKLOG);
+
+    tokio::spawn(async move {
+        while !sender.is_closed() {
+            let (stream, remote) = match listener.accept().await {
+                Ok(accepted) => accepted,
+                Err(err) => {
+                    error!("could not accept connection: {}", err);
+                    tokio::time::sleep(Duration::from_millis(100)).await;
+                    continue;
+                }
+            };
+
+            let (acceptor, sender) = (acceptor.clone(), sender.clone());
+            tokio::spawn(async move {
+                let timeout = Duration::from_secs(settings::TLS_HANDSHAKE_TIMEOUT);
+                match tokio::time::timeout(timeout, acceptor.accept(stream)).await {
+                    Ok(Ok(stream)) => {
+                        let _ = sender.send(Ok(stream)).await;
+                    },
+                    Ok(Err(err)) => info!("tls handshake with {} has failed: {}", remote, err),
+                    Err(_) => info!("tls handshake with {} has timed out", remote),
+                }
+            });
+        }
+    });
+
+    Ok(ReceiverStream::new(receiver))
+}
@@ -0,0 +1,55 @@
+use std::time::{SystemTime, UNIX_EPOCH};
+use rand::Rng;
+
+// crockford's base32, so ids are url-safe and case-insensitive
+const ENCODING: &[u8] = b"0123456789ABCDEFGHJKMNPQRSTVWXYZ";
+const RANDOM_BITS: u32 = 80;
+
+pub const ULID_LEN: usize = 26;
+
+/// Returns a brand new ulid: 48 bits of milliseconds since the unix epoch followed by 80 random bits. So ids sort by
+/// their creation time (up to the millisecond), lexicographically as well, while no coordination is required to
+/// generate them
+pub fn generate() -> String {
+    let millis = match SystemTime::now().duration_since(UNIX_EPOCH) {
+        Ok(elapsed) => elapsed.as_millis() as u64,
+        Err(_) => 0,
+    };
+
+    let random: u128 = rand::thread_rng().gen();
+    encode(millis, random)
+}
+
+fn encode(millis: u64, random: u128) -> String {
+    let random_mask = (1u128 << RANDOM_BITS) - 1;
+    let value = ((millis as u128 & 0xFFFF_FFFF_FFFF) << RANDOM_BITS) | (random & random_mask);
+
+    (0..ULID_LEN).rev()
+        .map(|index| ENCODING[((value >> (index * 5)) & 0x1F) as usize] as char)
+        .collect()
+}
+
+#[cfg(test)]
+pub mod tests {
+    use super::{generate, encode, ENCODING, ULID_LEN};
+
+    #[test]
+    fn encode_should_not_fail() {
+        assert_eq!(encode(0, 0), "00000000000000000000000000");
+        assert_eq!(&encode(1469918176385, 0)[..10], "01ARYZ6S41");
+        assert_eq!(&encode(0, u128::MAX)[10..], "ZZZZZZZZZZZZZZZZ");
+    }
+
+    #[test]
+    fn encode_should_be_sortable() {
+        assert!(encode(1469918176385, u128::MAX) < encode(1469918176386, 0));
+    }
+
+    #[test]
+    fn generate_should_not_fail() {
+        let ulid = generate();
+        assert_eq!(ulid.len(), ULID_LEN);
+        assert!(ulid.bytes().all(|byte| ENCODING.contains(&byte)));
+        assert_ne!(ulid, generate());
+    }
+}
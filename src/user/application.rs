@@ -1,64 +1,427 @@
 use std::error::Error;
+use std::fs;
 use std::time::Duration;
+use std::collections::HashMap;
 use crate::metadata::domain::Metadata;
 use crate::security;
-use crate::constants::{errors, settings};
+use crate::regex;
+use crate::constants::{errors, settings, environment};
+use crate::config;
 use crate::smtp;
+use crate::i18n;
+use crate::sms::application::sms_send;
+use crate::metrics::in_stage;
+use crate::pagination::Page;
+use crate::hashing::hashing_run;
+use crate::lock::application::{lock_run, lock_email_key, lock_phone_key, lock_username_key};
 use crate::session::{
+    application as sess_application,
     get_repository as get_sess_repository,
-    domain::{Session, Token as SessionToken},
+    domain::{Session, LogoutCause, LogoutReason},
+};
+use crate::audit::{
+    application::{audit_record, audit_history},
+    domain::{Event, EventKind, Filter},
 };
 
-use crate::directory::get_repository as get_dir_repository;
+use crate::directory::{
+    get_repository as get_dir_repository,
+    domain::Directory,
+};
+use crate::app::{
+    get_repository as get_app_repository,
+    domain::App,
+};
+use crate::policy::application::{policy_enforce, policy_consent};
+use crate::invitation::application::{invitation_find, invitation_redeem};
+use crate::tenant::application::{tenant_find, tenant_setting};
+use crate::captcha::application::captcha_verify;
+use crate::username::application::{username_check, username_required};
+use crate::feature::{
+    application::{feature_check, feature_check_by_app_id},
+    domain::Flag,
+};
+use crate::detection::domain::Origin;
+use crate::time;
 use crate::secret::{
     get_repository as get_secret_repository,
     domain::Secret,
 };
 use super::{
     get_repository as get_user_repository,
-    domain::{User, Token},
+    domain::{User, Token, EmailToken, ResetToken, ActivationToken, AttributeDefinition, LoginIdentifier,
+             match_no_password},
+    domain::normalize_phone,
 };
 
-/// If, and only if, there is no user with the same email, a new user with these email and password is created into the system
-pub fn user_signup(email: &str,
-                   password: &str) -> Result<(), Box<dyn Error>> {
+lazy_static! {
+    // the schema file, if any, declares an attribute definition per line
+    static ref SIGNUP_SCHEMA: Vec<AttributeDefinition> = {
+        match config::get(environment::SIGNUP_SCHEMA) {
+            Ok(path) => fs::read_to_string(path).expect("signup schema must be readable")
+                .lines()
+                .filter(|line| line.trim().len() > 0 && !line.trim().starts_with('#'))
+                .map(|line| AttributeDefinition::parse(line).expect("signup schema must be well formatted"))
+                .collect(),
+            Err(_) => Vec::new(),
+        }
+    };
+}
+
+/// If, and only if, there is no user with the same email in the given tenant, the provided versions of the policies
+/// are the latest ones, the invitation, if any or required, is valid and the attributes satisfy the signup schema, a
+/// new user with these email and password is created into the tenant. If a captcha provider is set, the response to
+/// its challenge must be a valid one. A phone number, if any, gets verified by a code sent to it, apart from the email.
+/// A username, if any or required by the tenant, must satisfy its policy and be taken by no other user of the tenant
+pub fn user_signup(tenant: &str,
+                   email: &str,
+                   password: &str,
+                   terms: i32,
+                   privacy: i32,
+                   invitation: &str,
+                   attributes: &HashMap<String, String>,
+                   phone: &str,
+                   username: &str,
+                   captcha: &str,
+                   origin: &Origin) -> Result<(), Box<dyn Error>> {
     
     info!("got a signup request from user {} ", email);
+    in_stage("signup", "captcha.verify", || captcha_verify(captcha, origin.get_ip()))?;
+    let tenant = in_stage("signup", "tenant.find", || tenant_find(tenant))?;
+    feature_check(Flag::Signup, tenant.get_id(), "")?;
+    user_create(tenant.get_id(), email, password, terms, privacy, invitation, attributes, phone, username, "")?;
+    Ok(())
+}
+
+/// Same as user_signup, but if, and only if, the provided token belongs to a guest session, the new user is created
+/// into the tenant of the session and takes it over, keeping the same session id, once verified. Until then the
+/// session keeps being a guest one, so no email the user does not own gets any right. Returns the token of the session
+pub fn user_upgrade_guest(token: &str,
+                          email: &str,
+                          password: &str,
+                          terms: i32,
+                          privacy: i32,
+                          invitation: &str,
+                          attributes: &HashMap<String, String>,
+                          phone: &str,
+                          username: &str,
+                          captcha: &str,
+                          origin: &Origin) -> Result<String, Box<dyn Error>> {
     
+    info!("got a guest upgrade request from user {} ", email);
+    captcha_verify(captcha, origin.get_ip())?;
+    let claim = sess_application::decode_token(token)?;
+    if !claim.guest {
+        return Err(errors::ALREADY_EXISTS.into());
+    }
+
+    feature_check_by_app_id(Flag::Signup, claim.tenant, claim.app)?;
+
+    // replaying the token of a session upgraded already must fail before any user gets created
+    sess_application::session_check_guest(&claim.sub, claim.tenant)?;
+    user_create(claim.tenant, email, password, terms, privacy, invitation, attributes, phone, username, &claim.sub)?;
+    Ok(token.to_string())
+}
+
+fn user_create(tenant: i32,
+               email: &str,
+               password: &str,
+               terms: i32,
+               privacy: i32,
+               invitation: &str,
+               attributes: &HashMap<String, String>,
+               phone: &str,
+               username: &str,
+               guest: &str) -> Result<User, Box<dyn Error>> {
+
+    // no other instance may create a user, nor confirm an email change, with the same email meanwhile
+    lock_run(&lock_email_key(tenant, email), || {
+        user_create_unlocked(tenant, email, password, terms, privacy, invitation, attributes, phone, username, guest)
+    })
+}
+
+fn user_create_unlocked(tenant: i32,
+                        email: &str,
+                        password: &str,
+                        terms: i32,
+                        privacy: i32,
+                        invitation: &str,
+                        attributes: &HashMap<String, String>,
+                        phone: &str,
+                        username: &str,
+                        guest: &str) -> Result<User, Box<dyn Error>> {
+
+    // the email may be taken as an alias as well, which no unique index on users tells
+    if get_user_repository().find_by_email(tenant, email).is_ok() {
+        return Err(errors::ALREADY_EXISTS.into());
+    }
+
+    // no lock is held for the username, so two signups taking it meanwhile are told apart by the unique index
+    if username.len() > 0 {
+        user_check_username(tenant, username, None)?;
+    } else if username_required(tenant) {
+        return Err(errors::INVALID_USERNAME.into());
+    }
+
+    let mut invitation = in_stage("signup", "invitation.find", || invitation_find(tenant, invitation, email))?;
     let meta = Metadata::new();
-    let mut user = User::new(meta, email, password)?;
-    get_user_repository().create(&mut user)?;
+    let (owned_email, owned_password) = (email.to_string(), password.to_string());
+    let mut user = in_stage("signup", "user.hash_password", || hashing_run(move || {
+        User::new(meta, tenant, &owned_email, &owned_password).map_err(|err| err.to_string())
+    }))??;
+    let consented = policy_enforce(&mut user, terms, privacy)?;
+    user.set_attributes(&SIGNUP_SCHEMA, attributes)?;
+    if let Some(invitation) = &invitation {
+        user.admin = invitation.is_admin();
+    }
+
+    user.set_username(username);
+
+    let phone_code = security::get_random_code(settings::PHONE_CODE_LEN);
+    if phone.len() > 0 {
+        user.set_phone(phone, &phone_code, Duration::from_secs(settings::PHONE_CODE_TIMEOUT))?;
+    }
+
+    in_stage("signup", "user.create", || get_user_repository().create(&mut user))?;
+    audit_record(user.get_id(), user.get_id(), EventKind::Signup, "");
+    if consented {
+        policy_consent(&user);
+    }
+
+    if let Some(invitation) = &mut invitation {
+        invitation_redeem(invitation)?;
+    }
     
-    let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+    let mut claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+    claim.guest = guest.to_string();
     let token = security::encode_jwt(claim)?;
     
-    smtp::send_verification_email(email, &token)?;
+    smtp::send_verification_email(user.tenant, user.get_locale(), email, &token, None)?;
+    if user.get_phone().is_some() {
+        user_send_phone_code(&user, &phone_code)?;
+    }
+
+    Ok(user)
+}
+
+/// If, and only if, the provided token is valid, returns the owner of the session as well as its attributes mapped
+/// by the claims the signup schema exposes them as
+pub fn user_info(token: &str) -> Result<(User, HashMap<String, String>), Box<dyn Error>> {
+    info!("got a user info request");
+
+    let claim = sess_application::decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = match sess_arc.read() {
+        Ok(sess) => sess.get_user()?.get_id(),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    user_info_by_id(user_id)
+}
+
+/// Same as user_info, but for requests authenticated by an api key granted for the user scope
+pub fn user_info_by_id(user_id: i32) -> Result<(User, HashMap<String, String>), Box<dyn Error>> {
+    let user = get_user_repository().find(user_id)?;
+    let claims = user.get_claims(&SIGNUP_SCHEMA);
+    Ok((user, claims))
+}
+
+/// Fails unless the given username satisfies the policy of the given tenant and no other user of the tenant than the
+/// given one, if any, has it already, regardless of its case
+fn user_check_username(tenant: i32, username: &str, owner: Option<i32>) -> Result<(), Box<dyn Error>> {
+    username_check(tenant, username)?;
+    match get_user_repository().find_by_username(tenant, username) {
+        Ok(other) if Some(other.get_id()) != owner => Err(errors::ALREADY_EXISTS.into()),
+        _ => Ok(()),
+    }
+}
+
+/// If, and only if, the provided token is valid, the given username satisfies the policy of the tenant and no other
+/// user of the tenant has it already, regardless of its case, it becomes the one of the session's owner. An empty
+/// username removes the one of the user, if any, unless the tenant requires one. Returns the updated user
+pub fn user_set_username(token: &str, username: &str) -> Result<User, Box<dyn Error>> {
+    info!("got a set username request");
+    let (user, _) = user_info(token)?;
+
+    // no other instance may take the same username meanwhile
+    lock_run(&lock_username_key(user.tenant, username), || user_set_username_unlocked(user.get_id(), username))
+}
+
+fn user_set_username_unlocked(user_id: i32, username: &str) -> Result<User, Box<dyn Error>> {
+    // the user is read once the lock is held, so it is up to date
+    let mut user = get_user_repository().find(user_id)?;
+    user_take_username(&mut user, username)?;
+    get_user_repository().save(&user)?;
+    Ok(user)
+}
+
+/// Sets the given username as the one of the given user, as long as it is available for it
+fn user_take_username(user: &mut User, username: &str) -> Result<(), Box<dyn Error>> {
+    if username.len() > 0 {
+        user_check_username(user.tenant, username, Some(user.get_id()))?;
+    } else if username_required(user.tenant) {
+        return Err(errors::INVALID_USERNAME.into());
+    }
+
+    user.set_username(username);
+    Ok(())
+}
+
+/// If, and only if, the provided token is valid and the given locale is supported, it becomes the one the emails to
+/// the session's owner are sent in. An empty locale sets the default one back. Returns the updated user
+pub fn user_set_locale(token: &str, locale: &str) -> Result<User, Box<dyn Error>> {
+    info!("got a set locale request");
+    let (mut user, _) = user_info(token)?;
+    user.set_locale(locale)?;
+    get_user_repository().save(&user)?;
+    Ok(user)
+}
+
+/// If, and only if, the provided token is valid, returns all the apps the session's owner has authorized by logging
+/// into them, along with the directory telling when it was granted and last used
+pub fn user_list_consents(token: &str) -> Result<Vec<(App, Directory)>, Box<dyn Error>> {
+    info!("got a list consents request");
+    let (user, _) = user_info(token)?;
+
+    let mut consents = Vec::new();
+    for dir in get_dir_repository().find_all_by_user(user.get_id())? {
+        match get_app_repository().find(dir.get_app()) {
+            Ok(app) => consents.push((app, dir)),
+            Err(err) => warn!("app {} of directory {} could not be found: {}", dir.get_app(), dir.get_id(), err),
+        }
+    }
+
+    Ok(consents)
+}
+
+/// If, and only if, the provided token is valid and the session's owner has authorized the app with the given url,
+/// the authorization gets revoked, so does any session or remember-me session the user has for the app
+pub fn user_revoke_consent(token: &str, app_url: &str) -> Result<(), Box<dyn Error>> {
+    info!("got a revoke consent request for app {}", app_url);
+    let (user, _) = user_info(token)?;
+
+    let app = get_app_repository().find_by_url(user.tenant, app_url)?;
+    sess_application::session_revoke_app(user.tenant, &user.email, user.get_id(), &app)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::Revoke, &LogoutReason::User.describe(app.get_url()));
     Ok(())
 }
 
+/// Makes sure the given user has all the attributes the signup schema requires on login, taking the missing ones from
+/// the provided attributes. Fails with the names of these still missing, if any, following the error as a
+/// comma-separated list. Returns true if the user got updated, in which case it must be saved
+pub fn user_complete_profile(user: &mut User, attributes: &HashMap<String, String>) -> Result<bool, Box<dyn Error>> {
+    let missing = user.get_missing_attributes(&SIGNUP_SCHEMA);
+    if missing.is_empty() {
+        return Ok(false);
+    }
+
+    let provided = |name: &String| attributes.get(name).filter(|value| value.len() > 0).is_some();
+    let still_missing: Vec<&str> = missing.iter().filter(|name| !provided(name)).map(String::as_str).collect();
+    if !still_missing.is_empty() {
+        return Err(format!("{}: {}", errors::PROFILE_INCOMPLETE, still_missing.join(",")).into());
+    }
+
+    let mut updated = user.get_attributes().clone();
+    updated.extend(missing.into_iter().filter_map(|name| attributes.get(&name).cloned().map(|value| (name, value))));
+    user.set_attributes(&SIGNUP_SCHEMA, &updated)?;
+    Ok(true)
+}
+
+/// Returns the attributes listed by the given error, if it is a PROFILE_INCOMPLETE one
+pub fn user_missing_attributes(err: &str) -> Option<Vec<String>> {
+    err.strip_prefix(errors::PROFILE_INCOMPLETE)
+        .and_then(|missing| missing.strip_prefix(": "))
+        .map(|missing| missing.split(',').map(str::to_string).collect())
+}
+
+/// If, and only if, the provided token is valid and the resulting attributes still satisfy the signup schema, the
+/// given attributes of the session's owner get set, keeping the rest of them as they are. An empty value removes the
+/// attribute. The username, if any, gets set as by user_set_username along with them. Returns the updated user
+pub fn user_update_profile(token: &str,
+                           attributes: &HashMap<String, String>,
+                           username: Option<&str>) -> Result<User, Box<dyn Error>> {
+
+    info!("got a profile update request");
+    let (user, _) = user_info(token)?;
+    match username {
+        // no other instance may take the same username meanwhile
+        Some(username) => lock_run(&lock_username_key(user.tenant, username), || {
+            user_update_profile_unlocked(user.get_id(), attributes, Some(username))
+        }),
+        None => user_update_profile_unlocked(user.get_id(), attributes, None),
+    }
+}
+
+fn user_update_profile_unlocked(user_id: i32,
+                                attributes: &HashMap<String, String>,
+                                username: Option<&str>) -> Result<User, Box<dyn Error>> {
+
+    // the user is read once the lock, if any, is held, so it is up to date
+    let mut user = get_user_repository().find(user_id)?;
+    if let Some(username) = username {
+        user_take_username(&mut user, username)?;
+    }
+
+    let mut updated = user.get_attributes().clone();
+    updated.extend(attributes.iter().map(|(name, value)| (name.clone(), value.clone())));
+    user.set_attributes(&SIGNUP_SCHEMA, &updated)?;
+    get_user_repository().save(&user)?;
+    Ok(user)
+}
+
 /// If, and only if, the provided token is valid, the owner gets verified
 pub fn user_verify(token: &str) -> Result<(), Box<dyn Error>> {
 
-    info!("got a verification request for token {} ", token);
+    info!("got a verification request");
 
     let claim = security::decode_jwt::<Token>(token)?;
     let mut user = get_user_repository().find(claim.sub)?;
     user.verify()?;
     
     get_user_repository().save(&user)?;
+    audit_record(user.get_id(), user.get_id(), EventKind::Verify, "");
+
+    // the guest session the user signed up from is taken over only once the email is known to be owned, but not
+    // taking it over, such as for having expired, does not make the verification to fail
+    if claim.guest.len() > 0 {
+        let user_id = user.get_id();
+        if let Err(err) = sess_application::session_upgrade(&claim.guest, user) {
+            warn!("guest session of user {} could not be upgraded: {}", user_id, err);
+        }
+    }
+
     Ok(())
 }
 
-/// If, and only if, the provided credentials matches with the user's ones, the user and all its data is deleted
-/// from the system and repositories
-pub fn user_delete(email: &str,
+/// If, and only if, the provided credentials matches with the ones of the user of the given tenant, the user gets
+/// marked as deleted and its session revoked. The user and all its data will be removed from the system once the
+/// retention period is over
+pub fn user_delete(tenant: &str,
+                   email: &str,
                    pwd: &str,
                    totp: &str) -> Result<(), Box<dyn Error>> {
     
     info!("got a deletion request from user {} ", email);
 
-    let user = get_user_repository().find_by_email(email)?;
-    if !user.match_password(pwd) {
+    let tenant = tenant_find(tenant)?;
+    let mut user = match get_user_repository().find_by_email(tenant.get_id(), email) {
+        Ok(user) => user,
+        Err(err) => {
+            // missing users take as long as wrong passwords, so the time it takes does not tell whether they exist
+            info!("could not find user {}: {}", email, err);
+            let pwd = pwd.to_string();
+            hashing_run(move || match_no_password(&pwd))?;
+            return Err(errors::NOT_FOUND.into());
+        }
+    };
+
+    let (candidate, password) = (user.clone(), pwd.to_string());
+    if !hashing_run(move || candidate.match_password(&password))? {
         return Err(errors::NOT_FOUND.into());
     }
 
@@ -68,24 +431,62 @@ pub fn user_delete(email: &str,
         security::verify_totp(data, totp)?;
     }
 
+    user.mark_deleted()?;
+    get_user_repository().save(&user)?;
+
     // if the user was logged in, the session must be removed
-    if let Ok(sess_arc) = get_sess_repository().find_by_email(&user.email) {
-        let sess = match sess_arc.write() {
-            Ok(sess) => sess,
-            Err(err) => {
-                error!("read-write lock for session got poisoned: {}", err);
-                return Err(errors::POISONED.into());
-            }
-        };
+    sess_application::session_revoke(user.tenant, &user.email, LogoutReason::User)?;
 
-        get_sess_repository().delete(&sess)?; // do not save directories
-    }
+    audit_record(user.get_id(), user.get_id(), EventKind::Delete, "");
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to an administrator and the user with the given email, in the same
+/// tenant as the administrator, is still within its retention period, the deletion gets undone and the reason
+/// recorded into the audit trail
+pub fn user_restore(token: &str,
+                    email: &str,
+                    reason: &str) -> Result<(), Box<dyn Error>> {
 
-    get_dir_repository().delete_all_by_user(&user)?;
-    get_user_repository().delete(&user)?;
+    info!("got a restoration request for user {} ", email);
+
+    let admin = get_admin_user(token)?;
+    let mut user = get_user_repository().find_deleted_by_email(admin.tenant, email)?;
+    user.restore()?;
+    get_user_repository().save(&user)?;
+
+    audit_record(user.get_id(), admin.get_id(), EventKind::Restore, reason);
     Ok(())
 }
 
+/// All these users that got deleted before the given retention period are removed from the system, as well as all
+/// their data
+pub fn user_purge(retention: Duration) -> Result<usize, Box<dyn Error>> {
+    let deadline = time::now() - retention;
+    let deleted = get_user_repository().find_all_deleted_before(deadline)?;
+    
+    for user in deleted.iter() {
+        info!("purging user {} ", user.get_id());
+        // recorded while the user still exists, so the webhooks subscribed to it can be told who it was
+        audit_record(user.get_id(), 0, EventKind::Erase, "");
+        get_dir_repository().delete_all_by_user(user)?;
+        get_user_repository().delete(user)?;
+    }
+
+    Ok(deleted.len())
+}
+
+/// All the users, deleted ones included, get saved back, so their personal data gets encrypted by the current key.
+/// Once done, any older key can be retired
+pub fn user_reseal() -> Result<usize, Box<dyn Error>> {
+    let all_users = get_user_repository().find_all()?;
+    for user in all_users.iter() {
+        get_user_repository().save(user)?;
+    }
+
+    Ok(all_users.len())
+}
+
 /// All available actions to apply over the 2FA method of a user
 pub enum TfaActions {
     ENABLE,
@@ -95,7 +496,7 @@ pub enum TfaActions {
 const TOTP_SECRET_PROPOSAL_KEY: &str = "user::totp_secret";
 
 fn user_enable_two_factor_authenticator(sess: &mut Session, totp: &str) -> Result<String, Box<dyn Error>> {
-    if sess.get_user().secret.is_some() {
+    if sess.get_user()?.secret.is_some() {
         // if the 2FA is already enabled the actions must fail
         return Err(errors::HAS_FAILED.into());
     }
@@ -109,98 +510,835 @@ fn user_enable_two_factor_authenticator(sess: &mut Session, totp: &str) -> Resul
                 return Err(errors::UNAUTHORIZED.into());
             }
 
-            let mut new_secret = Secret::new(key);
-            get_secret_repository().create(&mut new_secret)?;
+            let mut new_secret = Secret::new(key);
+            get_secret_repository().create(&mut new_secret)?;
+
+            let old_secret = sess.get_user_mut()?.set_secret(Some(new_secret));
+            if let Err(err) = get_user_repository().save(sess.get_user()?) {
+                // this line will not panic due the previous set of Secret
+                let new_secret = sess.get_user_mut()?.set_secret(old_secret).unwrap();
+                get_secret_repository().delete(&new_secret)?;
+                return Err(err);
+            }
+
+            if let Some(secret) = old_secret {
+                get_secret_repository().delete(&secret)?;
+            }
+
+            Ok("".into())
+        },
+
+        None => {
+            let token = security::get_random_string(settings::TOKEN_LEN);
+            sess.store(TOTP_SECRET_PROPOSAL_KEY, &token);
+            Ok(token)
+
+            // let issuer = match config::get(environment::APP_NAME) {
+            //     Ok(app_name) => app_name,
+            //     Err(_) => "".to_string(),
+            // };
+            
+            // let uri = security::get_uri_format(token.as_bytes(), &issuer, sess.get_user().get_email())?;
+            //Ok(uri)
+        }
+    }
+}
+
+fn user_disable_two_factor_authenticator(sess: &mut Session, totp: &str) -> Result<(), Box<dyn Error>> {
+    if let Some(secret) = &sess.get_user()?.secret {
+        // if the 2FA is enabled it must be confirmed before deletion
+        let data = secret.get_data();
+        security::verify_totp(data, totp)?;
+    } else {
+        return Err(errors::HAS_FAILED.into());
+    }
+
+    // this block got duplicated in order to avoid mutability collisions
+    if let Some(secret) = sess.get_user_mut()?.set_secret(None) {
+        get_user_repository().save(sess.get_user()?)?;
+        get_secret_repository().delete(&secret)?;
+    }
+    
+    Ok(())
+}
+
+/// If, and only if, the provided token is valid and the provided credentials matches with the user's ones then a 2FA secret
+/// is created or destroyed depending on the requested action.
+pub fn user_two_factor_authenticator(token: &str,
+                                     pwd: &str,
+                                     totp: &str,
+                                     action: TfaActions) -> Result<String, Box<dyn Error>> {
+
+    info!("got an authentication method update");
+    let claim = sess_application::decode_token(token)?;
+    
+    // session is required in order to have an ephimeral place where to find the metadata for the action
+    // aka: sandbox
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+    let mut sess = match sess_arc.write() {
+        Ok(sess) => sess,
+        Err(err) => {
+            error!("read-write lock for session got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    if !sess.get_user()?.match_password(pwd) {
+        return Err(errors::NOT_FOUND.into());
+    } else if !sess.get_user()?.is_verified() {
+        return Err(errors::NOT_VERIFIED.into());
+    }
+
+    let user_id = sess.get_user()?.get_id();
+    let issuer = sess.get_issuer()?;
+    match action {
+        TfaActions::ENABLE => {
+            feature_check_by_app_id(Flag::TotpEnrollment, claim.tenant, claim.app)?;
+            let uri = user_enable_two_factor_authenticator(&mut sess, totp)?;
+            get_sess_repository().save(&sess)?;
+
+            if uri.len() == 0 {
+                // the secret has been confirmed, so the 2FA method is enabled from now on
+                audit_record(user_id, issuer, EventKind::MfaUpdate, "enabled");
+            }
+
+            Ok(uri)
+        },
+        
+        TfaActions::DISABLE => {
+            user_disable_two_factor_authenticator(&mut sess, totp)?;
+            get_sess_repository().save(&sess)?;
+            audit_record(user_id, issuer, EventKind::MfaUpdate, "disabled");
+            Ok("".into())
+        },
+    }
+}
+
+/// If, and only if, the provided token is valid, the given page of the authentication events history of the token's
+/// owner is returned, along with the token of the next page, if any
+pub fn user_login_history(token: &str, filter: &Filter, page: &Page) -> Result<(Vec<Event>, String), Box<dyn Error>> {
+
+    info!("got a login history request");
+    let claim = sess_application::decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = match sess_arc.read() {
+        Ok(sess) => sess.get_user()?.get_id(),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    audit_history(user_id, filter, page)
+}
+
+/// Returns the up to date user owning the session of the provided token if, and only if, the given credentials match
+fn get_session_user(token: &str,
+                    pwd: &str,
+                    totp: &str) -> Result<User, Box<dyn Error>> {
+
+    let claim = sess_application::decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+
+    let user_id = match sess_arc.read() {
+        Ok(sess) => sess.get_user()?.get_id(),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let user = get_user_repository().find(user_id)?;
+    if !user.match_password(pwd) {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    // if, and only if, the user has activated the 2fa
+    if let Some(secret) = &user.secret {
+        let data = secret.get_data();
+        security::verify_totp(data, totp)?;
+    }
+
+    Ok(user)
+}
+
+/// Sends a confirmation email to the provided address if, and only if, it is not registered by any user of the same
+/// tenant yet
+fn user_request_email(user: &User, email: &str, alias: bool) -> Result<(), Box<dyn Error>> {
+    regex::match_regex(regex::EMAIL, email)?;
+    if get_user_repository().find_by_email(user.tenant, email).is_ok() {
+        return Err(errors::ALREADY_EXISTS.into());
+    }
+
+    let claim = EmailToken::new(user, email, alias, Duration::from_secs(settings::TOKEN_TIMEOUT));
+    let token = security::encode_jwt(claim)?;
+
+    smtp::send_email_change_confirmation(user.tenant, user.get_locale(), email, &token, None)?;
+    if !alias {
+        smtp::send_email_change_notification(user.tenant, user.get_locale(), &user.email, email, None)?;
+    }
+
+    Ok(())
+}
+
+/// If, and only if, the provided token is valid, the credentials matches with the user's ones and there is no user
+/// with the new email, a confirmation email is sent to the new address and a notification to the old one. The email
+/// does not change until the new address gets confirmed
+pub fn user_change_email(token: &str,
+                         email: &str,
+                         pwd: &str,
+                         totp: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got an email change request");
+    let user = get_session_user(token, pwd, totp)?;
+    user_request_email(&user, email, false)
+}
+
+/// Same as user_change_email, but once confirmed the new address is added as an alias of the user
+pub fn user_add_email(token: &str,
+                      email: &str,
+                      pwd: &str,
+                      totp: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got an add email request");
+    let user = get_session_user(token, pwd, totp)?;
+    user_request_email(&user, email, true)
+}
+
+pub fn user_remove_email(token: &str,
+                         email: &str,
+                         pwd: &str,
+                         totp: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got a remove email request");
+    let mut user = get_session_user(token, pwd, totp)?;
+    user.remove_alias(email)?;
+    get_user_repository().save(&user)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::EmailChange, &format!("alias {} removed", email));
+    Ok(())
+}
+
+/// If, and only if, the provided email is an alias of the session's owner, it becomes the primary one. Since sessions
+/// are indexed by the primary email, the session of the user is revoked
+pub fn user_set_primary_email(token: &str,
+                              email: &str,
+                              pwd: &str,
+                              totp: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got a set primary email request");
+    let mut user = get_session_user(token, pwd, totp)?;
+    let old_email = user.email.clone();
+    user.set_primary(email)?;
+    get_user_repository().save(&user)?;
+
+    sess_application::session_revoke(user.tenant, &old_email, LogoutReason::User)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::EmailChange, &old_email);
+    Ok(())
+}
+
+/// If, and only if, the provided token is valid and the email is still available, the email gets confirmed. If the
+/// token was issued for an alias, the email is added as such; else the email of the token's owner gets replaced,
+/// keeping the old one as a recovery contact for a grace period and revoking the session of the user
+pub fn user_confirm_email(token: &str) -> Result<(), Box<dyn Error>> {
+    info!("got an email confirmation request");
+
+    let claim = security::decode_jwt::<EmailToken>(token)?;
+    let tenant = get_user_repository().find(claim.sub)?.tenant;
+    lock_run(&lock_email_key(tenant, &claim.email), || user_confirm_email_unlocked(&claim))
+}
+
+fn user_confirm_email_unlocked(claim: &EmailToken) -> Result<(), Box<dyn Error>> {
+    // the user is read once the lock is held, so it is up to date
+    let mut user = get_user_repository().find(claim.sub)?;
+    if get_user_repository().find_by_email(user.tenant, &claim.email).is_ok() {
+        return Err(errors::ALREADY_EXISTS.into());
+    }
+
+    if claim.alias {
+        user.add_alias(&claim.email)?;
+        get_user_repository().save(&user)?;
+
+        audit_record(user.get_id(), user.get_id(), EventKind::EmailChange, &format!("alias {} added", claim.email));
+        return Ok(());
+    }
+
+    let old_email = user.email.clone();
+    user.change_email(&claim.email, Duration::from_secs(settings::RECOVERY_PERIOD))?;
+    get_user_repository().save(&user)?;
+
+    // the session is indexed by the old email, so it must be removed
+    sess_application::session_revoke(user.tenant, &old_email, LogoutReason::User)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::EmailChange, &old_email);
+    Ok(())
+}
+
+/// Sends the given code, the phone number of the provided user is being verified by, as a text message in the locale
+/// of the user
+fn user_send_phone_code(user: &User, code: &str) -> Result<(), Box<dyn Error>> {
+    let phone = user.get_phone().ok_or(errors::NOT_FOUND)?;
+    let text = i18n::get_sms_text(user.get_locale().unwrap_or_default(), "phone_code")
+        .ok_or("text message for phone codes not found")?;
+
+    sms_send(phone, &text.replace("{code}", code))
+}
+
+/// If, and only if, the provided token is valid and the credentials matches with the user's ones, the given phone
+/// number becomes the one of the session's owner, and a code to verify it by is sent to it. The phone cannot be logged
+/// in by until it gets verified. An empty phone removes the one of the user, if any
+pub fn user_set_phone(token: &str,
+                      phone: &str,
+                      pwd: &str,
+                      totp: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got a set phone request");
+    let mut user = get_session_user(token, pwd, totp)?;
+    let code = security::get_random_code(settings::PHONE_CODE_LEN);
+    user.set_phone(phone, &code, Duration::from_secs(settings::PHONE_CODE_TIMEOUT))?;
+    get_user_repository().save(&user)?;
+
+    if user.get_phone().is_none() {
+        audit_record(user.get_id(), user.get_id(), EventKind::PhoneChange, "phone removed");
+        return Ok(());
+    }
+
+    audit_record(user.get_id(), user.get_id(), EventKind::PhoneChange, "phone set, pending verification");
+    user_send_phone_code(&user, &code)
+}
+
+/// If, and only if, the provided code is the one sent to the given phone number for a user of the given tenant, and no
+/// other user of the tenant has verified the same phone yet, the phone of that user gets verified. Since proving the
+/// phone proves the signup as well, so does the user, if it was not verified yet
+pub fn user_verify_phone(tenant: &str, phone: &str, code: &str) -> Result<(), Box<dyn Error>> {
+    info!("got a phone verification request");
+
+    let tenant = tenant_find(tenant)?;
+    let phone = normalize_phone(phone)?;
+    lock_run(&lock_phone_key(tenant.get_id(), &phone), || user_verify_phone_unlocked(tenant.get_id(), &phone, code))
+}
+
+fn user_verify_phone_unlocked(tenant: i32, phone: &str, code: &str) -> Result<(), Box<dyn Error>> {
+    // the users are read once the lock is held, so they are up to date
+    let owners = get_user_repository().find_all_by_phone(tenant, phone)?;
+    if owners.iter().any(|user| user.is_phone_verified()) {
+        return Err(errors::ALREADY_EXISTS.into());
+    }
+
+    // the phone may be pending verification by many users, but the code tells which one of them it was sent to
+    let mut user = owners.into_iter()
+        .find_map(|mut user| user.verify_phone(code).ok().map(|_| user))
+        .ok_or(errors::WRONG_CODE)?;
+
+    let verified = !user.is_verified();
+    if verified {
+        user.verify()?;
+    }
+
+    get_user_repository().save(&user)?;
+    audit_record(user.get_id(), user.get_id(), EventKind::PhoneChange, "phone verified");
+    if verified {
+        audit_record(user.get_id(), user.get_id(), EventKind::Verify, "phone verified");
+    }
+
+    Ok(())
+}
+
+/// Returns the identifiers the users of the given tenant may log in by: the LOGIN_IDENTIFIERS of the tenant, or else
+/// the default ones. Emails are always included, since every user has one, while phones must be enabled explicitly
+pub fn user_login_identifiers(tenant: i32) -> Vec<LoginIdentifier> {
+    let idents = tenant_setting(tenant, environment::LOGIN_IDENTIFIERS)
+        .unwrap_or(settings::LOGIN_IDENTIFIERS.to_string());
+
+    let mut all = vec![LoginIdentifier::Email];
+    all.extend(LoginIdentifier::parse_all(&idents).into_iter().filter(|ident| *ident != LoginIdentifier::Email));
+    all
+}
+
+/// Returns the email of the user the given login identifier stands for, in the given tenant: the identifier itself if
+/// it is an email, or else the email of the user having verified it as its phone number, as long as the tenant permits
+/// logging in by phone. Anything else is returned as it is, so the login fails the same way as for an unknown email
+pub fn user_resolve_identifier(tenant: i32, ident: &str) -> Result<String, Box<dyn Error>> {
+    if regex::match_regex(regex::EMAIL, ident).is_ok() ||
+       !user_login_identifiers(tenant).contains(&LoginIdentifier::Phone) {
+        return Ok(ident.to_string());
+    }
+
+    let phone = match normalize_phone(ident) {
+        Ok(phone) => phone,
+        Err(_) => return Ok(ident.to_string()),
+    };
+
+    let owner = get_user_repository().find_all_by_phone(tenant, &phone)?
+        .into_iter()
+        .find(|user| user.is_phone_verified());
+
+    match owner {
+        Some(user) => Ok(user.email),
+        None => Ok(ident.to_string()),
+    }
+}
+
+/// Returns the up to date user owning the session of the provided token if, and only if, it is granted for
+/// administrative actions
+pub fn get_admin_user(token: &str) -> Result<User, Box<dyn Error>> {
+    let claim = sess_application::decode_token(token)?;
+    let sess_arc = get_sess_repository().find(&claim.sub)?;
+    
+    let user_id = match sess_arc.read() {
+        Ok(sess) => sess.get_user()?.get_id(),
+        Err(err) => {
+            error!("read lock for session got poisoned: {}", err);
+            return Err(errors::POISONED.into());
+        }
+    };
+
+    let admin = get_user_repository().find(user_id)?;
+    if !admin.is_admin() || admin.is_suspended() {
+        return Err(errors::UNAUTHORIZED.into());
+    }
+
+    Ok(admin)
+}
+
+/// If, and only if, the provided token belongs to an administrator, the user with the given email, in the same tenant
+/// as the administrator, gets suspended, all its sessions revoked and the reason recorded into the audit trail
+pub fn user_suspend(token: &str,
+                    email: &str,
+                    reason: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got a suspension request for user {} ", email);
+
+    let admin = get_admin_user(token)?;
+    user_suspend_by(&admin, admin.tenant, email, reason)
+}
+
+/// The user with the given email, in the given tenant, gets suspended on behalf of the given administrator, all its
+/// sessions revoked and the reason recorded into the audit trail
+pub fn user_suspend_by(admin: &User,
+                       tenant: i32,
+                       email: &str,
+                       reason: &str) -> Result<(), Box<dyn Error>> {
+
+    let mut user = get_user_repository().find_by_email(tenant, email)?;
+    if user.get_id() == admin.get_id() {
+        // an administrator cannot suspend itself
+        return Err(errors::HAS_FAILED.into());
+    }
+
+    user.suspend()?;
+    get_user_repository().save(&user)?;
+    sess_application::session_revoke(user.tenant, &user.email, LogoutReason::Admin)?;
+
+    audit_record(user.get_id(), admin.get_id(), EventKind::Suspend, reason);
+    Ok(())
+}
+
+/// If, and only if, the provided token belongs to an administrator, the user with the given email, in the same tenant
+/// as the administrator, gets reinstated and the reason recorded into the audit trail
+pub fn user_reinstate(token: &str,
+                      email: &str,
+                      reason: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got a reinstatement request for user {} ", email);
+
+    let admin = get_admin_user(token)?;
+    user_reinstate_by(&admin, admin.tenant, email, reason)
+}
+
+/// The suspension of the user with the given email, in the given tenant, gets lifted on behalf of the given
+/// administrator and the reason recorded into the audit trail
+pub fn user_reinstate_by(admin: &User,
+                         tenant: i32,
+                         email: &str,
+                         reason: &str) -> Result<(), Box<dyn Error>> {
+
+    let mut user = get_user_repository().find_by_email(tenant, email)?;
+    user.reinstate()?;
+    get_user_repository().save(&user)?;
+
+    audit_record(user.get_id(), admin.get_id(), EventKind::Reinstate, reason);
+    Ok(())
+}
+
+/// If, and only if, there is no user with the same email in the tenant of the given administrator, a new user is
+/// created into it on behalf of the administrator, such as when provisioned by the identity provider of the tenant.
+/// Provisioned users are verified by the provider, so no verification email is sent, but they are required to set
+/// their own password by a reset one. Inactive users get suspended right away
+pub fn user_provision(admin: &User,
+                      email: &str,
+                      active: bool) -> Result<User, Box<dyn Error>> {
+
+    info!("got a provisioning request for user {} ", email);
+
+    // nobody knows this password, so the user cannot log in until it gets reset; hashed as clients do
+    let password = security::get_random_string(settings::PROVISIONED_PASSWORD_LEN);
+    let password = sha256::digest_bytes(password.as_bytes());
+    let mut user = User::new(Metadata::new(), admin.tenant, email, &password)?;
+    user.verify()?;
+    if !active {
+        user.suspend()?;
+    }
+
+    get_user_repository().create(&mut user)?;
+    audit_record(user.get_id(), admin.get_id(), EventKind::Signup, "provisioned");
+    user_require_reset(user.get_id(), None)?;
+    get_user_repository().find(user.get_id())
+}
+
+/// If, and only if, there is no user with the same email in the given tenant but a pending one, an account gets
+/// pre-registered with that email on behalf of the given administrator. The account stays pending, so it cannot log
+/// in, until its owner activates it by the token sent to its email, which is valid for as long as the given timeout
+/// tells; otherwise it expires. Pre-registering a pending account again sends a new token and moves its deadline. If
+/// mfa is set, the owner must set up its authenticator app as well to activate the account
+pub fn user_preregister(admin: &User,
+                        tenant: i32,
+                        email: &str,
+                        timeout: Duration,
+                        mfa: bool) -> Result<User, Box<dyn Error>> {
+
+    info!("got a pre-registration request for user {} ", email);
+
+    if timeout.as_secs() == 0 || timeout.as_secs() > settings::ACTIVATION_MAX_TIMEOUT {
+        return Err(errors::PARSE_FAILED.into());
+    }
+
+    let deadline = time::now() + timeout;
+    let user = match get_user_repository().find_by_email(tenant, email) {
+        Ok(mut user) if user.is_pending() => {
+            user.set_pending(deadline);
+            get_user_repository().save(&user)?;
+            user
+        },
+        Ok(_) => return Err(errors::ALREADY_EXISTS.into()),
+        Err(_) => {
+            // nobody knows this password, it gets replaced by the one the owner sets on activation
+            let password = security::get_random_string(settings::PROVISIONED_PASSWORD_LEN);
+            let password = sha256::digest_bytes(password.as_bytes());
+            let mut user = User::new(Metadata::new(), tenant, email, &password)?;
+            user.set_pending(deadline);
+
+            get_user_repository().create(&mut user)?;
+            audit_record(user.get_id(), admin.get_id(), EventKind::Signup, "pre-registered");
+            user
+        },
+    };
+
+    let claim = ActivationToken::new(&user, deadline, mfa);
+    let token = security::encode_jwt(claim)?;
+    smtp::send_activation_email(user.tenant, user.get_locale(), &user.email, &token, &time::_iso8601(deadline), None)?;
+    Ok(user)
+}
+
+/// Proposes a new secret for the authenticator app of the given pending user, replacing any former proposal, and
+/// returns it so the owner can set up its app
+fn user_propose_secret(user: &mut User) -> Result<String, Box<dyn Error>> {
+    let key = security::get_random_string(settings::TOKEN_LEN);
+    let mut new_secret = Secret::new(key.as_bytes());
+    get_secret_repository().create(&mut new_secret)?;
+
+    let old_secret = user.set_secret(Some(new_secret));
+    if let Err(err) = get_user_repository().save(user) {
+        // this line will not panic due the previous set of Secret
+        let new_secret = user.set_secret(old_secret).unwrap();
+        get_secret_repository().delete(&new_secret)?;
+        return Err(err);
+    }
+
+    if let Some(secret) = old_secret {
+        get_secret_repository().delete(&secret)?;
+    }
+
+    Ok(key)
+}
+
+/// If, and only if, the provided activation token is valid and its owner is still pending, the given password is set
+/// as the user's one and its account gets activated, so it can log in from now on. If the token tells the owner must
+/// set up its authenticator app, a call with no totp proposes a new secret for it and returns it, and the account is
+/// not activated until a later call confirms the secret by a totp. Returns an empty string once activated
+pub fn user_activate(token: &str, pwd: &str, totp: &str) -> Result<String, Box<dyn Error>> {
+    info!("got an account activation request");
+
+    let claim = security::decode_jwt::<ActivationToken>(token)?;
+    let mut user = get_user_repository().find(claim.sub)?;
+    if !user.is_pending() {
+        // the activation token has already been used
+        return Err(errors::HAS_FAILED.into());
+    }
+
+    regex::match_regex(regex::BASE64, pwd)?;
+    if claim.mfa {
+        if totp.len() == 0 {
+            return user_propose_secret(&mut user);
+        }
+
+        match &user.secret {
+            Some(secret) => security::verify_totp(secret.get_data(), totp)?,
+            None => return Err(errors::MFA_REQUIRED.into()),
+        };
+    }
+
+    user.activate(pwd)?;
+    get_user_repository().save(&user)?;
+    audit_record(user.get_id(), user.get_id(), EventKind::Activate, "");
+    if claim.mfa {
+        audit_record(user.get_id(), user.get_id(), EventKind::MfaUpdate, "enabled");
+    }
+
+    Ok("".into())
+}
+
+/// Removes every pre-registered account whose activation deadline is over. Returns how many of them have expired
+pub fn user_expire_pending() -> Result<usize, Box<dyn Error>> {
+    let expired = get_user_repository().find_all_pending_before(time::now())?;
+    for user in expired.iter() {
+        info!("expiring pending user {} ", user.get_id());
+        // recorded while the user still exists, so the webhooks subscribed to it can be told who it was
+        audit_record(user.get_id(), 0, EventKind::Erase, "activation expired");
+        get_dir_repository().delete_all_by_user(user)?;
+        get_user_repository().delete(user)?;
+    }
+
+    Ok(expired.len())
+}
+
+/// If, and only if, there is no user with the same email in the given tenant, a user imported from another identity
+/// provider is created into it. The password digest, if given, must be the one clients send, so the user keeps its
+/// password; otherwise the user is required to set a new one by a reset email. If dry_run is set, the user is only
+/// validated, and nothing gets created. Returns whether the password has been kept
+pub fn user_import(tenant: i32,
+                   email: &str,
+                   password: Option<&str>,
+                   verified: bool,
+                   active: bool,
+                   dry_run: bool) -> Result<bool, Box<dyn Error>> {
+
+    if get_user_repository().find_by_email(tenant, email).is_ok() {
+        return Err(errors::ALREADY_EXISTS.into());
+    }
+
+    // users whose password cannot be kept get one nobody knows until it gets reset
+    let random = sha256::digest_bytes(security::get_random_string(settings::PROVISIONED_PASSWORD_LEN).as_bytes());
+    let mut user = User::new(Metadata::new(), tenant, email, password.unwrap_or(&random))?;
+    if verified {
+        user.verify()?;
+    }
+
+    if !active {
+        user.suspend()?;
+    }
+
+    if dry_run {
+        return Ok(password.is_some());
+    }
+
+    get_user_repository().create(&mut user)?;
+    audit_record(user.get_id(), user.get_id(), EventKind::Signup, "imported");
+    if password.is_none() {
+        user_require_reset(user.get_id(), None)?;
+    }
+
+    Ok(password.is_some())
+}
+
+/// The already existing user with the given email, in the given tenant, gets the password digest, if any, verification
+/// and status told by an imported record. It gets logged out everywhere whenever its password changes, as the policy
+/// tells for password changes, and its session revoked whenever it gets suspended.
+/// Users are never unverified by an import, and deleted ones are not updated at all. If dry_run is set, the user is
+/// only validated, and nothing gets saved. Returns whether any password has been set
+pub fn user_import_update(tenant: i32,
+                          email: &str,
+                          password: Option<&str>,
+                          verified: bool,
+                          active: bool,
+                          dry_run: bool) -> Result<bool, Box<dyn Error>> {
+
+    let mut user = get_user_repository().find_by_email(tenant, email)?;
+    if user.is_deleted() {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    if let Some(password) = password {
+        user.reset_password(password)?;
+    }
+
+    if verified && !user.is_verified() {
+        user.verify()?;
+    }
+
+    let suspended = !active && !user.is_suspended();
+    match (active, user.is_suspended()) {
+        (true, true) => user.reinstate()?,
+        (false, false) => user.suspend()?,
+        _ => {},
+    }
+
+    if dry_run {
+        return Ok(password.is_some());
+    }
+
+    get_user_repository().save(&user)?;
+    let logged_out = match password {
+        Some(_) => sess_application::session_logout_everywhere(&user, user.get_id(), LogoutCause::PasswordChange)?,
+        None => false,
+    };
+
+    if suspended && !logged_out {
+        sess_application::session_revoke(user.tenant, &user.email, LogoutReason::Admin)?;
+    }
+
+    audit_record(user.get_id(), user.get_id(), EventKind::Signup, "import updated");
+    Ok(password.is_some())
+}
+
+/// Returns the user with the given id if, and only if, it belongs to the given tenant and has not been deleted
+pub fn user_find(tenant: i32, user_id: i32) -> Result<User, Box<dyn Error>> {
+    let user = get_user_repository().find(user_id)?;
+    if user.tenant != tenant || user.is_deleted() {
+        return Err(errors::NOT_FOUND.into());
+    }
 
-            let old_secret = sess.get_user_mut().set_secret(Some(new_secret));
-            if let Err(err) = get_user_repository().save(sess.get_user()) {
-                // this line will not panic due the previous set of Secret
-                let new_secret = sess.get_user_mut().set_secret(old_secret).unwrap();
-                get_secret_repository().delete(&new_secret)?;
-                return Err(err);
-            }
+    Ok(user)
+}
 
-            if let Some(secret) = old_secret {
-                get_secret_repository().delete(&secret)?;
-            }
+/// Returns the user with the given email, in the given tenant, if it has not been deleted
+pub fn user_find_by_email(tenant: i32, email: &str) -> Result<User, Box<dyn Error>> {
+    get_user_repository().find_by_email(tenant, email)
+}
 
-            Ok("".into())
-        },
+/// Returns all the users of the given tenant that have not been deleted, sorted by id
+pub fn user_list(tenant: i32) -> Result<Vec<User>, Box<dyn Error>> {
+    let mut users: Vec<User> = get_user_repository().find_all()?
+        .into_iter()
+        .filter(|user| user.tenant == tenant && !user.is_deleted())
+        .collect();
 
-        None => {
-            let token = security::get_random_string(settings::TOKEN_LEN);
-            sess.store(TOTP_SECRET_PROPOSAL_KEY, &token);
-            Ok(token)
+    users.sort_by_key(|user| user.get_id());
+    Ok(users)
+}
 
-            // let issuer = match env::var(environment::APP_NAME) {
-            //     Ok(app_name) => app_name,
-            //     Err(_) => "".to_string(),
-            // };
-            
-            // let uri = security::get_uri_format(token.as_bytes(), &issuer, sess.get_user().get_email())?;
-            //Ok(uri)
-        }
+/// The user with the given id, in the tenant of the given administrator, gets either suspended or reinstated on behalf
+/// of the administrator, as told by active, if it is not so already
+pub fn user_set_active(admin: &User,
+                       user_id: i32,
+                       active: bool,
+                       reason: &str) -> Result<(), Box<dyn Error>> {
+
+    let user = user_find(admin.tenant, user_id)?;
+    match (active, user.is_suspended()) {
+        (true, true) => user_reinstate_by(admin, admin.tenant, &user.email, reason),
+        (false, false) => user_suspend_by(admin, admin.tenant, &user.email, reason),
+        _ => Ok(()),
     }
 }
 
-fn user_disable_two_factor_authenticator(sess: &mut Session, totp: &str) -> Result<(), Box<dyn Error>> {
-    if let Some(secret) = &sess.get_user().secret {
-        // if the 2FA is enabled it must be confirmed before deletion
-        let data = secret.get_data();
-        security::verify_totp(data, totp)?;
-    } else {
-        return Err(errors::HAS_FAILED.into());
-    }
+/// The user with the given id, in the tenant of the given administrator, gets marked as deleted on behalf of the
+/// administrator, such as when deprovisioned by the identity provider of the tenant, and its session revoked. As any
+/// other deleted user, it will be removed from the system once the retention period is over
+pub fn user_deprovision(admin: &User, user_id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a deprovisioning request for user {} ", user_id);
 
-    // this block got duplicated in order to avoid mutability collisions
-    if let Some(secret) = sess.get_user_mut().set_secret(None) {
-        get_user_repository().save(sess.get_user())?;
-        get_secret_repository().delete(&secret)?;
+    let mut user = user_find(admin.tenant, user_id)?;
+    user.mark_deleted()?;
+    get_user_repository().save(&user)?;
+    sess_application::session_revoke(user.tenant, &user.email, LogoutReason::Admin)?;
+
+    audit_record(user.get_id(), admin.get_id(), EventKind::Delete, "deprovisioned");
+    Ok(())
+}
+
+/// Forces the user with the provided id to reset its password: an email with a reset token is sent to its primary
+/// address and, if any cause is given, the user gets logged out everywhere on it. The user cannot log in until the
+/// password gets reset
+pub fn user_require_reset(user_id: i32, cause: Option<LogoutCause>) -> Result<(), Box<dyn Error>> {
+    let mut user = get_user_repository().find(user_id)?;
+    user.require_reset();
+    get_user_repository().save(&user)?;
+    if let Some(cause) = cause {
+        sess_application::session_logout_everywhere(&user, user.get_id(), cause)?;
     }
-    
+
+    let claim = ResetToken::new(&user, Duration::from_secs(settings::RESET_TIMEOUT));
+    let token = security::encode_jwt(claim)?;
+    smtp::send_password_reset_email(user.tenant, user.get_locale(), &user.email, &token, None)?;
     Ok(())
 }
 
-/// If, and only if, the provided token is valid and the provided credentials matches with the user's ones then a 2FA secret
-/// is created or destroyed depending on the requested action.
-pub fn user_two_factor_authenticator(token: &str,
-                                     pwd: &str,
-                                     totp: &str,
-                                     action: TfaActions) -> Result<String, Box<dyn Error>> {
+/// Forces the user with the provided id to reset its password, as user_require_reset does, but the reset token gets
+/// returned rather than sent by email, so whoever is in charge of the reset hands it over. Meant for accounts whose
+/// email does not work anymore
+pub fn user_permit_reset(user_id: i32) -> Result<String, Box<dyn Error>> {
+    let mut user = get_user_repository().find(user_id)?;
+    user.require_reset();
+    get_user_repository().save(&user)?;
 
-    info!("got an authentication method update for cookie {} ", token);
-    let claim = security::decode_jwt::<SessionToken>(token)?;
-    
-    // session is required in order to have an ephimeral place where to find the metadata for the action
-    // aka: sandbox
-    let sess_arc = get_sess_repository().find(&claim.sub)?;
-    let mut sess = match sess_arc.write() {
-        Ok(sess) => sess,
-        Err(err) => {
-            error!("read-write lock for session got poisoned: {}", err);
-            return Err(errors::POISONED.into());
-        }
-    };
+    let claim = ResetToken::new(&user, Duration::from_secs(settings::RESET_TIMEOUT));
+    security::encode_jwt(claim)
+}
 
-    if !sess.get_user().match_password(pwd) {
+/// The user with the given email, in the given tenant, is told to be compromised, for the given cause, on behalf of the
+/// given administrator: it gets logged out everywhere, as the policy tells for that cause, and required to reset its
+/// password, since its credentials are likely to be known by someone else. The reason is recorded into the audit trail
+pub fn user_flag_compromised(admin: &User,
+                             tenant: i32,
+                             email: &str,
+                             cause: LogoutCause,
+                             reason: &str) -> Result<(), Box<dyn Error>> {
+
+    let user = get_user_repository().find_by_email(tenant, email)?;
+    if user.is_deleted() {
         return Err(errors::NOT_FOUND.into());
-    } else if !sess.get_user().is_verified() {
-        return Err(errors::NOT_VERIFIED.into());
     }
 
-    match action {
-        TfaActions::ENABLE => user_enable_two_factor_authenticator(&mut sess, totp),
-        TfaActions::DISABLE => {
-            user_disable_two_factor_authenticator(&mut sess, totp)?;
-            Ok("".into())
-        },
+    audit_record(user.get_id(), admin.get_id(), EventKind::Threat, &format!("{}: {}", cause.as_str(), reason));
+    sess_application::session_logout_everywhere(&user, admin.get_id(), cause)?;
+    user_require_reset(user.get_id(), None)
+}
+
+/// If, and only if, the provided reset token is valid and its owner is required to reset its password, the given one
+/// is set as the user's password and the user gets logged out everywhere, as the policy tells for password changes
+pub fn user_reset_password(token: &str, pwd: &str) -> Result<(), Box<dyn Error>> {
+    info!("got a password reset request");
+
+    let claim = security::decode_jwt::<ResetToken>(token)?;
+    let mut user = get_user_repository().find(claim.sub)?;
+    if !user.is_reset_required() {
+        // the reset token has already been used
+        return Err(errors::HAS_FAILED.into());
     }
+
+    user.reset_password(pwd)?;
+    get_user_repository().save(&user)?;
+    sess_application::session_logout_everywhere(&user, user.get_id(), LogoutCause::PasswordChange)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::PasswordReset, "");
+    Ok(())
+}
+
+/// If, and only if, the provided token is valid and the credentials matches with the user's ones, the new password is
+/// set as the user's one and the user gets logged out everywhere, as the policy tells for password changes
+pub fn user_change_password(token: &str,
+                            pwd: &str,
+                            new_pwd: &str,
+                            totp: &str) -> Result<(), Box<dyn Error>> {
+
+    info!("got a password change request");
+    let mut user = get_session_user(token, pwd, totp)?;
+    user.reset_password(new_pwd)?;
+    get_user_repository().save(&user)?;
+    sess_application::session_logout_everywhere(&user, user.get_id(), LogoutCause::PasswordChange)?;
+
+    audit_record(user.get_id(), user.get_id(), EventKind::PasswordReset, "changed");
+    Ok(())
 }
 
 #[cfg(test)]
 #[cfg(feature = "integration-tests")]
 mod tests {
-    use std::time::Duration;
+    use std::time::{Duration, SystemTime};
+    use std::collections::HashMap;
     use openssl::sign::Signer;
     use openssl::pkey::{PKey};
     use openssl::ec::EcKey;
@@ -208,12 +1346,17 @@ mod tests {
     
     use crate::constants::settings;
     use crate::security;
+    use crate::detection::domain::Origin;
     use crate::secret::get_repository as get_secret_repository;
     use crate::metadata::get_repository as get_meta_repository;
     use crate::directory::get_repository as get_dir_repository;
+    use crate::audit::get_repository as get_audit_repository;
 
     use crate::session::{
         application as sess_application,
+        get_repository as get_sess_repository,
+        get_remember_repository,
+        domain::Remember,
     };
 
     use crate::app::{
@@ -225,12 +1368,24 @@ mod tests {
         user_signup,
         user_verify,
         user_delete,
+        user_purge,
         user_two_factor_authenticator,
+        user_suspend,
+        user_reinstate,
+        user_preregister,
+        user_activate,
+        user_expire_pending,
+        user_login_history,
+        user_upgrade_guest,
+        user_list_consents,
+        user_revoke_consent,
         TfaActions
     };
+    use crate::pagination::Page;
+    use crate::audit::domain::{Filter, EventKind};
 
     use super::super::{
-        domain::Token,
+        domain::{Token, EmailToken, ActivationToken},
         get_repository as get_user_repository,
     };
 
@@ -245,9 +1400,9 @@ mod tests {
 
         const EMAIL: &str = "user_signup_should_not_fail@testing.com";
 
-        assert!(user_signup(EMAIL, PASSWORD).is_ok());
+        assert!(user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).is_ok());
 
-        let user = get_user_repository().find_by_email(EMAIL).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
         get_meta_repository().find(user.meta.get_id()).unwrap();
 
         get_user_repository().delete(&user).unwrap();
@@ -259,9 +1414,9 @@ mod tests {
 
         const EMAIL: &str = "user_signup_repeated_should_fail@testing.com";
 
-        user_signup(EMAIL, PASSWORD).unwrap();
-        let user = get_user_repository().find_by_email(EMAIL).unwrap();
-        assert!(user_signup(EMAIL, PASSWORD).is_err());
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        assert!(user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).is_err());
 
         get_user_repository().delete(&user).unwrap();
     }
@@ -272,31 +1427,61 @@ mod tests {
 
         const EMAIL: &str = "user_verify_should_not_fail@testing.com";
 
-        user_signup(EMAIL, PASSWORD).unwrap();
-        let user = get_user_repository().find_by_email(EMAIL).unwrap();
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
 
         let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
         let token = security::encode_jwt(claim).unwrap();
 
         assert!(user_verify(&token).is_ok());
         
-        let user = get_user_repository().find_by_email(EMAIL).unwrap(); // get the updated data of the user
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap(); // get the updated data of the user
         assert!(user.verified_at.is_some());
 
         get_user_repository().delete(&user).unwrap();
     }
 
+    #[test]
+    fn user_verify_by_email_token_should_fail() {
+        dotenv::dotenv().unwrap();
+
+        const EMAIL: &str = "user_verify_by_email_token_should_fail@testing.com";
+        const ALIAS: &str = "user_verify_by_email_token_should_fail_alias@testing.com";
+
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+
+        // tokens of any other kind never verify the account, no matter they are signed by the same keys
+        let claim = EmailToken::new(&user, ALIAS, true, Duration::from_secs(settings::TOKEN_TIMEOUT));
+        let token = security::encode_jwt(claim).unwrap();
+        assert!(user_verify(&token).is_err());
+
+        let claim = ActivationToken::new(&user, SystemTime::now() + Duration::from_secs(60), false);
+        let token = security::encode_jwt(claim).unwrap();
+        assert!(user_verify(&token).is_err());
+
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        assert!(user.verified_at.is_none());
+
+        get_user_repository().delete(&user).unwrap();
+    }
+
     #[test]
     fn user_delete_should_not_fail() {
         dotenv::dotenv().unwrap();
 
         const EMAIL: &str = "user_delete_should_not_fail@testing.com";
 
-        user_signup(EMAIL, PASSWORD).unwrap();
-        let user = get_user_repository().find_by_email(EMAIL).unwrap();
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
 
-        assert!(user_delete(EMAIL, PASSWORD, "").is_ok());
+        assert!(user_delete("", EMAIL, PASSWORD, "").is_ok());
         assert!(get_user_repository().find(user.id).is_err());
+        assert!(get_user_repository().find_deleted_by_email(settings::DEFAULT_TENANT, EMAIL).is_ok());
+        assert!(get_meta_repository().find(user.meta.get_id()).is_ok());
+
+        assert!(user_purge(Duration::from_secs(0)).is_ok());
+        assert!(get_user_repository().find_deleted_by_email(settings::DEFAULT_TENANT, EMAIL).is_err());
         assert!(get_meta_repository().find(user.meta.get_id()).is_err());
     }
 
@@ -306,11 +1491,11 @@ mod tests {
 
         const EMAIL: &str = "user_delete_with_wrong_password_should_fail@testing.com";
 
-        user_signup(EMAIL, PASSWORD).unwrap();
-        let user = get_user_repository().find_by_email(EMAIL).unwrap();
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
 
 
-        assert!(user_delete(EMAIL, "fakepassword", "").is_err());
+        assert!(user_delete("", EMAIL, "fakepassword", "").is_err());
         get_user_repository().delete(&user).unwrap();
     }
 
@@ -330,17 +1515,17 @@ mod tests {
         signer.update(EC_PUBLIC).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_application::app_register(URL, EC_PUBLIC, &signature).unwrap();
-        let app = get_app_repository().find_by_url(URL).unwrap();
+        app_application::app_register("", URL, EC_PUBLIC, &signature).unwrap();
+        let app = get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).unwrap();
 
-        user_signup(EMAIL, PASSWORD).unwrap();
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
 
-        let user = get_user_repository().find_by_email(EMAIL).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
         let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
         let token = security::encode_jwt(claim).unwrap();
         user_verify(&token).unwrap();
 
-        let token = sess_application::session_login(EMAIL, PASSWORD, "", URL).unwrap();
+        let token = sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
         
         // generate secret proposal
         let secret = user_two_factor_authenticator(&token, PASSWORD, "", TfaActions::ENABLE).unwrap();
@@ -371,10 +1556,11 @@ mod tests {
         signer.update(URL.as_bytes()).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_application::app_delete(URL, &signature).unwrap();
+        app_application::app_delete("", URL, &signature).unwrap();
         
-        assert!(user_delete(EMAIL, PASSWORD, "").is_err());
-        assert!(user_delete(EMAIL, PASSWORD, &code).is_ok());
+        assert!(user_delete("", EMAIL, PASSWORD, "").is_err());
+        assert!(user_delete("", EMAIL, PASSWORD, &code).is_ok());
+        assert!(user_purge(Duration::from_secs(0)).is_ok());
 
         assert!(get_dir_repository().find_by_user_and_app(user_id, app.get_id()).is_err());
         assert!(get_secret_repository().find(secret_id).is_err());
@@ -397,17 +1583,17 @@ mod tests {
         signer.update(EC_PUBLIC).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_application::app_register(URL, EC_PUBLIC, &signature).unwrap();
-        let app = get_app_repository().find_by_url(URL).unwrap();
+        app_application::app_register("", URL, EC_PUBLIC, &signature).unwrap();
+        let app = get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).unwrap();
 
-        user_signup(EMAIL, PASSWORD).unwrap();
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
 
-        let user = get_user_repository().find_by_email(EMAIL).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
         let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
         let token = security::encode_jwt(claim).unwrap();
         user_verify(&token).unwrap();
 
-        let token = sess_application::session_login(EMAIL, PASSWORD, "", URL).unwrap();
+        let token = sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
 
         // generate secret proposal
         let secret = user_two_factor_authenticator(&token, PASSWORD, "", TfaActions::ENABLE).unwrap();
@@ -435,8 +1621,327 @@ mod tests {
         signer.update(URL.as_bytes()).unwrap();
         let signature = signer.sign_to_vec().unwrap();
 
-        app_application::app_delete(URL, &signature).unwrap();
-        assert!(user_delete(EMAIL, PASSWORD, "").is_ok());
+        app_application::app_delete("", URL, &signature).unwrap();
+        assert!(user_delete("", EMAIL, PASSWORD, "").is_ok());
+        assert!(user_purge(Duration::from_secs(0)).is_ok());
         assert!(get_dir_repository().find_by_user_and_app(user_id, app.get_id()).is_err());
     }
+
+    #[test]
+    fn user_suspend_should_not_fail() {
+        dotenv::dotenv().unwrap();
+
+        const URL: &str = "http://user.suspend.should.not.fail";
+        const ADMIN: &str = "user_suspend_should_not_fail_admin@testing.com";
+        const EMAIL: &str = "user_suspend_should_not_fail@testing.com";
+
+        let private = base64::decode(EC_SECRET).unwrap();
+        let eckey = EcKey::private_key_from_pem(&private).unwrap();
+        let keypair = PKey::from_ec_key(eckey).unwrap();
+
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        signer.update(EC_PUBLIC).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_register("", URL, EC_PUBLIC, &signature).unwrap();
+
+        for email in &[ADMIN, EMAIL] {
+            user_signup("", email, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+            let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, email).unwrap();
+            let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+            let token = security::encode_jwt(claim).unwrap();
+            user_verify(&token).unwrap();
+        }
+
+        let mut admin = get_user_repository().find_by_email(settings::DEFAULT_TENANT, ADMIN).unwrap();
+        admin.admin = true;
+        get_user_repository().save(&admin).unwrap();
+
+        let admin_token = sess_application::session_login("", ADMIN, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user_token = sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+
+        // a non-admin user must not be able to suspend anyone
+        assert!(user_suspend(&user_token, ADMIN, "testing").is_err());
+
+        user_suspend(&admin_token, EMAIL, "testing").unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        assert!(user.is_suspended());
+        assert!(get_sess_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).is_err());
+        assert!(sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).is_err());
+
+        user_reinstate(&admin_token, EMAIL, "testing").unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        assert!(!user.is_suspended());
+        assert!(sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).is_ok());
+
+        let events = get_audit_repository().find_by_user(user.get_id(), "", 10).unwrap();
+        assert_eq!(2, events.len());
+
+        // clear up data
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_delete("", URL, &signature).unwrap();
+        user_delete("", EMAIL, PASSWORD, "").unwrap();
+        user_delete("", ADMIN, PASSWORD, "").unwrap();
+    }
+
+    #[test]
+    fn user_activate_should_not_fail() {
+        dotenv::dotenv().unwrap();
+
+        const ADMIN: &str = "user_activate_should_not_fail_admin@testing.com";
+        const EMAIL: &str = "user_activate_should_not_fail@testing.com";
+
+        user_signup("", ADMIN, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let admin = get_user_repository().find_by_email(settings::DEFAULT_TENANT, ADMIN).unwrap();
+
+        let timeout = Duration::from_secs(60);
+        let user = user_preregister(&admin, settings::DEFAULT_TENANT, EMAIL, timeout, false).unwrap();
+        assert!(user.is_pending());
+        assert!(user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).is_err());
+
+        let claim = ActivationToken::new(&user, user.get_activation_deadline().unwrap(), false);
+        let token = security::encode_jwt(claim).unwrap();
+        assert_eq!("", user_activate(&token, PASSWORD, "").unwrap());
+
+        // the activation token cannot be used twice
+        assert!(user_activate(&token, PASSWORD, "").is_err());
+
+        let user = get_user_repository().find(user.get_id()).unwrap();
+        assert!(!user.is_pending());
+        assert!(user.is_verified());
+        assert!(user.match_password(PASSWORD));
+        assert!(user_preregister(&admin, settings::DEFAULT_TENANT, EMAIL, timeout, false).is_err());
+
+        get_user_repository().delete(&user).unwrap();
+        get_user_repository().delete(&admin).unwrap();
+    }
+
+    #[test]
+    fn user_expire_pending_should_not_fail() {
+        dotenv::dotenv().unwrap();
+
+        const ADMIN: &str = "user_expire_pending_should_not_fail_admin@testing.com";
+        const EMAIL: &str = "user_expire_pending_should_not_fail@testing.com";
+
+        user_signup("", ADMIN, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let admin = get_user_repository().find_by_email(settings::DEFAULT_TENANT, ADMIN).unwrap();
+
+        let timeout = Duration::from_secs(60);
+        let mut user = user_preregister(&admin, settings::DEFAULT_TENANT, EMAIL, timeout, true).unwrap();
+        user.set_pending(SystemTime::now() - timeout);
+        get_user_repository().save(&user).unwrap();
+
+        assert!(user_expire_pending().unwrap() >= 1);
+        assert!(get_user_repository().find_any(user.get_id()).is_err());
+
+        get_user_repository().delete(&admin).unwrap();
+    }
+
+    #[test]
+    fn user_login_history_should_not_fail() {
+        dotenv::dotenv().unwrap();
+
+        const URL: &str = "http://user.login.history.should.not.fail";
+        const EMAIL: &str = "user_login_history_should_not_fail@testing.com";
+
+        let private = base64::decode(EC_SECRET).unwrap();
+        let eckey = EcKey::private_key_from_pem(&private).unwrap();
+        let keypair = PKey::from_ec_key(eckey).unwrap();
+
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        signer.update(EC_PUBLIC).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_register("", URL, EC_PUBLIC, &signature).unwrap();
+
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+        let token = security::encode_jwt(claim).unwrap();
+        user_verify(&token).unwrap();
+
+        let token = sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+
+        // the login shows up in the history of the user, telling the app it took place through
+        let page = Page::new("history", 0, "").unwrap();
+        let filter = Filter {kinds: vec![EventKind::Login], ..Default::default()};
+        let (events, next) = user_login_history(&token, &filter, &page).unwrap();
+        assert_eq!(1, events.len());
+        assert_eq!(user.get_id(), events[0].get_user());
+        assert_eq!(EventKind::Login, events[0].get_kind());
+        assert_eq!(URL, events[0].get_app());
+        assert!(next.is_empty());
+
+        assert!(user_login_history("not a token", &filter, &page).is_err());
+
+        // clear up data
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_delete("", URL, &signature).unwrap();
+        user_delete("", EMAIL, PASSWORD, "").unwrap();
+    }
+
+    #[test]
+    fn user_list_consents_should_not_fail() {
+        dotenv::dotenv().unwrap();
+
+        const URL: &str = "http://user.list.consents.should.not.fail";
+        const GONE_URL: &str = "http://user.list.consents.should.not.fail.gone";
+        const EMAIL: &str = "user_list_consents_should_not_fail@testing.com";
+        const OTHER: &str = "user_list_consents_should_not_fail_other@testing.com";
+
+        let private = base64::decode(EC_SECRET).unwrap();
+        let eckey = EcKey::private_key_from_pem(&private).unwrap();
+        let keypair = PKey::from_ec_key(eckey).unwrap();
+
+        for url in &[URL, GONE_URL] {
+            let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+            signer.update(url.as_bytes()).unwrap();
+            signer.update(EC_PUBLIC).unwrap();
+            let signature = signer.sign_to_vec().unwrap();
+            app_application::app_register("", url, EC_PUBLIC, &signature).unwrap();
+        }
+
+        for email in &[EMAIL, OTHER] {
+            user_signup("", email, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+            let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, email).unwrap();
+            let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+            let token = security::encode_jwt(claim).unwrap();
+            user_verify(&token).unwrap();
+        }
+
+        // both users authorize the same app, but only the caller authorizes the one that is going to be gone
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        let token = sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", GONE_URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        sess_application::session_login("", OTHER, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+
+        let consents = user_list_consents(&token).unwrap();
+        assert_eq!(2, consents.len());
+        assert!(consents.iter().all(|(_, dir)| dir.get_user() == user.get_id()));
+
+        // an app that no longer exists is skipped, even if its directory is still there
+        let gone = get_app_repository().find_by_url(settings::DEFAULT_TENANT, GONE_URL).unwrap();
+        get_app_repository().delete(&gone).unwrap();
+
+        let consents = user_list_consents(&token).unwrap();
+        assert_eq!(1, consents.len());
+        assert_eq!(URL, consents[0].0.get_url());
+        assert_eq!(user.get_id(), consents[0].1.get_user());
+
+        assert!(user_list_consents("not a token").is_err());
+
+        // clear up data
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_delete("", URL, &signature).unwrap();
+        user_delete("", EMAIL, PASSWORD, "").unwrap();
+        user_delete("", OTHER, PASSWORD, "").unwrap();
+    }
+
+    #[test]
+    fn user_revoke_consent_should_not_fail() {
+        dotenv::dotenv().unwrap();
+
+        const URL: &str = "http://user.revoke.consent.should.not.fail";
+        const EMAIL: &str = "user_revoke_consent_should_not_fail@testing.com";
+
+        let private = base64::decode(EC_SECRET).unwrap();
+        let eckey = EcKey::private_key_from_pem(&private).unwrap();
+        let keypair = PKey::from_ec_key(eckey).unwrap();
+
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        signer.update(EC_PUBLIC).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_register("", URL, EC_PUBLIC, &signature).unwrap();
+        let app = get_app_repository().find_by_url(settings::DEFAULT_TENANT, URL).unwrap();
+
+        user_signup("", EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        let claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+        let token = security::encode_jwt(claim).unwrap();
+        user_verify(&token).unwrap();
+
+        let token = sess_application::session_login("", EMAIL, PASSWORD, "", &[], "", URL, 0, 0, &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        let remember = Remember::new(&user, &app, Duration::from_secs(settings::REMEMBER_TIMEOUT));
+        let remember = get_remember_repository().insert(remember).unwrap();
+        assert!(get_dir_repository().find_by_user_and_app(user.get_id(), app.get_id()).is_ok());
+
+        // the directory of the app gets removed, so do the sessions of the user for the app
+        user_revoke_consent(&token, URL).unwrap();
+        assert!(get_dir_repository().find_by_user_and_app(user.get_id(), app.get_id()).is_err());
+        assert!(get_sess_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).is_err());
+        assert!(get_remember_repository().find(&remember).is_err());
+
+        let events = get_audit_repository().find_by_user(user.get_id(), "", 10).unwrap();
+        assert!(events.iter().any(|event| event.get_kind() == EventKind::Revoke));
+
+        // the token of a revoked consent is no longer valid
+        assert!(user_revoke_consent(&token, URL).is_err());
+
+        // clear up data
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_delete("", URL, &signature).unwrap();
+        user_delete("", EMAIL, PASSWORD, "").unwrap();
+    }
+
+    #[test]
+    fn user_upgrade_guest_should_not_fail() {
+        dotenv::dotenv().unwrap();
+
+        const URL: &str = "http://user.upgrade.guest.should.not.fail";
+        const EMAIL: &str = "user_upgrade_guest_should_not_fail@testing.com";
+        const OTHER: &str = "user_upgrade_guest_should_not_fail_other@testing.com";
+
+        let private = base64::decode(EC_SECRET).unwrap();
+        let eckey = EcKey::private_key_from_pem(&private).unwrap();
+        let keypair = PKey::from_ec_key(eckey).unwrap();
+
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        signer.update(EC_PUBLIC).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_register("", URL, EC_PUBLIC, &signature).unwrap();
+        let guest = sess_application::session_guest("", URL).unwrap();
+        let sid = sess_application::decode_token(&guest).unwrap().sub;
+
+        // the session keeps being a guest one until the user gets verified
+        user_upgrade_guest(&guest, EMAIL, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).unwrap();
+        assert!(get_sess_repository().find(&sid).unwrap().read().unwrap().is_guest());
+        assert!(get_sess_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).is_err());
+
+        let user = get_user_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).unwrap();
+        let mut claim = Token::new(&user, Duration::from_secs(settings::TOKEN_TIMEOUT));
+        claim.guest = sid.clone();
+        user_verify(&security::encode_jwt(claim).unwrap()).unwrap();
+        assert!(!get_sess_repository().find(&sid).unwrap().read().unwrap().is_guest());
+        assert!(get_sess_repository().find_by_email(settings::DEFAULT_TENANT, EMAIL).is_ok());
+
+        // replaying the token of an upgraded session leaves no user behind
+        assert!(user_upgrade_guest(&guest, OTHER, PASSWORD, 0, 0, "", &HashMap::new(), "", "", "", &Origin::default()).is_err());
+        assert!(get_user_repository().find_by_email(settings::DEFAULT_TENANT, OTHER).is_err());
+
+        // clear up data
+        let mut signer = Signer::new(MessageDigest::sha256(), &keypair).unwrap();
+        signer.update(URL.as_bytes()).unwrap();
+        let signature = signer.sign_to_vec().unwrap();
+
+        app_application::app_delete("", URL, &signature).unwrap();
+        user_delete("", EMAIL, PASSWORD, "").unwrap();
+    }
 }
\ No newline at end of file
@@ -1,20 +1,32 @@
 use std::error::Error;
 use std::time::{SystemTime, Duration};
+use std::collections::HashMap;
 
 use crate::regex;
+use crate::i18n;
 use crate::secret::domain::Secret;
 use crate::metadata::domain::Metadata;
-use crate::time::unix_timestamp;
-use crate::security;
+use crate::policy::domain::{Policy, PolicyKind};
+use crate::time::{self, unix_timestamp};
+use crate::security::{self, TokenKind};
+use crate::constants::errors;
 
 pub trait UserRepository {
     fn find(&self, id: i32) -> Result<User, Box<dyn Error>>;
-    fn find_by_email(&self, email: &str) -> Result<User, Box<dyn Error>>;
+    fn find_any(&self, id: i32) -> Result<User, Box<dyn Error>>; // deleted ones included
+    fn find_by_email(&self, tenant: i32, email: &str) -> Result<User, Box<dyn Error>>;
+    fn find_deleted_by_email(&self, tenant: i32, email: &str) -> Result<User, Box<dyn Error>>;
+    fn find_all_deleted_before(&self, deadline: SystemTime) -> Result<Vec<User>, Box<dyn Error>>;
+    fn find_all_pending_before(&self, deadline: SystemTime) -> Result<Vec<User>, Box<dyn Error>>; // by activation one
+    fn find_all(&self) -> Result<Vec<User>, Box<dyn Error>>; // deleted ones included
+    fn find_all_by_phone(&self, tenant: i32, phone: &str) -> Result<Vec<User>, Box<dyn Error>>; // verified or not
+    fn find_by_username(&self, tenant: i32, username: &str) -> Result<User, Box<dyn Error>>; // regardless of its case
     fn create(&self, user: &mut User) -> Result<(), Box<dyn Error>>;
     fn save(&self, user: &User) -> Result<(), Box<dyn Error>>;
     fn delete(&self, user: &User) -> Result<(), Box<dyn Error>>;
 }
 
+#[derive(Clone)]
 pub struct User {
     pub(super) id: i32,
     pub(super) email: String, // hash of the email
@@ -22,10 +34,141 @@ pub struct User {
     pub(super) verified_at: Option<SystemTime>,
     pub(super) secret: Option<Secret>,
     pub(super) meta: Metadata,
+    pub(super) suspended_at: Option<SystemTime>,
+    pub(super) admin: bool,
+    pub(super) deleted_at: Option<SystemTime>,
+    pub(super) terms_version: i32,
+    pub(super) privacy_version: i32,
+    pub(super) terms_accepted_at: Option<SystemTime>, // when the accepted version of the terms was accepted
+    pub(super) privacy_accepted_at: Option<SystemTime>, // when the accepted version of the privacy policy was accepted
+    pub(super) recovery_email: Option<String>,
+    pub(super) recovery_until: Option<SystemTime>,
+    pub(super) aliases: Vec<String>, // secondary verified emails
+    pub(super) attributes: HashMap<String, String>, // custom signup attributes
+    pub(super) reset_required_at: Option<SystemTime>, // when the user was forced to reset its password, if so
+    pub(super) locale: Option<String>, // the one emails are sent in, if not the default one
+    pub(super) tenant: i32, // the tenant the user belongs to; emails are unique within it
+    pub(super) phone: Option<String>, // in e.164 format; verified phones are unique within the tenant
+    pub(super) phone_verified_at: Option<SystemTime>,
+    pub(super) phone_code: Option<String>, // digest of the code the phone is being verified by, if so
+    pub(super) phone_code_until: Option<SystemTime>,
+    pub(super) username: Option<String>, // unique within the tenant regardless of its case
+    pub(super) activation_deadline: Option<SystemTime>, // if pre-registered, when the account expires unless activated
+}
+
+/// All the identifiers a user may log in by, besides its password
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum LoginIdentifier {
+    Email,
+    Phone, // verified phone numbers only
+}
+
+impl LoginIdentifier {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            LoginIdentifier::Email => "email",
+            LoginIdentifier::Phone => "phone",
+        }
+    }
+
+    pub fn from_str(ident: &str) -> Option<Self> {
+        match ident {
+            "email" => Some(LoginIdentifier::Email),
+            "phone" => Some(LoginIdentifier::Phone),
+            _ => None,
+        }
+    }
+
+    /// parses a comma separated list of identifiers, such as LOGIN_IDENTIFIERS, ignoring any unknown one
+    pub fn parse_all(idents: &str) -> Vec<Self> {
+        let mut all = Vec::new();
+        for ident in idents.split(',').filter_map(|ident| LoginIdentifier::from_str(ident.trim())) {
+            if !all.contains(&ident) {
+                all.push(ident);
+            }
+        }
+
+        all
+    }
+}
+
+/// Returns the given phone number in e.164 format, as long as it is a valid one. Spaces, dashes, dots and parentheses
+/// are ignored, and the international call prefix 00 is taken as the leading plus sign, so numbers can be typed in as
+/// they are usually written down, though the country code is always required
+pub fn normalize_phone(phone: &str) -> Result<String, Box<dyn Error>> {
+    let digits: String = phone.chars().filter(|c| !" -.()".contains(*c)).collect();
+    let normalized = match digits.strip_prefix("00") {
+        Some(rest) => format!("+{}", rest),
+        None => digits,
+    };
+
+    regex::match_regex(regex::PHONE, &normalized)?;
+    Ok(normalized)
+}
+
+/// Declares an additional attribute a user may, or must, provide at signup
+#[derive(Clone, PartialEq, Debug)]
+pub struct AttributeDefinition {
+    pub(super) name: String,
+    pub(super) required: bool,
+    pub(super) on_login: bool, // if true, the attribute is not required by the signup but by the next login
+    pub(super) claim: Option<String>, // the claim the attribute is exposed as, if any
+    pub(super) pattern: Option<String>, // the regex the value must match, if any
+}
+
+impl AttributeDefinition {
+    /// parses a definition with the format `<name> <required|optional|login> <claim|-> [pattern]`
+    pub fn parse(line: &str) -> Result<Self, Box<dyn Error>> {
+        let mut fields = line.trim().splitn(4, char::is_whitespace)
+            .filter(|field| field.len() > 0);
+
+        let name = match fields.next() {
+            Some(name) => name.to_string(),
+            None => return Err("attribute name required".into()),
+        };
+
+        let (required, on_login) = match fields.next() {
+            Some("required") => (true, false),
+            Some("optional") => (false, false),
+            Some("login") => (false, true),
+            _ => return Err("attribute must be either required, optional or login".into()),
+        };
+
+        let claim = match fields.next() {
+            Some("-") | None => None,
+            Some(claim) => Some(claim.to_string()),
+        };
+
+        let pattern = fields.next().map(|pattern| pattern.trim().to_string());
+        Ok(AttributeDefinition {
+            name: name,
+            required: required,
+            on_login: on_login,
+            claim: claim,
+            pattern: pattern,
+        })
+    }
+
+    pub fn get_name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn is_required(&self) -> bool {
+        self.required
+    }
+
+    pub fn is_required_on_login(&self) -> bool {
+        self.required || self.on_login
+    }
+
+    pub fn get_claim(&self) -> Option<&str> {
+        self.claim.as_deref()
+    }
 }
 
 impl User {
     pub fn new(meta: Metadata,
+               tenant: i32,
                email: &str,
                password: &str) -> Result<Self, Box<dyn Error>> {
         
@@ -39,6 +182,26 @@ impl User {
             verified_at: None,
             secret: None,
             meta: meta,
+            suspended_at: None,
+            admin: false,
+            deleted_at: None,
+            terms_version: 0,
+            privacy_version: 0,
+            terms_accepted_at: None,
+            privacy_accepted_at: None,
+            recovery_email: None,
+            recovery_until: None,
+            aliases: Vec::new(),
+            attributes: HashMap::new(),
+            reset_required_at: None,
+            locale: None,
+            tenant: tenant,
+            phone: None,
+            phone_verified_at: None,
+            phone_code: None,
+            phone_code_until: None,
+            username: None,
+            activation_deadline: None,
         };
 
         Ok(user)
@@ -50,7 +213,136 @@ impl User {
             return Err("already verified".into());
         }
 
-        self.verified_at = Some(SystemTime::now());
+        self.verified_at = Some(time::now());
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the user was not suspended before, sets the current time as its suspension time
+    pub(super) fn suspend(&mut self) -> Result<(), Box<dyn Error>> {
+        if self.suspended_at.is_some() {
+            return Err("already suspended".into());
+        }
+
+        self.suspended_at = Some(time::now());
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the user was suspended, removes its suspension time
+    pub(super) fn reinstate(&mut self) -> Result<(), Box<dyn Error>> {
+        if self.suspended_at.is_none() {
+            return Err("not suspended".into());
+        }
+
+        self.suspended_at = None;
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the user was not deleted before, sets the current time as its deletion time
+    pub(super) fn mark_deleted(&mut self) -> Result<(), Box<dyn Error>> {
+        if self.deleted_at.is_some() {
+            return Err("already deleted".into());
+        }
+
+        self.deleted_at = Some(time::now());
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the user was deleted, removes its deletion time
+    pub(super) fn restore(&mut self) -> Result<(), Box<dyn Error>> {
+        if self.deleted_at.is_none() {
+            return Err("not deleted".into());
+        }
+
+        self.deleted_at = None;
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// replaces the email of the user by the provided one, keeping the old email as a recovery contact until the grace
+    /// period is over
+    pub(super) fn change_email(&mut self, email: &str, grace: Duration) -> Result<(), Box<dyn Error>> {
+        regex::match_regex(regex::EMAIL, email)?;
+        if self.email == email {
+            return Err("same email".into());
+        }
+
+        let old_email = std::mem::replace(&mut self.email, email.to_string());
+        self.recovery_email = Some(old_email);
+        self.recovery_until = Some(time::now() + grace);
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the provided email is not one of the user's emails yet, it gets registered as an alias
+    pub(super) fn add_alias(&mut self, email: &str) -> Result<(), Box<dyn Error>> {
+        regex::match_regex(regex::EMAIL, email)?;
+        if self.has_email(email) {
+            return Err("already registered".into());
+        }
+
+        self.aliases.push(email.to_string());
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the provided email is one of the user's aliases, it gets removed
+    pub(super) fn remove_alias(&mut self, email: &str) -> Result<(), Box<dyn Error>> {
+        let index = match self.aliases.iter().position(|alias| alias == email) {
+            Some(index) => index,
+            None => return Err("not an alias".into()),
+        };
+
+        self.aliases.remove(index);
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the provided email is one of the user's aliases, it becomes the primary email and the old primary email
+    /// becomes an alias
+    pub(super) fn set_primary(&mut self, email: &str) -> Result<(), Box<dyn Error>> {
+        let index = match self.aliases.iter().position(|alias| alias == email) {
+            Some(index) => index,
+            None => return Err("not an alias".into()),
+        };
+
+        std::mem::swap(&mut self.email, &mut self.aliases[index]);
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// sets the provided attributes if, and only if, all of them are declared by the schema, satisfy its definition
+    /// and none of the required ones is missing
+    pub(super) fn set_attributes(&mut self,
+                                 schema: &[AttributeDefinition],
+                                 attributes: &HashMap<String, String>) -> Result<(), Box<dyn Error>> {
+        
+        for name in attributes.keys() {
+            if !schema.iter().any(|def| &def.name == name) {
+                return Err(format!("unknown attribute {}", name).into());
+            }
+        }
+
+        for def in schema {
+            match attributes.get(&def.name) {
+                Some(value) if value.len() > 0 => {
+                    if let Some(pattern) = &def.pattern {
+                        regex::match_regex(pattern, value)?;
+                    }
+                },
+                _ if def.required => return Err(format!("attribute {} required", def.name).into()),
+                _ => {},
+            }
+        }
+
+        self.attributes = attributes.iter()
+            .filter(|(_, value)| value.len() > 0)
+            .map(|(name, value)| (name.clone(), value.clone()))
+            .collect();
+
         self.meta.touch();
         Ok(())
     }
@@ -67,10 +359,136 @@ impl User {
         self.id
     }
 
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
     pub fn get_email(&self) -> &str {
         &self.email
     }
 
+    pub fn get_aliases(&self) -> &[String] {
+        &self.aliases
+    }
+
+    pub fn get_attributes(&self) -> &HashMap<String, String> {
+        &self.attributes
+    }
+
+    pub fn get_locale(&self) -> Option<&str> {
+        self.locale.as_deref()
+    }
+
+    /// sets the locale the emails to the user are sent in if, and only if, it is supported; if empty, the default one
+    /// is used back
+    pub(super) fn set_locale(&mut self, locale: &str) -> Result<(), Box<dyn Error>> {
+        self.locale = match locale {
+            "" => None,
+            locale => match i18n::normalize(locale).filter(|locale| i18n::is_supported(locale)) {
+                Some(locale) => Some(locale),
+                None => return Err("locale not supported".into()),
+            },
+        };
+
+        self.meta.touch();
+        Ok(())
+    }
+
+    pub fn get_username(&self) -> Option<&str> {
+        self.username.as_deref()
+    }
+
+    /// sets the provided username as the user's one, as long as it is already checked against the policy of its
+    /// tenant. If empty, the username of the user, if any, gets removed
+    pub(super) fn set_username(&mut self, username: &str) {
+        self.username = match username {
+            "" => None,
+            username => Some(username.to_string()),
+        };
+
+        self.meta.touch();
+    }
+
+    pub fn get_phone(&self) -> Option<&str> {
+        self.phone.as_deref()
+    }
+
+    /// if true, the user has verified its phone number, so it can log in by it, else it has not
+    pub fn is_phone_verified(&self) -> bool {
+        self.phone.is_some() && self.phone_verified_at.is_some()
+    }
+
+    /// sets the provided phone number as the user's one, unverified until the given code is confirmed within the
+    /// timeout. If empty, the phone number of the user, if any, gets removed
+    pub(super) fn set_phone(&mut self, phone: &str, code: &str, timeout: Duration) -> Result<(), Box<dyn Error>> {
+        if phone.is_empty() {
+            self.phone = None;
+            self.phone_code = None;
+            self.phone_code_until = None;
+        } else {
+            let phone = normalize_phone(phone)?;
+            self.phone_code = Some(security::format_password(&format!("{}:{}", phone, code)));
+            self.phone_code_until = Some(time::now() + timeout);
+            self.phone = Some(phone);
+        }
+
+        self.phone_verified_at = None;
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if the provided code is the one the phone number of the user is being verified by, and it has not expired yet,
+    /// sets the current time as the verification time of the phone. Codes can be confirmed once only
+    pub(super) fn verify_phone(&mut self, code: &str) -> Result<(), Box<dyn Error>> {
+        let (phone, digest, until) = match (&self.phone, &self.phone_code, self.phone_code_until) {
+            (Some(phone), Some(digest), Some(until)) => (phone, digest, until),
+            _ => return Err(errors::WRONG_CODE.into()),
+        };
+
+        let expected = security::format_password(&format!("{}:{}", phone, code));
+        if until <= time::now() || !security::constant_time_eq(&expected, digest) {
+            return Err(errors::WRONG_CODE.into());
+        }
+
+        self.phone_verified_at = Some(time::now());
+        self.phone_code = None;
+        self.phone_code_until = None;
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// returns the names of the attributes the schema requires on login the user has no value for, such as these
+    /// deferred by the signup or declared after it
+    pub fn get_missing_attributes(&self, schema: &[AttributeDefinition]) -> Vec<String> {
+        schema.iter()
+            .filter(|def| def.is_required_on_login() && !self.attributes.contains_key(&def.name))
+            .map(|def| def.name.clone())
+            .collect()
+    }
+
+    /// returns the user's attributes mapped by the claims the schema exposes them as
+    pub fn get_claims(&self, schema: &[AttributeDefinition]) -> HashMap<String, String> {
+        schema.iter()
+            .filter_map(|def| match (&def.claim, self.attributes.get(&def.name)) {
+                (Some(claim), Some(value)) => Some((claim.clone(), value.clone())),
+                _ => None,
+            })
+            .collect()
+    }
+
+    /// if true, the provided email is either the primary email or an alias of the user, else is not
+    pub fn has_email(&self, email: &str) -> bool {
+        self.email == email || self.aliases.iter().any(|alias| alias == email)
+    }
+
+    /// returns the recovery email of the user if, and only if, its grace period is not over yet
+    pub fn get_recovery_email(&self) -> Option<&str> {
+        match (&self.recovery_email, self.recovery_until) {
+            (Some(email), Some(until)) if until > time::now() => Some(email.as_str()),
+            _ => None,
+        }
+    }
+
     pub fn get_secret(&self) -> &Option<Secret> {
         &self.secret
     }
@@ -80,12 +498,165 @@ impl User {
         self.verified_at.is_some()
     }
 
-    // checks the provided password matches the user's one
+    /// if true, the user is suspended and cannot log in, else is not
+    pub fn is_suspended(&self) -> bool {
+        self.suspended_at.is_some()
+    }
+
+    /// if true, the user has been deleted and is waiting to be purged, else is not
+    pub fn is_deleted(&self) -> bool {
+        self.deleted_at.is_some()
+    }
+
+    /// returns the version of the given kind of policy the user has accepted, being 0 if none
+    pub fn get_policy_version(&self, kind: PolicyKind) -> i32 {
+        match kind {
+            PolicyKind::Terms => self.terms_version,
+            PolicyKind::Privacy => self.privacy_version,
+        }
+    }
+
+    /// returns when the user accepted its version of the given kind of policy, if ever
+    pub fn get_policy_accepted_at(&self, kind: PolicyKind) -> Option<SystemTime> {
+        match kind {
+            PolicyKind::Terms => self.terms_accepted_at,
+            PolicyKind::Privacy => self.privacy_accepted_at,
+        }
+    }
+
+    /// if true, the user accepted the given kind of policy longer ago than the provided lifetime, so it has to be
+    /// accepted again even if the version is the latest one, else it has not
+    pub fn is_policy_expired(&self, kind: PolicyKind, lifetime: Duration) -> bool {
+        match self.get_policy_accepted_at(kind) {
+            Some(accepted_at) => accepted_at.elapsed().map(|elapsed| elapsed >= lifetime).unwrap_or(false),
+            None => false,
+        }
+    }
+
+    /// records the provided policy as the one accepted by the user for its kind, as of now
+    pub fn accept_policy(&mut self, policy: &Policy) {
+        match policy.get_kind() {
+            PolicyKind::Terms => {
+                self.terms_version = policy.get_version();
+                self.terms_accepted_at = Some(time::now());
+            },
+            PolicyKind::Privacy => {
+                self.privacy_version = policy.get_version();
+                self.privacy_accepted_at = Some(time::now());
+            },
+        }
+
+        self.meta.touch();
+    }
+
+    /// forces the user to reset its password before logging in again
+    pub(super) fn require_reset(&mut self) {
+        if self.reset_required_at.is_none() {
+            self.reset_required_at = Some(time::now());
+            self.meta.touch();
+        }
+    }
+
+    /// if true, the user must reset its password before logging in, else it must not
+    pub fn is_reset_required(&self) -> bool {
+        self.reset_required_at.is_some()
+    }
+
+    /// keeps the user pending until the given deadline: it cannot log in until its account gets activated, and the
+    /// account expires if that does not happen in time
+    pub(super) fn set_pending(&mut self, deadline: SystemTime) {
+        self.activation_deadline = Some(deadline);
+        self.meta.touch();
+    }
+
+    /// if true, the user has been pre-registered and its account has not been activated yet, else it has not
+    pub fn is_pending(&self) -> bool {
+        self.activation_deadline.is_some()
+    }
+
+    pub fn get_activation_deadline(&self) -> Option<SystemTime> {
+        self.activation_deadline
+    }
+
+    /// if the user is pending and its deadline is not over, sets the provided password as the user's one and
+    /// activates its account. The email gets verified as well, since the activation token was sent to it
+    pub(super) fn activate(&mut self, password: &str) -> Result<(), Box<dyn Error>> {
+        match self.activation_deadline {
+            Some(deadline) if deadline > time::now() => {},
+            _ => return Err(errors::HAS_FAILED.into()),
+        }
+
+        self.reset_password(password)?;
+        if self.verified_at.is_none() {
+            self.verified_at = Some(time::now());
+        }
+
+        self.activation_deadline = None;
+        Ok(())
+    }
+
+    /// sets the provided password as the user's one, releasing any pending reset requirement
+    pub(super) fn reset_password(&mut self, password: &str) -> Result<(), Box<dyn Error>> {
+        regex::match_regex(regex::BASE64, password)?;
+        self.password = security::format_password(password);
+        self.reset_required_at = None;
+        self.meta.touch();
+        Ok(())
+    }
+
+    /// if true, the user is granted for administrative actions, else is not
+    pub fn is_admin(&self) -> bool {
+        self.admin
+    }
+
+    // checks the provided password matches the user's one, no matter it got peppered before the latest rotation
     pub fn match_password(&self, password: &str) -> bool {
-        security::format_password(password) == self.password
+        match_digest(password, &self.password)
+    }
+
+    // checks the provided password matches the user's one as peppered before the latest rotation
+    fn is_previously_peppered(&self, password: &str) -> bool {
+        security::format_previous_password(password)
+            .map(|previous| security::constant_time_eq(&previous, &self.password))
+            .unwrap_or(false)
+    }
+
+    /// peppers the user's password again with the current pepper if, and only if, it was peppered by the previous
+    /// one, returning true if so. The provided password must have been matched already
+    pub fn repepper_password(&mut self, password: &str) -> bool {
+        let current = security::format_password(password);
+        if security::constant_time_eq(&current, &self.password) || !self.is_previously_peppered(password) {
+            return false;
+        }
+
+        self.password = current;
+        self.meta.touch();
+        true
     }
 }
 
+// checks the password matches the digest as peppered by either the current pepper or the previous one. Both digests
+// are always computed, so the time it takes does not tell which one the digest has
+fn match_digest(password: &str, digest: &str) -> bool {
+    match_digest_peppered(password, digest, security::get_previous_pepper().as_deref())
+}
+
+// does as match_digest, but with the previous pepper, if any, told explicitly instead of resolved through the keyring
+fn match_digest_peppered(password: &str, digest: &str, previous: Option<&str>) -> bool {
+    let current = security::constant_time_eq(&security::format_password(password), digest);
+    let previous = previous
+        .map(|pepper| security::constant_time_eq(&security::format_password_as(password, pepper), digest))
+        .unwrap_or(false);
+
+    previous | current
+}
+
+/// does as much hashing work on the provided password as matching it against the password of any user, so failing
+/// for a missing user takes as long as failing for a wrong password. It never matches, since no digest is empty
+pub fn match_no_password(password: &str) -> bool {
+    match_digest(password, "")
+}
+
 // token for email-verification
 #[derive(Serialize, Deserialize)]
 pub struct Token {
@@ -93,15 +664,104 @@ pub struct Token {
     pub(super) iat: SystemTime,     // issued at: creation time
     pub(super) iss: String,         // issuer
     pub(super) sub: i32,            // subject: the user id
+    #[serde(default)]
+    pub(super) guest: String,       // the guest session the user takes over once verified, if any
+}
+
+impl TokenKind for Token {
+    const KIND: &'static str = "verification+jwt";
 }
 
 impl Token {
     pub fn new(user: &User, timeout: Duration) -> Self {
         Token {
-            exp: unix_timestamp(SystemTime::now() + timeout),
-            iat: SystemTime::now(),
+            exp: unix_timestamp(time::now() + timeout),
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: user.id,
+            guest: "".to_string(),
+        }
+    }
+}
+
+
+// token for email-change confirmation
+#[derive(Serialize, Deserialize)]
+pub struct EmailToken {
+    pub(super) exp: usize,          // expiration time (as UTC timestamp) - required
+    pub(super) iat: SystemTime,     // issued at: creation time
+    pub(super) iss: String,         // issuer
+    pub(super) sub: i32,            // subject: the user id
+    pub(super) email: String,       // the email to confirm
+    pub(super) alias: bool,         // if true, the email is confirmed as an alias instead of as the new primary email
+}
+
+impl TokenKind for EmailToken {
+    const KIND: &'static str = "email+jwt";
+}
+
+impl EmailToken {
+    pub fn new(user: &User, email: &str, alias: bool, timeout: Duration) -> Self {
+        EmailToken {
+            exp: unix_timestamp(time::now() + timeout),
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: user.id,
+            email: email.to_string(),
+            alias: alias,
+        }
+    }
+}
+
+
+// token for password reset
+#[derive(Serialize, Deserialize)]
+pub struct ResetToken {
+    pub(super) exp: usize,          // expiration time (as UTC timestamp) - required
+    pub(super) iat: SystemTime,     // issued at: creation time
+    pub(super) iss: String,         // issuer
+    pub(super) sub: i32,            // subject: the user id
+    pub(super) reset: bool,         // always true, tells apart reset tokens from verification ones
+}
+
+impl TokenKind for ResetToken {
+    const KIND: &'static str = "reset+jwt";
+}
+
+impl ResetToken {
+    pub fn new(user: &User, timeout: Duration) -> Self {
+        ResetToken {
+            exp: unix_timestamp(time::now() + timeout),
+            iat: time::now(),
+            iss: "tpauth.alvidir.com".to_string(),
+            sub: user.id,
+            reset: true,
+        }
+    }
+}
+
+// token for the activation of pre-registered accounts
+#[derive(Serialize, Deserialize)]
+pub struct ActivationToken {
+    pub(super) exp: usize,          // expiration time (as UTC timestamp) - required, the activation deadline
+    pub(super) iat: SystemTime,     // issued at: creation time
+    pub(super) iss: String,         // issuer
+    pub(super) sub: i32,            // subject: the user id
+    pub(super) mfa: bool,           // if true, the user must set up its authenticator app to activate its account
+}
+
+impl TokenKind for ActivationToken {
+    const KIND: &'static str = "activation+jwt";
+}
+
+impl ActivationToken {
+    pub fn new(user: &User, deadline: SystemTime, mfa: bool) -> Self {
+        ActivationToken {
+            exp: unix_timestamp(deadline),
+            iat: time::now(),
             iss: "tpauth.alvidir.com".to_string(),
             sub: user.id,
+            mfa: mfa,
         }
     }
 }
@@ -110,9 +770,15 @@ impl Token {
 #[cfg(test)]
 pub mod tests {
     use std::time::{SystemTime, Duration};
+    use std::collections::HashMap;
+    use crate::constants::settings;
     use crate::metadata::domain::tests::new_metadata;
     use crate::time::unix_timestamp;
-    use super::{User, Token};
+    use crate::policy::domain::PolicyKind;
+    use crate::security::PEPPERED;
+    use super::{User, Token, EmailToken, ResetToken, ActivationToken, AttributeDefinition, LoginIdentifier};
+    use super::{match_no_password, match_digest_peppered};
+    use super::normalize_phone;
         
     pub fn new_user() -> User {
         User{
@@ -122,6 +788,26 @@ pub mod tests {
             verified_at: None,
             secret: None,
             meta: new_metadata(),
+            suspended_at: None,
+            admin: false,
+            deleted_at: None,
+            terms_version: 0,
+            privacy_version: 0,
+            terms_accepted_at: None,
+            privacy_accepted_at: None,
+            recovery_email: None,
+            recovery_until: None,
+            aliases: Vec::new(),
+            attributes: HashMap::new(),
+            reset_required_at: None,
+            locale: None,
+            tenant: settings::DEFAULT_TENANT,
+            phone: None,
+            phone_verified_at: None,
+            phone_code: None,
+            phone_code_until: None,
+            username: None,
+            activation_deadline: None,
         }
     }
 
@@ -133,6 +819,26 @@ pub mod tests {
             verified_at: None,
             secret: None,
             meta: new_metadata(),
+            suspended_at: None,
+            admin: false,
+            deleted_at: None,
+            terms_version: 0,
+            privacy_version: 0,
+            terms_accepted_at: None,
+            privacy_accepted_at: None,
+            recovery_email: None,
+            recovery_until: None,
+            aliases: Vec::new(),
+            attributes: HashMap::new(),
+            reset_required_at: None,
+            locale: None,
+            tenant: settings::DEFAULT_TENANT,
+            phone: None,
+            phone_verified_at: None,
+            phone_code: None,
+            phone_code_until: None,
+            username: None,
+            activation_deadline: None,
         }
     }
 
@@ -143,10 +849,12 @@ pub mod tests {
 
         let meta = new_metadata();
         let user = User::new(meta,
+                             settings::DEFAULT_TENANT,
                              EMAIL,
                              PWD).unwrap();
 
         assert_eq!(user.id, 0); 
+        assert_eq!(user.tenant, settings::DEFAULT_TENANT);
         assert_eq!(user.email, EMAIL);
         assert!(user.secret.is_none());
     }
@@ -158,6 +866,7 @@ pub mod tests {
 
         let meta = new_metadata();
         let user = User::new(meta,
+                             settings::DEFAULT_TENANT,
                              EMAIL,
                              PWD);
     
@@ -171,6 +880,7 @@ pub mod tests {
 
         let meta = new_metadata();
         let user = User::new(meta,
+                             settings::DEFAULT_TENANT,
                              EMAIL,
                              PWD);
     
@@ -201,12 +911,315 @@ pub mod tests {
         assert!(user.verify().is_err());
     }
 
+    #[test]
+    fn user_suspend_should_not_fail() {
+        let mut user = new_user();
+        assert!(!user.is_suspended());
+
+        let before = SystemTime::now();
+        assert!(user.suspend().is_ok());
+        let after = SystemTime::now();
+
+        let time = user.suspended_at.unwrap();
+        assert!(time >= before && time <= after);
+        assert!(user.is_suspended());
+    }
+
+    #[test]
+    fn user_suspend_should_fail() {
+        let mut user = new_user();
+        user.suspended_at = Some(SystemTime::now());
+
+        assert!(user.suspend().is_err());
+    }
+
+    #[test]
+    fn user_reinstate_should_not_fail() {
+        let mut user = new_user();
+        user.suspended_at = Some(SystemTime::now());
+
+        assert!(user.reinstate().is_ok());
+        assert!(!user.is_suspended());
+    }
+
+    #[test]
+    fn user_reinstate_should_fail() {
+        let mut user = new_user();
+        assert!(user.reinstate().is_err());
+    }
+
+    #[test]
+    fn user_mark_deleted_should_not_fail() {
+        let mut user = new_user();
+        assert!(!user.is_deleted());
+
+        let before = SystemTime::now();
+        assert!(user.mark_deleted().is_ok());
+        let after = SystemTime::now();
+
+        let time = user.deleted_at.unwrap();
+        assert!(time >= before && time <= after);
+        assert!(user.is_deleted());
+        assert!(user.mark_deleted().is_err());
+    }
+
+    #[test]
+    fn user_restore_should_not_fail() {
+        let mut user = new_user();
+        assert!(user.restore().is_err());
+
+        user.deleted_at = Some(SystemTime::now());
+        assert!(user.restore().is_ok());
+        assert!(!user.is_deleted());
+    }
+
+    #[test]
+    fn user_accept_policy_should_not_fail() {
+        use crate::policy::domain::tests::new_policy;
+
+        let mut user = new_user();
+        assert_eq!(0, user.get_policy_version(PolicyKind::Terms));
+        assert_eq!(0, user.get_policy_version(PolicyKind::Privacy));
+
+        user.accept_policy(&new_policy(PolicyKind::Terms, 3));
+        assert_eq!(3, user.get_policy_version(PolicyKind::Terms));
+        assert_eq!(0, user.get_policy_version(PolicyKind::Privacy));
+        assert!(user.get_policy_accepted_at(PolicyKind::Terms).is_some());
+        assert!(user.get_policy_accepted_at(PolicyKind::Privacy).is_none());
+    }
+
+    #[test]
+    fn user_is_policy_expired_should_not_fail() {
+        use crate::policy::domain::tests::new_policy;
+
+        let mut user = new_user();
+        assert!(!user.is_policy_expired(PolicyKind::Terms, Duration::from_secs(0)));
+
+        user.accept_policy(&new_policy(PolicyKind::Terms, 1));
+        assert!(!user.is_policy_expired(PolicyKind::Terms, Duration::from_secs(60)));
+
+        user.terms_accepted_at = Some(SystemTime::now() - Duration::from_secs(120));
+        assert!(user.is_policy_expired(PolicyKind::Terms, Duration::from_secs(60)));
+        assert!(!user.is_policy_expired(PolicyKind::Privacy, Duration::from_secs(60)));
+    }
+
+    #[test]
+    fn user_change_email_should_not_fail() {
+        const EMAIL: &str = "new_dummy@test.com";
+        let grace = Duration::from_secs(60);
+
+        let mut user = new_user();
+        let old_email = user.email.clone();
+        assert!(user.get_recovery_email().is_none());
+
+        user.change_email(EMAIL, grace).unwrap();
+        assert_eq!(EMAIL, user.email);
+        assert_eq!(Some(old_email.as_str()), user.get_recovery_email());
+    }
+
+    #[test]
+    fn user_change_email_should_fail() {
+        let grace = Duration::from_secs(60);
+        let mut user = new_user();
+        let old_email = user.email.clone();
+
+        assert!(user.change_email("not_an_email", grace).is_err());
+        assert!(user.change_email(&old_email, grace).is_err());
+        assert_eq!(old_email, user.email);
+    }
+
+    #[test]
+    fn user_recovery_email_expired_should_fail() {
+        let mut user = new_user();
+        user.recovery_email = Some("old_dummy@test.com".to_string());
+        user.recovery_until = Some(SystemTime::now() - Duration::from_secs(1));
+
+        assert!(user.get_recovery_email().is_none());
+    }
+
+    #[test]
+    fn user_email_token_should_not_fail() {
+        const EMAIL: &str = "new_dummy@test.com";
+        let user = new_user();
+        let timeout = Duration::from_secs(60);
+
+        let before = SystemTime::now();
+        let claim = EmailToken::new(&user, EMAIL, true, timeout);
+        let after = SystemTime::now();
+
+        assert!(claim.iat >= before && claim.iat <= after);
+        assert!(claim.exp >= unix_timestamp(before + timeout));
+        assert!(claim.exp <= unix_timestamp(after + timeout));
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!(user.id, claim.sub);
+        assert_eq!(EMAIL, claim.email);
+        assert!(claim.alias);
+    }
+
+    #[test]
+    fn user_add_alias_should_not_fail() {
+        const EMAIL: &str = "alias_dummy@test.com";
+
+        let mut user = new_user();
+        assert!(!user.has_email(EMAIL));
+
+        user.add_alias(EMAIL).unwrap();
+        assert!(user.has_email(EMAIL));
+        assert_eq!(1, user.get_aliases().len());
+    }
+
+    #[test]
+    fn user_add_alias_should_fail() {
+        let mut user = new_user();
+        let primary = user.email.clone();
+
+        assert!(user.add_alias("not_an_email").is_err());
+        assert!(user.add_alias(&primary).is_err());
+        
+        user.add_alias("alias_dummy@test.com").unwrap();
+        assert!(user.add_alias("alias_dummy@test.com").is_err());
+    }
+
+    #[test]
+    fn user_remove_alias_should_not_fail() {
+        const EMAIL: &str = "alias_dummy@test.com";
+
+        let mut user = new_user();
+        assert!(user.remove_alias(EMAIL).is_err());
+
+        user.add_alias(EMAIL).unwrap();
+        user.remove_alias(EMAIL).unwrap();
+        assert!(!user.has_email(EMAIL));
+    }
+
+    #[test]
+    fn user_set_primary_should_not_fail() {
+        const EMAIL: &str = "alias_dummy@test.com";
+
+        let mut user = new_user();
+        let primary = user.email.clone();
+        assert!(user.set_primary(EMAIL).is_err());
+
+        user.add_alias(EMAIL).unwrap();
+        user.set_primary(EMAIL).unwrap();
+        assert_eq!(EMAIL, user.get_email());
+        assert_eq!(&[primary], user.get_aliases());
+    }
+
+    #[test]
+    fn user_attribute_definition_parse_should_not_fail() {
+        let def = AttributeDefinition::parse("nickname required nick ^[a-z]{3,16}$").unwrap();
+        assert_eq!("nickname", def.name);
+        assert!(def.required);
+        assert_eq!(Some("nick"), def.get_claim());
+        assert_eq!(Some("^[a-z]{3,16}$".to_string()), def.pattern);
+
+        let def = AttributeDefinition::parse("company optional -").unwrap();
+        assert_eq!("company", def.name);
+        assert!(!def.required);
+        assert!(!def.is_required_on_login());
+        assert_eq!(None, def.claim);
+        assert_eq!(None, def.pattern);
+
+        let def = AttributeDefinition::parse("phone login phone_number").unwrap();
+        assert!(!def.required);
+        assert!(def.is_required_on_login());
+    }
+
+    #[test]
+    fn user_attribute_definition_parse_should_fail() {
+        assert!(AttributeDefinition::parse("").is_err());
+        assert!(AttributeDefinition::parse("nickname").is_err());
+        assert!(AttributeDefinition::parse("nickname mandatory nick").is_err());
+    }
+
+    #[test]
+    fn user_set_attributes_should_not_fail() {
+        let schema = vec![
+            AttributeDefinition::parse("nickname required nick ^[a-z]{3,16}$").unwrap(),
+            AttributeDefinition::parse("company optional -").unwrap(),
+        ];
+
+        let mut attributes = HashMap::new();
+        attributes.insert("nickname".to_string(), "dummy".to_string());
+        attributes.insert("company".to_string(), "".to_string());
+
+        let mut user = new_user();
+        user.set_attributes(&schema, &attributes).unwrap();
+        assert_eq!(1, user.get_attributes().len());
+        assert_eq!(Some(&"dummy".to_string()), user.get_attributes().get("nickname"));
+
+        let claims = user.get_claims(&schema);
+        assert_eq!(1, claims.len());
+        assert_eq!(Some(&"dummy".to_string()), claims.get("nick"));
+    }
+
+    #[test]
+    fn user_get_missing_attributes_should_not_fail() {
+        let schema = vec![
+            AttributeDefinition::parse("nickname required nick").unwrap(),
+            AttributeDefinition::parse("company optional -").unwrap(),
+            AttributeDefinition::parse("phone login -").unwrap(),
+        ];
+
+        let mut attributes = HashMap::new();
+        attributes.insert("nickname".to_string(), "dummy".to_string());
+
+        let mut user = new_user();
+        user.set_attributes(&schema, &attributes).unwrap(); // attributes required on login are not by the signup
+        assert_eq!(vec!["phone".to_string()], user.get_missing_attributes(&schema));
+
+        attributes.insert("phone".to_string(), "123456789".to_string());
+        user.set_attributes(&schema, &attributes).unwrap();
+        assert!(user.get_missing_attributes(&schema).is_empty());
+    }
+
+    #[test]
+    fn user_set_attributes_should_fail() {
+        let schema = vec![
+            AttributeDefinition::parse("nickname required nick ^[a-z]{3,16}$").unwrap(),
+        ];
+
+        let mut user = new_user();
+        let mut attributes = HashMap::new();
+        assert!(user.set_attributes(&schema, &attributes).is_err()); // missing required attribute
+
+        attributes.insert("nickname".to_string(), "NOT_VALID".to_string());
+        assert!(user.set_attributes(&schema, &attributes).is_err()); // pattern does not match
+
+        attributes.insert("nickname".to_string(), "dummy".to_string());
+        attributes.insert("unknown".to_string(), "dummy".to_string());
+        assert!(user.set_attributes(&schema, &attributes).is_err()); // undeclared attribute
+        assert_eq!(0, user.get_attributes().len());
+    }
+
     #[test]
     fn user_match_password_should_fail() {
         let user = new_user();
         assert!(!user.match_password("TESTER"));
     }
 
+    #[test]
+    fn match_no_password_should_hash_as_match_password() {
+        let user = new_user();
+        let peppered = |matches: &dyn Fn() -> bool| {
+            let before = PEPPERED.with(|peppered| peppered.get());
+            assert!(!matches());
+            PEPPERED.with(|peppered| peppered.get()) - before
+        };
+
+        // whatever the peppers the keyring resolves
+        assert_eq!(peppered(&|| user.match_password("TESTER")), peppered(&|| match_no_password("TESTER")));
+
+        // a pepper rotation in progress, so the previous digest has to be computed as well. The previous pepper is
+        // told explicitly, so the one the other tests resolve through the keyring is left untouched
+        let existing = peppered(&|| match_digest_peppered("TESTER", &user.password, Some("previous")));
+        let missing = peppered(&|| match_digest_peppered("TESTER", "", Some("previous")));
+
+        assert!(existing > 0);
+        assert_eq!(existing, missing);
+    }
+
     #[test]
     fn user_token_should_not_fail() {
         let user = new_user();
@@ -264,4 +1277,182 @@ pub mod tests {
         sleep(Duration::from_secs(1));
         assert!(security::decode_jwt::<Token>(&token).is_err());
     }
+
+    #[test]
+    fn user_require_reset_should_not_fail() {
+        let mut user = new_user();
+        assert!(!user.is_reset_required());
+
+        let before = SystemTime::now();
+        user.require_reset();
+        let after = SystemTime::now();
+
+        assert!(user.is_reset_required());
+        let time = user.reset_required_at.unwrap();
+        assert!(time >= before && time <= after);
+    }
+
+    #[test]
+    fn user_reset_password_should_not_fail() {
+        const PWD: &str = "0123456789ABCDEF";
+
+        let mut user = new_user();
+        user.require_reset();
+        user.reset_password(PWD).unwrap();
+
+        assert!(!user.is_reset_required());
+        assert!(user.match_password(PWD));
+    }
+
+    #[test]
+    fn user_reset_wrong_password_should_fail() {
+        let mut user = new_user();
+        user.require_reset();
+
+        assert!(user.reset_password("PASSWORD#").is_err());
+        assert!(user.is_reset_required());
+    }
+
+    #[test]
+    fn user_reset_token_should_not_fail() {
+        let user = new_user();
+        let timeout = Duration::from_secs(60);
+
+        let before = SystemTime::now();
+        let claim = ResetToken::new(&user, timeout);
+        let after = SystemTime::now();
+
+        assert!(claim.iat >= before && claim.iat <= after);
+        assert!(claim.exp >= unix_timestamp(before + timeout));
+        assert!(claim.exp <= unix_timestamp(after + timeout));
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!(user.id, claim.sub);
+        assert!(claim.reset);
+    }
+
+    #[test]
+    fn user_activate_should_not_fail() {
+        const PWD: &str = "0123456789ABCDEF";
+
+        let mut user = new_user();
+        user.set_pending(SystemTime::now() + Duration::from_secs(60));
+        assert!(user.is_pending());
+
+        user.activate(PWD).unwrap();
+        assert!(!user.is_pending());
+        assert!(user.is_verified());
+        assert!(user.match_password(PWD));
+    }
+
+    #[test]
+    fn user_activate_should_fail() {
+        const PWD: &str = "0123456789ABCDEF";
+
+        let mut user = new_user();
+        assert!(user.activate(PWD).is_err());
+
+        user.set_pending(SystemTime::now() - Duration::from_secs(1));
+        assert!(user.activate(PWD).is_err());
+        assert!(user.is_pending());
+        assert!(!user.match_password(PWD));
+    }
+
+    #[test]
+    fn user_activation_token_should_not_fail() {
+        let user = new_user();
+        let deadline = SystemTime::now() + Duration::from_secs(60);
+
+        let claim = ActivationToken::new(&user, deadline, true);
+        assert_eq!(unix_timestamp(deadline), claim.exp);
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!(user.id, claim.sub);
+        assert!(claim.mfa);
+    }
+
+    #[test]
+    fn user_set_locale_should_not_fail() {
+        let mut user = new_user();
+        user.set_locale("es_mx").unwrap();
+        assert_eq!(Some("es-MX"), user.get_locale());
+
+        user.set_locale("").unwrap();
+        assert_eq!(None, user.get_locale());
+    }
+
+    #[test]
+    fn user_set_locale_should_fail() {
+        let mut user = new_user();
+        assert!(user.set_locale("xx").is_err());
+        assert!(user.set_locale("not a locale").is_err());
+        assert_eq!(None, user.get_locale());
+    }
+
+    #[test]
+    fn user_set_username_should_not_fail() {
+        let mut user = new_user();
+        user.set_username("Alice");
+        assert_eq!(Some("Alice"), user.get_username());
+
+        user.set_username("");
+        assert_eq!(None, user.get_username());
+    }
+
+    #[test]
+    fn normalize_phone_should_not_fail() {
+        assert_eq!("+34600123456", normalize_phone("+34600123456").unwrap());
+        assert_eq!("+34600123456", normalize_phone("+34 600 12 34 56").unwrap());
+        assert_eq!("+34600123456", normalize_phone("0034 600-12.34.56").unwrap());
+        assert_eq!("+14155550123", normalize_phone("+1 (415) 555-0123").unwrap());
+    }
+
+    #[test]
+    fn normalize_phone_should_fail() {
+        assert!(normalize_phone("").is_err());
+        assert!(normalize_phone("600123456").is_err(), "the country code must be required");
+        assert!(normalize_phone("+0600123456").is_err());
+        assert!(normalize_phone("+3460012345678901").is_err());
+        assert!(normalize_phone("+34 600 abc 456").is_err());
+    }
+
+    #[test]
+    fn login_identifier_parse_all_should_not_fail() {
+        for ident in &[LoginIdentifier::Email, LoginIdentifier::Phone] {
+            assert_eq!(Some(*ident), LoginIdentifier::from_str(ident.as_str()));
+        }
+
+        let idents = LoginIdentifier::parse_all("email, phone,email");
+        assert_eq!(vec![LoginIdentifier::Email, LoginIdentifier::Phone], idents);
+        assert_eq!(vec![LoginIdentifier::Phone], LoginIdentifier::parse_all("phone,username"));
+        assert!(LoginIdentifier::parse_all("").is_empty());
+    }
+
+    #[test]
+    fn user_verify_phone_should_not_fail() {
+        let mut user = new_user();
+        user.set_phone("+34 600 12 34 56", "123456", Duration::from_secs(60)).unwrap();
+        assert_eq!(Some("+34600123456"), user.get_phone());
+        assert!(!user.is_phone_verified());
+
+        user.verify_phone("123456").unwrap();
+        assert!(user.is_phone_verified());
+        assert!(user.verify_phone("123456").is_err(), "codes must be confirmed once only");
+
+        user.set_phone("", "", Duration::from_secs(60)).unwrap();
+        assert_eq!(None, user.get_phone());
+        assert!(!user.is_phone_verified());
+    }
+
+    #[test]
+    fn user_verify_phone_should_fail() {
+        let mut user = new_user();
+        assert!(user.verify_phone("123456").is_err());
+        assert!(user.set_phone("600123456", "123456", Duration::from_secs(60)).is_err());
+
+        user.set_phone("+34600123456", "123456", Duration::from_secs(60)).unwrap();
+        assert!(user.verify_phone("654321").is_err());
+
+        user.phone_code_until = Some(SystemTime::now() - Duration::from_secs(1));
+        assert!(user.verify_phone("123456").is_err(), "expired codes must not be confirmed");
+        assert!(!user.is_phone_verified());
+    }
 }
\ No newline at end of file
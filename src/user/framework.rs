@@ -1,13 +1,23 @@
 use std::error::Error;
 use std::time::SystemTime;
+use std::collections::HashMap;
 use tonic::{Request, Response, Status};
 use diesel::NotFound;
 use diesel::result::Error as PgError;
 
+use crate::logging;
+use crate::constants::errors;
 use crate::diesel::prelude::*;
 use crate::postgres::*;
+use crate::memory;
 use crate::schema::users;
 use crate::schema::users::dsl::*;
+use crate::schema::emails;
+use crate::schema::attributes;
+use crate::time::unix_timestamp;
+use crate::pagination::Page;
+use crate::audit::framework::get_filter as get_audit_filter;
+use crate::pii;
 use crate::metadata::{
     get_repository as get_meta_repository,
     framework::PostgresMetadataRepository,
@@ -17,6 +27,13 @@ use crate::secret::{
     framework::PostgresSecretRepository,
 };
 
+use crate::apikey::framework::ApiKeyIdentity;
+use crate::tenant::framework::get_tenant;
+use crate::ratelimit::framework::rate_limit;
+use crate::detection::framework::get_origin;
+
+use crate::firewall::framework::ip_filter;
+use crate::username::domain::normalize_username;
 use super::domain::{User, UserRepository};
 use super::application::TfaActions;
 
@@ -30,56 +47,555 @@ use proto::user_service_server::UserService;
 pub use proto::user_service_server::UserServiceServer;
 
 // Proto message structs
-use proto::{SignupRequest, DeleteRequest, TfaRequest, TfaResponse};
+use proto::{SignupRequest, DeleteRequest, TfaRequest, TfaResponse, SuspendRequest, RestoreRequest};
+use proto::{HistoryRequest, HistoryResponse, Event as ProtoEvent, EmailRequest, UserInfoResponse, UpgradeResponse};
+use proto::{ResetRequest, LocaleRequest, Consent, ConsentList, ConsentRequest, PhoneRequest, UsernameRequest};
+use proto::{ActivationRequest, ActivationResponse};
+
+pub struct UserServiceImplementation;
+
+#[tonic::async_trait]
+impl UserService for UserServiceImplementation {
+    async fn signup(&self, request: Request<SignupRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "user.signup", Some(&request.get_ref().email))?;
+        let tenant = get_tenant(&request)?;
+        let origin = get_origin(&request);
+        let msg_ref = request.into_inner();
+
+        match super::application::user_signup(&tenant,
+                                              &msg_ref.email,
+                                              &msg_ref.pwd,
+                                              msg_ref.terms,
+                                              msg_ref.privacy,
+                                              &msg_ref.invitation,
+                                              &msg_ref.attributes,
+                                              &msg_ref.phone,
+                                              &msg_ref.username,
+                                              &msg_ref.captcha,
+                                              &origin) {
+
+            Err(err) if err.to_string() == errors::OVERLOADED => Err(Status::resource_exhausted(errors::OVERLOADED)),
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(_) => Ok(Response::new(())),
+        }
+    }
+
+    async fn upgrade_guest(&self, request: Request<SignupRequest>) -> Result<Response<UpgradeResponse>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let origin = get_origin(&request);
+        let msg_ref = request.into_inner();
+        match super::application::user_upgrade_guest(&token,
+                                                     &msg_ref.email,
+                                                     &msg_ref.pwd,
+                                                     msg_ref.terms,
+                                                     msg_ref.privacy,
+                                                     &msg_ref.invitation,
+                                                     &msg_ref.attributes,
+                                                     &msg_ref.phone,
+                                                     &msg_ref.username,
+                                                     &msg_ref.captcha,
+                                                     &origin) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(token) => Ok(Response::new(
+                UpgradeResponse{
+                    token: token,
+                }
+            )),
+        }
+    }
+
+    async fn verify(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        if let Err(err) = super::application::user_verify(token){               
+            return Err(Status::aborted(err.to_string()));
+        }
+
+        Ok(Response::new(()))
+    }
+
+    async fn delete(&self, request: Request<DeleteRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        let tenant = get_tenant(&request)?;
+        let msg_ref = request.into_inner();
+
+        match super::application::user_delete(&tenant,
+                                              &msg_ref.ident,
+                                              &msg_ref.pwd,
+                                              &msg_ref.totp) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn tfa(&self, request: Request<TfaRequest>) -> Result<Response<TfaResponse>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        let action = match msg_ref.action {
+            0 => TfaActions::ENABLE,
+            1 => TfaActions::DISABLE,
+            _ => return Err(Status::invalid_argument("wrong action")),
+        };
+
+        match super::application::user_two_factor_authenticator(&token,
+                                                                &msg_ref.pwd,
+                                                                &msg_ref.totp,
+                                                                action) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(uri) => Ok(Response::new(
+                TfaResponse{
+                    uri: uri,
+                }
+            )),
+        }
+    }
+
+    async fn suspend_user(&self, request: Request<SuspendRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_suspend(&token,
+                                               &msg_ref.ident,
+                                               &msg_ref.reason) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn reinstate_user(&self, request: Request<SuspendRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_reinstate(&token,
+                                                 &msg_ref.ident,
+                                                 &msg_ref.reason) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn restore_user(&self, request: Request<RestoreRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        ip_filter(&request, "admin")?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_restore(&token,
+                                               &msg_ref.ident,
+                                               &msg_ref.reason) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn get_login_history(&self, request: Request<HistoryRequest>) -> Result<Response<HistoryResponse>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        if msg_ref.page > 0 {
+            // offsets are no longer supported, since pages got skewed by the events recorded in the meantime
+            return Err(Status::invalid_argument(errors::INVALID_PAGE_TOKEN));
+        }
+
+        let page = match Page::new("history", msg_ref.page_size, &msg_ref.page_token) {
+            Err(err) => return Err(Status::invalid_argument(err.to_string())),
+            Ok(page) => page,
+        };
+
+        let filter = get_audit_filter(&msg_ref.kinds, msg_ref.since, msg_ref.until)?;
+        match super::application::user_login_history(&token, &filter, &page) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((events, next_page_token)) => Ok(Response::new(
+                HistoryResponse{
+                    events: events.iter().map(|event| ProtoEvent{
+                        kind: event.get_kind().as_str().to_string(),
+                        reason: event.get_reason().to_string(),
+                        issuer: event.get_issuer(),
+                        created_at: unix_timestamp(event.get_created_at()) as u64,
+                    }).collect(),
+                    next_page_token: next_page_token,
+                }
+            )),
+        }
+    }
+
+    async fn change_email(&self, request: Request<EmailRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_change_email(&token,
+                                                    &msg_ref.email,
+                                                    &msg_ref.pwd,
+                                                    &msg_ref.totp) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn confirm_email(&self, request: Request<()>) -> Result<Response<()>, Status> {
+        let metadata = request.metadata();
+        if let None = metadata.get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match metadata.get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token,
+        };
+
+        if let Err(err) = super::application::user_confirm_email(token){               
+            return Err(Status::aborted(err.to_string()));
+        }
+
+        Ok(Response::new(()))
+    }
+
+    async fn add_email(&self, request: Request<EmailRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_add_email(&token,
+                                                 &msg_ref.email,
+                                                 &msg_ref.pwd,
+                                                 &msg_ref.totp) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn remove_email(&self, request: Request<EmailRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_remove_email(&token,
+                                                    &msg_ref.email,
+                                                    &msg_ref.pwd,
+                                                    &msg_ref.totp) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn set_primary_email(&self, request: Request<EmailRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_set_primary_email(&token,
+                                                         &msg_ref.email,
+                                                         &msg_ref.pwd,
+                                                         &msg_ref.totp) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn set_phone(&self, request: Request<PhoneRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "user.set_phone", None)?;
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_set_phone(&token,
+                                                 &msg_ref.phone,
+                                                 &msg_ref.pwd,
+                                                 &msg_ref.totp) {
+
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn verify_phone(&self, request: Request<PhoneRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        rate_limit(&request, "user.verify_phone", Some(&request.get_ref().phone))?;
+        let tenant = get_tenant(&request)?;
+        let msg_ref = request.into_inner();
+
+        match super::application::user_verify_phone(&tenant, &msg_ref.phone, &msg_ref.code) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn get_user_info(&self, request: Request<()>) -> Result<Response<UserInfoResponse>, Status> {
+        let result = if let Some(identity) = request.extensions().get::<ApiKeyIdentity>() {
+            super::application::user_info_by_id(identity.user)
+        } else {
+            let metadata = request.metadata();
+            if let None = metadata.get("token") {
+                return Err(Status::failed_precondition("token required"));
+            };
+
+            let token = match metadata.get("token")
+                .unwrap() // this line will not fail due to the previous check of None 
+                .to_str() {
+                Err(err) => return Err(Status::aborted(err.to_string())),
+                Ok(token) => token,
+            };
+
+            super::application::user_info(token)
+        };
+
+        match result {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok((user, claims)) => Ok(Response::new(
+                UserInfoResponse{
+                    id: user.get_id(),
+                    email: user.get_email().to_string(),
+                    claims: claims,
+                    locale: user.get_locale().unwrap_or_default().to_string(),
+                    phone: user.get_phone().unwrap_or_default().to_string(),
+                    phone_verified: user.is_phone_verified(),
+                    username: user.get_username().unwrap_or_default().to_string(),
+                }
+            )),
+        }
+    }
+
+    async fn reset_password(&self, request: Request<ResetRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_reset_password(&token, &msg_ref.pwd) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(()) => Ok(Response::new(())),
+        }
+    }
+
+    async fn set_locale(&self, request: Request<LocaleRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
+
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
+
+        let msg_ref = request.into_inner();
+        match super::application::user_set_locale(&token, &msg_ref.locale) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(_) => Ok(Response::new(())),
+        }
+    }
+
+    async fn set_username(&self, request: Request<UsernameRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
 
-pub struct UserServiceImplementation;
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
 
-#[tonic::async_trait]
-impl UserService for UserServiceImplementation {
-    async fn signup(&self, request: Request<SignupRequest>) -> Result<Response<()>, Status> {
         let msg_ref = request.into_inner();
-
-        match super::application::user_signup(&msg_ref.email,
-                                              &msg_ref.pwd) {
-
+        match super::application::user_set_username(&token, &msg_ref.username) {
             Err(err) => Err(Status::aborted(err.to_string())),
             Ok(_) => Ok(Response::new(())),
         }
     }
 
-    async fn verify(&self, request: Request<()>) -> Result<Response<()>, Status> {
-        let metadata = request.metadata();
-        if let None = metadata.get("token") {
+    async fn activate_account(&self,
+                              request: Request<ActivationRequest>) -> Result<Response<ActivationResponse>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
             return Err(Status::failed_precondition("token required"));
         };
 
-        let token = match metadata.get("token")
+        let token = match request.metadata().get("token")
             .unwrap() // this line will not fail due to the previous check of None 
             .to_str() {
             Err(err) => return Err(Status::aborted(err.to_string())),
-            Ok(token) => token,
+            Ok(token) => token.to_string(),
         };
 
-        if let Err(err) = super::application::user_verify(token){               
-            return Err(Status::aborted(err.to_string()));
+        let msg_ref = request.into_inner();
+        match super::application::user_activate(&token, &msg_ref.pwd, &msg_ref.totp) {
+            Err(err) => Err(Status::aborted(err.to_string())),
+            Ok(secret) => Ok(Response::new(ActivationResponse{secret: secret})),
         }
-
-        Ok(Response::new(()))
     }
 
-    async fn delete(&self, request: Request<DeleteRequest>) -> Result<Response<()>, Status> {
-        let msg_ref = request.into_inner();
+    async fn list_consents(&self, request: Request<()>) -> Result<Response<ConsentList>, Status> {
+        logging::dump(request.get_ref());
+        if let None = request.metadata().get("token") {
+            return Err(Status::failed_precondition("token required"));
+        };
 
-        match super::application::user_delete(&msg_ref.ident,
-                                              &msg_ref.pwd,
-                                              &msg_ref.totp) {
+        let token = match request.metadata().get("token")
+            .unwrap() // this line will not fail due to the previous check of None 
+            .to_str() {
+            Err(err) => return Err(Status::aborted(err.to_string())),
+            Ok(token) => token.to_string(),
+        };
 
+        match super::application::user_list_consents(&token) {
             Err(err) => Err(Status::aborted(err.to_string())),
-            Ok(()) => Ok(Response::new(())),
+            Ok(consents) => Ok(Response::new(
+                ConsentList{
+                    consents: consents.iter().map(|(app, dir)| Consent{
+                        app: app.get_url().to_string(),
+                        granted_at: unix_timestamp(dir.get_created_at()) as u64,
+                        used_at: unix_timestamp(dir.get_touch_at()) as u64,
+                    }).collect(),
+                }
+            )),
         }
     }
 
-    async fn tfa(&self, request: Request<TfaRequest>) -> Result<Response<TfaResponse>, Status> {
+    async fn revoke_consent(&self, request: Request<ConsentRequest>) -> Result<Response<()>, Status> {
+        logging::dump(request.get_ref());
         if let None = request.metadata().get("token") {
             return Err(Status::failed_precondition("token required"));
         };
@@ -92,22 +608,9 @@ impl UserService for UserServiceImplementation {
         };
 
         let msg_ref = request.into_inner();
-        let action = match msg_ref.action {
-            0 => TfaActions::ENABLE,
-            1 => TfaActions::DISABLE,
-            _ => return Err(Status::invalid_argument("wrong action")),
-        };
-
-        match super::application::user_two_factor_authenticator(&token,
-                                                                &msg_ref.pwd,
-                                                                &msg_ref.totp,
-                                                                action) {
+        match super::application::user_revoke_consent(&token, &msg_ref.app) {
             Err(err) => Err(Status::aborted(err.to_string())),
-            Ok(uri) => Ok(Response::new(
-                TfaResponse{
-                    uri: uri,
-                }
-            )),
+            Ok(_) => Ok(Response::new(())),
         }
     }
 }
@@ -125,6 +628,27 @@ struct PostgresUser {
     pub verified_at: Option<SystemTime>,
     pub secret_id: Option<i32>,
     pub meta_id: i32,
+    pub suspended_at: Option<SystemTime>,
+    pub admin: bool,
+    pub deleted_at: Option<SystemTime>,
+    pub terms_version: i32,
+    pub privacy_version: i32,
+    pub recovery_email: Option<String>,
+    pub recovery_until: Option<SystemTime>,
+    pub reset_required_at: Option<SystemTime>,
+    pub tenant_id: i32,
+    pub email_hash: Option<String>,
+    pub locale: Option<String>,
+    pub terms_accepted_at: Option<SystemTime>,
+    pub privacy_accepted_at: Option<SystemTime>,
+    pub phone: Option<String>,
+    pub phone_hash: Option<String>,
+    pub phone_verified_at: Option<SystemTime>,
+    pub phone_code: Option<String>,
+    pub phone_code_until: Option<SystemTime>,
+    pub username: Option<String>,
+    pub username_hash: Option<String>,
+    pub activation_deadline: Option<SystemTime>,
 }
 
 #[derive(Insertable)]
@@ -136,21 +660,116 @@ struct NewPostgresUser<'a> {
     pub verified_at: Option<SystemTime>,
     pub secret_id: Option<i32>,
     pub meta_id: i32,
+    pub admin: bool,
+    pub terms_version: i32,
+    pub privacy_version: i32,
+    pub tenant_id: i32,
+    pub email_hash: Option<&'a str>,
+    pub locale: Option<&'a str>,
+    pub terms_accepted_at: Option<SystemTime>,
+    pub privacy_accepted_at: Option<SystemTime>,
+    pub phone: Option<&'a str>,
+    pub phone_hash: Option<&'a str>,
+    pub phone_verified_at: Option<SystemTime>,
+    pub phone_code: Option<&'a str>,
+    pub phone_code_until: Option<SystemTime>,
+    pub username: Option<&'a str>,
+    pub username_hash: Option<&'a str>,
+    pub activation_deadline: Option<SystemTime>,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "emails"]
+struct NewPostgresEmail<'a> {
+    pub user_id: i32,
+    pub email: &'a str,
+    pub email_hash: Option<&'a str>,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "attributes"]
+struct NewPostgresAttribute<'a> {
+    pub user_id: i32,
+    pub name: &'a str,
+    pub value: &'a str,
+}
+
+/// Personal data of a user as it is kept at rest: encrypted, as well as the blind index of each email, the phone and
+/// the username so the user can still be found by them
+struct SealedUser {
+    email: String,
+    email_hash: String,
+    recovery_email: Option<String>,
+    phone: Option<(String, String)>,
+    username: Option<(String, String)>, // indexed as normalized, so it is unique regardless of its case
+    aliases: Vec<(String, String)>,
+    attributes: Vec<(String, String)>,
+}
+
+impl SealedUser {
+    fn new(user: &User) -> Result<Self, Box<dyn Error>> {
+        let mut aliases = Vec::new();
+        for alias in user.aliases.iter() {
+            aliases.push((pii::encrypt(alias)?, pii::blind_index(alias)?));
+        }
+
+        let mut attrs = Vec::new();
+        for (attr_name, attr_value) in user.attributes.iter() {
+            attrs.push((attr_name.clone(), pii::encrypt(attr_value)?));
+        }
+
+        Ok(SealedUser {
+            email: pii::encrypt(&user.email)?,
+            email_hash: pii::blind_index(&user.email)?,
+            recovery_email: match &user.recovery_email {
+                Some(recovery) => Some(pii::encrypt(recovery)?),
+                None => None,
+            },
+            phone: match &user.phone {
+                Some(number) => Some((pii::encrypt(number)?, pii::blind_index(number)?)),
+                None => None,
+            },
+            username: match &user.username {
+                Some(handle) => Some((pii::encrypt(handle)?, pii::blind_index(&normalize_username(handle))?)),
+                None => None,
+            },
+            aliases: aliases,
+            attributes: attrs,
+        })
+    }
 }
 
 pub struct PostgresUserRepository;
 
 impl PostgresUserRepository {
-    fn create_on_conn(conn: &PgConnection, user: &mut User) -> Result<(), PgError>  {
+    fn create_on_conn(conn: &PgConnection, user: &mut User, sealed: &SealedUser) -> Result<(), PgError>  {
          // in order to create a user it must exists the metadata for this user
          PostgresMetadataRepository::create_on_conn(conn, &mut user.meta)?;
 
         let new_user = NewPostgresUser {
-            email: &user.email,
+            email: &sealed.email,
             password: &user.password,
             verified_at: user.verified_at,
             secret_id: if let Some(secret) = &user.secret {Some(secret.get_id())} else {None},
             meta_id: user.meta.get_id(),
+            admin: user.admin,
+            terms_version: user.terms_version,
+            privacy_version: user.privacy_version,
+            tenant_id: user.tenant,
+            email_hash: Some(&sealed.email_hash),
+            locale: user.locale.as_deref(),
+            terms_accepted_at: user.terms_accepted_at,
+            privacy_accepted_at: user.privacy_accepted_at,
+            phone: sealed.phone.as_ref().map(|(phone, _)| phone.as_str()),
+            phone_hash: sealed.phone.as_ref().map(|(_, phone_hash)| phone_hash.as_str()),
+            phone_verified_at: user.phone_verified_at,
+            phone_code: user.phone_code.as_deref(),
+            phone_code_until: user.phone_code_until,
+            username: sealed.username.as_ref().map(|(handle, _)| handle.as_str()),
+            username_hash: sealed.username.as_ref().map(|(_, handle_hash)| handle_hash.as_str()),
+            activation_deadline: user.activation_deadline,
         };
 
         let result = diesel::insert_into(users::table)
@@ -158,10 +777,64 @@ impl PostgresUserRepository {
             .get_result::<PostgresUser>(conn)?;
 
         user.id = result.id;
+        PostgresUserRepository::save_aliases_on_conn(conn, user, sealed)?;
+        PostgresUserRepository::save_attributes_on_conn(conn, user, sealed)?;
+        Ok(())
+    }
+
+    fn save_aliases_on_conn(conn: &PgConnection, user: &User, sealed: &SealedUser) -> Result<(), PgError>  {
+        diesel::delete(
+            emails::table.filter(emails::user_id.eq(user.id))
+        ).execute(conn)?;
+
+        let new_emails: Vec<NewPostgresEmail> = sealed.aliases.iter()
+            .map(|(alias, alias_hash)| NewPostgresEmail {
+                user_id: user.id,
+                email: alias,
+                email_hash: Some(alias_hash),
+            })
+            .collect();
+
+        if new_emails.len() > 0 {
+            diesel::insert_into(emails::table)
+                .values(&new_emails)
+                .execute(conn)?;
+        }
+
+        Ok(())
+    }
+
+    fn save_attributes_on_conn(conn: &PgConnection, user: &User, sealed: &SealedUser) -> Result<(), PgError>  {
+        diesel::delete(
+            attributes::table.filter(attributes::user_id.eq(user.id))
+        ).execute(conn)?;
+
+        let new_attributes: Vec<NewPostgresAttribute> = sealed.attributes.iter()
+            .map(|(attr_name, attr_value)| NewPostgresAttribute {
+                user_id: user.id,
+                name: attr_name,
+                value: attr_value,
+            })
+            .collect();
+
+        if new_attributes.len() > 0 {
+            diesel::insert_into(attributes::table)
+                .values(&new_attributes)
+                .execute(conn)?;
+        }
+
         Ok(())
     }
 
     fn delete_on_conn(conn: &PgConnection, user: &User) -> Result<(), PgError>  {
+        diesel::delete(
+            emails::table.filter(emails::user_id.eq(user.id))
+        ).execute(conn)?;
+
+        diesel::delete(
+            attributes::table.filter(attributes::user_id.eq(user.id))
+        ).execute(conn)?;
+
         let _result = diesel::delete(
             users.filter(id.eq(user.id))
         ).execute(conn)?;
@@ -175,34 +848,103 @@ impl PostgresUserRepository {
         Ok(())
    }
 
-    fn build_first(results: &[PostgresUser]) -> Result<User, Box<dyn Error>> {
-        if results.len() == 0 {
-            return Err(Box::new(NotFound));
-        }
-
+    fn build(result: &PostgresUser) -> Result<User, Box<dyn Error>> {
         let mut secret_opt = None;
-        if let Some(secr_id) = results[0].secret_id {
+        if let Some(secr_id) = result.secret_id {
             let secret = get_secret_repository().find(secr_id)?;
             secret_opt = Some(secret);
         }
 
-        let meta = get_meta_repository().find(results[0].meta_id)?;
+        let meta = get_meta_repository().find(result.meta_id)?;
+        let aliases = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            emails::table.filter(emails::user_id.eq(result.id))
+                         .select(emails::email)
+                         .load::<String>(&connection)?
+        };
+
+        let attrs = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            attributes::table.filter(attributes::user_id.eq(result.id))
+                             .select((attributes::name, attributes::value))
+                             .load::<(String, String)>(&connection)?
+        };
+
+        let mut plain_aliases = Vec::new();
+        for alias in aliases.iter() {
+            plain_aliases.push(pii::decrypt(alias)?);
+        }
+
+        let mut plain_attrs = HashMap::new();
+        for (attr_name, attr_value) in attrs.into_iter() {
+            plain_attrs.insert(attr_name, pii::decrypt(&attr_value)?);
+        }
 
         Ok(User{
-            id: results[0].id,
-            email: results[0].email.clone(),
-            password: results[0].password.clone(),
-            verified_at: results[0].verified_at,
+            id: result.id,
+            email: pii::decrypt(&result.email)?,
+            password: result.password.clone(),
+            verified_at: result.verified_at,
             secret: secret_opt,
             meta: meta,
+            suspended_at: result.suspended_at,
+            admin: result.admin,
+            deleted_at: result.deleted_at,
+            terms_version: result.terms_version,
+            privacy_version: result.privacy_version,
+            terms_accepted_at: result.terms_accepted_at,
+            privacy_accepted_at: result.privacy_accepted_at,
+            recovery_email: match &result.recovery_email {
+                Some(recovery) => Some(pii::decrypt(recovery)?),
+                None => None,
+            },
+            recovery_until: result.recovery_until,
+            aliases: plain_aliases,
+            attributes: plain_attrs,
+            reset_required_at: result.reset_required_at,
+            locale: result.locale.clone(),
+            tenant: result.tenant_id,
+            phone: match &result.phone {
+                Some(number) => Some(pii::decrypt(number)?),
+                None => None,
+            },
+            phone_verified_at: result.phone_verified_at,
+            phone_code: result.phone_code.clone(),
+            phone_code_until: result.phone_code_until,
+            username: match &result.username {
+                Some(handle) => Some(pii::decrypt(handle)?),
+                None => None,
+            },
+            activation_deadline: result.activation_deadline,
         })
     }
+
+    fn build_first(results: &[PostgresUser]) -> Result<User, Box<dyn Error>> {
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresUserRepository::build(&results[0])
+    }
 }
 
 impl UserRepository for PostgresUserRepository {
     fn find(&self, target: i32) -> Result<User, Box<dyn Error>>  {
         use crate::schema::users::dsl::*;
         
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            users.filter(id.eq(target))
+                 .filter(deleted_at.is_null())
+                 .load::<PostgresUser>(&connection)?
+        };
+    
+        PostgresUserRepository::build_first(&results)
+    }
+
+    fn find_any(&self, target: i32) -> Result<User, Box<dyn Error>>  {
+        use crate::schema::users::dsl::*;
+        
         let results = { // block is required because of connection release
             let connection = get_connection().get()?;
             users.filter(id.eq(target))
@@ -212,39 +954,192 @@ impl UserRepository for PostgresUserRepository {
         PostgresUserRepository::build_first(&results)
     }
     
-    fn find_by_email(&self, target: &str) -> Result<User, Box<dyn Error>>  {
+    fn find_by_email(&self, target_tenant: i32, target: &str) -> Result<User, Box<dyn Error>>  {
+        use crate::schema::users::dsl::*;
+        
+        // users kept before encryption got enabled have no blind index yet
+        let target_hash = pii::blind_index(target)?;
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            users.filter(tenant_id.eq(target_tenant))
+                 .filter(email_hash.eq(target_hash.as_str()).or(email.eq(target)))
+                 .filter(deleted_at.is_null())
+                 .load::<PostgresUser>(&connection)?
+        };
+
+        if results.len() > 0 {
+            return PostgresUserRepository::build_first(&results);
+        }
+
+        // the target may be an alias rather than the primary email
+        let owners = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            emails::table.inner_join(users)
+                         .filter(tenant_id.eq(target_tenant))
+                         .filter(emails::email_hash.eq(target_hash.as_str()).or(emails::email.eq(target)))
+                         .select(emails::user_id)
+                         .load::<i32>(&connection)?
+        };
+
+        if owners.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        self.find(owners[0])
+    }
+
+    fn find_deleted_by_email(&self, target_tenant: i32, target: &str) -> Result<User, Box<dyn Error>>  {
         use crate::schema::users::dsl::*;
         
+        let target_hash = pii::blind_index(target)?;
         let results = { // block is required because of connection release
             let connection = get_connection().get()?;
-            users.filter(email.eq(target))
+            users.filter(tenant_id.eq(target_tenant))
+                 .filter(email_hash.eq(target_hash.as_str()).or(email.eq(target)))
+                 .filter(deleted_at.is_not_null())
                  .load::<PostgresUser>(&connection)?
         };
     
         PostgresUserRepository::build_first(&results)
     }
 
+    fn find_all_deleted_before(&self, deadline: SystemTime) -> Result<Vec<User>, Box<dyn Error>>  {
+        use crate::schema::users::dsl::*;
+        
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            users.filter(deleted_at.lt(deadline))
+                 .load::<PostgresUser>(&connection)?
+        };
+
+        let mut deleted = Vec::new();
+        for result in results.iter() {
+            deleted.push(PostgresUserRepository::build(result)?);
+        }
+
+        Ok(deleted)
+    }
+
+    fn find_all_pending_before(&self, deadline: SystemTime) -> Result<Vec<User>, Box<dyn Error>>  {
+        use crate::schema::users::dsl::*;
+        
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            users.filter(activation_deadline.lt(deadline))
+                 .filter(deleted_at.is_null())
+                 .load::<PostgresUser>(&connection)?
+        };
+
+        let mut pending = Vec::new();
+        for result in results.iter() {
+            pending.push(PostgresUserRepository::build(result)?);
+        }
+
+        Ok(pending)
+    }
+
+    fn find_all(&self) -> Result<Vec<User>, Box<dyn Error>>  {
+        use crate::schema::users::dsl::*;
+        
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            users.order(id.asc())
+                 .load::<PostgresUser>(&connection)?
+        };
+
+        let mut all_users = Vec::new();
+        for result in results.iter() {
+            all_users.push(PostgresUserRepository::build(result)?);
+        }
+
+        Ok(all_users)
+    }
+
+    fn find_all_by_phone(&self, target_tenant: i32, target: &str) -> Result<Vec<User>, Box<dyn Error>>  {
+        use crate::schema::users::dsl::*;
+
+        let target_hash = pii::blind_index(target)?;
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            users.filter(tenant_id.eq(target_tenant))
+                 .filter(phone_hash.eq(target_hash.as_str()))
+                 .filter(deleted_at.is_null())
+                 .order(id.asc())
+                 .load::<PostgresUser>(&connection)?
+        };
+
+        let mut owners = Vec::new();
+        for result in results.iter() {
+            owners.push(PostgresUserRepository::build(result)?);
+        }
+
+        Ok(owners)
+    }
+
+    fn find_by_username(&self, target_tenant: i32, target: &str) -> Result<User, Box<dyn Error>>  {
+        use crate::schema::users::dsl::*;
+
+        let target_hash = pii::blind_index(&normalize_username(target))?;
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            users.filter(tenant_id.eq(target_tenant))
+                 .filter(username_hash.eq(target_hash.as_str()))
+                 .filter(deleted_at.is_null())
+                 .load::<PostgresUser>(&connection)?
+        };
+
+        PostgresUserRepository::build_first(&results)
+    }
+
     fn create(&self, user: &mut User) -> Result<(), Box<dyn Error>> {
+        let sealed = SealedUser::new(user)?;
         let conn = get_connection().get()?;
-        conn.transaction::<_, PgError, _>(|| PostgresUserRepository::create_on_conn(&conn, user))?;
+        conn.transaction::<_, PgError, _>(|| PostgresUserRepository::create_on_conn(&conn, user, &sealed))?;
         Ok(())
     }
 
     fn save(&self, user: &User) -> Result<(), Box<dyn Error>> {
+        let sealed = SealedUser::new(user)?;
         let pg_user = PostgresUser {
             id: user.id,
-            email: user.email.to_string(),
+            email: sealed.email.clone(),
             password: user.password.clone(),
             verified_at: user.verified_at,
             secret_id: if let Some(secret) = &user.secret {Some(secret.get_id())} else {None},
             meta_id: user.meta.get_id(),
+            suspended_at: user.suspended_at,
+            admin: user.admin,
+            deleted_at: user.deleted_at,
+            terms_version: user.terms_version,
+            privacy_version: user.privacy_version,
+            recovery_email: sealed.recovery_email.clone(),
+            recovery_until: user.recovery_until,
+            reset_required_at: user.reset_required_at,
+            tenant_id: user.tenant,
+            email_hash: Some(sealed.email_hash.clone()),
+            locale: user.locale.clone(),
+            terms_accepted_at: user.terms_accepted_at,
+            privacy_accepted_at: user.privacy_accepted_at,
+            phone: sealed.phone.as_ref().map(|(phone, _)| phone.clone()),
+            phone_hash: sealed.phone.as_ref().map(|(_, phone_hash)| phone_hash.clone()),
+            phone_verified_at: user.phone_verified_at,
+            phone_code: user.phone_code.clone(),
+            phone_code_until: user.phone_code_until,
+            username: sealed.username.as_ref().map(|(handle, _)| handle.clone()),
+            username_hash: sealed.username.as_ref().map(|(_, handle_hash)| handle_hash.clone()),
+            activation_deadline: user.activation_deadline,
         };
         
-        let connection = get_connection().get()?;
-        diesel::update(users)
-            .filter(id.eq(user.id))
-            .set(&pg_user)
-            .execute(&connection)?;
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| {
+            diesel::update(users)
+                .filter(id.eq(user.id))
+                .set(&pg_user)
+                .execute(&conn)?;
+
+            PostgresUserRepository::save_aliases_on_conn(&conn, user, &sealed)?;
+            PostgresUserRepository::save_attributes_on_conn(&conn, user, &sealed)
+        })?;
 
         Ok(())
     }
@@ -252,6 +1147,116 @@ impl UserRepository for PostgresUserRepository {
     fn delete(&self, user: &User) -> Result<(), Box<dyn Error>> {
         let conn = get_connection().get()?;
         conn.transaction::<_, PgError, _>(|| PostgresUserRepository::delete_on_conn(&conn, user))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryUserRepository {
+    table: memory::Table<User>,
+}
+
+impl InMemoryUserRepository {
+    pub fn new() -> Self {
+        InMemoryUserRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl UserRepository for InMemoryUserRepository {
+    fn find(&self, target: i32) -> Result<User, Box<dyn Error>>  {
+        let user = self.table.find(target)?;
+        if user.deleted_at.is_some() {
+            return Err(Box::new(NotFound));
+        }
+
+        Ok(user)
+    }
+
+    fn find_any(&self, target: i32) -> Result<User, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+    
+    fn find_by_email(&self, tenant: i32, target: &str) -> Result<User, Box<dyn Error>>  {
+        // the target may be an alias rather than the primary email
+        self.table.find_first(|user| {
+            user.tenant == tenant && user.deleted_at.is_none() &&
+            (user.email == target || user.aliases.iter().any(|alias| alias == target))
+        })
+    }
+
+    fn find_deleted_by_email(&self, tenant: i32, target: &str) -> Result<User, Box<dyn Error>>  {
+        self.table.find_first(|user| user.tenant == tenant && user.deleted_at.is_some() && user.email == target)
+    }
+
+    fn find_all(&self) -> Result<Vec<User>, Box<dyn Error>>  {
+        self.table.find_all(|_| true)
+    }
+
+    fn find_all_by_phone(&self, tenant: i32, target: &str) -> Result<Vec<User>, Box<dyn Error>>  {
+        self.table.find_all(|user| {
+            user.tenant == tenant && user.deleted_at.is_none() && user.phone.as_deref() == Some(target)
+        })
+    }
+
+    fn find_by_username(&self, tenant: i32, target: &str) -> Result<User, Box<dyn Error>>  {
+        let target = normalize_username(target);
+        self.table.find_first(|user| {
+            user.tenant == tenant && user.deleted_at.is_none() &&
+            user.username.as_deref().map(normalize_username).as_deref() == Some(target.as_str())
+        })
+    }
+
+    fn find_all_deleted_before(&self, deadline: SystemTime) -> Result<Vec<User>, Box<dyn Error>>  {
+        self.table.find_all(|user| {
+            match user.deleted_at {
+                Some(deleted_at) => deleted_at < deadline,
+                None => false,
+            }
+        })
+    }
+
+    fn find_all_pending_before(&self, deadline: SystemTime) -> Result<Vec<User>, Box<dyn Error>>  {
+        self.table.find_all(|user| {
+            match user.activation_deadline {
+                Some(activation_deadline) => user.deleted_at.is_none() && activation_deadline < deadline,
+                None => false,
+            }
+        })
+    }
+
+    fn create(&self, user: &mut User) -> Result<(), Box<dyn Error>> {
+        // in order to create a user it must exists the metadata for this user
+        get_meta_repository().create(&mut user.meta)?;
+        
+        // usernames are unique among the non deleted users only, as the partial index on postgres tells
+        let (target_tenant, target) = (user.tenant, user.email.clone());
+        let handle = user.username.as_deref().map(normalize_username);
+        let same_handle = move |existing: &User| {
+            handle.is_some() && existing.deleted_at.is_none() &&
+            existing.username.as_deref().map(normalize_username) == handle
+        };
+
+        self.table.insert(user,
+                          |existing| {
+                              existing.tenant == target_tenant && (existing.email == target || same_handle(existing))
+                          },
+                          |user, new_id| user.id = new_id)
+    }
+
+    fn save(&self, user: &User) -> Result<(), Box<dyn Error>> {
+        self.table.update(user.id, user)
+    }
+
+    fn delete(&self, user: &User) -> Result<(), Box<dyn Error>> {
+        self.table.delete(user.id)?;
+        get_meta_repository().delete(&user.meta)?;
+
+        if let Some(secret) = &user.secret {
+            get_secret_repository().delete(secret)?;
+        }
+
         Ok(())
     }
 }
\ No newline at end of file
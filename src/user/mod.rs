@@ -2,12 +2,18 @@ pub mod framework;
 pub mod application;
 pub mod domain;
 
+use crate::storage::{self, Backend};
+
 lazy_static! {
-    static ref REPO_PROVIDER: framework::PostgresUserRepository = {
-        framework::PostgresUserRepository
+    static ref REPO_PROVIDER: Box<dyn domain::UserRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresUserRepository),
+            Backend::Memory => Box::new(framework::InMemoryUserRepository::new()),
+            backend => storage::unsupported(backend, "users"),
+        }
     }; 
 }   
 
 pub fn get_repository() -> Box<&'static dyn domain::UserRepository> {
-    return Box::new(&*REPO_PROVIDER);
+    Box::new(&**REPO_PROVIDER)
 }
\ No newline at end of file
@@ -0,0 +1,102 @@
+use std::error::Error;
+use crate::constants::{errors, settings, environment};
+use crate::metadata::domain::Metadata;
+use crate::tenant::application::tenant_setting;
+use super::{
+    get_repository as get_reserved_repository,
+    domain::{ReservedName, DenyKind, UsernamePolicy, Charset},
+};
+
+/// Returns the given numeric setting of the given tenant, or else the provided default
+fn get_len_setting(tenant: i32, name: &str, default: usize) -> usize {
+    tenant_setting(tenant, name)
+        .and_then(|value| value.parse().ok())
+        .unwrap_or(default)
+}
+
+/// Returns true if, and only if, new users of the given tenant must provide a username at signup
+pub fn username_required(tenant: i32) -> bool {
+    match tenant_setting(tenant, environment::USERNAME_REQUIRED) {
+        Some(value) => value == "true",
+        None => false,
+    }
+}
+
+/// Returns the rules the usernames of the given tenant must satisfy, as told by its USERNAME_MIN_LEN,
+/// USERNAME_MAX_LEN and USERNAME_CHARSET settings, or else the default ones
+pub fn username_policy(tenant: i32) -> UsernamePolicy {
+    UsernamePolicy {
+        min_len: get_len_setting(tenant, environment::USERNAME_MIN_LEN, settings::USERNAME_MIN_LEN),
+        max_len: get_len_setting(tenant, environment::USERNAME_MAX_LEN, settings::USERNAME_MAX_LEN),
+        charset: tenant_setting(tenant, environment::USERNAME_CHARSET)
+            .and_then(|charset| Charset::from_str(&charset))
+            .or_else(|| Charset::from_str(settings::USERNAME_CHARSET))
+            .unwrap_or(Charset::Extended),
+    }
+}
+
+/// Fails unless the given username satisfies the policy of the given tenant and it is not denied by any of the words
+/// the tenant reserves. Whether some other user has it already is up to the caller
+pub fn username_check(tenant: i32, username: &str) -> Result<(), Box<dyn Error>> {
+    let denied = get_reserved_repository().find_all_by_tenant(tenant)?;
+    username_policy(tenant).check(username, &denied)
+}
+
+/// Denies the given word to the usernames of the given tenant, as told by the given kind: either as a whole or
+/// anywhere. Users already having a denied username keep it
+pub fn reserved_add(tenant: i32, word: &str, kind: DenyKind) -> Result<ReservedName, Box<dyn Error>> {
+    info!("got a reserved name request to deny {} usernames as {}", kind.as_str(), word);
+
+    let mut name = ReservedName::new(Metadata::new(), tenant, word, kind)?;
+    get_reserved_repository().create(&mut name)?;
+    Ok(name)
+}
+
+/// Lets the usernames of the given tenant be, or have, the reserved word with the given id back
+pub fn reserved_delete(tenant: i32, id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a deletion request for reserved name {}", id);
+
+    let name = get_reserved_repository().find(id)?;
+    if name.get_tenant() != tenant {
+        return Err(errors::NOT_FOUND.into());
+    }
+
+    get_reserved_repository().delete(&name)
+}
+
+/// Returns all the words the usernames of the given tenant may not be, or have
+pub fn reserved_list(tenant: i32) -> Result<Vec<ReservedName>, Box<dyn Error>> {
+    get_reserved_repository().find_all_by_tenant(tenant)
+}
+
+
+#[cfg(test)]
+#[cfg(feature = "integration-tests")]
+mod tests {
+    use crate::constants::{errors, settings};
+    use super::super::domain::DenyKind;
+    use super::{username_check, reserved_add, reserved_delete, reserved_list};
+
+    #[test]
+    fn username_check_should_not_fail() {
+        assert!(username_check(settings::DEFAULT_TENANT, "john.doe").is_ok());
+    }
+
+    #[test]
+    fn username_check_should_fail() {
+        let err = username_check(settings::DEFAULT_TENANT, "jo").unwrap_err();
+        assert_eq!(errors::INVALID_USERNAME, err.to_string());
+    }
+
+    #[test]
+    fn reserved_add_should_not_fail() {
+        let name = reserved_add(settings::DEFAULT_TENANT, "Root", DenyKind::Reserved).unwrap();
+        let err = username_check(settings::DEFAULT_TENANT, "r.o.o.t").unwrap_err();
+        assert_eq!(errors::USERNAME_RESERVED, err.to_string());
+        assert!(reserved_list(settings::DEFAULT_TENANT).unwrap().iter().any(|other| other.get_id() == name.get_id()));
+
+        assert!(reserved_delete(settings::DEFAULT_TENANT + 1, name.get_id()).is_err());
+        reserved_delete(settings::DEFAULT_TENANT, name.get_id()).unwrap();
+        assert!(username_check(settings::DEFAULT_TENANT, "root").is_ok());
+    }
+}
@@ -0,0 +1,268 @@
+use std::error::Error;
+use std::time::SystemTime;
+use crate::constants::{errors, settings};
+use crate::metadata::domain::Metadata;
+
+pub trait ReservedNameRepository {
+    fn find(&self, id: i32) -> Result<ReservedName, Box<dyn Error>>;
+    fn find_all_by_tenant(&self, tenant: i32) -> Result<Vec<ReservedName>, Box<dyn Error>>;
+    fn create(&self, name: &mut ReservedName) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, name: &ReservedName) -> Result<(), Box<dyn Error>>;
+}
+
+/// Characters usernames may be split by, as long as they are surrounded by any other ones
+const SEPARATORS: &[char] = &['.', '-', '_'];
+
+/// All the sets of characters usernames may be made of
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Charset {
+    Alphanumeric, // ascii letters and digits only
+    Extended, // ascii letters and digits, split by separators
+    Unicode, // letters and digits of any script, split by separators
+}
+
+impl Charset {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Charset::Alphanumeric => "alphanumeric",
+            Charset::Extended => "extended",
+            Charset::Unicode => "unicode",
+        }
+    }
+
+    pub fn from_str(charset: &str) -> Option<Self> {
+        match charset {
+            "alphanumeric" => Some(Charset::Alphanumeric),
+            "extended" => Some(Charset::Extended),
+            "unicode" => Some(Charset::Unicode),
+            _ => None,
+        }
+    }
+
+    /// if true, usernames of this charset may have the given character, else they may not
+    fn allows(&self, c: char) -> bool {
+        match self {
+            Charset::Alphanumeric => c.is_ascii_alphanumeric(),
+            Charset::Extended => c.is_ascii_alphanumeric() || SEPARATORS.contains(&c),
+            Charset::Unicode => c.is_alphanumeric() || SEPARATORS.contains(&c),
+        }
+    }
+}
+
+/// How a denied word is matched against usernames
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum DenyKind {
+    Reserved, // denies the usernames being the word, such as admin or support
+    Profanity, // denies the usernames having the word anywhere
+}
+
+impl DenyKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            DenyKind::Reserved => "reserved",
+            DenyKind::Profanity => "profanity",
+        }
+    }
+
+    pub fn from_str(kind: &str) -> Option<Self> {
+        match kind {
+            "reserved" => Some(DenyKind::Reserved),
+            "profanity" => Some(DenyKind::Profanity),
+            _ => None,
+        }
+    }
+}
+
+/// Returns the given username as it is told apart from any other: lowercased, so usernames are unique regardless of
+/// their case
+pub fn normalize_username(username: &str) -> String {
+    username.to_lowercase()
+}
+
+/// Returns the given username as it is matched against the denied words: normalized and with no separators, so
+/// a.d.m.i.n is denied as admin is
+fn get_skeleton(username: &str) -> String {
+    normalize_username(username).chars()
+        .filter(|c| !SEPARATORS.contains(c))
+        .collect()
+}
+
+/// A word usernames of a tenant may not be, or have, as told by its kind
+#[derive(Clone)]
+pub struct ReservedName {
+    pub(super) id: i32,
+    pub(super) tenant: i32,
+    pub(super) word: String, // as matched against usernames, so with no separators
+    pub(super) kind: DenyKind,
+    pub(super) meta: Metadata,
+}
+
+impl ReservedName {
+    pub fn new(meta: Metadata, tenant: i32, word: &str, kind: DenyKind) -> Result<Self, Box<dyn Error>> {
+        let word = get_skeleton(word.trim());
+        if word.is_empty() || word.chars().count() > settings::RESERVED_NAME_LEN {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        Ok(ReservedName {
+            id: 0,
+            tenant: tenant,
+            word: word,
+            kind: kind,
+            meta: meta,
+        })
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_word(&self) -> &str {
+        &self.word
+    }
+
+    pub fn get_kind(&self) -> DenyKind {
+        self.kind
+    }
+
+    pub fn get_created_at(&self) -> SystemTime {
+        self.meta.created_at
+    }
+
+    /// if true, the given username is denied by this word, else it is not
+    pub fn matches(&self, username: &str) -> bool {
+        let skeleton = get_skeleton(username);
+        match self.kind {
+            DenyKind::Reserved => skeleton == self.word,
+            DenyKind::Profanity => skeleton.contains(&self.word),
+        }
+    }
+}
+
+/// The rules every username of a tenant must satisfy
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub struct UsernamePolicy {
+    pub min_len: usize, // in characters
+    pub max_len: usize,
+    pub charset: Charset,
+}
+
+impl UsernamePolicy {
+    /// fails unless the given username has as many characters as the policy permits, all of them from its charset
+    /// and with no separator at any end nor next to another, and it is not denied by any of the given words
+    pub fn check(&self, username: &str, denied: &[ReservedName]) -> Result<(), Box<dyn Error>> {
+        let len = username.chars().count();
+        if len < self.min_len || len > self.max_len || !username.chars().all(|c| self.charset.allows(c)) {
+            return Err(errors::INVALID_USERNAME.into());
+        }
+
+        if username.split(|c| SEPARATORS.contains(&c)).any(str::is_empty) {
+            return Err(errors::INVALID_USERNAME.into());
+        }
+
+        if denied.iter().any(|name| name.matches(username)) {
+            return Err(errors::USERNAME_RESERVED.into());
+        }
+
+        Ok(())
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use crate::constants::{errors, settings};
+    use crate::metadata::domain::tests::new_metadata;
+    use super::{ReservedName, UsernamePolicy, Charset, DenyKind, normalize_username};
+
+    pub fn new_reserved_name(word: &str, kind: DenyKind) -> ReservedName {
+        ReservedName::new(new_metadata(), settings::DEFAULT_TENANT, word, kind).unwrap()
+    }
+
+    fn new_policy(charset: Charset) -> UsernamePolicy {
+        UsernamePolicy {
+            min_len: 3,
+            max_len: 16,
+            charset: charset,
+        }
+    }
+
+    #[test]
+    fn charset_from_str_should_not_fail() {
+        for charset in &[Charset::Alphanumeric, Charset::Extended, Charset::Unicode] {
+            assert_eq!(Some(*charset), Charset::from_str(charset.as_str()));
+        }
+
+        assert_eq!(None, Charset::from_str("emoji"));
+    }
+
+    #[test]
+    fn normalize_username_should_not_fail() {
+        assert_eq!("john.doe", normalize_username("John.Doe"));
+        assert_eq!(normalize_username("ÉLODIE"), normalize_username("élodie"));
+    }
+
+    #[test]
+    fn reserved_name_new_should_not_fail() {
+        let name = new_reserved_name(" Ad.Min ", DenyKind::Reserved);
+        assert_eq!("admin", name.get_word());
+        assert_eq!(DenyKind::Reserved, name.get_kind());
+    }
+
+    #[test]
+    fn reserved_name_new_should_fail() {
+        assert!(ReservedName::new(new_metadata(), settings::DEFAULT_TENANT, "", DenyKind::Reserved).is_err());
+        assert!(ReservedName::new(new_metadata(), settings::DEFAULT_TENANT, "._-", DenyKind::Profanity).is_err());
+
+        let long = "a".repeat(settings::RESERVED_NAME_LEN + 1);
+        assert!(ReservedName::new(new_metadata(), settings::DEFAULT_TENANT, &long, DenyKind::Reserved).is_err());
+    }
+
+    #[test]
+    fn reserved_name_matches_should_not_fail() {
+        let reserved = new_reserved_name("admin", DenyKind::Reserved);
+        assert!(reserved.matches("admin"));
+        assert!(reserved.matches("AdMin"));
+        assert!(reserved.matches("ad.min"));
+        assert!(!reserved.matches("admin42"));
+
+        let profanity = new_reserved_name("darn", DenyKind::Profanity);
+        assert!(profanity.matches("darn"));
+        assert!(profanity.matches("big_DARN_fan"));
+        assert!(!profanity.matches("dart"));
+    }
+
+    #[test]
+    fn username_policy_check_should_not_fail() {
+        let denied = vec![new_reserved_name("admin", DenyKind::Reserved)];
+        let policy = new_policy(Charset::Extended);
+        assert!(policy.check("john", &denied).is_ok());
+        assert!(policy.check("John.Doe_42", &denied).is_ok());
+        assert!(policy.check("administrator", &denied).is_ok());
+
+        assert!(new_policy(Charset::Alphanumeric).check("JohnDoe42", &denied).is_ok());
+        assert!(new_policy(Charset::Unicode).check("élodie-ñú", &denied).is_ok());
+    }
+
+    #[test]
+    fn username_policy_check_should_fail() {
+        let denied = vec![new_reserved_name("admin", DenyKind::Reserved)];
+        let policy = new_policy(Charset::Extended);
+
+        let wrong = &["jo", "a_very_long_username", "john doe", "john@doe", ".john", "john-", "john..doe", "élodie"];
+        for username in wrong {
+            let err = policy.check(username, &denied).unwrap_err();
+            assert_eq!(errors::INVALID_USERNAME, err.to_string());
+        }
+
+        assert!(new_policy(Charset::Alphanumeric).check("john.doe", &denied).is_err());
+        assert!(new_policy(Charset::Unicode).check("john!", &denied).is_err());
+
+        let err = policy.check("Ad-Min", &denied).unwrap_err();
+        assert_eq!(errors::USERNAME_RESERVED, err.to_string());
+    }
+}
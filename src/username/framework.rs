@@ -0,0 +1,165 @@
+use std::error::Error;
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::reserved_names;
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use super::domain::{ReservedName, DenyKind, ReservedNameRepository};
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(Clone)]
+#[table_name = "reserved_names"]
+struct PostgresReservedName {
+    pub id: i32,
+    pub tenant_id: i32,
+    pub word: String,
+    pub kind: String,
+    pub meta_id: i32,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "reserved_names"]
+struct NewPostgresReservedName<'a> {
+    pub tenant_id: i32,
+    pub word: &'a str,
+    pub kind: &'a str,
+    pub meta_id: i32,
+}
+
+pub struct PostgresReservedNameRepository;
+
+impl PostgresReservedNameRepository {
+    fn create_on_conn(conn: &PgConnection, name: &mut ReservedName) -> Result<(), PgError>  {
+        // in order to create a reserved name it must exists the metadata for this name
+        PostgresMetadataRepository::create_on_conn(conn, &mut name.meta)?;
+
+        let new_name = NewPostgresReservedName {
+            tenant_id: name.tenant,
+            word: &name.word,
+            kind: name.kind.as_str(),
+            meta_id: name.meta.get_id(),
+        };
+
+        let result = diesel::insert_into(reserved_names::table)
+            .values(&new_name)
+            .get_result::<PostgresReservedName>(conn)?;
+
+        name.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, name: &ReservedName) -> Result<(), PgError>  {
+        let _result = diesel::delete(
+            reserved_names::table.filter(reserved_names::id.eq(name.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &name.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresReservedName) -> Result<ReservedName, Box<dyn Error>> {
+        let kind = DenyKind::from_str(&result.kind)
+            .ok_or(NotFound)?;
+
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(ReservedName{
+            id: result.id,
+            tenant: result.tenant_id,
+            word: result.word.clone(),
+            kind: kind,
+            meta: meta,
+        })
+    }
+}
+
+impl ReservedNameRepository for PostgresReservedNameRepository {
+    fn find(&self, target: i32) -> Result<ReservedName, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            reserved_names::table.filter(reserved_names::id.eq(target))
+                                 .load::<PostgresReservedName>(&connection)?
+        };
+
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresReservedNameRepository::build(&results[0])
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<ReservedName>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            reserved_names::table.filter(reserved_names::tenant_id.eq(target))
+                                 .order((reserved_names::kind.asc(), reserved_names::word.asc()))
+                                 .load::<PostgresReservedName>(&connection)?
+        };
+
+        let mut all_names = Vec::new();
+        for result in results.iter() {
+            all_names.push(PostgresReservedNameRepository::build(result)?);
+        }
+
+        Ok(all_names)
+    }
+
+    fn create(&self, name: &mut ReservedName) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresReservedNameRepository::create_on_conn(&conn, name))?;
+        Ok(())
+    }
+
+    fn delete(&self, name: &ReservedName) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresReservedNameRepository::delete_on_conn(&conn, name))?;
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryReservedNameRepository {
+    table: memory::Table<ReservedName>,
+}
+
+impl InMemoryReservedNameRepository {
+    pub fn new() -> Self {
+        InMemoryReservedNameRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl ReservedNameRepository for InMemoryReservedNameRepository {
+    fn find(&self, target: i32) -> Result<ReservedName, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<ReservedName>, Box<dyn Error>>  {
+        let mut all_names = self.table.find_all(|name| name.tenant == target)?;
+        all_names.sort_by(|a, b| (a.kind.as_str(), &a.word).cmp(&(b.kind.as_str(), &b.word)));
+        Ok(all_names)
+    }
+
+    fn create(&self, name: &mut ReservedName) -> Result<(), Box<dyn Error>> {
+        // in order to create a reserved name it must exists the metadata for this name
+        get_meta_repository().create(&mut name.meta)?;
+        let (tenant, word, kind) = (name.tenant, name.word.clone(), name.kind);
+        self.table.insert(name, |other| other.tenant == tenant && other.word == word && other.kind == kind,
+                          |name, new_id| name.id = new_id)
+    }
+
+    fn delete(&self, name: &ReservedName) -> Result<(), Box<dyn Error>> {
+        self.table.delete(name.id)?;
+        get_meta_repository().delete(&name.meta)
+    }
+}
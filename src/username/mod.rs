@@ -0,0 +1,19 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::ReservedNameRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresReservedNameRepository),
+            Backend::Memory => Box::new(framework::InMemoryReservedNameRepository::new()),
+            backend => storage::unsupported(backend, "reserved names"),
+        }
+    };
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::ReservedNameRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
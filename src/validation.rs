@@ -0,0 +1,514 @@
+use std::collections::HashMap;
+use std::future::Future;
+use std::pin::Pin;
+use std::task::{Context, Poll};
+use hyper::Body;
+use hyper::body::Bytes;
+use http::header::CONTENT_TYPE;
+use prost::Message;
+use tonic::Status;
+use tonic::body::BoxBody;
+use tower::{Layer, Service};
+
+use crate::regex;
+use crate::constants::{errors, settings};
+use crate::status::{FieldViolation, Violations};
+
+const FILE_DESCRIPTOR_SET: &[u8] = tonic::include_file_descriptor_set!("tpauth_descriptor");
+const GRPC_CONTENT_TYPE: &str = "application/grpc";
+const GRPC_WEB_TEXT_CONTENT_TYPE: &str = "application/grpc-web-text";
+const FRAME_HEADER_LEN: usize = 5; // compression flag and length of the message
+const MAX_DEPTH: usize = 8; // nested messages deeper than this are not validated
+
+// wire types and field types, as defined by google/protobuf/descriptor.proto
+const WIRE_VARINT: u64 = 0;
+const WIRE_FIXED64: u64 = 1;
+const WIRE_LENGTH_DELIMITED: u64 = 2;
+const WIRE_FIXED32: u64 = 5;
+const TYPE_STRING: i32 = 9;
+const TYPE_MESSAGE: i32 = 11;
+
+// the fields each method cannot go without, by its path
+const REQUIRED: &[(&str, &[&str])] = &[
+    ("/user.UserService/Signup", &["email", "pwd"]),
+    ("/user.UserService/UpgradeGuest", &["email", "pwd"]),
+    ("/user.UserService/ChangeEmail", &["email"]),
+    ("/user.UserService/AddEmail", &["email"]),
+    ("/user.UserService/RemoveEmail", &["email"]),
+    ("/user.UserService/SetPrimaryEmail", &["email"]),
+    ("/user.UserService/VerifyPhone", &["phone", "code"]),
+    ("/user.UserService/ActivateAccount", &["pwd"]),
+    ("/session.SessionService/Login", &["ident", "app"]),
+    ("/session.SessionService/LoginWithProvider", &["provider", "code", "app"]),
+    ("/session.SessionService/Challenge", &["ident"]),
+    ("/session.SessionService/CreateGuestSession", &["app"]),
+    ("/session.SessionService/Impersonate", &["ident", "app"]),
+    ("/session.v2.SessionService/Login", &["ident", "app"]),
+    ("/invitation.InvitationService/Invite", &["email"]),
+    ("/identity.IdentityService/ConfirmLink", &["token", "pwd"]),
+    ("/recovery.RecoveryService/StartRecovery", &["email"]),
+    ("/recovery.RecoveryService/CompleteRecovery", &["code"]),
+];
+
+// fields holding an email, if set, wherever they are
+const EMAIL_FIELDS: &[&str] = &["email", "support_email"];
+
+// fields holding free text, such as the body of a template, bound by a larger length than the rest
+const TEXT_FIELDS: &[&str] = &["body"];
+
+// The subset of google/protobuf/descriptor.proto telling the fields of every request message
+#[derive(Clone, PartialEq, Message)]
+struct FileDescriptorSet {
+    #[prost(message, repeated, tag = "1")]
+    file: Vec<FileDescriptorProto>,
+}
+
+#[derive(Clone, PartialEq, Message)]
+struct FileDescriptorProto {
+    #[prost(string, tag = "2")]
+    package: String,
+    #[prost(message, repeated, tag = "4")]
+    message_type: Vec<DescriptorProto>,
+    #[prost(message, repeated, tag = "6")]
+    service: Vec<ServiceDescriptorProto>,
+}
+
+#[derive(Clone, PartialEq, Message)]
+struct DescriptorProto {
+    #[prost(string, tag = "1")]
+    name: String,
+    #[prost(message, repeated, tag = "2")]
+    field: Vec<FieldDescriptorProto>,
+    #[prost(message, repeated, tag = "3")]
+    nested_type: Vec<DescriptorProto>,
+}
+
+#[derive(Clone, PartialEq, Message)]
+struct FieldDescriptorProto {
+    #[prost(string, tag = "1")]
+    name: String,
+    #[prost(int32, tag = "3")]
+    number: i32,
+    #[prost(int32, tag = "5")]
+    kind: i32,
+    #[prost(string, tag = "6")]
+    type_name: String,
+}
+
+#[derive(Clone, PartialEq, Message)]
+struct ServiceDescriptorProto {
+    #[prost(string, tag = "1")]
+    name: String,
+    #[prost(message, repeated, tag = "2")]
+    method: Vec<MethodDescriptorProto>,
+}
+
+#[derive(Clone, PartialEq, Message)]
+struct MethodDescriptorProto {
+    #[prost(string, tag = "1")]
+    name: String,
+    #[prost(string, tag = "2")]
+    input_type: String,
+    #[prost(bool, tag = "5")]
+    client_streaming: bool,
+}
+
+/// The messages, by their fully qualified name (e.g. .user.SignupRequest), and the unary methods, by their path (e.g.
+/// /user.UserService/Signup), of all the services
+#[derive(Default)]
+struct Index {
+    messages: HashMap<String, Vec<FieldDescriptorProto>>,
+    methods: HashMap<String, String>,
+}
+
+impl Index {
+    fn new(encoded: &[u8]) -> Result<Self, prost::DecodeError> {
+        let mut index = Index::default();
+        for file in FileDescriptorSet::decode(encoded)?.file {
+            let (prefix, service_prefix) = match file.package.len() {
+                0 => ("".to_string(), "".to_string()),
+                _ => (format!(".{}", file.package), format!("{}.", file.package)),
+            };
+
+            for message in file.message_type.iter() {
+                index.add_message(&prefix, message);
+            }
+
+            for service in file.service.iter() {
+                let methods = service.method.iter().filter(|method| !method.client_streaming);
+                for method in methods {
+                    let path = format!("/{}{}/{}", service_prefix, service.name, method.name);
+                    index.methods.insert(path, method.input_type.clone());
+                }
+            }
+        }
+
+        Ok(index)
+    }
+
+    fn add_message(&mut self, prefix: &str, message: &DescriptorProto) {
+        let name = format!("{}.{}", prefix, message.name);
+        for nested in message.nested_type.iter() {
+            self.add_message(&name, nested);
+        }
+
+        self.messages.insert(name, message.field.clone());
+    }
+}
+
+lazy_static! {
+    static ref INDEX: Index = Index::new(FILE_DESCRIPTOR_SET)
+        .expect("file descriptor set must be decodable");
+}
+
+fn read_varint(buf: &[u8], pos: &mut usize) -> Option<u64> {
+    let mut value = 0;
+    for shift in (0..64).step_by(7) {
+        let byte = *buf.get(*pos)?;
+        *pos += 1;
+        value |= ((byte & 0x7f) as u64) << shift;
+        if byte & 0x80 == 0 {
+            return Some(value);
+        }
+    }
+
+    None
+}
+
+/// Returns the violations of the given string field, if any: it must be valid utf-8 with no control characters, other
+/// than line breaks and tabs, within the length bound of its field and, if it holds an email, well formed
+fn check_string(name: &str, path: &str, value: &[u8]) -> Option<FieldViolation> {
+    let violation = |description: String| Some(FieldViolation {
+        field: path.to_string(),
+        description: description,
+    });
+
+    let max = if TEXT_FIELDS.contains(&name) {settings::MAX_TEXT_LEN} else {settings::MAX_FIELD_LEN};
+    if value.len() > max {
+        return violation(format!("must be up to {} bytes long", max));
+    }
+
+    let value = match std::str::from_utf8(value) {
+        Ok(value) => value,
+        Err(_) => return violation("must be valid utf-8".to_string()),
+    };
+
+    if value.chars().any(|c| c.is_control() && !matches!(c, '\n' | '\r' | '\t')) {
+        return violation("must have no control characters".to_string());
+    }
+
+    if value.len() > 0 && EMAIL_FIELDS.contains(&name) && regex::match_regex(regex::EMAIL, value).is_err() {
+        return violation("must be a valid email".to_string());
+    }
+
+    None
+}
+
+/// Walks the given encoded message of the given type, returning the violations of all its string fields, including
+/// these of its nested messages, as well as the names of its fields that are set. Returns None if the message is not
+/// well formed, so it fails as it would with no validation at all
+fn check_message(index: &Index,
+                 kind: &str,
+                 prefix: &str,
+                 buf: &[u8],
+                 depth: usize) -> Option<(Vec<FieldViolation>, Vec<String>)> {
+
+    let fields = match index.messages.get(kind) {
+        Some(fields) if depth < MAX_DEPTH => fields,
+        _ => return Some((vec![], vec![])),
+    };
+
+    let mut violations = Vec::new();
+    let mut set = Vec::new();
+    let mut pos = 0;
+    while pos < buf.len() {
+        let key = read_varint(buf, &mut pos)?;
+        let (number, wire) = ((key >> 3) as i32, key & 0x07);
+        let value = match wire {
+            WIRE_VARINT => {
+                read_varint(buf, &mut pos)?;
+                None
+            },
+            WIRE_FIXED64 | WIRE_FIXED32 => {
+                pos += if wire == WIRE_FIXED64 {8} else {4};
+                None
+            },
+            WIRE_LENGTH_DELIMITED => {
+                let len = read_varint(buf, &mut pos)? as usize;
+                let value = buf.get(pos..pos.checked_add(len)?)?;
+                pos += len;
+                Some(value)
+            },
+            _ => return None,
+        };
+
+        let field = match fields.iter().find(|field| field.number == number) {
+            Some(field) => field,
+            None => continue, // unknown fields are ignored, as decoding does
+        };
+
+        let path = format!("{}{}", prefix, field.name);
+        match (field.kind, value) {
+            (TYPE_STRING, Some(value)) => {
+                violations.extend(check_string(&field.name, &path, value));
+                if value.len() > 0 {
+                    set.push(field.name.clone());
+                }
+            },
+            (TYPE_MESSAGE, Some(value)) => {
+                let (nested, _) = check_message(index, &field.type_name, &format!("{}.", path), value, depth + 1)?;
+                violations.extend(nested);
+                set.push(field.name.clone());
+            },
+            _ => set.push(field.name.clone()),
+        }
+    }
+
+    if pos > buf.len() {
+        return None;
+    }
+
+    Some((violations, set))
+}
+
+/// Returns the violations of the given encoded request message of the method with the given path: the bounds and
+/// formats of its string fields, as well as the fields it requires. Methods not known, such as streaming ones, have
+/// none
+fn check_request(index: &Index, path: &str, message: &[u8]) -> Vec<FieldViolation> {
+    let kind = match index.methods.get(path) {
+        Some(kind) => kind,
+        None => return vec![],
+    };
+
+    let (mut violations, set) = match check_message(index, kind, "", message, 0) {
+        Some(checked) => checked,
+        None => return vec![],
+    };
+
+    let required = REQUIRED.iter()
+        .filter(|(method, _)| *method == path)
+        .flat_map(|(_, fields)| fields.iter())
+        .filter(|field| !set.iter().any(|set| set == *field))
+        .map(|field| FieldViolation {
+            field: field.to_string(),
+            description: "required".to_string(),
+        });
+
+    violations.extend(required);
+    violations
+}
+
+/// Returns true if, and only if, the given path is the one of a unary method of any service
+pub fn is_unary(path: &str) -> bool {
+    INDEX.methods.contains_key(path)
+}
+
+/// Returns the message of the given unary grpc request body, as long as it is a single uncompressed frame
+fn get_message(body: &[u8]) -> Option<&[u8]> {
+    let header = body.get(..FRAME_HEADER_LEN)?;
+    let len = u32::from_be_bytes([header[1], header[2], header[3], header[4]]) as usize;
+    if header[0] != 0 || body.len() != FRAME_HEADER_LEN + len {
+        return None;
+    }
+
+    Some(&body[FRAME_HEADER_LEN..])
+}
+
+/// A layer rejecting, with INVALID_ARGUMENT, every unary request whose message has any field out of bounds, with
+/// control characters or not valid utf-8, an email that is not well formed, or misses any field its method requires,
+/// before it is served at all. The fields that are wrong are told by the details of the status, as provided by the
+/// ErrorDetailsLayer, which must go before this one. Streaming requests, and grpc-web ones encoded as text, are
+/// served as they are
+#[derive(Clone, Default)]
+pub struct ValidationLayer;
+
+impl<S> Layer<S> for ValidationLayer {
+    type Service = ValidationService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        ValidationService { inner }
+    }
+}
+
+#[derive(Clone)]
+pub struct ValidationService<S> {
+    inner: S,
+}
+
+impl<S> Service<http::Request<Body>> for ValidationService<S>
+where
+    S: Service<http::Request<Body>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<Body>) -> Self::Future {
+        let binary = request.headers().get(CONTENT_TYPE)
+            .and_then(|kind| kind.to_str().ok())
+            .map(|kind| kind.starts_with(GRPC_CONTENT_TYPE) && !kind.starts_with(GRPC_WEB_TEXT_CONTENT_TYPE))
+            .unwrap_or(false);
+
+        let path = request.uri().path().to_string();
+        if !binary || !INDEX.methods.contains_key(&path) {
+            return Box::pin(self.inner.call(request));
+        }
+
+        // the service that has been polled ready is the one to be called, leaving its clone in its place
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        Box::pin(async move {
+            let (parts, body) = request.into_parts();
+            let body = match hyper::body::to_bytes(body).await {
+                Ok(body) => body,
+                Err(err) => {
+                    // the body fails the same way it would have with no validation, such as for being too large
+                    let failed = Body::wrap_stream(tokio_stream::once(Err::<Bytes, _>(err)));
+                    return inner.call(http::Request::from_parts(parts, failed)).await;
+                },
+            };
+
+            let violations = get_message(&body)
+                .map(|message| check_request(&INDEX, &path, message))
+                .unwrap_or_default();
+
+            if violations.len() > 0 {
+                let mut response = Status::invalid_argument(errors::INVALID_REQUEST).to_http();
+                response.extensions_mut().insert(Violations(violations));
+                return Ok(response);
+            }
+
+            inner.call(http::Request::from_parts(parts, Body::from(body))).await
+        })
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use prost::Message;
+    use crate::constants::settings;
+    use super::{Index, INDEX, check_request, check_string, get_message, read_varint};
+
+    // the fields of the SignupRequest message of the user service, encoded as they are on the wire
+    #[derive(Clone, PartialEq, Message)]
+    struct SignupRequest {
+        #[prost(string, tag = "1")]
+        email: String,
+        #[prost(string, tag = "2")]
+        pwd: String,
+        #[prost(map = "string, string", tag = "6")]
+        attributes: std::collections::HashMap<String, String>,
+    }
+
+    fn get_fields(index: &Index, path: &str, request: &SignupRequest) -> Vec<String> {
+        check_request(index, path, &request.encode_to_vec()).into_iter()
+            .map(|violation| violation.field)
+            .collect()
+    }
+
+    #[test]
+    fn index_should_not_fail() {
+        assert_eq!(".user.SignupRequest", INDEX.methods.get("/user.UserService/Signup").unwrap());
+        assert!(INDEX.messages.contains_key(".session.LoginRequest"));
+        assert!(!INDEX.methods.contains_key("/admin.AdminService/BulkImportUsers"));
+    }
+
+    #[test]
+    fn check_request_should_not_fail() {
+        let request = SignupRequest {
+            email: "check_request_should_not_fail@testing.com".to_string(),
+            pwd: "abcdef".to_string(),
+            attributes: vec![("given_name".to_string(), "Alice".to_string())].into_iter().collect(),
+        };
+
+        assert!(get_fields(&INDEX, "/user.UserService/Signup", &request).is_empty());
+    }
+
+    #[test]
+    fn check_request_should_fail() {
+        let request = SignupRequest {
+            email: "not an email".to_string(),
+            pwd: "".to_string(),
+            attributes: vec![("given_name".to_string(), "Ali\u{0}ce".to_string())].into_iter().collect(),
+        };
+
+        let mut fields = get_fields(&INDEX, "/user.UserService/Signup", &request);
+        fields.sort();
+        assert_eq!(vec!["attributes.value", "email", "pwd"], fields);
+
+        let request = SignupRequest {
+            email: "check_request_should_fail@testing.com".to_string(),
+            pwd: "a".repeat(settings::MAX_FIELD_LEN + 1),
+            attributes: Default::default(),
+        };
+
+        assert_eq!(vec!["pwd"], get_fields(&INDEX, "/user.UserService/Signup", &request));
+    }
+
+    #[test]
+    fn check_request_malformed_should_fail() {
+        // malformed messages fail as they would with no validation at all, so no violation is told
+        let path = "/user.UserService/Signup";
+        assert!(check_request(&INDEX, path, &[10, 5, b'a']).is_empty());
+        assert!(check_request(&INDEX, path, &[11]).is_empty());
+        assert!(check_request(&INDEX, path, &[0x80]).is_empty());
+
+        // methods not known have no violations, not even the fields other methods require
+        assert!(check_request(&INDEX, "/user.UserService/Unknown", &[]).is_empty());
+        assert!(!check_request(&INDEX, path, &[]).is_empty());
+    }
+
+    #[test]
+    fn check_string_should_not_fail() {
+        assert!(check_string("body", "body", "line\r\n\tbreak".as_bytes()).is_none());
+        assert!(check_string("email", "email", b"").is_none());
+        assert!(check_string("body", "body", "a".repeat(settings::MAX_TEXT_LEN).as_bytes()).is_none());
+    }
+
+    #[test]
+    fn check_string_should_fail() {
+        let description = |name: &str, value: &[u8]| check_string(name, "path", value).unwrap().description;
+        assert_eq!("must be valid utf-8", description("name", &[0xff, 0xfe]));
+        assert_eq!("must have no control characters", description("name", b"bell\x07"));
+        assert_eq!("must be a valid email", description("support_email", b"not an email"));
+
+        let max = format!("must be up to {} bytes long", settings::MAX_FIELD_LEN);
+        assert_eq!(max, description("name", "a".repeat(settings::MAX_FIELD_LEN + 1).as_bytes()));
+
+        let max = format!("must be up to {} bytes long", settings::MAX_TEXT_LEN);
+        assert_eq!(max, description("body", "a".repeat(settings::MAX_TEXT_LEN + 1).as_bytes()));
+
+        // the violation is told by the path of the field, not by its name alone
+        assert_eq!("attributes.value", check_string("value", "attributes.value", &[0xff]).unwrap().field);
+    }
+
+    #[test]
+    fn read_varint_should_fail() {
+        // truncated and longer than 64 bits
+        let mut pos = 0;
+        assert!(read_varint(&[0x80], &mut pos).is_none());
+
+        let mut pos = 0;
+        assert!(read_varint(&[0xff; 11], &mut pos).is_none());
+    }
+
+    #[test]
+    fn get_message_should_not_fail() {
+        let body = [0, 0, 0, 0, 2, 10, 0];
+        assert_eq!(Some(&body[5..]), get_message(&body));
+    }
+
+    #[test]
+    fn get_message_should_fail() {
+        // compressed, truncated and multi-frame bodies are not validated
+        assert!(get_message(&[1, 0, 0, 0, 2, 10, 0]).is_none());
+        assert!(get_message(&[0, 0, 0, 0, 3, 10, 0]).is_none());
+        assert!(get_message(&[0, 0, 0]).is_none());
+    }
+}
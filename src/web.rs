@@ -0,0 +1,1038 @@
+use std::error::Error;
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::net::SocketAddr;
+use hyper::{Body, Method, Server, StatusCode};
+use hyper::header::{
+    CONTENT_LANGUAGE, CONTENT_SECURITY_POLICY, CONTENT_TYPE, COOKIE, HOST, LOCATION, RETRY_AFTER, SET_COOKIE,
+};
+use hyper::server::conn::AddrStream;
+use hyper::service::{make_service_fn, service_fn};
+use tower::Layer;
+use tera::{Tera, Context};
+use tonic::metadata::MetadataMap;
+
+use crate::constants::{environment, errors, settings};
+use crate::{config, i18n, security, status};
+use crate::headers::HeadersLayer;
+use crate::detection::framework::get_origin;
+use crate::policy::domain::PolicyKind;
+use crate::policy::application::policy_latest;
+use crate::tenant::application::{tenant_find, tenant_key_set};
+use crate::app::domain::Branding;
+use crate::app::application::app_branding;
+use crate::app::get_repository as get_app_repository;
+use crate::session::application::{session_login, session_check, session_resolve_cookie};
+use crate::session::domain::CookieCodec;
+use crate::user::application::{user_missing_attributes, user_info, user_change_password};
+use crate::session::framework::new_cookie_header;
+
+const LOGIN_PATH: &str = "/login";
+const JWKS_PATH: &str = "/.well-known/jwks.json";
+const PASSWORD_PATH: &str = "/password";
+const CHANGE_PASSWORD_PATH: &str = "/.well-known/change-password";
+const TENANTS_PATH: &str = "/tenants/";
+const HTML_CONTENT_TYPE: &str = "text/html; charset=utf-8";
+const JSON_CONTENT_TYPE: &str = "application/json";
+const INVALID_STATE: &str = "the state of the app is missing or not valid";
+const INVALID_APP: &str = "the app is not registered";
+const LOGIN_REQUIRED: &str = "log in to change your password";
+const WRONG_CREDENTIALS: &str = "wrong password or code";
+const FORM_EXPIRED: &str = "the form has expired, please try again";
+const PAGES_SECURITY_POLICY: &str = "default-src 'none'; style-src 'unsafe-inline'; img-src https:; \
+                                     form-action 'self'; frame-ancestors 'none'";
+
+const TEMPLATES: &[(&str, &str)] = &[
+    ("base.html", include_str!("../templates/web/base.html")),
+    ("hidden.html", include_str!("../templates/web/hidden.html")),
+    ("login.html", include_str!("../templates/web/login.html")),
+    ("mfa.html", include_str!("../templates/web/mfa.html")),
+    ("consent.html", include_str!("../templates/web/consent.html")),
+    ("profile.html", include_str!("../templates/web/profile.html")),
+    ("error.html", include_str!("../templates/web/error.html")),
+    ("password.html", include_str!("../templates/web/password.html")),
+];
+
+lazy_static! {
+    static ref TERA: Tera = {
+        let mut bundled = Tera::default();
+        bundled.add_raw_templates(TEMPLATES.to_vec()).unwrap();
+
+        // custom templates take precedence over the bundled ones, so only those to be changed need to be provided
+        match config::get(environment::WEB_TEMPLATES) {
+            Ok(templates) => {
+                let mut custom = Tera::new(&templates).unwrap();
+                custom.extend(&bundled).unwrap();
+                custom
+            },
+            Err(_) => bundled,
+        }
+    };
+}
+
+/// Where the login pages of a request are served at: the path of the login page, along with the tenant the pages are
+/// pinned to, if any, by either the path prefix of the tenant or the host the request is addressed to
+struct Site {
+    path: String,
+    tenant: Option<String>,
+}
+
+impl Site {
+    /// Returns the site the given request to the login pages is addressed to, unless it is not to the login pages
+    fn new(request: &hyper::Request<Body>) -> Option<Self> {
+        let tenant = match parse_login_path(request.uri().path())? {
+            "" => get_host_tenant(request),
+            tenant => Some(tenant.to_string()),
+        };
+
+        Some(Site {
+            path: request.uri().path().to_string(),
+            tenant: tenant,
+        })
+    }
+}
+
+/// Where the user is logging into, as told by the query of the login page first, and by the hidden fields of every
+/// form after that. The tenant of a site pinned to one is not told by any of them
+struct Target {
+    path: String,   // the one of the login page all the forms are posted to
+    tenant: String,
+    app: String,
+    registered: String, // the url the app is registered with, once resolved, which is the only one redirected to
+    redirect: String,
+    state: String,  // opaque to the service, round-tripped back to the app along the redirect
+    csrf: String,
+    locale: String, // the one the pages are rendered in, as requested by the browser
+}
+
+impl Target {
+    fn new(params: &HashMap<String, String>, csrf: &str, locale: &str) -> Self {
+        let param = |name: &str| params.get(name).cloned().unwrap_or_default();
+        let tenant = match param("tenant") {
+            tenant if tenant.len() > 0 => tenant,
+            _ => settings::DEFAULT_TENANT_NAME.to_string(),
+        };
+
+        Target {
+            path: LOGIN_PATH.to_string(),
+            tenant: tenant,
+            app: param("app"),
+            registered: "".to_string(),
+            redirect: param("redirect"),
+            state: param("state"),
+            csrf: csrf.to_string(),
+            locale: locale.to_string(),
+        }
+    }
+
+    /// Returns the target as served by the given site, so its tenant, if pinned, prevails over the requested one
+    fn at(mut self, site: &Site) -> Self {
+        self.path = site.path.clone();
+        if let Some(tenant) = &site.tenant {
+            self.tenant = tenant.clone();
+        }
+
+        self
+    }
+
+    /// Returns the target along with the url its app is registered with in its tenant, failing if the app is not
+    /// registered at all, so no redirect is ever built out of an url told by the request alone
+    fn resolve(mut self) -> Result<Self, Box<dyn Error>> {
+        let tenant = tenant_find(&self.tenant)?;
+        let app = get_app_repository().find_by_url(tenant.get_id(), &self.app)?;
+        self.registered = app.get_url().to_string();
+        Ok(self)
+    }
+
+    /// Returns the branding the pages must be rendered with, if the app has any
+    fn get_branding(&self) -> Option<Branding> {
+        let tenant = tenant_find(&self.tenant).ok()?;
+        app_branding(tenant.get_id(), &self.app)
+    }
+
+    /// Returns the url the user gets redirected to once logged in: the requested one if, and only if, it belongs to
+    /// the registered url of the app, or that url otherwise, so the pages cannot be used to redirect anywhere else.
+    /// Targets not resolved yet have no url to redirect to
+    fn get_redirect(&self) -> &str {
+        match self.redirect.strip_prefix(&self.registered) {
+            Some(_) if self.registered.len() == 0 => "",
+            Some(rest) if rest.len() == 0 || rest.starts_with(&['/', '?', '#'][..]) => &self.redirect,
+            _ => &self.registered,
+        }
+    }
+
+    /// Returns the url the user gets redirected back to the app by, whether logged in or not: the redirect one, with
+    /// the state of the app added into its query, so the app can tell the redirect is the answer to its own request
+    fn get_callback(&self) -> String {
+        with_param(self.get_redirect(), "state", &self.state)
+    }
+
+    /// Tells whether the app has provided a state to be round-tripped, as every request to the login page requires
+    fn has_valid_state(&self) -> bool {
+        self.state.len() > 0 && self.state.len() <= settings::WEB_STATE_LEN
+    }
+
+    fn to_context(&self) -> Context {
+        let mut context = new_context(self.get_branding().as_ref(), &self.locale);
+        context.insert("login_path", &self.path);
+        context.insert("tenant", &self.tenant);
+        context.insert("app", &self.app);
+        context.insert("redirect", &self.redirect);
+        context.insert("state", &self.state);
+        context.insert("csrf", &self.csrf);
+        context
+    }
+}
+
+/// Decodes the given url-encoded value, as found in queries and form bodies
+fn decode_param(value: &str) -> String {
+    let bytes = value.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut index = 0;
+    while index < bytes.len() {
+        match bytes[index] {
+            b'+' => decoded.push(b' '),
+            b'%' if index + 2 < bytes.len() => {
+                let hex = std::str::from_utf8(&bytes[index + 1..index + 3]).ok();
+                match hex.and_then(|hex| u8::from_str_radix(hex, 16).ok()) {
+                    Some(byte) => {
+                        decoded.push(byte);
+                        index += 2;
+                    },
+                    None => decoded.push(b'%'),
+                }
+            },
+            byte => decoded.push(byte),
+        }
+
+        index += 1;
+    }
+
+    String::from_utf8_lossy(&decoded).to_string()
+}
+
+/// Encodes the given value to be url-safe, as the parameters added into the query of the redirects must be
+fn encode_param(value: &str) -> String {
+    value.bytes()
+        .map(|byte| match byte {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' => (byte as char).to_string(),
+            byte => format!("%{:02X}", byte),
+        })
+        .collect()
+}
+
+/// Returns the decoded parameters of the given url-encoded query or form. Repeated parameters keep their first value
+fn parse_params(encoded: &str) -> HashMap<String, String> {
+    let mut params = HashMap::new();
+    for param in encoded.split('&').filter(|param| param.len() > 0) {
+        let mut parts = param.splitn(2, '=');
+        let key = decode_param(parts.next().unwrap_or_default());
+        let value = decode_param(parts.next().unwrap_or_default());
+        params.entry(key).or_insert(value);
+    }
+
+    params
+}
+
+/// Returns the value of the given cookie of the request, if any
+fn get_cookie(request: &hyper::Request<Body>, name: &str) -> Option<String> {
+    request.headers().get_all(COOKIE).iter()
+        .filter_map(|header| header.to_str().ok())
+        .flat_map(|header| header.split(';'))
+        .filter_map(|cookie| {
+            let mut parts = cookie.trim().splitn(2, '=');
+            match (parts.next(), parts.next()) {
+                (Some(key), Some(value)) if key == name => Some(value.to_string()),
+                _ => None,
+            }
+        })
+        .next()
+}
+
+/// Returns the session token of the browser, as told by its token cookie, be it the token itself or an opaque handle
+fn get_token(request: &hyper::Request<Body>) -> String {
+    match get_cookie(request, settings::COOKIE_NAME) {
+        Some(cookie) if CookieCodec::is_opaque(&cookie) => session_resolve_cookie(&cookie).unwrap_or_default(),
+        Some(token) => token,
+        None => "".to_string(),
+    }
+}
+
+/// Returns the tenant the host the given request is addressed to is bound to, if any, as told by WEB_TENANT_HOSTS: a
+/// comma-separated list of <host>=<tenant> bindings, such as "login.acme.com=acme"
+fn get_host_tenant(request: &hyper::Request<Body>) -> Option<String> {
+    let host = request.uri().host()
+        .or_else(|| request.headers().get(HOST).and_then(|host| host.to_str().ok()))?
+        .split(':').next()?
+        .to_lowercase();
+
+    config::get(environment::WEB_TENANT_HOSTS).ok()?
+        .split(',')
+        .filter_map(|binding| {
+            let mut parts = binding.trim().splitn(2, '=');
+            Some((parts.next()?.trim().to_lowercase(), parts.next()?.trim().to_string()))
+        })
+        .find(|(bound, tenant)| *bound == host && tenant.len() > 0)
+        .map(|(_, tenant)| tenant)
+}
+
+/// Returns the locale the pages must be rendered in, out of these accepted by the browser
+fn get_locale(request: &hyper::Request<Body>) -> String {
+    i18n::negotiate(&i18n::get_requested(request.headers()))
+}
+
+/// Returns a new context for the templates, with the name the pages must be titled by, the branding they must be
+/// rendered with, if any, and their texts in the given locale
+fn new_context(branding: Option<&Branding>, locale: &str) -> Context {
+    let app_name = match branding.and_then(|branding| branding.get_name()) {
+        Some(name) => name.to_string(),
+        None => config::get(environment::APP_NAME).unwrap_or("tpauth".to_string()),
+    };
+
+    let mut context = Context::new();
+    context.insert("app_name", &app_name);
+    context.insert("brand", &branding);
+    context.insert("locale", locale);
+    context.insert("t", &i18n::get_pages(locale));
+    context
+}
+
+fn new_response(status: StatusCode, body: Body) -> hyper::Response<Body> {
+    let mut response = hyper::Response::new(body);
+    *response.status_mut() = status;
+    response
+}
+
+fn render(status: StatusCode, template: &str, context: &Context) -> hyper::Response<Body> {
+    match TERA.render(template, context) {
+        Ok(html) => {
+            let mut response = new_response(status, Body::from(html));
+            response.headers_mut().insert(CONTENT_TYPE, HTML_CONTENT_TYPE.parse().unwrap());
+            if let Some(locale) = context.get("locale").and_then(|locale| locale.as_str()) {
+                if let Ok(locale) = locale.parse() {
+                    response.headers_mut().insert(CONTENT_LANGUAGE, locale);
+                }
+            }
+
+            response
+        },
+        Err(err) => {
+            error!("could not render page {}: {}", template, err);
+            new_response(StatusCode::INTERNAL_SERVER_ERROR, Body::from(errors::HAS_FAILED))
+        }
+    }
+}
+
+fn render_error(status: StatusCode, detail: &str, back: Option<&str>, locale: &str) -> hyper::Response<Body> {
+    let mut context = new_context(None, locale);
+    context.insert("error", &i18n::translate_error(locale, detail));
+    context.insert("back", &back);
+    render(status, "error.html", &context)
+}
+
+/// Returns the given url with the given parameter, once encoded, added into its query, before its fragment if any
+fn with_param(url: &str, name: &str, value: &str) -> String {
+    let (url, fragment) = match url.find('#') {
+        Some(index) => url.split_at(index),
+        None => (url, ""),
+    };
+
+    let separator = if url.contains('?') {'&'} else {'?'};
+    format!("{}{}{}={}{}", url, separator, name, encode_param(value), fragment)
+}
+
+/// Returns the given url with the given error added into its query, as the redirects telling the app why the login has
+/// not been completed do
+fn with_error(url: &str, error: &str) -> String {
+    with_param(url, "error", error)
+}
+
+/// Returns the value of the cookie binding the given state to the browser it has been sent by, so a form carrying any
+/// other state, such as one injected by somebody else, is told apart
+fn state_digest(csrf: &str, state: &str) -> String {
+    sha256::digest_bytes(format!("{}:{}", csrf, state).as_bytes())
+}
+
+/// Logs the user in with no page at all, as prompt=none asks for: by the session of its token cookie, if it is still
+/// open and authorized for the app, or else by redirecting back with the consent_required error, if it is open but not
+/// authorized, or the login_required one, so single-page apps can renew their tokens by a background redirect with no
+/// interaction of the user
+fn silent_login(request: &hyper::Request<Body>, target: &Target) -> hyper::Response<Body> {
+    let token = get_token(request);
+    let mut response = new_response(StatusCode::SEE_OTHER, Body::empty());
+    let location = match session_check(&token, &target.registered) {
+        Ok((token, _)) => {
+            if let Some(cookie) = new_cookie_header(settings::COOKIE_NAME, &token).and_then(|header| header.parse().ok()) {
+                response.headers_mut().append(SET_COOKIE, cookie);
+            }
+
+            target.get_callback()
+        },
+        Err(err) if err.to_string() == errors::CONSENT_REQUIRED => {
+            with_error(&target.get_callback(), "consent_required")
+        },
+        Err(err) => {
+            debug!("silent login is not possible: {}", err);
+            with_error(&target.get_callback(), "login_required")
+        },
+    };
+
+    if let Ok(location) = location.parse() {
+        response.headers_mut().insert(LOCATION, location);
+    }
+
+    response
+}
+
+/// Serves the login page, along with a new csrf cookie whose value every form must echo and a cookie binding the state
+/// of the app to the browser, unless the app asks for no page at all by prompt=none. Requests with no state are rejected
+fn login_page(request: &hyper::Request<Body>, site: &Site) -> hyper::Response<Body> {
+    let params = parse_params(request.uri().query().unwrap_or_default());
+    let csrf = security::get_random_string(settings::WEB_CSRF_LEN);
+    let target = Target::new(&params, &csrf, &get_locale(request)).at(site);
+    if !target.has_valid_state() {
+        return render_error(StatusCode::BAD_REQUEST, INVALID_STATE, None, &target.locale);
+    }
+
+    let locale = target.locale.clone();
+    let target = match target.resolve() {
+        Ok(target) => target,
+        Err(err) => {
+            debug!("app of the login page could not be resolved: {}", err);
+            return render_error(StatusCode::BAD_REQUEST, INVALID_APP, None, &locale);
+        },
+    };
+
+    if params.get("prompt").map(String::as_str) == Some("none") {
+        return silent_login(request, &target);
+    }
+
+    let mut context = target.to_context();
+    context.insert("email", "");
+    context.insert("error", "");
+
+    let mut response = render(StatusCode::OK, "login.html", &context);
+    let cookie = format!("{}={}; Path={}; HttpOnly; SameSite=Strict", settings::WEB_CSRF_COOKIE_NAME, csrf,
+                         target.path);
+    if let Ok(cookie) = cookie.parse() {
+        response.headers_mut().append(SET_COOKIE, cookie);
+    }
+
+    let cookie = format!("{}={}; Path={}; HttpOnly; SameSite=Strict", settings::WEB_STATE_COOKIE_NAME,
+                         state_digest(&csrf, &target.state), target.path);
+    if let Ok(cookie) = cookie.parse() {
+        response.headers_mut().append(SET_COOKIE, cookie);
+    }
+
+    response
+}
+
+/// Returns the page telling the user what is missing for the login to succeed, given the error the login has failed
+/// with: the mfa code, the acceptance of the latest policies, the missing attributes of the profile or, as a last
+/// resort, the right credentials
+fn next_page(target: &Target, form: &HashMap<String, String>, digest: &str, err: &str) -> hyper::Response<Body> {
+    let field = |name: &str| form.get(name).cloned().unwrap_or_default();
+    let mut context = target.to_context();
+    context.insert("email", &field("email"));
+    context.insert("digest", digest);
+    context.insert("totp", &field("totp"));
+    context.insert("terms", &field("terms"));
+    context.insert("privacy", &field("privacy"));
+
+    let totp_given = field("totp").len() > 0;
+    let translate = |message: &str| i18n::translate_error(&target.locale, message);
+    match err {
+        errors::MFA_REQUIRED => {
+            context.insert("error", "");
+            render(StatusCode::OK, "mfa.html", &context)
+        },
+        errors::UNAUTHORIZED if totp_given => {
+            context.insert("error", &translate("the code is not valid"));
+            render(StatusCode::UNAUTHORIZED, "mfa.html", &context)
+        },
+        errors::POLICY_REQUIRED => {
+            let (terms, privacy) = match (policy_latest(PolicyKind::Terms), policy_latest(PolicyKind::Privacy)) {
+                (Ok(terms), Ok(privacy)) => (terms, privacy),
+                (Err(err), _) | (_, Err(err)) => {
+                    error!("could not find the latest policies: {}", err);
+                    return render_error(StatusCode::INTERNAL_SERVER_ERROR, errors::HAS_FAILED, None, &target.locale);
+                },
+            };
+
+            context.insert("terms", &terms.get_version());
+            context.insert("terms_url", terms.get_url());
+            context.insert("privacy", &privacy.get_version());
+            context.insert("privacy_url", privacy.get_url());
+            context.insert("error", "");
+            render(StatusCode::OK, "consent.html", &context)
+        },
+        err if err.starts_with(errors::PROFILE_INCOMPLETE) => {
+            context.insert("missing", &user_missing_attributes(err).unwrap_or_default());
+            context.insert("error", "");
+            render(StatusCode::OK, "profile.html", &context)
+        },
+        errors::UNAUTHORIZED | errors::NOT_FOUND | "Record not found" => {
+            context.insert("error", &translate("wrong email or password"));
+            render(StatusCode::UNAUTHORIZED, "login.html", &context)
+        },
+        errors::THROTTLED | errors::TOO_MANY_REQUESTS => {
+            context.insert("error", &translate(err));
+            render(StatusCode::TOO_MANY_REQUESTS, "login.html", &context)
+        },
+        errors::NOT_VERIFIED | errors::NOT_ACTIVATED | errors::SUSPENDED | errors::RESET_REQUIRED |
+        errors::CAPTCHA_REQUIRED | errors::LOGIN_DENIED | errors::IP_NOT_ALLOWED | errors::FEATURE_DISABLED |
+        errors::QUOTA_EXCEEDED | errors::ISSUANCE_DENIED => {
+            context.insert("error", &translate(err));
+            render(StatusCode::FORBIDDEN, "login.html", &context)
+        },
+        errors::OVERLOADED => {
+            render_error(StatusCode::SERVICE_UNAVAILABLE, errors::OVERLOADED, None, &target.locale)
+        },
+        _ => {
+            error!("hosted login has failed: {}", err);
+            render_error(StatusCode::INTERNAL_SERVER_ERROR, errors::HAS_FAILED, None, &target.locale)
+        },
+    }
+}
+
+/// Logs the user in with the credentials of the submitted form, which may come from the login page itself or any of
+/// the pages asking for what the login is missing. The password is digested here as clients do before sending it,
+/// and carried as such by the forms after the first one
+async fn login(request: hyper::Request<Body>, remote: SocketAddr, site: &Site) -> hyper::Response<Body> {
+    let csrf = get_cookie(&request, settings::WEB_CSRF_COOKIE_NAME).unwrap_or_default();
+    let bound = get_cookie(&request, settings::WEB_STATE_COOKIE_NAME).unwrap_or_default();
+    let locale = get_locale(&request);
+    let mut metadata = MetadataMap::from_headers(request.headers().clone());
+    if !metadata.contains_key("x-forwarded-for") {
+        if let Ok(ip) = remote.ip().to_string().parse() {
+            metadata.insert("x-forwarded-for", ip);
+        }
+    }
+
+    let mut grpc_request = tonic::Request::new(());
+    *grpc_request.metadata_mut() = metadata;
+    let origin = get_origin(&grpc_request);
+
+    let body = match hyper::body::to_bytes(request.into_body()).await {
+        Ok(body) if body.len() <= settings::WEB_MAX_BODY => body,
+        Ok(_) => return render_error(StatusCode::PAYLOAD_TOO_LARGE, "request too large", Some(&site.path), &locale),
+        Err(err) => return render_error(StatusCode::BAD_REQUEST, &err.to_string(), Some(&site.path), &locale),
+    };
+
+    let form = parse_params(&String::from_utf8_lossy(&body));
+    let target = Target::new(&form, &csrf, &locale).at(site);
+    let echoed = form.get("csrf").map(String::as_str).unwrap_or_default();
+    if csrf.len() == 0 || !security::constant_time_eq(&csrf, echoed) {
+        return render_error(StatusCode::FORBIDDEN, FORM_EXPIRED, Some(&site.path), &locale);
+    }
+
+    // the state of the form must be the one the login page has been requested with, by this very browser
+    if !target.has_valid_state() || !security::constant_time_eq(&bound, &state_digest(&csrf, &target.state)) {
+        return render_error(StatusCode::FORBIDDEN, INVALID_STATE, None, &locale);
+    }
+
+    let target = match target.resolve() {
+        Ok(target) => target,
+        Err(err) => {
+            debug!("app of the login form could not be resolved: {}", err);
+            return render_error(StatusCode::BAD_REQUEST, INVALID_APP, None, &locale);
+        },
+    };
+
+    let field = |name: &str| form.get(name).map(String::as_str).unwrap_or_default();
+    let digest = match field("password") {
+        password if password.len() > 0 => sha256::digest_bytes(password.as_bytes()),
+        _ => field("digest").to_string(),
+    };
+
+    let version = |name: &str| field(name).parse().unwrap_or_default();
+    let attributes: HashMap<String, String> = form.iter()
+        .filter_map(|(name, value)| name.strip_prefix("attribute.").map(|name| (name.to_string(), value.clone())))
+        .collect();
+
+    let token = match session_login(&target.tenant, field("email"), &digest, "", &[], field("totp"), &target.registered,
+                                    version("terms"), version("privacy"), &attributes, "", "", "", &origin) {
+        Ok(token) => token,
+        Err(err) => {
+            // throttled browsers are told how long to wait, as any other http client
+            let mut response = next_page(&target, &form, &digest, &err.to_string());
+            let retry = status::get_retry_after(&*err)
+                .and_then(|delay| status::as_retry_secs(delay).to_string().parse().ok());
+
+            if let Some(retry) = retry {
+                response.headers_mut().insert(RETRY_AFTER, retry);
+            }
+
+            return response;
+        },
+    };
+
+    let mut response = new_response(StatusCode::SEE_OTHER, Body::empty());
+    if let Ok(location) = target.get_callback().parse() {
+        response.headers_mut().insert(LOCATION, location);
+    }
+
+    if let Some(cookie) = new_cookie_header(settings::COOKIE_NAME, &token).and_then(|header| header.parse().ok()) {
+        response.headers_mut().append(SET_COOKIE, cookie);
+    }
+
+    // neither the csrf cookie nor the state one are of any use once logged in
+    for name in &[settings::WEB_CSRF_COOKIE_NAME, settings::WEB_STATE_COOKIE_NAME] {
+        let expired = format!("{}=; Path={}; Max-Age=0", name, target.path);
+        if let Ok(expired) = expired.parse() {
+            response.headers_mut().append(SET_COOKIE, expired);
+        }
+    }
+
+    response
+}
+
+/// Returns the name of the tenant the given path asks the key set of: none for the default tenant at
+/// /.well-known/jwks.json, and the given one at /tenants/<tenant>/.well-known/jwks.json
+fn parse_jwks_path(path: &str) -> Option<&str> {
+    parse_tenant_path(path, JWKS_PATH)
+}
+
+/// Returns the name of the tenant the given path pins the login pages to: none at /login, and the given one at
+/// /tenants/<tenant>/login
+fn parse_login_path(path: &str) -> Option<&str> {
+    parse_tenant_path(path, LOGIN_PATH)
+}
+
+/// Returns the name of the tenant the given path asks the change-password url of, as password managers do: none at
+/// /.well-known/change-password, and the given one at /tenants/<tenant>/.well-known/change-password
+fn parse_change_password_path(path: &str) -> Option<&str> {
+    parse_tenant_path(path, CHANGE_PASSWORD_PATH)
+}
+
+/// Returns the name of the tenant the given path serves the change-password page of: none at /password, and the given
+/// one at /tenants/<tenant>/password
+fn parse_password_path(path: &str) -> Option<&str> {
+    parse_tenant_path(path, PASSWORD_PATH)
+}
+
+/// Returns the path of the change-password page of the given tenant, the default one if none
+fn get_password_path(tenant: &str) -> String {
+    match tenant {
+        "" => PASSWORD_PATH.to_string(),
+        tenant => format!("{}{}{}", TENANTS_PATH, tenant, PASSWORD_PATH),
+    }
+}
+
+fn parse_tenant_path<'a>(path: &'a str, suffix: &str) -> Option<&'a str> {
+    if path == suffix {
+        return Some("");
+    }
+
+    path.strip_prefix(TENANTS_PATH)
+        .and_then(|path| path.strip_suffix(suffix))
+        .filter(|tenant| tenant.len() > 0 && !tenant.contains('/'))
+}
+
+/// Serves the public keys the tokens of the given tenant are verified by, as a json web key set
+fn jwks(tenant: &str) -> hyper::Response<Body> {
+    let jwks = tenant_find(tenant).and_then(|tenant| security::get_jwks(&tenant_key_set(tenant.get_id())));
+    let jwks = match jwks {
+        Ok(jwks) => jwks,
+        Err(err) => {
+            warn!("key set of tenant {} could not be served: {}", tenant, err);
+            return new_response(StatusCode::NOT_FOUND, Body::empty());
+        }
+    };
+
+    let mut response = new_response(StatusCode::OK, Body::from(jwks.to_string()));
+    response.headers_mut().insert(CONTENT_TYPE, JSON_CONTENT_TYPE.parse().unwrap());
+    response
+}
+
+/// Redirects browsers and password managers asking for the well-known change-password url to the change-password page
+/// of the same tenant, so users warned about a breached password are taken right to the page rotating it
+fn change_password_redirect(tenant: &str) -> hyper::Response<Body> {
+    let mut response = new_response(StatusCode::SEE_OTHER, Body::empty());
+    if let Ok(location) = get_password_path(tenant).parse() {
+        response.headers_mut().insert(LOCATION, location);
+    }
+
+    response
+}
+
+/// Returns the context of the change-password page posting its form to the given path
+fn password_context(path: &str, csrf: &str, email: &str, locale: &str) -> Context {
+    let mut context = new_context(None, locale);
+    context.insert("password_path", path);
+    context.insert("csrf", csrf);
+    context.insert("email", email);
+    context.insert("error", "");
+    context.insert("done", &false);
+    context
+}
+
+/// Serves the page changing the password of the user logged in by the token cookie of the browser, along with a new
+/// csrf cookie its form must echo. The email of the user is rendered on the form as well, so password managers can
+/// tell which credential to update. Browsers with no open session are told to log in first
+fn password_page(request: &hyper::Request<Body>, path: &str) -> hyper::Response<Body> {
+    let locale = get_locale(request);
+    let user = match user_info(&get_token(request)) {
+        Ok((user, _)) => user,
+        Err(err) => {
+            debug!("change-password page requested with no open session: {}", err);
+            return render_error(StatusCode::UNAUTHORIZED, LOGIN_REQUIRED, None, &locale);
+        },
+    };
+
+    let csrf = security::get_random_string(settings::WEB_CSRF_LEN);
+    let context = password_context(path, &csrf, user.get_email(), &locale);
+    let mut response = render(StatusCode::OK, "password.html", &context);
+    let cookie = format!("{}={}; Path={}; HttpOnly; SameSite=Strict", settings::WEB_CSRF_COOKIE_NAME, csrf, path);
+    if let Ok(cookie) = cookie.parse() {
+        response.headers_mut().append(SET_COOKIE, cookie);
+    }
+
+    response
+}
+
+/// Changes the password of the user logged in by the token cookie of the browser, given its current one, and its mfa
+/// code if it has 2FA activated, as the submitted form tells. Both passwords are digested here as clients do before
+/// sending them
+async fn change_password(request: hyper::Request<Body>, path: &str) -> hyper::Response<Body> {
+    let csrf = get_cookie(&request, settings::WEB_CSRF_COOKIE_NAME).unwrap_or_default();
+    let token = get_token(&request);
+    let locale = get_locale(&request);
+
+    let body = match hyper::body::to_bytes(request.into_body()).await {
+        Ok(body) if body.len() <= settings::WEB_MAX_BODY => body,
+        Ok(_) => return render_error(StatusCode::PAYLOAD_TOO_LARGE, "request too large", Some(path), &locale),
+        Err(err) => return render_error(StatusCode::BAD_REQUEST, &err.to_string(), Some(path), &locale),
+    };
+
+    let form = parse_params(&String::from_utf8_lossy(&body));
+    let echoed = form.get("csrf").map(String::as_str).unwrap_or_default();
+    if csrf.len() == 0 || !security::constant_time_eq(&csrf, echoed) {
+        return render_error(StatusCode::FORBIDDEN, FORM_EXPIRED, Some(path), &locale);
+    }
+
+    let user = match user_info(&token) {
+        Ok((user, _)) => user,
+        Err(_) => return render_error(StatusCode::UNAUTHORIZED, LOGIN_REQUIRED, None, &locale),
+    };
+
+    let field = |name: &str| form.get(name).map(String::as_str).unwrap_or_default();
+    let digest = |name: &str| sha256::digest_bytes(field(name).as_bytes());
+    let mut context = password_context(path, &csrf, user.get_email(), &locale);
+    if field("new_password").len() == 0 {
+        context.insert("error", &i18n::translate_error(&locale, errors::INVALID_REQUEST));
+        return render(StatusCode::BAD_REQUEST, "password.html", &context);
+    }
+
+    match user_change_password(&token, &digest("password"), &digest("new_password"), field("totp")) {
+        Ok(_) => {
+            context.insert("done", &true);
+            let mut response = render(StatusCode::OK, "password.html", &context);
+            let expired = format!("{}=; Path={}; Max-Age=0", settings::WEB_CSRF_COOKIE_NAME, path);
+            if let Ok(expired) = expired.parse() {
+                response.headers_mut().append(SET_COOKIE, expired);
+            }
+
+            response
+        },
+        Err(err) => match err.to_string().as_str() {
+            errors::NOT_FOUND | errors::UNAUTHORIZED => {
+                context.insert("error", &i18n::translate_error(&locale, WRONG_CREDENTIALS));
+                render(StatusCode::UNAUTHORIZED, "password.html", &context)
+            },
+            _ => {
+                error!("hosted password change has failed: {}", err);
+                render_error(StatusCode::INTERNAL_SERVER_ERROR, errors::HAS_FAILED, Some(path), &locale)
+            },
+        },
+    }
+}
+
+async fn handle(request: hyper::Request<Body>, remote: SocketAddr) -> Result<hyper::Response<Body>, Infallible> {
+    let locale = get_locale(&request);
+    if let Some(site) = Site::new(&request) {
+        let response = match request.method() {
+            &Method::GET => login_page(&request, &site),
+            &Method::POST => login(request, remote, &site).await,
+            _ => render_error(StatusCode::METHOD_NOT_ALLOWED, "method not allowed", Some(&site.path), &locale),
+        };
+
+        return Ok(response);
+    }
+
+    let path = request.uri().path().to_string();
+    if parse_password_path(&path).is_some() {
+        let response = match request.method() {
+            &Method::GET => password_page(&request, &path),
+            &Method::POST => change_password(request, &path).await,
+            _ => render_error(StatusCode::METHOD_NOT_ALLOWED, "method not allowed", Some(&path), &locale),
+        };
+
+        return Ok(response);
+    }
+
+    let response = match (request.method(), request.uri().path()) {
+        (&Method::GET, path) if parse_change_password_path(path).is_some() => {
+            change_password_redirect(parse_change_password_path(path).unwrap_or_default())
+        },
+        (&Method::GET, path) if parse_jwks_path(path).is_some() => {
+            // the key set of the default path is the one of the tenant the host is bound to, if any
+            let tenant = match parse_jwks_path(path).unwrap_or_default() {
+                "" => get_host_tenant(&request).unwrap_or_default(),
+                tenant => tenant.to_string(),
+            };
+
+            jwks(&tenant)
+        },
+        _ => render_error(StatusCode::NOT_FOUND, errors::NOT_FOUND, None, &locale),
+    };
+
+    Ok(response)
+}
+
+/// Serves the hosted login pages at the /login path of the given address: the login form itself and, as required by
+/// the same transaction the grpc login goes through, the pages asking for the mfa code and the acceptance of the
+/// latest policies. Once logged in, the token is set as cookie and the user redirected back to the app. The key set of
+/// each tenant is served as well, at its JWKS endpoint, and so is the change-password page, at /password, which the
+/// well-known change-password url redirects to
+pub async fn serve(addr: SocketAddr) -> Result<(), Box<dyn Error + Send + Sync>> {
+    // pages are allowed their inline styles and images, besides posting the forms they render
+    let headers = HeadersLayer::new().with(CONTENT_SECURITY_POLICY, PAGES_SECURITY_POLICY);
+    let make_service = make_service_fn(move |conn: &AddrStream| {
+        let (remote, headers) = (conn.remote_addr(), headers.clone());
+        async move {
+            Ok::<_, Infallible>(headers.layer(service_fn(move |request| handle(request, remote))))
+        }
+    });
+
+    Server::try_bind(&addr)?.serve(make_service).await?;
+    Ok(())
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::collections::HashMap;
+    use crate::fuzz::fuzz_str;
+    use std::env;
+    use hyper::Body;
+    use crate::constants::environment;
+    use super::{Target, Site, TERA, new_context, parse_params, parse_jwks_path, parse_login_path,
+                with_error, with_param, state_digest, get_host_tenant, parse_change_password_path, parse_password_path,
+                get_password_path, change_password_redirect, password_context};
+
+    #[test]
+    fn parse_params_should_not_fail() {
+        let params = parse_params("email=alice%40example.com&password=a+b%26c&email=bob&empty=");
+        assert_eq!("alice@example.com", params["email"]);
+        assert_eq!("a b&c", params["password"]);
+        assert_eq!("", params["empty"]);
+        assert!(parse_params("").is_empty());
+    }
+
+    #[test]
+    fn fuzz_parse_params() {
+        fuzz_str(&["email=alice%40example.com&password=a+b%26c", "app=https%3A%2F%2Fapp.example.com&redirect=%2F",
+                   "app=https%3A%2F%2Fevil.com&redirect=https%3A%2F%2Fevil.com%2Fhome", "%", "%%4", "%zz=%e2%82%ac&&=",
+                   "a=b=c"], |encoded| {
+            let params = parse_params(encoded);
+            let target = resolved_target(&params, "https://app.example.com");
+
+            // redirects must never leave the registered url of the app, whatever the params tell, and fall back to it
+            let redirect = target.get_redirect();
+            assert!(redirect.starts_with("https://app.example.com"));
+            if !params.get("redirect").map(|url| url.starts_with("https://app.example.com")).unwrap_or_default() {
+                assert_eq!("https://app.example.com", redirect);
+            }
+
+            // nor do they go anywhere at all before the app gets resolved
+            assert_eq!("", Target::new(&params, "", "en").get_redirect());
+        });
+    }
+
+    fn resolved_target(params: &HashMap<String, String>, registered: &str) -> Target {
+        let mut target = Target::new(params, "", "en");
+        target.registered = registered.to_string();
+        target
+    }
+
+    #[test]
+    fn target_get_redirect_should_not_fail() {
+        let mut params = HashMap::new();
+        params.insert("app".to_string(), "https://app.example.com".to_string());
+
+        params.insert("redirect".to_string(), "https://app.example.com/home?tab=1".to_string());
+        assert_eq!("https://app.example.com/home?tab=1",
+                   resolved_target(&params, "https://app.example.com").get_redirect());
+
+        params.insert("redirect".to_string(), "https://app.example.com".to_string());
+        assert_eq!("https://app.example.com", resolved_target(&params, "https://app.example.com").get_redirect());
+    }
+
+    #[test]
+    fn target_get_redirect_should_fail() {
+        let mut params = HashMap::new();
+        params.insert("app".to_string(), "https://app.example.com".to_string());
+
+        params.insert("redirect".to_string(), "https://app.example.com.evil.com/home".to_string());
+        assert_eq!("https://app.example.com", resolved_target(&params, "https://app.example.com").get_redirect());
+
+        params.insert("redirect".to_string(), "https://evil.com".to_string());
+        assert_eq!("https://app.example.com", resolved_target(&params, "https://app.example.com").get_redirect());
+
+        // neither the app nor the redirect told by the request are ever trusted before the app gets resolved
+        params.insert("app".to_string(), "https://evil.com".to_string());
+        assert_eq!("", Target::new(&params, "", "en").get_redirect());
+    }
+
+    #[test]
+    fn with_error_should_not_fail() {
+        assert_eq!("https://app.example.com?error=login_required", with_error("https://app.example.com", "login_required"));
+        assert_eq!("https://app.example.com/home?tab=1&error=login_required#top",
+                   with_error("https://app.example.com/home?tab=1#top", "login_required"));
+        assert_eq!("https://app.example.com/?error=login_required#a?b",
+                   with_error("https://app.example.com/#a?b", "login_required"));
+    }
+
+    #[test]
+    fn with_param_should_not_fail() {
+        assert_eq!("https://app.example.com?state=a%2Bb%26c%3D", with_param("https://app.example.com", "state", "a+b&c="));
+        assert_eq!("https://app.example.com/home?tab=1&state=xyz-_.~#top",
+                   with_param("https://app.example.com/home?tab=1#top", "state", "xyz-_.~"));
+    }
+
+    #[test]
+    fn target_get_callback_should_not_fail() {
+        let mut params = HashMap::new();
+        params.insert("app".to_string(), "https://app.example.com".to_string());
+        params.insert("redirect".to_string(), "https://evil.com".to_string());
+        params.insert("state".to_string(), "af0 ifjsldkj".to_string());
+
+        let target = resolved_target(&params, "https://app.example.com");
+        assert!(target.has_valid_state());
+        assert_eq!("https://app.example.com?state=af0%20ifjsldkj", target.get_callback());
+    }
+
+    #[test]
+    fn target_has_valid_state_should_fail() {
+        let mut params = HashMap::new();
+        params.insert("app".to_string(), "https://app.example.com".to_string());
+        assert!(!Target::new(&params, "", "en").has_valid_state());
+
+        params.insert("state".to_string(), "a".repeat(513));
+        assert!(!Target::new(&params, "", "en").has_valid_state());
+    }
+
+    #[test]
+    fn state_digest_should_not_fail() {
+        assert_eq!(state_digest("csrf", "state"), state_digest("csrf", "state"));
+        assert_ne!(state_digest("csrf", "state"), state_digest("csrf", "other"));
+        assert_ne!(state_digest("csrf", "state"), state_digest("other", "state"));
+    }
+
+    #[test]
+    fn parse_jwks_path_should_not_fail() {
+        assert_eq!(Some(""), parse_jwks_path("/.well-known/jwks.json"));
+        assert_eq!(Some("acme"), parse_jwks_path("/tenants/acme/.well-known/jwks.json"));
+        assert_eq!(None, parse_jwks_path("/tenants//.well-known/jwks.json"));
+        assert_eq!(None, parse_jwks_path("/tenants/acme/other/.well-known/jwks.json"));
+        assert_eq!(None, parse_jwks_path("/login"));
+    }
+
+    #[test]
+    fn parse_login_path_should_not_fail() {
+        assert_eq!(Some(""), parse_login_path("/login"));
+        assert_eq!(Some("acme"), parse_login_path("/tenants/acme/login"));
+        assert_eq!(None, parse_login_path("/tenants//login"));
+        assert_eq!(None, parse_login_path("/tenants/acme/other/login"));
+        assert_eq!(None, parse_login_path("/.well-known/jwks.json"));
+    }
+
+    #[test]
+    fn parse_password_path_should_not_fail() {
+        assert_eq!(Some(""), parse_change_password_path("/.well-known/change-password"));
+        assert_eq!(Some("acme"), parse_change_password_path("/tenants/acme/.well-known/change-password"));
+        assert_eq!(None, parse_change_password_path("/password"));
+
+        assert_eq!(Some(""), parse_password_path("/password"));
+        assert_eq!(Some("acme"), parse_password_path("/tenants/acme/password"));
+        assert_eq!(None, parse_password_path("/tenants//password"));
+        assert_eq!(None, parse_password_path("/.well-known/change-password"));
+    }
+
+    #[test]
+    fn change_password_redirect_should_not_fail() {
+        assert_eq!("/password", get_password_path(""));
+        assert_eq!("/tenants/acme/password", get_password_path("acme"));
+
+        let response = change_password_redirect("acme");
+        assert_eq!(303, response.status().as_u16());
+        assert_eq!("/tenants/acme/password", response.headers().get("location").unwrap());
+    }
+
+    #[test]
+    fn render_password_should_not_fail() {
+        let context = password_context("/password", "csrf", "alice@example.com", "en");
+        let html = TERA.render("password.html", &context).unwrap();
+
+        // password managers tell the credential to update by the username and the autocomplete of each field
+        assert!(html.contains("value=\"alice@example.com\" autocomplete=\"username\""));
+        assert!(html.contains("autocomplete=\"current-password\""));
+        assert!(html.contains("autocomplete=\"new-password\""));
+        assert!(html.contains("action=\"/password\""));
+    }
+
+    #[test]
+    fn get_host_tenant_should_not_fail() {
+        env::set_var(environment::WEB_TENANT_HOSTS, "login.acme.com=acme, login.initech.com=initech");
+        let request = |host: &str| hyper::Request::builder()
+            .uri("/login")
+            .header("host", host)
+            .body(Body::empty())
+            .unwrap();
+
+        assert_eq!(Some("acme".to_string()), get_host_tenant(&request("Login.Acme.com:8443")));
+        assert_eq!(Some("initech".to_string()), get_host_tenant(&request("login.initech.com")));
+        assert_eq!(None, get_host_tenant(&request("login.example.com")));
+    }
+
+    #[test]
+    fn target_at_should_not_fail() {
+        let mut params = HashMap::new();
+        params.insert("tenant".to_string(), "initech".to_string());
+
+        // the tenant a site is pinned to cannot be overridden by the forms
+        let site = Site {path: "/tenants/acme/login".to_string(), tenant: Some("acme".to_string())};
+        let target = Target::new(&params, "", "en").at(&site);
+        assert_eq!("acme", target.tenant);
+        assert_eq!("/tenants/acme/login", target.path);
+
+        let site = Site {path: "/login".to_string(), tenant: None};
+        let target = Target::new(&params, "", "en").at(&site);
+        assert_eq!("initech", target.tenant);
+        assert_eq!("/login", target.path);
+    }
+
+    #[test]
+    fn render_should_escape_html() {
+        let mut context = new_context(None, "en");
+        context.insert("error", "<script>alert(1)</script>");
+        context.insert("back", &None::<String>);
+
+        let html = TERA.render("error.html", &context).unwrap();
+        assert!(!html.contains("<script>"));
+        assert!(html.contains("&lt;script&gt;"));
+    }
+
+    #[test]
+    fn render_should_localize() {
+        let mut context = new_context(None, "es");
+        context.insert("error", "");
+        context.insert("back", &Some("/login"));
+
+        let html = TERA.render("error.html", &context).unwrap();
+        assert!(html.contains("<html lang=\"es\">"));
+        assert!(html.contains("Algo ha ido mal"));
+        assert!(html.contains("Volver"));
+    }
+}
@@ -0,0 +1,149 @@
+use std::error::Error;
+use std::time::SystemTime;
+use crate::metadata::domain::Metadata;
+use crate::constants::{errors, settings};
+use crate::pagination::Page;
+use crate::audit::domain::Event;
+use crate::security;
+use crate::user::get_repository as get_user_repository;
+use crate::tenant::application::{tenant_issuer, tenant_key_set};
+use super::{
+    get_repository as get_webhook_repository,
+    get_delivery_repository,
+    get_sender,
+    domain::{Webhook, Delivery, DeliveryStatus, Format, SecurityEventToken, get_topics, is_lifecycle, is_logout},
+};
+
+const SECURITY_EVENT_TYPE: &str = "secevent+jwt";
+
+/// Registers a new webhook of the given tenant, subscribed to the given topics and delivered in the given format.
+/// Returns the webhook along with its secret, which is the only time it is told
+pub fn webhook_register(tenant: i32,
+                        url: &str,
+                        topics: &[String],
+                        format: Format) -> Result<Webhook, Box<dyn Error>> {
+
+    info!("got a webhook registration request for url {} ", url);
+
+    let mut webhook = Webhook::new(Metadata::new(), tenant, url, topics, format)?;
+    get_webhook_repository().create(&mut webhook)?;
+    Ok(webhook)
+}
+
+/// Removes the webhook with the given id, as well as its delivery log
+pub fn webhook_delete(id: i32) -> Result<(), Box<dyn Error>> {
+    info!("got a webhook deletion request for webhook {} ", id);
+
+    let webhook = get_webhook_repository().find(id)?;
+    get_webhook_repository().delete(&webhook)
+}
+
+/// Returns the given page of the delivery log of the given webhook, from the newest delivery to the oldest one, and the
+/// token of the next page, if any
+pub fn webhook_deliveries(id: i32, page: &Page) -> Result<(Vec<Delivery>, String), Box<dyn Error>> {
+    let before = match page.get_cursor() {
+        "" => 0,
+        cursor => cursor.parse::<i32>().map_err(|_| errors::INVALID_PAGE_TOKEN)?,
+    };
+
+    let webhook = get_webhook_repository().find(id)?;
+    let mut deliveries = get_delivery_repository().find_by_webhook(webhook.get_id(), before, page.get_limit())?;
+    let next = page.next_token(&mut deliveries, |delivery| delivery.get_id().to_string());
+    Ok((deliveries, next))
+}
+
+/// Schedules a delivery of the given event to every webhook of the tenant it belongs to that is subscribed to any of
+/// its topics, once per topic. Returns how many deliveries have been scheduled
+pub fn webhook_notify(event: &Event) -> Result<usize, Box<dyn Error>> {
+    let topics = get_topics(event.get_kind());
+    if topics.is_empty() {
+        return Ok(0); // events of this kind are not notified
+    }
+
+    // deleted users are still told about, since their deletion and erasure are notified as well
+    let user = get_user_repository().find_any(event.get_user())?;
+    let webhooks = get_webhook_repository().find_all_by_tenant(user.get_tenant())?;
+    let mut count = 0;
+    for (webhook, topic) in webhooks.iter().flat_map(|webhook| topics.iter().map(move |topic| (webhook, *topic))) {
+        if !webhook.is_subscribed(topic) {
+            continue;
+        }
+
+        let mut delivery = match webhook.get_format() {
+            Format::Json if is_lifecycle(topic) => Delivery::new_lifecycle(webhook, topic, event, &user),
+            Format::Json if is_logout(topic) => Delivery::new_logout(webhook, topic, event),
+            Format::Json => Delivery::new(webhook, topic, event),
+            Format::SecurityEvent => {
+                // security event tokens are signed just like any other token of the tenant, so receivers may verify
+                // them by its jwks
+                let issuer = tenant_issuer(user.get_tenant());
+                let claim = SecurityEventToken::new(webhook, &issuer, user.get_email(), topic, event)?;
+                let token = security::encode_jwt_as(&tenant_key_set(user.get_tenant()), SECURITY_EVENT_TYPE, claim)?;
+                Delivery::new_security_event(webhook, topic, event, &token)
+            },
+        };
+
+        get_delivery_repository().create(&mut delivery)?;
+        count += 1;
+    }
+
+    Ok(count)
+}
+
+/// Schedules a brand new delivery of every delivery of the given webhook created since the given time, whatever its
+/// outcome, the oldest first, so the endpoint gets them all again, such as after restoring its data. Only the given
+/// topics are replayed, if any. Returns how many deliveries have been scheduled, up to WEBHOOK_REPLAY_MAX
+pub fn webhook_replay(id: i32, since: SystemTime, topics: &[String]) -> Result<usize, Box<dyn Error>> {
+    info!("got a replay request for webhook {} ", id);
+
+    let webhook = get_webhook_repository().find(id)?;
+    let mut replayed = Vec::new();
+    let mut before = 0;
+    'pages: loop {
+        let deliveries = get_delivery_repository().find_by_webhook(webhook.get_id(), before, settings::WEBHOOK_BATCH)?;
+        for delivery in deliveries.iter() {
+            if delivery.get_created_at() < since || replayed.len() >= settings::WEBHOOK_REPLAY_MAX {
+                break 'pages;
+            }
+
+            if topics.is_empty() || topics.iter().any(|topic| topic == delivery.get_topic()) {
+                replayed.push(delivery.replay());
+            }
+        }
+
+        match deliveries.last() {
+            Some(last) if deliveries.len() as u64 == settings::WEBHOOK_BATCH => before = last.get_id(),
+            _ => break,
+        }
+    }
+
+    // the ones found are the newest first, while they are replayed in the order they were made
+    for delivery in replayed.iter_mut().rev() {
+        get_delivery_repository().create(delivery)?;
+    }
+
+    Ok(replayed.len())
+}
+
+/// Attempts up to limit deliveries whose time has come, the oldest first, recording the outcome of each of them.
+/// Returns how many deliveries have been attempted
+pub fn webhook_deliver(limit: u64) -> Result<usize, Box<dyn Error>> {
+    let due = get_delivery_repository().find_due(limit)?;
+    for mut delivery in due.iter().cloned() {
+        let outcome = match get_webhook_repository().find(delivery.get_webhook()) {
+            Ok(webhook) => get_sender().send(&webhook, &delivery),
+            Err(err) => Err(err),
+        };
+
+        delivery.record(outcome);
+        match delivery.get_status() {
+            DeliveryStatus::Delivered => info!("delivery {} to webhook {} has succeeded", delivery.get_id(), delivery.get_webhook()),
+            DeliveryStatus::Failed => warn!("delivery {} to webhook {} has failed for good: {}", delivery.get_id(), delivery.get_webhook(), delivery.get_error()),
+            DeliveryStatus::Pending => warn!("delivery {} to webhook {} has failed: {}", delivery.get_id(), delivery.get_webhook(), delivery.get_error()),
+        }
+
+        get_delivery_repository().save(&delivery)?;
+    }
+
+    Ok(due.len())
+}
@@ -0,0 +1,748 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use openssl::hash::MessageDigest;
+use openssl::pkey::PKey;
+use openssl::sign::Signer;
+use http::Uri;
+use crate::security;
+use crate::constants::{errors, settings};
+use crate::metadata::domain::{Metadata, InnerMetadata};
+use crate::audit::domain::{Event, EventKind};
+use crate::user::domain::User;
+use crate::session::domain::LogoutReason;
+use crate::time::{self, unix_timestamp};
+
+pub trait WebhookRepository {
+    fn find(&self, id: i32) -> Result<Webhook, Box<dyn Error>>;
+    fn find_all_by_tenant(&self, tenant_id: i32) -> Result<Vec<Webhook>, Box<dyn Error>>;
+    fn create(&self, webhook: &mut Webhook) -> Result<(), Box<dyn Error>>;
+    fn delete(&self, webhook: &Webhook) -> Result<(), Box<dyn Error>>;
+}
+
+pub trait DeliveryRepository {
+    // up to limit deliveries of the given webhook created before the one with the given id, the newest first, or the
+    // latest ones if the id is zero
+    fn find_by_webhook(&self, webhook_id: i32, before: i32, limit: u64) -> Result<Vec<Delivery>, Box<dyn Error>>;
+    // up to limit pending deliveries whose next attempt is due, the oldest first
+    fn find_due(&self, limit: u64) -> Result<Vec<Delivery>, Box<dyn Error>>;
+    fn create(&self, delivery: &mut Delivery) -> Result<(), Box<dyn Error>>;
+    fn save(&self, delivery: &Delivery) -> Result<(), Box<dyn Error>>;
+}
+
+pub trait DeliverySender {
+    // posts the given delivery, returning the status code of the response
+    fn send(&self, webhook: &Webhook, delivery: &Delivery) -> Result<u16, Box<dyn Error>>;
+}
+
+// version of the json schema users are told to lifecycle webhooks by, increased on every breaking change
+pub const USER_SCHEMA_VERSION: u32 = 1;
+
+/// All the events webhooks may subscribe to, each of them standing for a kind of event of the audit trail. The same
+/// kind of event may be notified by many topics
+pub const TOPICS: &[(&str, EventKind)] = &[
+    ("user.created", EventKind::Signup),
+    ("user.verified", EventKind::Verify),
+    ("user.activated", EventKind::Activate),
+    ("user.suspended", EventKind::Suspend),
+    ("user.reinstated", EventKind::Reinstate),
+    ("user.deleted", EventKind::Delete),
+    ("user.restored", EventKind::Restore),
+    ("user.erased", EventKind::Erase),
+    ("login.failed", EventKind::LoginFailed),
+    ("session.logged_out", EventKind::Logout),
+    ("session.revoked", EventKind::Revoke),
+    ("session.logged_out_everywhere", EventKind::GlobalLogout),
+    ("consent.granted", EventKind::Consent),
+    ("credential.changed", EventKind::PasswordReset),
+    ("account.disabled", EventKind::Suspend),
+];
+
+const CAEP_EVENT_TYPE: &str = "https://schemas.openid.net/secevent/caep/event-type/";
+const RISC_EVENT_TYPE: &str = "https://schemas.openid.net/secevent/risc/event-type/";
+
+/// Returns all the topics the given kind of event is notified as, none if it is not notified at all
+pub fn get_topics(kind: EventKind) -> Vec<&'static str> {
+    TOPICS.iter().filter(|(_, other)| *other == kind).map(|(topic, _)| *topic).collect()
+}
+
+/// Returns whether the given topic tells about a transition of the lifecycle of an account, whose deliveries tell the
+/// account as it is left by the transition, so downstream systems can keep a copy of it
+pub fn is_lifecycle(topic: &str) -> bool {
+    topic.starts_with("user.")
+}
+
+/// Returns whether the given topic tells about sessions coming to an end, whose deliveries tell why as well, so apps
+/// relying on them can tell their users accordingly, as back-channel logout notifications do
+pub fn is_logout(topic: &str) -> bool {
+    topic.starts_with("session.")
+}
+
+/// Returns why the sessions the given event tells about have come to an end, if it is known
+fn get_logout_reason(event: &Event) -> Option<LogoutReason> {
+    LogoutReason::from_description(event.get_reason())
+}
+
+/// Returns the state the given user is left in by the transition the given lifecycle topic stands for
+fn get_state(user: &User, topic: &str) -> &'static str {
+    if topic == "user.erased" {
+        "erased"
+    } else if user.is_deleted() {
+        "deleted"
+    } else if user.is_suspended() {
+        "suspended"
+    } else if user.is_pending() {
+        "pending"
+    } else {
+        "active"
+    }
+}
+
+/// Returns the account of the given user as told to lifecycle webhooks, following the schema of schemas/user.v1.json
+pub fn export_user(user: &User, topic: &str) -> serde_json::Value {
+    serde_json::json!({
+        "version": USER_SCHEMA_VERSION,
+        "id": user.get_id(),
+        "tenant": user.get_tenant(),
+        "email": user.get_email(),
+        "verified": user.is_verified(),
+        "state": get_state(user, topic),
+    })
+}
+
+/// Returns the type of the security event the given topic is notified as, by webhooks receiving security event tokens,
+/// if any: sessions ended and credentials changed as told by CAEP, and accounts disabled as told by RISC
+pub fn get_event_type(topic: &str) -> Option<String> {
+    match topic {
+        "session.logged_out" | "session.revoked" | "session.logged_out_everywhere" => {
+            Some(format!("{}session-revoked", CAEP_EVENT_TYPE))
+        },
+        "credential.changed" => Some(format!("{}credential-change", CAEP_EVENT_TYPE)),
+        "account.disabled" => Some(format!("{}account-disabled", RISC_EVENT_TYPE)),
+        _ => None,
+    }
+}
+
+/// Returns the signature a delivery is sent along with: the HMAC-SHA256 of its timestamp and body, joined by a dot,
+/// keyed by the secret of the webhook, as a hex string
+pub fn sign(secret: &str, timestamp: usize, body: &str) -> Result<String, Box<dyn Error>> {
+    let key = PKey::hmac(secret.as_bytes())?;
+    let mut signer = Signer::new(MessageDigest::sha256(), &key)?;
+    signer.update(timestamp.to_string().as_bytes())?;
+    signer.update(b".")?;
+    signer.update(body.as_bytes())?;
+
+    let signature: Vec<String> = signer.sign_to_vec()?.iter().map(|byte| format!("{:02x}", byte)).collect();
+    Ok(signature.join(""))
+}
+
+/// All the formats a webhook may receive its deliveries in
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum Format {
+    Json,          // a json object with the event, signed by the secret of the webhook
+    SecurityEvent, // a security event token (RFC 8417), signed by the signing key of the tenant, as pushed by RFC 8935
+}
+
+impl Format {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Format::Json => "json",
+            Format::SecurityEvent => "set",
+        }
+    }
+
+    pub fn from_str(format: &str) -> Option<Self> {
+        match format {
+            "json" => Some(Format::Json),
+            "set" => Some(Format::SecurityEvent),
+            _ => None,
+        }
+    }
+}
+
+/// An endpoint of a tenant receiving the events it subscribes to
+#[derive(Clone)]
+pub struct Webhook {
+    pub(super) id: i32,
+    pub(super) tenant: i32,
+    pub(super) url: String,
+    pub(super) secret: String,      // the key deliveries are signed by
+    pub(super) topics: Vec<String>, // the topics the webhook is subscribed to
+    pub(super) format: Format,
+    pub(super) meta: Metadata,
+}
+
+impl Webhook {
+    pub fn new(meta: Metadata,
+               tenant: i32,
+               url: &str,
+               topics: &[String],
+               format: Format) -> Result<Self, Box<dyn Error>> {
+
+        // unlike the url of an app, the one of a webhook is an endpoint, so it may have any path
+        let uri: Uri = url.parse()?;
+        if !matches!(uri.scheme_str(), Some("http") | Some("https")) || uri.host().is_none() {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        if topics.len() == 0 || topics.iter().any(|topic| !TOPICS.iter().any(|(other, _)| other == topic)) {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        // receivers of security events are only told about the topics standing for any of them
+        if format == Format::SecurityEvent && topics.iter().any(|topic| get_event_type(topic).is_none()) {
+            return Err(errors::PARSE_FAILED.into());
+        }
+
+        let webhook = Webhook {
+            id: 0,
+            tenant: tenant,
+            url: url.to_string(),
+            secret: security::get_random_string(settings::WEBHOOK_SECRET_LEN),
+            topics: topics.to_vec(),
+            format: format,
+            meta: meta,
+        };
+
+        Ok(webhook)
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_tenant(&self) -> i32 {
+        self.tenant
+    }
+
+    pub fn get_url(&self) -> &str {
+        &self.url
+    }
+
+    pub fn get_secret(&self) -> &str {
+        &self.secret
+    }
+
+    pub fn get_topics(&self) -> &[String] {
+        &self.topics
+    }
+
+    pub fn get_format(&self) -> Format {
+        self.format
+    }
+
+    pub fn is_subscribed(&self, topic: &str) -> bool {
+        self.topics.iter().any(|other| other == topic)
+    }
+}
+
+// token telling a webhook about a security event of one of its users, as RFC 8417 defines it
+#[derive(Serialize, Deserialize)]
+pub struct SecurityEventToken {
+    pub(super) iss: String,               // issuer, as the tokens of the tenant tell it
+    pub(super) iat: usize,                // issued at: the time the event happened
+    pub(super) jti: String,               // the id of the event, so receivers can deduplicate it
+    pub(super) aud: String,               // the url of the webhook
+    pub(super) sub_id: serde_json::Value, // the subject of the event, as RFC 9493 identifies it
+    pub(super) events: serde_json::Value, // the event, keyed by its type
+}
+
+impl SecurityEventToken {
+    pub fn new(webhook: &Webhook, issuer: &str, email: &str, topic: &str, event: &Event) -> Result<Self, Box<dyn Error>> {
+        let event_type = get_event_type(topic).ok_or(errors::NOT_FOUND)?;
+        let timestamp = unix_timestamp(event.get_created_at());
+        let mut payload = serde_json::json!({
+            "event_timestamp": timestamp,
+        });
+
+        if topic == "credential.changed" {
+            payload["credential_type"] = "password".into();
+            payload["change_type"] = "update".into();
+        }
+
+        if event.get_reason().len() > 0 {
+            payload["reason_admin"] = serde_json::json!({"en": event.get_reason()});
+        }
+
+        // the message the user may be shown, as CAEP tells it
+        if let Some(reason) = get_logout_reason(event).filter(|_| is_logout(topic)) {
+            payload["reason_user"] = serde_json::json!({"en": reason.get_message()});
+        }
+
+        let mut events = serde_json::Map::new();
+        events.insert(event_type, payload);
+        Ok(SecurityEventToken {
+            iss: issuer.to_string(),
+            iat: timestamp,
+            jti: event.get_id().to_string(),
+            aud: webhook.url.clone(),
+            sub_id: serde_json::json!({"format": "email", "email": email}),
+            events: serde_json::Value::Object(events),
+        })
+    }
+}
+
+/// All the states a delivery goes through
+#[derive(Clone, Copy, PartialEq, Debug)]
+pub enum DeliveryStatus {
+    Pending,   // not delivered yet, but to be attempted again
+    Delivered, // accepted by the endpoint
+    Failed,    // not accepted after all the attempts
+}
+
+impl DeliveryStatus {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            DeliveryStatus::Pending => "pending",
+            DeliveryStatus::Delivered => "delivered",
+            DeliveryStatus::Failed => "failed",
+        }
+    }
+
+    pub fn from_str(status: &str) -> Option<Self> {
+        match status {
+            "pending" => Some(DeliveryStatus::Pending),
+            "delivered" => Some(DeliveryStatus::Delivered),
+            "failed" => Some(DeliveryStatus::Failed),
+            _ => None,
+        }
+    }
+}
+
+/// A notification of an event to a webhook, along with the log of its attempts
+#[derive(Clone)]
+pub struct Delivery {
+    pub(super) id: i32,
+    pub(super) webhook: i32,
+    pub(super) event: String,      // the id of the event being notified
+    pub(super) topic: String,
+    pub(super) payload: String,    // the body, so every attempt posts the very same content
+    pub(super) status: DeliveryStatus,
+    pub(super) attempts: i32,
+    pub(super) response: i32,      // status code of the latest response, zero if none
+    pub(super) error: String,      // why the latest attempt failed, if it did
+    pub(super) next_at: SystemTime,
+    pub(super) meta: InnerMetadata,
+}
+
+impl Delivery {
+    pub fn new(webhook: &Webhook, topic: &str, event: &Event) -> Self {
+        let payload = serde_json::json!({
+            "id": event.get_id(),
+            "type": topic,
+            "created_at": unix_timestamp(event.get_created_at()),
+            "data": event.to_json(),
+        });
+
+        Delivery {
+            id: 0,
+            webhook: webhook.id,
+            event: event.get_id().to_string(),
+            topic: topic.to_string(),
+            payload: payload.to_string(),
+            status: DeliveryStatus::Pending,
+            attempts: 0,
+            response: 0,
+            error: "".to_string(),
+            next_at: time::now(),
+            meta: InnerMetadata::new(),
+        }
+    }
+
+    /// Same as new, but the delivery posts the given security event token rather than the json of the event, as
+    /// webhooks receiving security events do
+    pub fn new_security_event(webhook: &Webhook, topic: &str, event: &Event, token: &str) -> Self {
+        let mut delivery = Delivery::new(webhook, topic, event);
+        delivery.payload = token.to_string();
+        delivery
+    }
+
+    /// Same as new, but the delivery tells the account of the given user as well, as left by the lifecycle transition
+    /// the topic stands for
+    pub fn new_lifecycle(webhook: &Webhook, topic: &str, event: &Event, user: &User) -> Self {
+        let mut delivery = Delivery::new(webhook, topic, event);
+        if let Ok(mut payload) = serde_json::from_str::<serde_json::Value>(&delivery.payload) {
+            payload["user"] = export_user(user, topic);
+            delivery.payload = payload.to_string();
+        }
+
+        delivery
+    }
+
+    /// Same as new, but the delivery tells why the sessions have come to an end as well, if known, by its
+    /// logout_reason
+    pub fn new_logout(webhook: &Webhook, topic: &str, event: &Event) -> Self {
+        let mut delivery = Delivery::new(webhook, topic, event);
+        let reason = match get_logout_reason(event) {
+            Some(reason) => reason,
+            None => return delivery,
+        };
+
+        if let Ok(mut payload) = serde_json::from_str::<serde_json::Value>(&delivery.payload) {
+            payload["logout_reason"] = reason.as_str().into();
+            delivery.payload = payload.to_string();
+        }
+
+        delivery
+    }
+
+    /// Returns a brand new delivery of the very same content, to be attempted right away no matter how this one went.
+    /// It tells the same event, so endpoints deduplicating deliveries by it get to know it has been replayed
+    pub fn replay(&self) -> Self {
+        Delivery {
+            id: 0,
+            webhook: self.webhook,
+            event: self.event.clone(),
+            topic: self.topic.clone(),
+            payload: self.payload.clone(),
+            status: DeliveryStatus::Pending,
+            attempts: 0,
+            response: 0,
+            error: "".to_string(),
+            next_at: time::now(),
+            meta: InnerMetadata::new(),
+        }
+    }
+
+    pub fn get_id(&self) -> i32 {
+        self.id
+    }
+
+    pub fn get_webhook(&self) -> i32 {
+        self.webhook
+    }
+
+    pub fn get_event(&self) -> &str {
+        &self.event
+    }
+
+    pub fn get_topic(&self) -> &str {
+        &self.topic
+    }
+
+    pub fn get_payload(&self) -> &str {
+        &self.payload
+    }
+
+    pub fn get_status(&self) -> DeliveryStatus {
+        self.status
+    }
+
+    pub fn get_attempts(&self) -> i32 {
+        self.attempts
+    }
+
+    pub fn get_response(&self) -> i32 {
+        self.response
+    }
+
+    pub fn get_error(&self) -> &str {
+        &self.error
+    }
+
+    pub fn get_created_at(&self) -> SystemTime {
+        self.meta.created_at
+    }
+
+    pub fn get_touch_at(&self) -> SystemTime {
+        self.meta.touch_at
+    }
+
+    /// Records the outcome of an attempt: any 2xx response delivers the notification, otherwise the next attempt is
+    /// scheduled twice as late as the previous one, until no attempt is left
+    pub fn record(&mut self, outcome: Result<u16, Box<dyn Error>>) {
+        self.attempts += 1;
+        self.meta.touch();
+
+        let (response, error) = match outcome {
+            Ok(code) if (200..300).contains(&code) => (code as i32, "".to_string()),
+            Ok(code) => (code as i32, format!("unexpected status {}", code)),
+            Err(err) => (0, err.to_string()),
+        };
+
+        let error: String = error.chars().take(settings::WEBHOOK_ERROR_LEN).collect();
+
+        self.response = response;
+        self.error = error;
+        if self.error.len() == 0 {
+            self.status = DeliveryStatus::Delivered;
+        } else if self.attempts >= settings::WEBHOOK_MAX_ATTEMPTS {
+            self.status = DeliveryStatus::Failed;
+        } else {
+            let backoff = settings::WEBHOOK_BACKOFF * 2_u64.pow(self.attempts as u32 - 1);
+            self.next_at = time::now() + Duration::from_secs(backoff);
+        }
+    }
+}
+
+
+#[cfg(test)]
+pub mod tests {
+    use std::time::SystemTime;
+    use crate::metadata::domain::tests::new_metadata;
+    use crate::audit::domain::{Event, EventKind};
+    use crate::constants::settings;
+    use crate::user::domain::tests::new_user;
+    use crate::session::domain::LogoutReason;
+    use super::{Webhook, Delivery, DeliveryStatus, Format, SecurityEventToken, USER_SCHEMA_VERSION};
+    use super::{get_topics, get_event_type, is_lifecycle, is_logout, export_user, sign};
+
+    pub fn new_webhook() -> Webhook {
+        Webhook{
+            id: 999,
+            tenant: 1,
+            url: "https://example.com/hooks".to_string(),
+            secret: "secret".to_string(),
+            topics: vec!["user.created".to_string(), "login.failed".to_string()],
+            format: Format::Json,
+            meta: new_metadata(),
+        }
+    }
+
+    #[test]
+    fn webhook_new_should_not_fail() {
+        let topics = vec!["session.revoked".to_string()];
+        let webhook = Webhook::new(new_metadata(), 1, "https://example.com/hooks", &topics, Format::Json).unwrap();
+
+        assert_eq!(0, webhook.id);
+        assert_eq!(1, webhook.tenant);
+        assert_eq!("https://example.com/hooks", webhook.url);
+        assert_eq!(settings::WEBHOOK_SECRET_LEN, webhook.secret.len());
+        assert!(webhook.is_subscribed("session.revoked"));
+        assert!(!webhook.is_subscribed("user.created"));
+        assert_eq!(Format::Json, webhook.format);
+
+        let topics = vec!["session.revoked".to_string(), "account.disabled".to_string()];
+        let webhook = Webhook::new(new_metadata(), 1, "https://example.com/events", &topics, Format::SecurityEvent);
+        assert_eq!(Format::SecurityEvent, webhook.unwrap().format);
+    }
+
+    #[test]
+    fn webhook_new_should_fail() {
+        let topics = vec!["session.revoked".to_string()];
+        assert!(Webhook::new(new_metadata(), 1, "not an url", &topics, Format::Json).is_err());
+        assert!(Webhook::new(new_metadata(), 1, "ftp://example.com/hooks", &topics, Format::Json).is_err());
+        assert!(Webhook::new(new_metadata(), 1, "https://example.com/hooks", &[], Format::Json).is_err());
+        assert!(Webhook::new(new_metadata(), 1, "https://example.com/hooks", &["user.deleted".to_string()],
+                             Format::Json).is_err());
+
+        // there is no security event standing for a signup
+        assert!(Webhook::new(new_metadata(), 1, "https://example.com/events", &["user.created".to_string()],
+                             Format::SecurityEvent).is_err());
+    }
+
+    #[test]
+    fn format_from_str_should_not_fail() {
+        for format in &[Format::Json, Format::SecurityEvent] {
+            assert_eq!(Some(*format), Format::from_str(format.as_str()));
+        }
+
+        assert_eq!(None, Format::from_str("xml"));
+    }
+
+    #[test]
+    fn get_event_type_should_not_fail() {
+        const CAEP: &str = "https://schemas.openid.net/secevent/caep/event-type/";
+        assert_eq!(Some(format!("{}session-revoked", CAEP)), get_event_type("session.revoked"));
+        assert_eq!(Some(format!("{}session-revoked", CAEP)), get_event_type("session.logged_out_everywhere"));
+        assert_eq!(Some(format!("{}session-revoked", CAEP)), get_event_type("session.logged_out"));
+        assert_eq!(Some(format!("{}credential-change", CAEP)), get_event_type("credential.changed"));
+        assert_eq!(Some("https://schemas.openid.net/secevent/risc/event-type/account-disabled".to_string()),
+                   get_event_type("account.disabled"));
+        assert_eq!(None, get_event_type("user.created"));
+    }
+
+    #[test]
+    fn security_event_token_new_should_not_fail() {
+        let webhook = new_webhook();
+        let event = Event::new(1, 1, EventKind::PasswordReset, "");
+        let claim = SecurityEventToken::new(&webhook, "tpauth.alvidir.com", "alice@example.com", "credential.changed",
+                                            &event).unwrap();
+
+        assert_eq!("tpauth.alvidir.com", claim.iss);
+        assert_eq!(event.get_id(), claim.jti);
+        assert_eq!(webhook.url, claim.aud);
+        assert_eq!("email", claim.sub_id["format"]);
+        assert_eq!("alice@example.com", claim.sub_id["email"]);
+
+        let change = &claim.events["https://schemas.openid.net/secevent/caep/event-type/credential-change"];
+        assert_eq!("password", change["credential_type"]);
+        assert_eq!("update", change["change_type"]);
+        assert_eq!(claim.iat as u64, change["event_timestamp"].as_u64().unwrap());
+
+        let event = Event::new(1, 1, EventKind::Signup, "");
+        assert!(SecurityEventToken::new(&webhook, "", "alice@example.com", "user.created", &event).is_err());
+    }
+
+    #[test]
+    fn security_event_token_new_logout_should_not_fail() {
+        let event = Event::new(1, 2, EventKind::Revoke, "admin: leaving the company");
+        let claim = SecurityEventToken::new(&new_webhook(), "tpauth.alvidir.com", "alice@example.com",
+                                            "session.revoked", &event).unwrap();
+
+        let revoked = &claim.events["https://schemas.openid.net/secevent/caep/event-type/session-revoked"];
+        assert_eq!("admin: leaving the company", revoked["reason_admin"]["en"]);
+        assert_eq!(LogoutReason::Admin.get_message(), revoked["reason_user"]["en"]);
+    }
+
+    #[test]
+    fn delivery_new_security_event_should_not_fail() {
+        let event = Event::new(1, 1, EventKind::Suspend, "");
+        let delivery = Delivery::new_security_event(&new_webhook(), "account.disabled", &event, "a.b.c");
+        assert_eq!("a.b.c", delivery.payload);
+        assert_eq!("account.disabled", delivery.topic);
+        assert_eq!(DeliveryStatus::Pending, delivery.status);
+    }
+
+    #[test]
+    fn get_topics_should_not_fail() {
+        assert_eq!(vec!["user.created"], get_topics(EventKind::Signup));
+        assert_eq!(vec!["consent.granted"], get_topics(EventKind::Consent));
+        assert_eq!(vec!["user.suspended", "account.disabled"], get_topics(EventKind::Suspend));
+        assert_eq!(vec!["session.logged_out"], get_topics(EventKind::Logout));
+        assert!(get_topics(EventKind::Login).is_empty());
+    }
+
+    #[test]
+    fn sign_should_not_fail() {
+        // echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+        let signature = sign("secret", 1700000000, "{}").unwrap();
+        assert_eq!("b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163", signature);
+        assert_ne!(signature, sign("another", 1700000000, "{}").unwrap());
+        assert_ne!(signature, sign("secret", 1700000001, "{}").unwrap());
+    }
+
+    #[test]
+    fn delivery_new_should_not_fail() {
+        let webhook = new_webhook();
+        let event = Event::new(1, 1, EventKind::Signup, "");
+        let delivery = Delivery::new(&webhook, "user.created", &event);
+
+        assert_eq!(webhook.id, delivery.webhook);
+        assert_eq!("user.created", delivery.topic);
+        assert_eq!(DeliveryStatus::Pending, delivery.status);
+        assert_eq!(0, delivery.attempts);
+        assert!(delivery.next_at <= SystemTime::now());
+
+        let payload: serde_json::Value = serde_json::from_str(&delivery.payload).unwrap();
+        assert_eq!("user.created", payload["type"]);
+        assert_eq!("signup", payload["data"]["kind"]);
+    }
+
+    #[test]
+    fn is_lifecycle_should_not_fail() {
+        assert!(is_lifecycle("user.created"));
+        assert!(is_lifecycle("user.erased"));
+        assert!(!is_lifecycle("account.disabled"));
+        assert!(!is_lifecycle("login.failed"));
+    }
+
+    #[test]
+    fn is_logout_should_not_fail() {
+        assert!(is_logout("session.logged_out"));
+        assert!(is_logout("session.logged_out_everywhere"));
+        assert!(!is_logout("user.suspended"));
+    }
+
+    #[test]
+    fn delivery_new_logout_should_not_fail() {
+        let event = Event::new(1, 1, EventKind::GlobalLogout, "security: credential_reuse");
+        let delivery = Delivery::new_logout(&new_webhook(), "session.logged_out_everywhere", &event);
+
+        let payload: serde_json::Value = serde_json::from_str(&delivery.payload).unwrap();
+        assert_eq!("session.logged_out_everywhere", payload["type"]);
+        assert_eq!("security", payload["logout_reason"]);
+
+        // events recorded before reasons were told have none
+        let event = Event::new(1, 1, EventKind::Logout, "https://app.example.com");
+        let delivery = Delivery::new_logout(&new_webhook(), "session.logged_out", &event);
+        let payload: serde_json::Value = serde_json::from_str(&delivery.payload).unwrap();
+        assert!(payload["logout_reason"].is_null());
+    }
+
+    #[test]
+    fn export_user_should_not_fail() {
+        let user = new_user();
+        let json = export_user(&user, "user.created");
+        assert_eq!(USER_SCHEMA_VERSION as u64, json["version"].as_u64().unwrap());
+        assert_eq!(999, json["id"].as_i64().unwrap());
+        assert_eq!("dummy@test.com", json["email"]);
+        assert_eq!(false, json["verified"]);
+        assert_eq!("active", json["state"]);
+        assert_eq!("erased", export_user(&user, "user.erased")["state"]);
+    }
+
+    #[test]
+    fn export_user_should_match_schema() {
+        let schema: serde_json::Value = serde_json::from_str(include_str!("../../schemas/user.v1.json")).unwrap();
+        assert_eq!(USER_SCHEMA_VERSION as u64, schema["properties"]["version"]["const"].as_u64().unwrap());
+
+        let json = export_user(&new_user(), "user.created");
+        let properties = schema["properties"].as_object().unwrap();
+        assert_eq!(properties.len(), json.as_object().unwrap().len());
+        for field in schema["required"].as_array().unwrap() {
+            assert!(!json[field.as_str().unwrap()].is_null(), "{} is missing", field);
+        }
+    }
+
+    #[test]
+    fn delivery_new_lifecycle_should_not_fail() {
+        let webhook = new_webhook();
+        let event = Event::new(999, 999, EventKind::Verify, "");
+        let delivery = Delivery::new_lifecycle(&webhook, "user.verified", &event, &new_user());
+
+        let payload: serde_json::Value = serde_json::from_str(&delivery.payload).unwrap();
+        assert_eq!("user.verified", payload["type"]);
+        assert_eq!("verify", payload["data"]["kind"]);
+        assert_eq!(999, payload["user"]["id"].as_i64().unwrap());
+        assert_eq!("active", payload["user"]["state"]);
+    }
+
+    #[test]
+    fn delivery_replay_should_not_fail() {
+        let event = Event::new(1, 1, EventKind::Signup, "");
+        let mut delivery = Delivery::new(&new_webhook(), "user.created", &event);
+        delivery.id = 10;
+        for _ in 0..settings::WEBHOOK_MAX_ATTEMPTS {
+            delivery.record(Err("connection refused".into()));
+        }
+
+        let replay = delivery.replay();
+        assert_eq!(0, replay.id);
+        assert_eq!(delivery.webhook, replay.webhook);
+        assert_eq!(delivery.event, replay.event);
+        assert_eq!(delivery.payload, replay.payload);
+        assert_eq!(DeliveryStatus::Pending, replay.status);
+        assert_eq!(0, replay.attempts);
+        assert_eq!("", replay.error);
+    }
+
+    #[test]
+    fn delivery_record_should_not_fail() {
+        let event = Event::new(1, 1, EventKind::Signup, "");
+        let mut delivery = Delivery::new(&new_webhook(), "user.created", &event);
+
+        delivery.record(Ok(500));
+        assert_eq!(DeliveryStatus::Pending, delivery.status);
+        assert_eq!(1, delivery.attempts);
+        assert_eq!(500, delivery.response);
+        assert!(delivery.next_at > SystemTime::now());
+
+        delivery.record(Ok(204));
+        assert_eq!(DeliveryStatus::Delivered, delivery.status);
+        assert_eq!(2, delivery.attempts);
+        assert_eq!("", delivery.error);
+    }
+
+    #[test]
+    fn delivery_record_should_fail() {
+        let event = Event::new(1, 1, EventKind::Signup, "");
+        let mut delivery = Delivery::new(&new_webhook(), "user.created", &event);
+
+        for _ in 0..settings::WEBHOOK_MAX_ATTEMPTS {
+            delivery.record(Err("connection refused".into()));
+        }
+
+        assert_eq!(DeliveryStatus::Failed, delivery.status);
+        assert_eq!("connection refused", delivery.error);
+    }
+}
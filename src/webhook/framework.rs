@@ -0,0 +1,419 @@
+use std::error::Error;
+use std::time::{SystemTime, Duration};
+use diesel::NotFound;
+use diesel::result::Error as PgError;
+
+use crate::diesel::prelude::*;
+use crate::postgres::*;
+use crate::memory;
+use crate::schema::{webhooks, deliveries};
+use crate::constants::{settings, errors};
+use crate::metadata::domain::InnerMetadata;
+use crate::time::{self, unix_timestamp};
+
+use crate::metadata::{
+    get_repository as get_meta_repository,
+    framework::PostgresMetadataRepository,
+};
+
+use super::domain::{
+    Webhook, Delivery, DeliveryStatus, Format, sign,
+    WebhookRepository, DeliveryRepository, DeliverySender,
+};
+
+const SIGNATURE_HEADER: &str = "X-Tpauth-Signature";
+const TOPIC_HEADER: &str = "X-Tpauth-Event";
+const DELIVERY_HEADER: &str = "X-Tpauth-Delivery";
+const TOPIC_SEPARATOR: &str = ",";
+const JSON_CONTENT_TYPE: &str = "application/json";
+const SECURITY_EVENT_CONTENT_TYPE: &str = "application/secevent+jwt";
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(Clone)]
+#[table_name = "webhooks"]
+struct PostgresWebhook {
+    pub id: i32,
+    pub tenant_id: i32,
+    pub url: String,
+    pub secret: String,
+    pub topics: String,
+    pub meta_id: i32,
+    pub format: String,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "webhooks"]
+struct NewPostgresWebhook<'a> {
+    pub tenant_id: i32,
+    pub url: &'a str,
+    pub secret: &'a str,
+    pub topics: &'a str,
+    pub meta_id: i32,
+    pub format: &'a str,
+}
+
+pub struct PostgresWebhookRepository;
+
+impl PostgresWebhookRepository {
+    fn create_on_conn(conn: &PgConnection, webhook: &mut Webhook) -> Result<(), PgError>  {
+        // in order to create a webhook it must exists the metadata for this webhook
+        PostgresMetadataRepository::create_on_conn(conn, &mut webhook.meta)?;
+
+        let topics = webhook.topics.join(TOPIC_SEPARATOR);
+        let new_webhook = NewPostgresWebhook {
+            tenant_id: webhook.tenant,
+            url: &webhook.url,
+            secret: &webhook.secret,
+            topics: &topics,
+            meta_id: webhook.meta.get_id(),
+            format: webhook.format.as_str(),
+        };
+
+        let result = diesel::insert_into(webhooks::table)
+            .values(&new_webhook)
+            .get_result::<PostgresWebhook>(conn)?;
+
+        webhook.id = result.id;
+        Ok(())
+    }
+
+    fn delete_on_conn(conn: &PgConnection, webhook: &Webhook) -> Result<(), PgError>  {
+        // the delivery log of the webhook gets removed along with it
+        let _result = diesel::delete(
+            webhooks::table.filter(webhooks::id.eq(webhook.id))
+        ).execute(conn)?;
+
+        PostgresMetadataRepository::delete_on_conn(conn, &webhook.meta)?;
+        Ok(())
+    }
+
+    fn build(result: &PostgresWebhook) -> Result<Webhook, Box<dyn Error>> {
+        let meta = get_meta_repository().find(result.meta_id)?;
+        Ok(Webhook{
+            id: result.id,
+            tenant: result.tenant_id,
+            url: result.url.clone(),
+            secret: result.secret.clone(),
+            topics: result.topics.split(TOPIC_SEPARATOR).map(str::to_string).collect(),
+            format: Format::from_str(&result.format).unwrap_or(Format::Json),
+            meta: meta,
+        })
+    }
+}
+
+impl WebhookRepository for PostgresWebhookRepository {
+    fn find(&self, target: i32) -> Result<Webhook, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            webhooks::table.filter(webhooks::id.eq(target))
+                           .load::<PostgresWebhook>(&connection)?
+        };
+
+        if results.len() == 0 {
+            return Err(Box::new(NotFound));
+        }
+
+        PostgresWebhookRepository::build(&results[0])
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<Webhook>, Box<dyn Error>>  {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            webhooks::table.filter(webhooks::tenant_id.eq(target))
+                           .order(webhooks::id.asc())
+                           .load::<PostgresWebhook>(&connection)?
+        };
+
+        let mut all_webhooks = Vec::new();
+        for result in results.iter() {
+            all_webhooks.push(PostgresWebhookRepository::build(result)?);
+        }
+
+        Ok(all_webhooks)
+    }
+
+    fn create(&self, webhook: &mut Webhook) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresWebhookRepository::create_on_conn(&conn, webhook))?;
+        Ok(())
+    }
+
+    fn delete(&self, webhook: &Webhook) -> Result<(), Box<dyn Error>> {
+        let conn = get_connection().get()?;
+        conn.transaction::<_, PgError, _>(|| PostgresWebhookRepository::delete_on_conn(&conn, webhook))?;
+        Ok(())
+    }
+}
+
+#[derive(Queryable, Insertable, Associations)]
+#[derive(Identifiable)]
+#[derive(AsChangeset)]
+#[derive(Clone)]
+#[table_name = "deliveries"]
+struct PostgresDelivery {
+    pub id: i32,
+    pub webhook_id: i32,
+    pub event_id: String,
+    pub topic: String,
+    pub payload: String,
+    pub status: String,
+    pub attempts: i32,
+    pub response: i32,
+    pub error: String,
+    pub next_at: SystemTime,
+    pub created_at: SystemTime,
+    pub touch_at: SystemTime,
+}
+
+#[derive(Insertable)]
+#[derive(Clone)]
+#[table_name = "deliveries"]
+struct NewPostgresDelivery<'a> {
+    pub webhook_id: i32,
+    pub event_id: &'a str,
+    pub topic: &'a str,
+    pub payload: &'a str,
+    pub status: &'a str,
+    pub next_at: SystemTime,
+    pub created_at: SystemTime,
+    pub touch_at: SystemTime,
+}
+
+pub struct PostgresDeliveryRepository;
+
+impl PostgresDeliveryRepository {
+    fn build(result: &PostgresDelivery) -> Result<Delivery, Box<dyn Error>> {
+        let status = match DeliveryStatus::from_str(&result.status) {
+            Some(status) => status,
+            None => return Err(errors::PARSE_FAILED.into()),
+        };
+
+        Ok(Delivery {
+            id: result.id,
+            webhook: result.webhook_id,
+            event: result.event_id.clone(),
+            topic: result.topic.clone(),
+            payload: result.payload.clone(),
+            status: status,
+            attempts: result.attempts,
+            response: result.response,
+            error: result.error.clone(),
+            next_at: result.next_at,
+            meta: InnerMetadata {
+                created_at: result.created_at,
+                touch_at: result.touch_at,
+            },
+        })
+    }
+
+    fn build_all(results: &[PostgresDelivery]) -> Result<Vec<Delivery>, Box<dyn Error>> {
+        let mut all_deliveries = Vec::new();
+        for result in results.iter() {
+            all_deliveries.push(PostgresDeliveryRepository::build(result)?);
+        }
+
+        Ok(all_deliveries)
+    }
+}
+
+impl DeliveryRepository for PostgresDeliveryRepository {
+    fn find_by_webhook(&self, target: i32, before: i32, limit: u64) -> Result<Vec<Delivery>, Box<dyn Error>> {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            match before {
+                0 => deliveries::table.filter(deliveries::webhook_id.eq(target))
+                                      .order(deliveries::id.desc())
+                                      .limit(limit as i64)
+                                      .load::<PostgresDelivery>(&connection)?,
+                _ => deliveries::table.filter(deliveries::webhook_id.eq(target))
+                                      .filter(deliveries::id.lt(before))
+                                      .order(deliveries::id.desc())
+                                      .limit(limit as i64)
+                                      .load::<PostgresDelivery>(&connection)?,
+            }
+        };
+
+        PostgresDeliveryRepository::build_all(&results)
+    }
+
+    fn find_due(&self, limit: u64) -> Result<Vec<Delivery>, Box<dyn Error>> {
+        let results = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            deliveries::table.filter(deliveries::status.eq(DeliveryStatus::Pending.as_str()))
+                             .filter(deliveries::next_at.le(time::now()))
+                             .order(deliveries::next_at.asc())
+                             .limit(limit as i64)
+                             .load::<PostgresDelivery>(&connection)?
+        };
+
+        PostgresDeliveryRepository::build_all(&results)
+    }
+
+    fn create(&self, delivery: &mut Delivery) -> Result<(), Box<dyn Error>> {
+        let new_delivery = NewPostgresDelivery {
+            webhook_id: delivery.webhook,
+            event_id: &delivery.event,
+            topic: &delivery.topic,
+            payload: &delivery.payload,
+            status: delivery.status.as_str(),
+            next_at: delivery.next_at,
+            created_at: delivery.meta.created_at,
+            touch_at: delivery.meta.touch_at,
+        };
+
+        let result = { // block is required because of connection release
+            let connection = get_connection().get()?;
+            diesel::insert_into(deliveries::table)
+                .values(&new_delivery)
+                .get_result::<PostgresDelivery>(&connection)?
+        };
+
+        delivery.id = result.id;
+        Ok(())
+    }
+
+    fn save(&self, delivery: &Delivery) -> Result<(), Box<dyn Error>> {
+        let pg_delivery = PostgresDelivery {
+            id: delivery.id,
+            webhook_id: delivery.webhook,
+            event_id: delivery.event.clone(),
+            topic: delivery.topic.clone(),
+            payload: delivery.payload.clone(),
+            status: delivery.status.as_str().to_string(),
+            attempts: delivery.attempts,
+            response: delivery.response,
+            error: delivery.error.clone(),
+            next_at: delivery.next_at,
+            created_at: delivery.meta.created_at,
+            touch_at: delivery.meta.touch_at,
+        };
+
+        let connection = get_connection().get()?;
+        diesel::update(deliveries::table)
+            .filter(deliveries::id.eq(delivery.id))
+            .set(&pg_delivery)
+            .execute(&connection)?;
+
+        Ok(())
+    }
+}
+
+
+pub struct InMemoryWebhookRepository {
+    table: memory::Table<Webhook>,
+}
+
+impl InMemoryWebhookRepository {
+    pub fn new() -> Self {
+        InMemoryWebhookRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl WebhookRepository for InMemoryWebhookRepository {
+    fn find(&self, target: i32) -> Result<Webhook, Box<dyn Error>>  {
+        self.table.find(target)
+    }
+
+    fn find_all_by_tenant(&self, target: i32) -> Result<Vec<Webhook>, Box<dyn Error>>  {
+        self.table.find_all(|webhook| webhook.tenant == target)
+    }
+
+    fn create(&self, webhook: &mut Webhook) -> Result<(), Box<dyn Error>> {
+        // in order to create a webhook it must exists the metadata for this webhook
+        get_meta_repository().create(&mut webhook.meta)?;
+        self.table.insert(webhook, |_| false, |webhook, new_id| webhook.id = new_id)
+    }
+
+    fn delete(&self, webhook: &Webhook) -> Result<(), Box<dyn Error>> {
+        // pending deliveries of the webhook fail by themselves once they find it gone
+        self.table.delete(webhook.id)?;
+        get_meta_repository().delete(&webhook.meta)
+    }
+}
+
+pub struct InMemoryDeliveryRepository {
+    table: memory::Table<Delivery>,
+}
+
+impl InMemoryDeliveryRepository {
+    pub fn new() -> Self {
+        InMemoryDeliveryRepository {
+            table: memory::Table::new(),
+        }
+    }
+}
+
+impl DeliveryRepository for InMemoryDeliveryRepository {
+    fn find_by_webhook(&self, target: i32, before: i32, limit: u64) -> Result<Vec<Delivery>, Box<dyn Error>> {
+        // rows are sorted by id, so reversing them keeps the latest delivery on top
+        let mut all_deliveries = self.table.find_all(|delivery| delivery.webhook == target &&
+                                                                (before == 0 || delivery.id < before))?;
+        all_deliveries.reverse();
+        Ok(all_deliveries.into_iter().take(limit as usize).collect())
+    }
+
+    fn find_due(&self, limit: u64) -> Result<Vec<Delivery>, Box<dyn Error>> {
+        let now = time::now();
+        let mut due = self.table.find_all(|delivery| delivery.status == DeliveryStatus::Pending && delivery.next_at <= now)?;
+        due.sort_by_key(|delivery| delivery.next_at);
+        due.truncate(limit as usize);
+        Ok(due)
+    }
+
+    fn create(&self, delivery: &mut Delivery) -> Result<(), Box<dyn Error>> {
+        self.table.insert(delivery, |_| false, |delivery, new_id| delivery.id = new_id)
+    }
+
+    fn save(&self, delivery: &Delivery) -> Result<(), Box<dyn Error>> {
+        self.table.update(delivery.id, delivery)
+    }
+}
+
+
+/// Posts every delivery to the url of its webhook, signed by the secret of the webhook. Any response is told by its
+/// status code, so the delivery log keeps track of it, while only transport failures are returned as errors
+pub struct HttpDeliverySender {
+    agent: ureq::Agent,
+}
+
+impl HttpDeliverySender {
+    pub fn new() -> Self {
+        HttpDeliverySender {
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(settings::WEBHOOK_TIMEOUT))
+                .redirects(0) // the endpoint is the registered one, not any other it may point to
+                .build(),
+        }
+    }
+}
+
+impl DeliverySender for HttpDeliverySender {
+    fn send(&self, webhook: &Webhook, delivery: &Delivery) -> Result<u16, Box<dyn Error>> {
+        let timestamp = unix_timestamp(time::now());
+        let signature = sign(&webhook.secret, timestamp, &delivery.payload)?;
+
+        // security event tokens are told apart by their media type, while any error the receiver replies with is json
+        let content_type = match webhook.format {
+            Format::Json => JSON_CONTENT_TYPE,
+            Format::SecurityEvent => SECURITY_EVENT_CONTENT_TYPE,
+        };
+
+        let result = self.agent.post(&webhook.url)
+            .set("Content-Type", content_type)
+            .set("Accept", JSON_CONTENT_TYPE)
+            .set(SIGNATURE_HEADER, &format!("t={},v1={}", timestamp, signature))
+            .set(TOPIC_HEADER, &delivery.topic)
+            .set(DELIVERY_HEADER, &delivery.id.to_string())
+            .send_string(&delivery.payload);
+
+        match result {
+            Ok(response) => Ok(response.status()),
+            Err(ureq::Error::Status(code, _)) => Ok(code),
+            Err(err) => Err(err.into()),
+        }
+    }
+}
@@ -0,0 +1,39 @@
+pub mod framework;
+pub mod application;
+pub mod domain;
+
+use crate::storage::{self, Backend};
+
+lazy_static! {
+    static ref REPO_PROVIDER: Box<dyn domain::WebhookRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresWebhookRepository),
+            Backend::Memory => Box::new(framework::InMemoryWebhookRepository::new()),
+            backend => storage::unsupported(backend, "webhooks"),
+        }
+    };
+
+    static ref DELIVERY_REPO_PROVIDER: Box<dyn domain::DeliveryRepository + Sync + Send> = {
+        match storage::get_backend(Backend::Postgres) {
+            Backend::Postgres => Box::new(framework::PostgresDeliveryRepository),
+            Backend::Memory => Box::new(framework::InMemoryDeliveryRepository::new()),
+            backend => storage::unsupported(backend, "webhook deliveries"),
+        }
+    };
+
+    static ref SENDER_PROVIDER: Box<dyn domain::DeliverySender + Sync + Send> = {
+        Box::new(framework::HttpDeliverySender::new())
+    };
+}
+
+pub fn get_repository() -> Box<&'static dyn domain::WebhookRepository> {
+    Box::new(&**REPO_PROVIDER)
+}
+
+pub fn get_delivery_repository() -> Box<&'static dyn domain::DeliveryRepository> {
+    Box::new(&**DELIVERY_REPO_PROVIDER)
+}
+
+pub fn get_sender() -> Box<&'static dyn domain::DeliverySender> {
+    Box::new(&**SENDER_PROVIDER)
+}
@@ -0,0 +1,145 @@
+//! End-to-end tests: every test runs the service against brand new datastores and goes through its flows as any
+//! client would, over grpc. They require docker (or any compatible cli, as told by DOCKER), so they only build with
+//! the integration-tests feature (e.g. `make e2e-tests`).
+
+mod harness;
+
+use std::collections::HashSet;
+use tonic::Request;
+use tonic::metadata::MetadataValue;
+use tonic::transport::Channel;
+use tpauth::client::Client;
+use harness::{App, Server};
+
+mod proto {
+    pub mod user {
+        tonic::include_proto!("user");
+    }
+
+    pub mod app {
+        tonic::include_proto!("app");
+    }
+}
+
+use proto::user::user_service_client::UserServiceClient;
+use proto::user::SignupRequest;
+use proto::app::app_service_client::AppServiceClient;
+use proto::app::RegisterRequest;
+
+const APP_URL: &str = "http://e2e.tpauth";
+const PASSWORD: &str = "936a185caaa266bb9cbe981e9e05cb78cd732b0b3280eb944412bb6f8f8f07af";
+
+type Result<T> = std::result::Result<T, Box<dyn std::error::Error>>;
+
+async fn register_app(server: &Server, url: &str) -> Result<App> {
+    let app = App::new(url)?;
+    let firm = app.sign(&[url.as_bytes(), &app.public])?;
+    let mut client = AppServiceClient::connect(server.get_url()).await?;
+    client.register(RegisterRequest {
+        url: url.to_string(),
+        public: app.public.clone(),
+        firm: firm,
+    }).await?;
+
+    Ok(app)
+}
+
+/// Signs up the given user, and verifies it by the token of the verification email
+async fn signup(server: &Server, users: &mut UserServiceClient<Channel>, email: &str) -> Result<()> {
+    users.signup(SignupRequest {
+        email: email.to_string(),
+        pwd: PASSWORD.to_string(),
+        ..Default::default()
+    }).await?;
+
+    let token = server.wait_for_email(email)?;
+    let mut request = Request::new(());
+    request.metadata_mut().insert("token", MetadataValue::from_str(&token)?);
+    users.verify(request).await?;
+    Ok(())
+}
+
+#[tokio::test]
+async fn signup_login_refresh_logout_should_not_fail() -> Result<()> {
+    let server = Server::start()?;
+    let app = register_app(&server, APP_URL).await?;
+    let mut users = UserServiceClient::connect(server.get_url()).await?;
+
+    const EMAIL: &str = "signup_login_refresh_logout@e2e.tpauth";
+    signup(&server, &mut users, EMAIL).await?;
+
+    let client = Client::new(&server.get_url())?;
+    client.login(EMAIL, PASSWORD, "", &app.url).await?;
+    let first = client.token().await?;
+    let introspection = client.validate(&first).await?;
+    assert!(introspection.user > 0);
+    assert!(!introspection.elevated);
+
+    // refreshing keeps the very same session, by a brand new token
+    client.refresh().await?;
+    let second = client.token().await?;
+    assert_ne!(first, second);
+    assert_eq!(introspection, client.validate(&second).await?);
+
+    // once logged out, no token of the session is valid anymore
+    client.logout().await?;
+    assert!(client.validate(&first).await.is_err());
+    assert!(client.validate(&second).await.is_err());
+    assert!(client.token().await.is_err());
+    Ok(())
+}
+
+#[tokio::test]
+async fn login_should_fail() -> Result<()> {
+    let server = Server::start()?;
+    let app = register_app(&server, APP_URL).await?;
+    let mut users = UserServiceClient::connect(server.get_url()).await?;
+
+    const EMAIL: &str = "login_should_fail@e2e.tpauth";
+    users.signup(SignupRequest {
+        email: EMAIL.to_string(),
+        pwd: PASSWORD.to_string(),
+        ..Default::default()
+    }).await?;
+
+    let client = Client::new(&server.get_url())?;
+    assert!(client.login(EMAIL, PASSWORD, "", &app.url).await.is_err(), "unverified users must not log in");
+
+    let token = server.wait_for_email(EMAIL)?;
+    let mut request = Request::new(());
+    request.metadata_mut().insert("token", MetadataValue::from_str(&token)?);
+    users.verify(request).await?;
+
+    let wrong = PASSWORD.replace('9', "8");
+    assert!(client.login(EMAIL, &wrong, "", &app.url).await.is_err());
+    assert!(client.login("nobody@e2e.tpauth", PASSWORD, "", &app.url).await.is_err());
+    assert!(client.login(EMAIL, PASSWORD, "", "http://unknown.e2e.tpauth").await.is_err());
+    assert!(client.refresh().await.is_err(), "no session must be refreshed before logging in");
+    Ok(())
+}
+
+#[tokio::test]
+async fn sessions_should_be_isolated() -> Result<()> {
+    let server = Server::start()?;
+    let app = register_app(&server, APP_URL).await?;
+    let mut users = UserServiceClient::connect(server.get_url()).await?;
+
+    const EMAILS: &[&str] = &["alice@e2e.tpauth", "bob@e2e.tpauth"];
+    let mut ids = HashSet::new();
+    let mut clients = Vec::new();
+    for email in EMAILS {
+        signup(&server, &mut users, email).await?;
+        let client = Client::new(&server.get_url())?;
+        client.login(email, PASSWORD, "", &app.url).await?;
+        ids.insert(client.validate(&client.token().await?).await?.user);
+        clients.push(client);
+    }
+
+    assert_eq!(EMAILS.len(), ids.len());
+
+    // logging out of a session leaves any other as it is
+    let remaining = clients[1].token().await?;
+    clients[0].logout().await?;
+    assert!(clients[1].validate(&remaining).await.is_ok());
+    Ok(())
+}